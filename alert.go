@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// Kinds of alert sinks, the prefixes of -alert values
+const (
+	alertSNS       = "sns:"
+	alertSlack     = "slack:"
+	alertPagerDuty = "pagerduty:"
+	alertWebhook   = "webhook"
+	// pagerDutyEventsURL is the PagerDuty Events API v2
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	// alertTimeout bounds each notification, a slow sink doesn't hold the watch
+	alertTimeout = 30 * time.Second
+)
+
+// alertSink is where alerts go: an SNS topic, a Slack incoming webhook,
+// a PagerDuty service or any webhook receiving the JSON details
+type alertSink struct {
+	kind   string
+	target string // Topic ARN, webhook URL or PagerDuty routing key
+	sess   *session.Session
+	client *http.Client
+}
+
+// alert is a condition starting or ending
+type alert struct {
+	key      string      // Identifies the condition, so its end resolves the PagerDuty incident
+	summary  string      // One line, the Slack text, SNS subject and PagerDuty summary
+	resolved bool        // The condition ended
+	details  interface{} // Posted to webhooks, published to SNS and attached to PagerDuty events
+}
+
+// alertFlag collects repeated -alert flags
+type alertFlag []string
+
+// watchAlert is the JSON details of a watch threshold crossed, or back under it
+type watchAlert struct {
+	Queue     string `json:"queue"`
+	Check     string `json:"check"` // depth, oldest-age or dlq-arrivals
+	Value     string `json:"value"`
+	Threshold string `json:"threshold"`
+	Resolved  bool   `json:"resolved"`
+	Time      string `json:"time"`
+}
+
+// watchThresholds are the limits watch alerts on
+type watchThresholds struct {
+	maxDepth    int           // Available messages, -1 disables
+	maxAge      time.Duration // Age of the oldest message, 0 disables
+	dlqArrivals int           // Messages reaching the DLQ between two checks, 0 disables
+}
+
+// watchAlerter alerts when queues cross the thresholds, and resolves the alerts once back under
+type watchAlerter struct {
+	thresholds watchThresholds
+	sinks      []*alertSink
+	firing     map[string]bool          // Conditions alerted, by key
+	dlqURLs    map[string]string        // DLQ of each queue, empty without one
+	dlqDepths  map[string]int           // Depth of each DLQ at the previous check
+	ages       map[string]time.Duration // Last oldest message age of each queue
+	ageChecks  map[string]time.Time     // CloudWatch is read once a minute per queue at most
+}
+
+// - - - - - - - - - - - - - - - -
+//   ALERTING
+// - - - - - - - - - - - - - - - -
+
+// parseAlertSink parses sns:TOPIC_ARN, slack:WEBHOOK_URL, pagerduty:ROUTING_KEY or a webhook URL
+func parseAlertSink(value string, sess *session.Session) (*alertSink, error) {
+	sink := &alertSink{sess: sess}
+	switch {
+	case strings.HasPrefix(value, alertSNS):
+		sink.kind, sink.target = alertSNS, value[len(alertSNS):]
+		if a, err := arn.Parse(sink.target); err != nil || a.Service != "sns" {
+			return nil, fmt.Errorf("alert %q: expected sns:arn:aws:sns:REGION:ACCOUNT:TOPIC", value)
+		}
+	case strings.HasPrefix(value, alertSlack):
+		sink.kind, sink.target = alertSlack, value[len(alertSlack):]
+		if !strings.HasPrefix(sink.target, "https://") {
+			return nil, fmt.Errorf("alert %q: expected slack:https://hooks.slack.com/services/...", value)
+		}
+	case strings.HasPrefix(value, alertPagerDuty):
+		sink.kind, sink.target = alertPagerDuty, value[len(alertPagerDuty):]
+		if len(sink.target) == 0 {
+			return nil, fmt.Errorf("alert %q: expected pagerduty:ROUTING_KEY", value)
+		}
+	case strings.HasPrefix(value, "https://") || strings.HasPrefix(value, "http://"):
+		sink.kind, sink.target = alertWebhook, value
+	default:
+		return nil, fmt.Errorf("alert %q: expected sns:TOPIC_ARN, slack:WEBHOOK_URL, pagerduty:ROUTING_KEY or a webhook URL", value)
+	}
+	if sink.kind != alertSNS {
+		client, err := newHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		client.Timeout = alertTimeout
+		sink.client = client
+	}
+	return sink, nil
+}
+
+// send notifies the sink of an alert
+func (s *alertSink) send(a alert) error {
+	details, _ := json.Marshal(a.details)
+	summary := a.summary
+	if a.resolved {
+		summary = "Resolved: " + summary
+	}
+	switch s.kind {
+	case alertSNS:
+		topic, _ := arn.Parse(s.target)
+		subject := summary
+		// SNS subjects are at most 100 characters
+		if len(subject) > 100 {
+			subject = subject[:97] + "..."
+		}
+		_, err := snsClient(s.sess, topic.Region).Publish(&sns.PublishInput{
+			TopicArn: aws.String(s.target),
+			Subject:  aws.String(subject),
+			Message:  aws.String(string(details)),
+		})
+		return err
+	case alertSlack:
+		icon := ":rotating_light:"
+		if a.resolved {
+			icon = ":white_check_mark:"
+		}
+		return s.post(s.target, map[string]string{"text": icon + " " + summary})
+	case alertPagerDuty:
+		event := map[string]interface{}{
+			"routing_key":  s.target,
+			"event_action": "trigger",
+			"dedup_key":    a.key,
+		}
+		if a.resolved {
+			event["event_action"] = "resolve"
+		} else {
+			event["payload"] = map[string]interface{}{
+				"summary":        a.summary,
+				"source":         "sqscli",
+				"severity":       "error",
+				"custom_details": a.details,
+			}
+		}
+		return s.post(pagerDutyEventsURL, event)
+	}
+	return s.post(s.target, a.details)
+}
+
+// post sends a JSON body, an error if it is refused
+func (s *alertSink) post(url string, body interface{}) error {
+	b, _ := json.Marshal(body)
+	resp, err := s.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert refused: %s", resp.Status)
+	}
+	return nil
+}
+
+// newWatchAlerter returns the alerter of watch, nil without thresholds
+func newWatchAlerter(thresholds watchThresholds, sinks []*alertSink) *watchAlerter {
+	if thresholds.maxDepth < 0 && thresholds.maxAge == 0 && thresholds.dlqArrivals == 0 {
+		return nil
+	}
+	return &watchAlerter{
+		thresholds: thresholds,
+		sinks:      sinks,
+		firing:     make(map[string]bool),
+		dlqURLs:    make(map[string]string),
+		dlqDepths:  make(map[string]int),
+		ages:       make(map[string]time.Duration),
+		ageChecks:  make(map[string]time.Time),
+	}
+}
+
+// check compares a queue to the thresholds, attrs being its attributes just read
+func (w *watchAlerter) check(svc *service, qURL string, attrs map[string]*string) {
+	label := svc.queueLabel(qURL)
+	t := w.thresholds
+	if t.maxDepth >= 0 {
+		depth := intAttribute(attrs, "ApproximateNumberOfMessages")
+		w.update(label, "depth", depth > t.maxDepth, strconv.Itoa(depth), strconv.Itoa(t.maxDepth))
+	}
+	if t.maxAge > 0 {
+		if time.Since(w.ageChecks[qURL]) >= time.Minute {
+			w.ageChecks[qURL] = time.Now()
+			if age, ok := svc.oldestMessageAge(queueNameFromURL(qURL)); ok {
+				w.ages[qURL] = age
+			}
+		}
+		if age, ok := w.ages[qURL]; ok {
+			w.update(label, "oldest-age", age > t.maxAge, age.String(), t.maxAge.String())
+		}
+	}
+	if t.dlqArrivals > 0 {
+		dlqURL, ok := w.dlqURLs[qURL]
+		if !ok {
+			q := svc.queueAt(qURL)
+			q.attrs = attrs
+			if dlq := q.deadLetterQueue(); dlq != nil {
+				dlqURL = dlq.url
+			} else {
+				log.Printf("Warning: %s has no DLQ, -dlq-arrivals is ignored\n", label)
+			}
+			w.dlqURLs[qURL] = dlqURL
+		}
+		if len(dlqURL) == 0 {
+			return
+		}
+		depth := intAttribute(svc.getQueueAttributes(dlqURL).Attributes, "ApproximateNumberOfMessages")
+		if previous, ok := w.dlqDepths[qURL]; ok {
+			arrivals := depth - previous
+			if arrivals < 0 {
+				arrivals = 0
+			}
+			w.update(label, "dlq-arrivals", arrivals >= t.dlqArrivals, strconv.Itoa(arrivals), strconv.Itoa(t.dlqArrivals))
+		}
+		w.dlqDepths[qURL] = depth
+	}
+}
+
+// update alerts when a condition starts or ends
+func (w *watchAlerter) update(label, check string, over bool, value, threshold string) {
+	key := label + "/" + check
+	if over == w.firing[key] {
+		return
+	}
+	w.firing[key] = over
+	a := alert{
+		key:      "sqscli/" + key,
+		summary:  fmt.Sprintf("%s %s is %s, threshold %s", label, check, value, threshold),
+		resolved: !over,
+		details: watchAlert{
+			Queue:     label,
+			Check:     check,
+			Value:     value,
+			Threshold: threshold,
+			Resolved:  !over,
+			Time:      time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	sendAlert(w.sinks, a)
+}
+
+// sendAlert logs an alert and sends it to the sinks, a failing sink is only logged
+func sendAlert(sinks []*alertSink, a alert) {
+	if a.resolved {
+		log.Printf("Resolved: %s\n", a.summary)
+	} else {
+		log.Printf("Alert: %s\n", a.summary)
+	}
+	for _, sink := range sinks {
+		if err := sink.send(a); err != nil {
+			log.Printf("Error alerting %s: %s\n", sink.kind, err)
+		}
+	}
+}
+
+// String implements flag.Value
+func (a *alertFlag) String() string {
+	return strings.Join(*a, ",")
+}
+
+// Set implements flag.Value, called once per -alert
+func (a *alertFlag) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+// sinks parses the flags into alert sinks
+func (a *alertFlag) sinks(sess *session.Session) ([]*alertSink, error) {
+	var sinks []*alertSink
+	for _, value := range *a {
+		sink, err := parseAlertSink(value, sess)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
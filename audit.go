@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// finding is a misconfiguration reported by audit
+type finding struct {
+	Region string `json:"region,omitempty"` // Set by audits across -regions
+	Queue  string `json:"queue"`
+	Check  string `json:"check"`
+	Detail string `json:"detail"`
+}
+
+// redrivePolicy is the JSON document of the RedrivePolicy attribute
+type redrivePolicy struct {
+	DeadLetterTargetArn string      `json:"deadLetterTargetArn"`
+	MaxReceiveCount     json.Number `json:"maxReceiveCount"`
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// audit scans queues and reports misconfigurations
+func audit(args []string) {
+	auditCommand := flag.NewFlagSet("audit", flag.ExitOnError)
+	queueName := auditCommand.String("queue", "*", "queue name or pattern")
+	auditCommand.StringVar(queueName, "q", "*", "queue name or pattern") // Aliasing
+	maxAge := auditCommand.Duration("max-age", 7*24*time.Hour, "oldest message age considered ancient")
+	format := auditCommand.String("format", "table", "output format: table or json")
+	regions := auditCommand.String("regions", "", "comma separated regions to audit")
+	auditHelp := auditCommand.Bool("help", false, "help for audit command")
+	auditCommand.BoolVar(auditHelp, "h", false, "help") // Aliasing
+	parseFlags(auditCommand, args)
+
+	if *auditHelp {
+		auditUsage()
+	}
+
+	// Verify
+	if *format != "table" && *format != "json" {
+		fmt.Println("Format must be table or json.")
+		auditUsage()
+	}
+
+	// Connect
+	services := regionServices(*regions)
+
+	// Dead-letter queues live in the region of their source queues, regions are audited apart
+	var findings []finding
+	t := regionalTable(&table{columns: []column{
+		{key: "queue", title: "QUEUE"},
+		{key: "check", title: "CHECK"},
+		{key: "detail", title: "DETAIL"},
+	}}, services)
+	for _, svc := range services {
+		for _, f := range svc.auditQueues(svc.resolveQueues(*queueName), *maxAge) {
+			f.Region = svc.region
+			findings = append(findings, f)
+			t.addIn(svc, f.Queue, f.Check, f.Detail)
+		}
+	}
+	// The global -o wins over -format
+	if len(outputFormat) > 0 {
+		*format = outputFormat
+	}
+	t.render(os.Stdout, *format)
+
+	// Non-zero so compliance pipelines can gate on it
+	if len(findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// auditQueues runs every check against every queue
+func (s *service) auditQueues(qURLs []string, maxAge time.Duration) []finding {
+	attrs := make(map[string]map[string]*string, len(qURLs))
+	dlqArns := make(map[string]bool)
+	for _, qURL := range qURLs {
+		a := s.getQueueAttributes(qURL).Attributes
+		attrs[qURL] = a
+		if p, ok := parseRedrivePolicy(a); ok {
+			dlqArns[p.DeadLetterTargetArn] = true
+		}
+	}
+
+	var findings []finding
+	for _, qURL := range qURLs {
+		name := queueNameFromURL(qURL)
+		a := attrs[qURL]
+		isDLQ := dlqArns[aws.StringValue(a["QueueArn"])]
+		report := func(check, format string, args ...interface{}) {
+			findings = append(findings, finding{Queue: name, Check: check, Detail: fmt.Sprintf(format, args...)})
+		}
+
+		if _, ok := parseRedrivePolicy(a); !ok && !isDLQ {
+			report("no-dlq", "no dead-letter queue configured")
+		}
+
+		retention := intAttribute(a, "MessageRetentionPeriod")
+		visibility := intAttribute(a, "VisibilityTimeout")
+		if retention < visibility {
+			report("retention", "retention %ds is shorter than visibility timeout %ds", retention, visibility)
+		}
+
+		if aws.StringValue(a["KmsMasterKeyId"]) == "" && aws.StringValue(a["SqsManagedSseEnabled"]) != "true" {
+			report("unencrypted", "server-side encryption is disabled")
+		}
+
+		if n := intAttribute(a, "ApproximateNumberOfMessages"); isDLQ && n > 0 {
+			report("dlq-messages", "dead-letter queue holds %d messages", n)
+		}
+
+		if age, ok := s.oldestMessageAge(name); ok && age > maxAge {
+			report("ancient-message", "oldest message is %s old", age.Round(time.Minute))
+		}
+	}
+	return findings
+}
+
+// parseRedrivePolicy decodes the redrive policy of a queue, if any
+func parseRedrivePolicy(attrs map[string]*string) (redrivePolicy, bool) {
+	var p redrivePolicy
+	raw := aws.StringValue(attrs["RedrivePolicy"])
+	if raw == "" || json.Unmarshal([]byte(raw), &p) != nil || p.DeadLetterTargetArn == "" {
+		return p, false
+	}
+	return p, true
+}
+
+// intAttribute returns a numeric queue attribute, 0 if missing
+func intAttribute(attrs map[string]*string, name string) int {
+	n, _ := strconv.Atoi(aws.StringValue(attrs[name]))
+	return n
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// oldestMessageAge returns the age of the oldest message of a queue from CloudWatch
+func (s *service) oldestMessageAge(name string) (time.Duration, bool) {
+	cw := cloudWatchClient(s.sess)
+	now := time.Now()
+	result, err := cw.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/SQS"),
+		MetricName: aws.String("ApproximateAgeOfOldestMessage"),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("QueueName"), Value: aws.String(name)},
+		},
+		StartTime:  aws.Time(now.Add(-15 * time.Minute)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(300),
+		Statistics: []*string{aws.String(cloudwatch.StatisticMaximum)},
+	})
+	if err != nil {
+		log.Printf("Error fetching oldest message age of %s: %s\n", name, err)
+		return 0, false
+	}
+
+	var max float64
+	for _, dp := range result.Datapoints {
+		if v := aws.Float64Value(dp.Maximum); v > max {
+			max = v
+		}
+	}
+	return time.Duration(max) * time.Second, len(result.Datapoints) > 0
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func auditUsage() {
+	fmt.Println("usage: sqscli audit [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue      Queue name or pattern (default all queues)")
+	fmt.Println("  -max-age    Oldest message age considered ancient (default 168h)")
+	fmt.Println("  -format     Output format, table or json (default table)")
+	fmt.Println("  -regions    Comma separated regions to audit, e.g. us-east-1,eu-west-1")
+	os.Exit(0)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// auditLogOff disables the audit log
+const auditLogOff = "off"
+
+// auditedOperations are the destructive commands written to the audit log, and their operation
+var auditedOperations = map[string]string{
+	"purge":     "purge",
+	"expire":    "delete",
+	"drain":     "delete",
+	"qtoq":      "redrive",
+	"park":      "move",
+	"unpark":    "move",
+	"delete":    "delete",
+	"migrate":   "move",
+	"merge":     "move",
+	"split":     "move",
+	"mirror":    "copy",
+	"drain-all": "move",
+}
+
+// auditLog is where destructive actions are recorded, set by -audit-log
+// a JSONL file, ~/.sqscli/audit.jsonl by default, or an S3 prefix, s3://bucket/prefix
+var auditLog string
+
+// auditAction is the destructive action in progress, nil when not audited
+var auditAction *auditEntry
+
+// auditEntry is a line of the audit log
+// an action is written when it starts and again when it ends, so a crashed run leaves a trace
+type auditEntry struct {
+	Time      time.Time      `json:"time"`
+	Action    string         `json:"action"` // Identifies the action across its entries
+	Phase     string         `json:"phase"`  // started or finished
+	Identity  *auditIdentity `json:"identity"`
+	Host      string         `json:"host"`
+	Command   string         `json:"command"`
+	Operation string         `json:"operation"` // purge, redrive, move or delete
+	Queues    []string       `json:"queues"`
+	Region    string         `json:"region"`
+	Args      []string       `json:"args"`
+	Ticket    string         `json:"ticket,omitempty"`   // -ticket
+	Messages  *int64         `json:"messages,omitempty"` // Affected, set when finished
+	Failed    *int64         `json:"failed,omitempty"`
+	Outcome   string         `json:"outcome,omitempty"` // completed, failed or interrupted
+
+	once sync.Once
+}
+
+// auditIdentity is the caller of an action, as STS sees it
+type auditIdentity struct {
+	Account string `json:"account,omitempty"`
+	ARN     string `json:"arn,omitempty"`
+	UserID  string `json:"userId,omitempty"`
+	Error   string `json:"error,omitempty"` // The caller couldn't be identified
+}
+
+// - - - - - - - - - - - - - - - -
+//   AUDIT LOG
+// - - - - - - - - - - - - - - - -
+
+// defaultAuditLog is ~/.sqscli/audit.jsonl
+func defaultAuditLog() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return auditLogOff
+	}
+	return filepath.Join(home, ".sqscli", "audit.jsonl")
+}
+
+// startAudit writes the start of a destructive action, fatal if the audit log can't be written
+// runs against the emulator or a replay change no real queue and are not audited
+func startAudit(command string, queues ...string) {
+	kind, ok := auditedOperations[command]
+	if !ok || auditLog == auditLogOff || len(auditLog) == 0 || localMode || len(replayDir) > 0 {
+		return
+	}
+	host, _ := os.Hostname()
+	// The action of a bulk operation is the operation, its resumes included
+	action, _ := newUUID()
+	if operation != nil {
+		action = operation.ID
+	}
+	auditAction = &auditEntry{
+		Action:    action,
+		Identity:  callerIdentity(),
+		Host:      host,
+		Command:   command,
+		Operation: kind,
+		Queues:    queues,
+		Region:    awsRegion,
+		Args:      os.Args[1:],
+		Ticket:    ticket,
+	}
+	auditAction.Phase = "started"
+	auditAction.Time = time.Now().UTC()
+	if err := writeAudit(auditAction); err != nil {
+		log.Fatalf("Error writing the audit log %s: %s\n", auditLog, err)
+	}
+}
+
+// finishAudit writes the end of the destructive action, with the messages affected and failed
+// only the first call does anything, exit paths call it through finishReport
+func finishAudit(messages, failed int64) {
+	if auditAction == nil {
+		return
+	}
+	auditAction.once.Do(func() {
+		auditAction.Phase = "finished"
+		auditAction.Time = time.Now().UTC()
+		auditAction.Messages, auditAction.Failed = &messages, &failed
+		switch {
+		case isInterrupted():
+			auditAction.Outcome = "interrupted"
+		case failed > 0:
+			auditAction.Outcome = "failed"
+		default:
+			auditAction.Outcome = "completed"
+		}
+		if err := writeAudit(auditAction); err != nil {
+			log.Printf("Error writing the audit log %s: %s\n", auditLog, err)
+		}
+	})
+}
+
+// writeAudit appends an entry to the audit log file, or puts it as an object under the S3 prefix
+func writeAudit(e *auditEntry) error {
+	b, _ := json.Marshal(e)
+	b = append(b, '\n')
+	if strings.HasPrefix(auditLog, "s3://") {
+		bucket, prefix, err := parseS3URI(auditLog)
+		if err != nil {
+			return err
+		}
+		// Objects are never rewritten, a bucket with Object Lock makes the log tamper-proof
+		key := fmt.Sprintf("%s/%s/%s-%s-%s.json", strings.TrimSuffix(prefix, "/"), e.Time.Format("2006/01/02"), e.Time.Format("150405.000000000"), e.Action, e.Phase)
+		_, err = s3Client(regionSession(awsRegion)).PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(b),
+			ContentType: aws.String("application/x-ndjson"),
+		})
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(auditLog), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// callerIdentity asks STS who runs the action
+func callerIdentity() *auditIdentity {
+	out, err := stsClient(regionSession(awsRegion)).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return &auditIdentity{Error: err.Error()}
+	}
+	return &auditIdentity{
+		Account: aws.StringValue(out.Account),
+		ARN:     aws.StringValue(out.Arn),
+		UserID:  aws.StringValue(out.UserId),
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// avroMagic starts every Avro object container file
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+// avroSchema is a parsed Avro schema
+// logical types are written as their underlying type
+type avroSchema struct {
+	typ      string // Primitive name, record, enum, array, map, fixed or union
+	name     string
+	fields   []avroField   // record
+	symbols  []string      // enum
+	items    *avroSchema   // array
+	values   *avroSchema   // map
+	size     int           // fixed
+	branches []*avroSchema // union
+}
+
+// avroField is a field of a record schema
+type avroField struct {
+	name     string
+	schema   *avroSchema
+	defValue interface{}
+	hasDef   bool
+}
+
+// avroWriter writes messages as records of an Avro object container file
+// records are buffered and written as a block on flush
+type avroWriter struct {
+	w         io.Writer
+	schema    *avroSchema
+	rawSchema string
+	sync      [16]byte
+	block     bytes.Buffer
+	count     int64
+}
+
+// - - - - - - - - - - - - - - - -
+//   SCHEMAS
+// - - - - - - - - - - - - - - - -
+
+// loadAvroSchema reads a schema from a file, or the latest version of a subject
+// of a Confluent schema registry
+// returns the schema JSON
+func loadAvroSchema(file, registry, subject string) (string, error) {
+	if len(file) > 0 {
+		b, err := ioutil.ReadFile(file)
+		return string(b), err
+	}
+
+	endpoint := strings.TrimSuffix(registry, "/") + "/subjects/" + url.PathEscape(subject) + "/versions/latest"
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	client, err := newHTTPClient()
+	if err != nil {
+		return "", err
+	}
+	client.Timeout = 30 * time.Second
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("schema registry answered %s for subject %s", resp.Status, subject)
+	}
+	var version struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return "", err
+	}
+	if version.SchemaType != "" && version.SchemaType != "AVRO" {
+		return "", fmt.Errorf("subject %s holds a %s schema", subject, version.SchemaType)
+	}
+	return version.Schema, nil
+}
+
+// parseAvroSchema parses an Avro schema in its JSON form
+func parseAvroSchema(raw string) (*avroSchema, error) {
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	return parseAvroType(v, "", make(map[string]*avroSchema))
+}
+
+// parseAvroType parses a schema node, named types are registered in names
+func parseAvroType(v interface{}, namespace string, names map[string]*avroSchema) (*avroSchema, error) {
+	switch node := v.(type) {
+	case string:
+		switch node {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroSchema{typ: node}, nil
+		}
+		if s, ok := names[node]; ok {
+			return s, nil
+		}
+		if s, ok := names[namespace+"."+node]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", node)
+	case []interface{}:
+		s := &avroSchema{typ: "union"}
+		for _, branch := range node {
+			b, err := parseAvroType(branch, namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			s.branches = append(s.branches, b)
+		}
+		return s, nil
+	case map[string]interface{}:
+		typ, _ := node["type"].(string)
+		s := &avroSchema{typ: typ}
+		switch typ {
+		case "record", "error", "enum", "fixed":
+			s.typ = strings.Replace(typ, "error", "record", 1)
+			name, _ := node["name"].(string)
+			if len(name) == 0 {
+				return nil, fmt.Errorf("%s without name", typ)
+			}
+			if ns, ok := node["namespace"].(string); ok {
+				namespace = ns
+			}
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				namespace = name[:i]
+			}
+			s.name = name
+			names[name] = s
+			if len(namespace) > 0 && !strings.Contains(name, ".") {
+				names[namespace+"."+name] = s
+			}
+		}
+		switch s.typ {
+		case "record":
+			fields, _ := node["fields"].([]interface{})
+			for _, f := range fields {
+				fm, ok := f.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("record %s: invalid field", s.name)
+				}
+				fieldSchema, err := parseAvroType(fm["type"], namespace, names)
+				if err != nil {
+					return nil, fmt.Errorf("record %s: %s", s.name, err)
+				}
+				field := avroField{schema: fieldSchema}
+				field.name, _ = fm["name"].(string)
+				field.defValue, field.hasDef = fm["default"]
+				s.fields = append(s.fields, field)
+			}
+		case "enum":
+			symbols, _ := node["symbols"].([]interface{})
+			for _, symbol := range symbols {
+				name, _ := symbol.(string)
+				s.symbols = append(s.symbols, name)
+			}
+		case "array", "map":
+			key := "items"
+			if s.typ == "map" {
+				key = "values"
+			}
+			inner, err := parseAvroType(node[key], namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			if s.typ == "array" {
+				s.items = inner
+			} else {
+				s.values = inner
+			}
+		case "fixed":
+			n, _ := node["size"].(json.Number)
+			size, err := n.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("fixed %s: invalid size", s.name)
+			}
+			s.size = int(size)
+		default:
+			// {"type": "string", "logicalType": ...} and the like
+			return parseAvroType(node["type"], namespace, names)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("invalid schema node %v", v)
+}
+
+// - - - - - - - - - - - - - - - -
+//   ENCODING
+// - - - - - - - - - - - - - - - -
+
+// newAvroWriter returns a writer of records to w, writeHeader starts the file
+func newAvroWriter(w io.Writer, rawSchema string) (*avroWriter, error) {
+	schema, err := parseAvroSchema(rawSchema)
+	if err != nil {
+		return nil, err
+	}
+	aw := &avroWriter{w: w, schema: schema, rawSchema: rawSchema}
+	if _, err := rand.Read(aw.sync[:]); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// writeHeader starts a container file, again for each part of a split export
+func (aw *avroWriter) writeHeader() error {
+	var header bytes.Buffer
+	header.Write(avroMagic)
+	writeAvroLong(&header, 2)
+	writeAvroBytes(&header, []byte("avro.schema"))
+	writeAvroBytes(&header, []byte(aw.rawSchema))
+	writeAvroBytes(&header, []byte("avro.codec"))
+	writeAvroBytes(&header, []byte("null"))
+	writeAvroLong(&header, 0)
+	header.Write(aw.sync[:])
+	_, err := aw.w.Write(header.Bytes())
+	return err
+}
+
+// append encodes the JSON body of a message as a record of the block
+func (aw *avroWriter) append(m *sqs.Message, body string) error {
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("message %s is not JSON: %s", aws.StringValue(m.MessageId), err)
+	}
+	var record bytes.Buffer
+	if err := encodeAvro(&record, aw.schema, v); err != nil {
+		return fmt.Errorf("message %s doesn't match the schema: %s", aws.StringValue(m.MessageId), err)
+	}
+	aw.block.Write(record.Bytes())
+	aw.count++
+	return nil
+}
+
+// flush writes the buffered records as a block
+func (aw *avroWriter) flush() error {
+	if aw.count == 0 {
+		return nil
+	}
+	var block bytes.Buffer
+	writeAvroLong(&block, aw.count)
+	writeAvroLong(&block, int64(aw.block.Len()))
+	block.Write(aw.block.Bytes())
+	block.Write(aw.sync[:])
+	aw.block.Reset()
+	aw.count = 0
+	_, err := aw.w.Write(block.Bytes())
+	return err
+}
+
+// encodeAvro writes a decoded JSON value in the Avro binary encoding of a schema
+func encodeAvro(buf *bytes.Buffer, s *avroSchema, v interface{}) error {
+	switch s.typ {
+	case "null":
+		if v != nil {
+			return fmt.Errorf("expected null, got %v", v)
+		}
+	case "boolean":
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("expected boolean, got %v", v)
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case "int", "long":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("expected %s, got %v", s.typ, v)
+		}
+		i, err := n.Int64()
+		if err != nil || (s.typ == "int" && (i < math.MinInt32 || i > math.MaxInt32)) {
+			return fmt.Errorf("%s is not an %s", n, s.typ)
+		}
+		writeAvroLong(buf, i)
+	case "float", "double":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("expected %s, got %v", s.typ, v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return err
+		}
+		if s.typ == "float" {
+			binary.Write(buf, binary.LittleEndian, math.Float32bits(float32(f)))
+		} else {
+			binary.Write(buf, binary.LittleEndian, math.Float64bits(f))
+		}
+	case "string", "bytes":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected %s, got %v", s.typ, v)
+		}
+		writeAvroBytes(buf, []byte(str))
+	case "fixed":
+		str, ok := v.(string)
+		if !ok || len(str) != s.size {
+			return fmt.Errorf("expected %d bytes for %s", s.size, s.name)
+		}
+		buf.WriteString(str)
+	case "enum":
+		str, _ := v.(string)
+		for i, symbol := range s.symbols {
+			if symbol == str {
+				writeAvroLong(buf, int64(i))
+				return nil
+			}
+		}
+		return fmt.Errorf("%v is not a symbol of %s", v, s.name)
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected array, got %v", v)
+		}
+		if len(items) > 0 {
+			writeAvroLong(buf, int64(len(items)))
+			for _, item := range items {
+				if err := encodeAvro(buf, s.items, item); err != nil {
+					return err
+				}
+			}
+		}
+		writeAvroLong(buf, 0)
+	case "map":
+		values, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected map, got %v", v)
+		}
+		if len(values) > 0 {
+			writeAvroLong(buf, int64(len(values)))
+			for k, value := range values {
+				writeAvroBytes(buf, []byte(k))
+				if err := encodeAvro(buf, s.values, value); err != nil {
+					return err
+				}
+			}
+		}
+		writeAvroLong(buf, 0)
+	case "record":
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected record %s, got %v", s.name, v)
+		}
+		for _, f := range s.fields {
+			value, ok := object[f.name]
+			if !ok && f.hasDef {
+				value = f.defValue
+			}
+			if err := encodeAvro(buf, f.schema, value); err != nil {
+				return fmt.Errorf("%s.%s: %s", s.name, f.name, err)
+			}
+		}
+	case "union":
+		// Plain JSON values take the first branch they fit,
+		// the Avro JSON form {"type": value} picks the branch by name
+		if object, ok := v.(map[string]interface{}); ok && len(object) == 1 {
+			for i, b := range s.branches {
+				if inner, ok := object[branchName(b)]; ok {
+					writeAvroLong(buf, int64(i))
+					return encodeAvro(buf, b, inner)
+				}
+			}
+		}
+		for i, b := range s.branches {
+			var branch bytes.Buffer
+			if encodeAvro(&branch, b, v) == nil {
+				writeAvroLong(buf, int64(i))
+				buf.Write(branch.Bytes())
+				return nil
+			}
+		}
+		return fmt.Errorf("%v matches no branch of the union", v)
+	default:
+		return fmt.Errorf("unsupported type %s", s.typ)
+	}
+	return nil
+}
+
+// branchName is the name of a union branch in the Avro JSON encoding
+func branchName(s *avroSchema) string {
+	if len(s.name) > 0 {
+		return s.name
+	}
+	return s.typ
+}
+
+// writeAvroLong writes a zig-zag variable length long
+func writeAvroLong(buf *bytes.Buffer, n int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], n)])
+}
+
+// writeAvroBytes writes length prefixed bytes
+func writeAvroBytes(buf *bytes.Buffer, b []byte) {
+	writeAvroLong(buf, int64(len(b)))
+	buf.Write(b)
+}
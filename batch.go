@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// maxBatchEntries is the most entries a SendMessageBatch accepts
+	maxBatchEntries = 10
+	// maxBatchPayload is the biggest total payload of a SendMessageBatch (256KB)
+	maxBatchPayload = 256 * 1024
+)
+
+// - - - - - - - - - - - - - - - -
+//   BATCHING
+// - - - - - - - - - - - - - - - -
+
+// entrySize is the payload SQS counts for an entry: the body, and the name,
+// data type and value of each message attribute
+func entrySize(e *sqs.SendMessageBatchRequestEntry) int {
+	size := len(aws.StringValue(e.MessageBody))
+	for name, value := range e.MessageAttributes {
+		size += len(name) + len(aws.StringValue(value.DataType)) +
+			len(aws.StringValue(value.StringValue)) + len(value.BinaryValue)
+	}
+	return size
+}
+
+// fitsBatch is true if entry can join batch without going over the payload limit
+// an empty batch takes any entry, SQS rejects the ones too big on their own
+func fitsBatch(batch []*sqs.SendMessageBatchRequestEntry, entry *sqs.SendMessageBatchRequestEntry) bool {
+	if len(batch) == 0 {
+		return true
+	}
+	size := entrySize(entry)
+	for _, e := range batch {
+		size += entrySize(e)
+	}
+	return size <= maxBatchPayload
+}
+
+// packEntries splits entries in batches of at most max entries and maxBatchPayload bytes
+// the order is kept, so FIFO groups stay in sequence
+func packEntries(entries []*sqs.SendMessageBatchRequestEntry, max int) [][]*sqs.SendMessageBatchRequestEntry {
+	var batches [][]*sqs.SendMessageBatchRequestEntry
+	var batch []*sqs.SendMessageBatchRequestEntry
+	for _, e := range entries {
+		if len(batch) == max || !fitsBatch(batch, e) {
+			batches = append(batches, batch)
+			batch = nil
+		}
+		batch = append(batch, e)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
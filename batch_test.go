@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// batchTestEntry is an entry of body bytes, without attributes
+func batchTestEntry(body int) *sqs.SendMessageBatchRequestEntry {
+	return &sqs.SendMessageBatchRequestEntry{Id: nextEntryID(), MessageBody: aws.String(strings.Repeat("x", body))}
+}
+
+func TestEntrySize(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry *sqs.SendMessageBatchRequestEntry
+		want  int
+	}{
+		{"body only", batchTestEntry(100), 100},
+		{"string attribute", &sqs.SendMessageBatchRequestEntry{
+			MessageBody: aws.String("body"),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"Source": {DataType: aws.String("String"), StringValue: aws.String("billing")},
+			},
+		}, 4 + len("Source") + len("String") + len("billing")},
+		{"binary attribute", &sqs.SendMessageBatchRequestEntry{
+			MessageBody: aws.String(""),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"Blob": {DataType: aws.String("Binary"), BinaryValue: []byte{1, 2, 3}},
+			},
+		}, len("Blob") + len("Binary") + 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entrySize(tt.entry); got != tt.want {
+				t.Errorf("entrySize = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackEntries(t *testing.T) {
+	entries := func(sizes ...int) []*sqs.SendMessageBatchRequestEntry {
+		var es []*sqs.SendMessageBatchRequestEntry
+		for _, size := range sizes {
+			es = append(es, batchTestEntry(size))
+		}
+		return es
+	}
+	repeat := func(n, size int) []int {
+		sizes := make([]int, n)
+		for i := range sizes {
+			sizes[i] = size
+		}
+		return sizes
+	}
+	tests := []struct {
+		name    string
+		entries []*sqs.SendMessageBatchRequestEntry
+		max     int
+		want    []int // Entries of each batch
+	}{
+		{"empty", nil, maxBatchEntries, nil},
+		{"one batch", entries(repeat(7, 10)...), maxBatchEntries, []int{7}},
+		{"entry limit", entries(repeat(23, 10)...), maxBatchEntries, []int{10, 10, 3}},
+		{"smaller batch size", entries(repeat(5, 10)...), 2, []int{2, 2, 1}},
+		{"payload limit", entries(repeat(5, 100*1024)...), maxBatchEntries, []int{2, 2, 1}},
+		{"exactly 256KB", entries(128*1024, 128*1024, 1), maxBatchEntries, []int{2, 1}},
+		{"one byte over", entries(128*1024, 128*1024+1), maxBatchEntries, []int{1, 1}},
+		{"too big alone still sent", entries(10, maxBatchPayload+1, 10), maxBatchEntries, []int{1, 1, 1}},
+		{"small ones after a big one", entries(200*1024, 60*1024, 10, 10), maxBatchEntries, []int{1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches := packEntries(tt.entries, tt.max)
+			if len(batches) != len(tt.want) {
+				t.Fatalf("%d batches, want %d", len(batches), len(tt.want))
+			}
+			next := 0
+			for i, batch := range batches {
+				if len(batch) != tt.want[i] {
+					t.Errorf("batch %d holds %d entries, want %d", i, len(batch), tt.want[i])
+				}
+				size := 0
+				for _, e := range batch {
+					// The order is kept
+					if e != tt.entries[next] {
+						t.Errorf("batch %d is out of order", i)
+					}
+					next++
+					size += entrySize(e)
+				}
+				if len(batch) > 1 && size > maxBatchPayload {
+					t.Errorf("batch %d holds %d bytes", i, size)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// maxRecentQueues is the number of recently used queues kept
+const maxRecentQueues = 20
+
+// bookmarkRef marks a queue given by bookmark, like -queue @orders
+const bookmarkRef = "@"
+
+// bookmarkFlags are the flags taking queues, their @NAME values are replaced by the queues of the bookmarks
+var bookmarkFlags = []string{"queue", "queue1", "queue2", "to"}
+
+// bookmarkName is a valid bookmark name
+var bookmarkName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// bookmark is a queue saved under a short name
+type bookmark struct {
+	Queue string    `json:"queue"` // Queue name or ARN
+	Note  string    `json:"note,omitempty"`
+	Added time.Time `json:"added"`
+}
+
+// recentQueue is a queue a command resolved
+type recentQueue struct {
+	Queue  string    `json:"queue"`
+	Region string    `json:"region"`
+	Local  bool      `json:"local,omitempty"` // A queue of the emulator, see -local
+	Used   time.Time `json:"used"`
+}
+
+// bookmarksFile is the content of ~/.sqscli/bookmarks.json
+type bookmarksFile struct {
+	Bookmarks map[string]bookmark `json:"bookmarks"`
+	Recents   []recentQueue       `json:"recents"` // Most recent first
+}
+
+// recentsSeen are the queues of the run already saved as recent, each is saved once per run
+var recentsSeen = struct {
+	sync.Mutex
+	queues map[string]bool
+}{queues: make(map[string]bool)}
+
+// - - - - - - - - - - - - - - - -
+//   BOOKMARK COMMAND
+// - - - - - - - - - - - - - - - -
+
+// bookmarkCommand adds, removes and lists the queue bookmarks, commands take @NAME for their queue
+func bookmarkCommand(args []string) {
+	if len(args) == 0 {
+		bookmarkUsage()
+	}
+	switch args[0] {
+	case "add":
+		bookmarkAdd(args[1:])
+	case "rm":
+		bookmarkRemove(args[1:])
+	case "list":
+		bookmarkList(args[1:])
+	case "recents":
+		bookmarkRecents(args[1:])
+	default:
+		bookmarkUsage()
+	}
+}
+
+// bookmarkAdd saves a queue under a name, replacing the bookmark of that name
+func bookmarkAdd(args []string) {
+	addCommand := flag.NewFlagSet("bookmark add", flag.ExitOnError)
+	note := addCommand.String("note", "", "note shown by bookmark list")
+	addHelp := addCommand.Bool("help", false, "help for bookmark add command")
+	addCommand.BoolVar(addHelp, "h", false, "help") // Aliasing
+	parseFlags(addCommand, args)
+
+	if *addHelp {
+		bookmarkUsage()
+	}
+
+	// Verify
+	if addCommand.NArg() != 2 {
+		fmt.Println("Required bookmark name and queue are missing.")
+		bookmarkUsage()
+	}
+	name, queue := strings.TrimPrefix(addCommand.Arg(0), bookmarkRef), addCommand.Arg(1)
+	if !bookmarkName.MatchString(name) {
+		log.Fatalf("Invalid bookmark name %s, expected letters, digits, -, _ and .\n", name)
+	}
+	if strings.HasPrefix(queue, bookmarkRef) || isGlob(queue) {
+		log.Fatal("A bookmark is a queue name or ARN, not a bookmark or pattern")
+	}
+
+	// Apply
+	f := loadBookmarks()
+	_, replaced := f.Bookmarks[name]
+	f.Bookmarks[name] = bookmark{Queue: queue, Note: *note, Added: time.Now().UTC()}
+	if err := saveBookmarks(f); err != nil {
+		log.Fatal("Error saving the bookmarks ", err)
+	}
+	if replaced {
+		fmt.Printf("Bookmark @%s replaced: %s\n", name, queue)
+	} else {
+		fmt.Printf("Bookmark @%s added: %s\n", name, queue)
+	}
+}
+
+// bookmarkRemove removes bookmarks
+func bookmarkRemove(args []string) {
+	rmCommand := flag.NewFlagSet("bookmark rm", flag.ExitOnError)
+	rmHelp := rmCommand.Bool("help", false, "help for bookmark rm command")
+	rmCommand.BoolVar(rmHelp, "h", false, "help") // Aliasing
+	parseFlags(rmCommand, args)
+
+	if *rmHelp || rmCommand.NArg() == 0 {
+		bookmarkUsage()
+	}
+
+	f := loadBookmarks()
+	for _, name := range rmCommand.Args() {
+		name = strings.TrimPrefix(name, bookmarkRef)
+		if _, ok := f.Bookmarks[name]; !ok {
+			log.Fatalf("No bookmark @%s\n", name)
+		}
+		delete(f.Bookmarks, name)
+	}
+	if err := saveBookmarks(f); err != nil {
+		log.Fatal("Error saving the bookmarks ", err)
+	}
+}
+
+// bookmarkList prints the bookmarks by name
+func bookmarkList(args []string) {
+	listCommand := flag.NewFlagSet("bookmark list", flag.ExitOnError)
+	listHelp := listCommand.Bool("help", false, "help for bookmark list command")
+	listCommand.BoolVar(listHelp, "h", false, "help") // Aliasing
+	parseFlags(listCommand, args)
+
+	if *listHelp {
+		bookmarkUsage()
+	}
+	f := loadBookmarks()
+	names := make([]string, 0, len(f.Bookmarks))
+	for name := range f.Bookmarks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	t := &table{columns: []column{
+		{key: "name", title: "NAME"},
+		{key: "queue", title: "QUEUE"},
+		{key: "note", title: "NOTE"},
+		{key: "added", title: "ADDED", wide: true},
+	}}
+	for _, name := range names {
+		b := f.Bookmarks[name]
+		t.add(bookmarkRef+name, b.Queue, b.Note, formatTime(b.Added, timeRFC3339))
+	}
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t.render(os.Stdout, format)
+}
+
+// bookmarkRecents prints the queues used lately, most recent first
+func bookmarkRecents(args []string) {
+	recentsCommand := flag.NewFlagSet("bookmark recents", flag.ExitOnError)
+	clear := recentsCommand.Bool("clear", false, "forget the queues used")
+	recentsHelp := recentsCommand.Bool("help", false, "help for bookmark recents command")
+	recentsCommand.BoolVar(recentsHelp, "h", false, "help") // Aliasing
+	parseFlags(recentsCommand, args)
+
+	if *recentsHelp {
+		bookmarkUsage()
+	}
+	f := loadBookmarks()
+	if *clear {
+		f.Recents = nil
+		if err := saveBookmarks(f); err != nil {
+			log.Fatal("Error saving the bookmarks ", err)
+		}
+		return
+	}
+	t := &table{columns: []column{
+		{key: "queue", title: "QUEUE"},
+		{key: "region", title: "REGION"},
+		{key: "used", title: "USED"},
+	}}
+	for _, r := range f.Recents {
+		region := r.Region
+		if r.Local {
+			region += " (local)"
+		}
+		t.add(r.Queue, region, formatTime(r.Used, timeRFC3339))
+	}
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t.render(os.Stdout, format)
+}
+
+// - - - - - - - - - - - - - - - -
+//   BOOKMARKS
+// - - - - - - - - - - - - - - - -
+
+// lookupBookmark returns the queue of a @NAME reference, names without @ are returned as is
+func lookupBookmark(name string) (string, error) {
+	if !strings.HasPrefix(name, bookmarkRef) {
+		return name, nil
+	}
+	b, ok := loadBookmarks().Bookmarks[name[len(bookmarkRef):]]
+	if !ok {
+		return "", fmt.Errorf("no bookmark %s, see bookmark list", name)
+	}
+	return b.Queue, nil
+}
+
+// expandBookmark returns the queue of a @NAME reference, fatal if there is no such bookmark
+func expandBookmark(name string) string {
+	queue, err := lookupBookmark(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return queue
+}
+
+// expandBookmarkFlags replaces the @NAME queues of the flags of a command, in comma separated lists too
+func expandBookmarkFlags(fs *flag.FlagSet) {
+	for _, name := range bookmarkFlags {
+		f := fs.Lookup(name)
+		if f == nil || !strings.Contains(f.Value.String(), bookmarkRef) {
+			continue
+		}
+		parts := strings.Split(f.Value.String(), ",")
+		for i, part := range parts {
+			parts[i] = expandBookmark(strings.TrimSpace(part))
+		}
+		fs.Set(name, strings.Join(parts, ","))
+	}
+}
+
+// rememberQueue saves a queue as the most recent one, once per run
+// failures are ignored, recents are only a convenience
+func (s *service) rememberQueue(name string) {
+	if len(recordDir) > 0 || len(replayDir) > 0 {
+		return
+	}
+	recent := recentQueue{Queue: name, Region: aws.StringValue(s.sess.Config.Region), Local: localMode, Used: time.Now().UTC()}
+	recentsSeen.Lock()
+	defer recentsSeen.Unlock()
+	key := fmt.Sprint(recent.Queue, recent.Region, recent.Local)
+	if recentsSeen.queues[key] {
+		return
+	}
+	recentsSeen.queues[key] = true
+
+	f := loadBookmarks()
+	recents := []recentQueue{recent}
+	for _, r := range f.Recents {
+		if r.Queue != recent.Queue || r.Region != recent.Region || r.Local != recent.Local {
+			recents = append(recents, r)
+		}
+	}
+	if len(recents) > maxRecentQueues {
+		recents = recents[:maxRecentQueues]
+	}
+	f.Recents = recents
+	saveBookmarks(f)
+}
+
+// recentQueueNames returns the queues used lately with the region and endpoint of the service, most recent first
+func (s *service) recentQueueNames() []string {
+	var names []string
+	region := aws.StringValue(s.sess.Config.Region)
+	for _, r := range loadBookmarks().Recents {
+		if r.Region == region && r.Local == localMode {
+			names = append(names, r.Queue)
+		}
+	}
+	return names
+}
+
+// bookmarksPath is the bookmarks file, empty without a home directory
+func bookmarksPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sqscli", "bookmarks.json")
+}
+
+// loadBookmarks reads the bookmarks file, a missing or unreadable file has no bookmarks
+func loadBookmarks() *bookmarksFile {
+	f := &bookmarksFile{}
+	if b, err := ioutil.ReadFile(bookmarksPath()); err == nil {
+		json.Unmarshal(b, f)
+	}
+	if f.Bookmarks == nil {
+		f.Bookmarks = make(map[string]bookmark)
+	}
+	return f
+}
+
+// saveBookmarks writes the bookmarks file, replaced at once
+func saveBookmarks(f *bookmarksFile) error {
+	file := bookmarksPath()
+	if len(file) == 0 {
+		return fmt.Errorf("no home directory")
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func bookmarkUsage() {
+	fmt.Println("usage: sqscli bookmark <add|rm|list|recents> [options]")
+	fmt.Println("add [-note NOTE] <name> <queue>")
+	fmt.Println("                    Save a queue name or ARN as @name, commands take @name for their queue")
+	fmt.Println("rm <name>...        Remove bookmarks")
+	fmt.Println("list                List the bookmarks")
+	fmt.Println("recents [-clear]    List the queues used lately, most recent first, or forget them")
+	os.Exit(0)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// defaultBounceWindow is how long the redrives of a message are remembered, -bounce-window
+const defaultBounceWindow = 24 * time.Hour
+
+// redriveIDAttribute identifies a message across its redrives, stamped on the first one
+// and carried by the next ones, SQS keeps it when the message goes back to the DLQ
+const redriveIDAttribute = "sqscli.redriveId"
+
+// bounceRecord is a message sent by a redrive, a JSON line of the bounce state file
+type bounceRecord struct {
+	RedriveID string    `json:"redriveId,omitempty"`
+	Key       string    `json:"key,omitempty"` // SHA-256 of the body, records made before redrive IDs
+	ID        string    `json:"id,omitempty"`  // Message ID as received, records made before redrive IDs
+	At        time.Time `json:"at"`
+}
+
+// bounceTracker counts the redrives of messages within a window, to stop redriving
+// the ones coming back to the DLQ over and over
+// messages are recognized by their redrive ID, distinct messages sharing a body are counted apart
+type bounceTracker struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	onBounce string         // Where bounced messages go, -on-bounce
+	route    *exceedRoute   // Route of onBounce, set once the source queue is known
+	redrives map[string]int // Redrives by redrive ID
+	keys     map[string]int // Redrives by body hash, of the records without redrive ID
+	ids      map[string]int // Redrives by message ID, of the records without redrive ID
+	f        *os.File
+}
+
+// - - - - - - - - - - - - - - - -
+//   BOUNCES
+// - - - - - - - - - - - - - - - -
+
+// newBounceTracker loads the redrives of the state file made within the window,
+// and drops the older ones from it
+func newBounceTracker(maxBounces int, window time.Duration, stateFile, onBounce string) (*bounceTracker, error) {
+	if maxBounces < 1 {
+		return nil, fmt.Errorf("the maximum number of bounces must be at least 1")
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("the bounce window must be positive")
+	}
+	t := &bounceTracker{max: maxBounces, window: window, onBounce: onBounce,
+		redrives: make(map[string]int), keys: make(map[string]int), ids: make(map[string]int)}
+
+	var kept []bounceRecord
+	if f, err := os.Open(stateFile); err == nil {
+		since := time.Now().Add(-window)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var r bounceRecord
+			if json.Unmarshal(scanner.Bytes(), &r) != nil || r.At.Before(since) {
+				continue
+			}
+			kept = append(kept, r)
+			t.count(r)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	// Rewritten at once without the expired redrives
+	var b []byte
+	for _, r := range kept {
+		line, _ := json.Marshal(r)
+		b = append(append(b, line...), '\n')
+	}
+	tmp := stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, stateFile); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(stateFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t.f = f
+	if len(kept) > 0 {
+		log.Printf("%d redrives of the last %s loaded from %s\n", len(kept), window, stateFile)
+	}
+	return t, nil
+}
+
+// count adds a redrive to the counts
+func (t *bounceTracker) count(r bounceRecord) {
+	if len(r.RedriveID) > 0 {
+		t.redrives[r.RedriveID]++
+		return
+	}
+	if len(r.Key) > 0 {
+		t.keys[r.Key]++
+	}
+	if len(r.ID) > 0 {
+		t.ids[r.ID]++
+	}
+}
+
+// bounces returns how many times a message was redriven within the window
+// messages without redrive ID were never redriven, unless by a run older than redrive IDs
+func (t *bounceTracker) bounces(m *sqs.Message) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id := redriveID(m); len(id) > 0 {
+		return t.redrives[id]
+	}
+	n := t.keys[bodyHash(m)]
+	if byID := t.ids[aws.StringValue(m.MessageId)]; byID > n {
+		n = byID
+	}
+	return n
+}
+
+// stamp gives the messages of a batch about to be redriven the first time their redrive ID,
+// resendBatch carries it
+func (t *bounceTracker) stamp(batch []*sqs.Message) {
+	for _, m := range batch {
+		if len(redriveID(m)) > 0 {
+			continue
+		}
+		id, _ := newUUID()
+		if m.MessageAttributes == nil {
+			m.MessageAttributes = make(map[string]*sqs.MessageAttributeValue)
+		}
+		m.MessageAttributes[redriveIDAttribute] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(id),
+		}
+	}
+}
+
+// record saves the redrives of sent messages, synced to the state file
+func (t *bounceTracker) record(messages []*sqs.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now().UTC()
+	for _, m := range messages {
+		r := bounceRecord{RedriveID: redriveID(m), At: now}
+		t.count(r)
+		line, _ := json.Marshal(r)
+		fmt.Fprintln(t.f, string(line))
+	}
+	if err := t.f.Sync(); err != nil {
+		log.Fatal("Error syncing bounce state ", err)
+	}
+}
+
+// divertBounced routes the messages of a batch already redriven the maximum number of times
+// and returns the others
+func (s *service) divertBounced(from string, t *bounceTracker, fifo bool, batch []*sqs.Message) ([]*sqs.Message, []error) {
+	var keep, bounced []*sqs.Message
+	for _, m := range batch {
+		if t.bounces(m) >= t.max {
+			bounced = append(bounced, m)
+		} else {
+			keep = append(keep, m)
+		}
+	}
+	if len(bounced) == 0 {
+		return keep, nil
+	}
+	done, errs := s.divertTo(from, t.route, fifo, bounced)
+	atomic.AddInt64(&tally.bounced, int64(len(done)))
+	log.Printf("%d messages bounced back %d times within %s: %s\n", len(done), t.max, t.window, t.route.action)
+	return keep, errs
+}
+
+// redriveID returns the redrive ID of a message, empty if it was never redriven
+func redriveID(m *sqs.Message) string {
+	if v, ok := m.MessageAttributes[redriveIDAttribute]; ok {
+		return aws.StringValue(v.StringValue)
+	}
+	return ""
+}
+
+// bodyHash returns the SHA-256 of the body of a message, as received
+func bodyHash(m *sqs.Message) string {
+	sum := sha256.Sum256([]byte(aws.StringValue(m.Body)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// canaryAttribute marks the probes, its value identifies each probe
+	canaryAttribute = "sqscli.canary"
+	// canaryGroup is the message group of the probes sent to FIFO queues
+	canaryGroup = "sqscli-canary"
+	// canaryVisibility hides the probes while they are being deleted
+	canaryVisibility = 30
+)
+
+// errProbeLost is a probe not received back before the timeout
+var errProbeLost = errors.New("probe not received back")
+
+// canarying is the state of the canary in progress, nil otherwise
+var canarying *canaryStatus
+
+// canaryTiming is what a probe measured
+type canaryTiming struct {
+	roundTrip time.Duration // From the send to the probe received
+	send      time.Duration // The SendMessage call
+	delivery  time.Duration // From the send acknowledged to the probe received
+}
+
+// canaryStatus is the outcome of the last probes, served on /canary and exported as the sqscli.canary.latency metric
+type canaryStatus struct {
+	Queue     string  `json:"queue"`
+	Probes    int     `json:"probes"`
+	Failed    int     `json:"failed"`
+	LatencyMS float64 `json:"latencyMs"` // Round trip of the last probe received
+	LastProbe string  `json:"lastProbe,omitempty"`
+	LastError string  `json:"lastError,omitempty"` // Of the last probe, empty once one succeeds
+	mu        sync.Mutex
+}
+
+// canaryProbe is the body of a probe
+type canaryProbe struct {
+	Canary string `json:"canary"`
+	SentAt string `json:"sentAt"`
+}
+
+// canaryAlert is the JSON details of a canary failing or slow, or healthy again
+type canaryAlert struct {
+	Queue     string `json:"queue"`
+	Latency   string `json:"latency,omitempty"`
+	Threshold string `json:"threshold,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Resolved  bool   `json:"resolved"`
+	Time      string `json:"time"`
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// canary sends a probe to a queue, receives and deletes it, and prints the round trip
+// with -interval it probes until interrupted, alerting when probes fail or are too slow
+func canary(args []string) {
+	canaryCommand := flag.NewFlagSet("canary", flag.ExitOnError)
+	queueName := canaryCommand.String("queue", "", "queue name")
+	canaryCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	interval := canaryCommand.Duration("interval", 0, "probe continuously at this interval")
+	timeout := canaryCommand.Duration("timeout", 30*time.Second, "time a probe has to come back")
+	maxLatency := canaryCommand.Duration("max-latency", 0, "alert when the round trip is longer")
+	var alerts alertFlag
+	canaryCommand.Var(&alerts, "alert", "alert sink: sns:TOPIC_ARN, slack:WEBHOOK_URL, pagerduty:ROUTING_KEY or a webhook URL, repeatable")
+	canaryHelp := canaryCommand.Bool("help", false, "help for canary command")
+	canaryCommand.BoolVar(canaryHelp, "h", false, "help") // Aliasing
+	parseFlags(canaryCommand, args)
+
+	if *canaryHelp {
+		canaryUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		canaryUsage()
+	}
+	if *interval < 0 || *timeout <= 0 || *maxLatency < 0 {
+		log.Fatal("Interval, timeout and max latency must be positive")
+	}
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+	sinks, err := alerts.sinks(svc.sess)
+	if err != nil {
+		log.Fatal(err)
+	}
+	q := svc.resolveQueue(*queueName)
+	qURL, fifo := q.url, q.fifo
+	label := svc.queueLabel(qURL)
+
+	canarying = &canaryStatus{Queue: label}
+	if len(healthAddr) > 0 {
+		serveHealth(healthAddr, map[string]http.HandlerFunc{"/canary": canarying.serve})
+	}
+	var timings []canaryTiming
+	probes, firing := 0, false
+	for {
+		probes++
+		t, err := svc.probe(qURL, fifo, *timeout)
+		canarying.record(t, err)
+		unhealthy := err != nil || (*maxLatency > 0 && t.roundTrip > *maxLatency)
+		switch {
+		case err != nil:
+			log.Printf("Probe %d failed after %s: %s\n", probes, t.roundTrip.Round(time.Millisecond), err)
+		case *interval > 0:
+			log.Printf("Probe %d: %s (send %s, delivery %s)\n", probes,
+				t.roundTrip.Round(time.Millisecond), t.send.Round(time.Millisecond), t.delivery.Round(time.Millisecond))
+		}
+		if err == nil {
+			timings = append(timings, t)
+		}
+		if unhealthy != firing && len(sinks) > 0 {
+			sendAlert(sinks, canaryAlertOf(label, t, err, *maxLatency, !unhealthy))
+		}
+		firing = unhealthy
+		if *interval == 0 {
+			break
+		}
+		select {
+		case <-interrupted:
+		case <-time.After(*interval):
+		}
+		if isInterrupted() {
+			break
+		}
+	}
+	if len(timings) == 0 {
+		log.Fatal("Every probe failed")
+	}
+
+	t := &table{columns: []column{
+		{key: "metric", title: "METRIC"},
+		{key: "min", title: "MIN"},
+		{key: "p50", title: "P50"},
+		{key: "p95", title: "P95"},
+		{key: "max", title: "MAX"},
+	}}
+	var roundTrips, sends, deliveries []time.Duration
+	for _, timing := range timings {
+		roundTrips = append(roundTrips, timing.roundTrip)
+		sends = append(sends, timing.send)
+		deliveries = append(deliveries, timing.delivery)
+	}
+	addDurations(t, "round trip", roundTrips)
+	addDurations(t, "send", sends)
+	addDurations(t, "delivery", deliveries)
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t.render(os.Stdout, format)
+	if failed := probes - len(timings); failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d probes failed\n", failed, probes)
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// canaryAlertOf returns the alert of a probe, resolved once the canary is healthy again
+func canaryAlertOf(label string, t canaryTiming, err error, maxLatency time.Duration, resolved bool) alert {
+	details := canaryAlert{Queue: label, Resolved: resolved, Time: time.Now().UTC().Format(time.RFC3339)}
+	summary := fmt.Sprintf("%s canary is healthy", label)
+	switch {
+	case err != nil:
+		details.Error = err.Error()
+		summary = fmt.Sprintf("%s canary failed: %s", label, err)
+	case !resolved:
+		details.Latency, details.Threshold = t.roundTrip.Round(time.Millisecond).String(), maxLatency.String()
+		summary = fmt.Sprintf("%s canary round trip is %s, threshold %s", label, details.Latency, details.Threshold)
+	default:
+		details.Latency = t.roundTrip.Round(time.Millisecond).String()
+	}
+	return alert{key: "sqscli/" + label + "/canary", summary: summary, resolved: resolved, details: details}
+}
+
+// record keeps the outcome of a probe
+func (c *canaryStatus) record(t canaryTiming, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Probes++
+	c.LastProbe = time.Now().UTC().Format(time.RFC3339)
+	if err != nil {
+		c.Failed++
+		c.LastError = err.Error()
+		return
+	}
+	c.LastError = ""
+	c.LatencyMS = float64(t.roundTrip) / float64(time.Millisecond)
+}
+
+// latency is the round trip of the last probe received, in milliseconds
+func (c *canaryStatus) latency() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.LatencyMS
+}
+
+// serve answers /canary with the status as JSON
+func (c *canaryStatus) serve(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	b, _ := json.Marshal(c)
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// probe sends a probe to a queue and receives it back, then deletes it
+// other messages received meanwhile are released right away, left-over probes of earlier runs are deleted
+func (s *service) probe(queue string, fifo bool, timeout time.Duration) (canaryTiming, error) {
+	var t canaryTiming
+	id, _ := newUUID()
+	body, _ := json.Marshal(canaryProbe{Canary: id, SentAt: time.Now().UTC().Format(time.RFC3339Nano)})
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queue),
+		MessageBody: aws.String(string(body)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			canaryAttribute: {DataType: aws.String("String"), StringValue: aws.String(id)},
+		},
+	}
+	if fifo {
+		input.MessageGroupId, input.MessageDeduplicationId = aws.String(canaryGroup), aws.String(id)
+	}
+
+	start := time.Now()
+	if _, err := s.SendMessage(input); err != nil {
+		t.roundTrip = time.Since(start)
+		return t, err
+	}
+	t.send = time.Since(start)
+	deadline := start.Add(timeout)
+	for time.Now().Before(deadline) {
+		wait := int64(time.Until(deadline).Seconds())
+		if wait > 20 {
+			wait = 20
+		}
+		result, err := s.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(queue),
+			MaxNumberOfMessages:   aws.Int64(10),
+			MessageAttributeNames: []*string{aws.String(canaryAttribute)},
+			VisibilityTimeout:     aws.Int64(canaryVisibility),
+			WaitTimeSeconds:       aws.Int64(wait),
+		})
+		if err != nil {
+			t.roundTrip = time.Since(start)
+			return t, err
+		}
+		received := time.Now()
+		found := false
+		var others []string
+		for _, m := range result.Messages {
+			marker, ok := m.MessageAttributes[canaryAttribute]
+			if !ok {
+				others = append(others, aws.StringValue(m.ReceiptHandle))
+				continue
+			}
+			if aws.StringValue(marker.StringValue) == id {
+				found = true
+			}
+			if _, err := s.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: aws.String(queue), ReceiptHandle: m.ReceiptHandle}); err != nil {
+				log.Println("Error deleting a probe", err)
+			}
+		}
+		s.changeVisibilityBatch(queue, others, 0)
+		if found {
+			t.roundTrip, t.delivery = received.Sub(start), received.Sub(start)-t.send
+			return t, nil
+		}
+		if isInterrupted() {
+			break
+		}
+	}
+	t.roundTrip = time.Since(start)
+	return t, errProbeLost
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func canaryUsage() {
+	fmt.Println("usage: sqscli canary [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -interval         Probe continuously at this interval, until interrupted")
+	fmt.Println("  -timeout          Time a probe has to come back (default 30s)")
+	fmt.Println("  -max-latency      Alert when the round trip is longer")
+	fmt.Println("  -alert            Alert sink: sns:TOPIC_ARN, slack:WEBHOOK_URL, pagerduty:ROUTING_KEY or a webhook URL, repeatable")
+	os.Exit(0)
+}
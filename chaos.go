@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// failureRates fails a share of the SDK calls, set by the hidden -inject-failure flag
+// keys are lowercase operation names
+var failureRates map[string]float64
+
+// failureAliases are the short names accepted by -inject-failure
+var failureAliases = map[string][]string{
+	"send":       {"sendmessage", "sendmessagebatch"},
+	"receive":    {"receivemessage"},
+	"delete":     {"deletemessage", "deletemessagebatch"},
+	"visibility": {"changemessagevisibility", "changemessagevisibilitybatch"},
+}
+
+// - - - - - - - - - - - - - - - -
+//   FAULT INJECTION
+// - - - - - - - - - - - - - - - -
+
+// parseFailureRates parses a list like send:0.05,delete:0.02
+// names are aliases, operation names (GetQueueAttributes) or * for every call
+func parseFailureRates(raw string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, part := range strings.Split(raw, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q is not name:rate", part)
+		}
+		rate, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("%q: rate must be between 0 and 1", part)
+		}
+		name := strings.ToLower(kv[0])
+		if ops, ok := failureAliases[name]; ok {
+			for _, op := range ops {
+				rates[op] = rate
+			}
+			continue
+		}
+		rates[name] = rate
+	}
+	return rates, nil
+}
+
+// injectFailures makes the calls of every client created from the session fail at random
+// failed calls never reach AWS, like a request lost on the way
+func injectFailures(sess *session.Session, rates map[string]float64) {
+	sess.Handlers.Validate.PushBack(func(r *request.Request) {
+		rate, ok := rates[strings.ToLower(r.Operation.Name)]
+		if !ok {
+			rate, ok = rates["*"]
+		}
+		if !ok || rand.Float64() >= rate {
+			return
+		}
+		log.Printf("Injected failure on %s\n", r.Operation.Name)
+		r.Error = awserr.New("InjectedFailure", "failure injected by -inject-failure", nil)
+	})
+}
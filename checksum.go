@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Checksum verification modes
+const (
+	checksumOff  = "off"
+	checksumWarn = "warn"
+	checksumFail = "fail"
+)
+
+// checksumMode decides what happens on a MD5 mismatch, set by the -checksum flag
+var checksumMode = checksumWarn
+
+// - - - - - - - - - - - - - - - -
+//   CHECKSUMS
+// - - - - - - - - - - - - - - - -
+
+// checkChecksum reports a mismatch according to checksumMode
+func checkChecksum(what, id, expected, actual string) error {
+	if checksumMode == checksumOff || expected == actual {
+		return nil
+	}
+	err := fmt.Errorf("%s MD5 mismatch for message %s: expected %s, got %s", what, id, expected, actual)
+	if checksumMode == checksumFail {
+		return err
+	}
+	log.Println("Warning:", err)
+	return nil
+}
+
+// verifyReceived compares the checksums SQS returned with a received message
+func verifyReceived(m *sqs.Message) error {
+	id := aws.StringValue(m.MessageId)
+	if m.MD5OfBody != nil {
+		if err := checkChecksum("Body", id, md5OfBody(aws.StringValue(m.Body)), *m.MD5OfBody); err != nil {
+			return err
+		}
+	}
+	if m.MD5OfMessageAttributes != nil {
+		return checkChecksum("Attributes", id, md5OfMessageAttributes(m.MessageAttributes), *m.MD5OfMessageAttributes)
+	}
+	return nil
+}
+
+// verifySent compares the checksums SQS returned with the entries of a batch
+func verifySent(entries []*sqs.SendMessageBatchRequestEntry, results []*sqs.SendMessageBatchResultEntry) error {
+	byID := make(map[string]*sqs.SendMessageBatchRequestEntry, len(entries))
+	for _, e := range entries {
+		byID[*e.Id] = e
+	}
+	for _, r := range results {
+		e, ok := byID[aws.StringValue(r.Id)]
+		if !ok {
+			continue
+		}
+		if err := checkChecksum("Body", *e.Id, md5OfBody(aws.StringValue(e.MessageBody)), aws.StringValue(r.MD5OfMessageBody)); err != nil {
+			return err
+		}
+		if r.MD5OfMessageAttributes != nil {
+			if err := checkChecksum("Attributes", *e.Id, md5OfMessageAttributes(e.MessageAttributes), *r.MD5OfMessageAttributes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// md5OfBody returns the hex MD5 of a message body
+func md5OfBody(body string) string {
+	sum := md5.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// md5OfMessageAttributes returns the hex MD5 of message attributes
+// following the SQS encoding: attributes sorted by name, each one being
+// name, data type, transport type and value, all length prefixed
+func md5OfMessageAttributes(attrs map[string]*sqs.MessageAttributeValue) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := md5.New()
+	writeField := func(b []byte) {
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(b)))
+		h.Write(size)
+		h.Write(b)
+	}
+	for _, name := range names {
+		attr := attrs[name]
+		writeField([]byte(name))
+		writeField([]byte(aws.StringValue(attr.DataType)))
+		if attr.StringValue != nil {
+			h.Write([]byte{1})
+			writeField([]byte(*attr.StringValue))
+		} else {
+			h.Write([]byte{2})
+			writeField(attr.BinaryValue)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
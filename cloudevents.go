@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// cloudEventsVersion is the supported CloudEvents spec version
+	cloudEventsVersion = "1.0"
+	// cloudEventsType is the type of exported messages carrying none
+	cloudEventsType = "com.amazonaws.sqs.message"
+	// cloudEventsPrefix prefixes the message attributes holding event attributes,
+	// like the ce- headers of the HTTP binary mode
+	cloudEventsPrefix = "ce-"
+)
+
+// Modes of send -cloudevents
+const (
+	cloudEventsUnwrap   = "unwrap"
+	cloudEventsValidate = "validate"
+)
+
+// cloudEventsRequired are the attributes every event must have
+var cloudEventsRequired = []string{"specversion", "id", "source", "type"}
+
+// - - - - - - - - - - - - - - - -
+//   EXPORT
+// - - - - - - - - - - - - - - - -
+
+// formatCloudEvent outputs a message as a CloudEvents JSON line
+// events sent with -cloudevents unwrap get their attributes back,
+// others are wrapped with the message ID, queue and sent time
+func formatCloudEvent(m *sqs.Message, queue string, opts csvOptions) {
+	event := map[string]interface{}{
+		"specversion": cloudEventsVersion,
+		"id":          aws.StringValue(m.MessageId),
+		"source":      queue,
+		"type":        cloudEventsType,
+	}
+	if sent, ok := sentAt(m); ok {
+		event["time"] = sent.UTC().Format(time.RFC3339Nano)
+	}
+	if opts.annotate {
+		event["sqsqueue"] = opts.source.queue
+		event["sqsregion"] = opts.source.region
+		event["sqsaccount"] = opts.source.account
+		event["exportedat"] = opts.source.exportedAt
+	}
+	for name, value := range m.MessageAttributes {
+		if strings.HasPrefix(name, cloudEventsPrefix) && value.StringValue != nil {
+			event[strings.TrimPrefix(name, cloudEventsPrefix)] = *value.StringValue
+		}
+	}
+
+	body := opts.redact.apply(messageBody(m))
+	if json.Valid([]byte(body)) {
+		event["data"] = json.RawMessage(body)
+		if _, ok := event["datacontenttype"]; !ok {
+			event["datacontenttype"] = "application/json"
+		}
+	} else {
+		event["data"] = body
+		if _, ok := event["datacontenttype"]; !ok {
+			event["datacontenttype"] = "text/plain"
+		}
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Fatal("Error encoding event ", err)
+	}
+	fmt.Fprintln(output, string(b))
+}
+
+// - - - - - - - - - - - - - - - -
+//   IMPORT
+// - - - - - - - - - - - - - - - -
+
+// parseCloudEvent checks a body is a CloudEvents 1.0 JSON event
+func parseCloudEvent(body string) (map[string]json.RawMessage, error) {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return nil, fmt.Errorf("not a JSON event: %s", err)
+	}
+	for _, name := range cloudEventsRequired {
+		var value string
+		if json.Unmarshal(event[name], &value) != nil || len(value) == 0 {
+			return nil, fmt.Errorf("missing required attribute %q", name)
+		}
+	}
+	var version string
+	json.Unmarshal(event["specversion"], &version)
+	if version != cloudEventsVersion {
+		return nil, fmt.Errorf("unsupported specversion %q", version)
+	}
+	if _, ok := event["data_base64"]; ok {
+		if _, ok := event["data"]; ok {
+			return nil, fmt.Errorf("both data and data_base64 are set")
+		}
+	}
+	return event, nil
+}
+
+// cloudEventTime returns the time of an event, false when it has none or it is not RFC3339
+func cloudEventTime(event map[string]json.RawMessage) (time.Time, bool) {
+	var raw string
+	if json.Unmarshal(event["time"], &raw) != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	return t, err == nil
+}
+
+// unwrapCloudEvent returns the data of an event as the body, and its other
+// attributes as ce- message attributes
+func unwrapCloudEvent(event map[string]json.RawMessage) (string, map[string]*sqs.MessageAttributeValue, error) {
+	var body string
+	switch {
+	case event["data_base64"] != nil:
+		var encoded string
+		if err := json.Unmarshal(event["data_base64"], &encoded); err != nil {
+			return "", nil, fmt.Errorf("data_base64 is not a string")
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", nil, fmt.Errorf("data_base64: %s", err)
+		}
+		body = string(data)
+	case event["data"] != nil:
+		// A JSON string is the data itself, anything else is sent as JSON
+		if json.Unmarshal(event["data"], &body) != nil {
+			body = string(event["data"])
+		}
+	}
+	if len(body) == 0 {
+		return "", nil, fmt.Errorf("no data to send")
+	}
+
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(event))
+	for name := range event {
+		if name == "data" || name == "data_base64" {
+			continue
+		}
+		var value interface{}
+		json.Unmarshal(event[name], &value)
+		attrs[cloudEventsPrefix+name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(fmt.Sprint(value)),
+		}
+	}
+	return body, attrs, nil
+}
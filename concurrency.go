@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// concurrencyAuto is the -concurrency value scaling the receivers automatically
+	concurrencyAuto = "auto"
+	// adaptiveReceivers is the number of receivers scaled automatically
+	adaptiveReceivers = -1
+	// maxReceivers bounds the receivers of a stage
+	maxReceivers = 32
+	// scaleInterval is how often automatic concurrency is reconsidered
+	scaleInterval = 2 * time.Second
+	// scaleUpRatio adds a receiver below this share of short receives
+	scaleUpRatio = 0.2
+	// scaleDownRatio removes a receiver above this share of short receives
+	scaleDownRatio = 0.5
+)
+
+// throttled counts the requests throttled by AWS, retried by the SDK
+var throttled int64
+
+// autoscaler sizes the receivers of a stage from what the last receives saw
+// short receives, returning less than a full batch, mean the queue can't feed more receivers
+// throttling halves the receivers, like TCP backs off on congestion
+type autoscaler struct {
+	target    int32
+	receives  int64
+	short     int64
+	throttled int64 // Value of throttled at the last adjustment
+}
+
+// - - - - - - - - - - - - - - - -
+//   CONCURRENT RECEIVES
+// - - - - - - - - - - - - - - - -
+
+// parseConcurrency parses -concurrency, a number of receivers or auto
+func parseConcurrency(raw string) (int, error) {
+	if raw == concurrencyAuto {
+		return adaptiveReceivers, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 || n > maxReceivers {
+		return 0, fmt.Errorf("concurrency must be auto or between 1 and %d", maxReceivers)
+	}
+	return n, nil
+}
+
+// countThrottles counts the throttled requests of a session
+func countThrottles(sess *session.Session) {
+	sess.Handlers.Retry.PushBack(func(r *request.Request) {
+		if request.IsErrorThrottle(r.Error) {
+			atomic.AddInt64(&throttled, 1)
+		}
+	})
+}
+
+// receiveConcurrently runs receivers calling next until one reports the queue exhausted
+// next returns a batch, the number of messages received and whether the queue is exhausted
+// adaptiveReceivers starts with one receiver and scales them automatically
+func receiveConcurrently(workers int, next func() ([]*sqs.Message, int, bool), out chan<- []*sqs.Message) {
+	adaptive := workers == adaptiveReceivers
+	if adaptive {
+		workers = 1
+	}
+	a := &autoscaler{target: int32(workers), throttled: atomic.LoadInt64(&throttled)}
+
+	done := make(chan struct{})
+	var once sync.Once
+	var wg sync.WaitGroup
+	receiver := func(id int32) {
+		defer wg.Done()
+		for !isInterrupted() && id < atomic.LoadInt32(&a.target) {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			batch, n, exhausted := next()
+			a.observe(n)
+			if exhausted {
+				once.Do(func() { close(done) })
+				return
+			}
+			if len(batch) > 0 {
+				out <- batch
+			}
+		}
+	}
+
+	running := int32(0)
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+	for {
+		// Receivers above the target stop by themselves
+		if target := atomic.LoadInt32(&a.target); running != target {
+			for ; running < target; running++ {
+				wg.Add(1)
+				go receiver(running)
+			}
+			running = target
+		}
+		select {
+		case <-done:
+			wg.Wait()
+			return
+		case <-ticker.C:
+			if isInterrupted() {
+				wg.Wait()
+				return
+			}
+			if adaptive {
+				a.adjust()
+			}
+		}
+	}
+}
+
+// observe records a receive of n messages
+func (a *autoscaler) observe(n int) {
+	atomic.AddInt64(&a.receives, 1)
+	if n < 10 {
+		atomic.AddInt64(&a.short, 1)
+	}
+}
+
+// adjust sets the target from the receives since the last adjustment
+func (a *autoscaler) adjust() {
+	receives := atomic.SwapInt64(&a.receives, 0)
+	short := atomic.SwapInt64(&a.short, 0)
+	now := atomic.LoadInt64(&throttled)
+	throttles := now - a.throttled
+	a.throttled = now
+	if receives == 0 {
+		return
+	}
+
+	ratio := float64(short) / float64(receives)
+	current := atomic.LoadInt32(&a.target)
+	target := current
+	switch {
+	case throttles > 0:
+		target = current / 2
+	case ratio > scaleDownRatio:
+		target = current - 1
+	case ratio < scaleUpRatio:
+		target = current + 1
+	}
+	if target < 1 {
+		target = 1
+	}
+	if target > maxReceivers {
+		target = maxReceivers
+	}
+	if target != current {
+		atomic.StoreInt32(&a.target, target)
+		log.Printf("Receivers: %d -> %d (%.0f%% short receives, %d throttled)\n", current, target, ratio*100, throttles)
+	}
+}
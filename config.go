@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"gopkg.in/yaml.v3"
+)
+
+// configAttributes are the queue attributes that can be set, hence exported
+var configAttributes = []string{
+	"DelaySeconds",
+	"MaximumMessageSize",
+	"MessageRetentionPeriod",
+	"Policy",
+	"ReceiveMessageWaitTimeSeconds",
+	"RedrivePolicy",
+	"RedriveAllowPolicy",
+	"VisibilityTimeout",
+	"KmsMasterKeyId",
+	"KmsDataKeyReusePeriodSeconds",
+	"SqsManagedSseEnabled",
+	"FifoQueue",
+	"ContentBasedDeduplication",
+	"DeduplicationScope",
+	"FifoThroughputLimit",
+}
+
+// jsonAttributes hold JSON documents, compared once normalized
+var jsonAttributes = map[string]bool{
+	"Policy":             true,
+	"RedrivePolicy":      true,
+	"RedriveAllowPolicy": true,
+}
+
+// queueConfig is the declarative description of a queue
+type queueConfig struct {
+	Name       string            `json:"name" yaml:"name"`
+	Attributes map[string]string `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+}
+
+// queueConfigFile is the content of a config export
+type queueConfigFile struct {
+	Queues []queueConfig `json:"queues" yaml:"queues"`
+}
+
+// configChange is a step of a config apply plan
+type configChange struct {
+	queue  string
+	create bool
+	attrs  map[string]string // Attributes to set
+	tags   map[string]string // Tags to add or change
+	untags []string          // Tags to remove
+	errors []string          // Changes that can't be applied
+	diff   []string          // Human readable changes
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// config dispatches the config subcommands
+func config(args []string) {
+	if len(args) == 0 {
+		configUsage()
+	}
+	switch args[0] {
+	case "export":
+		configExport(args[1:])
+	case "apply":
+		configApply(args[1:])
+	case "to-terraform", "to-cloudformation":
+		configToIaC(args[0], args[1:])
+	default:
+		configUsage()
+	}
+}
+
+// configExport dumps the configuration of queues as YAML or JSON
+func configExport(args []string) {
+	exportCommand := flag.NewFlagSet("config export", flag.ExitOnError)
+	queueName := exportCommand.String("queue", "*", "queue name or pattern")
+	exportCommand.StringVar(queueName, "q", "*", "queue name or pattern") // Aliasing
+	format := exportCommand.String("format", "yaml", "output format: yaml or json")
+	exportHelp := exportCommand.Bool("help", false, "help for config export command")
+	exportCommand.BoolVar(exportHelp, "h", false, "help") // Aliasing
+	parseFlags(exportCommand, args)
+
+	if *exportHelp {
+		configUsage()
+	}
+	if *format != "yaml" && *format != "json" {
+		fmt.Println("Format must be yaml or json.")
+		configUsage()
+	}
+
+	// Connect
+	svc := newService()
+
+	var file queueConfigFile
+	for _, qURL := range svc.resolveQueues(*queueName) {
+		file.Queues = append(file.Queues, svc.queueConfig(qURL))
+	}
+	writeConfigFile(os.Stdout, file, *format)
+}
+
+// configApply creates or updates queues to match a config file
+func configApply(args []string) {
+	applyCommand := flag.NewFlagSet("config apply", flag.ExitOnError)
+	configFile := applyCommand.String("file", "", "config file, YAML or JSON")
+	applyCommand.StringVar(configFile, "f", "", "config file, YAML or JSON") // Aliasing
+	plan := applyCommand.Bool("plan", false, "only print the changes")
+	yes := applyCommand.Bool("yes", false, "don't ask for confirmation")
+	applyHelp := applyCommand.Bool("help", false, "help for config apply command")
+	applyCommand.BoolVar(applyHelp, "h", false, "help") // Aliasing
+	parseFlags(applyCommand, args)
+
+	if *applyHelp {
+		configUsage()
+	}
+	if len(*configFile) == 0 {
+		fmt.Println("Required config file is missing.")
+		configUsage()
+	}
+
+	file := readConfigFile(*configFile)
+
+	// Connect
+	svc := newService()
+
+	// Plan
+	var changes []configChange
+	invalid := false
+	for _, want := range file.Queues {
+		c := svc.planQueueConfig(want)
+		for _, line := range c.diff {
+			fmt.Println(line)
+		}
+		for _, e := range c.errors {
+			fmt.Printf("! %s: %s\n", c.queue, e)
+			invalid = true
+		}
+		if c.create || len(c.attrs) > 0 || len(c.tags) > 0 || len(c.untags) > 0 {
+			changes = append(changes, c)
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+	if invalid {
+		log.Fatal("The plan contains changes that can't be applied")
+	}
+	if *plan || (!*yes && !confirm(fmt.Sprintf("Apply changes to %d queues?", len(changes)))) {
+		return
+	}
+
+	// Apply
+	for _, c := range changes {
+		svc.applyQueueConfig(c)
+		fmt.Printf("%s applied\n", c.queue)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// writeConfigFile encodes a config file as yaml or json
+func writeConfigFile(w *os.File, file queueConfigFile, format string) {
+	var err error
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(file)
+	} else {
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		err = enc.Encode(file)
+	}
+	if err != nil {
+		log.Fatal("Error writing config ", err)
+	}
+}
+
+// readConfigFile decodes a YAML or JSON config file
+func readConfigFile(name string) queueConfigFile {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		log.Fatal("Error reading config ", err)
+	}
+	// YAML is a superset of JSON
+	var file queueConfigFile
+	if err := yaml.Unmarshal(raw, &file); err != nil {
+		log.Fatal("Error parsing config ", err)
+	}
+	return file
+}
+
+// planQueueConfig compares a wanted config with the queue as it is
+func (s *service) planQueueConfig(want queueConfig) configChange {
+	c := configChange{queue: want.Name, attrs: map[string]string{}, tags: map[string]string{}}
+
+	qURL, ok := s.lookupQueueURL(want.Name)
+	if !ok {
+		c.create = true
+		c.attrs = want.Attributes
+		c.tags = want.Tags
+		c.diff = append(c.diff, fmt.Sprintf("+ %s (create)", want.Name))
+		for _, name := range sortedKeys(want.Attributes) {
+			c.diff = append(c.diff, fmt.Sprintf("    %s = %s", name, want.Attributes[name]))
+		}
+		for _, name := range sortedKeys(want.Tags) {
+			c.diff = append(c.diff, fmt.Sprintf("    tag %s = %s", name, want.Tags[name]))
+		}
+		return c
+	}
+
+	have := s.queueConfig(qURL)
+	for _, name := range sortedKeys(want.Attributes) {
+		value := want.Attributes[name]
+		if sameAttribute(name, have.Attributes[name], value) {
+			continue
+		}
+		if name == "FifoQueue" {
+			c.errors = append(c.errors, "FifoQueue can't be changed after creation")
+			continue
+		}
+		c.attrs[name] = value
+		c.diff = append(c.diff, fmt.Sprintf("~ %s %s: %q -> %q", want.Name, name, have.Attributes[name], value))
+	}
+	for _, name := range sortedKeys(want.Tags) {
+		if have.Tags[name] != want.Tags[name] {
+			c.tags[name] = want.Tags[name]
+			c.diff = append(c.diff, fmt.Sprintf("~ %s tag %s: %q -> %q", want.Name, name, have.Tags[name], want.Tags[name]))
+		}
+	}
+	for _, name := range sortedKeys(have.Tags) {
+		if _, ok := want.Tags[name]; !ok {
+			c.untags = append(c.untags, name)
+			c.diff = append(c.diff, fmt.Sprintf("- %s tag %s", want.Name, name))
+		}
+	}
+	return c
+}
+
+// sameAttribute compares attribute values, JSON documents are normalized first
+func sameAttribute(name, a, b string) bool {
+	if !jsonAttributes[name] || a == b {
+		return a == b
+	}
+	var bufA, bufB bytes.Buffer
+	if json.Compact(&bufA, []byte(a)) != nil || json.Compact(&bufB, []byte(b)) != nil {
+		return false
+	}
+	var docA, docB interface{}
+	json.Unmarshal(bufA.Bytes(), &docA)
+	json.Unmarshal(bufB.Bytes(), &docB)
+	// Re-encoding sorts the keys
+	encA, _ := json.Marshal(docA)
+	encB, _ := json.Marshal(docB)
+	return bytes.Equal(encA, encB)
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// queueConfig returns the settable attributes and tags of a queue
+func (s *service) queueConfig(qURL string) queueConfig {
+	attrs := s.getQueueAttributes(qURL).Attributes
+	c := queueConfig{
+		Name:       queueNameFromURL(qURL),
+		Attributes: map[string]string{},
+		Tags:       s.queueTags(qURL),
+	}
+	for _, name := range configAttributes {
+		if v, ok := attrs[name]; ok {
+			c.Attributes[name] = aws.StringValue(v)
+		}
+	}
+	return c
+}
+
+// queueTags returns the tags of a queue
+func (s *service) queueTags(qURL string) map[string]string {
+	result, err := s.ListQueueTags(&sqs.ListQueueTagsInput{QueueUrl: aws.String(qURL)})
+	if err != nil {
+		log.Fatalf("Error fetching tags of %s: %s\n", qURL, err)
+	}
+	return aws.StringValueMap(result.Tags)
+}
+
+// lookupQueueURL is getQueueURL for queues that may not exist
+func (s *service) lookupQueueURL(name string) (string, bool) {
+	queueInfo, err := s.GetQueueUrl(&sqs.GetQueueUrlInput{
+		QueueName: aws.String(name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == sqs.ErrCodeQueueDoesNotExist {
+		return "", false
+	}
+	if err != nil {
+		log.Fatalf("Error finding queue %s: %s\n", name, err)
+	}
+	return *queueInfo.QueueUrl, true
+}
+
+// applyQueueConfig executes a planned change
+func (s *service) applyQueueConfig(c configChange) {
+	if c.create {
+		input := &sqs.CreateQueueInput{
+			QueueName:  aws.String(c.queue),
+			Attributes: aws.StringMap(c.attrs),
+		}
+		if len(c.tags) > 0 {
+			input.Tags = aws.StringMap(c.tags)
+		}
+		if _, err := s.CreateQueue(input); err != nil {
+			log.Fatalf("Error creating queue %s: %s\n", c.queue, err)
+		}
+		return
+	}
+
+	qURL := s.getQueueURL(c.queue)
+	if len(c.attrs) > 0 {
+		_, err := s.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+			QueueUrl:   aws.String(qURL),
+			Attributes: aws.StringMap(c.attrs),
+		})
+		if err != nil {
+			log.Fatalf("Error updating queue %s: %s\n", c.queue, err)
+		}
+	}
+	if len(c.tags) > 0 {
+		_, err := s.TagQueue(&sqs.TagQueueInput{QueueUrl: aws.String(qURL), Tags: aws.StringMap(c.tags)})
+		if err != nil {
+			log.Fatalf("Error tagging queue %s: %s\n", c.queue, err)
+		}
+	}
+	if len(c.untags) > 0 {
+		_, err := s.UntagQueue(&sqs.UntagQueueInput{QueueUrl: aws.String(qURL), TagKeys: aws.StringSlice(c.untags)})
+		if err != nil {
+			log.Fatalf("Error untagging queue %s: %s\n", c.queue, err)
+		}
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func configUsage() {
+	fmt.Println("usage: sqscli config <export|apply|to-terraform|to-cloudformation> [options]")
+	fmt.Println("export options:")
+	fmt.Println("  -queue            Queue name or pattern (default all queues)")
+	fmt.Println("  -format           Output format, yaml or json (default yaml)")
+	fmt.Println("apply options:")
+	fmt.Println("  -file required    Config file, YAML or JSON")
+	fmt.Println("  -plan             Only print the changes")
+	fmt.Println("  -yes              Don't ask for confirmation")
+	fmt.Println("to-terraform / to-cloudformation options:")
+	fmt.Println("  -queue            Queue name or pattern (default all queues)")
+	fmt.Println("  -file             Render a config file instead of live queues")
+	fmt.Println("  -format           CloudFormation format, yaml or json (default yaml)")
+	os.Exit(0)
+}
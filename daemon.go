@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// scheduleContinuous runs a job again whenever it exits, like a forwarder
+	scheduleContinuous = "@continuous"
+	// maxRestartDelay bounds the backoff of continuous jobs exiting in a loop
+	maxRestartDelay = time.Minute
+	// alertOutputLines is how much of the output of a failed job its alert carries
+	alertOutputLines = 20
+	// jobStopTimeout is how long stopped jobs get to finish their in-flight messages
+	jobStopTimeout = 2 * time.Minute
+)
+
+// daemonConfig is the config file of the daemon
+type daemonConfig struct {
+	Health   string          `yaml:"health"` // Listen address of the health endpoints, like :8080
+	Jobs     []daemonJob     `yaml:"jobs"`
+	Redrives []daemonRedrive `yaml:"redrives"` // DLQs redriven back to their source queue, see redrive.go
+}
+
+// daemonJob is a sqscli command run on a schedule
+type daemonJob struct {
+	Name     string   `yaml:"name"`
+	Schedule string   `yaml:"schedule"` // Crontab line, @hourly, @every 10m or @continuous
+	Command  []string `yaml:"command"`  // sqscli command and its arguments
+	Output   string   `yaml:"output"`   // File the standard output is appended to, logged otherwise
+	Alert    string   `yaml:"alert"`    // Sink alerted when the job fails, see parseAlertSink
+	schedule *cronSchedule
+}
+
+// jobStatus is the state of a job served by the /jobs endpoint
+type jobStatus struct {
+	Name         string     `json:"name"`
+	Schedule     string     `json:"schedule"`
+	Running      bool       `json:"running"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	LastStart    *time.Time `json:"lastStart,omitempty"`
+	LastDuration string     `json:"lastDuration,omitempty"`
+	LastExitCode *int       `json:"lastExitCode,omitempty"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+}
+
+// jobAlert is the body posted to the alert webhook of a failed job
+type jobAlert struct {
+	Job      string   `json:"job"`
+	Command  []string `json:"command"`
+	ExitCode int      `json:"exitCode"`
+	Started  string   `json:"started"`
+	Duration string   `json:"duration"`
+	Output   []string `json:"output"` // Last lines of the output
+}
+
+// scheduler runs the jobs of a daemon
+type scheduler struct {
+	exe     string   // The sqscli binary
+	globals []string // Global options of the daemon, passed on to the jobs
+	mu      sync.Mutex
+	status  map[string]*jobStatus
+	running map[string]*exec.Cmd
+	wg      sync.WaitGroup
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// daemon runs the jobs of a config file on their schedules until interrupted
+// each run is a sqscli process of its own, so a failing job can't take the daemon down
+// install, uninstall and status manage the daemon registered as a service
+func daemon(args []string) {
+	if len(args) > 0 && (args[0] == "install" || args[0] == "uninstall" || args[0] == "status") {
+		daemonService(args[0], args[1:])
+		return
+	}
+	daemonCommand := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configFile := daemonCommand.String("config", "", "YAML file defining the jobs and redrives")
+	envFile := daemonCommand.String("env-file", "", "file of KEY=VALUE environment variables passed to the jobs")
+	serviceName := daemonCommand.String("service", "", "name of the service running the daemon, set by daemon install")
+	daemonHelp := daemonCommand.Bool("help", false, "help for daemon command")
+	daemonCommand.BoolVar(daemonHelp, "h", false, "help") // Aliasing
+	parseFlags(daemonCommand, args)
+
+	if *daemonHelp {
+		daemonUsage()
+	}
+
+	// Verify
+	if len(*configFile) == 0 {
+		fmt.Println("Required config file is missing.")
+		daemonUsage()
+	}
+	config, err := loadDaemonConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*envFile) > 0 {
+		vars, err := loadEnvFile(*envFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Jobs inherit the environment
+		for k, v := range vars {
+			os.Setenv(k, v)
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal("Error locating the sqscli binary ", err)
+	}
+
+	s := &scheduler{
+		exe: exe,
+		// Everything before the command name, but the health endpoints are the daemon's
+		globals: withoutFlag(os.Args[1:len(os.Args)-len(flag.Args())], "health"),
+		status:  make(map[string]*jobStatus),
+		running: make(map[string]*exec.Cmd),
+	}
+	os.Unsetenv(envName("", "health"))
+	if len(config.Health) > 0 {
+		healthAddr = config.Health
+	}
+	handleInterrupts()
+	// Every status is in place before the jobs and the health endpoints read it
+	for _, job := range config.Jobs {
+		s.status[job.Name] = &jobStatus{Name: job.Name, Schedule: job.Schedule}
+	}
+	for _, r := range config.Redrives {
+		s.status[r.Name] = &jobStatus{Name: r.Name, Schedule: "@every " + r.every.String()}
+	}
+	run := func() {
+		if len(healthAddr) > 0 {
+			serveHealth(healthAddr, map[string]http.HandlerFunc{"/jobs": s.serveJobs})
+		}
+		for i := range config.Jobs {
+			s.wg.Add(1)
+			go s.schedule(config.Jobs[i])
+		}
+		if len(config.Redrives) > 0 {
+			svc := newService()
+			for _, r := range config.Redrives {
+				s.wg.Add(1)
+				go s.watchRedrive(r, svc)
+			}
+		}
+		markReady()
+		log.Printf("Daemon started, %d jobs, %d redrives\n", len(config.Jobs), len(config.Redrives))
+
+		<-interrupted
+		s.stopJobs()
+		s.wg.Wait()
+		log.Println("Daemon stopped")
+	}
+	// Windows services report to the service manager, which stops them
+	if len(*serviceName) == 0 || !runService(*serviceName, run) {
+		run()
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// loadDaemonConfig reads and checks a daemon config file
+func loadDaemonConfig(file string) (*daemonConfig, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config daemonConfig
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %s", file, err)
+	}
+	if len(config.Jobs) == 0 && len(config.Redrives) == 0 {
+		return nil, fmt.Errorf("no job or redrive in %s", file)
+	}
+	names := make(map[string]bool)
+	for i := range config.Jobs {
+		job := &config.Jobs[i]
+		if len(job.Name) == 0 || names[job.Name] {
+			return nil, fmt.Errorf("job %d of %s needs a unique name", i+1, file)
+		}
+		names[job.Name] = true
+		if len(job.Command) == 0 || job.Command[0] == "daemon" {
+			return nil, fmt.Errorf("job %s needs a sqscli command", job.Name)
+		}
+		if len(job.Alert) > 0 {
+			if _, err := parseAlertSink(job.Alert, nil); err != nil {
+				return nil, fmt.Errorf("job %s: %s", job.Name, err)
+			}
+		}
+		if job.Schedule != scheduleContinuous {
+			if job.schedule, err = parseSchedule(job.Schedule); err != nil {
+				return nil, fmt.Errorf("job %s: %s", job.Name, err)
+			}
+		}
+	}
+	for i := range config.Redrives {
+		r := &config.Redrives[i]
+		if len(r.Name) == 0 || names[r.Name] {
+			return nil, fmt.Errorf("redrive %d of %s needs a name unique among jobs and redrives", i+1, file)
+		}
+		names[r.Name] = true
+		if err := r.check(); err != nil {
+			return nil, fmt.Errorf("redrive %s: %s", r.Name, err)
+		}
+	}
+	return &config, nil
+}
+
+// schedule runs a job at each time of its schedule, or again whenever it exits
+// a run still going at its next time skips it, runs of a job never overlap
+func (s *scheduler) schedule(job daemonJob) {
+	defer s.wg.Done()
+	restartDelay := time.Second
+	for !isInterrupted() {
+		if job.schedule == nil {
+			start := time.Now()
+			s.run(job)
+			// Backs off while the job exits right away, a run of a while resets the delay
+			if time.Since(start) > maxRestartDelay {
+				restartDelay = time.Second
+			}
+			s.setNextRun(job.Name, time.Now().Add(restartDelay))
+			if !sleepUnlessInterrupted(restartDelay) {
+				return
+			}
+			if restartDelay *= 2; restartDelay > maxRestartDelay {
+				restartDelay = maxRestartDelay
+			}
+			continue
+		}
+
+		next := job.schedule.next(time.Now())
+		if next.IsZero() {
+			log.Printf("[%s] Schedule %q never matches, job disabled\n", job.Name, job.Schedule)
+			return
+		}
+		s.setNextRun(job.Name, next)
+		if !sleepUnlessInterrupted(time.Until(next)) {
+			return
+		}
+		s.run(job)
+	}
+}
+
+// run runs a job once and waits for it
+// a failure is alerted, unless the daemon is stopping
+func (s *scheduler) run(job daemonJob) {
+	cmd := exec.Command(s.exe, append(append([]string{}, s.globals...), job.Command...)...)
+	tail := &lineTail{max: alertOutputLines}
+	var logs sync.WaitGroup
+	stderr, _ := cmd.StderrPipe()
+	logs.Add(1)
+	go tail.log(job.Name, stderr, &logs)
+	if len(job.Output) > 0 {
+		f, err := os.OpenFile(job.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("[%s] Error opening output: %s\n", job.Name, err)
+			return
+		}
+		defer f.Close()
+		cmd.Stdout = f
+	} else {
+		stdout, _ := cmd.StdoutPipe()
+		logs.Add(1)
+		go tail.log(job.Name, stdout, &logs)
+	}
+	isolateJob(cmd)
+
+	start := time.Now()
+	s.mu.Lock()
+	if isInterrupted() {
+		s.mu.Unlock()
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		s.mu.Unlock()
+		log.Printf("[%s] Error starting: %s\n", job.Name, err)
+		return
+	}
+	s.running[job.Name] = cmd
+	status := s.status[job.Name]
+	failing := status.LastExitCode != nil && *status.LastExitCode != 0
+	status.Running, status.LastStart, status.NextRun = true, &start, nil
+	status.Runs++
+	s.mu.Unlock()
+	log.Printf("[%s] Started: %s\n", job.Name, strings.Join(job.Command, " "))
+
+	logs.Wait()
+	cmd.Wait()
+	duration := time.Since(start).Round(time.Millisecond)
+	code := cmd.ProcessState.ExitCode()
+
+	s.mu.Lock()
+	delete(s.running, job.Name)
+	status.Running, status.LastDuration, status.LastExitCode = false, duration.String(), &code
+	if code != 0 {
+		status.Failures++
+	}
+	s.mu.Unlock()
+	log.Printf("[%s] Exited with %d after %s\n", job.Name, code, duration)
+
+	if len(job.Alert) == 0 || isInterrupted() {
+		return
+	}
+	// A success after failures resolves the alert
+	if code != 0 || failing {
+		s.alert(job, alert{
+			key:      "sqscli/job/" + job.Name,
+			summary:  fmt.Sprintf("Job %s exited with %d", job.Name, code),
+			resolved: code == 0,
+			details: jobAlert{
+				Job:      job.Name,
+				Command:  job.Command,
+				ExitCode: code,
+				Started:  start.Format(time.RFC3339),
+				Duration: duration.String(),
+				Output:   tail.lines(),
+			},
+		})
+	}
+}
+
+// alert notifies the sink of the job of a failed run, or of the run succeeding after failures
+// webhooks only receive failures
+func (s *scheduler) alert(job daemonJob, a alert) {
+	var sess *session.Session
+	if strings.HasPrefix(job.Alert, alertSNS) {
+		sess = regionSession(awsRegion)
+	}
+	sink, err := parseAlertSink(job.Alert, sess)
+	if err != nil {
+		log.Printf("[%s] Error alerting: %s\n", job.Name, err)
+		return
+	}
+	if a.resolved && sink.kind == alertWebhook {
+		return
+	}
+	if err := sink.send(a); err != nil {
+		log.Printf("[%s] Error alerting: %s\n", job.Name, err)
+	}
+}
+
+// stopJobs asks the running jobs to stop, they finish their in-flight messages
+// jobs still running after jobStopTimeout are killed
+func (s *scheduler) stopJobs() {
+	s.mu.Lock()
+	for name, cmd := range s.running {
+		log.Printf("[%s] Stopping\n", name)
+		stopJob(cmd)
+	}
+	s.mu.Unlock()
+	go func() {
+		time.Sleep(jobStopTimeout)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for name, cmd := range s.running {
+			log.Printf("[%s] Still running, killed\n", name)
+			cmd.Process.Kill()
+		}
+	}()
+}
+
+// setNextRun records when a job runs next
+func (s *scheduler) setNextRun(name string, next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status[name].NextRun = &next
+}
+
+// serveJobs serves the state of every job
+func (s *scheduler) serveJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := make([]jobStatus, 0, len(s.status))
+	for _, st := range s.status {
+		jobs = append(jobs, *st)
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// withoutFlag removes a flag and its value from command line arguments
+func withoutFlag(args []string, name string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		a := strings.TrimLeft(args[i], "-")
+		switch {
+		case a == name && len(a) < len(args[i]):
+			i++ // The value follows
+		case strings.HasPrefix(a, name+"=") && len(a) < len(args[i]):
+		default:
+			kept = append(kept, args[i])
+		}
+	}
+	return kept
+}
+
+// sleepUnlessInterrupted waits for d, false if the daemon was stopped meanwhile
+func sleepUnlessInterrupted(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-interrupted:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// lineTail logs the lines of a job output and keeps the last ones
+type lineTail struct {
+	mu   sync.Mutex
+	max  int
+	last []string
+}
+
+// log logs each line of r prefixed by the job name
+func (t *lineTail) log(name string, r io.Reader, done *sync.WaitGroup) {
+	defer done.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.Printf("[%s] %s\n", name, line)
+		t.mu.Lock()
+		if t.last = append(t.last, line); len(t.last) > t.max {
+			t.last = t.last[1:]
+		}
+		t.mu.Unlock()
+	}
+}
+
+// lines returns the last lines logged
+func (t *lineTail) lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.last...)
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func daemonUsage() {
+	fmt.Println("usage: sqscli daemon [options]")
+	fmt.Println("       sqscli daemon install|uninstall|status [options]")
+	fmt.Println("options:")
+	fmt.Println("  -config required   YAML file defining the jobs, redrives and health endpoint (daemon and install)")
+	fmt.Println("  -env-file          File of KEY=VALUE environment variables like AWS credentials (daemon and install)")
+	fmt.Println("  -name              Name of the systemd unit or Windows service (default sqscli)")
+	fmt.Println("  -user              Account the service runs as (install only, default root or LocalSystem)")
+	os.Exit(0)
+}
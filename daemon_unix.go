@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// isolateJob starts a job in a process group of its own
+// so a Ctrl-C in the terminal reaches the daemon only, which stops the jobs itself
+func isolateJob(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// stopJob asks a job to finish its in-flight messages and exit
+func stopJob(cmd *exec.Cmd) {
+	cmd.Process.Signal(os.Interrupt)
+}
+
+// shellCommand runs a command line with sh
+func shellCommand(ctx context.Context, line string) *exec.Cmd {
+	return exec.CommandContext(ctx, "sh", "-c", line)
+}
@@ -0,0 +1,27 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// createNewProcessGroup keeps the Ctrl-C of the console from reaching a job
+const createNewProcessGroup = 0x00000200
+
+// isolateJob starts a job in a process group of its own
+func isolateJob(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: createNewProcessGroup}
+}
+
+// stopJob stops a job, Windows can't deliver an interrupt to another process group
+func stopJob(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// shellCommand runs a command line with cmd
+func shellCommand(ctx context.Context, line string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", line)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/jmespath/go-jmespath"
+)
+
+// Keys of -dedupe-by
+const (
+	dedupeBodyHash  = "body-hash"
+	dedupeMessageID = "message-id"
+	dedupeJMESPath  = "jmespath:"
+	dedupeExpr      = "expr:"
+)
+
+// deduper remembers the keys of the messages already sent and skips the others
+// keys are kept in memory, and appended to a state file so a re-run
+// of a partially failed operation doesn't send them again
+type deduper struct {
+	mu    sync.Mutex
+	by    string
+	query *jmespath.JMESPath // For jmespath keys
+	expr  *expression        // For expr keys
+	seen  map[string]bool
+	f     *os.File
+}
+
+// - - - - - - - - - - - - - - - -
+//   DEDUPLICATION
+// - - - - - - - - - - - - - - - -
+
+// newDeduper parses a -dedupe-by value and loads the keys of the state file
+// an empty state file keeps the keys in memory only
+func newDeduper(by, stateFile string) (*deduper, error) {
+	d := &deduper{by: by, seen: make(map[string]bool)}
+	switch {
+	case by == dedupeBodyHash || by == dedupeMessageID:
+	case strings.HasPrefix(by, dedupeJMESPath):
+		query, err := jmespath.Compile(by[len(dedupeJMESPath):])
+		if err != nil {
+			return nil, fmt.Errorf("dedupe key %q: %s", by, err)
+		}
+		d.query = query
+	case strings.HasPrefix(by, dedupeExpr):
+		e, err := compileExpression(by[len(dedupeExpr):])
+		if err != nil {
+			return nil, fmt.Errorf("dedupe key: %s", err)
+		}
+		d.expr = e
+	default:
+		return nil, fmt.Errorf("dedupe key %q: expected body-hash, message-id, jmespath:QUERY or expr:EXPRESSION", by)
+	}
+	if len(stateFile) == 0 {
+		return d, nil
+	}
+
+	if f, err := os.Open(stateFile); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			d.seen[scanner.Text()] = true
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(stateFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	d.f = f
+	if len(d.seen) > 0 {
+		log.Printf("%d keys already sent loaded from %s\n", len(d.seen), stateFile)
+	}
+	return d, nil
+}
+
+// key returns the deduplication key of a message to send
+// messages without key (no ID, or no value at the path) are never skipped
+func (d *deduper) key(body, messageID string) (string, bool) {
+	return d.keyOf(&sqs.Message{MessageId: aws.String(messageID)}, body)
+}
+
+// keyOf returns the deduplication key of a message and its body
+// expressions see the attributes of received messages, a null value is no key
+func (d *deduper) keyOf(m *sqs.Message, body string) (string, bool) {
+	var raw string
+	messageID := aws.StringValue(m.MessageId)
+	switch {
+	case d.by == dedupeMessageID:
+		if len(messageID) == 0 {
+			return "", false
+		}
+		raw = messageID
+	case d.query != nil:
+		// Single values are keyed as a list, like the projections
+		values := searchBody(d.query, body)
+		if len(values) == 0 {
+			return "", false
+		}
+		b, _ := json.Marshal(values)
+		raw = string(b)
+	case d.expr != nil:
+		v, err := d.expr.eval(newExprEnv(m, body))
+		if err != nil || v == nil {
+			return "", false
+		}
+		b, _ := exprJSON(v)
+		raw = string(b)
+	default:
+		raw = body
+	}
+	// Hashed so the state file stays small, prefixed so keys of different kinds never match
+	sum := sha256.Sum256([]byte(d.by + "\n" + raw))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// messageKey returns the deduplication key of a received message
+func (d *deduper) messageKey(m *sqs.Message) (string, bool) {
+	return d.keyOf(m, messageBody(m))
+}
+
+// isSeen is true if the key was already sent
+func (d *deduper) isSeen(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seen[key]
+}
+
+// mark records keys as sent, synced to the state file
+func (d *deduper) mark(keys []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		d.seen[key] = true
+		if d.f != nil {
+			fmt.Fprintln(d.f, key)
+		}
+	}
+	if d.f != nil {
+		if err := d.f.Sync(); err != nil {
+			log.Fatal("Error syncing dedupe state ", err)
+		}
+	}
+}
+
+// filter splits a batch between the messages to send and the duplicates
+// duplicates within the batch are caught as well
+func (d *deduper) filter(batch []*sqs.Message) (fresh, duplicates []*sqs.Message) {
+	inBatch := make(map[string]bool)
+	for _, m := range batch {
+		key, ok := d.messageKey(m)
+		if ok && (inBatch[key] || d.isSeen(key)) {
+			duplicates = append(duplicates, m)
+			continue
+		}
+		if ok {
+			inBatch[key] = true
+		}
+		fresh = append(fresh, m)
+	}
+	return fresh, duplicates
+}
+
+// markMessages records the keys of sent messages
+func (d *deduper) markMessages(messages []*sqs.Message) {
+	var keys []string
+	for _, m := range messages {
+		if key, ok := d.messageKey(m); ok {
+			keys = append(keys, key)
+		}
+	}
+	d.mark(keys)
+}
+
+// containsString is true if values holds s
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
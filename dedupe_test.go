@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestDeduperKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		by       string
+		a, b     string // Bodies compared
+		same     bool   // Same key for both
+		noKey    bool   // No key for a
+		idA, idB string
+	}{
+		{"body hash same body", dedupeBodyHash, `{"a":1}`, `{"a":1}`, true, false, "1", "2"},
+		{"body hash other body", dedupeBodyHash, `{"a":1}`, `{"a":2}`, false, false, "1", "2"},
+		{"message id", dedupeMessageID, `{"a":1}`, `{"a":1}`, false, false, "1", "2"},
+		{"message id same id", dedupeMessageID, `{"a":1}`, `{"a":2}`, true, false, "1", "1"},
+		{"message id without id", dedupeMessageID, `{"a":1}`, `{"a":1}`, false, true, "", ""},
+		{"jmespath field", "jmespath:order.id", `{"order":{"id":7},"at":1}`, `{"order":{"id":7},"at":2}`, true, false, "1", "2"},
+		{"jmespath other field", "jmespath:order.id", `{"order":{"id":7}}`, `{"order":{"id":8}}`, false, false, "1", "2"},
+		{"jmespath integer and float", "jmespath:order.id", `{"order":{"id":7}}`, `{"order":{"id":7.0}}`, true, false, "1", "2"},
+		{"jmespath big integers keep their digits", "jmespath:id", `{"id":12345678901234567891}`, `{"id":12345678901234567892}`, false, false, "1", "2"},
+		{"jmespath filter on numbers", "jmespath:items[?qty > `1`].id", `{"items":[{"qty":2,"id":"a"},{"qty":1,"id":"b"}]}`, `{"items":[{"qty":3,"id":"a"}]}`, true, false, "1", "2"},
+		{"jmespath function", "jmespath:join('-', [tenant, order.id])", `{"tenant":"t","order":{"id":"1"}}`, `{"tenant":"t","order":{"id":"1"},"x":0}`, true, false, "1", "2"},
+		{"jmespath null", "jmespath:order.id", `{"other":1}`, `{"other":1}`, false, true, "1", "2"},
+		{"jmespath empty list", "jmespath:items[?qty > `5`].id", `{"items":[{"qty":1,"id":"a"}]}`, `{}`, false, true, "1", "2"},
+		{"jmespath not JSON", "jmespath:order.id", `plain`, `plain`, false, true, "1", "2"},
+		{"expression", "expr:lower(body.email)", `{"email":"A@x.com"}`, `{"email":"a@x.com"}`, true, false, "1", "2"},
+		{"expression null", "expr:body.email", `{}`, `{}`, false, true, "1", "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newDeduper(tt.by, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyA, okA := d.key(tt.a, tt.idA)
+			if okA == tt.noKey {
+				t.Fatalf("key of %s found = %v, want %v", tt.a, okA, !tt.noKey)
+			}
+			if tt.noKey {
+				return
+			}
+			keyB, okB := d.key(tt.b, tt.idB)
+			if !okB {
+				t.Fatalf("no key for %s", tt.b)
+			}
+			if (keyA == keyB) != tt.same {
+				t.Errorf("same key = %v, want %v", keyA == keyB, tt.same)
+			}
+		})
+	}
+}
+
+func TestDeduperKindsDontMatch(t *testing.T) {
+	byBody, _ := newDeduper(dedupeBodyHash, "")
+	byID, _ := newDeduper(dedupeMessageID, "")
+	a, _ := byBody.key("1", "1")
+	b, _ := byID.key("1", "1")
+	if a == b {
+		t.Error("a body hash key matches a message ID key")
+	}
+}
+
+func TestDeduperInvalidKeys(t *testing.T) {
+	for _, by := range []string{"", "hash", "jmespath:order.[", "expr:body.a =="} {
+		if _, err := newDeduper(by, ""); err == nil {
+			t.Errorf("%q accepted", by)
+		}
+	}
+}
+
+func TestDeduperState(t *testing.T) {
+	state := t.TempDir() + "/run.keys"
+	d, err := newDeduper("jmespath:id", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := func(body string) *sqs.Message {
+		return &sqs.Message{MessageId: aws.String(body), Body: aws.String(body)}
+	}
+	fresh, duplicates := d.filter([]*sqs.Message{message(`{"id":1}`), message(`{"id":1,"n":2}`), message(`{"id":2}`)})
+	if len(fresh) != 2 || len(duplicates) != 1 {
+		t.Fatalf("filtered %d fresh and %d duplicates, want 2 and 1", len(fresh), len(duplicates))
+	}
+	d.markMessages(fresh)
+	d.f.Close()
+
+	// A re-run loads the keys already sent
+	again, err := newDeduper("jmespath:id", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.f.Close()
+	fresh, duplicates = again.filter([]*sqs.Message{message(`{"id":2}`), message(`{"id":3}`), message(`{}`)})
+	if len(fresh) != 2 || len(duplicates) != 1 {
+		t.Errorf("filtered %d fresh and %d duplicates after a re-run, want 2 and 1", len(fresh), len(duplicates))
+	}
+}
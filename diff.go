@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// diff reports the messages present in one queue but not in the other
+// both queues are read whole and released at the end, nothing is deleted
+// the first queue is held in memory, put the smaller one first
+func diff(args []string) {
+	diffCommand := flag.NewFlagSet("diff", flag.ExitOnError)
+	q1 := diffCommand.String("queue1", "", "first queue")
+	diffCommand.StringVar(q1, "q1", "", "first queue") // Aliasing
+	q2 := diffCommand.String("queue2", "", "second queue")
+	diffCommand.StringVar(q2, "q2", "", "second queue") // Aliasing
+	keyBy := diffCommand.String("key", dedupeBodyHash, "message key: body-hash, jmespath:QUERY or expr:EXPRESSION")
+	visibility := diffCommand.Int64("visibility", 300, "seconds the messages stay hidden while reading")
+	diffHelp := diffCommand.Bool("help", false, "help for diff command")
+	diffCommand.BoolVar(diffHelp, "h", false, "help") // Aliasing
+	parseFlags(diffCommand, args)
+
+	if *diffHelp {
+		diffUsage()
+	}
+
+	// Verify
+	if len(*q1) == 0 || len(*q2) == 0 {
+		fmt.Println("Required queue name is missing.")
+		diffUsage()
+	}
+	if *keyBy == dedupeMessageID {
+		log.Fatal("Message IDs differ between queues, use body-hash, jmespath:QUERY or expr:EXPRESSION")
+	}
+	keys, err := newDeduper(*keyBy, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *visibility < 1 || *visibility > maxVisibilityTimeout {
+		log.Fatal("Visibility must be between 1 and 43200 seconds")
+	}
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+
+	names := [2]string{*q1, *q2}
+	var qURLs [2]string
+	for i, name := range names {
+		q := svc.resolveQueue(name)
+		// Later messages of a FIFO group are not received while the first ones are in flight
+		if q.fifo {
+			log.Fatal("FIFO queues can't be read whole without deleting, diff is not supported")
+		}
+		qURLs[i] = q.url
+	}
+
+	// The first queue is held by key, the second is matched against it as it is read
+	// so only its extra messages are kept
+	var read [2][]string
+	release := func() {
+		for i, qURL := range qURLs {
+			svc.changeVisibilityBatch(qURL, read[i], 0)
+		}
+	}
+	first := make(map[string][]*sqs.Message)
+	var extra []*sqs.Message
+	var extraKeys []string
+	for i, name := range names {
+		unkeyed, n := 0, 0
+		handles, err := svc.receiveAll(qURLs[i], *visibility, func(m *sqs.Message) {
+			n++
+			key, ok := keys.messageKey(m)
+			if !ok {
+				unkeyed++
+				return
+			}
+			if i == 0 {
+				first[key] = append(first[key], m)
+			} else if held := first[key]; len(held) > 0 {
+				first[key] = held[1:]
+			} else {
+				extra = append(extra, m)
+				extraKeys = append(extraKeys, key)
+			}
+		})
+		read[i] = handles
+		if err != nil {
+			release()
+			log.Fatalf("Error reading %s: %s\n", name, err)
+		}
+		if isInterrupted() {
+			release()
+			os.Exit(exitInterrupted)
+		}
+		if unkeyed > 0 {
+			log.Printf("%d messages of %s have no key and are ignored\n", unkeyed, name)
+		}
+		log.Printf("%d messages read from %s\n", n, name)
+	}
+
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t := &table{columns: []column{
+		{key: "onlyIn", title: "ONLY IN"},
+		{key: "messageId", title: "MESSAGE ID"},
+		{key: "body", title: "BODY"},
+		{key: "key", title: "KEY", wide: true},
+	}}
+	// A key held n times by one side and m times by the other leaves n-m extra copies
+	var onlyFirst []string
+	for key, held := range first {
+		if len(held) > 0 {
+			onlyFirst = append(onlyFirst, key)
+		}
+	}
+	sort.Strings(onlyFirst)
+	for _, key := range onlyFirst {
+		for _, m := range first[key] {
+			t.add(names[0], aws.StringValue(m.MessageId), messageBody(m), key)
+		}
+	}
+	order := make([]int, len(extra))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return extraKeys[order[a]] < extraKeys[order[b]] })
+	for _, i := range order {
+		t.add(names[1], aws.StringValue(extra[i].MessageId), messageBody(extra[i]), extraKeys[i])
+	}
+	t.render(os.Stdout, format)
+	release()
+
+	// Non-zero so scripts can check convergence
+	if len(t.rows) > 0 {
+		log.Printf("%d messages differ\n", len(t.rows))
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// receiveAll receives every visible message of a standard queue, hiding them for visibility,
+// and visits each once, returns the receipt handles to release
+// it stops once the queue returns nothing, a message received again means its visibility ran out
+func (s *service) receiveAll(queue string, visibility int64, visit func(m *sqs.Message)) ([]string, error) {
+	var handles []string
+	seen := make(map[string]bool)
+	for !isInterrupted() {
+		result := s.receiveMessagesFor(queue, 10, false, visibility)
+		if len(result.Messages) == 0 {
+			break // We are done
+		}
+		for _, m := range result.Messages {
+			handles = append(handles, aws.StringValue(m.ReceiptHandle))
+			if seen[aws.StringValue(m.MessageId)] {
+				return handles, fmt.Errorf("visibility ran out after %d messages, raise -visibility", len(seen))
+			}
+			seen[aws.StringValue(m.MessageId)] = true
+			visit(m)
+		}
+	}
+	return handles, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func diffUsage() {
+	fmt.Println("usage: sqscli diff [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue1 required   First queue")
+	fmt.Println("  -queue2 required   Second queue")
+	fmt.Println("  -key               Message key, body-hash, jmespath:QUERY or expr:EXPRESSION (default body-hash)")
+	fmt.Println("  -visibility        Seconds the messages stay hidden while reading (default 300)")
+	os.Exit(0)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes of drain-all
+const (
+	drainExport = "export"
+	drainMove   = "move"
+)
+
+// drainResult is the outcome of the run draining a queue
+type drainResult struct {
+	Queue    string     `json:"queue"`
+	Target   string     `json:"target"` // Export file or destination queue
+	Status   string     `json:"status"` // completed, failed or interrupted
+	ExitCode int        `json:"exitCode"`
+	Report   *runReport `json:"report,omitempty"` // Report of the run, with its operation ID
+	Error    string     `json:"error,omitempty"`  // Last output line of a failed run
+}
+
+// drainReport is the consolidated report of drain-all
+type drainReport struct {
+	Mode     string        `json:"mode"`
+	Queues   []drainResult `json:"queues"`
+	Totals   opProgress    `json:"totals"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Elapsed  float64       `json:"elapsedSeconds"`
+}
+
+// - - - - - - - - - - - - - - - -
+//   DRAIN-ALL COMMAND
+// - - - - - - - - - - - - - - - -
+
+// drainAll exports or moves many queues at once, for region evacuations or account migrations
+// each queue is drained by a qtocsv or qtoq run of its own, at most -parallel at a time,
+// so every queue gets its own operation, audit lines and report
+// arguments after the options are passed to each run
+func drainAll(args []string) {
+	drainCommand := flag.NewFlagSet("drain-all", flag.ExitOnError)
+	queueNames := drainCommand.String("queue", "", "comma separated queue names or patterns")
+	drainCommand.StringVar(queueNames, "q", "", "comma separated queue names or patterns") // Aliasing
+	mode := drainCommand.String("mode", drainExport, "export or move")
+	dir := drainCommand.String("dir", ".", "directory receiving one export file per queue")
+	format := drainCommand.String("format", exportCSVFormat, "export format: csv, cloudevents, avro, xml or yaml")
+	toRegion := drainCommand.String("to-region", "", "region of the destination queues, -region by default")
+	toPrefix := drainCommand.String("to-prefix", "", "prefix added to the destination queue names")
+	toSuffix := drainCommand.String("to-suffix", "", "suffix added to the destination queue names, before .fifo")
+	parallel := drainCommand.Int("parallel", 4, "queues drained at once")
+	concurrency := drainCommand.String("concurrency", "1", "concurrent receivers per queue, or auto")
+	reportFile := drainCommand.String("report", "", "file receiving the JSON consolidated report")
+	drainHelp := drainCommand.Bool("help", false, "help for drain-all command")
+	drainCommand.BoolVar(drainHelp, "h", false, "help") // Aliasing
+	parseFlags(drainCommand, args)
+
+	if *drainHelp {
+		drainAllUsage()
+	}
+
+	// Verify
+	if len(*queueNames) == 0 {
+		fmt.Println("Required argument is missing.")
+		drainAllUsage()
+	}
+	if *mode != drainExport && *mode != drainMove {
+		log.Fatal("Mode must be export or move")
+	}
+	if *parallel < 1 {
+		log.Fatal("Parallel must be at least 1")
+	}
+	if _, err := parseConcurrency(*concurrency); err != nil {
+		log.Fatal(err)
+	}
+	// Every run loads and saves the emulated queues, they can't overlap
+	if localMode && *parallel > 1 {
+		log.Println("Queues of the emulator are drained one at a time")
+		*parallel = 1
+	}
+	region := *toRegion
+	if len(region) == 0 {
+		region = awsRegion
+	}
+	if *mode == drainMove && region == awsRegion && len(*toPrefix) == 0 && len(*toSuffix) == 0 {
+		log.Fatal("Moved queues need a destination: -to-region, -to-prefix or -to-suffix")
+	}
+	if *mode == drainExport {
+		if err := os.MkdirAll(*dir, 0700); err != nil {
+			log.Fatal("Error creating the export directory ", err)
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal("Error locating the sqscli binary ", err)
+	}
+	reports, err := ioutil.TempDir("", "sqscli-drain-")
+	if err != nil {
+		log.Fatal("Error creating the report directory ", err)
+	}
+	defer os.RemoveAll(reports)
+
+	// Connect
+	svc := newService()
+
+	var queues []string
+	seen := make(map[string]bool)
+	for _, pattern := range strings.Split(*queueNames, ",") {
+		if pattern = strings.TrimSpace(pattern); len(pattern) == 0 {
+			continue
+		}
+		for _, qURL := range svc.resolveQueues(pattern) {
+			if name := queueNameFromURL(qURL); !seen[name] {
+				seen[name] = true
+				queues = append(queues, name)
+			}
+		}
+	}
+
+	// Each run audits its own queue as well
+	startAudit("drain-all", queues...)
+	s := &scheduler{
+		exe: exe,
+		// Everything before the command name, the health endpoints and operation are drain-all's
+		globals: withoutFlag(withoutFlag(os.Args[1:len(os.Args)-len(flag.Args())], "health"), "operation-id"),
+		running: make(map[string]*exec.Cmd),
+	}
+	os.Unsetenv(envName("", "health"))
+	handleInterrupts()
+	go func() {
+		<-interrupted
+		s.stopJobs()
+	}()
+	markReady()
+
+	started := time.Now()
+	log.Printf("Draining %d queues, %d at a time\n", len(queues), *parallel)
+	results := make([]drainResult, len(queues))
+	slots := make(chan struct{}, *parallel)
+	var wg sync.WaitGroup
+	for i, name := range queues {
+		report := filepath.Join(reports, fmt.Sprintf("%d.json", i))
+		command := []string{"-concurrency", *concurrency, "-report", report}
+		var target string
+		if *mode == drainExport {
+			target = filepath.Join(*dir, name+"."+exportExtension(*format))
+			command = append([]string{"qtocsv", "-queue", name, "-format", *format}, command...)
+		} else {
+			target = drainTarget(name, *toPrefix, *toSuffix)
+			command = append([]string{"qtoq", "-queue1", name, "-queue2", target, "-region2", region}, command...)
+		}
+		command = append(command, drainCommand.Args()...)
+		slots <- struct{}{}
+		if isInterrupted() {
+			results[i] = drainResult{Queue: name, Target: target, Status: opInterrupted, ExitCode: exitInterrupted}
+			<-slots
+			continue
+		}
+		wg.Add(1)
+		go func(i int, name, target, report string, command []string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = s.drain(name, target, report, command, *mode == drainExport)
+		}(i, name, target, report, command)
+	}
+	wg.Wait()
+
+	// Consolidate
+	r := drainReport{Mode: *mode, Queues: results, Started: started, Finished: time.Now()}
+	r.Elapsed = r.Finished.Sub(started).Seconds()
+	t := &table{columns: []column{
+		{key: "queue", title: "QUEUE"},
+		{key: "target", title: "TARGET"},
+		{key: "status", title: "STATUS"},
+		{key: "received", title: "RECEIVED"},
+		{key: "deleted", title: "DELETED"},
+		{key: "failed", title: "FAILED"},
+		{key: "elapsedSeconds", title: "ELAPSED", wide: true},
+		{key: "operation", title: "OPERATION", wide: true},
+	}}
+	failed := false
+	for _, res := range results {
+		failed = failed || res.Status != opCompleted
+		if res.Report == nil {
+			t.add(res.Queue, res.Target, res.Status, 0, 0, 0, 0, "")
+			continue
+		}
+		rep := res.Report
+		r.Totals.Received += rep.Received
+		r.Totals.Written += rep.Written
+		r.Totals.Sent += rep.Sent
+		r.Totals.Deleted += rep.Deleted
+		r.Totals.Failed += rep.Failed
+		r.Totals.Duplicates += rep.Duplicates
+		t.add(res.Queue, res.Target, res.Status, rep.Received, rep.Deleted, rep.Failed, math.Round(rep.Elapsed*1000)/1000, rep.Operation)
+	}
+	tableFormat := outputFormat
+	if len(tableFormat) == 0 {
+		tableFormat = formatTable
+	}
+	t.render(os.Stdout, tableFormat)
+	finishAudit(r.Totals.Deleted, r.Totals.Failed)
+	fmt.Fprintf(os.Stderr, "Drained %d queues in %s: %d received, %d deleted, %d failed\n",
+		len(results), r.Finished.Sub(started).Round(time.Millisecond), r.Totals.Received, r.Totals.Deleted, r.Totals.Failed)
+
+	if len(*reportFile) > 0 {
+		b, _ := json.MarshalIndent(r, "", "  ")
+		if err := ioutil.WriteFile(*reportFile, append(b, '\n'), 0600); err != nil {
+			log.Println("Error writing report", err)
+		}
+	}
+	switch {
+	case isInterrupted():
+		os.Exit(exitInterrupted)
+	case failed:
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// drain runs the command draining a queue and reads its report file
+// exports are written to the target file
+func (s *scheduler) drain(name, target, report string, command []string, export bool) drainResult {
+	res := drainResult{Queue: name, Target: target}
+	cmd := exec.Command(s.exe, append(append([]string{}, s.globals...), command...)...)
+	tail := &lineTail{max: 1}
+	var logs sync.WaitGroup
+	stderr, _ := cmd.StderrPipe()
+	logs.Add(1)
+	go tail.log(name, stderr, &logs)
+	if export {
+		f, file, err := createExportFile(target)
+		res.Target = file
+		if err != nil {
+			res.Status, res.ExitCode, res.Error = opFailed, 1, err.Error()
+			log.Printf("[%s] Error opening the export: %s\n", name, err)
+			return res
+		}
+		defer f.Close()
+		cmd.Stdout = f
+	} else {
+		stdout, _ := cmd.StdoutPipe()
+		logs.Add(1)
+		go tail.log(name, stdout, &logs)
+	}
+	isolateJob(cmd)
+
+	s.mu.Lock()
+	if isInterrupted() {
+		s.mu.Unlock()
+		res.Status, res.ExitCode = opInterrupted, exitInterrupted
+		return res
+	}
+	if err := cmd.Start(); err != nil {
+		s.mu.Unlock()
+		res.Status, res.ExitCode, res.Error = opFailed, 1, err.Error()
+		log.Printf("[%s] Error starting: %s\n", name, err)
+		return res
+	}
+	s.running[name] = cmd
+	s.mu.Unlock()
+
+	logs.Wait()
+	cmd.Wait()
+	s.mu.Lock()
+	delete(s.running, name)
+	s.mu.Unlock()
+
+	res.ExitCode = cmd.ProcessState.ExitCode()
+	switch res.ExitCode {
+	case 0:
+		res.Status = opCompleted
+	case exitInterrupted:
+		res.Status = opInterrupted
+	default:
+		res.Status = opFailed
+		if lines := tail.lines(); len(lines) > 0 {
+			res.Error = lines[0]
+		}
+	}
+	// The report is there unless the run failed before starting
+	if b, err := ioutil.ReadFile(report); err == nil {
+		rep := &runReport{}
+		if json.Unmarshal(b, rep) == nil {
+			res.Report = rep
+		}
+	}
+	log.Printf("[%s] %s\n", name, res.Status)
+	return res
+}
+
+// createExportFile creates an export file, numbered like o1-2.csv when it exists
+// so draining again never overwrites what an earlier drain exported
+func createExportFile(file string) (*os.File, string, error) {
+	ext := filepath.Ext(file)
+	for n := 1; ; n++ {
+		name := file
+		if n > 1 {
+			name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(file, ext), n, ext)
+		}
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if !os.IsExist(err) {
+			return f, name, err
+		}
+	}
+}
+
+// drainTarget is the destination queue of a moved queue, FIFO queues keep their suffix
+func drainTarget(name, prefix, suffix string) string {
+	if strings.HasSuffix(name, ".fifo") {
+		return prefix + strings.TrimSuffix(name, ".fifo") + suffix + ".fifo"
+	}
+	return prefix + name + suffix
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func drainAllUsage() {
+	fmt.Println("usage: sqscli drain-all [options] [-- run options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Comma separated queue names or patterns")
+	fmt.Println("  -mode             export (qtocsv) or move (qtoq) (default export)")
+	fmt.Println("  -dir              Directory receiving one export file per queue (default .)")
+	fmt.Println("  -format           Export format, csv, cloudevents, avro, xml or yaml (default csv)")
+	fmt.Println("  -to-region        Region of the destination queues (default -region)")
+	fmt.Println("  -to-prefix        Prefix added to the destination queue names")
+	fmt.Println("  -to-suffix        Suffix added to the destination queue names, before .fifo")
+	fmt.Println("  -parallel         Queues drained at once (default 4)")
+	fmt.Println("  -concurrency      Concurrent receivers per queue, 1 to 32, or auto (default 1)")
+	fmt.Println("  -report           File receiving the JSON consolidated report")
+	fmt.Println("Run options are passed to each qtocsv or qtoq run, like -since, -filter-attr or -provenance.")
+	os.Exit(0)
+}
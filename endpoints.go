@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// settingsFileName is the settings file in the home directory, unless SQSCLI_CONFIG names another
+const settingsFileName = ".sqscli.yaml"
+
+// settings is the content of the settings file
+type settings struct {
+	// Endpoints maps regions to the SQS endpoint used there, like an interface VPC endpoint
+	Endpoints map[string]string `yaml:"endpoints"`
+	// EndpointFallback uses the public endpoint when the host of an endpoint doesn't resolve
+	EndpointFallback bool `yaml:"endpointFallback"`
+	// Flags are defaults of global flags, like region: eu-west-1
+	Flags map[string]string `yaml:"flags"`
+	// Commands are defaults of command flags by command, like qtoq: {concurrency: auto}
+	Commands map[string]map[string]string `yaml:"commands"`
+	// Guardrails deny or restrict destructive runs, like purges of production queues
+	Guardrails []guardrail `yaml:"guardrails"`
+	// Environments are named targets, like dev, staging and prod, selected by -env or use-env
+	Environments map[string]environment `yaml:"environments"`
+}
+
+var (
+	// userSettings is the loaded settings file, empty if there is none
+	userSettings settings
+	// endpointURL is the SQS endpoint of the -region queues, set by -endpoint-url
+	endpointURL string
+	// endpointFallback is set by -endpoint-fallback, or endpointFallback in the settings
+	endpointFallback bool
+	// resolvedEndpoints holds the endpoint sqsEndpoint settled on for each region
+	resolvedEndpoints sync.Map
+)
+
+// - - - - - - - - - - - - - - - -
+//   ENDPOINTS
+// - - - - - - - - - - - - - - - -
+
+// loadSettings reads the settings file, a missing default file is not an error
+func loadSettings() error {
+	file := os.Getenv("SQSCLI_CONFIG")
+	explicit := len(file) > 0
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		file = filepath.Join(home, settingsFileName)
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(b, &userSettings); err != nil {
+		return fmt.Errorf("invalid settings file %s: %s", file, err)
+	}
+	for region, endpoint := range userSettings.Endpoints {
+		if _, err := parseEndpoint(endpoint); err != nil {
+			return fmt.Errorf("endpoint of %s in %s: %s", region, file, err)
+		}
+	}
+	if err := validateGuardrails(userSettings.Guardrails); err != nil {
+		return fmt.Errorf("%s in %s", err, file)
+	}
+	if err := validateEnvironments(userSettings.Environments); err != nil {
+		return fmt.Errorf("%s in %s", err, file)
+	}
+	return nil
+}
+
+// parseEndpoint checks an endpoint is an absolute URL
+func parseEndpoint(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid endpoint %q, expected a URL like https://vpce-0123.sqs.us-east-1.vpce.amazonaws.com", raw)
+	}
+	return u, nil
+}
+
+// sqsEndpoint returns the SQS endpoint of a region, empty for the public one
+// -endpoint-url applies to the -region queues, the settings file to every region
+// an endpoint whose host doesn't resolve fails, or falls back to the public endpoint
+// it is resolved once per region
+func sqsEndpoint(region string) string {
+	if endpoint, ok := resolvedEndpoints.Load(region); ok {
+		return endpoint.(string)
+	}
+	endpoint := resolveEndpoint(region)
+	resolvedEndpoints.Store(region, endpoint)
+	return endpoint
+}
+
+// resolveEndpoint checks the endpoint of a region resolves
+func resolveEndpoint(region string) string {
+	endpoint := userSettings.Endpoints[region]
+	if len(endpointURL) > 0 && region == awsRegion {
+		endpoint = endpointURL
+	}
+	if len(endpoint) == 0 {
+		return ""
+	}
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := net.LookupHost(u.Hostname()); err != nil {
+		if endpointFallback || userSettings.EndpointFallback {
+			log.Printf("Warning: endpoint %s does not resolve, using the public SQS endpoint of %s\n", u.Host, region)
+			return ""
+		}
+		log.Fatalf("Endpoint %s does not resolve: %s\n"+
+			"VPC endpoint names only resolve inside their VPC, and private DNS names only when the VPC enables it.\n"+
+			"Run from the VPC, check the endpoint, or use -endpoint-fallback to fall back to the public endpoint.\n",
+			u.Host, err)
+	}
+	return endpoint
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// entrySeq numbers the batch entries of the run
+var entrySeq int64
+
+// failedEntries ties the batch entries SQS refused back to the messages they carried, for the report
+var failedEntries struct {
+	sync.Mutex
+	entries []failedEntry
+}
+
+// failedEntry is a batch entry SQS refused
+type failedEntry struct {
+	Entry     string `json:"entry"`     // Batch entry ID
+	MessageID string `json:"messageId"` // Message ID in the queue it was received from
+	Queue     string `json:"queue"`     // Queue it was sent to or deleted from
+	Action    string `json:"action"`    // send or delete
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error"`
+}
+
+// - - - - - - - - - - - - - - - -
+//   BATCH ENTRY IDS
+// - - - - - - - - - - - - - - - -
+
+// nextEntryID returns the ID of a new batch entry, e1, e2... in the order of the run
+// message IDs repeat when a message is received twice, and SQS refuses batches repeating an ID
+func nextEntryID() *string {
+	return aws.String("e" + strconv.FormatInt(atomic.AddInt64(&entrySeq, 1), 10))
+}
+
+// recordFailedEntry adds a refused entry to the report
+func recordFailedEntry(action, queue, entry string, m *sqs.Message, code, err string) {
+	failedEntries.Lock()
+	defer failedEntries.Unlock()
+	failedEntries.entries = append(failedEntries.entries, failedEntry{
+		Entry:     entry,
+		MessageID: aws.StringValue(m.MessageId),
+		Queue:     queueNameFromURL(queue),
+		Action:    action,
+		Code:      code,
+		Error:     err,
+	})
+}
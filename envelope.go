@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// envelopeAttribute flags messages whose body is encrypted by sqscli
+	envelopeAttribute = "sqscli.encryption"
+	// envelopeKeyAttribute holds the KMS encrypted data key of a message
+	envelopeKeyAttribute = "sqscli.dataKey"
+	// envelopeAlgorithm is the value of envelopeAttribute
+	envelopeAlgorithm = "kms-aes256-gcm"
+)
+
+// envelope encrypts message bodies with a single KMS data key per run
+type envelope struct {
+	aead         cipher.AEAD
+	encryptedKey []byte
+}
+
+// envelopeOpener decrypts message bodies, caching the data keys
+type envelopeOpener struct {
+	sess *session.Session
+	mu   sync.Mutex
+	keys map[string]cipher.AEAD
+}
+
+// opener decrypts the messages encrypted by sqscli, set up by newService
+var opener *envelopeOpener
+
+// - - - - - - - - - - - - - - - -
+//   CLIENT-SIDE ENCRYPTION
+// - - - - - - - - - - - - - - - -
+
+// newEnvelope generates the data key encrypting the bodies of a run
+func (s *service) newEnvelope(keyID string) *envelope {
+	dataKey, err := kmsClient(s.sess).GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		log.Fatal("Error generating data key ", err)
+	}
+	return &envelope{aead: newAEAD(dataKey.Plaintext), encryptedKey: dataKey.CiphertextBlob}
+}
+
+// seal encrypts a body, returns the new body and the attributes needed to open it
+func (e *envelope) seal(body string) (string, map[string]*sqs.MessageAttributeValue) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Fatal("Error encrypting message ", err)
+	}
+	sealed := e.aead.Seal(nonce, nonce, []byte(body), nil)
+	return base64.StdEncoding.EncodeToString(sealed), map[string]*sqs.MessageAttributeValue{
+		envelopeAttribute: &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(envelopeAlgorithm),
+		},
+		envelopeKeyAttribute: &sqs.MessageAttributeValue{
+			DataType:    aws.String("Binary"),
+			BinaryValue: e.encryptedKey,
+		},
+	}
+}
+
+// newEnvelopeOpener returns an opener using the session for KMS calls
+func newEnvelopeOpener(sess *session.Session) *envelopeOpener {
+	return &envelopeOpener{sess: sess, keys: make(map[string]cipher.AEAD)}
+}
+
+// open decrypts a body encrypted by seal
+func (o *envelopeOpener) open(m *sqs.Message) (string, error) {
+	key := m.MessageAttributes[envelopeKeyAttribute]
+	if key == nil {
+		return "", errors.New("missing data key")
+	}
+
+	o.mu.Lock()
+	aead, ok := o.keys[string(key.BinaryValue)]
+	if !ok {
+		dataKey, err := kmsClient(o.sess).Decrypt(&kms.DecryptInput{CiphertextBlob: key.BinaryValue})
+		if err != nil {
+			o.mu.Unlock()
+			return "", err
+		}
+		aead = newAEAD(dataKey.Plaintext)
+		o.keys[string(key.BinaryValue)] = aead
+	}
+	o.mu.Unlock()
+
+	sealed, err := base64.StdEncoding.DecodeString(aws.StringValue(m.Body))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted body")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// messageBody returns the body of a message, decrypted if sqscli encrypted it, then decoded by the -transform plugin
+// the message itself is left untouched so it can be re-sent as is
+func messageBody(m *sqs.Message) string {
+	body := aws.StringValue(m.Body)
+	attr := m.MessageAttributes[envelopeAttribute]
+	if attr != nil && aws.StringValue(attr.StringValue) == envelopeAlgorithm && opener != nil {
+		var err error
+		if body, err = opener.open(m); err != nil {
+			log.Fatalf("Error decrypting message %s: %s\n", aws.StringValue(m.MessageId), err)
+		}
+	}
+	if bodyDecoder == nil {
+		return body
+	}
+	body, err := bodyDecoder.transform(m, body)
+	if err != nil {
+		log.Fatalf("Error transforming message %s: %s\n", aws.StringValue(m.MessageId), err)
+	}
+	return body
+}
+
+// envelopeAttributes returns the attributes needed to decrypt a message, if any
+func envelopeAttributes(m *sqs.Message) map[string]*sqs.MessageAttributeValue {
+	attrs := make(map[string]*sqs.MessageAttributeValue)
+	for _, name := range []string{envelopeAttribute, envelopeKeyAttribute} {
+		if v, ok := m.MessageAttributes[name]; ok {
+			attrs[name] = v
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the environment variables setting flags
+const envPrefix = "SQSCLI_"
+
+// flagEnvFallbacks are other variables of a flag, read after its SQSCLI_ one
+var flagEnvFallbacks = map[string][]string{
+	"region": {"AWS_REGION", "AWS_DEFAULT_REGION"},
+}
+
+// - - - - - - - - - - - - - - - -
+//   FLAGS FROM THE ENVIRONMENT
+// - - - - - - - - - - - - - - - -
+
+// parseFlags parses the flags of a command, then sets those not given
+// from the environment, or else from the settings file: flags > env > settings file
+// global flags are read from SQSCLI_<FLAG> and flags of the settings,
+// command flags from SQSCLI_<COMMAND>_<FLAG> and commands.<command> of the settings
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+
+	command, defaults := "", userSettings.Flags
+	if fs != flag.CommandLine {
+		command, defaults = fs.Name(), userSettings.Commands[fs.Name()]
+	}
+	for name := range defaults {
+		if fs.Lookup(name) == nil {
+			log.Fatalf("Unknown flag %s in the settings file%s\n", name, commandSuffix(command))
+		}
+	}
+
+	// Aliases share their value, the longest name is the one read
+	given := make(map[flag.Value]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Value] = true })
+	names := make(map[flag.Value]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) > len(names[f.Value]) {
+			names[f.Value] = f.Name
+		}
+	})
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Value] || names[f.Value] != f.Name || f.Name == "help" {
+			return
+		}
+		source, value, ok := flagDefault(command, f.Name, defaults)
+		if !ok {
+			return
+		}
+		if isBoolFlag(f) {
+			b, err := parseEnvBool(value)
+			if err != nil {
+				log.Fatalf("Invalid %s=%q: %s\n", source, value, err)
+			}
+			value = strconv.FormatBool(b)
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			log.Fatalf("Invalid %s=%q: %s\n", source, value, err)
+		}
+	})
+	if fs == flag.CommandLine {
+		applyEnvironment(given)
+	} else {
+		expandBookmarkFlags(fs)
+	}
+}
+
+// flagDefault returns the value of a flag not given, and where it comes from
+func flagDefault(command, name string, defaults map[string]string) (string, string, bool) {
+	vars := []string{envName(command, name)}
+	if len(command) == 0 {
+		vars = append(vars, flagEnvFallbacks[name]...)
+	}
+	for _, v := range vars {
+		if value, ok := os.LookupEnv(v); ok && len(value) > 0 {
+			return v, value, true
+		}
+	}
+	if value, ok := defaults[name]; ok {
+		return "settings " + name + commandSuffix(command), value, true
+	}
+	return "", "", false
+}
+
+// envName is the variable of a flag, like SQSCLI_REGION or SQSCLI_QTOQ_CONCURRENCY
+func envName(command, name string) string {
+	if len(command) > 0 {
+		name = command + "_" + name
+	}
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", " ", "_").Replace(name))
+}
+
+// commandSuffix names the command of a settings entry in errors
+func commandSuffix(command string) string {
+	if len(command) == 0 {
+		return ""
+	}
+	return " of " + command
+}
+
+// isBoolFlag is true for flags given without a value, like -staged
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// parseEnvBool accepts the usual spellings of booleans in environments, like 1, yes or off
+func parseEnvBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "y", "on":
+		return true, nil
+	case "no", "n", "off":
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("expected true or false")
+	}
+	return b, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// environment is a named target of the settings file, like prod, selected by -env or use-env
+type environment struct {
+	Profile    string      `yaml:"profile"`    // Shared config profile of the credentials
+	Region     string      `yaml:"region"`     // Region of the queues
+	Endpoint   string      `yaml:"endpoint"`   // SQS endpoint of the region, like a VPC endpoint
+	Account    string      `yaml:"account"`    // Account the credentials must belong to, checked before the first call
+	Guardrails []guardrail `yaml:"guardrails"` // Added to the guardrails of the settings file
+}
+
+// environmentFlags are the global flags an environment sets, by field
+var environmentFlags = map[string]func(environment) string{
+	"profile":      func(e environment) string { return e.Profile },
+	"region":       func(e environment) string { return e.Region },
+	"endpoint-url": func(e environment) string { return e.Endpoint },
+}
+
+var (
+	// environmentName is the environment of the run, set by -env, or by use-env for every run
+	environmentName string
+	// awsProfile is the shared config profile of the credentials, set by -profile
+	awsProfile string
+	// accountChecked verifies the account of the environment once
+	accountChecked sync.Once
+)
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// useEnv sets the environment of the next runs, or lists the environments of the settings file
+func useEnv(args []string) {
+	useEnvCommand := flag.NewFlagSet("use-env", flag.ExitOnError)
+	unset := useEnvCommand.Bool("unset", false, "clear the default environment")
+	useEnvHelp := useEnvCommand.Bool("help", false, "help for use-env command")
+	useEnvCommand.BoolVar(useEnvHelp, "h", false, "help") // Aliasing
+	parseFlags(useEnvCommand, args)
+
+	if *useEnvHelp {
+		useEnvUsage()
+	}
+
+	// Verify
+	if len(userSettings.Environments) == 0 {
+		log.Fatal("The settings file has no environments")
+	}
+	file := defaultEnvironmentFile()
+	if len(file) == 0 {
+		log.Fatal("No home directory to keep the default environment in")
+	}
+
+	// Apply
+	switch {
+	case *unset:
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Fatal("Error clearing the default environment ", err)
+		}
+		fmt.Fprintln(os.Stderr, "No default environment")
+	case useEnvCommand.NArg() > 0:
+		name := useEnvCommand.Arg(0)
+		env, ok := userSettings.Environments[name]
+		if !ok {
+			log.Fatalf("Unknown environment %s, the settings file has %s\n", name, strings.Join(environmentNames(), ", "))
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			log.Fatal("Error saving the default environment ", err)
+		}
+		if err := ioutil.WriteFile(file, []byte(name+"\n"), 0600); err != nil {
+			log.Fatal("Error saving the default environment ", err)
+		}
+		fmt.Fprintf(os.Stderr, "Default environment is now %s: %s\n", name, env.describe())
+	default:
+		format := outputFormat
+		if len(format) == 0 {
+			format = formatTable
+		}
+		t := &table{columns: []column{
+			{key: "current", title: "CURRENT"},
+			{key: "name", title: "NAME"},
+			{key: "profile", title: "PROFILE"},
+			{key: "region", title: "REGION"},
+			{key: "account", title: "ACCOUNT"},
+			{key: "endpoint", title: "ENDPOINT", wide: true},
+			{key: "guardrails", title: "GUARDRAILS", wide: true},
+		}}
+		for _, name := range environmentNames() {
+			env := userSettings.Environments[name]
+			mark := ""
+			if name == environmentName {
+				mark = "*"
+			}
+			t.add(mark, name, env.Profile, env.Region, env.Account, env.Endpoint, strconv.Itoa(len(env.Guardrails)))
+		}
+		t.render(os.Stdout, format)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   ENVIRONMENTS
+// - - - - - - - - - - - - - - - -
+
+// validateEnvironments checks the environments of the settings file
+func validateEnvironments(envs map[string]environment) error {
+	for name, env := range envs {
+		if len(env.Endpoint) > 0 {
+			if _, err := parseEndpoint(env.Endpoint); err != nil {
+				return fmt.Errorf("environment %s: %s", name, err)
+			}
+		}
+		if err := validateGuardrails(env.Guardrails); err != nil {
+			return fmt.Errorf("environment %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// applyEnvironment sets the global flags of the selected environment not given on the command line
+// nor by their SQSCLI_<FLAG> variable: flags > env > environment > settings file
+// its guardrails are added to those of the settings file
+func applyEnvironment(given map[flag.Value]bool) {
+	name := environmentName
+	if len(name) == 0 {
+		name = defaultEnvironment()
+		// A default left by use-env doesn't stop every run, use-env -unset included
+		if _, ok := userSettings.Environments[name]; len(name) > 0 && !ok {
+			log.Printf("Warning: the default environment %s is not in the settings file, it is ignored\n", name)
+			return
+		}
+	}
+	if len(name) == 0 {
+		return
+	}
+	env, ok := userSettings.Environments[name]
+	if !ok {
+		if len(userSettings.Environments) == 0 {
+			log.Fatalf("Unknown environment %s, the settings file has no environments\n", name)
+		}
+		log.Fatalf("Unknown environment %s, the settings file has %s\n", name, strings.Join(environmentNames(), ", "))
+	}
+	environmentName = name
+	for flagName, value := range environmentFlags {
+		f := flag.CommandLine.Lookup(flagName)
+		if len(value(env)) == 0 || given[f.Value] || len(os.Getenv(envName("", flagName))) > 0 {
+			continue
+		}
+		if err := flag.CommandLine.Set(flagName, value(env)); err != nil {
+			log.Fatalf("Invalid %s of environment %s: %s\n", flagName, name, err)
+		}
+	}
+	userSettings.Guardrails = append(userSettings.Guardrails, env.Guardrails...)
+}
+
+// checkAccount stops the run when the credentials don't belong to the account of the environment,
+// before the first call to the queues
+func checkAccount(sess *session.Session) {
+	env := userSettings.Environments[environmentName]
+	if len(env.Account) == 0 {
+		return
+	}
+	accountChecked.Do(func() {
+		out, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			log.Fatalf("Error checking the account of environment %s: %s\n", environmentName, err)
+		}
+		if account := aws.StringValue(out.Account); account != env.Account {
+			log.Fatalf("The credentials are of account %s, environment %s is account %s\n", account, environmentName, env.Account)
+		}
+	})
+}
+
+// defaultEnvironmentFile keeps the environment set by use-env, empty without a home directory
+func defaultEnvironmentFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sqscli", "env")
+}
+
+// defaultEnvironment returns the environment set by use-env, empty if there is none
+func defaultEnvironment() string {
+	file := defaultEnvironmentFile()
+	if len(file) == 0 {
+		return ""
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// environmentNames returns the names of the environments, sorted
+func environmentNames() []string {
+	names := make([]string, 0, len(userSettings.Environments))
+	for name := range userSettings.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// describe summarizes where an environment points
+func (e environment) describe() string {
+	var parts []string
+	if len(e.Profile) > 0 {
+		parts = append(parts, "profile "+e.Profile)
+	}
+	if len(e.Region) > 0 {
+		parts = append(parts, e.Region)
+	}
+	if len(e.Account) > 0 {
+		parts = append(parts, "account "+e.Account)
+	}
+	if len(parts) == 0 {
+		return "the default credentials and region"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func useEnvUsage() {
+	fmt.Println("usage: sqscli use-env [options] [name]")
+	fmt.Println("options:")
+	fmt.Println("  -unset            Clear the default environment")
+	os.Exit(0)
+}
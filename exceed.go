@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Actions of -on-exceed
+const (
+	exceedDrop   = "drop"
+	exceedPark   = "park"
+	exceedExport = "export"
+)
+
+// exceedRoute diverts the messages received too many times away from the destination
+type exceedRoute struct {
+	maxReceives int
+	action      string
+	park        string   // Parking-lot queue URL
+	file        *os.File // Archive of JSON lines
+	enc         *json.Encoder
+}
+
+// - - - - - - - - - - - - - - - -
+//   EXCEEDED RECEIVES
+// - - - - - - - - - - - - - - - -
+
+// newExceedRoute parses -on-exceed, see newDivertRoute
+func (s *service) newExceedRoute(maxReceives int, onExceed string, fifo bool) (*exceedRoute, error) {
+	if maxReceives < 1 {
+		return nil, fmt.Errorf("the maximum receive count must be at least 1")
+	}
+	r, err := s.newDivertRoute(onExceed, fifo)
+	if err != nil {
+		return nil, err
+	}
+	r.maxReceives = maxReceives
+	return r, nil
+}
+
+// newDivertRoute parses where diverted messages go: drop, park:QUEUE or export:FILE
+// the parking-lot queue must be of the same type as the source
+func (s *service) newDivertRoute(to string, fifo bool) (*exceedRoute, error) {
+	r := &exceedRoute{}
+	parts := strings.SplitN(to, ":", 2)
+	r.action = parts[0]
+	switch {
+	case to == exceedDrop:
+	case r.action == exceedPark && len(parts) == 2 && len(parts[1]) > 0:
+		lot := s.resolveQueue(parts[1])
+		r.park = lot.url
+		if lot.fifo != fifo {
+			return nil, fmt.Errorf("parking-lot queue %s is not of the same type as the source", parts[1])
+		}
+	case r.action == exceedExport && len(parts) == 2 && len(parts[1]) > 0:
+		f, err := os.OpenFile(parts[1], os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		r.file = f
+		r.enc = json.NewEncoder(f)
+	default:
+		return nil, fmt.Errorf("%q: expected drop, park:QUEUE or export:FILE", to)
+	}
+	return r, nil
+}
+
+// exceeds is true if the message was received more than the maximum, this receive included
+func (r *exceedRoute) exceeds(m *sqs.Message) bool {
+	n, err := strconv.Atoi(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	return err == nil && n > r.maxReceives
+}
+
+// divert routes the messages of a batch received too many times and returns the others
+// diverted messages are deleted from the source once dropped, parked or archived
+func (s *service) divert(from string, r *exceedRoute, fifo bool, batch []*sqs.Message) ([]*sqs.Message, []error) {
+	var keep, exceeded []*sqs.Message
+	for _, m := range batch {
+		if r.exceeds(m) {
+			exceeded = append(exceeded, m)
+		} else {
+			keep = append(keep, m)
+		}
+	}
+	if len(exceeded) == 0 {
+		return keep, nil
+	}
+
+	done, errs := s.divertTo(from, r, fifo, exceeded)
+	log.Printf("%d messages received more than %d times: %s\n", len(done), r.maxReceives, r.action)
+	return keep, errs
+}
+
+// divertTo drops, parks or archives messages, then deletes them from the source
+// returns the messages done, the others are released
+func (s *service) divertTo(from string, r *exceedRoute, fifo bool, messages []*sqs.Message) ([]*sqs.Message, []error) {
+	done := messages
+	var errs []error
+	switch r.action {
+	case exceedPark:
+		done, errs = s.resendBatch(r.park, messages, fifo, 0, nil, nil)
+		if len(done) < len(messages) {
+			s.changeVisibilityBatch(from, unsentReceipts(messages, done), 0)
+		}
+	case exceedExport:
+		for _, m := range messages {
+			err := r.enc.Encode(peekedMessage{
+				MessageID:         aws.StringValue(m.MessageId),
+				Body:              aws.StringValue(m.Body),
+				Attributes:        m.Attributes,
+				MessageAttributes: m.MessageAttributes,
+			})
+			if err != nil {
+				log.Fatal("Error writing diverted messages ", err)
+			}
+		}
+		// Archived before they are deleted
+		if err := r.file.Sync(); err != nil {
+			log.Fatal("Error syncing diverted messages ", err)
+		}
+	}
+	if len(done) > 0 {
+		atomic.AddInt64(&tally.deleted, int64(s.deleteMessageBatch(from, done)))
+	}
+	return done, errs
+}
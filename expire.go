@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Where expired messages go, -to
+const (
+	expireDelete = "delete"
+	expirePark   = "park"
+)
+
+// removeResult is what removing the messages of a queue did
+type removeResult struct {
+	removed int
+	oldest  time.Time // Send time of the oldest message removed
+	errs    []error
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// expire deletes or parks the messages of queues sent longer ago than a given age,
+// stale work that should never be processed
+func expire(args []string) {
+	expireCommand := flag.NewFlagSet("expire", flag.ExitOnError)
+	queueName := expireCommand.String("queue", "", "queue name or pattern")
+	expireCommand.StringVar(queueName, "q", "", "queue name or pattern") // Aliasing
+	olderThan := expireCommand.String("older-than", "", "age of the messages expired, like 7d or 36h, or an RFC3339 time")
+	to := expireCommand.String("to", expireDelete, "where expired messages go: delete, park, park:QUEUE or export:FILE")
+	dryRun := expireCommand.Bool("dry-run", false, "count the expired messages without touching them")
+	yes := expireCommand.Bool("yes", false, "don't ask for confirmation")
+	reportFile := expireCommand.String("report", "", "file receiving the JSON summary")
+	expireHelp := expireCommand.Bool("help", false, "help for expire command")
+	expireCommand.BoolVar(expireHelp, "h", false, "help") // Aliasing
+	parseFlags(expireCommand, args)
+
+	if *expireHelp {
+		expireUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 || len(*olderThan) == 0 {
+		fmt.Println("Required queue name or age is missing.")
+		expireUsage()
+	}
+	cutoff, err := parseWindowTime(*olderThan, time.Now())
+	if err != nil {
+		log.Fatal("Invalid age ", err)
+	}
+	if *to != expireDelete && *to != expirePark && !strings.HasPrefix(*to, exceedPark+":") && !strings.HasPrefix(*to, exceedExport+":") {
+		log.Fatalf("Invalid -to %q, expected delete, park, park:QUEUE or export:FILE\n", *to)
+	}
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+
+	queues := svc.queuesMatching(*queueName)
+	names := make([]string, 0, len(queues))
+	for _, q := range queues {
+		names = append(names, q.name)
+	}
+	if !*dryRun {
+		enforceGuardrails("expire", names, svc.depthCounter(), *yes)
+		if !*yes && !assumeYes {
+			for _, name := range names {
+				fmt.Println(name)
+			}
+			if !confirm(fmt.Sprintf("Expire the messages sent before %s from these %d queues (%s)?", formatTime(cutoff, timeRFC3339), len(queues), *to)) {
+				fmt.Println("Aborted.")
+				return
+			}
+		}
+		startReport("expire", *reportFile, names...)
+	}
+
+	// Apply
+	failed := false
+	for _, q := range queues {
+		if isInterrupted() {
+			break
+		}
+		name := q.name
+		r := svc.expireQueue(q, cutoff, *to, *dryRun)
+		for _, err := range r.errs {
+			log.Printf("Error expiring messages of %s: %s\n", name, err)
+			noteFailure(err)
+			failed = true
+		}
+		switch {
+		case r.removed == 0:
+			fmt.Printf("%s: no message sent before %s\n", name, formatTime(cutoff, timeRFC3339))
+		case *dryRun:
+			fmt.Printf("%s: %d messages to expire, the oldest sent %s\n", name, r.removed, formatTime(r.oldest, timeRFC3339))
+		default:
+			fmt.Printf("%s: %d messages expired (%s), the oldest sent %s\n", name, r.removed, *to, formatTime(r.oldest, timeRFC3339))
+		}
+	}
+	if *dryRun {
+		return
+	}
+	if failed {
+		failReport()
+	}
+	finishReport()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// expireQueue deletes, parks or exports the messages of a queue sent before cutoff,
+// moved messages by their original send, a dry run only counts them
+func (s *service) expireQueue(q *queue, cutoff time.Time, to string, dryRun bool) removeResult {
+	fifo := q.fifo
+	var route *exceedRoute
+	if !dryRun {
+		var err error
+		switch to {
+		case expireDelete:
+			route, err = s.newDivertRoute(exceedDrop, fifo)
+		case expirePark:
+			lot := parkingLotName(q.name)
+			s.ensureParkingLot(lot, fifo)
+			route, err = s.newDivertRoute(exceedPark+":"+lot, fifo)
+		default:
+			route, err = s.newDivertRoute(to, fifo)
+		}
+		if err != nil {
+			log.Fatal("Invalid -to ", err)
+		}
+		if route.file != nil {
+			defer route.file.Close()
+		}
+	}
+
+	keep := messageFilter{func(m *sqs.Message) bool { return inWindow(m, time.Time{}, cutoff) }}
+	return s.removeMessages(q, keep, route)
+}
+
+// removeMessages drops, parks or exports the messages of a queue the filter keeps, see divertTo
+// the other messages are kept hidden until the queue is done, then released
+// without a route the messages are only counted, by message ID, and skipped like the others
+func (s *service) removeMessages(q *queue, keep messageFilter, route *exceedRoute) removeResult {
+	qURL, fifo := q.url, q.fifo
+	var r removeResult
+	acks := newAcks(fifo)
+	note := func(m *sqs.Message) {
+		if sent, _ := sentAt(m); r.oldest.IsZero() || sent.Before(r.oldest) {
+			r.oldest = sent
+		}
+	}
+	if route == nil {
+		// The receivers call the filter one message at a time
+		counted := make(map[string]bool)
+		count := messageFilter{func(m *sqs.Message) bool {
+			if id := aws.StringValue(m.MessageId); keep.keeps(m) && !counted[id] {
+				counted[id] = true
+				note(m)
+			}
+			return false
+		}}
+		for range s.receiveStage(q, nil, count, acks, 1) {
+		}
+		r.removed = len(counted)
+		return r
+	}
+	for batch := range s.receiveStage(q, nil, keep, acks, 1) {
+		for _, m := range batch {
+			note(m)
+		}
+		done, errs := s.divertTo(qURL, route, fifo, batch)
+		if route.action == exceedPark {
+			atomic.AddInt64(&tally.sent, int64(len(done)))
+			atomic.AddInt64(&tally.failed, int64(len(batch)-len(done)))
+		}
+		r.removed += len(done)
+		r.errs = append(r.errs, errs...)
+		if acks != nil {
+			acks <- struct{}{}
+		}
+	}
+	return r
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func expireUsage() {
+	fmt.Println("usage: sqscli expire [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required       Queue name, wildcards match several queues")
+	fmt.Println("  -older-than required  Age of the messages expired, like 7d or 36h, or an RFC3339 time")
+	fmt.Println("  -to                   Where expired messages go: delete, park (the parking-lot queue),")
+	fmt.Println("                        park:QUEUE or export:FILE (default delete)")
+	fmt.Println("  -dry-run              Count the expired messages without touching them")
+	fmt.Println("  -yes                  Don't ask for confirmation")
+	fmt.Println("  -report               File receiving the JSON summary of the run")
+	os.Exit(0)
+}
@@ -0,0 +1,1003 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Kinds of the nodes of an expression, operators are nodes of their own symbol
+const (
+	exprLiteral  = "literal"
+	exprVariable = "variable"
+	exprMember   = "."
+	exprIndex    = "[]"
+	exprCall     = "call"
+	exprNegate   = "neg"
+	exprCond     = "?:"
+	exprList     = "list"
+	exprMap      = "map"
+)
+
+// exprVariables are the names an expression reads a message through
+var exprVariables = map[string]bool{
+	"body":              true, // The JSON body, decoded, or the body itself if it is not JSON
+	"raw":               true, // The body as a string
+	"id":                true, // Message ID
+	"attributes":        true, // System attributes, like ApproximateReceiveCount
+	"messageAttributes": true, // Message attribute values by name
+}
+
+// exprComparisons are the operators of the comparison level, words included
+var exprComparisons = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"in": true, "matches": true, "contains": true, "startsWith": true, "endsWith": true,
+}
+
+// exprFunctions are the functions of the expressions, and how many arguments they take
+var exprFunctions = map[string]int{
+	"len": 1, "lower": 1, "upper": 1, "trim": 1, "string": 1, "number": 1,
+	"json": 1, "parse": 1, "keys": 1, "split": 2, "join": 2, "replace": 3, "now": 0,
+}
+
+// expression is a compiled expression of -filter, -route, -transform expr: and the expr: keys,
+// one language reading the body as JSON, the attributes and the system attributes of messages
+type expression struct {
+	src  string
+	root *exprNode
+}
+
+// exprNode is a node of a compiled expression
+type exprNode struct {
+	op    string
+	value interface{} // Literal, variable or member name, map keys
+	args  []*exprNode
+	re    *regexp.Regexp // Regular expression given as a literal, compiled once
+}
+
+// exprToken is a token of an expression: a number, a string, a name or an operator
+type exprToken struct {
+	kind byte // 'n', 's', 'i' or 'o', 0 at the end
+	text string
+	num  float64
+	pos  int
+}
+
+// exprParser compiles the tokens of an expression, by precedence
+type exprParser struct {
+	tokens []exprToken
+	i      int
+}
+
+// exprEnv is the message an expression is evaluated on, decoded on first use
+type exprEnv struct {
+	m                 *sqs.Message
+	raw               string
+	body              interface{}
+	decoded           bool
+	attributes        map[string]interface{}
+	messageAttributes map[string]interface{}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMPILING
+// - - - - - - - - - - - - - - - -
+
+// compileExpression parses an expression, the errors tell where it is malformed
+func compileExpression(src string) (*expression, error) {
+	tokens, err := lexExpression(src)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %s", src, err)
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseCond()
+	if err == nil && p.peek().kind != 0 {
+		err = p.unexpected()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %s", src, err)
+	}
+	return &expression{src: src, root: root}, nil
+}
+
+// lexExpression splits an expression into tokens
+func lexExpression(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == 'e' || src[j] == 'E' ||
+				(src[j] == '-' || src[j] == '+') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed number %q at %d", src[i:j], i)
+			}
+			tokens = append(tokens, exprToken{kind: 'n', text: src[i:j], num: n, pos: i})
+			i = j
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] != '\\' || j+1 == len(src) {
+					b.WriteByte(src[j])
+					continue
+				}
+				j++
+				switch src[j] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				default:
+					b.WriteByte(src[j])
+				}
+			}
+			if j == len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, exprToken{kind: 's', text: b.String(), pos: i})
+			i = j + 1
+		case c == '_' || c == '$' || c < utf8.RuneSelf && unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '$' || src[j] < utf8.RuneSelf && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])))) {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: 'i', text: src[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%", "?", ":", ".", ",", "(", ")", "[", "]", "{", "}"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if len(op) == 0 {
+				return nil, fmt.Errorf("unexpected %q at %d", src[i:i+1], i)
+			}
+			tokens = append(tokens, exprToken{kind: 'o', text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{pos: len(src)}), nil
+}
+
+// peek returns the next token
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.i]
+}
+
+// next consumes the next token
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.i]
+	if t.kind != 0 {
+		p.i++
+	}
+	return t
+}
+
+// is is true if the next token is an operator, or a word, like && or and
+func (p *exprParser) is(texts ...string) bool {
+	t := p.peek()
+	if t.kind != 'o' && t.kind != 'i' {
+		return false
+	}
+	return containsString(texts, t.text)
+}
+
+// expect consumes an operator, an error if it is another token
+func (p *exprParser) expect(op string) error {
+	if t := p.peek(); t.kind != 'o' || t.text != op {
+		return fmt.Errorf("expected %s at %d", op, t.pos)
+	}
+	p.next()
+	return nil
+}
+
+// unexpected is the error of the next token
+func (p *exprParser) unexpected() error {
+	t := p.peek()
+	if t.kind == 0 {
+		return fmt.Errorf("unexpected end")
+	}
+	return fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// parseCond parses COND ? THEN : ELSE, the lowest precedence
+func (p *exprParser) parseCond() (*exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil || !p.is("?") {
+		return cond, err
+	}
+	p.next()
+	then, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+	return &exprNode{op: exprCond, args: []*exprNode{cond, then, otherwise}}, nil
+}
+
+// parseBinary parses the binary operators from a precedence level up:
+// || or, && and, the comparisons, + -, * / %
+func (p *exprParser) parseBinary(level int) (*exprNode, error) {
+	if level == 5 {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op := t.text
+		switch {
+		case level == 0 && p.is("||", "or"):
+			op = "||"
+		case level == 1 && p.is("&&", "and"):
+			op = "&&"
+		case level == 2 && (t.kind == 'o' || t.kind == 'i') && exprComparisons[op]:
+		case level == 3 && p.is("+", "-"):
+		case level == 4 && p.is("*", "/", "%"):
+		default:
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		n := &exprNode{op: op, args: []*exprNode{left, right}}
+		// Literal patterns are compiled once, and checked now
+		if op == "matches" && right.op == exprLiteral {
+			s, ok := right.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("matches takes a regular expression string at %d", t.pos)
+			}
+			if n.re, err = regexp.Compile(s); err != nil {
+				return nil, fmt.Errorf("at %d: %s", t.pos, err)
+			}
+		}
+		// Comparisons don't chain
+		if level == 2 {
+			return n, nil
+		}
+		left = n
+	}
+}
+
+// parseUnary parses ! not and -
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	switch {
+	case p.is("!", "not"):
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{op: "!", args: []*exprNode{x}}, nil
+	case p.is("-"):
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{op: exprNegate, args: []*exprNode{x}}, nil
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix parses the member accesses and indexes following a value, like body.items[0].sku
+func (p *exprParser) parsePostfix() (*exprNode, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.is("."):
+			p.next()
+			t := p.next()
+			if t.kind != 'i' {
+				return nil, fmt.Errorf("expected a name after . at %d", t.pos)
+			}
+			x = &exprNode{op: exprMember, value: t.text, args: []*exprNode{x}}
+		case p.is("["):
+			p.next()
+			index, err := p.parseCond()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &exprNode{op: exprIndex, args: []*exprNode{x, index}}
+		default:
+			return x, nil
+		}
+	}
+}
+
+// parsePrimary parses literals, variables, function calls, lists, maps and parenthesized expressions
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	t := p.peek()
+	switch t.kind {
+	case 'n':
+		p.next()
+		return &exprNode{op: exprLiteral, value: t.num}, nil
+	case 's':
+		p.next()
+		return &exprNode{op: exprLiteral, value: t.text}, nil
+	case 'i':
+		p.next()
+		switch t.text {
+		case "true", "false":
+			return &exprNode{op: exprLiteral, value: t.text == "true"}, nil
+		case "null":
+			return &exprNode{op: exprLiteral}, nil
+		}
+		if p.is("(") {
+			return p.parseCall(t)
+		}
+		if !exprVariables[t.text] {
+			return nil, fmt.Errorf("unknown name %s at %d, expected body, raw, id, attributes or messageAttributes", t.text, t.pos)
+		}
+		return &exprNode{op: exprVariable, value: t.text}, nil
+	case 'o':
+		switch t.text {
+		case "(":
+			p.next()
+			x, err := p.parseCond()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			p.next()
+			n := &exprNode{op: exprList}
+			for !p.is("]") {
+				item, err := p.parseCond()
+				if err != nil {
+					return nil, err
+				}
+				n.args = append(n.args, item)
+				if !p.is(",") {
+					break
+				}
+				p.next()
+			}
+			return n, p.expect("]")
+		case "{":
+			p.next()
+			n := &exprNode{op: exprMap}
+			var keys []string
+			for !p.is("}") {
+				k := p.next()
+				if k.kind != 'i' && k.kind != 's' {
+					return nil, fmt.Errorf("expected a key at %d", k.pos)
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				value, err := p.parseCond()
+				if err != nil {
+					return nil, err
+				}
+				keys = append(keys, k.text)
+				n.args = append(n.args, value)
+				if !p.is(",") {
+					break
+				}
+				p.next()
+			}
+			n.value = keys
+			return n, p.expect("}")
+		}
+	}
+	return nil, p.unexpected()
+}
+
+// parseCall parses the arguments of a function, checked against exprFunctions
+func (p *exprParser) parseCall(name exprToken) (*exprNode, error) {
+	arity, ok := exprFunctions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s at %d", name.text, name.pos)
+	}
+	p.next()
+	n := &exprNode{op: exprCall, value: name.text}
+	for !p.is(")") {
+		arg, err := p.parseCond()
+		if err != nil {
+			return nil, err
+		}
+		n.args = append(n.args, arg)
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if len(n.args) != arity {
+		return nil, fmt.Errorf("wrong number of arguments to %s at %d, expected %d", name.text, name.pos, arity)
+	}
+	if name.text == "replace" && n.args[1].op == exprLiteral {
+		s, ok := n.args[1].value.(string)
+		if !ok {
+			return nil, fmt.Errorf("replace takes a regular expression string at %d", name.pos)
+		}
+		var err error
+		if n.re, err = regexp.Compile(s); err != nil {
+			return nil, fmt.Errorf("at %d: %s", name.pos, err)
+		}
+	}
+	return n, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   EVALUATING
+// - - - - - - - - - - - - - - - -
+
+// newExprEnv returns the environment of a message, body is its decrypted body
+func newExprEnv(m *sqs.Message, body string) *exprEnv {
+	return &exprEnv{m: m, raw: body}
+}
+
+// lookup returns the value of a variable
+func (env *exprEnv) lookup(name string) interface{} {
+	switch name {
+	case "raw":
+		return env.raw
+	case "id":
+		return aws.StringValue(env.m.MessageId)
+	case "body":
+		if !env.decoded {
+			env.decoded = true
+			dec := json.NewDecoder(strings.NewReader(env.raw))
+			dec.UseNumber()
+			if dec.Decode(&env.body) != nil || dec.More() {
+				env.body = env.raw
+			}
+		}
+		return env.body
+	case "attributes":
+		if env.attributes == nil {
+			// Counts and timestamps are numbers
+			env.attributes = make(map[string]interface{}, len(env.m.Attributes))
+			for name, value := range env.m.Attributes {
+				s := aws.StringValue(value)
+				if _, err := strconv.ParseFloat(s, 64); err == nil {
+					env.attributes[name] = json.Number(s)
+				} else {
+					env.attributes[name] = s
+				}
+			}
+		}
+		return env.attributes
+	default:
+		if env.messageAttributes == nil {
+			env.messageAttributes = make(map[string]interface{}, len(env.m.MessageAttributes))
+			for name, value := range env.m.MessageAttributes {
+				switch dataType := aws.StringValue(value.DataType); {
+				case strings.HasPrefix(dataType, "Number"):
+					env.messageAttributes[name] = json.Number(aws.StringValue(value.StringValue))
+				case strings.HasPrefix(dataType, "Binary"):
+					env.messageAttributes[name] = string(value.BinaryValue)
+				default:
+					env.messageAttributes[name] = aws.StringValue(value.StringValue)
+				}
+			}
+		}
+		return env.messageAttributes
+	}
+}
+
+// eval evaluates the expression on a message
+func (e *expression) eval(env *exprEnv) (interface{}, error) {
+	v, err := e.root.eval(env)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", e.src, err)
+	}
+	return v, nil
+}
+
+// matches is true if the expression is true for a message
+func (e *expression) matches(m *sqs.Message) (bool, error) {
+	v, err := e.eval(newExprEnv(m, messageBody(m)))
+	return exprTruthy(v), err
+}
+
+// transform returns the value of the expression as the new body of a message,
+// strings as they are, anything else as JSON
+func (e *expression) transform(m *sqs.Message, body string) (string, error) {
+	v, err := e.eval(newExprEnv(m, body))
+	if err != nil {
+		return "", err
+	}
+	if v == nil {
+		return "", fmt.Errorf("%s: no body, the value is null", e.src)
+	}
+	return exprString(v), nil
+}
+
+// Close implements bodyTransform, expressions hold nothing
+func (e *expression) Close() error {
+	return nil
+}
+
+// eval evaluates a node, missing fields are null rather than errors
+func (n *exprNode) eval(env *exprEnv) (interface{}, error) {
+	switch n.op {
+	case exprLiteral:
+		return n.value, nil
+	case exprVariable:
+		return env.lookup(n.value.(string)), nil
+	case "&&", "||":
+		left, err := n.args[0].eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if exprTruthy(left) == (n.op == "||") {
+			return n.op == "||", nil
+		}
+		right, err := n.args[1].eval(env)
+		if err != nil {
+			return nil, err
+		}
+		return exprTruthy(right), nil
+	case exprCond:
+		cond, err := n.args[0].eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if exprTruthy(cond) {
+			return n.args[1].eval(env)
+		}
+		return n.args[2].eval(env)
+	}
+
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	switch n.op {
+	case exprMember:
+		if m, ok := args[0].(map[string]interface{}); ok {
+			return m[n.value.(string)], nil
+		}
+		return nil, nil
+	case exprIndex:
+		return exprAt(args[0], args[1]), nil
+	case exprList:
+		return args, nil
+	case exprMap:
+		m := make(map[string]interface{}, len(args))
+		for i, key := range n.value.([]string) {
+			m[key] = args[i]
+		}
+		return m, nil
+	case exprCall:
+		return n.call(args)
+	case "!":
+		return !exprTruthy(args[0]), nil
+	case exprNegate:
+		x, ok := exprNumber(args[0])
+		if !ok {
+			return nil, fmt.Errorf("- of %s", exprTypeName(args[0]))
+		}
+		return -x, nil
+	case "==":
+		return exprEqual(args[0], args[1]), nil
+	case "!=":
+		return !exprEqual(args[0], args[1]), nil
+	case "<", "<=", ">", ">=":
+		c, err := exprCompare(args[0], args[1])
+		if err != nil {
+			return false, nil
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "in":
+		return exprContains(args[1], args[0]), nil
+	case "contains":
+		return exprContains(args[0], args[1]), nil
+	case "startsWith", "endsWith":
+		s, ok1 := args[0].(string)
+		prefix, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return false, nil
+		}
+		if n.op == "startsWith" {
+			return strings.HasPrefix(s, prefix), nil
+		}
+		return strings.HasSuffix(s, prefix), nil
+	case "matches":
+		s, ok := args[0].(string)
+		if !ok {
+			return false, nil
+		}
+		re := n.re
+		if re == nil {
+			pattern, ok := args[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("matches takes a regular expression string, not %s", exprTypeName(args[1]))
+			}
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				return nil, err
+			}
+		}
+		return re.MatchString(s), nil
+	case "+":
+		if l, ok := args[0].([]interface{}); ok {
+			if r, ok := args[1].([]interface{}); ok {
+				return append(append([]interface{}{}, l...), r...), nil
+			}
+		}
+		_, lString := args[0].(string)
+		_, rString := args[1].(string)
+		if lString || rString {
+			return exprString(args[0]) + exprString(args[1]), nil
+		}
+	}
+	// Arithmetic
+	l, ok1 := exprNumber(args[0])
+	r, ok2 := exprNumber(args[1])
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("%s %s %s", exprTypeName(args[0]), n.op, exprTypeName(args[1]))
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	}
+	if r == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	return math.Mod(l, r), nil
+}
+
+// call evaluates a function on its arguments
+func (n *exprNode) call(args []interface{}) (interface{}, error) {
+	name := n.value.(string)
+	switch name {
+	case "len":
+		switch v := args[0].(type) {
+		case string:
+			return float64(utf8.RuneCountInString(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+	case "lower", "upper", "trim":
+		s, ok := args[0].(string)
+		if !ok {
+			break
+		}
+		switch name {
+		case "lower":
+			return strings.ToLower(s), nil
+		case "upper":
+			return strings.ToUpper(s), nil
+		}
+		return strings.TrimSpace(s), nil
+	case "string":
+		return exprString(args[0]), nil
+	case "number":
+		if x, ok := exprNumber(args[0]); ok {
+			return x, nil
+		}
+		if s, ok := args[0].(string); ok {
+			if x, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+				return x, nil
+			}
+		}
+		return nil, nil
+	case "json":
+		b, err := exprJSON(args[0])
+		return string(b), err
+	case "parse":
+		s, ok := args[0].(string)
+		if !ok {
+			break
+		}
+		var v interface{}
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, nil
+		}
+		return v, nil
+	case "keys":
+		m, ok := args[0].(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		list := make([]interface{}, len(keys))
+		for i, k := range keys {
+			list[i] = k
+		}
+		return list, nil
+	case "split":
+		s, ok1 := args[0].(string)
+		sep, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			break
+		}
+		parts := strings.Split(s, sep)
+		list := make([]interface{}, len(parts))
+		for i, part := range parts {
+			list[i] = part
+		}
+		return list, nil
+	case "join":
+		list, ok1 := args[0].([]interface{})
+		sep, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			break
+		}
+		parts := make([]string, len(list))
+		for i, v := range list {
+			parts[i] = exprString(v)
+		}
+		return strings.Join(parts, sep), nil
+	case "replace":
+		s, ok1 := args[0].(string)
+		replacement, ok2 := args[2].(string)
+		if !ok1 || !ok2 {
+			break
+		}
+		re := n.re
+		if re == nil {
+			pattern, ok := args[1].(string)
+			if !ok {
+				break
+			}
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				return nil, err
+			}
+		}
+		return re.ReplaceAllString(s, replacement), nil
+	case "now":
+		return float64(time.Now().UnixNano() / int64(time.Millisecond)), nil
+	}
+	types := make([]string, len(args))
+	for i, arg := range args {
+		types[i] = exprTypeName(arg)
+	}
+	return nil, fmt.Errorf("%s(%s)", name, strings.Join(types, ", "))
+}
+
+// - - - - - - - - - - - - - - - -
+//   VALUES
+// - - - - - - - - - - - - - - - -
+
+// exprTruthy is false for false, null, 0, and empty strings, lists and maps
+func exprTruthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case string:
+		return len(x) > 0
+	case []interface{}:
+		return len(x) > 0
+	case map[string]interface{}:
+		return len(x) > 0
+	}
+	n, _ := exprNumber(v)
+	return n != 0
+}
+
+// exprNumber returns the value of a number, JSON numbers included
+func exprNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case json.Number:
+		f, err := x.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// exprNumbers returns two values as numbers if one is a number and the other one a number
+// or a numeric string, so attributes compare to numbers like in -filter-attr
+func exprNumbers(a, b interface{}) (float64, float64, bool) {
+	x, okA := exprNumber(a)
+	y, okB := exprNumber(b)
+	if okA == okB {
+		return x, y, okA
+	}
+	var s string
+	var ok bool
+	if okA {
+		s, ok = b.(string)
+	} else {
+		s, ok = a.(string)
+	}
+	if !ok {
+		return 0, 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if okA {
+		return x, f, true
+	}
+	return f, y, true
+}
+
+// exprEqual compares two values, numbers by value
+func exprEqual(a, b interface{}) bool {
+	if x, y, ok := exprNumbers(a, b); ok {
+		return x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// exprCompare orders two numbers or two strings
+func exprCompare(a, b interface{}) (int, error) {
+	if x, y, ok := exprNumbers(a, b); ok {
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	s, ok1 := a.(string)
+	t, ok2 := b.(string)
+	if !ok1 || !ok2 {
+		return 0, fmt.Errorf("can't compare %s and %s", exprTypeName(a), exprTypeName(b))
+	}
+	return strings.Compare(s, t), nil
+}
+
+// exprContains is true if a list holds a value, a map has it as key, or a string holds it
+func exprContains(container, v interface{}) bool {
+	switch c := container.(type) {
+	case []interface{}:
+		for _, item := range c {
+			if exprEqual(item, v) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		if k, ok := v.(string); ok {
+			_, found := c[k]
+			return found
+		}
+	case string:
+		if s, ok := v.(string); ok {
+			return strings.Contains(c, s)
+		}
+	}
+	return false
+}
+
+// exprAt returns the item of a list at an index, negative from the end, or the value of a map at a key
+func exprAt(container, index interface{}) interface{} {
+	switch c := container.(type) {
+	case []interface{}:
+		f, ok := exprNumber(index)
+		if !ok {
+			return nil
+		}
+		i := int(f)
+		if i < 0 {
+			i += len(c)
+		}
+		if i < 0 || i >= len(c) {
+			return nil
+		}
+		return c[i]
+	case map[string]interface{}:
+		if k, ok := index.(string); ok {
+			return c[k]
+		}
+	}
+	return nil
+}
+
+// exprString returns a value as text: strings as they are, null as nothing, anything else as JSON
+func exprString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case json.Number:
+		return x.String()
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	b, _ := exprJSON(v)
+	return string(b)
+}
+
+// exprJSON encodes a value as compact JSON, without escaping HTML characters
+func exprJSON(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(b.Bytes(), "\n"), nil
+}
+
+// exprTypeName names the type of a value in errors
+func exprTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	}
+	return "map"
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// exprTestMessage is the message the expressions are evaluated on
+func exprTestMessage(body string) *sqs.Message {
+	return &sqs.Message{
+		MessageId: aws.String("id-1"),
+		Body:      aws.String(body),
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("4"),
+			sqs.MessageSystemAttributeNameSentTimestamp:           aws.String("1700000000000"),
+		},
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"Source": {DataType: aws.String("String"), StringValue: aws.String("billing")},
+			"Retry":  {DataType: aws.String("Number"), StringValue: aws.String("3")},
+		},
+	}
+}
+
+func TestExpressionMatches(t *testing.T) {
+	body := `{"status":"failed","customer":{"country":"FR"},"items":[{"sku":"A","qty":2},{"sku":"B","qty":12}],"total":10.5}`
+	tests := []struct {
+		expr string
+		body string
+		want bool
+	}{
+		{`body.status == "failed"`, body, true},
+		{`body.status != "failed"`, body, false},
+		{`body.customer.country in ["FR", "DE"]`, body, true},
+		{`body.customer.country in ["US"]`, body, false},
+		{`body.items[1].qty > 10`, body, true},
+		{`len(body.items) == 2 && body.total >= 10.5`, body, true},
+		{`body.total < 10 || body.status startsWith "fail"`, body, true},
+		{`body.missing.field == null`, body, true},
+		{`!(body.status == "ok")`, body, true},
+		{`body.status matches "^fa.*d$"`, body, true},
+		{`raw contains "sku"`, body, true},
+		{`upper(body.customer.country) == "FR" ? true : false`, body, true},
+		{`attributes.ApproximateReceiveCount > 3`, body, true},
+		{`attributes.ApproximateReceiveCount >= 5`, body, false},
+		{`messageAttributes.Source == "billing" && messageAttributes.Retry == 3`, body, true},
+		{`id == "id-1"`, body, true},
+		{`body == "plain text"`, "plain text", true},
+		{`body.status == "failed"`, "plain text", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := compileExpression(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.matches(exprTestMessage(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpressionTransform(t *testing.T) {
+	tests := []struct {
+		expr string
+		body string
+		want string
+	}{
+		{`body.payload`, `{"payload":"inner"}`, "inner"},
+		{`body.payload`, `{"payload":{"a":1}}`, `{"a":1}`},
+		{`{"id": id, "status": upper(body.status)}`, `{"status":"ok"}`, `{"id":"id-1","status":"OK"}`},
+		{`join(split(body.tags, ","), "|")`, `{"tags":"a,b,c"}`, "a|b|c"},
+		{`replace(raw, "[0-9]+", "N")`, `order 123`, "order N"},
+		{`string(body.n + 1)`, `{"n":41}`, "42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := compileExpression(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.transform(exprTestMessage(tt.body), tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("transform = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`body.status ==`,
+		`(body.status == "a"`,
+		`unknown.field == 1`,
+		`len(body.a, body.b)`,
+		`nosuchfunction(body)`,
+		`body.status == "unterminated`,
+	}
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := compileExpression(expr); err == nil {
+				t.Errorf("%q compiled", expr)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Checks of fifo-verify
+const (
+	fifoOutOfOrder = "out-of-order" // A sequence going back within a group
+	fifoReordered  = "reordered"    // The sequence number of the source queue going back, after a move
+	fifoGap        = "gap"          // The -seq-path counter skipping values
+	fifoDuplicate  = "duplicate"    // The -seq-path counter repeating a value
+)
+
+// sourceSequenceAttribute is the message attribute moves stamp with the sequence number
+// the message had in the queue it was moved from
+const sourceSequenceAttribute = "SequenceNumber"
+
+// fifoAnomaly is an ordering problem found in a message group
+type fifoAnomaly struct {
+	group     string
+	check     string
+	messageID string
+	detail    string
+}
+
+// fifoGroupState is what is known of a message group while its messages are checked in order
+type fifoGroupState struct {
+	messages       int
+	sequence       string // SequenceNumber of the last message
+	sourceSequence string // Source sequence number of the last message carrying one
+	counter        int64  // -seq-path counter of the last message carrying one
+	counted        bool
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// fifoVerify reads a FIFO queue without deleting it and checks the ordering of each message group:
+// sequence numbers, the source sequence numbers carried by moves and, with -seq-path,
+// an application counter of the bodies, exits with 1 on anomalies
+func fifoVerify(args []string) {
+	verifyCommand := flag.NewFlagSet("fifo-verify", flag.ExitOnError)
+	queueName := verifyCommand.String("queue", "", "queue name")
+	verifyCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	seqPath := verifyCommand.String("seq-path", "", "field path of a counter of the bodies, consecutive within a group, e.g. meta.seq")
+	visibility := verifyCommand.Int64("visibility", 300, "seconds the messages stay hidden while reading")
+	verifyHelp := verifyCommand.Bool("help", false, "help for fifo-verify command")
+	verifyCommand.BoolVar(verifyHelp, "h", false, "help") // Aliasing
+	parseFlags(verifyCommand, args)
+
+	if *verifyHelp {
+		fifoVerifyUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		fifoVerifyUsage()
+	}
+	var counterPath []pathStep
+	if len(*seqPath) > 0 {
+		path, err := parseFieldPath(*seqPath)
+		if err != nil {
+			log.Fatalf("Sequence path %q: %s\n", *seqPath, err)
+		}
+		counterPath = path
+	}
+	if *visibility < 1 || *visibility > maxVisibilityTimeout {
+		log.Fatal("Visibility must be between 1 and 43200 seconds")
+	}
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+	q := svc.resolveQueue(*queueName)
+	if !q.fifo {
+		log.Fatal("fifo-verify only applies to FIFO queues")
+	}
+	qURL := q.url
+	available := q.depth()
+
+	// Apply
+	var messages []*sqs.Message
+	handles, err := svc.receiveAll(qURL, *visibility, func(m *sqs.Message) { messages = append(messages, m) })
+	release := func() { svc.changeVisibilityBatch(qURL, handles, 0) }
+	if err != nil {
+		release()
+		log.Fatalf("Error reading %s: %s\n", *queueName, err)
+	}
+	if isInterrupted() {
+		release()
+		os.Exit(exitInterrupted)
+	}
+	groups, anomalies, uncounted := verifyGroups(messages, counterPath)
+	release()
+	log.Printf("%d messages read from %s in %d groups\n", len(messages), *queueName, len(groups))
+	// Later messages of a group are not handed out while the first ones are in flight
+	if len(messages) < available {
+		log.Printf("Warning: %d of about %d messages were read, the groups were only checked up to where SQS stops handing them out\n",
+			len(messages), available)
+	}
+	if uncounted > 0 {
+		log.Printf("Warning: %d messages have no counter at %s\n", uncounted, *seqPath)
+	}
+
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t := &table{columns: []column{
+		{key: "group", title: "GROUP"},
+		{key: "check", title: "CHECK"},
+		{key: "messageId", title: "MESSAGE ID"},
+		{key: "detail", title: "DETAIL"},
+	}}
+	for _, a := range anomalies {
+		t.add(a.group, a.check, a.messageID, a.detail)
+	}
+	t.render(os.Stdout, format)
+
+	// Non-zero so migrations and redrives can be gated on it
+	if len(anomalies) > 0 {
+		fmt.Fprintf(os.Stderr, "%d ordering anomalies in %s\n", len(anomalies), *queueName)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Ordering verified: %d messages in %d groups\n", len(messages), len(groups))
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// verifyGroups checks the messages of each group in the order they were received
+// returns the groups, the anomalies found, and the number of messages without a counter at path
+func verifyGroups(messages []*sqs.Message, path []pathStep) (map[string]*fifoGroupState, []fifoAnomaly, int) {
+	groups := make(map[string]*fifoGroupState)
+	var anomalies []fifoAnomaly
+	uncounted := 0
+	for _, m := range messages {
+		groupID := aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+		g, ok := groups[groupID]
+		if !ok {
+			g = &fifoGroupState{}
+			groups[groupID] = g
+		}
+		g.messages++
+		found := func(check, detail string) {
+			anomalies = append(anomalies, fifoAnomaly{group: groupID, check: check, messageID: aws.StringValue(m.MessageId), detail: detail})
+		}
+
+		sequence := aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameSequenceNumber])
+		if len(g.sequence) > 0 && sequenceLess(sequence, g.sequence) {
+			found(fifoOutOfOrder, fmt.Sprintf("sequence number %s after %s", sequence, g.sequence))
+		}
+		g.sequence = sequence
+
+		if attr, ok := m.MessageAttributes[sourceSequenceAttribute]; ok {
+			source := aws.StringValue(attr.StringValue)
+			if len(g.sourceSequence) > 0 && sequenceLess(source, g.sourceSequence) {
+				found(fifoReordered, fmt.Sprintf("source sequence number %s after %s", source, g.sourceSequence))
+			}
+			g.sourceSequence = source
+		}
+
+		if path == nil {
+			continue
+		}
+		counter, ok := bodyCounter(messageBody(m), path)
+		if !ok {
+			uncounted++
+			continue
+		}
+		if g.counted {
+			switch {
+			case counter == g.counter:
+				found(fifoDuplicate, fmt.Sprintf("counter %d again", counter))
+			case counter < g.counter:
+				found(fifoOutOfOrder, fmt.Sprintf("counter %d after %d", counter, g.counter))
+			case counter > g.counter+1:
+				found(fifoGap, fmt.Sprintf("counter %d after %d, %d missing", counter, g.counter, counter-g.counter-1))
+			}
+		}
+		g.counter, g.counted = counter, true
+	}
+	return groups, anomalies, uncounted
+}
+
+// bodyCounter returns the integer at the path of a JSON body, a number or a string of digits
+func bodyCounter(body string, path []pathStep) (int64, bool) {
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.UseNumber()
+	if dec.Decode(&doc) != nil {
+		return 0, false
+	}
+	values := lookupPath(doc, path, nil)
+	if len(values) != 1 {
+		return 0, false
+	}
+	var raw string
+	switch v := values[0].(type) {
+	case json.Number:
+		raw = v.String()
+	case string:
+		raw = v
+	default:
+		return 0, false
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	return n, err == nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func fifoVerifyUsage() {
+	fmt.Println("usage: sqscli fifo-verify [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   FIFO queue name")
+	fmt.Println("  -seq-path         Field path of a counter of the bodies, consecutive within a group, e.g. meta.seq")
+	fmt.Println("  -visibility       Seconds the messages stay hidden while reading (default 300)")
+	os.Exit(0)
+}
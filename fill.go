@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// fillAttribute marks the messages of a fill run, its value is the run ID
+	fillAttribute = "sqscli.fill"
+	// maxFillSenders bounds the concurrent senders of fill, like the receivers of qtoq
+	maxFillSenders = 32
+)
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// fill pushes synthetic messages of a given size to a queue as fast as it can,
+// to drive consumer autoscaling tests
+// the messages are marked with the run ID, drain -synthetic-only removes them
+func fill(args []string) {
+	fillCommand := flag.NewFlagSet("fill", flag.ExitOnError)
+	queueName := fillCommand.String("queue", "", "queue name")
+	fillCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	count := fillCommand.Int("count", 1000, "number of messages")
+	fillCommand.IntVar(count, "n", 1000, "number of messages") // Aliasing
+	size := fillCommand.String("size", "1KB", "size of the bodies, like 512B or 64KB")
+	concurrency := fillCommand.Int("concurrency", 8, "concurrent senders, 1 to 32")
+	flags := newSendFlags(fillCommand)
+	fillHelp := fillCommand.Bool("help", false, "help for fill command")
+	fillCommand.BoolVar(fillHelp, "h", false, "help") // Aliasing
+	parseFlags(fillCommand, args)
+
+	if *fillHelp {
+		fillUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		fillUsage()
+	}
+	if *count < 1 {
+		log.Fatal("Count must be positive")
+	}
+	bodySize, err := parseSize(*size)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *concurrency < 1 || *concurrency > maxFillSenders {
+		log.Fatal("Concurrency must be between 1 and 32")
+	}
+	opts := flags.options()
+	runID, _ := newUUID()
+	if opts.attrs == nil {
+		opts.attrs = make(map[string]*sqs.MessageAttributeValue)
+	}
+	opts.attrs[fillAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(runID)}
+	if len(opts.attrs) > maxMessageAttributes {
+		log.Fatalf("Too many attributes, SQS accepts %d with %s\n", maxMessageAttributes, fillAttribute)
+	}
+	// The attributes count in the 256KB of a message
+	room := maxMessageSize - entrySize(&sqs.SendMessageBatchRequestEntry{MessageAttributes: opts.attrs})
+	if bodySize < 1 || bodySize > int64(room) {
+		log.Fatalf("Size must be between 1 byte and %d bytes, 256KB less the attributes\n", room)
+	}
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+	q := svc.resolveQueue(*queueName)
+	qURL, fifo := q.url, q.fifo
+
+	// Apply
+	log.Printf("Fill run %s: %d messages of %s to %s, marked with %s\n", runID, *count, *size, *queueName, fillAttribute)
+	start := time.Now()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sent := 0
+	for w := 0; w < *concurrency; w++ {
+		// Sender w sends the messages w, w+concurrency, w+2*concurrency...
+		n := *count / *concurrency
+		if w < *count%*concurrency {
+			n++
+		}
+		if n == 0 {
+			break
+		}
+		// The attributes of an entry may get a trace header, each sender has its own
+		senderOpts := opts
+		senderOpts.attrs = make(map[string]*sqs.MessageAttributeValue, len(opts.attrs))
+		for name, value := range opts.attrs {
+			senderOpts.attrs[name] = value
+		}
+		wg.Add(1)
+		go func(w, n int) {
+			defer wg.Done()
+			i := 0
+			next := func() (string, error) {
+				if i >= n {
+					return "", io.EOF
+				}
+				i++
+				return fillBody(runID, w+(i-1)*(*concurrency), int(bodySize)), nil
+			}
+			k := svc.sendBodies(qURL, fifo, senderOpts, next)
+			mu.Lock()
+			sent += k
+			mu.Unlock()
+		}(w, n)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	log.Printf("%d messages sent in %s, %.0f messages/s\n", sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds())
+	fmt.Fprintf(os.Stderr, "Remove them with: sqscli drain -queue %s -synthetic-only -run %s\n", *queueName, runID)
+	if isInterrupted() {
+		os.Exit(exitInterrupted)
+	}
+}
+
+// drain deletes the messages of a queue, or only the synthetic ones of fill runs
+func drain(args []string) {
+	drainCommand := flag.NewFlagSet("drain", flag.ExitOnError)
+	queueName := drainCommand.String("queue", "", "queue name")
+	drainCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	syntheticOnly := drainCommand.Bool("synthetic-only", false, "only the messages of fill runs")
+	runID := drainCommand.String("run", "", "only the messages of this fill run, with -synthetic-only")
+	dryRun := drainCommand.Bool("dry-run", false, "count the messages without deleting them")
+	yes := drainCommand.Bool("yes", false, "don't ask for confirmation")
+	reportFile := drainCommand.String("report", "", "file receiving the JSON summary")
+	drainHelp := drainCommand.Bool("help", false, "help for drain command")
+	drainCommand.BoolVar(drainHelp, "h", false, "help") // Aliasing
+	parseFlags(drainCommand, args)
+
+	if *drainHelp {
+		drainUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		drainUsage()
+	}
+	if len(*runID) > 0 && !*syntheticOnly {
+		log.Fatal("-run requires -synthetic-only")
+	}
+	var keep messageFilter
+	what := "messages"
+	if *syntheticOnly {
+		keep = messageFilter{func(m *sqs.Message) bool { return isFillMessage(m, *runID) }}
+		what = "synthetic messages"
+		if len(*runID) > 0 {
+			what = "messages of fill run " + *runID
+		}
+	}
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+	q := svc.resolveQueue(*queueName)
+
+	var route *exceedRoute
+	if !*dryRun {
+		enforceGuardrails("drain", []string{q.name}, svc.depthCounter(), *yes)
+		// Synthetic messages are ours to delete, anything else is asked for
+		if !*syntheticOnly && !*yes && !assumeYes {
+			if !confirm(fmt.Sprintf("Delete every message of %s?", *queueName)) {
+				fmt.Println("Aborted.")
+				return
+			}
+		}
+		route, _ = svc.newDivertRoute(exceedDrop, q.fifo)
+		startReport("drain", *reportFile, q.name)
+	}
+
+	// Apply
+	r := svc.removeMessages(q, keep, route)
+	for _, err := range r.errs {
+		log.Printf("Error deleting messages of %s: %s\n", *queueName, err)
+		noteFailure(err)
+	}
+	if *dryRun {
+		fmt.Printf("%s: %d %s to delete\n", *queueName, r.removed, what)
+		return
+	}
+	fmt.Printf("%s: %d %s deleted\n", *queueName, r.removed, what)
+	if len(r.errs) > 0 {
+		failReport()
+	}
+	finishReport()
+	if len(r.errs) > 0 {
+		os.Exit(1)
+	}
+	if isInterrupted() {
+		os.Exit(exitInterrupted)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// fillBody returns the body of the message seq of a fill run, a JSON object padded to size bytes
+// smaller sizes give the object without padding
+func fillBody(runID string, seq, size int) string {
+	head := fmt.Sprintf(`{"fill":"%s","seq":%d,"pad":"`, runID, seq)
+	pad := size - len(head) - len(`"}`)
+	if pad < 0 {
+		pad = 0
+	}
+	return head + strings.Repeat("x", pad) + `"}`
+}
+
+// isFillMessage is true for the messages of a fill run, of any run if runID is empty
+func isFillMessage(m *sqs.Message, runID string) bool {
+	a, ok := m.MessageAttributes[fillAttribute]
+	return ok && (len(runID) == 0 || aws.StringValue(a.StringValue) == runID)
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func fillUsage() {
+	fmt.Println("usage: sqscli fill [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -count            Number of messages (default 1000)")
+	fmt.Println("  -size             Size of the bodies, like 512B or 64KB (default 1KB)")
+	fmt.Println("  -concurrency      Concurrent senders, 1 to 32 (default 8)")
+	fmt.Println("  -batch-size       Messages per batch, 1 to 10 (default 10)")
+	fmt.Println("  -group            FIFO message group ID template (default \"sqscli\")")
+	fmt.Println("  -delay-seconds    Delay before messages become visible, 0 to 900 (standard queues)")
+	fmt.Println("  -spread-over      Randomly add up to this much delay per message, e.g. 5m")
+	fmt.Println("  -attr             Message attribute Name=Type:value, repeatable")
+	fmt.Println("  -encrypt          Encrypt bodies client-side, requires -kms-key-id")
+	fmt.Println("  -kms-key-id       KMS key ID used by -encrypt")
+	fmt.Println("  -trace            Trace header injected in every message: xray or w3c")
+	os.Exit(0)
+}
+
+func drainUsage() {
+	fmt.Println("usage: sqscli drain [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -synthetic-only   Only the messages of fill runs, marked with sqscli.fill")
+	fmt.Println("  -run              Only the messages of this fill run, with -synthetic-only")
+	fmt.Println("  -dry-run          Count the messages without deleting them")
+	fmt.Println("  -yes              Don't ask for confirmation")
+	fmt.Println("  -report           File receiving the JSON summary of the run")
+	os.Exit(0)
+}
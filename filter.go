@@ -0,0 +1,271 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// messageFilter selects the messages a command works on
+// a nil filter keeps every message
+type messageFilter []func(m *sqs.Message) bool
+
+// filterFlags are the flags shared by the commands selecting messages
+type filterFlags struct {
+	since  *string
+	until  *string
+	attrs  *attrFlag
+	expr   *string
+	sample *string
+}
+
+// sampler keeps a share of the messages, or the first ones, see -sample
+type sampler struct {
+	rate  float64 // Share of the messages kept, like 0.01 for 1%
+	limit int64   // Messages kept before the sample is full, like 100
+	kept  int64
+}
+
+// filterFailed warns once that -filter failed on messages
+var filterFailed sync.Once
+
+// sample is the sample of the command, nil without -sample
+// once a head sample is full, receiving stops instead of going through the rest of the queue
+var sample *sampler
+
+// attrPredicate compares an attribute to a value
+// numbers are compared as numbers, anything else as strings
+type attrPredicate struct {
+	name  string
+	op    string
+	value string
+}
+
+// attrOperators are the comparisons of -filter-attr, two characters first
+var attrOperators = []string{"!=", ">=", "<=", "=", ">", "<"}
+
+// - - - - - - - - - - - - - - - -
+//   FLAGS
+// - - - - - - - - - - - - - - - -
+
+// newFilterFlags registers the shared filter flags on a command
+func newFilterFlags(cmd *flag.FlagSet) *filterFlags {
+	attrs := &attrFlag{}
+	cmd.Var(attrs, "filter-attr", "attribute predicate like RetryCount>3, repeatable")
+	return &filterFlags{
+		since:  cmd.String("since", "", "only messages sent after, RFC3339 or relative like 2h"),
+		until:  cmd.String("until", "", "only messages sent before, RFC3339 or relative like 30m"),
+		attrs:  attrs,
+		expr:   cmd.String("filter", "", "only messages the expression is true for, like body.status == \"failed\""),
+		sample: cmd.String("sample", "", "only a sample of the messages: a share like 1%, or the first N"),
+	}
+}
+
+// filter validates the flags, exits on invalid values
+func (f *filterFlags) filter() messageFilter {
+	var keep messageFilter
+	now := time.Now()
+	if len(*f.since) > 0 || len(*f.until) > 0 {
+		var since, until time.Time
+		var err error
+		if len(*f.since) > 0 {
+			if since, err = parseWindowTime(*f.since, now); err != nil {
+				log.Fatal("Invalid -since ", err)
+			}
+		}
+		if len(*f.until) > 0 {
+			if until, err = parseWindowTime(*f.until, now); err != nil {
+				log.Fatal("Invalid -until ", err)
+			}
+		}
+		if !since.IsZero() && !until.IsZero() && !since.Before(until) {
+			log.Fatal("-since must be before -until")
+		}
+		keep = append(keep, func(m *sqs.Message) bool {
+			return inWindow(m, since, until)
+		})
+	}
+	for _, raw := range *f.attrs {
+		p, err := parseAttrPredicate(raw)
+		if err != nil {
+			log.Fatal("Invalid -filter-attr ", err)
+		}
+		keep = append(keep, p.matches)
+	}
+	if len(*f.expr) > 0 {
+		e, err := compileExpression(*f.expr)
+		if err != nil {
+			log.Fatal("Invalid -filter ", err)
+		}
+		keep = append(keep, func(m *sqs.Message) bool {
+			ok, err := e.matches(m)
+			if err != nil {
+				filterFailed.Do(func() {
+					log.Println("Warning: -filter failed on some messages, they are left out:", err)
+				})
+			}
+			return ok && err == nil
+		})
+	}
+	// Last, so only messages matching the other checks are sampled
+	if len(*f.sample) > 0 {
+		s, err := parseSample(*f.sample)
+		if err != nil {
+			log.Fatal("Invalid -sample ", err)
+		}
+		sample = s
+		keep = append(keep, s.keeps)
+	}
+	return keep
+}
+
+// - - - - - - - - - - - - - - - -
+//   FILTERING
+// - - - - - - - - - - - - - - - -
+
+// keeps is true if the message passes every check of the filter
+func (f messageFilter) keeps(m *sqs.Message) bool {
+	for _, check := range f {
+		if !check(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSample parses a share of the messages like 1% or 0.5%, or a number of messages like 100
+func parseSample(raw string) (*sampler, error) {
+	if strings.HasSuffix(raw, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(raw, "%"), 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, fmt.Errorf("%q is not a share between 0 and 100%%", raw)
+		}
+		return &sampler{rate: pct / 100}, nil
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("%q is neither a share like 1%% nor a number of messages", raw)
+	}
+	return &sampler{limit: n}, nil
+}
+
+// keeps draws whether a message is in the sample, or counts it in until the sample is full
+func (s *sampler) keeps(m *sqs.Message) bool {
+	if s.limit > 0 {
+		return atomic.AddInt64(&s.kept, 1) <= s.limit
+	}
+	return rand.Float64() < s.rate
+}
+
+// full is true once a head sample has all its messages, never for a share or without sample
+func (s *sampler) full() bool {
+	return s != nil && s.limit > 0 && atomic.LoadInt64(&s.kept) >= s.limit
+}
+
+// parseWindowTime parses an RFC3339 time, or a duration before now like 2h, 90m or 3d
+func parseWindowTime(raw string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	if strings.HasSuffix(raw, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(raw, "d"))
+		if err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 time nor a duration like 2h", raw)
+	}
+	return now.Add(-d), nil
+}
+
+// inWindow is true if the message was sent within [since, until)
+// a zero bound is open, messages without SentTimestamp are never in a window
+// moved or restored messages are in the window of their original send
+func inWindow(m *sqs.Message, since, until time.Time) bool {
+	sent, ok := sentAt(m)
+	if !ok {
+		return false
+	}
+	if !since.IsZero() && sent.Before(since) {
+		return false
+	}
+	if !until.IsZero() && !sent.Before(until) {
+		return false
+	}
+	return true
+}
+
+// parseAttrPredicate parses Name<op>value, e.g. RetryCount>3 or Source=billing
+func parseAttrPredicate(raw string) (attrPredicate, error) {
+	i := strings.IndexAny(raw, "!=<>")
+	if i <= 0 {
+		return attrPredicate{}, fmt.Errorf("%q is not Name<op>value", raw)
+	}
+	for _, op := range attrOperators {
+		if strings.HasPrefix(raw[i:], op) {
+			return attrPredicate{
+				name:  strings.TrimSpace(raw[:i]),
+				op:    op,
+				value: strings.TrimSpace(raw[i+len(op):]),
+			}, nil
+		}
+	}
+	return attrPredicate{}, fmt.Errorf("%q: operator must be one of %s", raw, strings.Join(attrOperators, " "))
+}
+
+// matches is true if the message has the attribute and it compares as expected
+// message attributes are looked up first, then system attributes like ApproximateReceiveCount
+func (p attrPredicate) matches(m *sqs.Message) bool {
+	var actual string
+	if a, ok := m.MessageAttributes[p.name]; ok && a.StringValue != nil {
+		actual = *a.StringValue
+	} else if a, ok := m.Attributes[p.name]; ok && a != nil {
+		actual = *a
+	} else {
+		return p.op == "!=" // A missing attribute differs from anything
+	}
+
+	var cmp int
+	x, errX := strconv.ParseFloat(actual, 64)
+	y, errY := strconv.ParseFloat(p.value, 64)
+	switch {
+	case errX == nil && errY == nil:
+		cmp = compareFloats(x, y)
+	default:
+		cmp = strings.Compare(actual, p.value)
+	}
+	switch p.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	}
+	return cmp <= 0
+}
+
+// compareFloats returns -1, 0 or 1 like strings.Compare
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestAttrPredicate(t *testing.T) {
+	m := exprTestMessage("{}")
+	tests := []struct {
+		raw  string
+		want bool
+	}{
+		{"Source=billing", true},
+		{"Source!=billing", false},
+		{"Retry>2", true},
+		{"Retry>=3", true},
+		{"Retry<3", false},
+		{"Retry<=10", true}, // Compared as numbers, not as strings
+		{"ApproximateReceiveCount>3", true},
+		{"Missing=x", false},
+		{"Missing!=x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			p, err := parseAttrPredicate(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.matches(m); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	for _, raw := range []string{"Source", "=billing", "Retry~3"} {
+		if _, err := parseAttrPredicate(raw); err == nil {
+			t.Errorf("%q parsed", raw)
+		}
+	}
+}
+
+func TestParseWindowTime(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		raw     string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2024-03-01T00:00:00Z", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2h", now.Add(-2 * time.Hour), false},
+		{"90m", now.Add(-90 * time.Minute), false},
+		{"3d", now.AddDate(0, 0, -3), false},
+		{"-2h", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseWindowTime(tt.raw, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("time = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	sent := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	m := &sqs.Message{Attributes: map[string]*string{
+		sqs.MessageSystemAttributeNameSentTimestamp: aws.String("1710072000000"),
+	}}
+	moved := &sqs.Message{
+		Attributes: map[string]*string{sqs.MessageSystemAttributeNameSentTimestamp: aws.String("1900000000000")},
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			originalSentAtAttribute: {DataType: aws.String("Number"), StringValue: aws.String("1710072000000")},
+		},
+	}
+	tests := []struct {
+		name         string
+		m            *sqs.Message
+		since, until time.Time
+		want         bool
+	}{
+		{"open window", m, time.Time{}, time.Time{}, true},
+		{"since before", m, sent.Add(-time.Hour), time.Time{}, true},
+		{"since after", m, sent.Add(time.Hour), time.Time{}, false},
+		{"until excluded", m, time.Time{}, sent, false},
+		{"until after", m, time.Time{}, sent.Add(time.Second), true},
+		{"moved keeps its original send", moved, time.Time{}, sent.Add(time.Second), true},
+		{"no SentTimestamp", &sqs.Message{}, time.Time{}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inWindow(tt.m, tt.since, tt.until); got != tt.want {
+				t.Errorf("inWindow = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSample(t *testing.T) {
+	tests := []struct {
+		raw     string
+		rate    float64
+		limit   int64
+		wantErr bool
+	}{
+		{"1%", 0.01, 0, false},
+		{"100%", 1, 0, false},
+		{"25", 0, 25, false},
+		{"0%", 0, 0, true},
+		{"101%", 0, 0, true},
+		{"0", 0, 0, true},
+		{"some", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			s, err := parseSample(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (s.rate != tt.rate || s.limit != tt.limit) {
+				t.Errorf("sample = %v/%d, want %v/%d", s.rate, s.limit, tt.rate, tt.limit)
+			}
+		})
+	}
+}
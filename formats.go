@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"gopkg.in/yaml.v3"
+)
+
+// exportSource describes the queue of exported messages, added to each record by -annotate
+type exportSource struct {
+	queue      string
+	url        string
+	region     string
+	account    string
+	exportedAt string // Start of the queue export, RFC3339
+}
+
+// attributeSelection lists the attributes exported as columns,
+// see -system-attributes and -message-attributes
+type attributeSelection struct {
+	system     []string
+	message    []string
+	allMessage bool // Every message attribute, in a single JSON column
+}
+
+// - - - - - - - - - - - - - - - -
+//   XML AND YAML EXPORTS
+// - - - - - - - - - - - - - - - -
+
+// parseAttributeSelection parses comma separated attribute names, All selects every one
+func parseAttributeSelection(system, message string) (attributeSelection, error) {
+	var sel attributeSelection
+	known := sqs.MessageSystemAttributeName_Values()
+	for _, name := range strings.Split(system, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case len(name) == 0:
+		case name == sqs.QueueAttributeNameAll:
+			sel.system = known
+		case containsString(known, name):
+			sel.system = append(sel.system, name)
+		default:
+			return sel, fmt.Errorf("unknown system attribute %s, expected one of %s or All", name, strings.Join(known, ", "))
+		}
+	}
+	for _, name := range strings.Split(message, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case len(name) == 0:
+		case name == sqs.QueueAttributeNameAll:
+			sel.allMessage = true
+		default:
+			sel.message = append(sel.message, name)
+		}
+	}
+	if sel.allMessage {
+		sel.message = nil
+	}
+	return sel, nil
+}
+
+// attributeColumns are the columns of the selected attributes
+func (sel attributeSelection) columns() []column {
+	var columns []column
+	for _, name := range sel.system {
+		columns = append(columns, column{key: name, title: name})
+	}
+	for _, name := range sel.message {
+		columns = append(columns, column{key: name, title: name})
+	}
+	if sel.allMessage {
+		columns = append(columns, column{key: "messageAttributes", title: "Message Attributes"})
+	}
+	return columns
+}
+
+// values returns the selected attributes of a message, empty when it doesn't have one
+// timestamps follow -time-format, binary values are base64 encoded
+func (sel attributeSelection) values(m *sqs.Message) []string {
+	var values []string
+	for _, name := range sel.system {
+		value := aws.StringValue(m.Attributes[name])
+		if name == sqs.MessageSystemAttributeNameSentTimestamp || name == sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp {
+			value = formatMillis(value, timeEpoch)
+		}
+		values = append(values, value)
+	}
+	for _, name := range sel.message {
+		values = append(values, attributeString(m.MessageAttributes[name]))
+	}
+	if sel.allMessage {
+		all := make(map[string]string, len(m.MessageAttributes))
+		for name, value := range m.MessageAttributes {
+			if name != exportMarkerAttribute { // Left by an earlier export
+				all[name] = attributeString(value)
+			}
+		}
+		b, _ := json.Marshal(all)
+		values = append(values, string(b))
+	}
+	return values
+}
+
+// attributeString returns the value of a message attribute, base64 encoded when binary
+func attributeString(attr *sqs.MessageAttributeValue) string {
+	if attr == nil {
+		return ""
+	}
+	if attr.BinaryValue != nil {
+		return base64.StdEncoding.EncodeToString(attr.BinaryValue)
+	}
+	return aws.StringValue(attr.StringValue)
+}
+
+// newExportSource describes a queue, its region and account come from its ARN
+func (s *service) newExportSource(qURL string) *exportSource {
+	a := s.getQueueAttributes(qURL).Attributes
+	queueARN, err := parseQueueARN(aws.StringValue(a[sqs.QueueAttributeNameQueueArn]))
+	if err != nil {
+		log.Fatal("Error annotating the export ", err)
+	}
+	return &exportSource{
+		queue:      queueNameFromURL(qURL),
+		url:        qURL,
+		region:     queueARN.Region,
+		account:    queueARN.AccountID,
+		exportedAt: formatTime(time.Now(), timeRFC3339),
+	}
+}
+
+// exportColumns are the fields of an exported message, the CSV columns
+func exportColumns(opts csvOptions) []column {
+	columns := []column{{key: "body", title: "Body"}}
+	if opts.fifo {
+		columns = append(columns,
+			column{key: "messageGroupId", title: "Message Group ID"},
+			column{key: "messageDeduplicationId", title: "Message Deduplication ID"},
+			column{key: "sequenceNumber", title: "Sequence Number"},
+		)
+	}
+	columns = append(columns, column{key: "sent", title: "Sent"})
+	if opts.checksums {
+		columns = append(columns,
+			column{key: "md5OfBody", title: "MD5 Of Body"},
+			column{key: "md5OfMessageAttributes", title: "MD5 Of Message Attributes"},
+		)
+	}
+	if opts.traceColumn {
+		columns = append(columns, column{key: "traceHeader", title: "Trace Header"})
+	}
+	columns = append(columns, opts.attributes.columns()...)
+	if opts.annotate {
+		columns = append(columns,
+			column{key: "queue", title: "Queue"},
+			column{key: "queueUrl", title: "Queue URL"},
+			column{key: "region", title: "Region"},
+			column{key: "accountId", title: "Account ID"},
+			column{key: "exportedAt", title: "Exported At"},
+		)
+	}
+	return columns
+}
+
+// startXML opens the root element of the XML output
+func startXML() {
+	fmt.Fprintln(output, xml.Header+"<export>")
+}
+
+// endXML closes the root element of the XML output
+func endXML() {
+	fmt.Fprintln(output, "</export>")
+}
+
+// startXMLQueue opens the element of a queue, closed by endXMLQueue
+func startXMLQueue(queue string) {
+	fmt.Fprint(output, "  <queue name=\"")
+	xml.EscapeText(output, []byte(queue))
+	fmt.Fprintln(output, "\">")
+}
+
+// endXMLQueue closes the element of a queue
+func endXMLQueue() {
+	fmt.Fprintln(output, "  </queue>")
+}
+
+// formatXMLMessage outputs a message element, one child per column
+func formatXMLMessage(m *sqs.Message, opts csvOptions) {
+	fmt.Fprintln(output, "    <message>")
+	row := exportRow(m, opts)
+	for i, c := range exportColumns(opts) {
+		fmt.Fprintf(output, "      <%s>", c.key)
+		if err := xml.EscapeText(output, []byte(row[i])); err != nil {
+			log.Fatal("Error writing XML ", err)
+		}
+		fmt.Fprintf(output, "</%s>\n", c.key)
+	}
+	fmt.Fprintln(output, "    </message>")
+}
+
+// formatYAMLMessage outputs a message as an item of a YAML sequence, one key per column
+// items of every queue form a single sequence
+func formatYAMLMessage(m *sqs.Message, opts csvOptions) {
+	columns := exportColumns(opts)
+	row := orderedRow{keys: make([]string, len(columns))}
+	for i, c := range columns {
+		row.keys[i] = c.key
+	}
+	for _, value := range exportRow(m, opts) {
+		row.values = append(row.values, value)
+	}
+	b, err := yaml.Marshal([]orderedRow{row})
+	if err != nil {
+		log.Fatal("Error writing YAML ", err)
+	}
+	output.Write(b)
+}
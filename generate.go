@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// schema is the subset of JSON schema understood by the generator
+type schema struct {
+	Type       string             `json:"type"`
+	Format     string             `json:"format"`
+	Enum       []interface{}      `json:"enum"`
+	Minimum    *float64           `json:"minimum"`
+	Maximum    *float64           `json:"maximum"`
+	MinLength  int                `json:"minLength"`
+	MaxLength  int                `json:"maxLength"`
+	MinItems   int                `json:"minItems"`
+	MaxItems   int                `json:"maxItems"`
+	Properties map[string]*schema `json:"properties"`
+	Items      *schema            `json:"items"`
+}
+
+// fakers are the functions available in message templates
+var fakers = template.FuncMap{
+	"uuid": func() string {
+		uuid, _ := newUUID()
+		return uuid
+	},
+	"now": func() string {
+		return time.Now().UTC().Format(time.RFC3339)
+	},
+	"timestamp": func() int64 {
+		return time.Now().UnixNano() / int64(time.Millisecond)
+	},
+	"int": func(min, max int) int {
+		return min + rand.Intn(max-min+1)
+	},
+	"float": func(min, max float64) float64 {
+		return min + rand.Float64()*(max-min)
+	},
+	"choice": func(choices ...string) string {
+		return choices[rand.Intn(len(choices))]
+	},
+	"string": func(n int) string {
+		return randomString(n)
+	},
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// generate produces fake messages from a template or a JSON schema
+// and sends them to a queue
+func generate(args []string) {
+	generateCommand := flag.NewFlagSet("generate", flag.ExitOnError)
+	queueName := generateCommand.String("queue", "", "queue name")
+	generateCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	count := generateCommand.Int("count", 10, "number of messages")
+	generateCommand.IntVar(count, "n", 10, "number of messages") // Aliasing
+	tplArg := generateCommand.String("template", "", "message template, inline or @file")
+	schemaFile := generateCommand.String("schema", "", "JSON schema file")
+	flags := newSendFlags(generateCommand)
+	dryRun := generateCommand.Bool("dry-run", false, "print messages instead of sending them")
+	generateHelp := generateCommand.Bool("help", false, "help for generate command")
+	generateCommand.BoolVar(generateHelp, "h", false, "help") // Aliasing
+	parseFlags(generateCommand, args)
+
+	if *generateHelp {
+		generateUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 && !*dryRun {
+		fmt.Println("Required queue name is missing.")
+		generateUsage()
+	}
+	if (len(*tplArg) == 0) == (len(*schemaFile) == 0) {
+		fmt.Println("Exactly one of -template or -schema is required.")
+		generateUsage()
+	}
+	opts := flags.options()
+
+	rand.Seed(time.Now().UnixNano())
+	next := newGenerator(*tplArg, *schemaFile, *count)
+
+	if *dryRun {
+		for {
+			body, err := next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				log.Fatal("Error generating message ", err)
+			}
+			fmt.Println(body)
+		}
+	}
+
+	// Connect
+	svc := newService()
+	q := svc.resolveQueue(*queueName)
+	qURL, fifo := q.url, q.fifo
+
+	handleInterrupts()
+	sent := svc.sendBodies(qURL, fifo, opts, next)
+	fmt.Fprintf(os.Stderr, "%d messages sent\n", sent)
+	if isInterrupted() {
+		os.Exit(exitInterrupted)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// newGenerator returns a function yielding count generated bodies
+// and io.EOF afterwards
+func newGenerator(tplArg, schemaFile string, count int) func() (string, error) {
+	var render func(i int) (string, error)
+
+	if len(schemaFile) > 0 {
+		raw, err := ioutil.ReadFile(schemaFile)
+		if err != nil {
+			log.Fatal("Error reading schema ", err)
+		}
+		var sc schema
+		if err := json.Unmarshal(raw, &sc); err != nil {
+			log.Fatal("Error parsing schema ", err)
+		}
+		render = func(i int) (string, error) {
+			b, err := json.Marshal(fakeValue(&sc))
+			return string(b), err
+		}
+	} else {
+		text := tplArg
+		if strings.HasPrefix(tplArg, "@") {
+			raw, err := ioutil.ReadFile(tplArg[1:])
+			if err != nil {
+				log.Fatal("Error reading template ", err)
+			}
+			text = string(raw)
+		}
+		tpl, err := template.New("message").Funcs(fakers).Parse(text)
+		if err != nil {
+			log.Fatal("Error parsing template ", err)
+		}
+		render = func(i int) (string, error) {
+			var buf bytes.Buffer
+			err := tpl.Execute(&buf, struct{ Index int }{i})
+			return strings.TrimSpace(buf.String()), err
+		}
+	}
+
+	i := 0
+	return func() (string, error) {
+		if i >= count {
+			return "", io.EOF
+		}
+		i++
+		return render(i - 1)
+	}
+}
+
+// fakeValue builds a random value matching a schema
+func fakeValue(sc *schema) interface{} {
+	if len(sc.Enum) > 0 {
+		return sc.Enum[rand.Intn(len(sc.Enum))]
+	}
+
+	switch sc.Type {
+	case "object":
+		obj := make(map[string]interface{}, len(sc.Properties))
+		for name, prop := range sc.Properties {
+			obj[name] = fakeValue(prop)
+		}
+		return obj
+	case "array":
+		min, max := sc.MinItems, sc.MaxItems
+		if max < min || max == 0 {
+			max = min + 3
+		}
+		arr := make([]interface{}, min+rand.Intn(max-min+1))
+		for i := range arr {
+			if sc.Items != nil {
+				arr[i] = fakeValue(sc.Items)
+			}
+		}
+		return arr
+	case "integer":
+		min, max := schemaBounds(sc, 0, 1000)
+		return int64(min) + rand.Int63n(int64(max-min)+1)
+	case "number":
+		min, max := schemaBounds(sc, 0, 1000)
+		return min + rand.Float64()*(max-min)
+	case "boolean":
+		return rand.Intn(2) == 1
+	case "string":
+		switch sc.Format {
+		case "uuid":
+			uuid, _ := newUUID()
+			return uuid
+		case "date-time":
+			return time.Now().UTC().Format(time.RFC3339)
+		case "date":
+			return time.Now().UTC().Format("2006-01-02")
+		case "email":
+			return randomString(8) + "@example.com"
+		}
+		min, max := sc.MinLength, sc.MaxLength
+		if max < min || max == 0 {
+			max = min + 12
+		}
+		return randomString(min + rand.Intn(max-min+1))
+	}
+	return nil
+}
+
+// schemaBounds returns the numeric range of a schema with defaults
+func schemaBounds(sc *schema, min, max float64) (float64, float64) {
+	if sc.Minimum != nil {
+		min = *sc.Minimum
+	}
+	if sc.Maximum != nil {
+		max = *sc.Maximum
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// - - - - - - - - - - - - - - - -
+//   UTILS
+// - - - - - - - - - - - - - - - -
+
+// randomString returns n random lowercase alphanumeric characters
+func randomString(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func generateUsage() {
+	fmt.Println("usage: sqscli generate [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -count            Number of messages (default 10)")
+	fmt.Println("  -template         Message template, inline or @file")
+	fmt.Println("                    fakers: uuid, now, timestamp, int MIN MAX, float MIN MAX,")
+	fmt.Println("                    choice \"a\" \"b\" ..., string N, and .Index")
+	fmt.Println("  -schema           JSON schema file to generate messages from")
+	fmt.Println("  -batch-size       Messages per batch, 1 to 10 (default 10)")
+	fmt.Println("  -group            FIFO message group ID template (default \"sqscli\")")
+	fmt.Println("  -delay-seconds    Delay before messages become visible, 0 to 900 (standard queues)")
+	fmt.Println("  -spread-over      Randomly add up to this much delay per message, e.g. 5m")
+	fmt.Println("  -attr             Message attribute Name=Type:value, repeatable")
+	fmt.Println("  -encrypt          Encrypt bodies client-side, requires -kms-key-id")
+	fmt.Println("  -kms-key-id       KMS key ID used by -encrypt")
+	fmt.Println("  -trace            Trace header injected in every message: xray or w3c")
+	fmt.Println("  -dry-run          Print messages instead of sending them")
+	os.Exit(0)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// maxSessionPolicy is the longest inline session policy STS accepts, in characters
+const maxSessionPolicy = 2048
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// grant mints short-lived credentials restricted to what a command needs on its queues,
+// the policy of iam-policy given to STS as an inline session policy, and prints them as export statements
+// with -role-arn the role is assumed, otherwise a federation token is asked for the IAM user
+func grant(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		grantUsage()
+	}
+	command, args := args[0], args[1:]
+	// config subcommands are two words
+	if command == "config" && len(args) > 0 {
+		command, args = command+" "+args[0], args[1:]
+	}
+	policy, ok := commandPolicies[command]
+	if !ok {
+		fmt.Printf("Unknown command %q.\n", command)
+		grantUsage()
+	}
+
+	grantCommand := flag.NewFlagSet("grant", flag.ExitOnError)
+	queueName := grantCommand.String("queue", policy.defaultQueue, "queue name or pattern")
+	grantCommand.StringVar(queueName, "q", policy.defaultQueue, "queue name or pattern") // Aliasing
+	queue2 := grantCommand.String("queue2", "", "destination queue of qtoq")
+	grantCommand.StringVar(queue2, "q2", "", "destination queue of qtoq") // Aliasing
+	staged := grantCommand.Bool("staged", false, "include the staging queues of qtoq -staged")
+	kmsKey := grantCommand.String("kms-key", "", "KMS key ARN used for encryption")
+	roleARN := grantCommand.String("role-arn", "", "role assumed with the session policy, a federation token of the IAM user otherwise")
+	duration := grantCommand.Duration("duration", time.Hour, "lifetime of the credentials")
+	name := grantCommand.String("name", "sqscli-grant", "session name, shows in CloudTrail")
+	envFile := grantCommand.String("env-file", "", "write the credentials to this env file instead of printing them")
+	grantHelp := grantCommand.Bool("help", false, "help for grant command")
+	grantCommand.BoolVar(grantHelp, "h", false, "help") // Aliasing
+	parseFlags(grantCommand, args)
+
+	if *grantHelp {
+		grantUsage()
+	}
+
+	// Verify
+	if len(policy.queue) > 0 && len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		grantUsage()
+	}
+	if len(policy.destination) > 0 && len(*queue2) == 0 {
+		fmt.Println("Required destination queue name is missing.")
+		grantUsage()
+	}
+	if command == "decrypt-export" && len(*kmsKey) == 0 {
+		fmt.Println("Required KMS key is missing.")
+		grantUsage()
+	}
+	// The STS bounds, roles may allow less than 12 hours
+	if *duration < 15*time.Minute || *duration > 12*time.Hour {
+		log.Fatal("Duration must be between 15m and 12h")
+	}
+	if len(*name) < 2 || len(*name) > 32 {
+		log.Fatal("Session name must be 2 to 32 characters")
+	}
+
+	// Connect, the account ID is part of the queue ARNs
+	svc := newService()
+	client := stsClient(svc.sess)
+	identity, err := client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Fatal("Error identifying credentials ", err)
+	}
+	arn := func(name string) string {
+		return svc.queueARN(aws.StringValue(identity.Account), name)
+	}
+	b, _ := json.Marshal(policy.document(command, *queueName, *queue2, *kmsKey, *staged, arn))
+	if len(b) > maxSessionPolicy {
+		log.Fatalf("The policy is %d characters, STS accepts session policies up to %d\n", len(b), maxSessionPolicy)
+	}
+
+	// Apply
+	var creds *sts.Credentials
+	if len(*roleARN) > 0 {
+		out, err := client.AssumeRole(&sts.AssumeRoleInput{
+			RoleArn:         roleARN,
+			RoleSessionName: name,
+			Policy:          aws.String(string(b)),
+			DurationSeconds: aws.Int64(int64(duration.Seconds())),
+		})
+		if err != nil {
+			log.Fatal("Error assuming role ", err)
+		}
+		creds = out.Credentials
+	} else {
+		// Only long-term credentials of an IAM user get federation tokens
+		if strings.Contains(aws.StringValue(identity.Arn), ":assumed-role/") {
+			log.Fatal("Temporary credentials can't get federation tokens, give the -role-arn to assume")
+		}
+		out, err := client.GetFederationToken(&sts.GetFederationTokenInput{
+			Name:            name,
+			Policy:          aws.String(string(b)),
+			DurationSeconds: aws.Int64(int64(duration.Seconds())),
+		})
+		if err != nil {
+			log.Fatal("Error getting federation token ", err)
+		}
+		creds = out.Credentials
+	}
+
+	vars := [][2]string{
+		{"AWS_ACCESS_KEY_ID", aws.StringValue(creds.AccessKeyId)},
+		{"AWS_SECRET_ACCESS_KEY", aws.StringValue(creds.SecretAccessKey)},
+		{"AWS_SESSION_TOKEN", aws.StringValue(creds.SessionToken)},
+		{"AWS_REGION", awsRegion},
+	}
+	expires := formatTime(aws.TimeValue(creds.Expiration), timeRFC3339)
+	if len(*envFile) == 0 {
+		writeCredentials(os.Stdout, "export ", vars)
+		log.Printf("Credentials for %s expire %s\n", command, expires)
+		return
+	}
+	f, err := os.OpenFile(*envFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal("Error writing credentials ", err)
+	}
+	fmt.Fprintf(f, "# sqscli %s, expires %s\n", command, expires)
+	writeCredentials(f, "", vars)
+	if err := f.Close(); err != nil {
+		log.Fatal("Error writing credentials ", err)
+	}
+	log.Printf("Credentials for %s written to %s, they expire %s\n", command, *envFile, expires)
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// writeCredentials writes KEY=VALUE lines, prefixed with export for shells
+// values are single quoted, they never hold quotes
+func writeCredentials(w io.Writer, prefix string, vars [][2]string) {
+	for _, v := range vars {
+		if len(v[1]) > 0 {
+			fmt.Fprintf(w, "%s%s='%s'\n", prefix, v[0], v[1])
+		}
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func grantUsage() {
+	fmt.Println("usage: sqscli grant <command> [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue            Queue name or pattern the command runs against")
+	fmt.Println("  -queue2           Destination queue of qtoq")
+	fmt.Println("  -staged           Include the staging queues of qtoq -staged")
+	fmt.Println("  -kms-key          KMS key ARN, for encrypted exports, -encrypt and decrypt-export")
+	fmt.Println("  -role-arn         Role assumed with the session policy, a federation token of the IAM user otherwise")
+	fmt.Println("  -duration         Lifetime of the credentials, 15m to 12h (default 1h)")
+	fmt.Println("  -name             Session name, shows in CloudTrail (default sqscli-grant)")
+	fmt.Println("  -env-file         Write the credentials to this env file instead of printing them")
+	os.Exit(0)
+}
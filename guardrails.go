@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// guardedCommands are the commands removing messages from queues, which guardrails apply to
+var guardedCommands = map[string]bool{
+	"purge":   true,
+	"expire":  true,
+	"drain":   true,
+	"qtoq":    true,
+	"park":    true,
+	"unpark":  true,
+	"delete":  true,
+	"migrate": true,
+	"merge":   true,
+	"split":   true,
+}
+
+var (
+	// assumeYes confirms the runs guardrails require -yes for, set by -yes
+	assumeYes bool
+	// ticket is the change or incident ticket of the run, set by -ticket and written to the audit log
+	ticket string
+)
+
+// guardrail is a rule of the guardrails section of the settings file
+// it applies to a run of one of its commands on queues matching its pattern,
+// moving or deleting at least minMessages from them
+type guardrail struct {
+	Commands      []string `yaml:"commands"`      // Every guarded command if empty
+	Queue         string   `yaml:"queue"`         // Queue name pattern, every queue if empty
+	MinMessages   int      `yaml:"minMessages"`   // Applies from this many messages
+	Deny          bool     `yaml:"deny"`          // The run is refused
+	RequireYes    bool     `yaml:"requireYes"`    // The run needs -yes
+	RequireTicket bool     `yaml:"requireTicket"` // The run needs -ticket
+	Reason        string   `yaml:"reason"`        // Shown when the rule stops a run
+}
+
+// - - - - - - - - - - - - - - - -
+//   GUARDRAILS
+// - - - - - - - - - - - - - - - -
+
+// validateGuardrails checks the guardrails of the settings file
+func validateGuardrails(rules []guardrail) error {
+	for i, rule := range rules {
+		for _, command := range rule.Commands {
+			if !guardedCommands[command] {
+				return fmt.Errorf("guardrail %d: %q is not a command guardrails apply to", i+1, command)
+			}
+		}
+		if _, err := path.Match(rule.Queue, ""); err != nil {
+			return fmt.Errorf("guardrail %d: invalid queue pattern %q", i+1, rule.Queue)
+		}
+		if rule.MinMessages < 0 {
+			return fmt.Errorf("guardrail %d: minMessages must be positive", i+1)
+		}
+		if !rule.Deny && !rule.RequireYes && !rule.RequireTicket {
+			return fmt.Errorf("guardrail %d: expected deny, requireYes or requireTicket", i+1)
+		}
+	}
+	return nil
+}
+
+// enforceGuardrails stops a run the guardrails of the settings file don't allow
+// queues are those the command removes messages from, count gives how many it would
+// and is only called for rules with minMessages
+// yes is true when the command was confirmed with its own -yes, or the global one
+func enforceGuardrails(command string, queues []string, count func(queue string) int, yes bool) {
+	yes = yes || assumeYes
+	for _, rule := range userSettings.Guardrails {
+		if !rule.applies(command) {
+			continue
+		}
+		var matched []string
+		for _, queue := range queues {
+			if ok, _ := path.Match(rule.Queue, queue); ok || len(rule.Queue) == 0 {
+				matched = append(matched, queue)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		subject := command + " on " + strings.Join(matched, ", ")
+		if rule.MinMessages > 0 {
+			messages := 0
+			for _, queue := range matched {
+				messages += count(queue)
+			}
+			if messages < rule.MinMessages {
+				continue
+			}
+			subject = fmt.Sprintf("%s, %d messages,", subject, messages)
+		}
+		switch {
+		case rule.Deny:
+			log.Fatalf("Guardrail: %s is denied%s\n", subject, rule.reason())
+		case rule.RequireTicket && len(ticket) == 0:
+			log.Fatalf("Guardrail: %s requires a -ticket%s\n", subject, rule.reason())
+		case rule.RequireYes && !yes:
+			log.Fatalf("Guardrail: %s requires -yes%s\n", subject, rule.reason())
+		}
+	}
+}
+
+// depthCounter counts the available messages of a queue by name, for enforceGuardrails
+func (s *service) depthCounter() func(string) int {
+	return func(queue string) int {
+		return s.messageCount(s.getQueueURL(queue))
+	}
+}
+
+// applies is true if the rule covers the command
+func (g guardrail) applies(command string) bool {
+	if len(g.Commands) == 0 {
+		return true
+	}
+	for _, c := range g.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// reason returns the reason of the rule as the end of a sentence
+func (g guardrail) reason() string {
+	if len(g.Reason) == 0 {
+		return ""
+	}
+	return ": " + g.Reason
+}
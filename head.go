@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// headVisibility hides the messages while head looks for more, they are released right after
+const headVisibility = 30
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// head pretty-prints the first available messages of a queue and releases them
+func head(args []string) {
+	headCommand := flag.NewFlagSet("head", flag.ExitOnError)
+	queueName := headCommand.String("queue", "", "queue name")
+	headCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	count := headCommand.Int("count", 5, "number of messages")
+	headCommand.IntVar(count, "n", 5, "number of messages") // Aliasing
+	headHelp := headCommand.Bool("help", false, "help for head command")
+	headCommand.BoolVar(headHelp, "h", false, "help") // Aliasing
+	parseFlags(headCommand, args)
+
+	if *headHelp {
+		headUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		headUsage()
+	}
+	if *count < 1 {
+		log.Fatal("Count must be at least 1")
+	}
+
+	// Connect
+	svc := newService()
+	q := svc.resolveQueue(*queueName)
+	qURL, fifo := q.url, q.fifo
+
+	// Apply
+	var handles []string
+	defer func() { svc.changeVisibilityBatch(qURL, handles, 0) }()
+	color := colorOutput()
+
+	shown := 0
+	for shown < *count && !isInterrupted() {
+		num := *count - shown
+		if num > 10 {
+			num = 10
+		}
+		result := svc.receiveMessagesFor(qURL, num, fifo, headVisibility)
+		if len(result.Messages) == 0 {
+			break // We are done
+		}
+		for _, m := range result.Messages {
+			handles = append(handles, *m.ReceiptHandle)
+			shown++
+			printHeadMessage(shown, m, color)
+		}
+	}
+	if shown == 0 {
+		fmt.Println("No messages available in", *queueName)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// printHeadMessage prints a message header, its message attributes and its body,
+// indented and highlighted when the body is JSON
+func printHeadMessage(index int, m *sqs.Message, color bool) {
+	header := fmt.Sprintf("#%d %s", index, aws.StringValue(m.MessageId))
+	if sent, ok := sentAt(m); ok {
+		if len(timeFormat) == 0 {
+			header += fmt.Sprintf("  sent %s (%s)", humanAgo(sent), formatTime(sent, timeRFC3339))
+		} else {
+			header += "  sent " + formatTime(sent, "")
+		}
+	}
+	if receives := aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]); len(receives) > 0 {
+		header += "  receives " + receives
+	}
+	if group := aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]); len(group) > 0 {
+		header += "  group " + group
+	}
+	if color {
+		header = colorDim + header + colorReset
+	}
+	fmt.Println(header)
+
+	names := make([]string, 0, len(m.MessageAttributes))
+	for name := range m.MessageAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attr := m.MessageAttributes[name]
+		value := aws.StringValue(attr.StringValue)
+		if attr.BinaryValue != nil {
+			value = fmt.Sprintf("(%d bytes)", len(attr.BinaryValue))
+		}
+		fmt.Printf("  %s: %s\n", name, value)
+	}
+
+	body := messageBody(m)
+	var indented bytes.Buffer
+	if json.Indent(&indented, []byte(body), "", "  ") != nil {
+		fmt.Println(body) // Not JSON, printed as is
+	} else if color {
+		fmt.Println(highlightJSON(indented.String()))
+	} else {
+		fmt.Println(indented.String())
+	}
+	fmt.Println()
+}
+
+// highlightJSON colors the keys, strings, numbers and literals of valid JSON
+func highlightJSON(doc string) string {
+	var b strings.Builder
+	for i := 0; i < len(doc); {
+		c := doc[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for end < len(doc) && doc[end] != '"' {
+				if doc[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++ // Closing quote
+			rest := strings.TrimLeft(doc[end:], " ")
+			if strings.HasPrefix(rest, ":") {
+				b.WriteString(colorKey)
+			} else {
+				b.WriteString(colorString)
+			}
+			b.WriteString(doc[i:end])
+			b.WriteString(colorReset)
+			i = end
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(doc) && strings.IndexByte("0123456789.eE+-", doc[end]) >= 0 {
+				end++
+			}
+			b.WriteString(colorNumber + doc[i:end] + colorReset)
+			i = end
+		case c == 't' || c == 'f' || c == 'n':
+			end := i + 1
+			for end < len(doc) && doc[end] >= 'a' && doc[end] <= 'z' {
+				end++
+			}
+			b.WriteString(colorLit + doc[i:end] + colorReset)
+			i = end
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func headUsage() {
+	fmt.Println("usage: sqscli head [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -count            Number of messages (default 5)")
+	os.Exit(0)
+}
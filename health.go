@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+var (
+	// healthAddr is the listen address of the probe endpoints, set by -health
+	healthAddr string
+	// ready is set once the run can do its work, see markReady
+	ready int32
+)
+
+// - - - - - - - - - - - - - - - -
+//   HEALTH ENDPOINTS
+// - - - - - - - - - - - - - - - -
+
+// serveHealth serves the probes of a long-running run, and the extra routes given:
+// /healthz, liveness, ok as long as the process serves it, draining included
+// /readyz, readiness, ok once the run is ready and until it is asked to stop
+func serveHealth(addr string, routes map[string]http.HandlerFunc) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case isInterrupted():
+			http.Error(w, "stopping", http.StatusServiceUnavailable)
+		case atomic.LoadInt32(&ready) == 0:
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+	for path, handler := range routes {
+		mux.HandleFunc(path, handler)
+	}
+	log.Printf("Health endpoints on %s: /healthz, /readyz\n", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal("Error serving health endpoints ", err)
+		}
+	}()
+}
+
+// markReady makes /readyz ok
+func markReady() {
+	atomic.StoreInt32(&ready, 1)
+}
+
+// readyOnSuccess marks the run ready on the first AWS call of the session that succeeds
+// so credentials, network and endpoints are known good
+func readyOnSuccess(sess *session.Session) {
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		if r.Error == nil {
+			markReady()
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of -on-complete hooks
+const (
+	hookExec    = "exec:"
+	hookWebhook = "webhook:"
+	// hookTimeout bounds each hook, a stuck command doesn't hold the run forever
+	hookTimeout = 10 * time.Minute
+	// hookEnvPrefix names the variables given to exec hooks, apart from the flag variables
+	hookEnvPrefix = "SQSCLI_HOOK_"
+)
+
+// Statuses of a finished bulk run
+const (
+	statusCompleted   = "completed"
+	statusFailed      = "failed"
+	statusInterrupted = "interrupted"
+)
+
+// hookFlag collects repeated -on-complete flags
+type hookFlag []string
+
+// completionHooks run once the bulk run in progress is finished, see finishReport
+var completionHooks []string
+
+// - - - - - - - - - - - - - - - -
+//   HOOKS
+// - - - - - - - - - - - - - - - -
+
+// String implements flag.Value
+func (h *hookFlag) String() string {
+	return strings.Join(*h, ",")
+}
+
+// Set implements flag.Value, called once per -on-complete
+func (h *hookFlag) Set(value string) error {
+	if !strings.HasPrefix(value, hookExec) && !strings.HasPrefix(value, hookWebhook) {
+		return fmt.Errorf("expected exec:COMMAND or webhook:URL")
+	}
+	if strings.HasPrefix(value, hookWebhook) && !strings.HasPrefix(value, hookWebhook+"http") {
+		return fmt.Errorf("expected webhook:https://...")
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// runHooks runs the completion hooks of a finished run, one after the other
+// a failing hook is logged, the run itself is done already
+func runHooks(r *runReport) {
+	if len(completionHooks) == 0 {
+		return
+	}
+	b, _ := json.Marshal(r)
+	for _, hook := range completionHooks {
+		var err error
+		if strings.HasPrefix(hook, hookExec) {
+			err = execHook(hook[len(hookExec):], r, b)
+		} else {
+			err = postHook(hook[len(hookWebhook):], b)
+		}
+		if err != nil {
+			log.Printf("Error running hook %s: %s\n", hook, err)
+		}
+	}
+}
+
+// execHook runs a shell command with the report as JSON on stdin and its main fields
+// in SQSCLI_HOOK_* variables, its output goes to stderr
+func execHook(command string, r *runReport, report []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := shellCommand(ctx, command)
+	cmd.Stdin = bytes.NewReader(report)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = os.Environ()
+	for name, value := range map[string]string{
+		"COMMAND":   r.Command,
+		"STATUS":    r.Status,
+		"OPERATION": r.Operation,
+		"QUEUES":    strings.Join(r.Queues, ","),
+		"OUTPUT":    r.Output,
+		"RECEIVED":  strconv.FormatInt(r.Received, 10),
+		"DELETED":   strconv.FormatInt(r.Deleted, 10),
+		"FAILED":    strconv.FormatInt(r.Failed, 10),
+	} {
+		cmd.Env = append(cmd.Env, hookEnvPrefix+name+"="+value)
+	}
+	return cmd.Run()
+}
+
+// postHook posts the report as JSON to a webhook
+func postHook(url string, report []byte) error {
+	client, err := newHTTPClient()
+	if err != nil {
+		return err
+	}
+	client.Timeout = alertTimeout
+	resp, err := client.Post(url, "application/json", bytes.NewReader(report))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("refused: %s", resp.Status)
+	}
+	return nil
+}
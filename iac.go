@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// terraformArguments maps queue attributes to aws_sqs_queue arguments
+var terraformArguments = map[string]string{
+	"DelaySeconds":                  "delay_seconds",
+	"MaximumMessageSize":            "max_message_size",
+	"MessageRetentionPeriod":        "message_retention_seconds",
+	"ReceiveMessageWaitTimeSeconds": "receive_wait_time_seconds",
+	"VisibilityTimeout":             "visibility_timeout_seconds",
+	"Policy":                        "policy",
+	"RedrivePolicy":                 "redrive_policy",
+	"RedriveAllowPolicy":            "redrive_allow_policy",
+	"KmsMasterKeyId":                "kms_master_key_id",
+	"KmsDataKeyReusePeriodSeconds":  "kms_data_key_reuse_period_seconds",
+	"SqsManagedSseEnabled":          "sqs_managed_sse_enabled",
+	"FifoQueue":                     "fifo_queue",
+	"ContentBasedDeduplication":     "content_based_deduplication",
+	"DeduplicationScope":            "deduplication_scope",
+	"FifoThroughputLimit":           "fifo_throughput_limit",
+}
+
+// notIdentifier matches what can't be part of a Terraform or CloudFormation name
+var notIdentifier = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// configToIaC renders the configuration of queues as Terraform or CloudFormation
+func configToIaC(target string, args []string) {
+	iacCommand := flag.NewFlagSet("config "+target, flag.ExitOnError)
+	queueName := iacCommand.String("queue", "*", "queue name or pattern")
+	iacCommand.StringVar(queueName, "q", "*", "queue name or pattern") // Aliasing
+	configFile := iacCommand.String("file", "", "render a config file instead of live queues")
+	iacCommand.StringVar(configFile, "f", "", "render a config file instead of live queues") // Aliasing
+	format := iacCommand.String("format", "yaml", "CloudFormation format: yaml or json")
+	iacHelp := iacCommand.Bool("help", false, "help for config "+target+" command")
+	iacCommand.BoolVar(iacHelp, "h", false, "help") // Aliasing
+	parseFlags(iacCommand, args)
+
+	if *iacHelp {
+		configUsage()
+	}
+
+	var file queueConfigFile
+	if len(*configFile) > 0 {
+		file = readConfigFile(*configFile)
+	} else {
+		svc := newService()
+		for _, qURL := range svc.resolveQueues(*queueName) {
+			file.Queues = append(file.Queues, svc.queueConfig(qURL))
+		}
+	}
+
+	if target == "to-terraform" {
+		for i, q := range file.Queues {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Print(terraformQueue(q))
+		}
+		return
+	}
+
+	template := cloudFormationTemplate(file)
+	var err error
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(template)
+	} else {
+		err = yaml.NewEncoder(os.Stdout).Encode(template)
+	}
+	if err != nil {
+		log.Fatal("Error writing template ", err)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// terraformQueue renders an aws_sqs_queue resource
+func terraformQueue(q queueConfig) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "resource \"aws_sqs_queue\" %q {\n", terraformName(q.Name))
+	fmt.Fprintf(&b, "  name = %q\n", q.Name)
+	for _, name := range sortedKeys(q.Attributes) {
+		arg, ok := terraformArguments[name]
+		if !ok {
+			continue
+		}
+		value := q.Attributes[name]
+		switch {
+		case jsonAttributes[name]:
+			fmt.Fprintf(&b, "  %s = jsonencode(%s)\n", arg, indentJSON(value, "  "))
+		case isNumberOrBool(value):
+			fmt.Fprintf(&b, "  %s = %s\n", arg, value)
+		default:
+			fmt.Fprintf(&b, "  %s = %s\n", arg, terraformString(value))
+		}
+	}
+	if len(q.Tags) > 0 {
+		b.WriteString("\n  tags = {\n")
+		for _, name := range sortedKeys(q.Tags) {
+			fmt.Fprintf(&b, "    %s = %s\n", terraformString(name), terraformString(q.Tags[name]))
+		}
+		b.WriteString("  }\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// cloudFormationTemplate renders AWS::SQS::Queue (and QueuePolicy) resources
+func cloudFormationTemplate(file queueConfigFile) map[string]interface{} {
+	resources := map[string]interface{}{}
+	for _, q := range file.Queues {
+		id := cloudFormationName(q.Name)
+		props := map[string]interface{}{"QueueName": q.Name}
+		for name, value := range q.Attributes {
+			switch {
+			case name == "Policy":
+				resources[id+"Policy"] = map[string]interface{}{
+					"Type": "AWS::SQS::QueuePolicy",
+					"Properties": map[string]interface{}{
+						"Queues":         []interface{}{map[string]string{"Ref": id}},
+						"PolicyDocument": decodeJSON(value),
+					},
+				}
+			case jsonAttributes[name]:
+				props[name] = decodeJSON(value)
+			case isNumberOrBool(value):
+				props[name] = decodeJSON(value)
+			default:
+				props[name] = value
+			}
+		}
+		if len(q.Tags) > 0 {
+			var tags []map[string]string
+			for _, name := range sortedKeys(q.Tags) {
+				tags = append(tags, map[string]string{"Key": name, "Value": q.Tags[name]})
+			}
+			props["Tags"] = tags
+		}
+		resources[id] = map[string]interface{}{
+			"Type":       "AWS::SQS::Queue",
+			"Properties": props,
+		}
+	}
+	return map[string]interface{}{
+		"AWSTemplateFormatVersion": "2010-09-09",
+		"Resources":                resources,
+	}
+}
+
+// terraformName turns a queue name into a resource name, orders-dlq.fifo -> orders_dlq_fifo
+func terraformName(name string) string {
+	n := notIdentifier.ReplaceAllString(name, "_")
+	if n[0] >= '0' && n[0] <= '9' {
+		n = "q_" + n
+	}
+	return n
+}
+
+// cloudFormationName turns a queue name into a logical ID, orders-dlq.fifo -> OrdersDlqFifo
+func cloudFormationName(name string) string {
+	var b strings.Builder
+	for _, part := range notIdentifier.Split(name, -1) {
+		if len(part) > 0 {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+// terraformString quotes a string, escaping interpolation sequences
+func terraformString(s string) string {
+	s = strconv.Quote(s)
+	s = strings.Replace(s, "${", "$${", -1)
+	return strings.Replace(s, "%{", "%%{", -1)
+}
+
+// indentJSON pretty prints a JSON document as HCL, falls back to a quoted string
+func indentJSON(raw, prefix string) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(raw), prefix, "  "); err != nil {
+		return terraformString(raw)
+	}
+	s := strings.Replace(buf.String(), "${", "$${", -1)
+	return strings.Replace(s, "%{", "%%{", -1)
+}
+
+// decodeJSON decodes a JSON value, falls back to the raw string
+func decodeJSON(raw string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return raw
+	}
+	return v
+}
+
+// isNumberOrBool is true for attribute values that are not strings
+func isNumberOrBool(value string) bool {
+	if value == "true" || value == "false" {
+		return true
+	}
+	_, err := strconv.ParseInt(value, 10, 64)
+	return err == nil
+}
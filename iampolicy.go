@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// commandPolicy lists the IAM actions a command needs
+type commandPolicy struct {
+	queue        []string // Actions on -queue
+	destination  []string // Actions on -queue2
+	global       []string // Actions without resource-level permissions
+	kms          []string // Actions on -kms-key
+	defaultQueue string   // Queue used when -queue is omitted, required if empty
+}
+
+// policyDocument is an IAM policy
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+// policyStatement is a single statement of an IAM policy
+type policyStatement struct {
+	Sid      string   `json:"Sid"`
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// stagingActions are needed on the temporary queues of qtoq -staged
+var stagingActions = []string{
+	"sqs:CreateQueue", "sqs:DeleteQueue", "sqs:GetQueueUrl", "sqs:GetQueueAttributes",
+	"sqs:SendMessage", "sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:ChangeMessageVisibility",
+}
+
+// commandPolicies maps commands to the actions they call
+// batch calls are authorized by their single message action
+var commandPolicies = map[string]commandPolicy{
+	"qtocsv": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage",
+			"sqs:SendMessage", "sqs:DeleteMessage", "sqs:ChangeMessageVisibility"},
+		kms: []string{"kms:GenerateDataKey", "kms:Decrypt"},
+	},
+	"qtoq": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage",
+			"sqs:DeleteMessage", "sqs:ChangeMessageVisibility"},
+		destination: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+	},
+	"send": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+		kms:   []string{"kms:GenerateDataKey"},
+	},
+	"generate": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+		kms:   []string{"kms:GenerateDataKey"},
+	},
+	"change-visibility": {queue: []string{"sqs:GetQueueUrl", "sqs:ChangeMessageVisibility"}},
+	"peek": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage"},
+		kms:   []string{"kms:Decrypt"},
+	},
+	"delete":  {queue: []string{"sqs:DeleteMessage"}},
+	"release": {queue: []string{"sqs:ChangeMessageVisibility"}},
+	"extend":  {queue: []string{"sqs:ChangeMessageVisibility"}},
+	"stats":   {queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes"}},
+	"count":   {queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes"}},
+	"watch": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes"},
+		// -max-age and -alert sns:TOPIC_ARN
+		global: []string{"cloudwatch:GetMetricStatistics", "sns:Publish"},
+	},
+	"purge": {queue: []string{"sqs:GetQueueUrl", "sqs:PurgeQueue"}},
+	"expire": {
+		// Deleting, -queue patterns are resolved with ListQueues
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage",
+			"sqs:DeleteMessage", "sqs:ChangeMessageVisibility"},
+		global: []string{"sqs:ListQueues"},
+	},
+	"poison-report": {queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage",
+		"sqs:ChangeMessageVisibility"}},
+	"fifo-verify": {queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage",
+		"sqs:ChangeMessageVisibility"}},
+	"split": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage",
+			"sqs:DeleteMessage", "sqs:ChangeMessageVisibility"},
+		// One of the rule queues, the policy is generated for each
+		destination: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+	},
+	"merge": {
+		// -queue patterns are resolved with ListQueues
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage",
+			"sqs:DeleteMessage", "sqs:ChangeMessageVisibility"},
+		destination: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+		global:      []string{"sqs:ListQueues"},
+	},
+	"mirror": {
+		// Copies are re-added to the queue, marked
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage",
+			"sqs:SendMessage", "sqs:DeleteMessage", "sqs:ChangeMessageVisibility"},
+		destination: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+	},
+	"canary": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage", "sqs:ReceiveMessage",
+			"sqs:DeleteMessage", "sqs:ChangeMessageVisibility"},
+		// -alert sns:TOPIC_ARN
+		global: []string{"sns:Publish"},
+	},
+	"soak": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+		// The DLQ is only read
+		global: []string{"sqs:GetQueueAttributes"},
+		kms:    []string{"kms:GenerateDataKey"},
+	},
+	"fill": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+		kms:   []string{"kms:GenerateDataKey"},
+	},
+	"drain": {queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ReceiveMessage",
+		"sqs:DeleteMessage", "sqs:ChangeMessageVisibility"}},
+	"lag": {
+		queue:  []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes"},
+		global: []string{"cloudwatch:GetMetricStatistics"},
+	},
+	"audit": {
+		queue:        []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes"},
+		global:       []string{"cloudwatch:GetMetricStatistics"},
+		defaultQueue: "*",
+	},
+	"config export": {
+		queue:        []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ListQueueTags"},
+		defaultQueue: "*",
+	},
+	"config apply": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ListQueueTags",
+			"sqs:CreateQueue", "sqs:SetQueueAttributes", "sqs:TagQueue", "sqs:UntagQueue"},
+		defaultQueue: "*",
+	},
+	"config to-terraform": {
+		queue:        []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ListQueueTags"},
+		defaultQueue: "*",
+	},
+	"config to-cloudformation": {
+		queue:        []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:ListQueueTags"},
+		defaultQueue: "*",
+	},
+	"create":    {queue: []string{"sqs:CreateQueue"}},
+	"set-attrs": {queue: []string{"sqs:GetQueueUrl", "sqs:SetQueueAttributes"}},
+	"whoami": {
+		queue:        []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes"},
+		global:       []string{"sqs:ListQueues"},
+		defaultQueue: "*",
+	},
+	"decrypt-export": {kms: []string{"kms:Decrypt"}},
+	"recover": {
+		queue:        []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+		defaultQueue: "*",
+	},
+	"import": {
+		queue: []string{"sqs:GetQueueUrl", "sqs:GetQueueAttributes", "sqs:SendMessage"},
+		// -from s3://BUCKET/KEY
+		global: []string{"s3:GetObject"},
+		kms:    []string{"kms:GenerateDataKey"},
+	},
+	"ping": {
+		queue:        []string{"sqs:GetQueueUrl"},
+		global:       []string{"sqs:ListQueues"},
+		defaultQueue: "*",
+	},
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// iamPolicy prints the minimal IAM policy to run a command against a queue
+func iamPolicy(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		iamPolicyUsage()
+	}
+	command, args := args[0], args[1:]
+	// config subcommands are two words
+	if command == "config" && len(args) > 0 {
+		command, args = command+" "+args[0], args[1:]
+	}
+	policy, ok := commandPolicies[command]
+	if !ok {
+		fmt.Printf("Unknown command %q.\n", command)
+		iamPolicyUsage()
+	}
+
+	policyCommand := flag.NewFlagSet("iam-policy", flag.ExitOnError)
+	queueName := policyCommand.String("queue", policy.defaultQueue, "queue name or pattern")
+	policyCommand.StringVar(queueName, "q", policy.defaultQueue, "queue name or pattern") // Aliasing
+	queue2 := policyCommand.String("queue2", "", "destination queue of qtoq")
+	policyCommand.StringVar(queue2, "q2", "", "destination queue of qtoq") // Aliasing
+	staged := policyCommand.Bool("staged", false, "include the staging queues of qtoq -staged")
+	kmsKey := policyCommand.String("kms-key", "", "KMS key ARN used for encryption")
+	policyHelp := policyCommand.Bool("help", false, "help for iam-policy command")
+	policyCommand.BoolVar(policyHelp, "h", false, "help") // Aliasing
+	parseFlags(policyCommand, args)
+
+	if *policyHelp {
+		iamPolicyUsage()
+	}
+
+	// Verify
+	if len(policy.queue) > 0 && len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		iamPolicyUsage()
+	}
+	if len(policy.destination) > 0 && len(*queue2) == 0 {
+		fmt.Println("Required destination queue name is missing.")
+		iamPolicyUsage()
+	}
+	if command == "decrypt-export" && len(*kmsKey) == 0 {
+		fmt.Println("Required KMS key is missing.")
+		iamPolicyUsage()
+	}
+
+	// Connect, the account ID is part of the queue ARNs
+	svc := newService()
+	identity, err := stsClient(svc.sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Fatal("Error identifying credentials ", err)
+	}
+	arn := func(name string) string {
+		return svc.queueARN(aws.StringValue(identity.Account), name)
+	}
+	doc := policy.document(command, *queueName, *queue2, *kmsKey, *staged, arn)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		log.Fatal("Error writing policy ", err)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// document returns the policy of a command run against its queues, arn giving the ARN of a queue
+func (p commandPolicy) document(command, queue, queue2, kmsKey string, staged bool, arn func(string) string) policyDocument {
+	doc := policyDocument{Version: "2012-10-17"}
+	global := append([]string{}, p.global...)
+	if len(p.queue) > 0 {
+		doc.Statement = append(doc.Statement, allow("Queue", p.queue, arn(queue)))
+		// Patterns are resolved by listing the queues
+		if isGlob(queue) {
+			global = append(global, "sqs:ListQueues")
+		}
+	}
+	if len(p.destination) > 0 {
+		doc.Statement = append(doc.Statement, allow("DestinationQueue", p.destination, arn(queue2)))
+	}
+	if staged && command == "qtoq" {
+		doc.Statement = append(doc.Statement, allow("StagingQueues", stagingActions, arn(stagingPrefix(queue)+"*")))
+	}
+	if len(p.kms) > 0 && len(kmsKey) > 0 {
+		doc.Statement = append(doc.Statement, allow("KMS", p.kms, kmsKey))
+	}
+	if len(global) > 0 {
+		doc.Statement = append(doc.Statement, allow("Global", uniqueSorted(global), "*"))
+	}
+	return doc
+}
+
+// allow returns an Allow statement
+func allow(sid string, actions []string, resource string) policyStatement {
+	return policyStatement{Sid: sid, Effect: "Allow", Action: uniqueSorted(actions), Resource: []string{resource}}
+}
+
+// uniqueSorted returns the sorted distinct values
+func uniqueSorted(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var unique []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func iamPolicyUsage() {
+	fmt.Println("usage: sqscli iam-policy <command> [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue            Queue name or pattern the command runs against")
+	fmt.Println("  -queue2           Destination queue of qtoq")
+	fmt.Println("  -staged           Include the staging queues of qtoq -staged")
+	fmt.Println("  -kms-key          KMS key ARN, for encrypted exports, -encrypt and decrypt-export")
+	os.Exit(0)
+}
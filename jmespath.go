@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+)
+
+// maxExactFloat is the largest integer a float64 holds exactly, 2^53
+const maxExactFloat = 1 << 53
+
+// - - - - - - - - - - - - - - - -
+//   JMESPATH
+// - - - - - - - - - - - - - - - -
+
+// searchBody evaluates a JMESPath query on a JSON body and returns the values found:
+// the elements of a list, or the single value, none for null, an empty list or a body that isn't JSON
+func searchBody(query *jmespath.JMESPath, body string) []interface{} {
+	doc, ok := decodeJMESPathDoc(body)
+	if !ok {
+		return nil
+	}
+	return searchDoc(query, doc)
+}
+
+// searchDoc evaluates a JMESPath query on a document decoded by decodeJMESPathDoc, see searchBody
+func searchDoc(query *jmespath.JMESPath, doc interface{}) []interface{} {
+	v, err := query.Search(doc)
+	if err != nil || v == nil {
+		return nil
+	}
+	if values, ok := v.([]interface{}); ok {
+		return values
+	}
+	return []interface{}{v}
+}
+
+// decodeJMESPathDoc decodes a JSON body with its numbers as float64, the only number type
+// go-jmespath compares; integers past 2^53 stay json.Number so they keep every digit,
+// they can't be compared but still make exact keys
+func decodeJMESPathDoc(body string) (interface{}, bool) {
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.UseNumber()
+	if dec.Decode(&doc) != nil {
+		return nil, false
+	}
+	return floatNumbers(doc), true
+}
+
+// floatNumbers converts the json.Number values of a decoded document, see decodeJMESPathDoc
+func floatNumbers(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			node[k] = floatNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range node {
+			node[i] = floatNumbers(child)
+		}
+	case json.Number:
+		f, err := node.Float64()
+		if err != nil || (!strings.ContainsAny(node.String(), ".eE") && math.Abs(f) > maxExactFloat) {
+			return node
+		}
+		return f
+	}
+	return v
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+const (
+	// kmsMagic starts every file encrypted by sqscli
+	kmsMagic = "SQSCLIKMS1\n"
+	// kmsChunkSize is the plaintext size of an encrypted chunk
+	kmsChunkSize = 64 * 1024
+)
+
+// kmsWriter encrypts a stream with a KMS data key
+// the file is the magic, the encrypted data key, then AES-256-GCM chunks
+// each chunk authenticates its sequence number and whether it is the last one
+// so reordered or truncated files are detected
+type kmsWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  bytes.Buffer
+	seq  uint64
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// decryptExport decrypts a file written with -kms-encrypt-export to stdout
+func decryptExport(args []string) {
+	decryptCommand := flag.NewFlagSet("decrypt-export", flag.ExitOnError)
+	in := decryptCommand.String("in", "", "encrypted file")
+	decryptHelp := decryptCommand.Bool("help", false, "help for decrypt-export command")
+	decryptCommand.BoolVar(decryptHelp, "h", false, "help") // Aliasing
+	parseFlags(decryptCommand, args)
+
+	if *decryptHelp || len(*in) == 0 {
+		decryptExportUsage()
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatal("Error opening file ", err)
+	}
+	defer f.Close()
+
+	// Connect
+	svc := newService()
+
+	if err := svc.decryptKMS(bufio.NewReader(f), os.Stdout); err != nil {
+		log.Fatal("Error decrypting file ", err)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   ENCRYPTION
+// - - - - - - - - - - - - - - - -
+
+// newKMSWriter generates a data key with keyID and writes the file header to w
+func (s *service) newKMSWriter(keyID string, w io.Writer) *kmsWriter {
+	dataKey, err := kmsClient(s.sess).GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		log.Fatal("Error generating data key ", err)
+	}
+	aead := newAEAD(dataKey.Plaintext)
+
+	if _, err := io.WriteString(w, kmsMagic); err != nil {
+		log.Fatal("Error writing output ", err)
+	}
+	if err := writeFrame(w, dataKey.CiphertextBlob); err != nil {
+		log.Fatal("Error writing output ", err)
+	}
+	return &kmsWriter{w: w, aead: aead}
+}
+
+// Write buffers plaintext, full chunks are encrypted right away
+func (k *kmsWriter) Write(p []byte) (int, error) {
+	k.buf.Write(p)
+	for k.buf.Len() >= kmsChunkSize {
+		if err := k.writeChunk(k.buf.Next(kmsChunkSize), false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush encrypts whatever is buffered
+func (k *kmsWriter) Flush() error {
+	if k.buf.Len() == 0 {
+		return nil
+	}
+	return k.writeChunk(k.buf.Next(k.buf.Len()), false)
+}
+
+// Close writes the last chunk, without it the file is reported truncated
+func (k *kmsWriter) Close() error {
+	return k.writeChunk(k.buf.Next(k.buf.Len()), true)
+}
+
+// writeChunk encrypts and writes a chunk
+func (k *kmsWriter) writeChunk(plain []byte, last bool) error {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := k.aead.Seal(nonce, nonce, plain, chunkAAD(k.seq, last))
+	k.seq++
+	return writeFrame(k.w, sealed)
+}
+
+// decryptKMS decrypts a stream written by a kmsWriter
+func (s *service) decryptKMS(r io.Reader, w io.Writer) error {
+	magic := make([]byte, len(kmsMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != kmsMagic {
+		return errors.New("not a sqscli encrypted file")
+	}
+	encryptedKey, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	dataKey, err := kmsClient(s.sess).Decrypt(&kms.DecryptInput{CiphertextBlob: encryptedKey})
+	if err != nil {
+		return err
+	}
+	aead := newAEAD(dataKey.Plaintext)
+
+	for seq := uint64(0); ; seq++ {
+		sealed, err := readFrame(r)
+		if err == io.EOF {
+			return errors.New("file is truncated")
+		}
+		if err != nil {
+			return err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return errors.New("file is corrupted")
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+		// Try as a middle chunk, then as the last one
+		last := false
+		plain, err := aead.Open(nil, nonce, ciphertext, chunkAAD(seq, false))
+		if err != nil {
+			last = true
+			if plain, err = aead.Open(nil, nonce, ciphertext, chunkAAD(seq, true)); err != nil {
+				return errors.New("file is corrupted or was tampered with")
+			}
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// newAEAD returns AES-256-GCM for a data key
+func newAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatal("Error creating cipher ", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatal("Error creating cipher ", err)
+	}
+	return aead
+}
+
+// chunkAAD returns the additional data authenticated with a chunk
+func chunkAAD(seq uint64, last bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, seq)
+	if last {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// writeFrame writes a length prefixed block
+func writeFrame(w io.Writer, b []byte) error {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(b)))
+	if _, err := w.Write(size); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame reads a length prefixed block
+func readFrame(r io.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func decryptExportUsage() {
+	fmt.Println("usage: sqscli decrypt-export [options]")
+	fmt.Println("options:")
+	fmt.Println("  -in required   File written with -kms-encrypt-export")
+	os.Exit(0)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// queueLag is the backlog of a queue against its consumption
+type queueLag struct {
+	depth      int      // Messages available and in flight
+	deleted    *float64 // Messages deleted per minute, nil when CloudWatch has no data
+	sent       *float64 // Messages sent per minute
+	received   *float64 // Messages received per minute
+	oldest     time.Duration
+	haveOldest bool
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// lag estimates how long queues take to drain at the rate their consumers delete messages
+func lag(args []string) {
+	lagCommand := flag.NewFlagSet("lag", flag.ExitOnError)
+	queueName := lagCommand.String("queue", "", "queue name or pattern")
+	lagCommand.StringVar(queueName, "q", "", "queue name or pattern") // Aliasing
+	window := lagCommand.Duration("window", 15*time.Minute, "period the rates are averaged over")
+	regions := lagCommand.String("regions", "", "comma separated regions to report across")
+	lagHelp := lagCommand.Bool("help", false, "help for lag command")
+	lagCommand.BoolVar(lagHelp, "h", false, "help") // Aliasing
+	parseFlags(lagCommand, args)
+
+	if *lagHelp {
+		lagUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		lagUsage()
+	}
+	if *window < 5*time.Minute {
+		log.Fatal("Window must be at least 5m, SQS metrics come every 1 to 5 minutes")
+	}
+
+	// Connect
+	services := regionServices(*regions)
+
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t := regionalTable(&table{columns: []column{
+		{key: "queue", title: "QUEUE"},
+		{key: "messages", title: "MESSAGES"},
+		{key: "deletedPerMinute", title: "DELETED/MIN", human: humanRate},
+		{key: "sentPerMinute", title: "SENT/MIN", human: humanRate},
+		{key: "oldestSeconds", title: "OLDEST", human: humanDuration},
+		{key: "drainSeconds", title: "TIME TO DRAIN", human: humanDuration},
+		{key: "receivedPerMinute", title: "RECEIVED/MIN", wide: true, human: humanRate},
+		{key: "netDrainSeconds", title: "NET TIME TO DRAIN", wide: true, human: humanDuration},
+	}}, services)
+	for _, svc := range services {
+		for _, qURL := range svc.resolveQueues(*queueName) {
+			l := svc.queueLag(qURL, *window)
+			var oldest interface{}
+			if l.haveOldest {
+				oldest = int(l.oldest.Seconds())
+			}
+			t.addIn(svc, queueNameFromURL(qURL), l.depth, l.deleted, l.sent, oldest,
+				drainSeconds(l.depth, l.deleted, nil), l.received, drainSeconds(l.depth, l.deleted, l.sent))
+		}
+	}
+	t.render(os.Stdout, format)
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// drainSeconds estimates the seconds to delete depth messages at a rate per minute,
+// less the inflow when given, -1 when the queue never drains, nil when the rates are unknown
+func drainSeconds(depth int, deleted, sent *float64) interface{} {
+	if depth == 0 {
+		return 0
+	}
+	if deleted == nil {
+		return nil
+	}
+	rate := *deleted
+	if sent != nil {
+		rate -= *sent
+	}
+	if rate <= 0 {
+		return -1
+	}
+	return int(math.Ceil(float64(depth) / rate * 60))
+}
+
+// humanRate formats a rate per minute, unknown without CloudWatch data
+func humanRate(v interface{}) string {
+	rate, ok := v.(*float64)
+	if !ok || rate == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%.1f", *rate)
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// queueLag reads the depth of a queue and its CloudWatch rates over the window
+func (s *service) queueLag(qURL string, window time.Duration) queueLag {
+	a := s.getQueueAttributes(qURL).Attributes
+	name := queueNameFromURL(qURL)
+	l := queueLag{
+		depth:    intAttribute(a, "ApproximateNumberOfMessages") + intAttribute(a, "ApproximateNumberOfMessagesNotVisible"),
+		deleted:  s.metricRate(name, "NumberOfMessagesDeleted", window),
+		sent:     s.metricRate(name, "NumberOfMessagesSent", window),
+		received: s.metricRate(name, "NumberOfMessagesReceived", window),
+	}
+	l.oldest, l.haveOldest = s.oldestMessageAge(name)
+	return l
+}
+
+// metricRate returns the per minute average of an SQS CloudWatch metric over the window,
+// nil when CloudWatch has no data for the queue
+func (s *service) metricRate(name, metric string, window time.Duration) *float64 {
+	cw := cloudWatchClient(s.sess)
+	now := time.Now()
+	result, err := cw.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/SQS"),
+		MetricName: aws.String(metric),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("QueueName"), Value: aws.String(name)},
+		},
+		StartTime:  aws.Time(now.Add(-window)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(60),
+		Statistics: []*string{aws.String(cloudwatch.StatisticSum)},
+	})
+	if err != nil {
+		log.Printf("Error fetching %s of %s: %s\n", metric, name, err)
+		return nil
+	}
+	if len(result.Datapoints) == 0 {
+		return nil
+	}
+	var sum float64
+	for _, dp := range result.Datapoints {
+		sum += aws.Float64Value(dp.Sum)
+	}
+	rate := sum / window.Minutes()
+	return &rate
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func lagUsage() {
+	fmt.Println("usage: sqscli lag [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name, wildcards match several queues")
+	fmt.Println("  -window           Period the rates are averaged over (default 15m)")
+	fmt.Println("  -regions          Comma separated regions to report across, e.g. us-east-1,eu-west-1")
+	os.Exit(0)
+}
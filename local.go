@@ -0,0 +1,938 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// localAccount is the account ID of the emulated queues
+	localAccount = "000000000000"
+	// localRegion is the region of the emulated queues
+	localRegion = "us-west-2"
+	// localDeduplicationWindow is how long FIFO deduplication IDs are remembered
+	localDeduplicationWindow = 5 * time.Minute
+)
+
+// localMode runs every command against the in-process emulator, set by -local or SQSCLI_LOCAL
+var localMode bool
+
+// localStateFile persists the emulated queues between runs, set by -local-state or SQSCLI_LOCAL_STATE
+var localStateFile string
+
+// localDefaults are the attributes of a new queue
+var localDefaults = map[string]string{
+	sqs.QueueAttributeNameVisibilityTimeout:             "30",
+	sqs.QueueAttributeNameMessageRetentionPeriod:        "345600",
+	sqs.QueueAttributeNameDelaySeconds:                  "0",
+	sqs.QueueAttributeNameMaximumMessageSize:            "262144",
+	sqs.QueueAttributeNameReceiveMessageWaitTimeSeconds: "0",
+}
+
+// localQueueName are the valid queue names
+var localQueueName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,80}$`)
+
+// localServer is an in-process SQS emulator
+// it serves the SQS API on a loopback port so the SDK runs unchanged
+type localServer struct {
+	mu    sync.Mutex
+	url   string
+	file  string
+	state localState
+}
+
+// localState is everything the emulator knows, persisted as JSON
+type localState struct {
+	Queues   map[string]*localQueue `json:"queues"`
+	Sequence int64                  `json:"sequence"`
+}
+
+// localQueue is an emulated queue
+type localQueue struct {
+	Name       string                `json:"name"`
+	Attributes map[string]string     `json:"attributes"`
+	Tags       map[string]string     `json:"tags,omitempty"`
+	Messages   []*localMessage       `json:"messages"`
+	Dedup      map[string]localDedup `json:"dedup,omitempty"`
+}
+
+// localDedup remembers a FIFO deduplication ID
+type localDedup struct {
+	MessageID string `json:"messageId"`
+	Expires   int64  `json:"expires"`
+}
+
+// localMessage is an emulated message, timestamps are in milliseconds
+type localMessage struct {
+	ID             string                                `json:"id"`
+	Body           string                                `json:"body"`
+	Attributes     map[string]*sqs.MessageAttributeValue `json:"attributes,omitempty"`
+	GroupID        string                                `json:"groupId,omitempty"`
+	DedupID        string                                `json:"dedupId,omitempty"`
+	SequenceNumber string                                `json:"sequenceNumber,omitempty"`
+	Sent           int64                                 `json:"sent"`
+	VisibleAt      int64                                 `json:"visibleAt"`
+	ReceiptHandle  string                                `json:"receiptHandle,omitempty"`
+	ReceiveCount   int64                                 `json:"receiveCount"`
+	FirstReceive   int64                                 `json:"firstReceive,omitempty"`
+	TraceHeader    string                                `json:"traceHeader,omitempty"` // AWSTraceHeader system attribute
+}
+
+// localError is an SQS error returned by the emulator
+type localError struct {
+	code    string
+	message string
+}
+
+// localOperation decodes the input of an action and runs it
+type localOperation struct {
+	input    func() interface{}
+	run      func(s *localServer, in interface{}) (interface{}, *localError)
+	readOnly bool // The state is not saved after it
+}
+
+// localOperations are the emulated actions
+var localOperations = map[string]localOperation{
+	"CreateQueue": {
+		input: func() interface{} { return &sqs.CreateQueueInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.createQueue(in.(*sqs.CreateQueueInput))
+		},
+	},
+	"GetQueueUrl": {
+		input: func() interface{} { return &sqs.GetQueueUrlInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.getQueueURL(in.(*sqs.GetQueueUrlInput))
+		},
+		readOnly: true,
+	},
+	"ListQueues": {
+		input: func() interface{} { return &sqs.ListQueuesInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.listQueues(in.(*sqs.ListQueuesInput))
+		},
+		readOnly: true,
+	},
+	"DeleteQueue": {
+		input: func() interface{} { return &sqs.DeleteQueueInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.deleteQueue(in.(*sqs.DeleteQueueInput))
+		},
+	},
+	"PurgeQueue": {
+		input: func() interface{} { return &sqs.PurgeQueueInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.purgeQueue(in.(*sqs.PurgeQueueInput))
+		},
+	},
+	"GetQueueAttributes": {
+		input: func() interface{} { return &sqs.GetQueueAttributesInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.getQueueAttributes(in.(*sqs.GetQueueAttributesInput))
+		},
+		readOnly: true,
+	},
+	"SetQueueAttributes": {
+		input: func() interface{} { return &sqs.SetQueueAttributesInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.setQueueAttributes(in.(*sqs.SetQueueAttributesInput))
+		},
+	},
+	"TagQueue": {
+		input: func() interface{} { return &sqs.TagQueueInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.tagQueue(in.(*sqs.TagQueueInput))
+		},
+	},
+	"UntagQueue": {
+		input: func() interface{} { return &sqs.UntagQueueInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.untagQueue(in.(*sqs.UntagQueueInput))
+		},
+	},
+	"ListQueueTags": {
+		input: func() interface{} { return &sqs.ListQueueTagsInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.listQueueTags(in.(*sqs.ListQueueTagsInput))
+		},
+		readOnly: true,
+	},
+	"SendMessage": {
+		input: func() interface{} { return &sqs.SendMessageInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.sendMessage(in.(*sqs.SendMessageInput))
+		},
+	},
+	"SendMessageBatch": {
+		input: func() interface{} { return &sqs.SendMessageBatchInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.sendMessageBatch(in.(*sqs.SendMessageBatchInput))
+		},
+	},
+	"ReceiveMessage": {
+		input: func() interface{} { return &sqs.ReceiveMessageInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.receiveMessage(in.(*sqs.ReceiveMessageInput))
+		},
+	},
+	"DeleteMessage": {
+		input: func() interface{} { return &sqs.DeleteMessageInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.deleteMessage(in.(*sqs.DeleteMessageInput))
+		},
+	},
+	"DeleteMessageBatch": {
+		input: func() interface{} { return &sqs.DeleteMessageBatchInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.deleteMessageBatch(in.(*sqs.DeleteMessageBatchInput))
+		},
+	},
+	"ChangeMessageVisibility": {
+		input: func() interface{} { return &sqs.ChangeMessageVisibilityInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.changeMessageVisibility(in.(*sqs.ChangeMessageVisibilityInput))
+		},
+	},
+	"ChangeMessageVisibilityBatch": {
+		input: func() interface{} { return &sqs.ChangeMessageVisibilityBatchInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return s.changeMessageVisibilityBatch(in.(*sqs.ChangeMessageVisibilityBatchInput))
+		},
+	},
+	"GetCallerIdentity": {
+		input: func() interface{} { return &sts.GetCallerIdentityInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return &sts.GetCallerIdentityOutput{
+				Account: aws.String(localAccount),
+				Arn:     aws.String("arn:aws:iam::" + localAccount + ":user/sqscli-local"),
+				UserId:  aws.String("SQSCLILOCAL"),
+			}, nil
+		},
+		readOnly: true,
+	},
+	"AssumeRole": {
+		input: func() interface{} { return &sts.AssumeRoleInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return &sts.AssumeRoleOutput{Credentials: localCredentials(in.(*sts.AssumeRoleInput).DurationSeconds)}, nil
+		},
+		readOnly: true,
+	},
+	"GetFederationToken": {
+		input: func() interface{} { return &sts.GetFederationTokenInput{} },
+		run: func(s *localServer, in interface{}) (interface{}, *localError) {
+			return &sts.GetFederationTokenOutput{Credentials: localCredentials(in.(*sts.GetFederationTokenInput).DurationSeconds)}, nil
+		},
+		readOnly: true,
+	},
+}
+
+// localCredentials returns temporary credentials, the emulator accepts any
+func localCredentials(seconds *int64) *sts.Credentials {
+	return &sts.Credentials{
+		AccessKeyId:     aws.String("ASIASQSCLILOCAL"),
+		SecretAccessKey: aws.String(localID()),
+		SessionToken:    aws.String(localID()),
+		Expiration:      aws.Time(time.Now().Add(time.Duration(aws.Int64Value(seconds)) * time.Second)),
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   SERVER
+// - - - - - - - - - - - - - - - -
+
+// newLocalSession starts the emulator and returns a session pointing to it
+// only SQS and STS GetCallerIdentity are emulated, other services fail
+func newLocalSession(stateFile string) *session.Session {
+	s := &localServer{file: stateFile, state: localState{Queues: make(map[string]*localQueue)}}
+	if len(stateFile) > 0 {
+		b, err := ioutil.ReadFile(stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal("Error reading local state ", err)
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &s.state); err != nil {
+				log.Fatal("Error reading local state ", err)
+			}
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal("Error starting local emulator ", err)
+	}
+	s.url = "http://" + ln.Addr().String()
+	go http.Serve(ln, s)
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(localRegion),
+		Credentials: credentials.NewStaticCredentials("sqscli", "local", ""),
+		Endpoint:    aws.String(s.url),
+		DisableSSL:  aws.Bool(true),
+	})
+	if err != nil {
+		log.Fatal("Error connecting to local emulator ", err)
+	}
+	return sess
+}
+
+// ServeHTTP implements http.Handler for both the JSON and query protocols
+func (s *localServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := localID()
+	w.Header().Set("X-Amzn-Requestid", requestID)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// JSON protocol, the action is in the target header, e.g. AmazonSQS.SendMessage
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		action := target[strings.LastIndex(target, ".")+1:]
+		out, lerr := s.call(action, func(in interface{}) error {
+			return jsonutil.UnmarshalJSON(in, bytes.NewReader(body))
+		})
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if lerr != nil {
+			w.Header().Set("X-Amzn-Query-Error", lerr.code+";Sender")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": lerr.code, "message": lerr.message})
+			return
+		}
+		b, err := jsonutil.BuildJSON(out)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+		return
+	}
+
+	// Query protocol
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := form.Get("Action")
+	out, lerr := s.call(action, func(in interface{}) error { return decodeQuery(form, in) })
+	w.Header().Set("Content-Type", "text/xml")
+	if lerr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		encodeQueryError(w, requestID, lerr)
+		return
+	}
+	encodeQueryResponse(w, action, requestID, out)
+}
+
+// call decodes, validates and runs an action
+func (s *localServer) call(action string, decode func(interface{}) error) (interface{}, *localError) {
+	op, ok := localOperations[action]
+	if !ok {
+		return nil, &localError{"UnsupportedOperation", action + " is not supported in local mode"}
+	}
+	in := op.input()
+	if err := decode(in); err != nil {
+		return nil, &localError{"MalformedInput", err.Error()}
+	}
+	if v, ok := in.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			return nil, &localError{"MissingParameter", err.Error()}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out, lerr := op.run(s, in)
+	if lerr == nil && !op.readOnly {
+		s.save()
+	}
+	return out, lerr
+}
+
+// save persists the state, if there is a state file
+func (s *localServer) save() {
+	if len(s.file) == 0 {
+		return
+	}
+	b, err := json.Marshal(s.state)
+	if err != nil {
+		log.Fatal("Error saving local state ", err)
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		log.Fatal("Error saving local state ", err)
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		log.Fatal("Error saving local state ", err)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   QUEUES
+// - - - - - - - - - - - - - - - -
+
+// queueURL returns the URL of an emulated queue
+func (s *localServer) queueURL(name string) string {
+	return s.url + "/" + localAccount + "/" + name
+}
+
+// queue finds the queue of a URL and drops its expired messages
+func (s *localServer) queue(queueURL *string) (*localQueue, *localError) {
+	name := queueNameFromURL(aws.StringValue(queueURL))
+	q, ok := s.state.Queues[name]
+	if !ok {
+		return nil, &localError{sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist."}
+	}
+
+	now := nowMillis()
+	retention, _ := strconv.ParseInt(q.Attributes[sqs.QueueAttributeNameMessageRetentionPeriod], 10, 64)
+	kept := q.Messages[:0]
+	for _, m := range q.Messages {
+		if now-m.Sent < retention*1000 {
+			kept = append(kept, m)
+		}
+	}
+	q.Messages = kept
+	for id, d := range q.Dedup {
+		if d.Expires < now {
+			delete(q.Dedup, id)
+		}
+	}
+	return q, nil
+}
+
+// isFIFO is true for FIFO queues
+func (q *localQueue) isFIFO() bool {
+	return q.Attributes[sqs.QueueAttributeNameFifoQueue] == "true"
+}
+
+func (s *localServer) createQueue(in *sqs.CreateQueueInput) (interface{}, *localError) {
+	name := aws.StringValue(in.QueueName)
+	attrs := aws.StringValueMap(in.Attributes)
+	fifo := attrs[sqs.QueueAttributeNameFifoQueue] == "true"
+	if !localQueueName.MatchString(strings.TrimSuffix(name, ".fifo")) || fifo != strings.HasSuffix(name, ".fifo") {
+		return nil, &localError{"InvalidParameterValue", "Invalid queue name " + name}
+	}
+
+	if q, ok := s.state.Queues[name]; ok {
+		for k, v := range attrs {
+			if q.Attributes[k] != v {
+				return nil, &localError{sqs.ErrCodeQueueNameExists, "A queue already exists with the same name and a different value for attribute " + k}
+			}
+		}
+		return &sqs.CreateQueueOutput{QueueUrl: aws.String(s.queueURL(name))}, nil
+	}
+
+	q := &localQueue{Name: name, Attributes: make(map[string]string), Tags: aws.StringValueMap(in.Tags)}
+	for k, v := range localDefaults {
+		q.Attributes[k] = v
+	}
+	for k, v := range attrs {
+		q.Attributes[k] = v
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	q.Attributes[sqs.QueueAttributeNameQueueArn] = "arn:aws:sqs:" + localRegion + ":" + localAccount + ":" + name
+	q.Attributes[sqs.QueueAttributeNameCreatedTimestamp] = now
+	q.Attributes[sqs.QueueAttributeNameLastModifiedTimestamp] = now
+	s.state.Queues[name] = q
+	return &sqs.CreateQueueOutput{QueueUrl: aws.String(s.queueURL(name))}, nil
+}
+
+func (s *localServer) getQueueURL(in *sqs.GetQueueUrlInput) (interface{}, *localError) {
+	name := aws.StringValue(in.QueueName)
+	if _, ok := s.state.Queues[name]; !ok {
+		return nil, &localError{sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist."}
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(s.queueURL(name))}, nil
+}
+
+func (s *localServer) listQueues(in *sqs.ListQueuesInput) (interface{}, *localError) {
+	var names []string
+	for name := range s.state.Queues {
+		if strings.HasPrefix(name, aws.StringValue(in.QueueNamePrefix)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// The next token is the offset of the next page
+	start, _ := strconv.Atoi(aws.StringValue(in.NextToken))
+	end := len(names)
+	out := &sqs.ListQueuesOutput{}
+	if max := int(aws.Int64Value(in.MaxResults)); max > 0 && start+max < end {
+		end = start + max
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	for _, name := range names[start:end] {
+		out.QueueUrls = append(out.QueueUrls, aws.String(s.queueURL(name)))
+	}
+	return out, nil
+}
+
+func (s *localServer) deleteQueue(in *sqs.DeleteQueueInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	delete(s.state.Queues, q.Name)
+	return &sqs.DeleteQueueOutput{}, nil
+}
+
+func (s *localServer) purgeQueue(in *sqs.PurgeQueueInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	q.Messages = nil
+	return &sqs.PurgeQueueOutput{}, nil
+}
+
+func (s *localServer) getQueueAttributes(in *sqs.GetQueueAttributesInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+
+	attrs := make(map[string]string, len(q.Attributes)+3)
+	for k, v := range q.Attributes {
+		attrs[k] = v
+	}
+	now := nowMillis()
+	var visible, inFlight, delayed int
+	for _, m := range q.Messages {
+		switch {
+		case m.VisibleAt <= now:
+			visible++
+		case m.ReceiveCount == 0:
+			delayed++
+		default:
+			inFlight++
+		}
+	}
+	attrs[sqs.QueueAttributeNameApproximateNumberOfMessages] = strconv.Itoa(visible)
+	attrs[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible] = strconv.Itoa(inFlight)
+	attrs[sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed] = strconv.Itoa(delayed)
+
+	out := &sqs.GetQueueAttributesOutput{Attributes: make(map[string]*string)}
+	for _, name := range in.AttributeNames {
+		if aws.StringValue(name) == sqs.QueueAttributeNameAll {
+			out.Attributes = aws.StringMap(attrs)
+			break
+		}
+		if v, ok := attrs[aws.StringValue(name)]; ok {
+			out.Attributes[aws.StringValue(name)] = aws.String(v)
+		}
+	}
+	return out, nil
+}
+
+func (s *localServer) setQueueAttributes(in *sqs.SetQueueAttributesInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	for k, v := range aws.StringValueMap(in.Attributes) {
+		if k == sqs.QueueAttributeNameFifoQueue || k == sqs.QueueAttributeNameQueueArn {
+			return nil, &localError{"InvalidAttributeName", "Attribute " + k + " can't be changed"}
+		}
+		if len(v) == 0 {
+			delete(q.Attributes, k)
+			continue
+		}
+		q.Attributes[k] = v
+	}
+	q.Attributes[sqs.QueueAttributeNameLastModifiedTimestamp] = strconv.FormatInt(time.Now().Unix(), 10)
+	return &sqs.SetQueueAttributesOutput{}, nil
+}
+
+func (s *localServer) tagQueue(in *sqs.TagQueueInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	if q.Tags == nil {
+		q.Tags = make(map[string]string)
+	}
+	for k, v := range aws.StringValueMap(in.Tags) {
+		q.Tags[k] = v
+	}
+	return &sqs.TagQueueOutput{}, nil
+}
+
+func (s *localServer) untagQueue(in *sqs.UntagQueueInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	for _, k := range in.TagKeys {
+		delete(q.Tags, aws.StringValue(k))
+	}
+	return &sqs.UntagQueueOutput{}, nil
+}
+
+func (s *localServer) listQueueTags(in *sqs.ListQueueTagsInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	out := &sqs.ListQueueTagsOutput{}
+	if len(q.Tags) > 0 {
+		out.Tags = aws.StringMap(q.Tags)
+	}
+	return out, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   MESSAGES
+// - - - - - - - - - - - - - - - -
+
+// enqueue adds a message to a queue, returns its ID and sequence number
+// a FIFO message whose deduplication ID was seen recently is accepted but dropped
+func (s *localServer) enqueue(q *localQueue, body string, attrs map[string]*sqs.MessageAttributeValue, system map[string]*sqs.MessageSystemAttributeValue, delay *int64, groupID, dedupID *string) (string, string, *localError) {
+	if len(body) == 0 {
+		return "", "", &localError{"MissingParameter", "The request must contain the parameter MessageBody."}
+	}
+	maxSize, _ := strconv.Atoi(q.Attributes[sqs.QueueAttributeNameMaximumMessageSize])
+	if len(body) > maxSize {
+		return "", "", &localError{"InvalidParameterValue", "Message must be shorter than " + strconv.Itoa(maxSize) + " bytes."}
+	}
+
+	now := nowMillis()
+	id := localID()
+	m := &localMessage{ID: id, Body: body, Attributes: attrs, Sent: now, VisibleAt: now}
+	if trace, ok := system[sqs.MessageSystemAttributeNameForSendsAwstraceHeader]; ok {
+		m.TraceHeader = aws.StringValue(trace.StringValue)
+	}
+
+	if q.isFIFO() {
+		if delay != nil {
+			return "", "", &localError{"InvalidParameterValue", "DelaySeconds is not supported on FIFO queues."}
+		}
+		if len(aws.StringValue(groupID)) == 0 {
+			return "", "", &localError{"MissingParameter", "The request must contain the parameter MessageGroupId."}
+		}
+		m.GroupID = *groupID
+		m.DedupID = aws.StringValue(dedupID)
+		if len(m.DedupID) == 0 {
+			if q.Attributes[sqs.QueueAttributeNameContentBasedDeduplication] != "true" {
+				return "", "", &localError{"InvalidParameterValue", "The queue should either have ContentBasedDeduplication enabled or MessageDeduplicationId provided explicitly."}
+			}
+			sum := sha256.Sum256([]byte(body))
+			m.DedupID = hex.EncodeToString(sum[:])
+		}
+		if d, ok := q.Dedup[m.DedupID]; ok {
+			return d.MessageID, "", nil
+		}
+		if q.Dedup == nil {
+			q.Dedup = make(map[string]localDedup)
+		}
+		q.Dedup[m.DedupID] = localDedup{MessageID: id, Expires: now + int64(localDeduplicationWindow/time.Millisecond)}
+		s.state.Sequence++
+		m.SequenceNumber = fmt.Sprintf("%020d", s.state.Sequence)
+	} else {
+		seconds, _ := strconv.ParseInt(q.Attributes[sqs.QueueAttributeNameDelaySeconds], 10, 64)
+		if delay != nil {
+			seconds = *delay
+		}
+		m.VisibleAt = now + seconds*1000
+	}
+
+	q.Messages = append(q.Messages, m)
+	return id, m.SequenceNumber, nil
+}
+
+func (s *localServer) sendMessage(in *sqs.SendMessageInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	id, seq, lerr := s.enqueue(q, aws.StringValue(in.MessageBody), in.MessageAttributes, in.MessageSystemAttributes, in.DelaySeconds, in.MessageGroupId, in.MessageDeduplicationId)
+	if lerr != nil {
+		return nil, lerr
+	}
+	out := &sqs.SendMessageOutput{
+		MessageId:        aws.String(id),
+		MD5OfMessageBody: aws.String(md5OfBody(aws.StringValue(in.MessageBody))),
+	}
+	if len(in.MessageAttributes) > 0 {
+		out.MD5OfMessageAttributes = aws.String(md5OfMessageAttributes(in.MessageAttributes))
+	}
+	if len(seq) > 0 {
+		out.SequenceNumber = aws.String(seq)
+	}
+	return out, nil
+}
+
+func (s *localServer) sendMessageBatch(in *sqs.SendMessageBatchInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	if len(in.Entries) > 10 {
+		return nil, &localError{sqs.ErrCodeTooManyEntriesInBatchRequest, "Maximum number of entries per request are 10."}
+	}
+	size := 0
+	for _, e := range in.Entries {
+		size += entrySize(e)
+	}
+	if size > maxBatchPayload {
+		return nil, &localError{sqs.ErrCodeBatchRequestTooLong, fmt.Sprintf("Batch requests cannot be longer than %d bytes. You have sent %d bytes.", maxBatchPayload, size)}
+	}
+	out := &sqs.SendMessageBatchOutput{}
+	for _, e := range in.Entries {
+		id, seq, lerr := s.enqueue(q, aws.StringValue(e.MessageBody), e.MessageAttributes, e.MessageSystemAttributes, e.DelaySeconds, e.MessageGroupId, e.MessageDeduplicationId)
+		if lerr != nil {
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id: e.Id, Code: aws.String(lerr.code), Message: aws.String(lerr.message), SenderFault: aws.Bool(true),
+			})
+			continue
+		}
+		result := &sqs.SendMessageBatchResultEntry{
+			Id:               e.Id,
+			MessageId:        aws.String(id),
+			MD5OfMessageBody: aws.String(md5OfBody(aws.StringValue(e.MessageBody))),
+		}
+		if len(e.MessageAttributes) > 0 {
+			result.MD5OfMessageAttributes = aws.String(md5OfMessageAttributes(e.MessageAttributes))
+		}
+		if len(seq) > 0 {
+			result.SequenceNumber = aws.String(seq)
+		}
+		out.Successful = append(out.Successful, result)
+	}
+	return out, nil
+}
+
+func (s *localServer) receiveMessage(in *sqs.ReceiveMessageInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	max := int(aws.Int64Value(in.MaxNumberOfMessages))
+	if max == 0 {
+		max = 1
+	}
+	visibility, _ := strconv.ParseInt(q.Attributes[sqs.QueueAttributeNameVisibilityTimeout], 10, 64)
+	if in.VisibilityTimeout != nil {
+		visibility = *in.VisibilityTimeout
+	}
+	dlq, maxReceives := s.deadLetterQueue(q)
+
+	now := nowMillis()
+	out := &sqs.ReceiveMessageOutput{}
+	// FIFO groups with a message in flight are blocked
+	blocked := make(map[string]bool)
+	kept := q.Messages[:0]
+	for _, m := range q.Messages {
+		if m.VisibleAt > now {
+			blocked[m.GroupID] = q.isFIFO()
+			kept = append(kept, m)
+			continue
+		}
+		if len(out.Messages) == max || blocked[m.GroupID] {
+			kept = append(kept, m)
+			continue
+		}
+		if dlq != nil && m.ReceiveCount >= maxReceives {
+			m.VisibleAt, m.ReceiptHandle = now, ""
+			dlq.Messages = append(dlq.Messages, m)
+			continue
+		}
+
+		m.ReceiveCount++
+		if m.FirstReceive == 0 {
+			m.FirstReceive = now
+		}
+		m.VisibleAt = now + visibility*1000
+		m.ReceiptHandle = localID()
+		out.Messages = append(out.Messages, m.toSQS(in.AttributeNames, in.MessageAttributeNames))
+		kept = append(kept, m)
+	}
+	q.Messages = kept
+	return out, nil
+}
+
+// deadLetterQueue returns the dead-letter queue of a queue and its max receive count
+func (s *localServer) deadLetterQueue(q *localQueue) (*localQueue, int64) {
+	p, ok := parseRedrivePolicy(aws.StringMap(q.Attributes))
+	if !ok {
+		return nil, 0
+	}
+	maxReceives, err := p.MaxReceiveCount.Int64()
+	if err != nil {
+		return nil, 0
+	}
+	dlq := s.state.Queues[p.DeadLetterTargetArn[strings.LastIndex(p.DeadLetterTargetArn, ":")+1:]]
+	if dlq == nil {
+		return nil, 0
+	}
+	return dlq, maxReceives
+}
+
+// toSQS returns the message as received, with the requested attributes
+func (m *localMessage) toSQS(attributeNames, messageAttributeNames []*string) *sqs.Message {
+	system := map[string]string{
+		sqs.MessageSystemAttributeNameSentTimestamp:                    strconv.FormatInt(m.Sent, 10),
+		sqs.MessageSystemAttributeNameApproximateReceiveCount:          strconv.FormatInt(m.ReceiveCount, 10),
+		sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp: strconv.FormatInt(m.FirstReceive, 10),
+		sqs.MessageSystemAttributeNameSenderId:                         localAccount,
+	}
+	if len(m.GroupID) > 0 {
+		system[sqs.MessageSystemAttributeNameMessageGroupId] = m.GroupID
+		system[sqs.MessageSystemAttributeNameMessageDeduplicationId] = m.DedupID
+		system[sqs.MessageSystemAttributeNameSequenceNumber] = m.SequenceNumber
+	}
+	if len(m.TraceHeader) > 0 {
+		system[sqs.MessageSystemAttributeNameAwstraceHeader] = m.TraceHeader
+	}
+
+	out := &sqs.Message{
+		MessageId:     aws.String(m.ID),
+		ReceiptHandle: aws.String(m.ReceiptHandle),
+		Body:          aws.String(m.Body),
+		MD5OfBody:     aws.String(md5OfBody(m.Body)),
+	}
+	for _, name := range aws.StringValueSlice(attributeNames) {
+		for k, v := range system {
+			if name == sqs.QueueAttributeNameAll || name == k {
+				if out.Attributes == nil {
+					out.Attributes = make(map[string]*string)
+				}
+				out.Attributes[k] = aws.String(v)
+			}
+		}
+	}
+	for _, name := range aws.StringValueSlice(messageAttributeNames) {
+		for k, v := range m.Attributes {
+			if name == sqs.QueueAttributeNameAll || name == ".*" || name == k ||
+				(strings.HasSuffix(name, ".*") && strings.HasPrefix(k, strings.TrimSuffix(name, "*"))) {
+				if out.MessageAttributes == nil {
+					out.MessageAttributes = make(map[string]*sqs.MessageAttributeValue)
+				}
+				out.MessageAttributes[k] = v
+			}
+		}
+	}
+	if len(out.MessageAttributes) > 0 {
+		out.MD5OfMessageAttributes = aws.String(md5OfMessageAttributes(out.MessageAttributes))
+	}
+	return out
+}
+
+// message finds the message of a receipt handle
+func (q *localQueue) message(receipt string) (int, *localMessage) {
+	for i, m := range q.Messages {
+		if m.ReceiptHandle == receipt {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+// deleteReceipt deletes the message of a receipt handle
+// unknown handles are ignored, like SQS does for messages already deleted
+func (q *localQueue) deleteReceipt(receipt string) {
+	if i, _ := q.message(receipt); i >= 0 {
+		q.Messages = append(q.Messages[:i], q.Messages[i+1:]...)
+	}
+}
+
+// changeVisibility hides the message of a receipt handle for timeout seconds
+func (q *localQueue) changeVisibility(receipt string, timeout int64) *localError {
+	_, m := q.message(receipt)
+	if m == nil || m.VisibleAt <= nowMillis() {
+		return &localError{sqs.ErrCodeMessageNotInflight, "Message does not exist or is not available for visibility timeout change."}
+	}
+	if timeout < 0 || timeout > maxVisibilityTimeout {
+		return &localError{"InvalidParameterValue", "Visibility timeout must be between 0 and 43200 seconds."}
+	}
+	m.VisibleAt = nowMillis() + timeout*1000
+	return nil
+}
+
+func (s *localServer) deleteMessage(in *sqs.DeleteMessageInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	q.deleteReceipt(aws.StringValue(in.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (s *localServer) deleteMessageBatch(in *sqs.DeleteMessageBatchInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, e := range in.Entries {
+		q.deleteReceipt(aws.StringValue(e.ReceiptHandle))
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+func (s *localServer) changeMessageVisibility(in *sqs.ChangeMessageVisibilityInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	if lerr := q.changeVisibility(aws.StringValue(in.ReceiptHandle), aws.Int64Value(in.VisibilityTimeout)); lerr != nil {
+		return nil, lerr
+	}
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (s *localServer) changeMessageVisibilityBatch(in *sqs.ChangeMessageVisibilityBatchInput) (interface{}, *localError) {
+	q, lerr := s.queue(in.QueueUrl)
+	if lerr != nil {
+		return nil, lerr
+	}
+	out := &sqs.ChangeMessageVisibilityBatchOutput{}
+	for _, e := range in.Entries {
+		if lerr := q.changeVisibility(aws.StringValue(e.ReceiptHandle), aws.Int64Value(e.VisibilityTimeout)); lerr != nil {
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id: e.Id, Code: aws.String(lerr.code), Message: aws.String(lerr.message), SenderFault: aws.Bool(true),
+			})
+			continue
+		}
+		out.Successful = append(out.Successful, &sqs.ChangeMessageVisibilityBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+// localID returns a random ID for messages, receipts and requests
+// newUUID is not used so recordings only capture the IDs of the client
+func localID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// nowMillis returns the current time in milliseconds
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
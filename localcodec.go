@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The emulator speaks both SQS wire protocols, the query protocol (form
+// encoded requests, XML responses) of older SDKs and the JSON protocol of
+// newer ones. The query codec below walks the SDK shapes with reflection,
+// using the same locationName and flattened tags as the SDK serializers.
+
+// - - - - - - - - - - - - - - - -
+//   QUERY REQUESTS
+// - - - - - - - - - - - - - - - -
+
+// decodeQuery fills an SDK input shape from form values
+func decodeQuery(form url.Values, v interface{}) error {
+	return decodeQueryValue(form, reflect.ValueOf(v).Elem(), "", "")
+}
+
+func decodeQueryValue(form url.Values, v reflect.Value, prefix string, tag reflect.StructTag) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !hasQueryPrefix(form, prefix) {
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeQueryValue(form, elem.Elem(), prefix, tag); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue // Unexported
+			}
+			name := queryName(prefix, field)
+			if err := decodeQueryValue(form, v.Field(i), name, field.Tag); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return decodeQueryScalar(form, v, prefix)
+		}
+		if tag.Get("flattened") == "" {
+			prefix += "." + listMemberName(tag)
+		}
+		for i := 1; hasQueryPrefix(form, prefix+"."+strconv.Itoa(i)); i++ {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeQueryValue(form, elem, prefix+"."+strconv.Itoa(i), ""); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, elem))
+		}
+	case reflect.Map:
+		if tag.Get("flattened") == "" {
+			prefix += ".entry"
+		}
+		keyName, valueName := mapEntryNames(tag)
+		m := reflect.MakeMap(v.Type())
+		for i := 1; hasQueryPrefix(form, prefix+"."+strconv.Itoa(i)); i++ {
+			entry := prefix + "." + strconv.Itoa(i)
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeQueryValue(form, value, entry+"."+valueName, ""); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(form.Get(entry+"."+keyName)), value)
+		}
+		if m.Len() > 0 {
+			v.Set(m)
+		}
+	default:
+		return decodeQueryScalar(form, v, prefix)
+	}
+	return nil
+}
+
+// decodeQueryScalar parses a single form value
+func decodeQueryScalar(form url.Values, v reflect.Value, name string) error {
+	raw, ok := form[name]
+	if !ok {
+		return nil
+	}
+	s := raw[0]
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		v.SetBool(s == "true")
+	case reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", name, s)
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("%s: invalid base64", name)
+		}
+		v.SetBytes(b)
+	default:
+		return fmt.Errorf("%s: unsupported type %s", name, v.Type())
+	}
+	return nil
+}
+
+// hasQueryPrefix is true if a form value is at or under name
+func hasQueryPrefix(form url.Values, name string) bool {
+	for key := range form {
+		if key == name || strings.HasPrefix(key, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// queryName is the name of a struct field under prefix
+func queryName(prefix string, field reflect.StructField) string {
+	name := field.Tag.Get("locationName")
+	if list := field.Tag.Get("locationNameList"); list != "" && field.Tag.Get("flattened") != "" {
+		name = list
+	}
+	if name == "" {
+		name = field.Name
+	}
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// listMemberName returns the name of the members of a list that is not flattened
+func listMemberName(tag reflect.StructTag) string {
+	if name := tag.Get("locationNameList"); name != "" {
+		return name
+	}
+	return "member"
+}
+
+// mapEntryNames returns the names of the key and value of map entries
+func mapEntryNames(tag reflect.StructTag) (string, string) {
+	keyName, valueName := tag.Get("locationNameKey"), tag.Get("locationNameValue")
+	if keyName == "" {
+		keyName = "key"
+	}
+	if valueName == "" {
+		valueName = "value"
+	}
+	return keyName, valueName
+}
+
+// - - - - - - - - - - - - - - - -
+//   QUERY RESPONSES
+// - - - - - - - - - - - - - - - -
+
+// encodeQueryResponse writes an SDK output shape as an XML query response
+func encodeQueryResponse(w io.Writer, action, requestID string, v interface{}) error {
+	e := xml.NewEncoder(w)
+	response := xml.StartElement{Name: xml.Name{Local: action + "Response"}}
+	result := xml.StartElement{Name: xml.Name{Local: action + "Result"}}
+	e.EncodeToken(response)
+	e.EncodeToken(result)
+	if err := encodeXMLFields(e, reflect.ValueOf(v).Elem()); err != nil {
+		return err
+	}
+	e.EncodeToken(result.End())
+	e.EncodeElement(struct {
+		RequestID string `xml:"RequestId"`
+	}{requestID}, xml.StartElement{Name: xml.Name{Local: "ResponseMetadata"}})
+	e.EncodeToken(response.End())
+	return e.Flush()
+}
+
+// encodeQueryError writes an XML query error response
+func encodeQueryError(w io.Writer, requestID string, err *localError) error {
+	type errorBody struct {
+		Type    string `xml:"Type"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	return xml.NewEncoder(w).Encode(struct {
+		XMLName   xml.Name  `xml:"ErrorResponse"`
+		Error     errorBody `xml:"Error"`
+		RequestID string    `xml:"RequestId"`
+	}{Error: errorBody{"Sender", err.code, err.message}, RequestID: requestID})
+}
+
+// encodeXMLFields writes the set fields of a struct
+func encodeXMLFields(e *xml.Encoder, v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue // Unexported
+		}
+		if err := encodeXMLValue(e, v.Field(i), queryName("", field), field.Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeXMLValue writes a value as an element named name
+func encodeXMLValue(e *xml.Encoder, v reflect.Value, name string, tag reflect.StructTag) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return encodeXMLValue(e, v.Elem(), name, tag)
+	case reflect.Struct:
+		// Timestamps, like the expiration of STS credentials
+		if t, ok := v.Interface().(time.Time); ok {
+			return e.EncodeElement(t.UTC().Format(time.RFC3339), start)
+		}
+		e.EncodeToken(start)
+		if err := encodeXMLFields(e, v); err != nil {
+			return err
+		}
+		return e.EncodeToken(start.End())
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.EncodeElement(base64.StdEncoding.EncodeToString(v.Bytes()), start)
+		}
+		if v.Len() == 0 {
+			return nil
+		}
+		flattened := tag.Get("flattened") != ""
+		if !flattened {
+			e.EncodeToken(start)
+		}
+		for i := 0; i < v.Len(); i++ {
+			itemName := name
+			if !flattened {
+				itemName = listMemberName(tag)
+			}
+			if err := encodeXMLValue(e, v.Index(i), itemName, ""); err != nil {
+				return err
+			}
+		}
+		if !flattened {
+			return e.EncodeToken(start.End())
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		keyName, valueName := mapEntryNames(tag)
+		for _, k := range keys {
+			e.EncodeToken(start)
+			e.EncodeElement(k.String(), xml.StartElement{Name: xml.Name{Local: keyName}})
+			if err := encodeXMLValue(e, v.MapIndex(k), valueName, ""); err != nil {
+				return err
+			}
+			e.EncodeToken(start.End())
+		}
+	case reflect.String, reflect.Bool, reflect.Int64:
+		return e.EncodeElement(fmt.Sprint(v.Interface()), start)
+	default:
+		return fmt.Errorf("%s: unsupported type %s", name, v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// noCache disables the lookup cache, set by -no-cache
+	noCache bool
+	// cacheTTL keeps lookups on disk for this long, set by -cache-ttl, 0 keeps them for the run only
+	cacheTTL time.Duration
+	// cacheWarning warns about the cache file once per run
+	cacheWarning sync.Once
+)
+
+// cachedLookup is a queue URL or type, and when it was looked up
+type cachedLookup struct {
+	Value string    `json:"value"`
+	At    time.Time `json:"at"`
+}
+
+// lookupCacheFile is the content of ~/.sqscli/cache.json
+type lookupCacheFile struct {
+	URLs map[string]cachedLookup `json:"urls"` // By hash of endpoint, credentials and queue name
+	FIFO map[string]cachedLookup `json:"fifo"` // By queue URL
+}
+
+// lookups caches the queue URLs and types of the run, and of earlier runs with -cache-ttl
+// both only change when a queue is deleted, and a FIFO queue is one by name
+var lookups = struct {
+	sync.Mutex
+	loaded bool
+	lookupCacheFile
+}{lookupCacheFile: lookupCacheFile{URLs: make(map[string]cachedLookup), FIFO: make(map[string]cachedLookup)}}
+
+// - - - - - - - - - - - - - - - -
+//   LOOKUP CACHE
+// - - - - - - - - - - - - - - - -
+
+// cachedQueueURL returns the URL of a queue name looked up before
+func (s *service) cachedQueueURL(name string) (string, bool) {
+	key, ok := s.urlCacheKey(name)
+	if !ok {
+		return "", false
+	}
+	return cacheGet(func(c *lookupCacheFile) map[string]cachedLookup { return c.URLs }, key)
+}
+
+// cacheQueueURL remembers the URL of a queue name
+func (s *service) cacheQueueURL(name, qURL string) {
+	if key, ok := s.urlCacheKey(name); ok {
+		cachePut(func(c *lookupCacheFile) map[string]cachedLookup { return c.URLs }, key, qURL)
+	}
+}
+
+// cachedFIFO returns the type of a queue looked up before
+func cachedFIFO(qURL string) (bool, bool) {
+	v, ok := cacheGet(func(c *lookupCacheFile) map[string]cachedLookup { return c.FIFO }, qURL)
+	if !ok {
+		return false, false
+	}
+	fifo, err := strconv.ParseBool(v)
+	return fifo, err == nil
+}
+
+// cacheFIFO remembers the type of a queue
+func cacheFIFO(qURL string, fifo bool) {
+	cachePut(func(c *lookupCacheFile) map[string]cachedLookup { return c.FIFO }, qURL, strconv.FormatBool(fifo))
+}
+
+// urlCacheKey identifies a queue name for the endpoint and credentials of the service,
+// so the same name in another account is looked up again
+// it is hashed, the file holds no access key ID
+func (s *service) urlCacheKey(name string) (string, bool) {
+	if !cacheEnabled() || s.sess.Config.Credentials == nil {
+		return "", false
+	}
+	creds, err := s.sess.Config.Credentials.Get()
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(s.Endpoint + "\n" + creds.AccessKeyID + "\n" + name))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// cacheGet returns an entry of the cache, loading the cache file the first time
+func cacheGet(entries func(*lookupCacheFile) map[string]cachedLookup, key string) (string, bool) {
+	if !cacheEnabled() {
+		return "", false
+	}
+	lookups.Lock()
+	defer lookups.Unlock()
+	loadLookupCache()
+	e, ok := entries(&lookups.lookupCacheFile)[key]
+	if !ok {
+		return "", false
+	}
+	// Entries of earlier runs expire, those of the run are kept for it
+	if persistCache() && time.Since(e.At) > cacheTTL {
+		return "", false
+	}
+	return e.Value, true
+}
+
+// cachePut adds an entry to the cache, and saves the cache file with -cache-ttl
+func cachePut(entries func(*lookupCacheFile) map[string]cachedLookup, key, value string) {
+	if !cacheEnabled() {
+		return
+	}
+	lookups.Lock()
+	defer lookups.Unlock()
+	loadLookupCache()
+	entries(&lookups.lookupCacheFile)[key] = cachedLookup{Value: value, At: time.Now()}
+	if persistCache() {
+		saveLookupCache()
+	}
+}
+
+// cacheEnabled is false with -no-cache, and when recording or replaying:
+// replays answer the calls in the recorded order, a recording holds every lookup
+func cacheEnabled() bool {
+	return !noCache && len(recordDir) == 0 && len(replayDir) == 0
+}
+
+// persistCache is true when lookups are kept on disk between runs
+// the queues of the emulator are its own
+func persistCache() bool {
+	return cacheEnabled() && cacheTTL > 0 && !localMode
+}
+
+// lookupCachePath is the cache file, empty without a home directory
+func lookupCachePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sqscli", "cache.json")
+}
+
+// loadLookupCache reads the cache file once, an unreadable file is an empty cache
+func loadLookupCache() {
+	if lookups.loaded || !persistCache() {
+		return
+	}
+	lookups.loaded = true
+	b, err := ioutil.ReadFile(lookupCachePath())
+	if err != nil {
+		return
+	}
+	var c lookupCacheFile
+	if json.Unmarshal(b, &c) != nil {
+		return
+	}
+	for key, e := range c.URLs {
+		lookups.URLs[key] = e
+	}
+	for key, e := range c.FIFO {
+		lookups.FIFO[key] = e
+	}
+}
+
+// saveLookupCache writes the entries not expired to the cache file
+// failures are warned about once, the cache is only an optimization
+func saveLookupCache() {
+	file := lookupCachePath()
+	if len(file) == 0 {
+		return
+	}
+	c := lookupCacheFile{URLs: make(map[string]cachedLookup), FIFO: make(map[string]cachedLookup)}
+	for key, e := range lookups.URLs {
+		if time.Since(e.At) <= cacheTTL {
+			c.URLs[key] = e
+		}
+	}
+	for key, e := range lookups.FIFO {
+		if time.Since(e.At) <= cacheTTL {
+			c.FIFO[key] = e
+		}
+	}
+	b, _ := json.Marshal(c)
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	// Runs in parallel each write their own temporary file
+	tmp := file + "." + strconv.Itoa(os.Getpid()) + ".tmp"
+	if err == nil {
+		err = ioutil.WriteFile(tmp, b, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		cacheWarning.Do(func() { log.Println("Warning: the lookup cache can't be saved", err) })
+	}
+}
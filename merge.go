@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Remappings of FIFO message groups, -group
+const (
+	groupKeep   = "keep"
+	groupSource = "source"
+)
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// merge drains several queues into one, a source after the other
+// moved messages are stamped with their source queue unless -provenance=false
+func merge(args []string) {
+	mergeCommand := flag.NewFlagSet("merge", flag.ExitOnError)
+	queueNames := mergeCommand.String("queue", "", "comma separated source queue names or patterns")
+	mergeCommand.StringVar(queueNames, "q", "", "comma separated source queue names or patterns") // Aliasing
+	toName := mergeCommand.String("to", "", "destination queue")
+	group := mergeCommand.String("group", groupKeep, "FIFO message groups: keep, or source to prefix them with the source queue")
+	stamp := mergeCommand.Bool("provenance", true, "stamp moved messages with sqscli.sourceQueue, sqscli.movedAt and sqscli.operationId")
+	concurrencyFlag := mergeCommand.String("concurrency", "1", "concurrent receivers per queue, or auto")
+	reportFile := mergeCommand.String("report", "", "file receiving the JSON summary")
+	var onComplete hookFlag
+	mergeCommand.Var(&onComplete, "on-complete", "exec:COMMAND or webhook:URL run once the merge is done, repeatable")
+	filters := newFilterFlags(mergeCommand)
+	mergeHelp := mergeCommand.Bool("help", false, "help for merge command")
+	mergeCommand.BoolVar(mergeHelp, "h", false, "help") // Aliasing
+	parseFlags(mergeCommand, args)
+
+	if *mergeHelp {
+		mergeUsage()
+	}
+
+	// Verify
+	if len(*queueNames) == 0 || len(*toName) == 0 {
+		fmt.Println("Required source or destination queue name is missing.")
+		mergeUsage()
+	}
+	if *group != groupKeep && *group != groupSource {
+		log.Fatal("Group must be keep or source")
+	}
+	concurrency, err := parseConcurrency(*concurrencyFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keep := filters.filter()
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+	to := svc.resolveQueue(*toName)
+	fifo := to.fifo
+
+	var sources []*queue
+	seen := make(map[string]bool)
+	for _, pattern := range strings.Split(*queueNames, ",") {
+		if pattern = strings.TrimSpace(pattern); len(pattern) == 0 {
+			continue
+		}
+		for _, q := range svc.queuesMatching(pattern) {
+			if q.url == to.url || seen[q.url] {
+				continue // The destination matching a pattern isn't merged into itself
+			}
+			seen[q.url] = true
+			sources = append(sources, q)
+		}
+	}
+	if len(sources) == 0 {
+		log.Fatal("No source queue besides the destination")
+	}
+	// Checked before anything moves
+	names := make([]string, 0, len(sources)+1)
+	for _, q := range sources {
+		if q.fifo != fifo {
+			log.Fatalf("Queue %s is not of the same type as %s\n", q.name, *toName)
+		}
+		names = append(names, q.name)
+	}
+	if *group == groupSource && !fifo {
+		log.Println("Warning: -group only applies to FIFO queues")
+	}
+
+	enforceGuardrails("merge", names, svc.depthCounter(), false)
+
+	// Apply
+	completionHooks = onComplete
+	startReport("merge", *reportFile, append(names, *toName)...)
+	for _, q := range sources {
+		log.Printf("Merging %s into %s\n", q.name, *toName)
+		opts := moveOptions{spool: operationSpool(""), filter: keep, concurrency: concurrency, provenance: *stamp}
+		if *group == groupSource && fifo {
+			opts.groupPrefix = strings.TrimSuffix(q.name, ".fifo") + ":"
+		}
+		svc.moveQueue(q, to, opts)
+	}
+	finishReport()
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// regroupStage prefixes the FIFO message group of each message, so groups of
+// different sources sharing an ID stay apart once merged
+func regroupStage(prefix string, in <-chan []*sqs.Message) <-chan []*sqs.Message {
+	out := make(chan []*sqs.Message, pipelineBuffer)
+	go func() {
+		defer close(out)
+		for batch := range in {
+			for _, m := range batch {
+				m.Attributes["MessageGroupId"] = aws.String(prefix + aws.StringValue(m.Attributes["MessageGroupId"]))
+			}
+			out <- batch
+		}
+	}()
+	return out
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func mergeUsage() {
+	fmt.Println("usage: sqscli merge [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Comma separated source queue names or patterns")
+	fmt.Println("  -to required      Destination queue")
+	fmt.Println("  -group            FIFO message groups: keep, or source to prefix them with the source queue (default keep)")
+	fmt.Println("  -provenance       Stamp moved messages with sqscli.sourceQueue, sqscli.movedAt and sqscli.operationId (default true)")
+	fmt.Println("  -concurrency      Concurrent receivers per queue, 1 to 32, or auto to scale them (default 1)")
+	fmt.Println("  -report           File receiving the JSON summary of the run")
+	fmt.Println("  -on-complete      exec:COMMAND or webhook:URL run once the merge is done, repeatable")
+	fmt.Println("  -since            Only messages sent after, RFC3339 or relative like 2h")
+	fmt.Println("  -until            Only messages sent before, RFC3339 or relative like 30m")
+	fmt.Println("  -filter-attr      Attribute predicate like RetryCount>3 or Source=billing, repeatable")
+	fmt.Println("  -filter           Expression the messages must match, like body.status == \"failed\"")
+	fmt.Println("  -sample           A share of the messages like 1%, or the first N")
+	os.Exit(0)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// migration is a queue moving to another account or region
+type migration struct {
+	source    queueConfig
+	target    queueConfig // Configuration recreated in the target account
+	sourceURL string
+	moved     int64
+}
+
+// - - - - - - - - - - - - - - - -
+//   MIGRATE COMMAND
+// - - - - - - - - - - - - - - - -
+
+// migrate recreates queues in another account or region, then moves their messages
+// the configuration is recreated first: attributes, tags, policy and DLQ wiring,
+// whose ARNs are rewritten to the target account, region and names
+// dead-letter queues of the migrated queues are migrated too, and created before them
+// the run ends with a verification of every queue, exits with 1 if one doesn't match
+func migrate(args []string) {
+	migrateCommand := flag.NewFlagSet("migrate", flag.ExitOnError)
+	queueNames := migrateCommand.String("queue", "", "comma separated queue names or patterns")
+	migrateCommand.StringVar(queueNames, "q", "", "comma separated queue names or patterns") // Aliasing
+	fromProfile := migrateCommand.String("from-profile", "", "shared config profile of the source account")
+	fromEnvFile := migrateCommand.String("from-env-file", "", "env file holding the credentials of the source account")
+	fromRegion := migrateCommand.String("from-region", "", "region of the source queues, -region by default")
+	toProfile := migrateCommand.String("to-profile", "", "shared config profile of the target account")
+	toEnvFile := migrateCommand.String("to-env-file", "", "env file holding the credentials of the target account")
+	toRegion := migrateCommand.String("to-region", "", "region of the target queues, -region by default")
+	toPrefix := migrateCommand.String("to-prefix", "", "prefix added to the target queue names")
+	toSuffix := migrateCommand.String("to-suffix", "", "suffix added to the target queue names, before .fifo")
+	toKMSKey := migrateCommand.String("to-kms-key", "", "KMS key of the target queues encrypted with a key of their own")
+	configOnly := migrateCommand.Bool("config-only", false, "only recreate the queues, leave the messages")
+	concurrency := migrateCommand.String("concurrency", "1", "concurrent receivers per queue, or auto")
+	plan := migrateCommand.Bool("plan", false, "only print the changes")
+	yes := migrateCommand.Bool("yes", false, "don't ask for confirmation")
+	reportFile := migrateCommand.String("report", "", "file receiving the JSON summary")
+	migrateHelp := migrateCommand.Bool("help", false, "help for migrate command")
+	migrateCommand.BoolVar(migrateHelp, "h", false, "help") // Aliasing
+	parseFlags(migrateCommand, args)
+
+	if *migrateHelp {
+		migrateUsage()
+	}
+
+	// Verify
+	if len(*queueNames) == 0 {
+		fmt.Println("Required argument is missing.")
+		migrateUsage()
+	}
+	if (len(*fromProfile) > 0 && len(*fromEnvFile) > 0) || (len(*toProfile) > 0 && len(*toEnvFile) > 0) {
+		log.Fatal("Credentials come from a profile or an env file, not both")
+	}
+	if len(*fromRegion) == 0 {
+		*fromRegion = awsRegion
+	}
+	if len(*toRegion) == 0 {
+		*toRegion = awsRegion
+	}
+	sameAccount := *fromProfile == *toProfile && *fromEnvFile == *toEnvFile
+	if sameAccount && *fromRegion == *toRegion && len(*toPrefix) == 0 && len(*toSuffix) == 0 {
+		log.Fatal("The target queues would be the source queues: set -to-profile, -to-env-file, -to-region, -to-prefix or -to-suffix")
+	}
+	workers, err := parseConcurrency(*concurrency)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect
+	src := newAccountService(*fromRegion, *fromProfile, *fromEnvFile)
+	dst := newAccountService(*toRegion, *toProfile, *toEnvFile)
+	srcAccount, dstAccount := src.accountID(), dst.accountID()
+	log.Printf("Migrating from account %s in %s to account %s in %s\n", srcAccount, *fromRegion, dstAccount, *toRegion)
+
+	// Queues, with their dead-letter queues
+	var names []string
+	sources := make(map[string]*migration)
+	for _, pattern := range strings.Split(*queueNames, ",") {
+		if pattern = strings.TrimSpace(pattern); len(pattern) == 0 {
+			continue
+		}
+		for _, qURL := range src.resolveQueues(pattern) {
+			names = src.addMigration(sources, names, qURL)
+		}
+	}
+	for i := 0; i < len(names); i++ {
+		dlq, ok := deadLetterTarget(sources[names[i]].source)
+		if !ok {
+			continue
+		}
+		a, err := parseQueueARN(dlq)
+		if err != nil || a.AccountID != srcAccount || a.Region != aws.StringValue(src.sess.Config.Region) {
+			log.Printf("Warning: the dead-letter queue %s of %s is not migrated, it isn't in the source account and region\n", dlq, names[i])
+			continue
+		}
+		if _, ok := sources[a.Resource]; !ok {
+			log.Printf("Migrating %s too, the dead-letter queue of %s\n", a.Resource, names[i])
+			names = src.addMigration(sources, names, src.getQueueURL(a.Resource))
+		}
+	}
+
+	// Rewrite the ARNs of the migrated queues
+	arns := make(map[string]string)
+	for _, name := range names {
+		arns[src.queueARN(srcAccount, name)] = dst.queueARN(dstAccount, drainTarget(name, *toPrefix, *toSuffix))
+	}
+	var ordered []*migration
+	for _, name := range migrationOrder(names, sources, arns, src.queueARN(srcAccount, "")) {
+		m := sources[name]
+		m.target = rewriteQueueConfig(m.source, drainTarget(name, *toPrefix, *toSuffix), arns, *toKMSKey)
+		for _, value := range m.target.Attributes {
+			if strings.Contains(value, srcAccount) && srcAccount != dstAccount {
+				log.Printf("Warning: the configuration of %s still refers to the source account %s\n", name, srcAccount)
+				break
+			}
+		}
+		ordered = append(ordered, m)
+	}
+
+	// Plan
+	var changes []configChange
+	invalid := false
+	for _, m := range ordered {
+		c := dst.planQueueConfig(m.target)
+		for _, line := range c.diff {
+			fmt.Println(line)
+		}
+		for _, e := range c.errors {
+			fmt.Printf("! %s: %s\n", c.queue, e)
+			invalid = true
+		}
+		if c.create || len(c.attrs) > 0 || len(c.tags) > 0 || len(c.untags) > 0 {
+			changes = append(changes, c)
+		}
+	}
+	if invalid {
+		log.Fatal("The plan contains changes that can't be applied")
+	}
+	if len(changes) == 0 {
+		fmt.Println("No configuration changes.")
+	}
+	question := fmt.Sprintf("Migrate %d queues, %d configuration changes?", len(ordered), len(changes))
+	if *plan {
+		return
+	}
+	enforceGuardrails("migrate", names, src.depthCounter(), *yes)
+	if !*yes && !confirm(question) {
+		return
+	}
+
+	// Apply
+	startReport("migrate", *reportFile, names...)
+	handleInterrupts()
+	for _, c := range changes {
+		dst.applyQueueConfig(c)
+		fmt.Printf("%s applied\n", c.queue)
+	}
+	if !*configOnly {
+		for _, m := range ordered {
+			before := atomic.LoadInt64(&tally.deleted)
+			src.moveQueue(src.queueAt(m.sourceURL), dst.resolveQueue(m.target.Name), moveOptions{
+				spool:       operationSpool(""),
+				concurrency: workers,
+			})
+			m.moved = atomic.LoadInt64(&tally.deleted) - before
+			fmt.Printf("%s: %d messages moved to %s\n", m.source.Name, m.moved, m.target.Name)
+		}
+	}
+	finishReport()
+
+	// Verify
+	t := &table{columns: []column{
+		{key: "queue", title: "QUEUE"},
+		{key: "target", title: "TARGET"},
+		{key: "config", title: "CONFIG"},
+		{key: "moved", title: "MOVED"},
+		{key: "left", title: "LEFT"},
+		{key: "targetMessages", title: "TARGET MESSAGES"},
+		{key: "verified", title: "VERIFIED"},
+	}}
+	verified := true
+	for _, m := range ordered {
+		config := "ok"
+		if diff := dst.planQueueConfig(m.target).diff; len(diff) > 0 {
+			config = fmt.Sprintf("%d differences", len(diff))
+		}
+		left := src.pendingMessages(m.sourceURL)
+		ok := config == "ok" && (left == 0 || *configOnly)
+		verified = verified && ok
+		t.add(m.source.Name, m.target.Name, config, m.moved, left, dst.pendingMessages(dst.getQueueURL(m.target.Name)), ok)
+	}
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t.render(os.Stdout, format)
+	if !verified {
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// addMigration adds a source queue to migrate, once
+func (s *service) addMigration(sources map[string]*migration, names []string, qURL string) []string {
+	name := queueNameFromURL(qURL)
+	if _, ok := sources[name]; ok {
+		return names
+	}
+	sources[name] = &migration{source: s.queueConfig(qURL), sourceURL: qURL}
+	return append(names, name)
+}
+
+// accountID returns the account of the credentials of a service
+func (s *service) accountID() string {
+	out, err := sts.New(s.sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Fatal("Error identifying the account ", err)
+	}
+	return aws.StringValue(out.Account)
+}
+
+// pendingMessages counts the messages of a queue, available, in flight and delayed
+func (s *service) pendingMessages(qURL string) int {
+	attrs := s.getQueueAttributes(qURL).Attributes
+	n := 0
+	for _, name := range []string{"ApproximateNumberOfMessages", "ApproximateNumberOfMessagesNotVisible", "ApproximateNumberOfMessagesDelayed"} {
+		v, _ := strconv.Atoi(aws.StringValue(attrs[name]))
+		n += v
+	}
+	return n
+}
+
+// deadLetterTarget returns the ARN of the dead-letter queue of a queue, if it has one
+func deadLetterTarget(c queueConfig) (string, bool) {
+	var policy struct {
+		DeadLetterTargetArn string `json:"deadLetterTargetArn"`
+	}
+	if err := json.Unmarshal([]byte(c.Attributes["RedrivePolicy"]), &policy); err != nil || len(policy.DeadLetterTargetArn) == 0 {
+		return "", false
+	}
+	return policy.DeadLetterTargetArn, true
+}
+
+// migrationOrder puts the dead-letter queues before the queues redriving to them,
+// a queue can't be created with a redrive policy to a queue that doesn't exist yet
+// arnPrefix is the ARN of the source queues, without their name
+func migrationOrder(names []string, sources map[string]*migration, arns map[string]string, arnPrefix string) []string {
+	var ordered []string
+	done := make(map[string]bool)
+	var visit func(name string, depth int)
+	visit = func(name string, depth int) {
+		if done[name] || depth > len(names) {
+			return
+		}
+		if dlq, ok := deadLetterTarget(sources[name].source); ok {
+			if _, migrated := arns[dlq]; migrated {
+				visit(strings.TrimPrefix(dlq, arnPrefix), depth+1)
+			}
+		}
+		if !done[name] {
+			done[name] = true
+			ordered = append(ordered, name)
+		}
+	}
+	for _, name := range names {
+		visit(name, 0)
+	}
+	return ordered
+}
+
+// rewriteQueueConfig returns the configuration of a target queue
+// the ARNs of migrated queues in the DLQ wiring and policy become those of their targets
+// a queue encrypted with a key of its own gets kmsKey, when set
+func rewriteQueueConfig(c queueConfig, name string, arns map[string]string, kmsKey string) queueConfig {
+	target := queueConfig{Name: name, Attributes: make(map[string]string), Tags: c.Tags}
+	pairs := make([]string, 0, 2*len(arns))
+	for from, to := range arns {
+		// Quoted, so a queue named like the prefix of another isn't rewritten within it,
+		// or followed by a slash like the policy IDs of the console
+		pairs = append(pairs, `"`+from+`"`, `"`+to+`"`, `"`+from+`/`, `"`+to+`/`)
+	}
+	quoted := strings.NewReplacer(pairs...)
+	for attr, value := range c.Attributes {
+		switch attr {
+		case "RedrivePolicy", "RedriveAllowPolicy", "Policy":
+			value = quoted.Replace(value)
+		case "KmsMasterKeyId":
+			if len(kmsKey) > 0 && value != "alias/aws/sqs" {
+				value = kmsKey
+			}
+		}
+		target.Attributes[attr] = value
+	}
+	return target
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func migrateUsage() {
+	fmt.Println("usage: sqscli migrate [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Comma separated queue names or patterns")
+	fmt.Println("  -from-profile     Shared config profile of the source account (default the environment credentials)")
+	fmt.Println("  -from-env-file    Env file with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY of the source account")
+	fmt.Println("  -from-region      Region of the source queues (default -region)")
+	fmt.Println("  -to-profile       Shared config profile of the target account (default the environment credentials)")
+	fmt.Println("  -to-env-file      Env file with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY of the target account")
+	fmt.Println("  -to-region        Region of the target queues (default -region)")
+	fmt.Println("  -to-prefix        Prefix added to the target queue names")
+	fmt.Println("  -to-suffix        Suffix added to the target queue names, before .fifo")
+	fmt.Println("  -to-kms-key       KMS key of the target queues encrypted with a key of their own")
+	fmt.Println("  -config-only      Only recreate the queues, leave the messages")
+	fmt.Println("  -concurrency      Concurrent receivers per queue, 1 to 32, or auto (default 1)")
+	fmt.Println("  -plan             Only print the changes")
+	fmt.Println("  -yes              Don't ask for confirmation")
+	fmt.Println("  -report           File receiving the JSON summary of the run")
+	os.Exit(0)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// mirroring is the state of the mirror in progress, nil otherwise
+var mirroring *mirrorState
+
+// mirrorState is the progress of a mirror, served on /mirror and exported as the sqscli.mirror.lag metric
+type mirrorState struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Passes      int64   `json:"passes"`
+	Copied      int64   `json:"copied"`
+	Failed      int64   `json:"failed"`
+	LagSeconds  float64 `json:"lagSeconds"` // How long the last copied message waited in the source
+	LastCopy    string  `json:"lastCopy,omitempty"`
+	mu          sync.Mutex
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// mirror copies the new messages of a queue to another queue, in another account or region,
+// until it is interrupted
+// messages are not consumed: once copied, each is re-added to the source with a marker
+// so later passes skip it, like the copies of an export
+func mirror(args []string) {
+	mirrorCommand := flag.NewFlagSet("mirror", flag.ExitOnError)
+	queueName := mirrorCommand.String("queue", "", "queue name")
+	mirrorCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	toName := mirrorCommand.String("to", "", "destination queue")
+	toRegion := mirrorCommand.String("to-region", "", "region of the destination queue, -region by default")
+	toProfile := mirrorCommand.String("to-profile", "", "shared config profile of the destination account")
+	toEnvFile := mirrorCommand.String("to-env-file", "", "env file holding the credentials of the destination account")
+	id := mirrorCommand.String("id", "", "marks the messages already copied, REGION/QUEUE of the destination by default")
+	interval := mirrorCommand.Duration("interval", 10*time.Second, "pause between two passes over the queue")
+	stamp := mirrorCommand.Bool("provenance", false, "stamp copies with sqscli.sourceQueue, sqscli.movedAt and sqscli.operationId")
+	concurrencyFlag := mirrorCommand.String("concurrency", "1", "concurrent receivers, or auto")
+	reportFile := mirrorCommand.String("report", "", "file receiving the JSON summary")
+	filters := newFilterFlags(mirrorCommand)
+	mirrorHelp := mirrorCommand.Bool("help", false, "help for mirror command")
+	mirrorCommand.BoolVar(mirrorHelp, "h", false, "help") // Aliasing
+	parseFlags(mirrorCommand, args)
+
+	if *mirrorHelp {
+		mirrorUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 || len(*toName) == 0 {
+		fmt.Println("Required source or destination queue name is missing.")
+		mirrorUsage()
+	}
+	if len(*toProfile) > 0 && len(*toEnvFile) > 0 {
+		log.Fatal("Credentials come from a profile or an env file, not both")
+	}
+	if *interval <= 0 {
+		log.Fatal("Interval must be positive")
+	}
+	if len(*toRegion) == 0 {
+		*toRegion = awsRegion
+	}
+	concurrency, err := parseConcurrency(*concurrencyFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keep := filters.filter()
+
+	// Connect
+	svc := newService()
+	dst := newAccountService(*toRegion, *toProfile, *toEnvFile)
+	handleInterrupts()
+	q := svc.resolveQueue(*queueName)
+	to := dst.resolveQueue(*toName)
+	qURL, toURL, fifo := q.url, to.url, q.fifo
+	if qURL == toURL {
+		log.Fatal("The destination is the queue mirrored")
+	}
+	if to.fifo != fifo {
+		log.Fatal("Cannot mirror queues that are not of the same type")
+	}
+	if len(*id) == 0 {
+		*id = *toRegion + "/" + *toName
+	}
+	var prov *provenance
+	if *stamp {
+		prov = newProvenance(qURL)
+	}
+	// Copies and re-added messages keep their attributes
+	rewrite := &messageRewrite{attributes: true}
+
+	// Apply
+	mirroring = &mirrorState{Source: *queueName, Destination: *toName}
+	if len(healthAddr) > 0 {
+		serveHealth(healthAddr, map[string]http.HandlerFunc{"/mirror": mirroring.serve})
+	}
+	startReport("mirror", *reportFile, *queueName, *toName)
+	log.Printf("Mirroring %s to %s every %s\n", *queueName, *toName, *interval)
+	failed := false
+	for !isInterrupted() {
+		acks := newAcks(fifo)
+		copies, copyErrs := mirroring.copyStage(svc, dst, qURL, toURL, fifo, prov, rewrite,
+			svc.receiveStage(q, markedCopies(*id), keep, acks, concurrency))
+		opts := pipelineOptions{extra: exportMarker(*id), acks: acks, rewrite: rewrite}
+		n, errs := svc.resendStage(q, q, opts, copies)
+		if len(*copyErrs) > 0 || len(errs) > 0 {
+			failed = true
+		}
+		mirroring.mu.Lock()
+		mirroring.Passes++
+		mirroring.mu.Unlock()
+		if n > 0 {
+			log.Printf("%d messages copied, lag %s\n", n, mirroring.lag().Round(time.Second))
+		}
+		select {
+		case <-interrupted:
+		case <-time.After(*interval):
+		}
+	}
+	log.Printf("Mirror stopped, %d messages copied\n", atomic.LoadInt64(&tally.written))
+	if failed {
+		failReport()
+	}
+	finishReport()
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// lag is how long the last copied message waited in the source
+func (m *mirrorState) lag() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Duration(m.LagSeconds * float64(time.Second))
+}
+
+// serve answers /mirror with the state as JSON
+func (m *mirrorState) serve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	b, _ := json.Marshal(m)
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// copyStage sends each batch to the queue to of dst, and passes on the messages copied
+// the others are released right away, to be copied by the next pass
+// the errors are final once the returned channel is closed
+func (m *mirrorState) copyStage(src, dst *service, from, to string, fifo bool, prov *provenance, rewrite *messageRewrite, in <-chan []*sqs.Message) (<-chan []*sqs.Message, *[]error) {
+	out := make(chan []*sqs.Message, pipelineBuffer)
+	errors := &[]error{}
+	go func() {
+		defer close(out)
+		for batch := range in {
+			sent, errs := dst.resendBatch(to, batch, fifo, 0, prov.attributes(nil), rewrite)
+			for _, err := range errs {
+				log.Println("Error copying messages", err)
+				noteFailure(err)
+			}
+			*errors = append(*errors, errs...)
+			atomic.AddInt64(&tally.written, int64(len(sent)))
+			if len(sent) < len(batch) {
+				atomic.AddInt64(&tally.failed, int64(len(batch)-len(sent)))
+				src.changeVisibilityBatch(from, unsentReceipts(batch, sent), 0)
+			}
+			now := time.Now()
+			m.mu.Lock()
+			m.Copied += int64(len(sent))
+			m.Failed += int64(len(batch) - len(sent))
+			if len(sent) > 0 {
+				if at, ok := sentAt(sent[len(sent)-1]); ok {
+					m.LagSeconds = now.Sub(at).Seconds()
+				}
+				m.LastCopy = now.UTC().Format(time.RFC3339)
+			}
+			m.mu.Unlock()
+			// Passed on even when empty, FIFO receives wait for the batch to be acknowledged
+			out <- sent
+		}
+	}()
+	return out, errors
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func mirrorUsage() {
+	fmt.Println("usage: sqscli mirror [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue to mirror")
+	fmt.Println("  -to required      Destination queue")
+	fmt.Println("  -to-region        Region of the destination queue, -region by default")
+	fmt.Println("  -to-profile       Shared config profile of the destination account")
+	fmt.Println("  -to-env-file      Env file holding the credentials of the destination account")
+	fmt.Println("  -id               Marks the messages already copied, REGION/QUEUE of the destination by default")
+	fmt.Println("  -interval         Pause between two passes over the queue (default 10s)")
+	fmt.Println("  -provenance       Stamp copies with sqscli.sourceQueue, sqscli.movedAt and sqscli.operationId")
+	fmt.Println("  -concurrency      Concurrent receivers, 1 to 32, or auto to scale them (default 1)")
+	fmt.Println("  -report           File receiving the JSON summary of the run")
+	fmt.Println("  -since            Only messages sent after, RFC3339 or relative like 2h")
+	fmt.Println("  -until            Only messages sent before, RFC3339 or relative like 30m")
+	fmt.Println("  -filter-attr      Attribute predicate like RetryCount>3 or Source=billing, repeatable")
+	fmt.Println("  -filter           Expression the messages must match, like body.status == \"failed\"")
+	os.Exit(0)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Statuses of an operation
+const (
+	opRunning     = "running"
+	opCompleted   = "completed"
+	opFailed      = "failed"
+	opInterrupted = "interrupted"
+	opStopped     = "stopped" // Still running as far as its state says, but no longer saved
+)
+
+const (
+	// opHeartbeat is how often the state of a running operation is saved
+	opHeartbeat = 5 * time.Second
+	// maxOpFailures caps the errors kept in the state of an operation
+	maxOpFailures = 100
+)
+
+// operationID continues the operation of this ID, set by ops resume through the hidden -operation-id
+var operationID string
+
+// operation is the bulk operation in progress, nil for other commands
+var operation *opState
+
+// opState is the state of a bulk operation, saved under ~/.sqscli/ops
+type opState struct {
+	ID        string     `json:"id" yaml:"id"`
+	Command   string     `json:"command" yaml:"command"`
+	Args      []string   `json:"args" yaml:"args"` // Command line, filters included, run again by ops resume
+	Queues    []string   `json:"queues" yaml:"queues"`
+	Status    string     `json:"status" yaml:"status"`
+	Runs      int        `json:"runs" yaml:"runs"` // 1, plus one per resume
+	Started   time.Time  `json:"started" yaml:"started"`
+	Updated   time.Time  `json:"updated" yaml:"updated"`
+	Finished  *time.Time `json:"finished,omitempty" yaml:"finished,omitempty"`
+	Progress  opProgress `json:"progress" yaml:"progress"`                     // Summed over the runs
+	Failures  []string   `json:"failures,omitempty" yaml:"failures,omitempty"` // Errors of the runs, latest last
+	Undeleted []string   `json:"undeleted,omitempty" yaml:"undeleted,omitempty"`
+
+	base     opProgress // Progress of the previous runs
+	failures int        // Errors of this run
+	mu       sync.Mutex
+}
+
+// opProgress counts the messages an operation went through, see tally
+type opProgress struct {
+	Received   int64 `json:"received" yaml:"received"`
+	Written    int64 `json:"written" yaml:"written"`
+	Sent       int64 `json:"sent" yaml:"sent"`
+	Deleted    int64 `json:"deleted" yaml:"deleted"`
+	Failed     int64 `json:"failed" yaml:"failed"`
+	Duplicates int64 `json:"duplicatesSkipped" yaml:"duplicatesSkipped"`
+}
+
+// - - - - - - - - - - - - - - - -
+//   OPERATION STATE
+// - - - - - - - - - - - - - - - -
+
+// opsDir is where the operations are saved, ~/.sqscli/ops
+func opsDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".sqscli", "ops"), nil
+}
+
+// startOperation saves the start of a bulk operation, or the resume of the -operation-id one
+// the state is saved every opHeartbeat, a failure to save it is only a warning
+func startOperation(command string, queues ...string) {
+	dir, err := opsDir()
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		log.Println("Warning: the operation is not saved,", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	if len(operationID) > 0 {
+		op, err := loadOperation(operationID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if op.Command != command {
+			log.Fatalf("Operation %s is a %s, not a %s\n", op.ID, op.Command, command)
+		}
+		op.Status, op.Finished, op.Updated = opRunning, nil, now
+		op.Runs++
+		op.base, op.Undeleted = op.Progress, nil
+		operation = op
+		log.Printf("Resuming operation %s, run %d\n", op.ID, op.Runs)
+	} else {
+		id, _ := newUUID()
+		operation = &opState{
+			ID:      id,
+			Command: command,
+			Args:    os.Args[1:],
+			Queues:  queues,
+			Status:  opRunning,
+			Runs:    1,
+			Started: now,
+			Updated: now,
+		}
+		logVerbose("Operation %s started\n", id)
+	}
+	operation.save()
+
+	go func(op *opState) {
+		for range time.Tick(opHeartbeat) {
+			op.mu.Lock()
+			running := op.Status == opRunning
+			op.mu.Unlock()
+			if !running {
+				return
+			}
+			op.save()
+		}
+	}(operation)
+}
+
+// finishOperation saves the outcome of the operation
+// failed messages, or messages left undeleted, fail it so it can be resumed
+func finishOperation() {
+	op := operation
+	if op == nil {
+		return
+	}
+	op.mu.Lock()
+	if op.Status != opRunning {
+		op.mu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	op.Finished = &now
+	undeleted.Lock()
+	left := len(undeleted.ids)
+	undeleted.Unlock()
+	switch {
+	case isInterrupted():
+		op.Status = opInterrupted
+	case atomic.LoadInt64(&tally.failed) > 0 || left > 0 || op.failures > 0:
+		op.Status = opFailed
+	default:
+		op.Status = opCompleted
+	}
+	status := op.Status
+	op.mu.Unlock()
+	op.save()
+	// Only a run left unfinished has something to resume
+	if status != opCompleted {
+		log.Printf("Operation %s %s, resume it with: sqscli ops resume %s\n", op.ID, status, op.ID)
+	}
+}
+
+// noteFailure keeps an error of the operation in progress, if any
+func noteFailure(err error) {
+	op := operation
+	if op == nil || err == nil {
+		return
+	}
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.failures++
+	op.Failures = append(op.Failures, fmt.Sprintf("%s %s", time.Now().UTC().Format(time.RFC3339), err))
+	if len(op.Failures) > maxOpFailures {
+		op.Failures = op.Failures[len(op.Failures)-maxOpFailures:]
+	}
+}
+
+// operationSpool is the spool of a move or an export, the one given or else one of the operation
+// so a resumed run replays the batches an earlier run crashed with
+func operationSpool(file string) string {
+	if len(file) > 0 || operation == nil {
+		return file
+	}
+	dir, _ := opsDir()
+	return filepath.Join(dir, operation.ID+".spool")
+}
+
+// save writes the state with the progress so far, replacing the file at once
+func (op *opState) save() {
+	op.mu.Lock()
+	op.Updated = time.Now().UTC()
+	op.Progress = opProgress{
+		Received:   op.base.Received + atomic.LoadInt64(&tally.received),
+		Written:    op.base.Written + atomic.LoadInt64(&tally.written),
+		Sent:       op.base.Sent + atomic.LoadInt64(&tally.sent),
+		Deleted:    op.base.Deleted + atomic.LoadInt64(&tally.deleted),
+		Failed:     op.base.Failed + atomic.LoadInt64(&tally.failed),
+		Duplicates: op.base.Duplicates + atomic.LoadInt64(&tally.duplicates),
+	}
+	undeleted.Lock()
+	op.Undeleted = append([]string(nil), undeleted.ids...)
+	undeleted.Unlock()
+	b, _ := json.MarshalIndent(op, "", "  ")
+	op.mu.Unlock()
+
+	dir, _ := opsDir()
+	file := filepath.Join(dir, op.ID+".json")
+	tmp := file + ".tmp"
+	err := ioutil.WriteFile(tmp, append(b, '\n'), 0600)
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		log.Println("Error saving the operation", err)
+	}
+}
+
+// loadOperation reads the state of an operation, id may be a unique prefix of its ID
+func loadOperation(id string) (*opState, error) {
+	if len(id) == 0 || strings.ContainsAny(id, `/\.`) {
+		return nil, fmt.Errorf("invalid operation ID %q", id)
+	}
+	all, err := listOperations()
+	if err != nil {
+		return nil, err
+	}
+	var found *opState
+	for _, op := range all {
+		if op.ID == id {
+			return op, nil
+		}
+		if strings.HasPrefix(op.ID, id) {
+			if found != nil {
+				return nil, fmt.Errorf("operation ID %s is ambiguous, give more of it", id)
+			}
+			found = op
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("operation %s not found", id)
+	}
+	return found, nil
+}
+
+// listOperations reads the saved operations, latest first
+// a running operation no longer saved is shown as stopped, its process died
+func listOperations() ([]*opState, error) {
+	dir, err := opsDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ops []*opState
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		op := &opState{}
+		if err := json.Unmarshal(b, op); err != nil {
+			log.Printf("Skipping %s: %s\n", file, err)
+			continue
+		}
+		if op.Status == opRunning && time.Since(op.Updated) > 3*opHeartbeat {
+			op.Status = opStopped
+		}
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Started.After(ops[j].Started) })
+	return ops, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   OPS COMMAND
+// - - - - - - - - - - - - - - - -
+
+// ops lists, resumes and reports the bulk operations
+func ops(args []string) {
+	if len(args) == 0 {
+		opsUsage()
+	}
+	switch args[0] {
+	case "list":
+		opsList(args[1:])
+	case "resume":
+		opsResume(args[1:])
+	case "report":
+		opsReport(args[1:])
+	default:
+		opsUsage()
+	}
+}
+
+// opsList prints the saved operations, latest first
+func opsList(args []string) {
+	listCommand := flag.NewFlagSet("ops list", flag.ExitOnError)
+	status := listCommand.String("status", "", "only operations of this status")
+	listHelp := listCommand.Bool("help", false, "help for ops list command")
+	listCommand.BoolVar(listHelp, "h", false, "help") // Aliasing
+	parseFlags(listCommand, args)
+
+	if *listHelp {
+		opsUsage()
+	}
+	all, err := listOperations()
+	if err != nil {
+		log.Fatal("Error reading the operations ", err)
+	}
+	t := &table{columns: []column{
+		{key: "id", title: "ID"},
+		{key: "command", title: "COMMAND"},
+		{key: "status", title: "STATUS"},
+		{key: "started", title: "STARTED"},
+		{key: "deleted", title: "DELETED"},
+		{key: "failed", title: "FAILED"},
+		{key: "queues", title: "QUEUES"},
+		{key: "runs", title: "RUNS", wide: true},
+		{key: "updated", title: "UPDATED", wide: true},
+	}}
+	for _, op := range all {
+		if len(*status) > 0 && op.Status != *status {
+			continue
+		}
+		t.add(op.ID, op.Command, op.Status, formatTime(op.Started, timeRFC3339), op.Progress.Deleted, op.Progress.Failed,
+			strings.Join(op.Queues, ","), op.Runs, formatTime(op.Updated, timeRFC3339))
+	}
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t.render(os.Stdout, format)
+}
+
+// opsResume runs an operation again with its command line, continuing its state
+// moves and exports replay the spool of the operation first, and find only the messages left
+func opsResume(args []string) {
+	if len(args) != 1 || args[0] == "-h" || args[0] == "-help" {
+		opsUsage()
+	}
+	op, err := loadOperation(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch op.Status {
+	case opCompleted:
+		fmt.Printf("Operation %s is already completed.\n", op.ID)
+		return
+	case opRunning:
+		log.Fatalf("Operation %s is still running, last saved %s\n", op.ID, op.Updated.Format(time.RFC3339))
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal("Error locating the sqscli binary ", err)
+	}
+	cmd := exec.Command(exe, append([]string{"-operation-id", op.ID}, withoutFlag(op.Args, "operation-id")...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Fatal("Error resuming the operation ", err)
+	}
+	// A Ctrl-C reaches the run too, which stops on its own, a termination is passed on
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGTERM {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+	err = cmd.Wait()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		os.Exit(exit.ExitCode())
+	}
+	if err != nil {
+		log.Fatal("Error resuming the operation ", err)
+	}
+}
+
+// opsReport prints the state of an operation
+func opsReport(args []string) {
+	if len(args) != 1 || args[0] == "-h" || args[0] == "-help" {
+		opsUsage()
+	}
+	op, err := loadOperation(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch outputFormat {
+	case formatJSON:
+		b, _ := json.MarshalIndent(op, "", "  ")
+		fmt.Println(string(b))
+		return
+	case formatYAML:
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		enc.Encode(op)
+		enc.Close()
+		return
+	}
+
+	fmt.Printf("Operation %s\n", op.ID)
+	fmt.Printf("  %-20s %s\n", "Command", op.Command)
+	fmt.Printf("  %-20s sqscli %s\n", "Command line", strings.Join(op.Args, " "))
+	fmt.Printf("  %-20s %s\n", "Queues", strings.Join(op.Queues, ", "))
+	fmt.Printf("  %-20s %s\n", "Status", op.Status)
+	fmt.Printf("  %-20s %d\n", "Runs", op.Runs)
+	fmt.Printf("  %-20s %s\n", "Started", formatTime(op.Started, timeRFC3339))
+	if op.Finished != nil {
+		fmt.Printf("  %-20s %s\n", "Finished", formatTime(*op.Finished, timeRFC3339))
+	} else {
+		fmt.Printf("  %-20s %s\n", "Last saved", formatTime(op.Updated, timeRFC3339))
+	}
+	for _, line := range []struct {
+		name  string
+		value int64
+	}{
+		{"Received", op.Progress.Received},
+		{"Written", op.Progress.Written},
+		{"Sent", op.Progress.Sent},
+		{"Deleted", op.Progress.Deleted},
+		{"Failed", op.Progress.Failed},
+		{"Duplicates skipped", op.Progress.Duplicates},
+		{"Not deleted", int64(len(op.Undeleted))},
+	} {
+		fmt.Printf("  %-20s %d\n", line.name, line.value)
+	}
+	if len(op.Failures) > 0 {
+		fmt.Println("Failures:")
+		for _, f := range op.Failures {
+			fmt.Println("  " + f)
+		}
+	}
+	if len(op.Undeleted) > 0 {
+		fmt.Println("Not deleted:")
+		for _, id := range op.Undeleted {
+			fmt.Println("  " + id)
+		}
+	}
+}
+
+func opsUsage() {
+	fmt.Println("usage: sqscli ops <list|resume|report> [options]")
+	fmt.Println("list options:")
+	fmt.Println("  -status           Only operations of this status: running, completed, failed,")
+	fmt.Println("                    interrupted or stopped")
+	fmt.Println("resume <id>         Run an interrupted or failed operation again, where it stopped")
+	fmt.Println("report <id>         Print the state of an operation, -o json or yaml for the document")
+	fmt.Println("IDs can be shortened to a unique prefix.")
+	os.Exit(0)
+}
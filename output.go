@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats of the -o flag
+const (
+	formatTable = "table"
+	formatWide  = "wide"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+)
+
+// outputFormat is set by -o, empty keeps the historical output of each command
+var outputFormat string
+
+// column describes a column of a table
+type column struct {
+	key   string // JSON and YAML key
+	title string // Table header
+	wide  bool   // Only shown in tables with -o wide
+	// human formats the values in tables, like humanSize, JSON and YAML keep them exact
+	human func(interface{}) string
+}
+
+// table is the tabular result of a command, rendered in any output format
+type table struct {
+	columns []column
+	rows    [][]interface{}
+}
+
+// orderedRow is a table row keeping the column order in JSON and YAML
+type orderedRow struct {
+	keys   []string
+	values []interface{}
+}
+
+// - - - - - - - - - - - - - - - -
+//   RENDERING
+// - - - - - - - - - - - - - - - -
+
+// isOutputFormat is true for the values accepted by -o
+func isOutputFormat(format string) bool {
+	switch format {
+	case formatTable, formatWide, formatJSON, formatYAML:
+		return true
+	}
+	return false
+}
+
+// add appends a row, one value per column
+func (t *table) add(values ...interface{}) {
+	t.rows = append(t.rows, values)
+}
+
+// render writes the table in a format
+// JSON and YAML always hold every column
+func (t *table) render(w io.Writer, format string) error {
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t.records())
+	case formatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(t.records()); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	var visible []int
+	for i, c := range t.columns {
+		if !c.wide || format == formatWide {
+			visible = append(visible, i)
+		}
+	}
+	// Cells are aligned on their text, colors don't take room
+	cells := make([][]string, 0, len(t.rows)+1)
+	header := make([]string, len(visible))
+	for n, i := range visible {
+		header[n] = t.columns[i].title
+	}
+	cells = append(cells, header)
+	for _, row := range t.rows {
+		line := make([]string, len(visible))
+		for n, i := range visible {
+			if human := t.columns[i].human; human != nil {
+				line[n] = human(row[i])
+			} else {
+				line[n] = fmt.Sprint(row[i])
+			}
+		}
+		cells = append(cells, line)
+	}
+	widths := make([]int, len(visible))
+	for _, line := range cells {
+		for n, cell := range line {
+			if l := utf8.RuneCountInString(cell); l > widths[n] {
+				widths[n] = l
+			}
+		}
+	}
+	color := w == io.Writer(os.Stdout) && colorOutput()
+	for l, line := range cells {
+		var b strings.Builder
+		for n, cell := range line {
+			if l == 0 && color {
+				b.WriteString(colorBold + cell + colorReset)
+			} else {
+				b.WriteString(cell)
+			}
+			if n < len(line)-1 {
+				b.WriteString(strings.Repeat(" ", widths[n]-utf8.RuneCountInString(cell)+2))
+			}
+		}
+		b.WriteByte('\n')
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// records returns the rows as ordered objects
+func (t *table) records() []orderedRow {
+	keys := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		keys[i] = c.key
+	}
+	records := make([]orderedRow, 0, len(t.rows))
+	for _, row := range t.rows {
+		records = append(records, orderedRow{keys: keys, values: row})
+	}
+	return records
+}
+
+// MarshalJSON implements json.Marshaler
+func (r orderedRow) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(r.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (r orderedRow) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for i, key := range r.keys {
+		var value yaml.Node
+		if err := value.Encode(r.values[i]); err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &value)
+	}
+	return node, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Actions of -oversize-policy
+const (
+	oversizeReject   = "reject"
+	oversizeTruncate = "truncate"
+	oversizeS3       = "s3"
+)
+
+const (
+	// truncatedAttribute holds the original size of a truncated body
+	truncatedAttribute = "sqscli.truncated"
+	// extendedSizeAttribute holds the size of an offloaded body, as the SQS extended client does
+	extendedSizeAttribute = "ExtendedPayloadSize"
+	// s3PointerClass tags the body pointing at an offloaded payload
+	s3PointerClass = "software.amazon.payloadoffloading.PayloadS3Pointer"
+)
+
+// oversizePolicy handles the messages over the SQS size limit
+type oversizePolicy struct {
+	action string
+	bucket string
+	prefix string
+	client *s3.S3
+	report *json.Encoder // Rejected messages, JSON lines
+	count  int           // Messages handled
+}
+
+// rejectedMessage is a line of the -oversize-report file
+type rejectedMessage struct {
+	Index int    `json:"index"`
+	Size  int    `json:"size"`
+	Body  string `json:"body"`
+}
+
+// - - - - - - - - - - - - - - - -
+//   OVERSIZED MESSAGES
+// - - - - - - - - - - - - - - - -
+
+// newOversizePolicy parses -oversize-policy: reject, truncate or s3:BUCKET[/PREFIX]
+// rejected messages are appended to reportFile if set
+func (s *service) newOversizePolicy(raw, reportFile string) (*oversizePolicy, error) {
+	p := &oversizePolicy{}
+	parts := strings.SplitN(raw, ":", 2)
+	p.action = parts[0]
+	switch {
+	case raw == oversizeReject, raw == oversizeTruncate:
+	case p.action == oversizeS3 && len(parts) == 2 && len(parts[1]) > 0:
+		location := strings.SplitN(strings.TrimPrefix(parts[1], "//"), "/", 2)
+		p.bucket = location[0]
+		if len(location) == 2 && len(location[1]) > 0 {
+			p.prefix = strings.TrimSuffix(location[1], "/") + "/"
+		}
+		p.client = s3Client(s.sess)
+	default:
+		return nil, fmt.Errorf("%q: expected reject, truncate or s3:BUCKET[/PREFIX]", raw)
+	}
+	if len(reportFile) > 0 {
+		f, err := os.OpenFile(reportFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		p.report = json.NewEncoder(f)
+	}
+	return p, nil
+}
+
+// apply handles an entry over the size limit, false if it must not be sent
+func (p *oversizePolicy) apply(entry *sqs.SendMessageBatchRequestEntry, index int) bool {
+	size := entrySize(entry)
+	body := aws.StringValue(entry.MessageBody)
+	p.count++
+	switch p.action {
+	case oversizeReject:
+		log.Printf("Message %d rejected, %d bytes is over the SQS limit\n", index, size)
+		if p.report != nil {
+			if err := p.report.Encode(rejectedMessage{Index: index, Size: size, Body: body}); err != nil {
+				log.Fatal("Error writing oversize report ", err)
+			}
+		}
+		return false
+	case oversizeTruncate:
+		setAttribute(entry, truncatedAttribute, "Number", strconv.Itoa(len(body)))
+		// What the attributes take is not left for the body
+		room := maxMessageSize - (entrySize(entry) - len(body))
+		if room < 1 {
+			log.Fatalf("Message %d attributes leave no room for a body\n", index)
+		}
+		cut := body[:room]
+		for !utf8.ValidString(cut) {
+			cut = cut[:len(cut)-1]
+		}
+		entry.MessageBody = aws.String(cut)
+	case oversizeS3:
+		uuid, _ := newUUID()
+		key := p.prefix + uuid
+		_, err := p.client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(p.bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte(body)),
+		})
+		if err != nil {
+			log.Fatalf("Error offloading message %d to S3: %s\n", index, err)
+		}
+		pointer, _ := json.Marshal([]interface{}{s3PointerClass, map[string]string{
+			"s3BucketName": p.bucket,
+			"s3Key":        key,
+		}})
+		entry.MessageBody = aws.String(string(pointer))
+		setAttribute(entry, extendedSizeAttribute, "Number", strconv.Itoa(len(body)))
+	}
+	return true
+}
+
+// summary logs how many messages were handled
+func (p *oversizePolicy) summary() {
+	if p.count == 0 {
+		return
+	}
+	verb := map[string]string{oversizeReject: "rejected", oversizeTruncate: "truncated", oversizeS3: "offloaded to S3"}
+	log.Printf("%d oversized messages %s\n", p.count, verb[p.action])
+}
+
+// setAttribute sets a message attribute of an entry, leaving shared attribute maps untouched
+func setAttribute(entry *sqs.SendMessageBatchRequestEntry, name, dataType, value string) {
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(entry.MessageAttributes)+1)
+	for n, v := range entry.MessageAttributes {
+		attrs[n] = v
+	}
+	attrs[name] = &sqs.MessageAttributeValue{DataType: aws.String(dataType), StringValue: aws.String(value)}
+	entry.MessageAttributes = attrs
+}
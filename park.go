@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// parkingSuffix names the parking-lot queue of a queue
+	parkingSuffix = "-parking-lot"
+	// parkingRetention keeps parked messages as long as SQS allows (14 days)
+	parkingRetention = 1209600
+)
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// parkCommand moves the selected messages of a queue to its parking-lot queue (park)
+// or back from it (unpark)
+// the parking-lot queue is created on first park
+func parkCommand(action string, args []string) {
+	cmd := flag.NewFlagSet(action, flag.ExitOnError)
+	queueName := cmd.String("queue", "", "queue name")
+	cmd.StringVar(queueName, "q", "", "queue name") // Aliasing
+	reportFile := cmd.String("report", "", "file receiving the JSON summary")
+	var onComplete hookFlag
+	cmd.Var(&onComplete, "on-complete", "exec:COMMAND or webhook:URL run once the move is done, repeatable")
+	filters := newFilterFlags(cmd)
+	rewriter := newRewriteFlags(cmd)
+	stamp := cmd.Bool("provenance", false, "stamp moved messages with sqscli.sourceQueue, sqscli.movedAt and sqscli.operationId")
+	parkHelp := cmd.Bool("help", false, "help for "+action+" command")
+	cmd.BoolVar(parkHelp, "h", false, "help") // Aliasing
+	parseFlags(cmd, args)
+
+	if *parkHelp {
+		parkUsage(action)
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		parkUsage(action)
+	}
+	keep := filters.filter()
+	rewrite := rewriter.rewrite()
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+
+	q := svc.resolveQueue(*queueName)
+	lot := parkingLotName(q.name)
+	source := q.name
+	if action == "unpark" {
+		source = lot
+	}
+	enforceGuardrails(action, []string{source}, svc.depthCounter(), false)
+
+	completionHooks = onComplete
+	startReport(action, *reportFile, q.name, lot)
+	if action == "park" {
+		svc.moveQueue(q, svc.queueAt(svc.ensureParkingLot(lot, q.fifo)), moveOptions{spool: operationSpool(""), filter: keep, provenance: *stamp, rewrite: rewrite})
+	} else {
+		lotURL, err := svc.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(lot)})
+		if err != nil {
+			log.Fatalf("No parking-lot queue %s: %s\n", lot, err)
+		}
+		svc.moveQueue(svc.queueAt(*lotURL.QueueUrl), q, moveOptions{spool: operationSpool(""), filter: keep, provenance: *stamp, rewrite: rewrite})
+	}
+	rewrite.close()
+	finishReport()
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// parkingLotName returns the name of the parking-lot queue of a queue
+func parkingLotName(queue string) string {
+	if strings.HasSuffix(queue, ".fifo") {
+		return strings.TrimSuffix(queue, ".fifo") + parkingSuffix + ".fifo"
+	}
+	return queue + parkingSuffix
+}
+
+// ensureParkingLot returns the URL of a parking-lot queue, created with the longest retention if absent
+func (s *service) ensureParkingLot(name string, fifo bool) string {
+	if result, err := s.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(name)}); err == nil {
+		return *result.QueueUrl
+	}
+	attrs := map[string]string{
+		sqs.QueueAttributeNameMessageRetentionPeriod: strconv.Itoa(parkingRetention),
+	}
+	if fifo {
+		attrs[sqs.QueueAttributeNameFifoQueue] = "true"
+	}
+	result, err := s.CreateQueue(&sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: aws.StringMap(attrs),
+	})
+	if err != nil {
+		log.Fatalf("Error creating parking-lot queue %s: %s\n", name, err)
+	}
+	log.Println("Created parking-lot queue", *result.QueueUrl)
+	return *result.QueueUrl
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func parkUsage(action string) {
+	fmt.Printf("usage: sqscli %s [options]\n", action)
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name, its parking-lot queue is <queue>-parking-lot")
+	fmt.Println("  -report           File receiving the JSON summary of the run")
+	fmt.Println("  -on-complete      exec:COMMAND or webhook:URL run once the move is done, repeatable")
+	fmt.Println("  -since            Only messages sent after, RFC3339 or relative like 2h")
+	fmt.Println("  -until            Only messages sent before, RFC3339 or relative like 30m")
+	fmt.Println("  -filter-attr      Attribute predicate like RetryCount>3 or Source=billing, repeatable")
+	fmt.Println("  -filter           Expression the messages must match, like body.status == \"failed\"")
+	fmt.Println("  -sample           A share of the messages like 1%, or the first N")
+	fmt.Println("  -provenance       Stamp moved messages with sqscli.sourceQueue, sqscli.movedAt and sqscli.operationId")
+	fmt.Println("  -set-attr         Attribute Name=Type:value set on moved messages, repeatable")
+	fmt.Println("  -drop-attr        Attribute removed from moved messages, repeatable")
+	fmt.Println("  -replace          s/REGEX/REPLACEMENT/[g] applied to moved bodies, repeatable")
+	fmt.Println("  -transform        Moved bodies go through expr:EXPRESSION or the sqscli-transform-NAME plugin")
+	fmt.Println("  -trace            Trace header injected in moved messages: xray or w3c")
+	os.Exit(0)
+}
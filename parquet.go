@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+)
+
+// parquetMagic starts and ends every Parquet file
+var parquetMagic = []byte("PAR1")
+
+// Parquet enums, from parquet.thrift
+const (
+	parquetByteArray = 6 // Physical type of string columns
+
+	parquetOptional = 1 // Repetition types
+	parquetRepeated = 2
+
+	parquetUncompressed = 0 // Codecs
+	parquetSnappy       = 1
+	parquetGzip         = 2
+
+	parquetDataPage       = 0 // Page types
+	parquetDictionaryPage = 2
+	parquetDataPageV2     = 3
+
+	parquetPlain           = 0 // Encodings
+	parquetPlainDictionary = 2
+	parquetRLEDictionary   = 8
+)
+
+// Types of the Thrift compact protocol
+const (
+	thriftTypeTrue   = 1
+	thriftTypeFalse  = 2
+	thriftTypeByte   = 3
+	thriftTypeI16    = 4
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeDouble = 7
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeSet    = 10
+	thriftTypeMap    = 11
+	thriftTypeStruct = 12
+)
+
+// thriftStruct is a decoded Thrift struct, its values by field ID:
+// bool, int64, float64, []byte, []interface{} or thriftStruct, maps are skipped
+type thriftStruct map[int16]interface{}
+
+// thriftReader decodes the Thrift compact protocol of the Parquet metadata
+type thriftReader struct {
+	r io.ByteReader
+}
+
+// parquetReader reads the values of a string column of a Parquet file, row group after row group
+// only flat columns are read, in PLAIN or dictionary encoding, uncompressed, Snappy or gzip
+type parquetReader struct {
+	f        *os.File
+	column   string
+	optional bool  // Values have definition levels, nulls are skipped
+	codec    int64 // Compression codec of the current chunk
+	groups   []thriftStruct
+	group    int    // Next row group
+	chunk    []byte // Pages of the column in the current row group
+	left     int64  // Values of the chunk not decoded yet
+	dict     []string
+	values   []string // Decoded, not read yet
+}
+
+// - - - - - - - - - - - - - - - -
+//   PARQUET INPUT
+// - - - - - - - - - - - - - - - -
+
+// openParquet opens a Parquet file on one of its string columns
+func openParquet(path, column string) (*parquetReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &parquetReader{f: f, column: column}
+	if err := p.readFooter(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return p, nil
+}
+
+// readFooter decodes the file metadata and finds the column
+func (p *parquetReader) readFooter() error {
+	stat, err := p.f.Stat()
+	if err != nil {
+		return err
+	}
+	tail := make([]byte, 8)
+	if stat.Size() < 12 {
+		return fmt.Errorf("not a Parquet file")
+	}
+	if _, err := p.f.ReadAt(tail, stat.Size()-8); err != nil {
+		return err
+	}
+	if !bytes.Equal(tail[4:], parquetMagic) {
+		return fmt.Errorf("not a Parquet file")
+	}
+	size := int64(binary.LittleEndian.Uint32(tail))
+	if size > stat.Size()-12 {
+		return fmt.Errorf("invalid Parquet footer")
+	}
+	footer := make([]byte, size)
+	if _, err := p.f.ReadAt(footer, stat.Size()-8-size); err != nil {
+		return err
+	}
+	meta, err := (&thriftReader{bytes.NewReader(footer)}).readStruct()
+	if err != nil {
+		return fmt.Errorf("invalid Parquet metadata: %s", err)
+	}
+
+	// The root element is followed by the columns, flat ones have no children
+	found := false
+	var names []string
+	for i, e := range thriftList(meta[2]) {
+		el, _ := e.(thriftStruct)
+		if i == 0 || el == nil {
+			continue
+		}
+		name := string(thriftBytes(el[4]))
+		names = append(names, name)
+		if name != p.column {
+			continue
+		}
+		if thriftInt(el[5]) > 0 || thriftInt(el[3]) == parquetRepeated {
+			return fmt.Errorf("column %s is not a flat column", name)
+		}
+		if el[1] == nil || thriftInt(el[1]) != parquetByteArray {
+			return fmt.Errorf("column %s is not a string column", name)
+		}
+		p.optional = thriftInt(el[3]) == parquetOptional
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("no column %s, the columns are %s", p.column, strings.Join(names, ", "))
+	}
+	for _, g := range thriftList(meta[4]) {
+		if group, ok := g.(thriftStruct); ok {
+			p.groups = append(p.groups, group)
+		}
+	}
+	return nil
+}
+
+// Read returns the next value of the column, io.EOF after the last one
+// empty values are skipped like nulls, SQS refuses empty bodies
+func (p *parquetReader) Read() (string, error) {
+	for {
+		for len(p.values) == 0 {
+			if p.left == 0 {
+				if p.group == len(p.groups) {
+					return "", io.EOF
+				}
+				if err := p.loadChunk(p.groups[p.group]); err != nil {
+					return "", err
+				}
+				p.group++
+				continue
+			}
+			if err := p.readPage(); err != nil {
+				return "", err
+			}
+		}
+		v := p.values[0]
+		p.values = p.values[1:]
+		if len(v) > 0 {
+			return v, nil
+		}
+	}
+}
+
+// Close closes the file
+func (p *parquetReader) Close() error {
+	return p.f.Close()
+}
+
+// loadChunk reads the pages of the column in a row group
+func (p *parquetReader) loadChunk(group thriftStruct) error {
+	for _, c := range thriftList(group[1]) {
+		chunk, _ := c.(thriftStruct)
+		meta, _ := chunk[3].(thriftStruct)
+		if meta == nil {
+			return fmt.Errorf("column chunk without metadata")
+		}
+		var path []string
+		for _, part := range thriftList(meta[3]) {
+			path = append(path, string(thriftBytes(part)))
+		}
+		if strings.Join(path, ".") != p.column {
+			continue
+		}
+		if len(thriftBytes(chunk[1])) > 0 {
+			return fmt.Errorf("column chunks in other files are not supported")
+		}
+		switch thriftInt(meta[4]) {
+		case parquetUncompressed, parquetSnappy, parquetGzip:
+		default:
+			return fmt.Errorf("unsupported compression codec %d, expected none, snappy or gzip", thriftInt(meta[4]))
+		}
+		start := thriftInt(meta[9])
+		if dict := thriftInt(meta[11]); dict > 0 && dict < start {
+			start = dict
+		}
+		p.chunk = make([]byte, thriftInt(meta[7]))
+		if _, err := p.f.ReadAt(p.chunk, start); err != nil {
+			return err
+		}
+		p.left = thriftInt(meta[5])
+		p.dict = nil
+		p.codec = thriftInt(meta[4])
+		return nil
+	}
+	return fmt.Errorf("row group without column %s", p.column)
+}
+
+// readPage decodes the next page of the chunk, the dictionary page or a data page
+func (p *parquetReader) readPage() error {
+	r := bytes.NewReader(p.chunk)
+	header, err := (&thriftReader{r}).readStruct()
+	if err != nil {
+		return fmt.Errorf("invalid page header: %s", err)
+	}
+	size := thriftInt(header[3])
+	if size < 0 || size > int64(r.Len()) {
+		return fmt.Errorf("invalid page size")
+	}
+	offset := int64(len(p.chunk) - r.Len())
+	body := p.chunk[offset : offset+size]
+	p.chunk = p.chunk[offset+size:]
+
+	switch thriftInt(header[1]) {
+	case parquetDictionaryPage:
+		dh, _ := header[7].(thriftStruct)
+		data, err := p.decompressPage(body, thriftInt(header[2]))
+		if err != nil {
+			return err
+		}
+		p.dict, err = plainStrings(data, int(thriftInt(dh[1])))
+		return err
+	case parquetDataPage:
+		dh, _ := header[5].(thriftStruct)
+		data, err := p.decompressPage(body, thriftInt(header[2]))
+		if err != nil {
+			return err
+		}
+		n := int(thriftInt(dh[1]))
+		var defined []bool
+		if p.optional {
+			if len(data) < 4 {
+				return fmt.Errorf("truncated definition levels")
+			}
+			length := int(binary.LittleEndian.Uint32(data))
+			if length > len(data)-4 {
+				return fmt.Errorf("truncated definition levels")
+			}
+			if defined, err = definitionLevels(data[4:4+length], n); err != nil {
+				return err
+			}
+			data = data[4+length:]
+		}
+		return p.decodeValues(data, thriftInt(dh[2]), n, defined)
+	case parquetDataPageV2:
+		dh, _ := header[8].(thriftStruct)
+		n := int(thriftInt(dh[1]))
+		repLength, defLength := thriftInt(dh[6]), thriftInt(dh[5])
+		if repLength+defLength > int64(len(body)) {
+			return fmt.Errorf("truncated levels")
+		}
+		var defined []bool
+		if p.optional {
+			if defined, err = definitionLevels(body[repLength:repLength+defLength], n); err != nil {
+				return err
+			}
+		}
+		// Levels are never compressed, values are unless is_compressed is false
+		data := body[repLength+defLength:]
+		if compressed, ok := dh[7].(bool); !ok || compressed {
+			if data, err = p.decompressPage(data, thriftInt(header[2])-repLength-defLength); err != nil {
+				return err
+			}
+		}
+		return p.decodeValues(data, thriftInt(dh[4]), n, defined)
+	}
+	return nil // Index pages
+}
+
+// decodeValues decodes the n values of a data page, nulls are skipped
+func (p *parquetReader) decodeValues(data []byte, encoding int64, n int, defined []bool) error {
+	p.left -= int64(n)
+	present := n
+	for _, d := range defined {
+		if !d {
+			present--
+		}
+	}
+	var values []string
+	var err error
+	switch encoding {
+	case parquetPlain:
+		values, err = plainStrings(data, present)
+	case parquetPlainDictionary, parquetRLEDictionary:
+		if len(data) == 0 {
+			return fmt.Errorf("empty dictionary page")
+		}
+		var indexes []int64
+		if indexes, err = rleHybrid(data[1:], int(data[0]), present); err != nil {
+			return err
+		}
+		for _, i := range indexes {
+			if i < 0 || i >= int64(len(p.dict)) {
+				return fmt.Errorf("dictionary index %d out of range", i)
+			}
+			values = append(values, p.dict[i])
+		}
+	default:
+		return fmt.Errorf("unsupported encoding %d, expected PLAIN or a dictionary", encoding)
+	}
+	p.values = append(p.values, values...)
+	return err
+}
+
+// definitionLevels decodes the levels of a flat optional column, true for the values not null
+func definitionLevels(data []byte, n int) ([]bool, error) {
+	levels, err := rleHybrid(data, 1, n)
+	if err != nil {
+		return nil, err
+	}
+	defined := make([]bool, n)
+	for i, l := range levels {
+		defined[i] = l == 1
+	}
+	return defined, nil
+}
+
+// decompressPage decompresses a page with the codec of the chunk
+func (p *parquetReader) decompressPage(data []byte, size int64) ([]byte, error) {
+	switch p.codec {
+	case parquetSnappy:
+		return snappyDecode(data)
+	case parquetGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(io.LimitReader(r, size))
+	}
+	return data, nil
+}
+
+// plainStrings decodes n PLAIN byte arrays, each prefixed by its length
+func plainStrings(data []byte, n int) ([]string, error) {
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated values")
+		}
+		length := binary.LittleEndian.Uint32(data)
+		if int64(length) > int64(len(data)-4) {
+			return nil, fmt.Errorf("truncated values")
+		}
+		values = append(values, string(data[4:4+length]))
+		data = data[4+length:]
+	}
+	return values, nil
+}
+
+// rleHybrid decodes n values of the RLE / bit-packing hybrid encoding
+func rleHybrid(data []byte, bitWidth, n int) ([]int64, error) {
+	if bitWidth > 32 {
+		return nil, fmt.Errorf("invalid bit width %d", bitWidth)
+	}
+	r := bytes.NewReader(data)
+	values := make([]int64, 0, n)
+	for len(values) < n {
+		header, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("truncated levels or indexes")
+		}
+		if header&1 == 0 {
+			// A run of the same value, in its bytes
+			value := make([]byte, 8)
+			if _, err := io.ReadFull(r, value[:(bitWidth+7)/8]); err != nil {
+				return nil, fmt.Errorf("truncated levels or indexes")
+			}
+			v := int64(binary.LittleEndian.Uint64(value))
+			for i := uint64(0); i < header>>1 && len(values) < n; i++ {
+				values = append(values, v)
+			}
+			continue
+		}
+		// Groups of 8 values packed least significant bit first
+		packed := make([]byte, int(header>>1)*bitWidth)
+		if _, err := io.ReadFull(r, packed); err != nil {
+			return nil, fmt.Errorf("truncated levels or indexes")
+		}
+		for i := 0; i < int(header>>1)*8 && len(values) < n; i++ {
+			var v int64
+			for b := 0; b < bitWidth; b++ {
+				bit := i*bitWidth + b
+				if packed[bit/8]&(1<<uint(bit%8)) != 0 {
+					v |= 1 << uint(b)
+				}
+			}
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// snappyDecode decodes a raw Snappy block, the Parquet framing
+func snappyDecode(src []byte) ([]byte, error) {
+	r := bytes.NewReader(src)
+	size, err := binary.ReadUvarint(r)
+	if err != nil || size > math.MaxInt32 {
+		return nil, fmt.Errorf("invalid snappy block")
+	}
+	src = src[len(src)-r.Len():]
+	dst := make([]byte, 0, size)
+	invalid := errors.New("invalid snappy block")
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0: // Literal
+			length = int(tag>>2) + 1
+			src = src[1:]
+			if extra := int(tag>>2) - 59; extra > 0 {
+				if len(src) < extra {
+					return nil, invalid
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				length++
+				src = src[extra:]
+			}
+			if length > len(src) {
+				return nil, invalid
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1: // Copy, 1 byte offset
+			if len(src) < 2 {
+				return nil, invalid
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2: // Copy, 2 bytes offset
+			if len(src) < 3 {
+				return nil, invalid
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3: // Copy, 4 bytes offset
+			if len(src) < 5 {
+				return nil, invalid
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, invalid
+		}
+		// Copies may overlap what they write
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, invalid
+	}
+	return dst, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   THRIFT COMPACT PROTOCOL
+// - - - - - - - - - - - - - - - -
+
+// readStruct decodes a struct up to its stop field
+func (t *thriftReader) readStruct() (thriftStruct, error) {
+	s := make(thriftStruct)
+	var id int16
+	for {
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			return s, nil
+		}
+		if delta := int16(b >> 4); delta > 0 {
+			id += delta
+		} else {
+			v, err := t.readVarint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		typ := b & 0x0f
+		switch typ {
+		case thriftTypeTrue:
+			s[id] = true
+			continue
+		case thriftTypeFalse:
+			s[id] = false
+			continue
+		}
+		v, err := t.readValue(typ)
+		if err != nil {
+			return nil, err
+		}
+		s[id] = v
+	}
+}
+
+// readValue decodes a value of a type, booleans of lists included
+func (t *thriftReader) readValue(typ byte) (interface{}, error) {
+	switch typ {
+	case thriftTypeTrue, thriftTypeFalse:
+		b, err := t.r.ReadByte()
+		return b == thriftTypeTrue, err
+	case thriftTypeByte:
+		b, err := t.r.ReadByte()
+		return int64(int8(b)), err
+	case thriftTypeI16, thriftTypeI32, thriftTypeI64:
+		return t.readVarint()
+	case thriftTypeDouble:
+		var b [8]byte
+		for i := range b {
+			c, err := t.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			b[i] = c
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+	case thriftTypeBinary:
+		n, err := binary.ReadUvarint(t.r)
+		if err != nil {
+			return nil, err
+		}
+		if n > 1<<30 {
+			return nil, fmt.Errorf("binary of %d bytes", n)
+		}
+		b := make([]byte, n)
+		for i := range b {
+			if b[i], err = t.r.ReadByte(); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case thriftTypeList, thriftTypeSet:
+		h, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(h >> 4)
+		if n == 15 {
+			if n, err = binary.ReadUvarint(t.r); err != nil {
+				return nil, err
+			}
+		}
+		var list []interface{}
+		for i := uint64(0); i < n; i++ {
+			v, err := t.readValue(h & 0x0f)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case thriftTypeMap:
+		n, err := binary.ReadUvarint(t.r)
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		kv, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := t.readValue(kv >> 4); err != nil {
+				return nil, err
+			}
+			if _, err := t.readValue(kv & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case thriftTypeStruct:
+		return t.readStruct()
+	}
+	return nil, fmt.Errorf("unknown Thrift type %d", typ)
+}
+
+// readVarint decodes a zigzag varint
+func (t *thriftReader) readVarint() (int64, error) {
+	u, err := binary.ReadUvarint(t.r)
+	return int64(u>>1) ^ -int64(u&1), err
+}
+
+// thriftInt returns an integer field, 0 if missing
+func thriftInt(v interface{}) int64 {
+	n, _ := v.(int64)
+	return n
+}
+
+// thriftBytes returns a binary field, nil if missing
+func thriftBytes(v interface{}) []byte {
+	b, _ := v.([]byte)
+	return b
+}
+
+// thriftList returns a list field, nil if missing
+func thriftList(v interface{}) []interface{} {
+	l, _ := v.([]interface{})
+	return l
+}
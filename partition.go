@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// awsPartition forces the partition of the region, set by -partition
+// regions are matched to their partition otherwise: aws, aws-cn, aws-us-gov...
+var awsPartition string
+
+// - - - - - - - - - - - - - - - -
+//   PARTITIONS
+// - - - - - - - - - - - - - - - -
+
+// resolvePartition returns the partition of a region, -partition when set
+// regions the SDK doesn't know are matched by name, like cn-northwest-9 in aws-cn
+func resolvePartition(region string) (endpoints.Partition, error) {
+	partitions := endpoints.DefaultPartitions()
+	if len(awsPartition) > 0 {
+		var ids []string
+		for _, p := range partitions {
+			if p.ID() == awsPartition {
+				return p, nil
+			}
+			ids = append(ids, p.ID())
+		}
+		sort.Strings(ids)
+		return endpoints.Partition{}, fmt.Errorf("unknown partition %s, expected one of %s", awsPartition, strings.Join(ids, ", "))
+	}
+	if p, ok := endpoints.PartitionForRegion(partitions, region); ok {
+		return p, nil
+	}
+	return endpoints.Partition{}, fmt.Errorf("region %s is in no known partition, set -partition", region)
+}
+
+// partitionConfig points the endpoints of every service at the partition of the region
+// STS is called in the region too, the global endpoint only serves the aws partition
+func partitionConfig(region string) (*aws.Config, error) {
+	p, err := resolvePartition(region)
+	if err != nil {
+		return nil, err
+	}
+	resolver := endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		return p.EndpointFor(service, region, opts...)
+	})
+	return &aws.Config{
+		Region:              aws.String(region),
+		EndpointResolver:    resolver,
+		STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+	}, nil
+}
+
+// partition returns the partition of the service region, for ARNs
+func (s *service) partition() string {
+	if p, err := resolvePartition(aws.StringValue(s.sess.Config.Region)); err == nil {
+		return p.ID()
+	}
+	return endpoints.AwsPartitionID
+}
+
+// parseQueueARN parses the ARN of a queue, arn:PARTITION:sqs:REGION:ACCOUNT:NAME
+func parseQueueARN(raw string) (arn.ARN, error) {
+	a, err := arn.Parse(raw)
+	if err != nil {
+		return a, fmt.Errorf("invalid queue ARN %s: %s", raw, err)
+	}
+	if a.Service != "sqs" || len(a.Region) == 0 || len(a.AccountID) == 0 || strings.Contains(a.Resource, ":") {
+		return a, fmt.Errorf("%s is not the ARN of a queue", raw)
+	}
+	return a, nil
+}
+
+// queueARN returns the ARN of a queue of an account in the service region
+func (s *service) queueARN(account, name string) string {
+	return arn.ARN{
+		Partition: s.partition(),
+		Service:   "sqs",
+		Region:    aws.StringValue(s.sess.Config.Region),
+		AccountID: account,
+		Resource:  name,
+	}.String()
+}
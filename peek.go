@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// peekedMessage is the JSON representation of a peeked message
+type peekedMessage struct {
+	MessageID         string                                `json:"messageId"`
+	Body              string                                `json:"body"`
+	Attributes        map[string]*string                    `json:"attributes,omitempty"`
+	MessageAttributes map[string]*sqs.MessageAttributeValue `json:"messageAttributes,omitempty"`
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// peek prints messages of a queue without deleting them
+// messages stay in flight for the visibility timeout
+func peek(args []string) {
+	peekCommand := flag.NewFlagSet("peek", flag.ExitOnError)
+	queueName := peekCommand.String("queue", "", "queue name")
+	peekCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	count := peekCommand.Int("count", 10, "maximum number of messages")
+	peekCommand.IntVar(count, "n", 10, "maximum number of messages") // Aliasing
+	visibility := peekCommand.Int64("visibility", 30, "seconds the peeked messages stay hidden")
+	sinkURI := peekCommand.String("sink", sinkStdout, "sink receiving the peeked messages, stdout by default")
+	transform := peekCommand.String("transform", "", "expr:EXPRESSION or transform plugin sqscli-transform-NAME the bodies go through")
+	sessionFile := peekCommand.String("session", "", "write receipt handles to this session file")
+	filters := newFilterFlags(peekCommand)
+	peekHelp := peekCommand.Bool("help", false, "help for peek command")
+	peekCommand.BoolVar(peekHelp, "h", false, "help") // Aliasing
+	parseFlags(peekCommand, args)
+
+	if *peekHelp {
+		peekUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		peekUsage()
+	}
+	if *visibility < 0 || *visibility > maxVisibilityTimeout {
+		log.Fatal("Visibility must be between 0 and 43200 seconds")
+	}
+	keep := filters.filter()
+	if _, _, err := parseSinkURI(*sinkURI); err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect
+	svc := newService()
+	startBodyDecoder(*transform)
+	defer stopBodyDecoder()
+	q := svc.resolveQueue(*queueName)
+	qURL, fifo := q.url, q.fifo
+
+	var session *sessionWriter
+	if len(*sessionFile) > 0 {
+		session = newSessionWriter(*sessionFile)
+		defer session.close()
+	}
+
+	// Messages the filter doesn't keep are hidden while searching, released at the end
+	var others []string
+	defer func() { svc.changeVisibilityBatch(qURL, others, 0) }()
+	// Short visibilities hand the same messages out again, stop once only those come back
+	seen := make(map[string]bool)
+
+	sink, err := svc.newMessageSink(*sinkURI)
+	if err != nil {
+		log.Fatal("Error opening the sink ", err)
+	}
+	defer func() {
+		if err := sink.Close(); err != nil {
+			log.Println("Error closing the sink", err)
+		}
+	}()
+	for peeked := 0; peeked < *count && !sample.full(); {
+		num := *count - peeked
+		if num > 10 {
+			num = 10
+		}
+		result := svc.receiveMessagesFor(qURL, num, fifo, *visibility)
+		if len(result.Messages) == 0 {
+			break // We are done
+		}
+		again := 0
+		for _, m := range result.Messages {
+			if seen[aws.StringValue(m.MessageId)] {
+				again++
+			}
+		}
+		if again == len(result.Messages) {
+			break // Cycled through the whole queue
+		}
+
+		for _, m := range result.Messages {
+			if seen[aws.StringValue(m.MessageId)] {
+				continue
+			}
+			seen[aws.StringValue(m.MessageId)] = true
+			if !keep.keeps(m) {
+				others = append(others, *m.ReceiptHandle)
+				continue
+			}
+			if err := sink.Write(m); err != nil {
+				log.Fatal("Error writing to the sink ", err)
+			}
+			if session != nil {
+				session.add(qURL, m)
+			}
+			peeked++
+		}
+		if err := flushSink(sink); err != nil {
+			log.Fatal("Error writing to the sink ", err)
+		}
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func peekUsage() {
+	fmt.Println("usage: sqscli peek [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -count            Maximum number of messages (default 10)")
+	fmt.Println("  -visibility       Seconds the peeked messages stay hidden (default 30)")
+	fmt.Println("  -sink             Sink receiving the messages: -, file:PATH, s3://BUCKET/PREFIX, sqlite:PATH,")
+	fmt.Println("                    dynamodb:TABLE, kafka:URL, webhook:URL or plugin:NAME (default -, stdout)")
+	fmt.Println("  -transform        Bodies go through expr:EXPRESSION or the sqscli-transform-NAME plugin")
+	fmt.Println("  -session          Write message IDs and receipt handles to this session file")
+	fmt.Println("  -since            Only messages sent after, RFC3339 or relative like 2h")
+	fmt.Println("  -until            Only messages sent before, RFC3339 or relative like 30m")
+	fmt.Println("  -filter-attr      Attribute predicate like RetryCount>3 or Source=billing, repeatable")
+	fmt.Println("  -filter           Expression the messages must match, like body.status == \"failed\"")
+	fmt.Println("  -sample           A share of the messages like 1%, or the first N")
+	os.Exit(0)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// pingTiming is what a single ping measured
+// wait is the time between the request written and the first byte of the response,
+// the share of SQS; the rest of the round trip is the network's
+type pingTiming struct {
+	total   time.Duration
+	wait    time.Duration
+	dns     time.Duration // Only set on the calls resolving the host
+	connect time.Duration // Only set on the calls opening a connection
+	tls     time.Duration
+	reused  bool
+	lookup  bool // The host was resolved, it is not an IP
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// ping calls the SQS endpoint repeatedly and prints the latency percentiles
+// network time and SQS time are told apart, to diagnose where slowness comes from
+func ping(args []string) {
+	pingCommand := flag.NewFlagSet("ping", flag.ExitOnError)
+	queueName := pingCommand.String("queue", "", "queue name, GetQueueUrl is called instead of ListQueues")
+	pingCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	count := pingCommand.Int("count", 10, "number of calls")
+	interval := pingCommand.Duration("interval", 200*time.Millisecond, "pause between calls")
+	pingHelp := pingCommand.Bool("help", false, "help for ping command")
+	pingCommand.BoolVar(pingHelp, "h", false, "help") // Aliasing
+	parseFlags(pingCommand, args)
+
+	if *pingHelp {
+		pingUsage()
+	}
+
+	// Verify
+	if *count < 1 {
+		fmt.Println("Count must be at least 1.")
+		pingUsage()
+	}
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+
+	action := "ListQueues"
+	if len(*queueName) > 0 {
+		action = "GetQueueUrl"
+	}
+	fmt.Fprintf(os.Stderr, "Pinging %s with %s, %d calls\n", svc.Endpoint, action, *count)
+
+	var timings []pingTiming
+	for i := 0; i < *count && !isInterrupted(); i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		t, err := svc.pingOnce(*queueName)
+		if err != nil {
+			log.Printf("Call %d failed after %s: %s\n", i+1, t.total.Round(time.Millisecond), err)
+			continue
+		}
+		timings = append(timings, t)
+	}
+	if len(timings) == 0 {
+		log.Fatal("Every call failed")
+	}
+
+	t := &table{columns: []column{
+		{key: "metric", title: "METRIC"},
+		{key: "min", title: "MIN"},
+		{key: "p50", title: "P50"},
+		{key: "p95", title: "P95"},
+		{key: "max", title: "MAX"},
+	}}
+	addPercentiles(t, "round trip", timings, func(p pingTiming) (time.Duration, bool) { return p.total, true })
+	addPercentiles(t, "sqs", timings, func(p pingTiming) (time.Duration, bool) { return p.wait, true })
+	addPercentiles(t, "network", timings, func(p pingTiming) (time.Duration, bool) { return p.total - p.wait, true })
+	addPercentiles(t, "dns", timings, func(p pingTiming) (time.Duration, bool) { return p.dns, p.lookup })
+	addPercentiles(t, "connect", timings, func(p pingTiming) (time.Duration, bool) { return p.connect, !p.reused })
+	addPercentiles(t, "tls", timings, func(p pingTiming) (time.Duration, bool) { return p.tls, !p.reused && p.tls > 0 })
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t.render(os.Stdout, format)
+	if failed := *count - len(timings); failed > 0 && !isInterrupted() {
+		fmt.Fprintf(os.Stderr, "%d of %d calls failed\n", failed, *count)
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// pingOnce times a single call, without retries
+func (s *service) pingOnce(queue string) (pingTiming, error) {
+	var req *request.Request
+	if len(queue) > 0 {
+		req, _ = s.GetQueueUrlRequest(&sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+	} else {
+		req, _ = s.ListQueuesRequest(&sqs.ListQueuesInput{MaxResults: aws.Int64(1)})
+	}
+	req.Retryer = client.DefaultRetryer{NumMaxRetries: 0}
+
+	var t pingTiming
+	var dnsStart, connectStart, tlsStart, wrote time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn:           func(info httptrace.GotConnInfo) { t.reused = info.Reused },
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart, t.lookup = time.Now(), true },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.dns = time.Since(dnsStart) },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { t.connect = time.Since(connectStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.tls = time.Since(tlsStart) },
+		WroteRequest:      func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() {
+			t.wait = time.Since(wrote)
+		},
+	}
+	req.SetContext(httptrace.WithClientTrace(context.Background(), trace))
+
+	start := time.Now()
+	err := req.Send()
+	t.total = time.Since(start)
+	return t, err
+}
+
+// addPercentiles adds a row of the min, p50, p95 and max of a metric of the timings
+// timings the metric doesn't apply to are left out, no row is added if none is left
+func addPercentiles(t *table, metric string, timings []pingTiming, value func(pingTiming) (time.Duration, bool)) {
+	var values []time.Duration
+	for _, p := range timings {
+		if v, ok := value(p); ok {
+			values = append(values, v)
+		}
+	}
+	addDurations(t, metric, values)
+}
+
+// addDurations adds a row of the min, p50, p95 and max of durations, none if there are none
+func addDurations(t *table, metric string, values []time.Duration) {
+	if len(values) == 0 {
+		return
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	at := func(q float64) string {
+		return values[int(q*float64(len(values)-1)+0.5)].Round(time.Microsecond * 100).String()
+	}
+	t.add(metric, at(0), at(0.5), at(0.95), at(1))
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func pingUsage() {
+	fmt.Println("usage: sqscli ping [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue      Queue name, GetQueueUrl is called instead of ListQueues")
+	fmt.Println("  -count      Number of calls (default 10)")
+	fmt.Println("  -interval   Pause between calls (default 200ms)")
+	os.Exit(0)
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// pipelineBuffer is the number of batches buffered between two stages
+	// it bounds the memory used by a run whatever the size of the queue
+	pipelineBuffer = 10
+	// pipelineVisibility hides received messages while they go through the stages
+	pipelineVisibility = 60
+	// maxCopyOnlyReceives stops a run after this many receives only returned
+	// copies re-added by the same run, the queue has been cycled through
+	maxCopyOnlyReceives = 3
+	// maxHeldSkipped bounds the receipt handles of the skipped messages kept hidden
+	// until the end of a run, the next ones are released right away
+	maxHeldSkipped = 100000
+	// exportMarkerAttribute marks the copies re-added by a mirror, and by the exports of older versions
+	exportMarkerAttribute = "SqscliExportRun"
+	// maxOrderWindow bounds the messages held for reordering, they stay in flight meanwhile,
+	// their visibility extended
+	maxOrderWindow = 10000
+)
+
+// Orders of the exported records, -order
+const (
+	orderArrival = "arrival"
+	orderSent    = "sent"
+)
+
+// pipelineOptions tweaks how the resend stage handles batches
+type pipelineOptions struct {
+	extra      map[string]*sqs.MessageAttributeValue // Added to every re-sent message
+	spool      *spool                                // Persists batches before they are deleted
+	acks       chan<- struct{}                       // Signaled once a batch is deleted
+	dedup      *deduper                              // Skips messages already sent
+	exceed     *exceedRoute                          // Diverts messages received too many times
+	bounces    *bounceTracker                        // Diverts messages redriven too many times
+	provenance *provenance                           // Stamps the re-sent messages, -provenance
+	rewrite    *messageRewrite                       // Rewrites the attributes and bodies of the re-sent messages
+	delay      int64                                 // DelaySeconds of the re-sent messages, standard queues only
+	copies     *runCopies                            // Records the message IDs of the re-sent messages
+}
+
+// runCopies recognises the copies a run re-added to the queue it reads, by the message IDs
+// SQS gave them, or by the marker attribute of runID
+// a file keeps the IDs for a resumed run, they take about 100 bytes each in memory
+type runCopies struct {
+	runID    string
+	expected int // Messages the queue held at the start, the run stops once it went through as many, 0 for no limit
+	mu       sync.Mutex
+	ids      map[string]bool
+	f        *os.File
+	sends    sync.RWMutex // Held by the sends of copies, and shared by the receives
+}
+
+// - - - - - - - - - - - - - - - -
+//   PIPELINE STAGES
+// - - - - - - - - - - - - - - - -
+
+// receiveStage streams batches of messages from a queue until it is exhausted
+// or the run is interrupted
+// copies re-added by the run are skipped, they were already processed,
+// and released at the end, like the messages the filter doesn't keep
+// receives returning only skipped messages seen before mean the queue was cycled through
+// FIFO queues don't return more messages of a group while some are in flight
+// so a batch must be acknowledged on acks before the next receive
+// standard queues are received by workers concurrent receivers, or adaptiveReceivers
+func (s *service) receiveStage(q *queue, copies *runCopies, keep messageFilter, acks <-chan struct{}, workers int) <-chan []*sqs.Message {
+	out := make(chan []*sqs.Message, pipelineBuffer)
+	go func() {
+		defer close(out)
+		var mu sync.Mutex                // Receivers share what they skipped
+		held := make(map[string]string)  // Receipt handles of the skipped messages by message ID
+		seenIDs := make(map[string]bool) // Every message skipped, held or released
+		defer func() {
+			skipped := make([]string, 0, len(held))
+			for _, handle := range held {
+				skipped = append(skipped, handle)
+			}
+			s.changeVisibilityBatch(q.url, skipped, 0)
+		}()
+
+		copyOnly, filtered := 0, 0
+		through := 0 // Messages received other than copies, once each
+		asked := 0   // Messages the receives in progress asked for
+		defer func() {
+			if filtered > 0 {
+				log.Printf("%d messages not matching the filter left in %s\n", filtered, q.name)
+			}
+		}()
+		// next receives a batch, and reports the queue exhausted
+		next := func() ([]*sqs.Message, int, bool) {
+			if sample.full() {
+				return nil, 0, true
+			}
+			max := 10 // Batch of 10
+			// Receiving the copies would count against their maxReceiveCount, so the receives
+			// ask for no more messages than are left to go through, concurrent ones sharing them
+			if copies != nil && copies.expected > 0 {
+				mu.Lock()
+				left := copies.expected - through - asked
+				if left < max {
+					max = left
+				}
+				if max > 0 {
+					asked += max
+				}
+				done := through >= copies.expected
+				mu.Unlock()
+				if max <= 0 {
+					if !done {
+						time.Sleep(10 * time.Millisecond) // The other receivers are taking the rest
+					}
+					return nil, 0, done
+				}
+				defer func() {
+					mu.Lock()
+					asked -= max
+					mu.Unlock()
+				}()
+			}
+			// No copy is sent until the copies of the batch are recognised, see runCopies.sending
+			copies.pauseSends()
+			result := s.receiveMessagesFor(q.url, max, q.fifo, pipelineVisibility)
+			isCopy := make([]bool, len(result.Messages))
+			for i, m := range result.Messages {
+				isCopy[i] = copies.has(m)
+			}
+			copies.resumeSends()
+
+			if len(result.Messages) == 0 {
+				return nil, 0, true // We are done
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			var batch, released []*sqs.Message
+			seen := 0 // Copies and filtered messages already received
+			copied := 0
+			// Skipped messages are kept hidden until the end so they are not received again,
+			// they come back once their visibility expires on long scans
+			hold := func(m *sqs.Message) {
+				id := aws.StringValue(m.MessageId)
+				seenIDs[id] = true
+				if _, ok := held[id]; ok || len(held) < maxHeldSkipped {
+					held[id] = *m.ReceiptHandle
+				} else {
+					released = append(released, m)
+				}
+			}
+			for i, m := range result.Messages {
+				if isCopy[i] {
+					hold(m)
+					copied++
+					seen++
+					continue
+				}
+				if !keep.keeps(m) {
+					if seenIDs[aws.StringValue(m.MessageId)] {
+						seen++
+					} else {
+						filtered++
+						through++
+					}
+					hold(m)
+					continue
+				}
+				batch = append(batch, m)
+				through++
+			}
+			if len(released) > 0 {
+				s.changeVisibilityBatch(q.url, receipts(released), 0)
+			}
+			atomic.AddInt64(&tally.received, int64(len(batch)))
+			atomic.AddInt64(&tally.duplicates, int64(copied))
+
+			if seen == len(result.Messages) {
+				copyOnly++
+				// Cycled through the whole queue
+				return nil, len(result.Messages), copyOnly >= maxCopyOnlyReceives
+			}
+			copyOnly = 0
+			return batch, len(result.Messages), false
+		}
+
+		if !q.fifo && (workers > 1 || workers == adaptiveReceivers) {
+			receiveConcurrently(workers, next, out)
+			return
+		}
+		for !isInterrupted() {
+			batch, _, exhausted := next()
+			if exhausted {
+				return
+			}
+			if len(batch) == 0 {
+				continue // Nothing matched the filter
+			}
+			out <- batch
+			if q.fifo {
+				<-acks
+			}
+		}
+	}()
+	return out
+}
+
+// resendStage sends each batch to the "to" queue then deletes it from the "from" queue
+// the "to" queue is reached through its own service, it may be in another region
+// only messages that were sent are deleted, the others are released right away
+// returns the number of messages sent
+func (s *service) resendStage(from, to *queue, opts pipelineOptions, in <-chan []*sqs.Message) (int, []error) {
+	fifo := from.fifo
+	var errors []error
+	total := 0
+	for batch := range in {
+		if opts.exceed != nil {
+			var errs []error
+			batch, errs = s.divert(from.url, opts.exceed, fifo, batch)
+			for _, err := range errs {
+				log.Println("Error parking messages", err)
+			}
+			errors = append(errors, errs...)
+		}
+		if opts.bounces != nil {
+			var errs []error
+			batch, errs = s.divertBounced(from.url, opts.bounces, fifo, batch)
+			for _, err := range errs {
+				log.Println("Error parking messages", err)
+			}
+			errors = append(errors, errs...)
+		}
+		if opts.dedup != nil {
+			batch = s.skipDuplicates(from.url, opts.dedup, batch)
+		}
+		if opts.bounces != nil {
+			opts.bounces.stamp(batch)
+		}
+		if len(batch) == 0 {
+			if opts.acks != nil {
+				opts.acks <- struct{}{}
+			}
+			continue
+		}
+		spoolID := 0
+		if opts.spool != nil {
+			spoolID = opts.spool.write(to.url, batch)
+		}
+		var sent []*sqs.Message
+		var errs []error
+		opts.copies.sending(func() []string {
+			var copyIDs []string
+			sent, copyIDs, errs = to.svc.resendBatchCopies(to.url, batch, fifo, opts.delay, opts.provenance.attributes(opts.extra), opts.rewrite)
+			return copyIDs
+		})
+		for _, err := range errs {
+			log.Println("Error re-adding messages", err)
+			noteFailure(err)
+		}
+		errors = append(errors, errs...)
+
+		if opts.dedup != nil {
+			opts.dedup.markMessages(sent)
+		}
+		if opts.bounces != nil {
+			opts.bounces.record(sent)
+		}
+		atomic.AddInt64(&tally.sent, int64(len(sent)))
+		atomic.AddInt64(&tally.failed, int64(len(batch)-len(sent)))
+		if len(sent) > 0 {
+			atomic.AddInt64(&tally.deleted, int64(s.deleteMessageBatch(from.url, sent)))
+			total += len(sent)
+		}
+		if len(sent) < len(batch) {
+			s.changeVisibilityBatch(from.url, unsentReceipts(batch, sent), 0)
+		}
+		if opts.spool != nil {
+			opts.spool.done(spoolID)
+		}
+		if opts.acks != nil {
+			opts.acks <- struct{}{}
+		}
+	}
+	return total, errors
+}
+
+// orderStage re-batches messages in the order they were sent
+// up to window messages are held, so the order is exact within the window and
+// only approximate beyond, the rest is released once the input is closed
+// held messages stay hidden, their visibility is extended while they wait
+func (s *service) orderStage(q *queue, window int, in <-chan []*sqs.Message) <-chan []*sqs.Message {
+	out := make(chan []*sqs.Message, pipelineBuffer)
+	go func() {
+		defer close(out)
+		held := &sentOrder{}
+		// emit sends the oldest held messages, in batches of 10, until keep are left
+		emit := func(keep int) {
+			for held.Len() > keep {
+				var batch []*sqs.Message
+				for len(batch) < 10 && held.Len() > keep {
+					batch = append(batch, heap.Pop(held).(*sqs.Message))
+				}
+				out <- batch
+			}
+		}
+		// Extended every half visibility, before any held message shows up again
+		ticker := time.NewTicker(pipelineVisibility * time.Second / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case batch, ok := <-in:
+				if !ok {
+					emit(0)
+					return
+				}
+				for _, m := range batch {
+					heap.Push(held, m)
+				}
+				emit(window)
+			case <-ticker.C:
+				for _, err := range s.changeVisibilityBatch(q.url, receipts(*held), pipelineVisibility) {
+					log.Println("Error extending held messages", err)
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// - - - - - - - - - - - - - - - -
+//   PIPELINE HELPERS
+// - - - - - - - - - - - - - - - -
+
+// sentOrder is a heap of messages, the first sent on top
+type sentOrder []*sqs.Message
+
+func (o sentOrder) Len() int      { return len(o) }
+func (o sentOrder) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o sentOrder) Less(i, j int) bool {
+	a, _ := sentAt(o[i])
+	b, _ := sentAt(o[j])
+	return a.Before(b)
+}
+
+// Push implements heap.Interface
+func (o *sentOrder) Push(x interface{}) { *o = append(*o, x.(*sqs.Message)) }
+
+// Pop implements heap.Interface
+func (o *sentOrder) Pop() interface{} {
+	old := *o
+	m := old[len(old)-1]
+	*o = old[:len(old)-1]
+	return m
+}
+
+// skipDuplicates deletes the messages of a batch already sent by a previous run
+// and returns the others
+func (s *service) skipDuplicates(from string, d *deduper, batch []*sqs.Message) []*sqs.Message {
+	fresh, duplicates := d.filter(batch)
+	if len(duplicates) > 0 {
+		log.Printf("Skipping %d messages already sent\n", len(duplicates))
+		atomic.AddInt64(&tally.duplicates, int64(len(duplicates)))
+		atomic.AddInt64(&tally.deleted, int64(s.deleteMessageBatch(from, duplicates)))
+	}
+	return fresh
+}
+
+// newAcks returns the channel FIFO pipelines use to run in lockstep
+// other pipelines don't need one
+func newAcks(fifo bool) chan struct{} {
+	if !fifo {
+		return nil
+	}
+	return make(chan struct{}, 1)
+}
+
+// unsentReceipts returns the receipt handles of the messages of batch missing from sent
+func unsentReceipts(batch, sent []*sqs.Message) []string {
+	return receipts(unsentMessages(batch, sent))
+}
+
+// unsentMessages returns the messages of a batch that were not sent
+func unsentMessages(batch, sent []*sqs.Message) []*sqs.Message {
+	done := make(map[*sqs.Message]bool, len(sent))
+	for _, m := range sent {
+		done[m] = true
+	}
+	var unsent []*sqs.Message
+	for _, m := range batch {
+		if !done[m] {
+			unsent = append(unsent, m)
+		}
+	}
+	return unsent
+}
+
+// exportMarker returns the attributes marking copies re-added by a run
+func exportMarker(runID string) map[string]*sqs.MessageAttributeValue {
+	return map[string]*sqs.MessageAttributeValue{
+		exportMarkerAttribute: &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(runID),
+		},
+	}
+}
+
+// isRunCopy is true if the message was re-added by the runID run
+func isRunCopy(m *sqs.Message, runID string) bool {
+	marker, ok := m.MessageAttributes[exportMarkerAttribute]
+	return ok && aws.StringValue(marker.StringValue) == runID
+}
+
+// markedCopies recognises the copies marked with runID, see exportMarker
+func markedCopies(runID string) *runCopies {
+	return &runCopies{runID: runID, ids: make(map[string]bool)}
+}
+
+// openRunCopies recognises the copies whose IDs are recorded, and kept in the file
+// when path is set, loading the IDs an interrupted run left there
+// runID also recognises the marked copies of older versions, empty for none
+func openRunCopies(path, runID string) (*runCopies, error) {
+	c := markedCopies(runID)
+	if len(path) == 0 {
+		return c, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); len(id) > 0 {
+			c.ids[id] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.f = f
+	return c, nil
+}
+
+// has is true for the copies of the run, false for any message without run
+func (c *runCopies) has(m *sqs.Message) bool {
+	if c == nil {
+		return false
+	}
+	if len(c.runID) > 0 && isRunCopy(m, c.runID) {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ids[aws.StringValue(m.MessageId)]
+}
+
+// add records the IDs of copies just sent, synced to the file
+func (c *runCopies) add(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		c.ids[id] = true
+	}
+	if c.f == nil {
+		return
+	}
+	if _, err := fmt.Fprintln(c.f, strings.Join(ids, "\n")); err != nil {
+		log.Fatal("Error recording copies ", err)
+	}
+	if err := c.f.Sync(); err != nil {
+		log.Fatal("Error recording copies ", err)
+	}
+}
+
+// sending runs a send of copies and records the IDs it returns
+// receives wait meanwhile, see pauseSends, SQS only gives the IDs once the copies can be received
+// a nil runCopies just runs the send
+func (c *runCopies) sending(send func() []string) {
+	if c == nil {
+		send()
+		return
+	}
+	c.sends.Lock()
+	defer c.sends.Unlock()
+	c.add(send())
+}
+
+// pauseSends holds the sends of copies until resumeSends,
+// so a receive in between tells every copy it returns by its ID
+func (c *runCopies) pauseSends() {
+	if c != nil {
+		c.sends.RLock()
+	}
+}
+
+// resumeSends lets the sends of copies go on, see pauseSends
+func (c *runCopies) resumeSends() {
+	if c != nil {
+		c.sends.RUnlock()
+	}
+}
+
+// remove deletes the file of a finished run
+func (c *runCopies) remove() {
+	if c == nil || c.f == nil {
+		return
+	}
+	c.f.Close()
+	os.Remove(c.f.Name())
+}
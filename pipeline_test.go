@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// newTestService starts an emulator of its own, its queues are gone once the test ends
+func newTestService(t *testing.T) *service {
+	t.Helper()
+	localMode = true
+	sess := newLocalSession("")
+	return &service{SQS: sqs.New(sess), sess: sess}
+}
+
+// newTestQueue creates a queue in the emulator of s, FIFO when name ends in .fifo
+func newTestQueue(t *testing.T, s *service, name string, attrs map[string]string) *queue {
+	t.Helper()
+	fifo := strings.HasSuffix(name, ".fifo")
+	input := &sqs.CreateQueueInput{QueueName: aws.String(name), Attributes: aws.StringMap(attrs)}
+	if fifo {
+		if input.Attributes == nil {
+			input.Attributes = make(map[string]*string)
+		}
+		input.Attributes[sqs.QueueAttributeNameFifoQueue] = aws.String("true")
+	}
+	out, err := s.CreateQueue(input)
+	if err != nil {
+		t.Fatalf("creating %s: %s", name, err)
+	}
+	return &queue{svc: s, name: name, url: aws.StringValue(out.QueueUrl), fifo: fifo}
+}
+
+// sendTestMessages sends bodies in order, FIFO ones in the group g
+func sendTestMessages(t *testing.T, q *queue, bodies ...string) {
+	t.Helper()
+	for i, body := range bodies {
+		input := &sqs.SendMessageInput{QueueUrl: aws.String(q.url), MessageBody: aws.String(body)}
+		if q.fifo {
+			input.MessageGroupId = aws.String("g")
+			input.MessageDeduplicationId = aws.String(strconv.Itoa(i))
+		}
+		if _, err := q.svc.SendMessage(input); err != nil {
+			t.Fatalf("sending to %s: %s", q.name, err)
+		}
+	}
+}
+
+// drainTestQueue receives every message of a queue, hiding them, and returns them in order
+func drainTestQueue(t *testing.T, q *queue) []*sqs.Message {
+	t.Helper()
+	var messages []*sqs.Message
+	for {
+		out, err := q.svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(q.url),
+			MaxNumberOfMessages:   aws.Int64(10),
+			VisibilityTimeout:     aws.Int64(60),
+			AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+			MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		})
+		if err != nil {
+			t.Fatalf("receiving from %s: %s", q.name, err)
+		}
+		if len(out.Messages) == 0 {
+			return messages
+		}
+		messages = append(messages, out.Messages...)
+	}
+}
+
+// bodiesOf returns the bodies of messages, sorted unless ordered
+func bodiesOf(messages []*sqs.Message, ordered bool) []string {
+	bodies := make([]string, 0, len(messages))
+	for _, m := range messages {
+		bodies = append(bodies, aws.StringValue(m.Body))
+	}
+	if !ordered {
+		sort.Strings(bodies)
+	}
+	return bodies
+}
+
+func TestReceiveResendStages(t *testing.T) {
+	bodies := []string{`{"n":1,"status":"failed"}`, `{"n":2,"status":"ok"}`, `{"n":3,"status":"failed"}`, `{"n":4,"status":"ok"}`, `{"n":5,"status":"failed"}`}
+	failed, err := compileExpression(`body.status == "failed"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onlyFailed := messageFilter{func(m *sqs.Message) bool {
+		ok, _ := failed.matches(m)
+		return ok
+	}}
+
+	tests := []struct {
+		name      string
+		from, to  string
+		keep      messageFilter
+		workers   int
+		wantSent  int
+		wantMoved []string
+		wantLeft  []string
+	}{
+		{"standard", "src", "dst", nil, 1, 5, bodies, nil},
+		{"concurrent receivers", "src", "dst", nil, 4, 5, bodies, nil},
+		{"filtered", "src", "dst", onlyFailed, 1, 3, []string{bodies[0], bodies[2], bodies[4]}, []string{bodies[1], bodies[3]}},
+		{"fifo keeps the order", "src.fifo", "dst.fifo", nil, 1, 5, bodies, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			from, to := newTestQueue(t, s, tt.from, nil), newTestQueue(t, s, tt.to, nil)
+			sendTestMessages(t, from, bodies...)
+
+			acks := newAcks(from.fifo)
+			sent, errs := s.resendStage(from, to, pipelineOptions{acks: acks}, s.receiveStage(from, nil, tt.keep, acks, tt.workers))
+			if len(errs) > 0 {
+				t.Fatalf("errors: %v", errs)
+			}
+			if sent != tt.wantSent {
+				t.Errorf("sent %d messages, want %d", sent, tt.wantSent)
+			}
+			moved := drainTestQueue(t, to)
+			if got, want := fmt.Sprint(bodiesOf(moved, from.fifo)), fmt.Sprint(bodiesOf(messagesOf(tt.wantMoved), from.fifo)); got != want {
+				t.Errorf("moved %s, want %s", got, want)
+			}
+			if got, want := fmt.Sprint(bodiesOf(drainTestQueue(t, from), false)), fmt.Sprint(bodiesOf(messagesOf(tt.wantLeft), false)); got != want {
+				t.Errorf("left %s, want %s", got, want)
+			}
+			for _, m := range moved {
+				if _, ok := m.MessageAttributes[originalSentAtAttribute]; !ok {
+					t.Errorf("message %s lost its original sent time", aws.StringValue(m.Body))
+				}
+			}
+		})
+	}
+}
+
+// TestRunCopies re-adds the messages of a queue to the queue itself, like qtocsv:
+// each one goes through once, and the copies are never received
+func TestRunCopies(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages int
+		expected int
+		workers  int
+	}{
+		{"one batch", 5, 5, 1},
+		{"several batches", 35, 35, 1},
+		{"concurrent receivers", 35, 35, 4},
+		{"without expected count", 12, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			// Without an expected count the copies are received, only the copy-only receives stop the run
+			dlq := newTestQueue(t, s, "dlq", nil)
+			var attrs map[string]string
+			if tt.expected > 0 {
+				attrs = map[string]string{sqs.QueueAttributeNameRedrivePolicy: fmt.Sprintf(`{"deadLetterTargetArn":"arn:aws:sqs:%s:%s:dlq","maxReceiveCount":"1"}`, localRegion, localAccount)}
+			}
+			q := newTestQueue(t, s, "export", attrs)
+			bodies := make([]string, tt.messages)
+			for i := range bodies {
+				bodies[i] = fmt.Sprintf("m%03d", i)
+			}
+			sendTestMessages(t, q, bodies...)
+
+			copies, err := openRunCopies("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			copies.expected = tt.expected
+			sent, errs := s.resendStage(q, q, pipelineOptions{copies: copies}, s.receiveStage(q, copies, nil, nil, tt.workers))
+			if len(errs) > 0 {
+				t.Fatalf("errors: %v", errs)
+			}
+			if sent != tt.messages {
+				t.Errorf("went through %d messages, want %d", sent, tt.messages)
+			}
+			if len(copies.ids) != tt.messages {
+				t.Errorf("recorded %d copies, want %d", len(copies.ids), tt.messages)
+			}
+
+			again := drainTestQueue(t, q)
+			if got, want := fmt.Sprint(bodiesOf(again, false)), fmt.Sprint(bodies); got != want {
+				t.Errorf("queue holds %s, want %s", got, want)
+			}
+			for _, m := range again {
+				if !copies.has(m) {
+					t.Errorf("message %s is not recognised as a copy", aws.StringValue(m.Body))
+				}
+				// With an expected count the copies are never received, they keep their receives
+				if n := aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]); tt.expected > 0 && n != "1" {
+					t.Errorf("copy %s received %s times, want 1", aws.StringValue(m.Body), n)
+				}
+			}
+			if n := len(drainTestQueue(t, dlq)); n > 0 {
+				t.Errorf("%d copies redriven to the DLQ", n)
+			}
+		})
+	}
+}
+
+func TestRunCopiesHas(t *testing.T) {
+	copies := markedCopies("run-1")
+	copies.add([]string{"id-1"})
+	tests := []struct {
+		name    string
+		copies  *runCopies
+		message *sqs.Message
+		want    bool
+	}{
+		{"recorded ID", copies, &sqs.Message{MessageId: aws.String("id-1")}, true},
+		{"other ID", copies, &sqs.Message{MessageId: aws.String("id-2")}, false},
+		{"marked by the run", copies, &sqs.Message{MessageId: aws.String("id-3"), MessageAttributes: exportMarker("run-1")}, true},
+		{"marked by another run", copies, &sqs.Message{MessageId: aws.String("id-4"), MessageAttributes: exportMarker("run-2")}, false},
+		{"without run", nil, &sqs.Message{MessageId: aws.String("id-1")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.copies.has(tt.message); got != tt.want {
+				t.Errorf("has = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenRunCopiesResumes(t *testing.T) {
+	path := t.TempDir() + "/run.copies"
+	copies, err := openRunCopies(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copies.add([]string{"id-1", "id-2"})
+	copies.f.Close()
+
+	resumed, err := openRunCopies(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.remove()
+	for _, id := range []string{"id-1", "id-2"} {
+		if !resumed.has(&sqs.Message{MessageId: aws.String(id)}) {
+			t.Errorf("copy %s not loaded back", id)
+		}
+	}
+}
+
+// messagesOf wraps bodies in messages, for bodiesOf
+func messagesOf(bodies []string) []*sqs.Message {
+	messages := make([]*sqs.Message, 0, len(bodies))
+	for _, body := range bodies {
+		messages = append(messages, &sqs.Message{Body: aws.String(body)})
+	}
+	return messages
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Plugins are executables on PATH, like kubectl ones
+const (
+	// pluginPrefix names the command plugins, sqscli-NAME runs as sqscli NAME
+	pluginPrefix = "sqscli-"
+	// transformPluginPrefix names the transform plugins of -transform NAME
+	transformPluginPrefix = "sqscli-transform-"
+	// sinkPluginPrefix names the sink plugins of -sink plugin:NAME
+	sinkPluginPrefix = "sqscli-sink-"
+)
+
+// Kinds of plugins, as listed by plugins
+const (
+	pluginKindCommand   = "command"
+	pluginKindTransform = "transform"
+	pluginKindSink      = "sink"
+)
+
+// exprTransformPrefix marks the -transform values that are expressions, see expr.go
+const exprTransformPrefix = "expr:"
+
+// bodyTransform turns the body of a message into another one, a transform plugin or an expression
+type bodyTransform interface {
+	transform(m *sqs.Message, body string) (string, error)
+	Close() error
+}
+
+// bodyDecoder is the transform the bodies are read through, set by -transform on the commands
+// writing messages out, see messageBody
+var bodyDecoder bodyTransform
+
+// pluginProcess is a running transform or sink plugin, speaking JSON lines on stdin and stdout:
+// each message is written as a peeked message record, and the plugin answers each with one pluginResponse line,
+// in order, it runs for the whole command and exits once its stdin is closed
+type pluginProcess struct {
+	name string
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	out  *bufio.Reader
+	mu   sync.Mutex // One message at a time
+}
+
+// pluginResponse is the answer of a plugin to a message
+// transform plugins give the new body, the body is kept without one, sink plugins answer {}
+type pluginResponse struct {
+	Body  *string `json:"body,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// pluginSink writes the messages to a sink plugin, each is stored once the plugin answered
+type pluginSink struct {
+	p *pluginProcess
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// runCommandPlugin runs sqscli-NAME for an unknown command NAME with the rest of the arguments,
+// false if there is no such plugin, exits with the status of the plugin when it fails
+func runCommandPlugin(args []string) bool {
+	if strings.ContainsAny(args[0], `/\`) || strings.HasPrefix(args[0], "-") {
+		return false
+	}
+	path, err := exec.LookPath(pluginPrefix + args[0])
+	if err != nil {
+		return false
+	}
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = pluginEnv()
+	if err := cmd.Run(); err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() > 0 {
+			endTelemetry()
+			os.Exit(exit.ExitCode())
+		}
+		log.Fatalf("Error running plugin %s: %s\n", path, err)
+	}
+	return true
+}
+
+// listPlugins prints the plugins found on PATH, the first one of a name is the one run
+// built-in commands are never replaced by a command plugin
+func listPlugins(args []string) {
+	pluginsCommand := flag.NewFlagSet("plugins", flag.ExitOnError)
+	pluginsHelp := pluginsCommand.Bool("help", false, "help for plugins command")
+	pluginsCommand.BoolVar(pluginsHelp, "h", false, "help") // Aliasing
+	parseFlags(pluginsCommand, args)
+
+	if *pluginsHelp {
+		pluginsUsage()
+	}
+
+	// Apply, PATH order, the first plugin of a name is the one run
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t := &table{columns: []column{
+		{key: "name", title: "NAME"},
+		{key: "kind", title: "KIND"},
+		{key: "path", title: "PATH"},
+		{key: "note", title: "NOTE"},
+	}}
+	seen := make(map[string]bool)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if !strings.HasPrefix(f.Name(), pluginPrefix) || f.IsDir() || f.Mode()&0111 == 0 {
+				continue
+			}
+			name := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+			kind, note := pluginKindCommand, ""
+			switch {
+			case strings.HasPrefix(name, transformPluginPrefix):
+				name, kind = strings.TrimPrefix(name, transformPluginPrefix), pluginKindTransform
+			case strings.HasPrefix(name, sinkPluginPrefix):
+				name, kind = strings.TrimPrefix(name, sinkPluginPrefix), pluginKindSink
+			default:
+				name = strings.TrimPrefix(name, pluginPrefix)
+			}
+			if seen[kind+":"+name] {
+				note = "shadowed by the one before"
+			}
+			seen[kind+":"+name] = true
+			t.add(name, kind, filepath.Join(dir, f.Name()), note)
+		}
+	}
+	if len(t.rows) == 0 {
+		fmt.Fprintln(os.Stderr, "No sqscli-* plugin on PATH")
+		return
+	}
+	t.render(os.Stdout, format)
+}
+
+// pluginEnv is the environment of the plugins: the global flags given, in their SQSCLI_* variables,
+// so plugins running sqscli again through SQSCLI_BIN reach the same queues, and the AWS ones the SDKs read
+func pluginEnv() []string {
+	env := os.Environ()
+	flag.Visit(func(f *flag.Flag) {
+		env = append(env, envName("", f.Name)+"="+f.Value.String())
+	})
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+	env = append(env, envPrefix+"BIN="+self, "AWS_REGION="+awsRegion)
+	if len(awsProfile) > 0 {
+		env = append(env, "AWS_PROFILE="+awsProfile)
+	}
+	return env
+}
+
+// - - - - - - - - - - - - - - - -
+//   PROTOCOL
+// - - - - - - - - - - - - - - - -
+
+// startPlugin starts the plugin prefix+NAME found on PATH, or the executable at NAME if it is a path
+func startPlugin(prefix, name string) (*pluginProcess, error) {
+	path := name
+	if !strings.ContainsAny(name, `/\`) {
+		var err error
+		if path, err = exec.LookPath(prefix + name); err != nil {
+			return nil, fmt.Errorf("no plugin %s%s on PATH", prefix, name)
+		}
+	}
+	cmd := exec.Command(path)
+	cmd.Stderr = os.Stderr
+	cmd.Env = pluginEnv()
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("plugin %s: %s", path, err)
+	}
+	return &pluginProcess{name: filepath.Base(path), cmd: cmd, in: in, out: bufio.NewReaderSize(out, 64*1024)}, nil
+}
+
+// call sends a message record to the plugin and reads its answer
+func (p *pluginProcess) call(r peekedMessage) (pluginResponse, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return pluginResponse{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.in.Write(append(b, '\n')); err != nil {
+		return pluginResponse{}, fmt.Errorf("plugin %s: %s", p.name, err)
+	}
+	line, err := p.out.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = errors.New("exited before answering")
+		}
+		return pluginResponse{}, fmt.Errorf("plugin %s: %s", p.name, err)
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return pluginResponse{}, fmt.Errorf("plugin %s answered %q: %s", p.name, strings.TrimSpace(string(line)), err)
+	}
+	if len(resp.Error) > 0 {
+		return resp, fmt.Errorf("plugin %s: %s", p.name, resp.Error)
+	}
+	return resp, nil
+}
+
+// transform returns the body a transform plugin gives for a message and its body
+func (p *pluginProcess) transform(m *sqs.Message, body string) (string, error) {
+	resp, err := p.call(peekedMessage{
+		MessageID:         aws.StringValue(m.MessageId),
+		Body:              body,
+		Attributes:        m.Attributes,
+		MessageAttributes: m.MessageAttributes,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Body == nil {
+		return body, nil
+	}
+	return *resp.Body, nil
+}
+
+// Close closes the stdin of the plugin and waits for it to exit
+func (p *pluginProcess) Close() error {
+	p.in.Close()
+	if err := p.cmd.Wait(); err != nil {
+		return fmt.Errorf("plugin %s: %s", p.name, err)
+	}
+	return nil
+}
+
+// newBodyTransform compiles a -transform expr:EXPRESSION, or starts the transform plugin NAME
+func newBodyTransform(spec string) (bodyTransform, error) {
+	if strings.HasPrefix(spec, exprTransformPrefix) {
+		e, err := compileExpression(spec[len(exprTransformPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	p, err := startPlugin(transformPluginPrefix, spec)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// startBodyDecoder starts the -transform of a command writing messages out, if any
+func startBodyDecoder(spec string) {
+	if len(spec) == 0 {
+		return
+	}
+	t, err := newBodyTransform(spec)
+	if err != nil {
+		log.Fatal("Invalid -transform ", err)
+	}
+	bodyDecoder = t
+}
+
+// stopBodyDecoder waits for the -transform plugin to exit
+func stopBodyDecoder() {
+	if bodyDecoder == nil {
+		return
+	}
+	if err := bodyDecoder.Close(); err != nil {
+		log.Println("Error stopping transform", err)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   SINK
+// - - - - - - - - - - - - - - - -
+
+func (s *pluginSink) Write(m *sqs.Message) error {
+	_, err := s.p.call(newSinkRecord(m))
+	return err
+}
+
+func (s *pluginSink) Close() error {
+	return s.p.Close()
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func pluginsUsage() {
+	fmt.Println("usage: sqscli plugins")
+	fmt.Println("Lists the sqscli-NAME command plugins, sqscli-transform-NAME transform plugins")
+	fmt.Println("and sqscli-sink-NAME sink plugins found on PATH")
+	os.Exit(0)
+}
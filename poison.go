@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// poisonBodyWidth is the length of the sample body shown in tables
+const poisonBodyWidth = 60
+
+// poisonGroup gathers the messages over the threshold sharing a key
+type poisonGroup struct {
+	key         string
+	messages    []*sqs.Message
+	maxReceives int
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// poisonReport lists the messages of a queue received more times than a threshold,
+// grouped by key so repeat offenders stand out before they reach the DLQ
+func poisonReport(args []string) {
+	poisonCommand := flag.NewFlagSet("poison-report", flag.ExitOnError)
+	queueName := poisonCommand.String("queue", "", "queue name")
+	poisonCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	threshold := poisonCommand.Int("threshold", 3, "report messages received more times than this")
+	keyBy := poisonCommand.String("key", dedupeBodyHash, "message key: body-hash, jmespath:QUERY or expr:EXPRESSION")
+	visibility := poisonCommand.Int64("visibility", 300, "seconds the messages stay hidden while reading")
+	poisonHelp := poisonCommand.Bool("help", false, "help for poison-report command")
+	poisonCommand.BoolVar(poisonHelp, "h", false, "help") // Aliasing
+	parseFlags(poisonCommand, args)
+
+	if *poisonHelp {
+		poisonUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		poisonUsage()
+	}
+	if *threshold < 0 {
+		log.Fatal("Threshold must be positive")
+	}
+	if *keyBy == dedupeMessageID {
+		log.Fatal("Message IDs are unique, use body-hash, jmespath:QUERY or expr:EXPRESSION")
+	}
+	keys, err := newDeduper(*keyBy, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *visibility < 1 || *visibility > maxVisibilityTimeout {
+		log.Fatal("Visibility must be between 1 and 43200 seconds")
+	}
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+	q := svc.resolveQueue(*queueName)
+	qURL := q.url
+	// Later messages of a FIFO group are not received while the first ones are in flight
+	if q.fifo {
+		log.Fatal("FIFO queues can't be read whole without deleting, poison-report is not supported")
+	}
+
+	// Apply
+	var messages []*sqs.Message
+	handles, err := svc.receiveAll(qURL, *visibility, func(m *sqs.Message) { messages = append(messages, m) })
+	release := func() { svc.changeVisibilityBatch(qURL, handles, 0) }
+	if err != nil {
+		release()
+		log.Fatalf("Error reading %s: %s\n", *queueName, err)
+	}
+	if isInterrupted() {
+		release()
+		os.Exit(exitInterrupted)
+	}
+	log.Printf("%d messages read from %s\n", len(messages), *queueName)
+
+	groups := poisonGroups(messages, keys, *threshold)
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t := &table{columns: []column{
+		{key: "key", title: "KEY"},
+		{key: "messages", title: "MESSAGES"},
+		{key: "maxReceives", title: "MAX RECEIVES"},
+		{key: "oldestSent", title: "OLDEST SENT"},
+		{key: "body", title: "BODY"},
+		{key: "messageIds", title: "MESSAGE IDS", wide: true},
+	}}
+	poisoned := 0
+	for _, g := range groups {
+		poisoned += len(g.messages)
+		key, body := g.key, messageBody(g.messages[0])
+		if format == formatTable || format == formatWide {
+			key = shortKey(key)
+			body = shortBody(body)
+		}
+		var ids []string
+		for _, m := range g.messages {
+			ids = append(ids, aws.StringValue(m.MessageId))
+		}
+		oldest := ""
+		if sent, ok := sentAt(g.messages[0]); ok {
+			oldest = formatTime(sent, timeRFC3339)
+		}
+		t.add(key, len(g.messages), g.maxReceives, oldest, body, strings.Join(ids, ","))
+	}
+	t.render(os.Stdout, format)
+	release()
+
+	// Non-zero so scripts can alert on poison messages
+	if poisoned > 0 {
+		log.Printf("%d messages in %d groups received more than %d times\n", poisoned, len(groups), *threshold)
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// poisonGroups groups the messages received more than threshold times by key,
+// the largest groups first, messages of a group oldest first
+// the receive that read them is not counted
+func poisonGroups(messages []*sqs.Message, keys *deduper, threshold int) []*poisonGroup {
+	byKey := make(map[string]*poisonGroup)
+	var groups []*poisonGroup
+	for _, m := range messages {
+		receives, _ := strconv.Atoi(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+		receives-- // This read
+		if receives <= threshold {
+			continue
+		}
+		key, ok := keys.messageKey(m)
+		if !ok {
+			continue
+		}
+		g, ok := byKey[key]
+		if !ok {
+			g = &poisonGroup{key: key}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.messages = append(g.messages, m)
+		if receives > g.maxReceives {
+			g.maxReceives = receives
+		}
+	}
+	for _, g := range groups {
+		sort.SliceStable(g.messages, func(i, j int) bool { return sortLess(sortSent, g.messages[i], g.messages[j]) })
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if len(groups[i].messages) != len(groups[j].messages) {
+			return len(groups[i].messages) > len(groups[j].messages)
+		}
+		return groups[i].maxReceives > groups[j].maxReceives
+	})
+	return groups
+}
+
+// shortKey keeps the start of long keys, like body hashes
+func shortKey(key string) string {
+	if len(key) > 12 {
+		return key[:12]
+	}
+	return key
+}
+
+// shortBody keeps the first line of a body, cut to fit a table
+func shortBody(body string) string {
+	if i := strings.IndexAny(body, "\r\n"); i >= 0 {
+		body = body[:i] + "..."
+	}
+	if r := []rune(body); len(r) > poisonBodyWidth {
+		body = string(r[:poisonBodyWidth]) + "..."
+	}
+	return body
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func poisonUsage() {
+	fmt.Println("usage: sqscli poison-report [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -threshold        Report messages received more times than this (default 3)")
+	fmt.Println("  -key              Message key, body-hash, jmespath:QUERY or expr:EXPRESSION (default body-hash)")
+	fmt.Println("  -visibility       Seconds the messages stay hidden while reading (default 300)")
+	os.Exit(0)
+}
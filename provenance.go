@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Attributes stamped on moved messages by -provenance
+const (
+	provenanceSourceAttribute    = "sqscli.sourceQueue"
+	provenanceMovedAtAttribute   = "sqscli.movedAt"
+	provenanceOperationAttribute = "sqscli.operationId"
+)
+
+// originalSentAtAttribute keeps the first SentTimestamp of a message moved or restored,
+// epoch milliseconds, always stamped
+const originalSentAtAttribute = "sqscli.originalSentAt"
+
+// attributesDropped warns once that messages had no room left for some of the attributes sqscli adds
+var attributesDropped sync.Once
+
+// optionalAttributes are the attributes sqscli adds to re-sent messages for information,
+// dropped group after group when a message would have more than SQS accepts:
+// the system attributes of FIFO messages, their SentTimestamp, the provenance,
+// the first send and last the redrive ID, which -max-bounces counts on
+var optionalAttributes = [][]string{
+	{"ApproximateReceiveCount", "ApproximateFirstReceiveTimestamp", "SenderId", "SequenceNumber", "MessageGroupId"},
+	{"SentTimestamp"},
+	{provenanceSourceAttribute, provenanceMovedAtAttribute, provenanceOperationAttribute},
+	{originalSentAtAttribute},
+	{redriveIDAttribute},
+}
+
+// provenance stamps the messages of a move with where they come from
+type provenance struct {
+	source      string // Queue the messages were moved from
+	operationID string // The operation of the move, see ops
+}
+
+// - - - - - - - - - - - - - - - -
+//   PROVENANCE
+// - - - - - - - - - - - - - - - -
+
+// newProvenance returns the provenance of a move from a queue
+// the operation ID is also the action of the audit log, so stamped messages lead to their audit lines
+func newProvenance(sourceURL string) *provenance {
+	id := ""
+	if operation != nil {
+		id = operation.ID
+	} else {
+		id, _ = newUUID()
+	}
+	return &provenance{source: queueNameFromURL(sourceURL), operationID: id}
+}
+
+// attributes adds the provenance attributes to extra, moved now
+// a nil provenance returns extra as is
+func (p *provenance) attributes(extra map[string]*sqs.MessageAttributeValue) map[string]*sqs.MessageAttributeValue {
+	if p == nil {
+		return extra
+	}
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(extra)+3)
+	for name, value := range extra {
+		attrs[name] = value
+	}
+	for name, value := range map[string]string{
+		provenanceSourceAttribute:    p.source,
+		provenanceMovedAtAttribute:   time.Now().UTC().Format(time.RFC3339),
+		provenanceOperationAttribute: p.operationID,
+	} {
+		attrs[name] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	return attrs
+}
+
+// fitAttributes drops the optional attributes of a message about to be sent, in order,
+// until it has no more than SQS accepts, and fails when the others are still too many
+func fitAttributes(attrs map[string]*sqs.MessageAttributeValue) error {
+	for _, group := range optionalAttributes {
+		if len(attrs) <= maxMessageAttributes {
+			return nil
+		}
+		for _, name := range group {
+			if _, ok := attrs[name]; ok {
+				delete(attrs, name)
+				attributesDropped.Do(func() {
+					log.Println("Warning: some messages have too many attributes, they are sent without some of the ones sqscli adds, like", name)
+				})
+			}
+		}
+	}
+	if len(attrs) > maxMessageAttributes {
+		return fmt.Errorf("%d attributes, SQS accepts %d, see -drop-attr", len(attrs), maxMessageAttributes)
+	}
+	return nil
+}
+
+// originalSentAt returns the attribute keeping when a message was first sent:
+// the one it carries when moved or restored before, else its SentTimestamp
+func originalSentAt(m *sqs.Message) *sqs.MessageAttributeValue {
+	if attr, ok := m.MessageAttributes[originalSentAtAttribute]; ok && attr.StringValue != nil {
+		return attr
+	}
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameSentTimestamp])),
+	}
+}
+
+// sentAt returns when a message was first sent, across the moves and restores that kept it
+// false when the message has no SentTimestamp
+func sentAt(m *sqs.Message) (time.Time, bool) {
+	ms, err := strconv.ParseInt(aws.StringValue(originalSentAt(m).StringValue), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestFitAttributes(t *testing.T) {
+	// attrs returns the user attributes u0..un-1 and the given ones added by sqscli
+	attrs := func(user int, added ...string) map[string]*sqs.MessageAttributeValue {
+		m := make(map[string]*sqs.MessageAttributeValue)
+		for i := 0; i < user; i++ {
+			m[fmt.Sprintf("u%d", i)] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("v")}
+		}
+		for _, name := range added {
+			m[name] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("v")}
+		}
+		return m
+	}
+	provenanceTrio := []string{provenanceSourceAttribute, provenanceMovedAtAttribute, provenanceOperationAttribute}
+	tests := []struct {
+		name    string
+		attrs   map[string]*sqs.MessageAttributeValue
+		dropped []string
+		wantErr bool
+	}{
+		{"room left", attrs(3, "SentTimestamp", originalSentAtAttribute), nil, false},
+		{"exactly the limit", attrs(maxMessageAttributes-1, originalSentAtAttribute), nil, false},
+		{"SentTimestamp first", attrs(8, "SentTimestamp", originalSentAtAttribute, redriveIDAttribute), []string{"SentTimestamp"}, false},
+		{"FIFO attributes before SentTimestamp", attrs(7, "SentTimestamp", "SequenceNumber", "MessageGroupId", originalSentAtAttribute),
+			[]string{"SequenceNumber", "MessageGroupId"}, false},
+		{"provenance as a group", attrs(6, append(provenanceTrio, "SentTimestamp", originalSentAtAttribute, redriveIDAttribute)...),
+			append([]string{"SentTimestamp"}, provenanceTrio...), false},
+		{"redrive ID last", attrs(9, originalSentAtAttribute, redriveIDAttribute), []string{originalSentAtAttribute}, false},
+		{"user attributes never dropped", attrs(maxMessageAttributes+1, "SentTimestamp"), []string{"SentTimestamp"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := make(map[string]bool, len(tt.attrs))
+			for name := range tt.attrs {
+				before[name] = true
+			}
+			err := fitAttributes(tt.attrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && len(tt.attrs) > maxMessageAttributes {
+				t.Errorf("%d attributes left", len(tt.attrs))
+			}
+			var dropped []string
+			for name := range before {
+				if _, ok := tt.attrs[name]; !ok {
+					dropped = append(dropped, name)
+				}
+			}
+			sort.Strings(dropped)
+			want := append([]string(nil), tt.dropped...)
+			sort.Strings(want)
+			if strings.Join(dropped, ",") != strings.Join(want, ",") {
+				t.Errorf("dropped %v, want %v", dropped, want)
+			}
+		})
+	}
+}
+
+func TestOriginalSentAt(t *testing.T) {
+	sent := map[string]*string{sqs.MessageSystemAttributeNameSentTimestamp: aws.String("1700000000000")}
+	tests := []struct {
+		name string
+		m    *sqs.Message
+		want string
+	}{
+		{"first move", &sqs.Message{Attributes: sent}, "1700000000000"},
+		{"moved before", &sqs.Message{Attributes: sent, MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			originalSentAtAttribute: {DataType: aws.String("Number"), StringValue: aws.String("1600000000000")},
+		}}, "1600000000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aws.StringValue(originalSentAt(tt.m).StringValue); got != tt.want {
+				t.Errorf("originalSentAt = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
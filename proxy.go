@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+var (
+	// proxyURL is the proxy of every HTTP call, set by -proxy
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY are honored otherwise
+	proxyURL string
+	// caBundle is a PEM file of certificates trusted on top of the system ones, set by -ca-bundle
+	// proxies intercepting TLS sign with their own authority
+	caBundle string
+)
+
+// - - - - - - - - - - - - - - - -
+//   HTTP CLIENT
+// - - - - - - - - - - - - - - - -
+
+// newHTTPClient returns a client going through -proxy and trusting -ca-bundle
+// connections are pooled for the concurrent calls of a run
+func newHTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	if len(proxyURL) > 0 {
+		u, err := url.Parse(proxyURL)
+		if err != nil || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid proxy %q, expected a URL like http://proxy:3128", proxyURL)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if len(caBundle) > 0 {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificate in %s", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// caBundleFromEnv returns AWS_CA_BUNDLE, the CA bundle of the AWS CLI and SDKs
+// it is cleared so the SDK doesn't replace the system certificates with it
+func caBundleFromEnv() string {
+	bundle := os.Getenv("AWS_CA_BUNDLE")
+	os.Unsetenv("AWS_CA_BUNDLE")
+	return bundle
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// purge deletes all messages of queues
+func purge(args []string) {
+	purgeCommand := flag.NewFlagSet("purge", flag.ExitOnError)
+	queueName := purgeCommand.String("queue", "", "queue name or pattern")
+	purgeCommand.StringVar(queueName, "q", "", "queue name or pattern") // Aliasing
+	yes := purgeCommand.Bool("yes", false, "don't ask for confirmation")
+	reportFile := purgeCommand.String("report", "", "file receiving the JSON summary")
+	purgeHelp := purgeCommand.Bool("help", false, "help for purge command")
+	purgeCommand.BoolVar(purgeHelp, "h", false, "help") // Aliasing
+	parseFlags(purgeCommand, args)
+
+	if *purgeHelp {
+		purgeUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		purgeUsage()
+	}
+
+	// Connect
+	svc := newService()
+
+	queues := svc.queuesMatching(*queueName)
+	names := make([]string, 0, len(queues))
+	for _, q := range queues {
+		names = append(names, q.name)
+	}
+	enforceGuardrails("purge", names, svc.depthCounter(), *yes)
+	if !*yes {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		if !confirm(fmt.Sprintf("Purge these %d queues?", len(queues))) {
+			fmt.Println("Aborted.")
+			return
+		}
+	}
+
+	startReport("purge", *reportFile, *queueName)
+	failed := 0
+	for _, q := range queues {
+		// PurgeQueue doesn't say how many messages went, the approximate count will do
+		n := q.depth()
+		_, err := svc.PurgeQueue(&sqs.PurgeQueueInput{QueueUrl: aws.String(q.url)})
+		if err != nil {
+			log.Printf("Error purging %s: %s\n", q.name, err)
+			noteFailure(fmt.Errorf("purging %s: %s", q.name, err))
+			atomic.AddInt64(&tally.failed, int64(n))
+			failed++
+			continue
+		}
+		atomic.AddInt64(&tally.deleted, int64(n))
+		fmt.Printf("%s purged\n", q.name)
+	}
+	finishReport()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   UTILS
+// - - - - - - - - - - - - - - - -
+
+// confirm asks a yes/no question on the terminal, defaults to no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func purgeUsage() {
+	fmt.Println("usage: sqscli purge [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name, wildcards match several queues")
+	fmt.Println("  -yes              Don't ask for confirmation")
+	fmt.Println("  -report           File receiving the JSON summary of the run")
+	os.Exit(0)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// queue is a resolved queue: its name, URL and type, its attributes once read, and the service reaching it
+// commands resolve the queues they are given into queues and hand them to the pipeline stages
+type queue struct {
+	svc   *service
+	name  string
+	url   string
+	fifo  bool
+	attrs map[string]*string // Every attribute, read on first use
+}
+
+// - - - - - - - - - - - - - - - -
+//   QUEUES
+// - - - - - - - - - - - - - - - -
+
+// resolveQueue resolves a queue name or ARN, fatal if there is no such queue
+// the URL and type are cached, see getQueueURL and isFIFO
+func (s *service) resolveQueue(name string) *queue {
+	return s.queueAt(s.getQueueURL(name))
+}
+
+// queuesMatching resolves a name or a glob pattern into the queues it matches, see resolveQueues
+func (s *service) queuesMatching(pattern string) []*queue {
+	qURLs := s.resolveQueues(pattern)
+	queues := make([]*queue, 0, len(qURLs))
+	for _, qURL := range qURLs {
+		queues = append(queues, s.queueAt(qURL))
+	}
+	return queues
+}
+
+// queueAt describes the queue of a URL
+func (s *service) queueAt(qURL string) *queue {
+	return &queue{svc: s, name: queueNameFromURL(qURL), url: qURL, fifo: s.isFIFO(qURL)}
+}
+
+// String returns the name of the queue
+func (q *queue) String() string {
+	return q.name
+}
+
+// attributes returns every attribute of the queue, read on first use
+// depths change, use refresh to read them again
+func (q *queue) attributes() map[string]*string {
+	if q.attrs == nil {
+		q.refresh()
+	}
+	return q.attrs
+}
+
+// refresh reads the attributes of the queue again
+func (q *queue) refresh() map[string]*string {
+	q.attrs = q.svc.getQueueAttributes(q.url).Attributes
+	return q.attrs
+}
+
+// depth returns the messages available in the queue now
+func (q *queue) depth() int {
+	return intAttribute(q.refresh(), "ApproximateNumberOfMessages")
+}
+
+// arn returns the ARN of the queue
+func (q *queue) arn() string {
+	return aws.StringValue(q.attributes()[sqs.QueueAttributeNameQueueArn])
+}
+
+// account returns the account owning the queue, from its URL
+func (q *queue) account() string {
+	u, err := url.Parse(q.url)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+// region returns the region of the queue, from the host of its URL like sqs.eu-west-1.amazonaws.com,
+// the legacy eu-west-1.queue.amazonaws.com or a VPC endpoint
+// URLs of other endpoints, like the emulator, are in the region of the service
+func (q *queue) region() string {
+	if u, err := url.Parse(q.url); err == nil {
+		labels := strings.Split(u.Hostname(), ".")
+		for i, label := range labels {
+			switch {
+			case label == "sqs" && i+2 < len(labels):
+				return labels[i+1]
+			case label == "queue" && i > 0:
+				return labels[i-1]
+			case label == "queue" && u.Hostname() == "queue.amazonaws.com":
+				return "us-east-1"
+			}
+		}
+	}
+	return aws.StringValue(q.svc.sess.Config.Region)
+}
+
+// deadLetterQueue returns the DLQ the queue redrives to, nil without one, or if it doesn't exist
+// a DLQ of another account is reached with the credentials of the service
+func (q *queue) deadLetterQueue() *queue {
+	p, ok := parseRedrivePolicy(q.attributes())
+	if !ok {
+		return nil
+	}
+	a, err := parseQueueARN(p.DeadLetterTargetArn)
+	if err != nil || a.Region != q.region() {
+		return nil
+	}
+	input := &sqs.GetQueueUrlInput{QueueName: aws.String(a.Resource)}
+	if a.AccountID != q.account() {
+		input.QueueOwnerAWSAccountId = aws.String(a.AccountID)
+	}
+	out, err := q.svc.GetQueueUrl(input)
+	if err != nil {
+		return nil
+	}
+	return q.svc.queueAt(aws.StringValue(out.QueueUrl))
+}
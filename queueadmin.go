@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// sseFlags are the server-side encryption flags of create and set-attrs
+type sseFlags struct {
+	mode   *string
+	key    *string
+	reuse  *int64
+	values *attrFlag
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// create creates a queue
+func create(args []string) {
+	createCommand := flag.NewFlagSet("create", flag.ExitOnError)
+	queueName := createCommand.String("queue", "", "queue name")
+	createCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	fifo := createCommand.Bool("fifo", false, "create a FIFO queue, the name gets the .fifo suffix")
+	flags := newSSEFlags(createCommand)
+	createHelp := createCommand.Bool("help", false, "help for create command")
+	createCommand.BoolVar(createHelp, "h", false, "help") // Aliasing
+	parseFlags(createCommand, args)
+
+	if *createHelp {
+		queueAdminUsage("create")
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		queueAdminUsage("create")
+	}
+
+	attrs := flags.attributes()
+	name := *queueName
+	if *fifo {
+		attrs[sqs.QueueAttributeNameFifoQueue] = "true"
+		if !strings.HasSuffix(name, ".fifo") {
+			name += ".fifo"
+		}
+	}
+
+	// Connect
+	svc := newService()
+
+	result, err := svc.CreateQueue(&sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: aws.StringMap(attrs),
+	})
+	if err != nil {
+		log.Fatalf("Error creating queue %s: %s\n", name, err)
+	}
+	fmt.Println(*result.QueueUrl)
+}
+
+// setAttrs updates the attributes of queues
+func setAttrs(args []string) {
+	setCommand := flag.NewFlagSet("set-attrs", flag.ExitOnError)
+	queueName := setCommand.String("queue", "", "queue name or pattern")
+	setCommand.StringVar(queueName, "q", "", "queue name or pattern") // Aliasing
+	flags := newSSEFlags(setCommand)
+	setHelp := setCommand.Bool("help", false, "help for set-attrs command")
+	setCommand.BoolVar(setHelp, "h", false, "help") // Aliasing
+	parseFlags(setCommand, args)
+
+	if *setHelp {
+		queueAdminUsage("set-attrs")
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		queueAdminUsage("set-attrs")
+	}
+	attrs := flags.attributes()
+	if len(attrs) == 0 {
+		fmt.Println("Nothing to set.")
+		queueAdminUsage("set-attrs")
+	}
+
+	// Connect
+	svc := newService()
+
+	for _, qURL := range svc.resolveQueues(*queueName) {
+		_, err := svc.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+			QueueUrl:   aws.String(qURL),
+			Attributes: aws.StringMap(attrs),
+		})
+		if err != nil {
+			log.Fatalf("Error updating queue %s: %s\n", queueNameFromURL(qURL), err)
+		}
+		fmt.Printf("%s updated\n", queueNameFromURL(qURL))
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// newSSEFlags registers the encryption and attribute flags on a command
+func newSSEFlags(cmd *flag.FlagSet) *sseFlags {
+	values := &attrFlag{}
+	cmd.Var(values, "set", "queue attribute Name=value, repeatable")
+	return &sseFlags{
+		mode:   cmd.String("sse", "", "server-side encryption: sqs, kms or none"),
+		key:    cmd.String("kms-key", "", "KMS key ID for -sse kms"),
+		reuse:  cmd.Int64("kms-reuse", 0, "KMS data key reuse period in seconds (60-86400)"),
+		values: values,
+	}
+}
+
+// attributes turns the flags into queue attributes, exits on invalid values
+func (f *sseFlags) attributes() map[string]string {
+	attrs := make(map[string]string)
+	for _, raw := range *f.values {
+		parts := strings.SplitN(raw, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			log.Fatalf("%q is not Name=value\n", raw)
+		}
+		attrs[parts[0]] = parts[1]
+	}
+
+	switch *f.mode {
+	case "":
+	case "sqs":
+		attrs["SqsManagedSseEnabled"] = "true"
+	case "kms":
+		if len(*f.key) == 0 {
+			log.Fatal("-sse kms requires -kms-key")
+		}
+		attrs[sqs.QueueAttributeNameKmsMasterKeyId] = *f.key
+	case "none":
+		attrs["SqsManagedSseEnabled"] = "false"
+		attrs[sqs.QueueAttributeNameKmsMasterKeyId] = ""
+	default:
+		log.Fatal("-sse must be sqs, kms or none")
+	}
+	if *f.reuse != 0 {
+		if *f.reuse < 60 || *f.reuse > 86400 {
+			log.Fatal("-kms-reuse must be between 60 and 86400 seconds")
+		}
+		attrs[sqs.QueueAttributeNameKmsDataKeyReusePeriodSeconds] = strconv.FormatInt(*f.reuse, 10)
+	}
+	return attrs
+}
+
+// encryptionMode describes the server-side encryption of a queue
+func encryptionMode(attrs map[string]*string) string {
+	if key := aws.StringValue(attrs["KmsMasterKeyId"]); key != "" {
+		return "SSE-KMS (" + key + ")"
+	}
+	if aws.StringValue(attrs["SqsManagedSseEnabled"]) == "true" {
+		return "SSE-SQS"
+	}
+	return "none"
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func queueAdminUsage(command string) {
+	fmt.Printf("usage: sqscli %s [options]\n", command)
+	fmt.Println("options:")
+	if command == "create" {
+		fmt.Println("  -queue required   Queue name")
+		fmt.Println("  -fifo             Create a FIFO queue")
+	} else {
+		fmt.Println("  -queue required   Queue name, wildcards match several queues")
+	}
+	fmt.Println("  -sse              Server-side encryption, sqs, kms or none")
+	fmt.Println("  -kms-key          KMS key ID for -sse kms")
+	fmt.Println("  -kms-reuse        KMS data key reuse period in seconds, 60 to 86400")
+	fmt.Println("  -set              Queue attribute Name=value, repeatable")
+	os.Exit(0)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// maxQueueSuggestions caps the close matches offered for a queue name that doesn't resolve
+const maxQueueSuggestions = 10
+
+// exactNames disables the close matches of queue names that don't resolve, set by -exact
+var exactNames bool
+
+// queuePicks remembers the queue picked for a name, so a command resolving it again doesn't ask twice
+var queuePicks = struct {
+	sync.Mutex
+	urls map[string]string
+}{urls: make(map[string]string)}
+
+// - - - - - - - - - - - - - - - -
+//   QUEUE NAME MATCHING
+// - - - - - - - - - - - - - - - -
+
+// pickQueue resolves a queue name that doesn't exist to a close match
+// in a terminal the matches are offered as a pick list, the queues used lately first,
+// otherwise they are suggested and the run stops
+func (s *service) pickQueue(name string, err error) string {
+	queuePicks.Lock()
+	defer queuePicks.Unlock()
+	if qURL, ok := queuePicks.urls[name]; ok {
+		return qURL
+	}
+
+	// Without ListQueues permission, the original error is the one that matters
+	var urls []string
+	listErr := s.ListQueuesPages(&sqs.ListQueuesInput{MaxResults: aws.Int64(1000)}, func(page *sqs.ListQueuesOutput, lastPage bool) bool {
+		urls = append(urls, aws.StringValueSlice(page.QueueUrls)...)
+		return true
+	})
+	matches := recentFirst(closeQueues(name, urls), s.recentQueueNames())
+	if listErr != nil || len(matches) == 0 {
+		log.Fatalf("Error finding queue %s: %s\n", name, err)
+	}
+	if isPiped(os.Stdin) || isPiped(os.Stderr) {
+		names := make([]string, len(matches))
+		for i, qURL := range matches {
+			names[i] = queueNameFromURL(qURL)
+		}
+		log.Fatalf("Queue %s doesn't exist, did you mean %s?\n", name, strings.Join(names, ", "))
+	}
+
+	fmt.Fprintf(os.Stderr, "Queue %s doesn't exist, close matches:\n", name)
+	for i, qURL := range matches {
+		fmt.Fprintf(os.Stderr, "  %2d) %s\n", i+1, queueNameFromURL(qURL))
+	}
+	fmt.Fprintf(os.Stderr, "Pick a queue [1-%d]: ", len(matches))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	n, convErr := strconv.Atoi(strings.TrimSpace(answer))
+	if convErr != nil || n < 1 || n > len(matches) {
+		log.Fatal("No queue picked")
+	}
+	qURL := matches[n-1]
+	queuePicks.urls[name] = qURL
+	return qURL
+}
+
+// closeQueues returns the queues whose name is close to name, closest first:
+// names containing it or contained in it whatever the case, and names a few edits away
+func closeQueues(name string, urls []string) []string {
+	type match struct {
+		url      string
+		name     string
+		distance int
+	}
+	want := strings.ToLower(name)
+	// A typo or two, more for long names
+	maxDistance := len(want) / 4
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+	var matches []match
+	for _, qURL := range urls {
+		candidate := queueNameFromURL(qURL)
+		lower := strings.ToLower(candidate)
+		d := editDistance(want, lower)
+		if d <= maxDistance || strings.Contains(lower, want) || strings.Contains(want, lower) {
+			matches = append(matches, match{qURL, candidate, d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].name < matches[j].name
+	})
+	if len(matches) > maxQueueSuggestions {
+		matches = matches[:maxQueueSuggestions]
+	}
+	closest := make([]string, len(matches))
+	for i, m := range matches {
+		closest[i] = m.url
+	}
+	return closest
+}
+
+// recentFirst moves the queues used lately ahead of the other matches, most recent first
+func recentFirst(urls []string, recents []string) []string {
+	rank := make(map[string]int, len(recents))
+	for i, name := range recents {
+		rank[name] = i + 1
+	}
+	sorted := append([]string{}, urls...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ri, rj := rank[queueNameFromURL(sorted[i])], rank[queueNameFromURL(sorted[j])]
+		return ri > 0 && (rj == 0 || ri < rj)
+	})
+	return sorted
+}
+
+// editDistance is the Levenshtein distance of two strings, in bytes
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// min3 returns the smallest of three ints
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
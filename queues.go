@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// globChars are the characters making a queue name a pattern
+const globChars = "*?["
+
+// - - - - - - - - - - - - - - - -
+//   RESOLVING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// resolveQueues returns the URLs of the queues matching a name or a glob pattern
+// e.g. orders-*-dlq, patterns are resolved with ListQueues
+func (s *service) resolveQueues(pattern string) []string {
+	if !isGlob(pattern) {
+		return []string{s.getQueueURL(pattern)}
+	}
+
+	// Narrow the listing down to the literal prefix of the pattern
+	prefix := pattern[:strings.IndexAny(pattern, globChars)]
+	var urls []string
+	for _, qURL := range s.listQueues(prefix) {
+		if ok, err := path.Match(pattern, queueNameFromURL(qURL)); err != nil {
+			log.Fatalf("Invalid queue pattern %s: %s\n", pattern, err)
+		} else if ok {
+			urls = append(urls, qURL)
+		}
+	}
+	if len(urls) == 0 {
+		log.Fatalf("No queue matches %s\n", pattern)
+	}
+	return urls
+}
+
+// listQueues returns the URLs of all queues starting with prefix, sorted
+func (s *service) listQueues(prefix string) []string {
+	input := &sqs.ListQueuesInput{MaxResults: aws.Int64(1000)}
+	if len(prefix) > 0 {
+		input.QueueNamePrefix = aws.String(prefix)
+	}
+
+	var urls []string
+	err := s.ListQueuesPages(input, func(page *sqs.ListQueuesOutput, lastPage bool) bool {
+		urls = append(urls, aws.StringValueSlice(page.QueueUrls)...)
+		return true
+	})
+	if err != nil {
+		log.Fatal("Error listing queues ", err)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// isGlob is true if a queue name contains wildcards
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, globChars)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// readOnlyVisibility hides the messages a read-only export holds instead of re-adding them,
+// they are released once the queue is exported
+const readOnlyVisibility = 1800
+
+// readOnly blocks the calls changing queues or their messages, set by -read-only
+var readOnly bool
+
+// mutatingOperations are the SQS calls -read-only blocks
+// receives and visibility changes hide messages for a while but never lose them, they stay allowed
+var mutatingOperations = map[string]bool{
+	"SendMessage":           true,
+	"SendMessageBatch":      true,
+	"DeleteMessage":         true,
+	"DeleteMessageBatch":    true,
+	"PurgeQueue":            true,
+	"CreateQueue":           true,
+	"DeleteQueue":           true,
+	"SetQueueAttributes":    true,
+	"TagQueue":              true,
+	"UntagQueue":            true,
+	"AddPermission":         true,
+	"RemovePermission":      true,
+	"StartMessageMoveTask":  true,
+	"CancelMessageMoveTask": true,
+}
+
+// - - - - - - - - - - - - - - - -
+//   READ-ONLY MODE
+// - - - - - - - - - - - - - - - -
+
+// blockMutations stops the command on the first mutating SQS call of a client created from the session,
+// before it is sent, whatever the command and its flags
+// messages received so far come back once their visibility timeout expires
+func blockMutations(sess *session.Session) {
+	sess.Handlers.Validate.PushBack(func(r *request.Request) {
+		if r.ClientInfo.ServiceName != sqs.ServiceName || !mutatingOperations[r.Operation.Name] {
+			return
+		}
+		log.Fatalf("%s is blocked by -read-only\n", r.Operation.Name)
+	})
+}
+
+// - - - - - - - - - - - - - - - -
+//   PIPELINE STAGES
+// - - - - - - - - - - - - - - - -
+
+// holdStage keeps the exported batches hidden instead of re-adding and deleting them,
+// so the receives don't hand them out again, and returns their receipt handles to release
+// exports taking longer than readOnlyVisibility may write messages twice
+func (s *service) holdStage(queue string, in <-chan []*sqs.Message) []string {
+	var handles []string
+	for batch := range in {
+		held := receipts(batch)
+		for _, err := range s.changeVisibilityBatch(queue, held, readOnlyVisibility) {
+			log.Println("Error holding messages", err)
+		}
+		handles = append(handles, held...)
+	}
+	return handles
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// receiptMargin is kept before a visibility deadline, so a delete sent just before lands in time
+	receiptMargin = 2 * time.Second
+	// maxRecoveryReceives bounds the receives looking for messages whose receipt handle expired
+	maxRecoveryReceives = 10
+)
+
+// deadlines holds when each receipt handle stops hiding its message
+// SQS accepts deletes with a handle whose message was received again since, without deleting it
+var deadlines sync.Map // Receipt handle -> time.Time
+
+// undeleted lists the messages that could not be safely deleted, for the report
+var undeleted struct {
+	sync.Mutex
+	ids []string
+}
+
+// - - - - - - - - - - - - - - - -
+//   RECEIPT HANDLES
+// - - - - - - - - - - - - - - - -
+
+// trackReceipt records the deadline of a receipt handle hidden for visibility seconds from since
+// a visibility of 0 releases the message, the handle is forgotten
+func trackReceipt(handle string, since time.Time, visibility int64) {
+	if visibility <= 0 {
+		deadlines.Delete(handle)
+		return
+	}
+	deadlines.Store(handle, since.Add(time.Duration(visibility)*time.Second))
+}
+
+// isExpired is true if the receipt handle of a message may no longer hide it
+// messages received elsewhere, or before tracking, are assumed alive
+func isExpired(m *sqs.Message) bool {
+	deadline, ok := deadlines.Load(aws.StringValue(m.ReceiptHandle))
+	return ok && time.Now().Add(receiptMargin).After(deadline.(time.Time))
+}
+
+// deleteBatch deletes messages by batches of 10 with their receipt handles
+// returns the number deleted and the messages SQS refused
+func (s *service) deleteBatch(queue string, messages []*sqs.Message) (int, []*sqs.Message) {
+	deleted := 0
+	var failed []*sqs.Message
+	for i := 0; i < len(messages); i += 10 {
+		j := i + 10
+		if j > len(messages) {
+			j = len(messages)
+		}
+		byID := make(map[string]*sqs.Message, j-i)
+		var entries []*sqs.DeleteMessageBatchRequestEntry
+		for _, m := range messages[i:j] {
+			id := nextEntryID()
+			byID[*id] = m
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{Id: id, ReceiptHandle: m.ReceiptHandle})
+		}
+		result, err := s.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			Entries:  entries,
+			QueueUrl: aws.String(queue),
+		})
+		// An error just means the messages were not deleted, they will be received again
+		if err != nil {
+			log.Println("Delete Error", err)
+			continue
+		}
+		for _, m := range messages[i:j] {
+			deadlines.Delete(aws.StringValue(m.ReceiptHandle))
+		}
+		deleted += len(result.Successful)
+		for _, f := range result.Failed {
+			failed = append(failed, byID[aws.StringValue(f.Id)])
+			recordFailedEntry("delete", queue, aws.StringValue(f.Id), byID[aws.StringValue(f.Id)], aws.StringValue(f.Code), aws.StringValue(f.Message))
+		}
+	}
+	return deleted, failed
+}
+
+// deleteExpired receives again the messages whose receipt handle expired, matched by
+// message ID, and deletes them with their new receipt handle
+// other messages received meanwhile are released, messages not found are reported:
+// another consumer may hold them, or they are gone
+func (s *service) deleteExpired(queue string, messages []*sqs.Message) int {
+	wanted := make(map[string]bool, len(messages))
+	for _, m := range messages {
+		wanted[aws.StringValue(m.MessageId)] = true
+	}
+	log.Printf("%d receipt handles expired, receiving the messages again to delete them\n", len(messages))
+
+	deleted := 0
+	var others []string
+	for i := 0; i < maxRecoveryReceives && len(wanted) > 0; i++ {
+		result := s.receiveMessagesFor(queue, 10, false, pipelineVisibility)
+		if len(result.Messages) == 0 {
+			break
+		}
+		var found []*sqs.Message
+		for _, m := range result.Messages {
+			if wanted[aws.StringValue(m.MessageId)] {
+				delete(wanted, aws.StringValue(m.MessageId))
+				found = append(found, m)
+			} else {
+				others = append(others, aws.StringValue(m.ReceiptHandle))
+			}
+		}
+		n, failed := s.deleteBatch(queue, found)
+		deleted += n
+		for _, m := range failed {
+			wanted[aws.StringValue(m.MessageId)] = true
+		}
+	}
+	s.changeVisibilityBatch(queue, others, 0)
+
+	undeleted.Lock()
+	defer undeleted.Unlock()
+	for id := range wanted {
+		log.Printf("Warning: message %s could not be safely deleted, its receipt handle expired\n", id)
+		undeleted.ids = append(undeleted.ids, id)
+	}
+	return deleted
+}
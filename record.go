@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// recordDir captures every AWS API call of the run, set by -record
+var recordDir string
+
+// replayDir serves the AWS API calls captured by -record instead of calling AWS, set by -replay
+var replayDir string
+
+// uuids are the IDs generated during a recording, handed out again on replay
+// so run markers and resent batches match the recorded responses
+var uuids struct {
+	sync.Mutex
+	file   *os.File
+	replay []string
+}
+
+// recordedHeaders are the response headers kept in a recording
+var recordedHeaders = []string{"Content-Type", "X-Amzn-Requestid", "X-Amzn-Query-Error"}
+
+// interaction is a captured API call, one JSON file per call
+type interaction struct {
+	Action   string            `json:"action"`
+	Request  string            `json:"request"`
+	Status   int               `json:"status"`
+	Header   map[string]string `json:"header,omitempty"`
+	Response string            `json:"response"`
+}
+
+// recorder is an http.RoundTripper saving the calls it forwards
+type recorder struct {
+	mu   sync.Mutex
+	dir  string
+	seq  int
+	next http.RoundTripper
+}
+
+// replayer is an http.RoundTripper answering from a recording
+// calls are matched by action, in the recorded order, so concurrent
+// stages interleaving differently than during the recording still replay
+type replayer struct {
+	mu    sync.Mutex
+	calls map[string][]interaction
+}
+
+// - - - - - - - - - - - - - - - -
+//   RECORDING
+// - - - - - - - - - - - - - - - -
+
+// recordSession captures the calls of every client created from the session
+func recordSession(sess *session.Session, dir string) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatal("Error creating record directory ", err)
+	}
+	next := http.DefaultTransport
+	if sess.Config.HTTPClient != nil && sess.Config.HTTPClient.Transport != nil {
+		next = sess.Config.HTTPClient.Transport
+	}
+	sess.Config.HTTPClient = &http.Client{Transport: &recorder{dir: dir, next: next}}
+
+	f, err := os.OpenFile(filepath.Join(dir, "uuids.txt"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatal("Error creating record directory ", err)
+	}
+	uuids.Lock()
+	uuids.file = f
+	uuids.Unlock()
+}
+
+// recordUUID saves a generated ID when recording
+func recordUUID(id string) {
+	uuids.Lock()
+	defer uuids.Unlock()
+	if uuids.file != nil {
+		fmt.Fprintln(uuids.file, id)
+	}
+}
+
+// replayedUUID returns the next recorded ID when replaying
+func replayedUUID() (string, bool) {
+	uuids.Lock()
+	defer uuids.Unlock()
+	if len(uuids.replay) == 0 {
+		return "", false
+	}
+	id := uuids.replay[0]
+	uuids.replay = uuids.replay[1:]
+	return id, true
+}
+
+// RoundTrip implements http.RoundTripper
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	call := interaction{
+		Action:   apiAction(req, body),
+		Request:  string(body),
+		Status:   resp.StatusCode,
+		Header:   make(map[string]string),
+		Response: string(respBody),
+	}
+	for _, h := range recordedHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			call.Header[h] = v
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	b, _ := json.MarshalIndent(call, "", "  ")
+	file := filepath.Join(r.dir, fmt.Sprintf("%06d-%s.json", r.seq, call.Action))
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		log.Fatal("Error recording call ", err)
+	}
+	return resp, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   REPLAYING
+// - - - - - - - - - - - - - - - -
+
+// newReplaySession returns a session answered by a recording, without network
+func newReplaySession(dir string) *session.Session {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		log.Fatalf("No recorded calls in %s\n", dir)
+	}
+	sort.Strings(files)
+
+	r := &replayer{calls: make(map[string][]interaction)}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal("Error reading recording ", err)
+		}
+		var call interaction
+		if err := json.Unmarshal(b, &call); err != nil {
+			log.Fatalf("Error reading recording %s: %s\n", file, err)
+		}
+		r.calls[call.Action] = append(r.calls[call.Action], call)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "uuids.txt")); err == nil {
+		uuids.replay = strings.Fields(string(b))
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("sqscli", "replay", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		log.Fatal("Error replaying ", err)
+	}
+	// Set afterwards, the session refuses custom transports with a CA bundle
+	sess.Config.HTTPClient = &http.Client{Transport: r}
+	return sess
+}
+
+// RoundTrip implements http.RoundTripper
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	action := apiAction(req, body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := r.calls[action]
+	if len(calls) == 0 {
+		return nil, fmt.Errorf("replay: no recorded %s call left", action)
+	}
+	call := calls[0]
+	r.calls[action] = calls[1:]
+
+	resp := &http.Response{
+		Status:        http.StatusText(call.Status),
+		StatusCode:    call.Status,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(call.Response)),
+		ContentLength: int64(len(call.Response)),
+		Request:       req,
+	}
+	for h, v := range call.Header {
+		resp.Header.Set(h, v)
+	}
+	return resp, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   HELPERS
+// - - - - - - - - - - - - - - - -
+
+// readRequestBody reads the body of a request and puts it back
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// apiAction returns the API action of a request, for both the JSON and query protocols
+func apiAction(req *http.Request, body []byte) string {
+	if target := req.Header.Get("X-Amz-Target"); target != "" {
+		return target[strings.LastIndex(target, ".")+1:]
+	}
+	if form, err := url.ParseQuery(string(body)); err == nil && form.Get("Action") != "" {
+		return form.Get("Action")
+	}
+	return "Unknown"
+}
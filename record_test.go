@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// TestRecordReplay records a move against the emulator and replays it without the emulator:
+// the replayed run sends the same messages, FIFO deduplication IDs included
+func TestRecordReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		messages int
+	}{
+		{"standard", "src", "dst", 15},
+		{"fifo", "src.fifo", "dst.fifo", 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			bodies := make([]string, tt.messages)
+			for i := range bodies {
+				bodies[i] = fmt.Sprintf(`{"n":%d}`, i)
+			}
+			// run creates the queues, sends the messages and moves them, it returns what the to queue holds
+			// Entry IDs start over, like in the process of a replay
+			run := func(s *service) (int, []string) {
+				atomic.StoreInt64(&entrySeq, 0)
+				from, to := newTestQueue(t, s, tt.from, nil), newTestQueue(t, s, tt.to, nil)
+				sendTestMessages(t, from, bodies...)
+				acks := newAcks(from.fifo)
+				sent, errs := s.resendStage(from, to, pipelineOptions{acks: acks}, s.receiveStage(from, nil, nil, acks, 1))
+				if len(errs) > 0 {
+					t.Fatalf("errors: %v", errs)
+				}
+				return sent, bodiesOf(drainTestQueue(t, to), from.fifo)
+			}
+
+			localMode = true
+			sess := newLocalSession("")
+			recordSession(sess, dir)
+			wantSent, wantBodies := run(&service{SQS: sqs.New(sess), sess: sess})
+			uuids.Lock()
+			uuids.file.Close()
+			uuids.file = nil
+			uuids.Unlock()
+			if files, _ := filepath.Glob(filepath.Join(dir, "*-SendMessageBatch.json")); len(files) == 0 {
+				t.Fatal("no SendMessageBatch recorded")
+			}
+
+			localMode = false
+			replay := newReplaySession(dir)
+			sent, gotBodies := run(&service{SQS: sqs.New(replay), sess: replay})
+			if sent != wantSent {
+				t.Errorf("replay sent %d messages, the recording %d", sent, wantSent)
+			}
+			if fmt.Sprint(gotBodies) != fmt.Sprint(wantBodies) {
+				t.Errorf("replay moved %v, the recording %v", gotBodies, wantBodies)
+			}
+			if len(uuids.replay) > 0 {
+				t.Errorf("%d recorded IDs not replayed", len(uuids.replay))
+			}
+		})
+	}
+}
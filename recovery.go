@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// recoveryFile receives the messages that could be neither re-added nor left in their queue, set by -recovery-file
+var recoveryFile string
+
+// recoveryMu serializes the writes to the recovery file
+var recoveryMu sync.Mutex
+
+// recoveryRecord is a line of a recovery file: a received message, all its attributes,
+// and the queue it failed to be sent to
+type recoveryRecord struct {
+	Queue   string    `json:"queue"` // URL
+	Error   string    `json:"error,omitempty"`
+	SavedAt time.Time `json:"savedAt"`
+	peekedMessage
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// recoverMessages sends the messages of a recovery file again, to the queue each failed to reach
+// or to -queue, and rewrites the file with those failing again, removing it once empty
+func recoverMessages(args []string) {
+	recoverCommand := flag.NewFlagSet("recover", flag.ExitOnError)
+	queueName := recoverCommand.String("queue", "", "queue the messages are sent to, the one they failed to reach by default")
+	recoverCommand.StringVar(queueName, "q", "", "queue the messages are sent to") // Aliasing
+	recoverHelp := recoverCommand.Bool("help", false, "help for recover command")
+	recoverCommand.BoolVar(recoverHelp, "h", false, "help") // Aliasing
+	parseFlags(recoverCommand, args)
+
+	if *recoverHelp {
+		recoverUsage()
+	}
+
+	// Verify
+	if recoverCommand.NArg() != 1 {
+		fmt.Println("Required recovery file is missing.")
+		recoverUsage()
+	}
+	file := recoverCommand.Arg(0)
+	records, err := readRecovery(file)
+	if err != nil {
+		log.Fatal("Error reading recovery file ", err)
+	}
+	if len(records) == 0 {
+		fmt.Fprintf(os.Stderr, "No message to recover in %s\n", file)
+		return
+	}
+
+	// Connect
+	svc := newService()
+	to := ""
+	if len(*queueName) > 0 {
+		to = svc.resolveQueue(*queueName).url
+	}
+
+	// Apply, by queue in the order of the file, FIFO groups stay in sequence
+	var order []string
+	byQueue := make(map[string][]recoveryRecord)
+	for _, r := range records {
+		queue := r.Queue
+		if len(to) > 0 {
+			queue = to
+		}
+		if _, ok := byQueue[queue]; !ok {
+			order = append(order, queue)
+		}
+		byQueue[queue] = append(byQueue[queue], r)
+	}
+	var left []recoveryRecord
+	sent := 0
+	for _, queue := range order {
+		fifo := svc.isFIFO(queue)
+		pending := byQueue[queue]
+		for i := 0; i < len(pending); i += maxBatchEntries {
+			j := i + maxBatchEntries
+			if j > len(pending) {
+				j = len(pending)
+			}
+			batch := make([]*sqs.Message, 0, j-i)
+			for _, r := range pending[i:j] {
+				batch = append(batch, r.message())
+			}
+			done, errs := svc.resendBatch(queue, batch, fifo, 0, nil, nil)
+			for _, err := range errs {
+				log.Println("Error recovering messages", err)
+			}
+			sent += len(done)
+			ok := make(map[*sqs.Message]bool, len(done))
+			for _, m := range done {
+				ok[m] = true
+			}
+			for k, m := range batch {
+				if !ok[m] {
+					r := pending[i+k]
+					if len(errs) > 0 {
+						r.Error = errs[0].Error()
+					}
+					left = append(left, r)
+				}
+			}
+		}
+	}
+
+	// Only what failed again stays in the file
+	if len(left) == 0 {
+		if err := os.Remove(file); err != nil {
+			log.Println("Error removing recovery file", err)
+		}
+		fmt.Fprintf(os.Stderr, "%d messages recovered, %s removed\n", sent, file)
+		return
+	}
+	if err := writeRecovery(file, left); err != nil {
+		log.Fatal("Error rewriting recovery file ", err)
+	}
+	fmt.Fprintf(os.Stderr, "%d messages recovered, %d left in %s\n", sent, len(left), file)
+	os.Exit(1)
+}
+
+// - - - - - - - - - - - - - - - -
+//   RECOVERY FILE
+// - - - - - - - - - - - - - - - -
+
+// defaultRecoveryFile is ~/.sqscli/recovery.jsonl, empty without a home directory
+func defaultRecoveryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sqscli", "recovery.jsonl")
+}
+
+// saveForRecovery appends messages that failed to be sent to queue to the recovery file,
+// so recover can send them later, and tells how
+func saveForRecovery(queue string, messages []*sqs.Message, cause error) error {
+	if len(recoveryFile) == 0 {
+		return fmt.Errorf("no recovery file")
+	}
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(recoveryFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(recoveryFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, m := range messages {
+		r := recoveryRecord{Queue: queue, SavedAt: time.Now().UTC(), peekedMessage: peekedMessage{
+			MessageID:         aws.StringValue(m.MessageId),
+			Body:              aws.StringValue(m.Body),
+			Attributes:        m.Attributes,
+			MessageAttributes: m.MessageAttributes,
+		}}
+		if cause != nil {
+			r.Error = cause.Error()
+		}
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	// Saved before the messages are given up on
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("Warning: %d messages saved to %s, send them again with: sqscli recover %s\n", len(messages), recoveryFile, recoveryFile)
+	return nil
+}
+
+// readRecovery reads the records of a recovery file
+func readRecovery(file string) ([]recoveryRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []recoveryRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*maxMessageSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		var r recoveryRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// writeRecovery replaces a recovery file with records
+func writeRecovery(file string, records []recoveryRecord) error {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// message returns the received message a record holds, with the system attributes a re-add carries
+func (r recoveryRecord) message() *sqs.Message {
+	return &sqs.Message{
+		MessageId:         aws.String(r.MessageID),
+		Body:              aws.String(r.Body),
+		Attributes:        r.Attributes,
+		MessageAttributes: r.MessageAttributes,
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func recoverUsage() {
+	fmt.Println("usage: sqscli recover [options] <file>")
+	fmt.Println("options:")
+	fmt.Println("  -queue            Queue the messages are sent to, the one they failed to reach by default")
+	os.Exit(0)
+}
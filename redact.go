@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// redactMask replaces redacted values
+const redactMask = "[REDACTED]"
+
+// redactPresets are the named regex rules
+var redactPresets = map[string]string{
+	"email": `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"card":  `\b(?:\d[ -]?){12,18}\d\b`,
+}
+
+// redactRule masks either a JSON field path or a regex match
+type redactRule struct {
+	path []pathStep
+	re   *regexp.Regexp
+}
+
+// pathStep is one step of a field path, a key or an array index
+// "*" matches every key or index
+type pathStep struct {
+	key   string
+	index int // -1 for [*], only used when key is empty
+	array bool
+}
+
+// redactor is the ordered list of rules applied to a body
+type redactor []redactRule
+
+// - - - - - - - - - - - - - - - -
+//   RULES
+// - - - - - - - - - - - - - - - -
+
+// parseRedactRules parses -redact values
+// each one is a preset (email, card), regex:PATTERN, field:FIELD.PATH (path: being the former name)
+// or @file holding one rule per line
+func parseRedactRules(values []string) (redactor, error) {
+	var rules redactor
+	for _, v := range values {
+		if strings.HasPrefix(v, "@") {
+			fileRules, err := readRedactRules(v[1:])
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, fileRules...)
+			continue
+		}
+		rule, err := parseRedactRule(v)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// readRedactRules reads a rules file, blank lines and # comments are skipped
+func readRedactRules(file string) (redactor, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules redactor
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRedactRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// parseRedactRule parses a single rule
+func parseRedactRule(raw string) (redactRule, error) {
+	if pattern, ok := redactPresets[raw]; ok {
+		return redactRule{re: regexp.MustCompile(pattern)}, nil
+	}
+	switch {
+	case strings.HasPrefix(raw, "regex:"):
+		re, err := regexp.Compile(raw[len("regex:"):])
+		if err != nil {
+			return redactRule{}, fmt.Errorf("redact rule %q: %s", raw, err)
+		}
+		return redactRule{re: re}, nil
+	case strings.HasPrefix(raw, "field:"), strings.HasPrefix(raw, "path:"):
+		path, err := parseFieldPath(raw[strings.Index(raw, ":")+1:])
+		if err != nil {
+			return redactRule{}, fmt.Errorf("redact rule %q: %s", raw, err)
+		}
+		return redactRule{path: path}, nil
+	}
+	return redactRule{}, fmt.Errorf("redact rule %q: expected email, card, regex:PATTERN or field:FIELD.PATH", raw)
+}
+
+// parseFieldPath parses a dotted field path, keys, * and [N] or [*] indexes only, not JMESPath
+// e.g. customer.email, items[*].card, items[0].card, *.token
+func parseFieldPath(raw string) ([]pathStep, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	var path []pathStep
+	for _, segment := range strings.Split(raw, ".") {
+		if len(segment) == 0 {
+			return nil, fmt.Errorf("empty segment in %q", raw)
+		}
+		name := segment
+		if i := strings.Index(segment, "["); i >= 0 {
+			name = segment[:i]
+		}
+		if len(name) > 0 {
+			path = append(path, pathStep{key: name})
+		}
+		rest := segment[len(name):]
+		for len(rest) > 0 {
+			end := strings.Index(rest, "]")
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("malformed segment %q", segment)
+			}
+			index := -1
+			if inner := rest[1:end]; inner != "*" {
+				n, err := strconv.Atoi(inner)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("malformed index %q", inner)
+				}
+				index = n
+			}
+			path = append(path, pathStep{index: index, array: true})
+			rest = rest[end+1:]
+		}
+	}
+	return path, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   REDACTING
+// - - - - - - - - - - - - - - - -
+
+// apply masks a body, path rules only apply to JSON bodies
+func (r redactor) apply(body string) string {
+	if len(r) == 0 {
+		return body
+	}
+
+	var doc interface{}
+	isJSON := false
+	for _, rule := range r {
+		if rule.path == nil {
+			continue
+		}
+		if !isJSON {
+			dec := json.NewDecoder(strings.NewReader(body))
+			dec.UseNumber()
+			if dec.Decode(&doc) != nil {
+				break // Not JSON, no field to mask
+			}
+			isJSON = true
+		}
+		doc = maskPath(doc, rule.path)
+	}
+	if isJSON {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if enc.Encode(doc) == nil {
+			body = strings.TrimSuffix(buf.String(), "\n")
+		}
+	}
+
+	for _, rule := range r {
+		if rule.re != nil {
+			body = rule.re.ReplaceAllString(body, redactMask)
+		}
+	}
+	return body
+}
+
+// maskPath replaces the values at path with the mask
+func maskPath(v interface{}, path []pathStep) interface{} {
+	if len(path) == 0 {
+		return redactMask
+	}
+	step := path[0]
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if step.array {
+			return v
+		}
+		for k, child := range node {
+			if step.key == "*" || step.key == k {
+				node[k] = maskPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		if !step.array && step.key != "*" {
+			return v
+		}
+		for i, child := range node {
+			if step.key == "*" || step.index < 0 || step.index == i {
+				node[i] = maskPath(child, path[1:])
+			}
+		}
+	}
+	return v
+}
+
+// lookupPath appends the values at path to values
+func lookupPath(v interface{}, path []pathStep, values []interface{}) []interface{} {
+	if len(path) == 0 {
+		return append(values, v)
+	}
+	step := path[0]
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if step.array {
+			return values
+		}
+		if step.key != "*" {
+			if child, ok := node[step.key]; ok {
+				values = lookupPath(child, path[1:], values)
+			}
+			return values
+		}
+		// Sorted so the key doesn't depend on the map order
+		keys := make([]string, 0, len(node))
+		for k := range node {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			values = lookupPath(node[k], path[1:], values)
+		}
+	case []interface{}:
+		if !step.array && step.key != "*" {
+			return values
+		}
+		for i, child := range node {
+			if step.key == "*" || step.index < 0 || step.index == i {
+				values = lookupPath(child, path[1:], values)
+			}
+		}
+	}
+	return values
+}
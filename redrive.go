@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Defaults of the redrives of the daemon
+const (
+	redriveEvery      = 5 * time.Minute
+	redriveMaxPerHour = 100
+	redriveCoolOff    = 10 * time.Minute
+	redriveMaxCoolOff = 4 * time.Hour
+	redriveBreakAt    = 0.5
+	// redriveSampleSize is how many DLQ messages are looked at for ones that bounced back
+	redriveSampleSize = 10
+	// redriveKeptOperations is how many redrives are remembered to recognize their messages bouncing back
+	redriveKeptOperations = 100
+)
+
+// daemonRedrive is a DLQ the daemon redrives back to its source queue while it holds messages,
+// at most MaxPerHour an hour, waiting CoolOff between redrives
+// messages of a redrive landing back in the DLQ double the cool-off, and open the circuit breaker
+// once they are BreakAt of the DLQ, no redrive then happens for MaxCoolOff
+type daemonRedrive struct {
+	Name         string   `yaml:"name"`
+	DLQ          string   `yaml:"dlq"`
+	Source       string   `yaml:"source"`       // Queue redriven to, the one with the DLQ in its redrive policy by default
+	Every        string   `yaml:"every"`        // How often the DLQ is checked (default 5m)
+	MinDepth     int      `yaml:"minDepth"`     // Messages the DLQ holds before a redrive (default 1)
+	MaxPerHour   int      `yaml:"maxPerHour"`   // Messages redriven in any hour (default 100)
+	CoolOff      string   `yaml:"coolOff"`      // Wait after a redrive, doubled while messages bounce back (default 10m)
+	MaxCoolOff   string   `yaml:"maxCoolOff"`   // Longest cool-off, and how long the breaker stays open (default 4h)
+	BreakAt      float64  `yaml:"breakAt"`      // Share of the DLQ messages bounced back opening the breaker (default 0.5)
+	MaxBounces   int      `yaml:"maxBounces"`   // Redrives of a message before it goes to OnBounce instead, see qtoq -max-bounces
+	OnBounce     string   `yaml:"onBounce"`     // drop, park:QUEUE or export:FILE
+	BounceWindow string   `yaml:"bounceWindow"` // How long the redrives of a message are remembered (default 24h)
+	Args         []string `yaml:"args"`         // Other qtoq options, like -filter
+	Alert        string   `yaml:"alert"`        // Sink notified of the redrives and the breaker, see parseAlertSink
+	every        time.Duration
+	coolOff      time.Duration
+	maxCoolOff   time.Duration
+	bounceWindow time.Duration
+}
+
+// redriveWatch is the state of a redrive of the daemon
+type redriveWatch struct {
+	daemonRedrive
+	svc          *service
+	dlqURL       string
+	sourceURL    string
+	moved        []redriveBatch // Redrives of the last hour
+	operations   []string       // Operation IDs of the redrives, stamped on the messages moved
+	wait         time.Duration  // Current cool-off
+	coolUntil    time.Time
+	breakerUntil time.Time // Zero while the breaker is closed
+	redriving    bool      // The redrive alert is firing, resolved once the DLQ is empty
+}
+
+// redriveBatch is a number of messages redriven at a time
+type redriveBatch struct {
+	at    time.Time
+	count int64
+}
+
+// redriveAlert is the JSON details of a redrive alert
+type redriveAlert struct {
+	Redrive   string `json:"redrive"`
+	DLQ       string `json:"dlq"`
+	Source    string `json:"source"`
+	Action    string `json:"action"` // redrive, bounced, breaker-open, breaker-closed or empty
+	Moved     int64  `json:"moved,omitempty"`
+	Depth     int    `json:"depth"`
+	Bounced   int    `json:"bounced,omitempty"`  // Messages of the DLQ sample that bounced back
+	Diverted  int64  `json:"diverted,omitempty"` // Messages bounced back maxBounces times, sent to onBounce
+	Sampled   int    `json:"sampled,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	CoolOff   string `json:"coolOff,omitempty"`
+	Time      string `json:"time"`
+}
+
+// - - - - - - - - - - - - - - - -
+//   REDRIVES
+// - - - - - - - - - - - - - - - -
+
+// check checks a redrive of a daemon config, setting its defaults
+func (r *daemonRedrive) check() error {
+	if len(r.DLQ) == 0 {
+		return fmt.Errorf("needs a dlq")
+	}
+	durations := []struct {
+		raw   string
+		value *time.Duration
+		def   time.Duration
+	}{
+		{r.Every, &r.every, redriveEvery},
+		{r.CoolOff, &r.coolOff, redriveCoolOff},
+		{r.MaxCoolOff, &r.maxCoolOff, redriveMaxCoolOff},
+		{r.BounceWindow, &r.bounceWindow, defaultBounceWindow},
+	}
+	for _, d := range durations {
+		*d.value = d.def
+		if len(d.raw) == 0 {
+			continue
+		}
+		v, err := time.ParseDuration(d.raw)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid duration %q", d.raw)
+		}
+		*d.value = v
+	}
+	if r.coolOff > r.maxCoolOff {
+		return fmt.Errorf("coolOff %s is longer than maxCoolOff %s", r.coolOff, r.maxCoolOff)
+	}
+	if r.MinDepth <= 0 {
+		r.MinDepth = 1
+	}
+	if r.MaxPerHour <= 0 {
+		r.MaxPerHour = redriveMaxPerHour
+	}
+	if r.BreakAt == 0 {
+		r.BreakAt = redriveBreakAt
+	}
+	if r.BreakAt < 0 || r.BreakAt > 1 {
+		return fmt.Errorf("breakAt %g is not a share between 0 and 1", r.BreakAt)
+	}
+	if (r.MaxBounces > 0) != (len(r.OnBounce) > 0) {
+		return fmt.Errorf("maxBounces and onBounce go together")
+	}
+	if len(r.Alert) > 0 {
+		if _, err := parseAlertSink(r.Alert, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchRedrive checks a DLQ every r.every and redrives it until the daemon stops
+func (s *scheduler) watchRedrive(r daemonRedrive, svc *service) {
+	defer s.wg.Done()
+	w := &redriveWatch{daemonRedrive: r, svc: svc, wait: r.coolOff}
+	for {
+		s.setNextRun(r.Name, time.Now().Add(r.every))
+		if !sleepUnlessInterrupted(r.every) {
+			return
+		}
+		s.checkRedrive(w)
+	}
+}
+
+// checkRedrive redrives the DLQ if it holds messages, unless cooling off, over the hourly limit,
+// or with its breaker open
+func (s *scheduler) checkRedrive(w *redriveWatch) {
+	if err := w.resolve(); err != nil {
+		log.Printf("[%s] %s\n", w.Name, err)
+		return
+	}
+	depth, err := w.depth()
+	if err != nil {
+		log.Printf("[%s] Error reading the depth of %s: %s\n", w.Name, w.DLQ, err)
+		return
+	}
+	now := time.Now()
+	if depth == 0 && w.redriving {
+		w.redriving = false
+		s.redriveAlert(w, alert{key: "sqscli/redrive/" + w.Name, resolved: true,
+			summary: fmt.Sprintf("Redriving %s to %s", w.DLQ, w.Source),
+			details: w.details("empty", depth)})
+	}
+	if now.Before(w.coolUntil) || now.Before(w.breakerUntil) {
+		return
+	}
+
+	// Did the last redrive bounce back?
+	if len(w.operations) > 0 && depth > 0 {
+		bounced, sampled, err := w.bounced()
+		if err != nil {
+			log.Printf("[%s] Error sampling %s: %s\n", w.Name, w.DLQ, err)
+			return
+		}
+		details := w.details("", depth)
+		details.Bounced, details.Sampled = bounced, sampled
+		switch {
+		case sampled > 0 && float64(bounced)/float64(sampled) >= w.BreakAt:
+			w.breakerUntil = now.Add(w.maxCoolOff)
+			w.wait = w.maxCoolOff
+			details.Action, details.CoolOff = "breaker-open", w.maxCoolOff.String()
+			log.Printf("[%s] %d of %d messages sampled bounced back to %s, breaker open for %s\n", w.Name, bounced, sampled, w.DLQ, w.maxCoolOff)
+			s.redriveAlert(w, alert{key: "sqscli/redrive/" + w.Name + "/breaker",
+				summary: fmt.Sprintf("Redrive of %s stopped: %d of %d messages sampled bounced back from %s", w.DLQ, bounced, sampled, w.Source),
+				details: details})
+			return
+		case bounced > 0:
+			if w.wait *= 2; w.wait > w.maxCoolOff {
+				w.wait = w.maxCoolOff
+			}
+			log.Printf("[%s] %d of %d messages sampled bounced back to %s, cool-off now %s\n", w.Name, bounced, sampled, w.DLQ, w.wait)
+		default:
+			w.wait = w.coolOff
+		}
+		// A half-open breaker closes once the redrive doesn't bounce back
+		if !w.breakerUntil.IsZero() && bounced == 0 {
+			w.breakerUntil = time.Time{}
+			details.Action = "breaker-closed"
+			s.redriveAlert(w, alert{key: "sqscli/redrive/" + w.Name + "/breaker", resolved: true,
+				summary: fmt.Sprintf("Redrive of %s stopped: messages bounced back from %s", w.DLQ, w.Source),
+				details: details})
+		}
+	}
+	if depth < w.MinDepth {
+		return
+	}
+
+	// Within the hourly limit
+	var moved int64
+	kept := w.moved[:0]
+	for _, b := range w.moved {
+		if now.Sub(b.at) < time.Hour {
+			kept = append(kept, b)
+			moved += b.count
+		}
+	}
+	w.moved = kept
+	budget := int64(w.MaxPerHour) - moved
+	if budget <= 0 {
+		log.Printf("[%s] %d messages in %s, %d redriven in the last hour already\n", w.Name, depth, w.DLQ, moved)
+		return
+	}
+	if budget > int64(depth) {
+		budget = int64(depth)
+	}
+
+	report, err := ioutil.TempFile("", "sqscli-redrive-")
+	if err != nil {
+		log.Printf("[%s] Error creating the report: %s\n", w.Name, err)
+		return
+	}
+	report.Close()
+	defer os.Remove(report.Name())
+	command := append([]string{"qtoq", "-queue1", w.DLQ, "-queue2", w.Source, "-sample", strconv.FormatInt(budget, 10),
+		"-provenance", "-report", report.Name()}, w.Args...)
+	if w.MaxBounces > 0 {
+		state := w.bounceState()
+		os.MkdirAll(filepath.Dir(state), 0700)
+		command = append(command, "-max-bounces", strconv.Itoa(w.MaxBounces), "-bounce-state", state,
+			"-bounce-window", w.bounceWindow.String(), "-on-bounce", w.OnBounce)
+	}
+	s.run(daemonJob{Name: w.Name, Command: command, Alert: w.Alert})
+
+	rep := &runReport{}
+	if b, err := ioutil.ReadFile(report.Name()); err != nil || json.Unmarshal(b, rep) != nil {
+		return
+	}
+	w.coolUntil = time.Now().Add(w.wait)
+	if len(rep.Operation) > 0 {
+		if w.operations = append(w.operations, rep.Operation); len(w.operations) > redriveKeptOperations {
+			w.operations = w.operations[1:]
+		}
+	}
+	if rep.Bounced > 0 {
+		details := w.details("bounced", depth)
+		details.Diverted, details.Operation = rep.Bounced, rep.Operation
+		s.redriveAlert(w, alert{key: "sqscli/redrive/" + w.Name + "/bounced",
+			summary: fmt.Sprintf("%d messages of %s redriven %d times bounced back again: %s", rep.Bounced, w.DLQ, w.MaxBounces, w.OnBounce),
+			details: details})
+	}
+	if rep.Sent == 0 {
+		return
+	}
+	w.moved = append(w.moved, redriveBatch{at: now, count: rep.Sent})
+	w.redriving = true
+	details := w.details("redrive", depth-int(rep.Sent))
+	details.Moved, details.Operation, details.CoolOff = rep.Sent, rep.Operation, w.wait.String()
+	log.Printf("[%s] Redrove %d messages of %s to %s, next redrive in %s at the earliest\n", w.Name, rep.Sent, w.DLQ, w.Source, w.wait)
+	s.redriveAlert(w, alert{key: "sqscli/redrive/" + w.Name,
+		summary: fmt.Sprintf("Redriving %s to %s: %d messages moved, %d left", w.DLQ, w.Source, rep.Sent, details.Depth),
+		details: details})
+}
+
+// resolve finds the URLs of the DLQ and of its source queue, the queue with the DLQ in its redrive policy by default
+// errors are retried at the next check
+func (w *redriveWatch) resolve() error {
+	if len(w.sourceURL) > 0 {
+		return nil
+	}
+	dlq, err := lookupBookmark(w.DLQ)
+	if err != nil {
+		return err
+	}
+	out, err := w.svc.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(dlq)})
+	if err != nil {
+		return fmt.Errorf("error finding queue %s: %s", dlq, err)
+	}
+	w.dlqURL, w.DLQ = aws.StringValue(out.QueueUrl), queueNameFromURL(aws.StringValue(out.QueueUrl))
+	if len(w.Source) > 0 {
+		source, err := lookupBookmark(w.Source)
+		if err != nil {
+			return err
+		}
+		out, err := w.svc.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(source)})
+		if err != nil {
+			return fmt.Errorf("error finding queue %s: %s", source, err)
+		}
+		w.sourceURL, w.Source = aws.StringValue(out.QueueUrl), queueNameFromURL(aws.StringValue(out.QueueUrl))
+		return nil
+	}
+
+	attrs, err := w.svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(w.dlqURL), AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameQueueArn}),
+	})
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", w.DLQ, err)
+	}
+	dlqARN := aws.StringValue(attrs.Attributes[sqs.QueueAttributeNameQueueArn])
+	var sources []string
+	err = w.svc.ListQueuesPages(&sqs.ListQueuesInput{MaxResults: aws.Int64(1000)}, func(page *sqs.ListQueuesOutput, lastPage bool) bool {
+		for _, qURL := range aws.StringValueSlice(page.QueueUrls) {
+			a, err := w.svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+				QueueUrl: aws.String(qURL), AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameRedrivePolicy}),
+			})
+			if err != nil {
+				continue
+			}
+			if p, ok := parseRedrivePolicy(a.Attributes); ok && p.DeadLetterTargetArn == dlqARN {
+				sources = append(sources, qURL)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("error listing the queues redriving to %s: %s", w.DLQ, err)
+	}
+	if len(sources) != 1 {
+		names := make([]string, len(sources))
+		for i, qURL := range sources {
+			names[i] = queueNameFromURL(qURL)
+		}
+		return fmt.Errorf("%s is the dead-letter queue of %d queues %v, set source", w.DLQ, len(sources), names)
+	}
+	w.sourceURL, w.Source = sources[0], queueNameFromURL(sources[0])
+	log.Printf("[%s] Redriving %s to %s\n", w.Name, w.DLQ, w.Source)
+	return nil
+}
+
+// bounceState is the file recording the messages redriven, ~/.sqscli/redrive-NAME.bounces
+func (w *redriveWatch) bounceState() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "redrive-" + w.Name + ".bounces"
+	}
+	return filepath.Join(home, ".sqscli", "redrive-"+w.Name+".bounces")
+}
+
+// depth returns the messages available in the DLQ
+func (w *redriveWatch) depth() (int, error) {
+	out, err := w.svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(w.dlqURL), AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameApproximateNumberOfMessages}),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return intAttribute(out.Attributes, sqs.QueueAttributeNameApproximateNumberOfMessages), nil
+}
+
+// bounced samples the DLQ, counting the messages of the earlier redrives that came back
+// the messages sampled stay visible
+func (w *redriveWatch) bounced() (int, int, error) {
+	out, err := w.svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(w.dlqURL),
+		MaxNumberOfMessages:   aws.Int64(redriveSampleSize),
+		VisibilityTimeout:     aws.Int64(0),
+		MessageAttributeNames: aws.StringSlice([]string{provenanceOperationAttribute}),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	ours := make(map[string]bool, len(w.operations))
+	for _, id := range w.operations {
+		ours[id] = true
+	}
+	bounced := 0
+	for _, m := range out.Messages {
+		if a, ok := m.MessageAttributes[provenanceOperationAttribute]; ok && ours[aws.StringValue(a.StringValue)] {
+			bounced++
+		}
+	}
+	return bounced, len(out.Messages), nil
+}
+
+// details returns the alert details of an action of the redrive
+func (w *redriveWatch) details(action string, depth int) redriveAlert {
+	return redriveAlert{Redrive: w.Name, DLQ: w.DLQ, Source: w.Source, Action: action, Depth: depth, Time: time.Now().UTC().Format(time.RFC3339)}
+}
+
+// redriveAlert notifies the sink of a redrive, if it has one
+func (s *scheduler) redriveAlert(w *redriveWatch, a alert) {
+	if len(w.Alert) == 0 {
+		return
+	}
+	s.alert(daemonJob{Name: w.Name, Alert: w.Alert}, a)
+}
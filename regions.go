@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultRegion is used when neither -region, SQSCLI_REGION, AWS_REGION nor the settings set one
+const defaultRegion = "us-west-2"
+
+// awsRegion is the region of the queues, set by -region
+var awsRegion string
+
+// - - - - - - - - - - - - - - - -
+//   REGIONS
+// - - - - - - - - - - - - - - - -
+
+// parseRegions splits -regions, a comma separated list of regions
+func parseRegions(raw string) ([]string, error) {
+	var regions []string
+	for _, r := range strings.Split(raw, ",") {
+		r = strings.TrimSpace(r)
+		if len(r) == 0 {
+			continue
+		}
+		if containsString(regions, r) {
+			return nil, fmt.Errorf("region %s is listed twice", r)
+		}
+		regions = append(regions, r)
+	}
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("no region in %q", raw)
+	}
+	return regions, nil
+}
+
+// regionServices connects to each region of -regions, or to the -region one when empty
+// services of -regions carry their region, so their queues are labelled with it
+func regionServices(raw string) []*service {
+	if len(raw) == 0 {
+		return []*service{newService()}
+	}
+	regions, err := parseRegions(raw)
+	if err != nil {
+		fmt.Println("Invalid -regions:", err)
+		os.Exit(1)
+	}
+	services := make([]*service, 0, len(regions))
+	for _, r := range regions {
+		// Services are shared, the label is only for this command
+		svc := *newRegionService(r)
+		svc.region = r
+		services = append(services, &svc)
+	}
+	return services
+}
+
+// queueLabel names a queue in the output, prefixed by its region when several are listed
+func (s *service) queueLabel(qURL string) string {
+	if len(s.region) == 0 {
+		return queueNameFromURL(qURL)
+	}
+	return s.region + "/" + queueNameFromURL(qURL)
+}
+
+// regionalTable adds a REGION column in front of a table of -regions services
+func regionalTable(t *table, services []*service) *table {
+	if len(services[0].region) > 0 {
+		t.columns = append([]column{{key: "region", title: "REGION"}}, t.columns...)
+	}
+	return t
+}
+
+// addIn adds a row of a queue of s, led by the region on tables of -regions services
+func (t *table) addIn(s *service, values ...interface{}) {
+	if len(s.region) > 0 {
+		values = append([]interface{}{s.region}, values...)
+	}
+	t.add(values...)
+}
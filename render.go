@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// ANSI colors of the human output
+const (
+	colorReset  = "\033[0m"
+	colorBold   = "\033[1m"
+	colorDim    = "\033[2m"
+	colorKey    = "\033[36m" // Cyan
+	colorString = "\033[32m" // Green
+	colorNumber = "\033[33m" // Yellow
+	colorLit    = "\033[35m" // Magenta, true false null
+)
+
+// noColor is set by -no-color, NO_COLOR also turns colors off
+var noColor bool
+
+// - - - - - - - - - - - - - - - -
+//   RENDERING
+// - - - - - - - - - - - - - - - -
+
+// colorOutput is true when the output is a terminal and colors are not turned off
+func colorOutput() bool {
+	return !noColor && len(os.Getenv("NO_COLOR")) == 0 && !isPiped(os.Stdout)
+}
+
+// paint wraps text in a color when colors are on
+func paint(color, text string) string {
+	if !colorOutput() {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// humanSeconds formats a number of seconds in the largest unit dividing it, like 4d or 90s
+func humanSeconds(v interface{}) string {
+	n, ok := v.(int)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	for _, u := range []struct {
+		seconds int
+		unit    string
+	}{{86400, "d"}, {3600, "h"}, {60, "m"}} {
+		if n > 0 && n%u.seconds == 0 {
+			return fmt.Sprintf("%d%s", n/u.seconds, u.unit)
+		}
+	}
+	return fmt.Sprintf("%ds", n)
+}
+
+// humanSize formats a number of bytes, like 256 KiB
+func humanSize(v interface{}) string {
+	n, ok := v.(int)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	size, units := float64(n), []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for ; size >= 1024 && i < len(units)-1; i++ {
+		size /= 1024
+	}
+	if size == float64(int(size)) {
+		return fmt.Sprintf("%d %s", int(size), units[i])
+	}
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+// humanDuration formats a number of seconds roughly, like 3h20m,
+// never when negative and unknown when missing
+func humanDuration(v interface{}) string {
+	n, ok := v.(int)
+	switch {
+	case !ok:
+		return "unknown"
+	case n < 0:
+		return "never"
+	}
+	d := time.Duration(n) * time.Second
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", n)
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// humanAgo formats how long ago a time was, like 3h ago
+func humanAgo(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Second:
+		return "just now"
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// tally counts what a bulk run did, updated by the pipeline stages
+var tally struct {
+	received   int64 // Received, run copies excluded
+	written    int64 // Written to the export
+	sent       int64 // Sent to the destination
+	deleted    int64 // Deleted from the source
+	failed     int64 // Not sent, released to the source
+	retried    int64 // API calls retried by the SDK
+	duplicates int64 // Copies of the run received again and skipped
+	bounced    int64 // Redriven too many times, diverted by -max-bounces
+}
+
+// report describes the bulk run in progress, nil for other commands
+var report *runReport
+
+// runReport is the summary of a bulk run, printed and optionally written as JSON
+// for change-management evidence
+type runReport struct {
+	Operation  string   `json:"operation,omitempty"` // See ops
+	Command    string   `json:"command"`
+	Queues     []string `json:"queues"`
+	Received   int64    `json:"received"`
+	Written    int64    `json:"written"`
+	Sent       int64    `json:"sent"`
+	Deleted    int64    `json:"deleted"`
+	Failed     int64    `json:"failed"`
+	Retried    int64    `json:"retried"`
+	Duplicates int64    `json:"duplicatesSkipped"`
+	Bounced    int64    `json:"bouncedDiverted"`
+	Undeleted  []string `json:"undeleted,omitempty"` // Receipt handle expired, not found again
+	// FailedEntries are the batch entries SQS refused, with the message each carried
+	FailedEntries []failedEntry `json:"failedEntries,omitempty"`
+	Interrupted   bool          `json:"interrupted"`
+	Status        string        `json:"status"`           // completed, failed or interrupted
+	Output        string        `json:"output,omitempty"` // Export written to S3 or split files
+	Started       time.Time     `json:"started"`
+	Finished      time.Time     `json:"finished"`
+	Elapsed       float64       `json:"elapsedSeconds"`
+	Throughput    float64       `json:"messagesPerSecond"`
+
+	file   string
+	failed bool // The run stopped on errors, or its export is incomplete
+	once   sync.Once
+}
+
+// - - - - - - - - - - - - - - - -
+//   REPORTING
+// - - - - - - - - - - - - - - - -
+
+// startReport starts timing a bulk run, file receives the JSON report if set
+// the run is saved as an operation, or continues the one resumed
+func startReport(command, file string, queues ...string) {
+	startOperation(command, queues...)
+	report = &runReport{Command: command, Queues: queues, Started: time.Now(), file: file}
+	if operation != nil {
+		report.Operation = operation.ID
+	}
+	startAudit(command, queues...)
+}
+
+// failReport marks the bulk run in progress failed, before finishReport
+func failReport() {
+	if report != nil {
+		report.failed = true
+	}
+}
+
+// countRetries adds the retries of every call of the session to the tally
+func countRetries(sess *session.Session) {
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		atomic.AddInt64(&tally.retried, int64(r.RetryCount))
+	})
+}
+
+// finishReport prints the summary of the run on stderr, writes the JSON report and runs the hooks
+// only the first call does anything, so error paths can call it before exiting
+func finishReport() {
+	endTelemetry()
+	finishAudit(atomic.LoadInt64(&tally.deleted), atomic.LoadInt64(&tally.failed))
+	finishOperation()
+	if report == nil {
+		return
+	}
+	report.once.Do(func() {
+		r := report
+		r.Finished = time.Now()
+		r.Interrupted = isInterrupted()
+		r.Received = atomic.LoadInt64(&tally.received)
+		r.Written = atomic.LoadInt64(&tally.written)
+		r.Sent = atomic.LoadInt64(&tally.sent)
+		r.Deleted = atomic.LoadInt64(&tally.deleted)
+		r.Failed = atomic.LoadInt64(&tally.failed)
+		r.Retried = atomic.LoadInt64(&tally.retried)
+		r.Duplicates = atomic.LoadInt64(&tally.duplicates)
+		r.Bounced = atomic.LoadInt64(&tally.bounced)
+		undeleted.Lock()
+		r.Undeleted = append([]string(nil), undeleted.ids...)
+		undeleted.Unlock()
+		failedEntries.Lock()
+		r.FailedEntries = append([]failedEntry(nil), failedEntries.entries...)
+		failedEntries.Unlock()
+		switch {
+		case r.Interrupted:
+			r.Status = statusInterrupted
+		case r.failed || r.Failed > 0 || len(r.Undeleted) > 0:
+			r.Status = statusFailed
+		default:
+			r.Status = statusCompleted
+		}
+		elapsed := r.Finished.Sub(r.Started)
+		r.Elapsed = elapsed.Seconds()
+		if r.Elapsed > 0 {
+			r.Throughput = float64(r.Deleted) / r.Elapsed
+		}
+
+		r.summary(elapsed)
+
+		if len(r.file) > 0 {
+			b, _ := json.MarshalIndent(r, "", "  ")
+			if err := ioutil.WriteFile(r.file, append(b, '\n'), 0600); err != nil {
+				log.Println("Error writing report", err)
+			}
+		}
+		runHooks(r)
+	})
+}
+
+// summary prints the counts of the run on stderr, through a table with -o
+// the standard output may hold the exported messages
+func (r *runReport) summary(elapsed time.Duration) {
+	if len(outputFormat) > 0 {
+		t := &table{columns: []column{
+			{key: "command", title: "COMMAND"},
+			{key: "status", title: "STATUS"},
+			{key: "received", title: "RECEIVED"},
+			{key: "written", title: "WRITTEN", wide: true},
+			{key: "sent", title: "SENT"},
+			{key: "deleted", title: "DELETED"},
+			{key: "failed", title: "FAILED"},
+			{key: "retried", title: "RETRIED", wide: true},
+			{key: "duplicatesSkipped", title: "DUPLICATES", wide: true},
+			{key: "bouncedDiverted", title: "BOUNCED", wide: true},
+			{key: "notDeleted", title: "NOT DELETED"},
+			{key: "elapsedSeconds", title: "ELAPSED"},
+			{key: "messagesPerSecond", title: "MESSAGES/S", wide: true},
+		}}
+		t.add(r.Command, r.Status, r.Received, r.Written, r.Sent, r.Deleted, r.Failed, r.Retried, r.Duplicates, r.Bounced,
+			len(r.Undeleted), math.Round(r.Elapsed*1000)/1000, math.Round(r.Throughput*10)/10)
+		t.render(os.Stderr, outputFormat)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Summary of %s:\n", r.Command)
+	for _, line := range []struct {
+		name  string
+		value int64
+	}{
+		{"Received", r.Received},
+		{"Written", r.Written},
+		{"Sent", r.Sent},
+		{"Deleted", r.Deleted},
+		{"Failed", r.Failed},
+		{"Retried", r.Retried},
+		{"Duplicates skipped", r.Duplicates},
+		{"Bounced diverted", r.Bounced},
+		{"Not deleted", int64(len(r.Undeleted))},
+	} {
+		fmt.Fprintf(os.Stderr, "  %-20s %d\n", line.name, line.value)
+	}
+	fmt.Fprintf(os.Stderr, "  %-20s %s\n", "Elapsed", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(os.Stderr, "  %-20s %.1f messages/s\n", "Throughput", r.Throughput)
+}
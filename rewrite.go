@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// encryptedSkipped warns once that encrypted bodies are re-sent without -replace
+var encryptedSkipped sync.Once
+
+// messageRewrite adjusts re-sent messages: -set-attr and -drop-attr rewrite their message attributes,
+// carried over from the received message, -replace and -transform their body
+type messageRewrite struct {
+	set        map[string]*sqs.MessageAttributeValue
+	drop       map[string]bool
+	replace    []bodyReplace
+	transform  bodyTransform // Transform plugin or expression the bodies go through after -replace
+	attributes bool          // Carries the attributes even when none is set or dropped, like mirror copies
+	trace      *traceContext // Trace header injected in the re-sent messages, -trace
+}
+
+// bodyReplace is a -replace s/REGEX/REPLACEMENT/[g] expression
+type bodyReplace struct {
+	re          *regexp.Regexp
+	replacement string
+	all         bool // g flag, every match instead of the first one
+}
+
+// rewriteFlags are the -set-attr, -drop-attr, -replace, -transform and -trace flags of a command
+type rewriteFlags struct {
+	set       *attrFlag
+	drop      *attrFlag
+	replace   *attrFlag
+	transform *string
+	trace     *string
+}
+
+// - - - - - - - - - - - - - - - -
+//   FLAGS
+// - - - - - - - - - - - - - - - -
+
+// newRewriteFlags registers the rewriting flags on a command
+func newRewriteFlags(cmd *flag.FlagSet) *rewriteFlags {
+	f := &rewriteFlags{set: &attrFlag{}, drop: &attrFlag{}, replace: &attrFlag{}}
+	cmd.Var(f.set, "set-attr", "message attribute Name=Type:value set on re-sent messages, repeatable")
+	cmd.Var(f.drop, "drop-attr", "message attribute removed from re-sent messages, repeatable")
+	cmd.Var(f.replace, "replace", "s/REGEX/REPLACEMENT/[g] applied to re-sent bodies, repeatable")
+	f.transform = cmd.String("transform", "", "expr:EXPRESSION or transform plugin sqscli-transform-NAME the re-sent bodies go through")
+	f.trace = cmd.String("trace", "", "trace header injected in re-sent messages: xray or w3c")
+	return f
+}
+
+// rewrite validates the flags and starts the transform plugin, exits on invalid values
+// nil without flags, re-sent messages then keep their body as is and not their attributes
+func (f *rewriteFlags) rewrite() *messageRewrite {
+	if len(*f.set) == 0 && len(*f.drop) == 0 && len(*f.replace) == 0 && len(*f.transform) == 0 && len(*f.trace) == 0 {
+		return nil
+	}
+	set, err := f.set.values()
+	if err != nil {
+		log.Fatal("Invalid -set-attr ", err)
+	}
+	trace, err := newTraceContext(*f.trace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := &messageRewrite{set: set, drop: make(map[string]bool, len(*f.drop)), trace: trace}
+	for _, name := range *f.drop {
+		if _, ok := set[name]; ok {
+			log.Fatalf("Attribute %s is both set and dropped\n", name)
+		}
+		r.drop[name] = true
+	}
+	for _, expr := range *f.replace {
+		b, err := parseBodyReplace(expr)
+		if err != nil {
+			log.Fatal("Invalid -replace ", err)
+		}
+		r.replace = append(r.replace, b)
+	}
+	if len(*f.transform) > 0 {
+		if r.transform, err = newBodyTransform(*f.transform); err != nil {
+			log.Fatal("Invalid -transform ", err)
+		}
+	}
+	return r
+}
+
+// parseBodyReplace parses s/REGEX/REPLACEMENT/ with an optional g flag
+// any character following the s delimits the parts, like in sed, and can be escaped by a backslash
+// the replacement refers to groups as $1 or ${name}
+func parseBodyReplace(expr string) (bodyReplace, error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return bodyReplace{}, fmt.Errorf("%q is not s/REGEX/REPLACEMENT/", expr)
+	}
+	delim := expr[1:2]
+	var parts []string
+	var part strings.Builder
+	for i := 2; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && i+1 < len(expr) && expr[i+1:i+2] == delim:
+			part.WriteString(delim)
+			i++
+		case expr[i:i+1] == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(expr[i])
+		}
+	}
+	if len(parts) != 2 || (part.Len() > 0 && part.String() != "g") {
+		return bodyReplace{}, fmt.Errorf("%q is not s/REGEX/REPLACEMENT/ with an optional g flag", expr)
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return bodyReplace{}, fmt.Errorf("%q: %s", expr, err)
+	}
+	return bodyReplace{re: re, replacement: parts[1], all: part.String() == "g"}, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   REWRITING
+// - - - - - - - - - - - - - - - -
+
+// carry copies the attributes of a received message to the ones it is re-sent with
+// only when attributes are rewritten or carried, the export marker of a previous run is not carried
+func (r *messageRewrite) carry(m *sqs.Message, attrs map[string]*sqs.MessageAttributeValue) {
+	if r == nil || (len(r.set) == 0 && len(r.drop) == 0 && !r.attributes) {
+		return
+	}
+	for name, value := range m.MessageAttributes {
+		if name != exportMarkerAttribute {
+			attrs[name] = value
+		}
+	}
+}
+
+// stamp injects the trace header in an entry about to be re-sent
+func (r *messageRewrite) stamp(entry *sqs.SendMessageBatchRequestEntry) {
+	if r != nil {
+		r.trace.inject(entry)
+	}
+}
+
+// apply drops and sets attributes, see fitAttributes for their number
+func (r *messageRewrite) apply(attrs map[string]*sqs.MessageAttributeValue) {
+	if r == nil {
+		return
+	}
+	for name := range r.drop {
+		delete(attrs, name)
+	}
+	for name, value := range r.set {
+		attrs[name] = value
+	}
+}
+
+// body returns the body a message is re-sent with, replaced in order, then transformed
+// encrypted bodies are left as is, they would no longer decrypt
+func (r *messageRewrite) body(m *sqs.Message) (string, error) {
+	body := aws.StringValue(m.Body)
+	if r == nil || (len(r.replace) == 0 && r.transform == nil) {
+		return body, nil
+	}
+	if len(envelopeAttributes(m)) > 0 {
+		encryptedSkipped.Do(func() {
+			log.Println("Warning: some messages are encrypted, their bodies are moved without -replace or -transform")
+		})
+		return body, nil
+	}
+	for _, b := range r.replace {
+		if b.all {
+			body = b.re.ReplaceAllString(body, b.replacement)
+			continue
+		}
+		if loc := b.re.FindStringSubmatchIndex(body); loc != nil {
+			var out []byte
+			out = b.re.ExpandString(out, b.replacement, body, loc)
+			body = body[:loc[0]] + string(out) + body[loc[1]:]
+		}
+	}
+	if r.transform != nil {
+		return r.transform.transform(m, body)
+	}
+	return body, nil
+}
+
+// close waits for the transform plugin to exit, once the messages are re-sent
+func (r *messageRewrite) close() {
+	if r == nil || r.transform == nil {
+		return
+	}
+	if err := r.transform.Close(); err != nil {
+		log.Println("Error stopping transform", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestParseBodyReplace(t *testing.T) {
+	tests := []struct {
+		expr    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"s/old/new/", "old old", "new old", false},
+		{"s/old/new/g", "old old", "new new", false},
+		{`s/"v":(\d+)/"v":$1$1/`, `{"v":2}`, `{"v":22}`, false},
+		{"s/(?P<k>[a-z]+)=1/${k}=2/g", "a=1,b=1", "a=2,b=2", false},
+		{"s|/api/v1|/api/v2|", "/api/v1/orders", "/api/v2/orders", false},
+		{`s/a\/b/c/`, "a/b", "c", false},
+		{"s/missing/x/", "body", "body", false},
+		{"s/old/new", "", "", true},
+		{"s/old/new/x", "", "", true},
+		{"y/old/new/", "", "", true},
+		{"s/(/x/", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			b, err := parseBodyReplace(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			r := &messageRewrite{replace: []bodyReplace{b}}
+			got, err := r.body(&sqs.Message{Body: aws.String(tt.body)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteBody(t *testing.T) {
+	replace := func(exprs ...string) []bodyReplace {
+		var rs []bodyReplace
+		for _, expr := range exprs {
+			b, err := parseBodyReplace(expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs = append(rs, b)
+		}
+		return rs
+	}
+	transform := func(spec string) bodyTransform {
+		bt, err := newBodyTransform(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bt
+	}
+	tests := []struct {
+		name    string
+		rewrite *messageRewrite
+		m       *sqs.Message
+		want    string
+	}{
+		{"no rewrite", nil, &sqs.Message{Body: aws.String("as is")}, "as is"},
+		{"replaced in order", &messageRewrite{replace: replace("s/a/b/g", "s/b/c/")}, &sqs.Message{Body: aws.String("aa")}, "cb"},
+		{"transformed after the replaces", &messageRewrite{replace: replace("s/1/2/"), transform: transform("expr:body.n")}, &sqs.Message{Body: aws.String(`{"n":1}`)}, "2"},
+		{"encrypted left as is", &messageRewrite{replace: replace("s/a/b/")}, &sqs.Message{
+			Body: aws.String("aaa"),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				envelopeAttribute: {DataType: aws.String("String"), StringValue: aws.String(envelopeAlgorithm)},
+			},
+		}, "aaa"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rewrite.body(tt.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteAttributes(t *testing.T) {
+	value := func(s string) *sqs.MessageAttributeValue {
+		return &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(s)}
+	}
+	received := &sqs.Message{MessageAttributes: map[string]*sqs.MessageAttributeValue{
+		"Source":              value("billing"),
+		"Secret":              value("x"),
+		exportMarkerAttribute: value("run-1"),
+	}}
+	tests := []struct {
+		name    string
+		rewrite *messageRewrite
+		want    string // Attribute names and values after carry and apply
+	}{
+		{"nothing carried without rewrite", nil, ""},
+		{"set", &messageRewrite{set: map[string]*sqs.MessageAttributeValue{"Team": value("core")}, drop: map[string]bool{}},
+			"Secret=x Source=billing Team=core"},
+		{"set overrides", &messageRewrite{set: map[string]*sqs.MessageAttributeValue{"Source": value("replay")}, drop: map[string]bool{}},
+			"Secret=x Source=replay"},
+		{"drop", &messageRewrite{drop: map[string]bool{"Secret": true}}, "Source=billing"},
+		{"carried whole", &messageRewrite{attributes: true}, "Secret=x Source=billing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attrs := make(map[string]*sqs.MessageAttributeValue)
+			tt.rewrite.carry(received, attrs)
+			tt.rewrite.apply(attrs)
+			var got []string
+			for name, v := range attrs {
+				got = append(got, name+"="+aws.StringValue(v.StringValue))
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("attributes = %s, want %s", strings.Join(got, " "), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of script steps
+const (
+	stepExport  = "export"
+	stepMove    = "move"
+	stepVerify  = "verify"
+	stepCommand = "command"
+	// stepSkipped is the status of the steps a failure left out
+	stepSkipped = "skipped"
+	// verifyPollInterval is how often a verify step reads the depth again, until within
+	verifyPollInterval = 2 * time.Second
+)
+
+// scriptVar is a ${name} of a script
+var scriptVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// script is a run script: a runbook of sqscli steps, run in order
+type script struct {
+	Name  string            `yaml:"name"`
+	Vars  map[string]string `yaml:"vars"` // Values of the ${name} of the steps, -var overrides them
+	Steps []scriptStep      `yaml:"steps"`
+}
+
+// scriptStep is a step of a script, one of export, move, verify or command
+type scriptStep struct {
+	Name            string        `yaml:"name"`
+	Export          *scriptExport `yaml:"export"`
+	Move            *scriptMove   `yaml:"move"`
+	Verify          *scriptVerify `yaml:"verify"`
+	Command         []string      `yaml:"command"`         // Any sqscli command and its arguments
+	ContinueOnError bool          `yaml:"continueOnError"` // The next steps run even if this one fails
+}
+
+// scriptExport exports a queue with qtocsv, to a file or a sink
+type scriptExport struct {
+	Queue     string   `yaml:"queue"`
+	File      string   `yaml:"file"`
+	Format    string   `yaml:"format"`
+	Sink      string   `yaml:"sink"`
+	Filter    string   `yaml:"filter"`
+	Transform string   `yaml:"transform"`
+	Args      []string `yaml:"args"` // Other qtocsv options
+}
+
+// scriptMove moves the messages of a queue with qtoq, to a queue or a sink
+type scriptMove struct {
+	From      string   `yaml:"from"`
+	To        string   `yaml:"to"`
+	Sink      string   `yaml:"sink"`
+	Filter    string   `yaml:"filter"`
+	Transform string   `yaml:"transform"`
+	Args      []string `yaml:"args"` // Other qtoq options
+}
+
+// scriptVerify checks the depth of a queue, visible and in flight messages counted
+type scriptVerify struct {
+	Queue    string `yaml:"queue"`
+	MaxDepth *int   `yaml:"maxDepth"`
+	MinDepth *int   `yaml:"minDepth"`
+	Within   string `yaml:"within"` // How long the depth may take to settle, like 1m, checked once by default
+}
+
+// stepResult is the outcome of a step, saved in the checkpoint
+type stepResult struct {
+	Name      string     `json:"name"`
+	Kind      string     `json:"kind"`
+	Status    string     `json:"status"` // completed, failed, interrupted or skipped
+	ExitCode  int        `json:"exitCode"`
+	Target    string     `json:"target,omitempty"` // Export file, destination queue or sink
+	Detail    string     `json:"detail,omitempty"` // Verify outcome, or last output line of a failed run
+	Operation string     `json:"operation,omitempty"`
+	Report    *runReport `json:"report,omitempty"`
+	Started   time.Time  `json:"started"`
+	Finished  time.Time  `json:"finished"`
+}
+
+// scriptCheckpoint is the state of a script run, shared by its steps, so running the script again
+// carries on after the last completed step, resuming the operation of an interrupted one
+type scriptCheckpoint struct {
+	Script  string       `json:"script"`
+	Digest  string       `json:"digest"` // SHA-256 of the script, vars applied, a changed script starts over
+	Started time.Time    `json:"started"`
+	Steps   []stepResult `json:"steps"`
+}
+
+// scriptReport is the consolidated report of a script run
+type scriptReport struct {
+	Name     string       `json:"name"`
+	Script   string       `json:"script"`
+	Status   string       `json:"status"`
+	Steps    []stepResult `json:"steps"`
+	Totals   opProgress   `json:"totals"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Elapsed  float64      `json:"elapsedSeconds"`
+}
+
+// - - - - - - - - - - - - - - - -
+//   RUN COMMAND
+// - - - - - - - - - - - - - - - -
+
+// runScript runs the steps of a script in order, each export, move and command in a sqscli process of its own
+// like drain-all, and stops at the first failure; the checkpoint file records each step once done
+func runScript(args []string) {
+	runCommand := flag.NewFlagSet("run", flag.ExitOnError)
+	vars := &attrFlag{}
+	runCommand.Var(vars, "var", "name=value of a ${name} of the script, repeatable")
+	checkpointFile := runCommand.String("checkpoint", "", "checkpoint file of the run, <script>.checkpoint.json by default")
+	restart := runCommand.Bool("restart", false, "run every step again, ignoring the checkpoint")
+	dryRun := runCommand.Bool("dry-run", false, "print the commands of the steps without running them")
+	reportFile := runCommand.String("report", "", "file receiving the JSON consolidated report")
+	runHelp := runCommand.Bool("help", false, "help for run command")
+	runCommand.BoolVar(runHelp, "h", false, "help") // Aliasing
+	parseFlags(runCommand, args)
+
+	if *runHelp {
+		runUsage()
+	}
+
+	// Verify
+	if runCommand.NArg() != 1 {
+		fmt.Println("Required script file is missing.")
+		runUsage()
+	}
+	file := runCommand.Arg(0)
+	s, digest, err := loadScript(file, *vars)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*checkpointFile) == 0 {
+		*checkpointFile = strings.TrimSuffix(file, filepath.Ext(file)) + ".checkpoint.json"
+	}
+	commands := make([][]string, len(s.Steps))
+	for i, step := range s.Steps {
+		commands[i] = step.command()
+	}
+	if *dryRun {
+		for i, step := range s.Steps {
+			if commands[i] == nil {
+				fmt.Printf("%s: %s\n", step.Name, step.Verify.describe())
+				continue
+			}
+			fmt.Printf("%s: sqscli %s\n", step.Name, shellWords(commands[i]))
+		}
+		return
+	}
+
+	// Carry on after the steps done
+	cp := &scriptCheckpoint{Script: file, Digest: digest, Started: time.Now()}
+	if !*restart {
+		if previous, err := loadCheckpoint(*checkpointFile); err == nil {
+			if previous.Digest != digest {
+				log.Fatalf("%s changed since %s was saved, run it with -restart\n", file, *checkpointFile)
+			}
+			cp = previous
+		} else if !os.IsNotExist(err) {
+			log.Fatal("Error reading the checkpoint ", err)
+		}
+	}
+	done := make(map[string]stepResult, len(cp.Steps))
+	completed := 0
+	for _, r := range cp.Steps {
+		done[r.Name] = r
+		if r.Status == opCompleted {
+			completed++
+		}
+	}
+	if completed == len(s.Steps) {
+		fmt.Printf("Script %s is already completed, see %s, run it with -restart to run it again.\n", file, *checkpointFile)
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal("Error locating the sqscli binary ", err)
+	}
+	reports, err := ioutil.TempDir("", "sqscli-run-")
+	if err != nil {
+		log.Fatal("Error creating the report directory ", err)
+	}
+	defer os.RemoveAll(reports)
+	sched := &scheduler{
+		exe: exe,
+		// Everything before the command name, the health endpoints and operation are run's
+		globals: withoutFlag(withoutFlag(os.Args[1:len(os.Args)-len(flag.Args())], "health"), "operation-id"),
+		running: make(map[string]*exec.Cmd),
+	}
+	os.Unsetenv(envName("", "health"))
+	handleInterrupts()
+	go func() {
+		<-interrupted
+		sched.stopJobs()
+	}()
+	markReady()
+
+	// Apply, in order
+	var svc *service
+	var results []stepResult
+	stopped := false
+	for i, step := range s.Steps {
+		previous, seen := done[step.Name]
+		switch {
+		case seen && previous.Status == opCompleted:
+			log.Printf("[%s] already %s\n", step.Name, previous.Status)
+			results = append(results, previous)
+			continue
+		case stopped || isInterrupted():
+			results = append(results, stepResult{Name: step.Name, Kind: step.kind(), Target: step.target(), Status: stepSkipped})
+			continue
+		}
+
+		res := stepResult{Name: step.Name, Kind: step.kind(), Started: time.Now()}
+		if step.Verify != nil {
+			if svc == nil {
+				svc = newService()
+			}
+			ok, detail := svc.verify(step.Verify)
+			res.Status, res.Detail, res.Target = opCompleted, detail, step.target()
+			if !ok {
+				res.Status, res.ExitCode = opFailed, 1
+			}
+			log.Printf("[%s] %s\n", step.Name, detail)
+		} else {
+			report := filepath.Join(reports, fmt.Sprintf("%d.json", i))
+			command := append(append([]string{}, commands[i]...), "-report", report)
+			if step.Command != nil {
+				command = commands[i]
+			}
+			// An interrupted or failed move or export continues its operation
+			if seen && len(previous.Operation) > 0 {
+				log.Printf("[%s] resuming operation %s\n", step.Name, previous.Operation)
+				command = append([]string{"-operation-id", previous.Operation}, command...)
+			}
+			target := step.target()
+			log.Printf("[%s] sqscli %s\n", step.Name, shellWords(commands[i]))
+			d := sched.drain(step.Name, target, report, command, step.Export != nil && len(step.Export.File) > 0)
+			res.Status, res.ExitCode, res.Target, res.Detail, res.Report = d.Status, d.ExitCode, d.Target, d.Error, d.Report
+			if d.Report != nil {
+				res.Operation = d.Report.Operation
+			}
+		}
+		res.Finished = time.Now()
+		results = append(results, res)
+		if res.Status != opCompleted && !step.ContinueOnError {
+			stopped = true
+		}
+		// Saved after every step, the next run carries on from there
+		cp.Steps = append(results[:len(results):len(results)], pendingSteps(s.Steps[i+1:])...)
+		if err := cp.save(*checkpointFile); err != nil {
+			log.Println("Error saving the checkpoint", err)
+		}
+	}
+
+	// Consolidate
+	r := scriptReport{Name: s.Name, Script: file, Status: opCompleted, Steps: results, Started: cp.Started, Finished: time.Now()}
+	r.Elapsed = r.Finished.Sub(r.Started).Seconds()
+	t := &table{columns: []column{
+		{key: "step", title: "STEP"},
+		{key: "kind", title: "KIND"},
+		{key: "target", title: "TARGET"},
+		{key: "status", title: "STATUS"},
+		{key: "received", title: "RECEIVED"},
+		{key: "deleted", title: "DELETED"},
+		{key: "failed", title: "FAILED"},
+		{key: "detail", title: "DETAIL", wide: true},
+		{key: "operation", title: "OPERATION", wide: true},
+	}}
+	for _, res := range results {
+		switch {
+		case res.Status == opInterrupted:
+			r.Status = opInterrupted
+		case res.Status != opCompleted && r.Status != opInterrupted:
+			r.Status = opFailed
+		}
+		if res.Report == nil {
+			t.add(res.Name, res.Kind, res.Target, res.Status, 0, 0, 0, res.Detail, res.Operation)
+			continue
+		}
+		rep := res.Report
+		r.Totals.Received += rep.Received
+		r.Totals.Written += rep.Written
+		r.Totals.Sent += rep.Sent
+		r.Totals.Deleted += rep.Deleted
+		r.Totals.Failed += rep.Failed
+		r.Totals.Duplicates += rep.Duplicates
+		t.add(res.Name, res.Kind, res.Target, res.Status, rep.Received, rep.Deleted, rep.Failed, res.Detail, res.Operation)
+	}
+	tableFormat := outputFormat
+	if len(tableFormat) == 0 {
+		tableFormat = formatTable
+	}
+	t.render(os.Stdout, tableFormat)
+	fmt.Fprintf(os.Stderr, "Script %s %s in %s: %d received, %d deleted, %d failed\n",
+		file, r.Status, r.Finished.Sub(r.Started).Round(time.Millisecond), r.Totals.Received, r.Totals.Deleted, r.Totals.Failed)
+
+	if len(*reportFile) > 0 {
+		b, _ := json.MarshalIndent(r, "", "  ")
+		if err := ioutil.WriteFile(*reportFile, append(b, '\n'), 0600); err != nil {
+			log.Println("Error writing report", err)
+		}
+	}
+	switch r.Status {
+	case opInterrupted:
+		os.Exit(exitInterrupted)
+	case opFailed:
+		fmt.Fprintf(os.Stderr, "Fix the failed step and run the script again to carry on, %s keeps the steps done\n", *checkpointFile)
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   SCRIPTS
+// - - - - - - - - - - - - - - - -
+
+// loadScript reads a script, its ${name} replaced by the vars, and checks its steps
+// returns the digest of the script as run
+func loadScript(file string, overrides []string) (*script, string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	// Vars first, to replace them in the steps
+	var raw struct {
+		Vars map[string]string `yaml:"vars"`
+	}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, "", fmt.Errorf("invalid script %s: %s", file, err)
+	}
+	vars := raw.Vars
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	for _, v := range overrides {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, "", fmt.Errorf("invalid -var %q, expected name=value", v)
+		}
+		vars[parts[0]] = parts[1]
+	}
+	var missing []string
+	text := scriptVar.ReplaceAllStringFunc(string(b), func(ref string) string {
+		name := scriptVar.FindStringSubmatch(ref)[1]
+		value, ok := vars[name]
+		if !ok && !containsString(missing, name) {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return nil, "", fmt.Errorf("%s: no value for ${%s}, see vars and -var", file, strings.Join(missing, "}, ${"))
+	}
+
+	var s script
+	if err := yaml.Unmarshal([]byte(text), &s); err != nil {
+		return nil, "", fmt.Errorf("invalid script %s: %s", file, err)
+	}
+	if len(s.Steps) == 0 {
+		return nil, "", fmt.Errorf("no step in %s", file)
+	}
+	if len(s.Name) == 0 {
+		s.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	names := make(map[string]bool, len(s.Steps))
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if len(step.Name) == 0 {
+			step.Name = strings.TrimSuffix(fmt.Sprintf("%d-%s", i+1, step.kind()), "-")
+		}
+		if names[step.Name] {
+			return nil, "", fmt.Errorf("step %d of %s: name %s is already taken", i+1, file, step.Name)
+		}
+		names[step.Name] = true
+		if err := step.validate(); err != nil {
+			return nil, "", fmt.Errorf("step %s of %s: %s", step.Name, file, err)
+		}
+	}
+	sum := sha256.Sum256([]byte(text))
+	return &s, hex.EncodeToString(sum[:]), nil
+}
+
+// kind returns the kind of a step, empty if it has none
+func (s scriptStep) kind() string {
+	kinds := s.kinds()
+	if len(kinds) != 1 {
+		return ""
+	}
+	return kinds[0]
+}
+
+// kinds lists the kinds a step was given
+func (s scriptStep) kinds() []string {
+	var kinds []string
+	if s.Export != nil {
+		kinds = append(kinds, stepExport)
+	}
+	if s.Move != nil {
+		kinds = append(kinds, stepMove)
+	}
+	if s.Verify != nil {
+		kinds = append(kinds, stepVerify)
+	}
+	if s.Command != nil {
+		kinds = append(kinds, stepCommand)
+	}
+	return kinds
+}
+
+// validate checks a step has one kind and what that kind needs
+func (s scriptStep) validate() error {
+	if kinds := s.kinds(); len(kinds) != 1 {
+		return fmt.Errorf("expected one of export, move, verify or command, got %d", len(kinds))
+	}
+	switch {
+	case s.Export != nil:
+		e := s.Export
+		if len(e.Queue) == 0 {
+			return fmt.Errorf("export needs a queue")
+		}
+		if len(e.File) > 0 == (len(e.Sink) > 0) {
+			return fmt.Errorf("export needs either a file or a sink")
+		}
+		if len(e.Sink) > 0 {
+			if _, _, err := parseSinkURI(e.Sink); err != nil {
+				return err
+			}
+		}
+		return validateStepExpressions(e.Filter, e.Transform)
+	case s.Move != nil:
+		m := s.Move
+		if len(m.From) == 0 {
+			return fmt.Errorf("move needs a queue from")
+		}
+		if len(m.To) > 0 == (len(m.Sink) > 0) {
+			return fmt.Errorf("move needs either a queue to or a sink")
+		}
+		return validateStepExpressions(m.Filter, m.Transform)
+	case s.Verify != nil:
+		v := s.Verify
+		if len(v.Queue) == 0 {
+			return fmt.Errorf("verify needs a queue")
+		}
+		if v.MaxDepth == nil && v.MinDepth == nil {
+			return fmt.Errorf("verify needs maxDepth or minDepth")
+		}
+		if len(v.Within) > 0 {
+			if _, err := time.ParseDuration(v.Within); err != nil {
+				return fmt.Errorf("invalid within: %s", err)
+			}
+		}
+	default:
+		if len(s.Command) == 0 {
+			return fmt.Errorf("command is empty")
+		}
+		if s.Command[0] == "run" {
+			return fmt.Errorf("scripts don't run scripts")
+		}
+	}
+	return nil
+}
+
+// validateStepExpressions checks the filter and expr: transform of a step before anything runs
+func validateStepExpressions(filter, transform string) error {
+	if len(filter) > 0 {
+		if _, err := compileExpression(filter); err != nil {
+			return fmt.Errorf("filter: %s", err)
+		}
+	}
+	if strings.HasPrefix(transform, exprTransformPrefix) {
+		if _, err := compileExpression(transform[len(exprTransformPrefix):]); err != nil {
+			return fmt.Errorf("transform: %s", err)
+		}
+	}
+	return nil
+}
+
+// command returns the sqscli command line of a step, nil for verify steps, run in process
+func (s scriptStep) command() []string {
+	var command []string
+	add := func(name, value string) {
+		if len(value) > 0 {
+			command = append(command, "-"+name, value)
+		}
+	}
+	switch {
+	case s.Export != nil:
+		e := s.Export
+		command = []string{"qtocsv", "-queue", e.Queue}
+		add("format", e.Format)
+		add("sink", e.Sink)
+		add("filter", e.Filter)
+		add("transform", e.Transform)
+		return append(command, e.Args...)
+	case s.Move != nil:
+		m := s.Move
+		command = []string{"qtoq", "-queue1", m.From}
+		add("queue2", m.To)
+		add("sink", m.Sink)
+		add("filter", m.Filter)
+		add("transform", m.Transform)
+		return append(command, m.Args...)
+	case s.Command != nil:
+		return s.Command
+	}
+	return nil
+}
+
+// target returns the export file, destination queue or sink of a step, the queue of a verify
+func (s scriptStep) target() string {
+	switch {
+	case s.Export != nil:
+		return s.Export.File + s.Export.Sink
+	case s.Move != nil:
+		return s.Move.To + s.Move.Sink
+	case s.Verify != nil:
+		return s.Verify.Queue
+	}
+	return ""
+}
+
+// describe tells what a verify step checks
+func (v *scriptVerify) describe() string {
+	var checks []string
+	if v.MinDepth != nil {
+		checks = append(checks, fmt.Sprintf("at least %d", *v.MinDepth))
+	}
+	if v.MaxDepth != nil {
+		checks = append(checks, fmt.Sprintf("at most %d", *v.MaxDepth))
+	}
+	within := ""
+	if len(v.Within) > 0 {
+		within = " within " + v.Within
+	}
+	return fmt.Sprintf("verify %s holds %s messages%s", v.Queue, strings.Join(checks, " and "), within)
+}
+
+// verify reads the depth of the queue of a verify step until it passes or within is over
+func (s *service) verify(v *scriptVerify) (bool, string) {
+	name, err := lookupBookmark(v.Queue)
+	if err != nil {
+		return false, err.Error()
+	}
+	out, err := s.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(name)})
+	if err != nil {
+		return false, fmt.Sprintf("no queue %s: %s", v.Queue, err)
+	}
+	q := s.queueAt(aws.StringValue(out.QueueUrl))
+	within, _ := time.ParseDuration(v.Within)
+	deadline := time.Now().Add(within)
+	for {
+		attrs := q.refresh()
+		depth := intAttribute(attrs, sqs.QueueAttributeNameApproximateNumberOfMessages) +
+			intAttribute(attrs, sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible)
+		ok := (v.MinDepth == nil || depth >= *v.MinDepth) && (v.MaxDepth == nil || depth <= *v.MaxDepth)
+		if ok || !time.Now().Before(deadline) || isInterrupted() {
+			verdict := "passed"
+			if !ok {
+				verdict = "failed"
+			}
+			return ok, fmt.Sprintf("%s: %d messages, %s", v.describe(), depth, verdict)
+		}
+		time.Sleep(verifyPollInterval)
+	}
+}
+
+// pendingSteps lists steps not run yet, so the checkpoint holds every step
+func pendingSteps(steps []scriptStep) []stepResult {
+	var pending []stepResult
+	for _, step := range steps {
+		pending = append(pending, stepResult{Name: step.Name, Kind: step.kind(), Target: step.target(), Status: stepSkipped})
+	}
+	return pending
+}
+
+// shellWords joins a command line the way a shell reads it back, quoting the words that need it
+func shellWords(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		if len(w) > 0 && !strings.ContainsAny(w, " \t\n\"'\\$`*?[]{}()<>|&;#~!") {
+			quoted[i] = w
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(w, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// - - - - - - - - - - - - - - - -
+//   CHECKPOINTS
+// - - - - - - - - - - - - - - - -
+
+// loadCheckpoint reads the checkpoint of a script
+func loadCheckpoint(file string) (*scriptCheckpoint, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cp scriptCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return &cp, nil
+}
+
+// save writes the checkpoint, replaced at once
+func (cp *scriptCheckpoint) save(file string) error {
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func runUsage() {
+	fmt.Println("usage: sqscli run [options] <script.yaml>")
+	fmt.Println("options:")
+	fmt.Println("  -var              name=value of a ${name} of the script, repeatable")
+	fmt.Println("  -checkpoint       Checkpoint file of the run (default <script>.checkpoint.json)")
+	fmt.Println("  -restart          Run every step again, ignoring the checkpoint")
+	fmt.Println("  -dry-run          Print the commands of the steps without running them")
+	fmt.Println("  -report           File receiving the JSON consolidated report")
+	os.Exit(0)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// s3MinPartSize is the smallest part S3 accepts, the last part excepted (5MB)
+	s3MinPartSize = 5 << 20
+	// s3ManifestSuffix names the manifest uploaded next to the export object
+	s3ManifestSuffix = ".manifest.json"
+)
+
+// s3Manifest records the progress of a multipart export, so an interrupted one resumes
+// it is rewritten after every batch, uploaded parts and the bytes of the
+// pending part that are on disk included
+type s3Manifest struct {
+	Bucket          string          `json:"bucket"`
+	Key             string          `json:"key"`
+	UploadID        string          `json:"uploadId"`
+	RunID           string          `json:"runId"` // Marked the copies of exports made by older versions
+	Format          string          `json:"format"`
+	AvroSync        string          `json:"avroSync,omitempty"` // Sync marker of the Avro blocks
+	Queues          []s3ExportQueue `json:"queues"`
+	Parts           []s3Part        `json:"parts"`
+	PendingSize     int64           `json:"pendingSize"`
+	PendingMessages int             `json:"pendingMessages"`
+	Messages        int             `json:"messages"`
+	Complete        bool            `json:"complete"`
+}
+
+// s3ExportQueue is the progress of a queue of the export
+type s3ExportQueue struct {
+	Name string `json:"name"`
+	Done bool   `json:"done"`
+}
+
+// s3Part is an uploaded part of the export object
+type s3Part struct {
+	Number   int64  `json:"number"`
+	ETag     string `json:"etag"`
+	Size     int64  `json:"size"`
+	Messages int    `json:"messages"`
+	SHA256   string `json:"sha256"`
+}
+
+// s3Writer streams the export to an S3 multipart upload
+// the output is written to a local pending file, uploaded as a part once big enough
+type s3Writer struct {
+	client   *s3.S3
+	path     string // Manifest file
+	partSize int64
+	pending  *os.File
+	manifest s3Manifest
+	resumed  bool
+}
+
+// - - - - - - - - - - - - - - - -
+//   S3 EXPORT
+// - - - - - - - - - - - - - - - -
+
+// parseS3URI splits s3://bucket/key
+func parseS3URI(uri string) (string, string, error) {
+	rest := strings.TrimPrefix(uri, "s3://")
+	parts := strings.SplitN(rest, "/", 2)
+	if rest == uri || len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("invalid S3 URI %q, expected s3://bucket/key", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+// newS3Writer resumes the export of a manifest, or starts a multipart upload
+// a resumed export must target the same object in the same format
+func (s *service) newS3Writer(uri, manifestFile, format string, partSize int64) *s3Writer {
+	bucket, key, err := parseS3URI(uri)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := &s3Writer{client: s3Client(s.sess), path: manifestFile, partSize: partSize}
+
+	if b, err := ioutil.ReadFile(manifestFile); err == nil {
+		if err := json.Unmarshal(b, &w.manifest); err != nil {
+			log.Fatalf("Invalid manifest %s: %s\n", manifestFile, err)
+		}
+		m := w.manifest
+		if m.Bucket != bucket || m.Key != key || m.Format != format {
+			log.Fatalf("Manifest %s is an export of s3://%s/%s as %s, remove it to start over\n",
+				manifestFile, m.Bucket, m.Key, m.Format)
+		}
+		w.verifyParts()
+		w.resumed = true
+		log.Printf("Resuming export to %s after %d parts, %d messages\n", uri, len(m.Parts), m.Messages+m.PendingMessages)
+	} else if os.IsNotExist(err) {
+		upload, err := w.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			log.Fatal("Error starting the S3 upload ", err)
+		}
+		runID, _ := newUUID()
+		w.manifest = s3Manifest{
+			Bucket:   bucket,
+			Key:      key,
+			UploadID: aws.StringValue(upload.UploadId),
+			RunID:    runID,
+			Format:   format,
+		}
+		w.save()
+	} else {
+		log.Fatal("Error reading manifest ", err)
+	}
+
+	// Bytes past the recorded size belong to a batch that was not re-added, it comes back
+	pending, err := os.OpenFile(manifestFile+".pending", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		log.Fatal("Error opening pending part ", err)
+	}
+	if err := pending.Truncate(w.manifest.PendingSize); err != nil {
+		log.Fatal("Error truncating pending part ", err)
+	}
+	if _, err := pending.Seek(w.manifest.PendingSize, 0); err != nil {
+		log.Fatal("Error opening pending part ", err)
+	}
+	w.pending = pending
+	return w
+}
+
+// verifyParts checks the parts of the manifest are still in the upload
+// uploads aborted, or expired by a lifecycle rule, can't be resumed
+func (w *s3Writer) verifyParts() {
+	uploaded := make(map[int64]string)
+	err := w.client.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(w.manifest.Bucket),
+		Key:      aws.String(w.manifest.Key),
+		UploadId: aws.String(w.manifest.UploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			uploaded[aws.Int64Value(p.PartNumber)] = aws.StringValue(p.ETag)
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatalf("Upload %s can't be resumed, remove %s to start over: %s\n", w.manifest.UploadID, w.path, err)
+	}
+	for _, p := range w.manifest.Parts {
+		if uploaded[p.Number] != p.ETag {
+			log.Fatalf("Part %d of upload %s is missing, remove %s to start over\n", p.Number, w.manifest.UploadID, w.path)
+		}
+	}
+}
+
+// startQueue records the export of a queue started, false if it was started by the resumed run
+func (w *s3Writer) startQueue(name string) bool {
+	for _, q := range w.manifest.Queues {
+		if q.Name == name {
+			return false
+		}
+	}
+	w.manifest.Queues = append(w.manifest.Queues, s3ExportQueue{Name: name})
+	return true
+}
+
+// queueDone is true if the resumed run exported the whole queue
+func (w *s3Writer) queueDone(name string) bool {
+	for _, q := range w.manifest.Queues {
+		if q.Name == name {
+			return q.Done
+		}
+	}
+	return false
+}
+
+// finishQueue records the export of a queue done, saved with the next flush
+func (w *s3Writer) finishQueue(name string) {
+	for i := range w.manifest.Queues {
+		if w.manifest.Queues[i].Name == name {
+			w.manifest.Queues[i].Done = true
+		}
+	}
+}
+
+// syncAvro gives an Avro writer the sync marker of the resumed export, or records its own
+func (w *s3Writer) syncAvro(aw *avroWriter) {
+	if len(w.manifest.AvroSync) > 0 {
+		hex.Decode(aw.sync[:], []byte(w.manifest.AvroSync))
+	} else {
+		w.manifest.AvroSync = hex.EncodeToString(aw.sync[:])
+	}
+}
+
+// Write appends to the pending part
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pending.Write(p)
+}
+
+// written counts a message of the pending part
+func (w *s3Writer) written() {
+	w.manifest.PendingMessages++
+}
+
+// Flush syncs the pending part and uploads it once big enough
+// the manifest is saved either way, before the batch is re-added
+func (w *s3Writer) Flush() error {
+	if err := w.pending.Sync(); err != nil {
+		return err
+	}
+	size, err := w.pending.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	w.manifest.PendingSize = size
+	if size >= w.partSize {
+		if err := w.uploadPart(); err != nil {
+			return err
+		}
+	}
+	return w.save()
+}
+
+// uploadPart uploads the pending part under the next part number, and saves the manifest with it
+// a crash before the manifest is saved uploads the same number again, which replaces it
+func (w *s3Writer) uploadPart() error {
+	data := make([]byte, w.manifest.PendingSize)
+	if _, err := w.pending.ReadAt(data, 0); err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	number := int64(len(w.manifest.Parts) + 1)
+	result, err := w.client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(w.manifest.Bucket),
+		Key:        aws.String(w.manifest.Key),
+		UploadId:   aws.String(w.manifest.UploadID),
+		PartNumber: aws.Int64(number),
+		Body:       bytes.NewReader(data),
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	})
+	if err != nil {
+		return fmt.Errorf("uploading part %d: %s", number, err)
+	}
+	digest := sha256.Sum256(data)
+	w.manifest.Parts = append(w.manifest.Parts, s3Part{
+		Number:   number,
+		ETag:     aws.StringValue(result.ETag),
+		Size:     int64(len(data)),
+		Messages: w.manifest.PendingMessages,
+		SHA256:   hex.EncodeToString(digest[:]),
+	})
+	w.manifest.Messages += w.manifest.PendingMessages
+	w.manifest.PendingSize, w.manifest.PendingMessages = 0, 0
+	// Recorded before the pending data goes, a crash in between leaves nothing to upload again
+	if err := w.save(); err != nil {
+		return err
+	}
+	if err := w.pending.Truncate(0); err != nil {
+		return err
+	}
+	_, err = w.pending.Seek(0, 0)
+	log.Printf("Uploaded part %d, %d bytes\n", number, len(data))
+	return err
+}
+
+// complete uploads the last part, completes the upload and puts the manifest next to the object
+// the local manifest and pending part are removed, a new run starts a new export
+func (w *s3Writer) complete() {
+	if err := w.Flush(); err != nil {
+		log.Fatal("Error flushing the S3 export ", err)
+	}
+	if w.manifest.PendingSize > 0 || len(w.manifest.Parts) == 0 {
+		if err := w.uploadPart(); err != nil {
+			log.Fatal("Error uploading the last part ", err)
+		}
+	}
+
+	parts := make([]*s3.CompletedPart, 0, len(w.manifest.Parts))
+	for _, p := range w.manifest.Parts {
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(p.Number), ETag: aws.String(p.ETag)})
+	}
+	_, err := w.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.manifest.Bucket),
+		Key:             aws.String(w.manifest.Key),
+		UploadId:        aws.String(w.manifest.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		log.Fatal("Error completing the S3 upload ", err)
+	}
+
+	w.manifest.Complete = true
+	b, _ := json.MarshalIndent(w.manifest, "", "  ")
+	_, err = w.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(w.manifest.Bucket),
+		Key:         aws.String(w.manifest.Key + s3ManifestSuffix),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		log.Fatal("Error uploading the manifest ", err)
+	}
+	w.pending.Close()
+	os.Remove(w.pending.Name())
+	os.Remove(w.path)
+	log.Printf("Exported %d messages to s3://%s/%s in %d parts\n",
+		w.manifest.Messages, w.manifest.Bucket, w.manifest.Key, len(w.manifest.Parts))
+}
+
+// save writes the manifest atomically
+func (w *s3Writer) save() error {
+	b, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := w.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// maxMessageSize is the biggest payload SQS accepts for a single message (256KB)
+const maxMessageSize = 256 * 1024
+
+// maxLineSize is the longest input line read, bodies over maxMessageSize go to -oversize-policy (64MB)
+const maxLineSize = 64 << 20
+
+// maxMessageAttributes is the number of message attributes SQS accepts per message
+const maxMessageAttributes = 10
+
+// maxDelaySeconds is the longest delay SQS accepts for a message (15 minutes)
+const maxDelaySeconds = 900
+
+// sendFlags are the flags shared by the commands sending new messages
+type sendFlags struct {
+	batchSize *int
+	group     *string
+	delay     *int64
+	spread    *time.Duration
+	attrs     *attrFlag
+	encrypt   *bool
+	kmsKeyID  *string
+	trace     *string
+}
+
+// sendOptions are the validated sendFlags
+type sendOptions struct {
+	batch    int
+	groupTpl *template.Template
+	delay    int64         // DelaySeconds applied to every message
+	spread   time.Duration // Window over which extra delays are randomly spread
+	attrs    map[string]*sqs.MessageAttributeValue
+	kmsKeyID string          // Bodies are encrypted client-side with this key when set
+	dedup    *deduper        // Skips bodies already sent
+	events   string          // CloudEvents handling, unwrap or validate
+	drop     *messageRewrite // Drops attributes of unwrapped CloudEvents
+	oversize *oversizePolicy // Handles bodies over maxMessageSize, nil fails the send
+	trace    *traceContext   // Trace header injected in every message, -trace
+}
+
+// attrFlag collects repeated -attr Name=Type:value flags
+type attrFlag []string
+
+// messageTemplateData is what the FIFO group template is executed against
+type messageTemplateData struct {
+	Index int         // Position of the message in the input, starting at 0
+	Body  string      // Raw body
+	JSON  interface{} // Decoded body, nil if the body is not JSON
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// send pushes messages read from stdin in a queue
+// each line (or each JSON object with -json) becomes a message
+func send(args []string) {
+	sendCommand := flag.NewFlagSet("send", flag.ExitOnError)
+	queueName := sendCommand.String("queue", "", "queue name")
+	sendCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	jsonStream := sendCommand.Bool("json", false, "read a stream of JSON objects instead of lines")
+	dedupeBy := sendCommand.String("dedupe-by", "", "skip bodies already sent: body-hash, jmespath:QUERY or expr:EXPRESSION")
+	dedupeState := sendCommand.String("dedupe-state", "", "file persisting the keys already sent")
+	cloudEvents := sendCommand.String("cloudevents", "", "CloudEvents JSON input: unwrap or validate")
+	dropAttrs := &attrFlag{}
+	sendCommand.Var(dropAttrs, "drop-attr", "attribute of unwrapped CloudEvents not sent, repeatable")
+	oversizePolicy := sendCommand.String("oversize-policy", "", "messages over 256KB: reject, truncate or s3:BUCKET[/PREFIX]")
+	oversizeReport := sendCommand.String("oversize-report", "", "file listing the rejected messages")
+	flags := newSendFlags(sendCommand)
+	sendHelp := sendCommand.Bool("help", false, "help for send command")
+	sendCommand.BoolVar(sendHelp, "h", false, "help") // Aliasing
+	parseFlags(sendCommand, args)
+
+	if *sendHelp {
+		sendUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		sendUsage()
+	}
+	if sendCommand.NArg() > 0 && sendCommand.Arg(0) != "-" {
+		fmt.Println("Only stdin (-) is supported as a message source.")
+		sendUsage()
+	}
+	if sendCommand.NArg() == 0 && !isPiped(os.Stdin) {
+		fmt.Println("Nothing to send, pipe messages or use - to read stdin.")
+		sendUsage()
+	}
+	opts := flags.options()
+	if len(*dedupeBy) > 0 {
+		if *dedupeBy == dedupeMessageID {
+			log.Fatal("New messages have no ID yet, use body-hash, jmespath:QUERY or expr:EXPRESSION")
+		}
+		var err error
+		if opts.dedup, err = newDeduper(*dedupeBy, *dedupeState); err != nil {
+			log.Fatal(err)
+		}
+	} else if len(*dedupeState) > 0 {
+		log.Fatal("-dedupe-state requires -dedupe-by")
+	}
+	switch *cloudEvents {
+	case "", cloudEventsUnwrap, cloudEventsValidate:
+		opts.events = *cloudEvents
+	default:
+		log.Fatal("-cloudevents must be unwrap or validate")
+	}
+	if len(*dropAttrs) > 0 {
+		if opts.events != cloudEventsUnwrap {
+			log.Fatal("-drop-attr requires -cloudevents unwrap, other messages only have the -attr attributes")
+		}
+		opts.drop = &messageRewrite{drop: make(map[string]bool)}
+		for _, name := range *dropAttrs {
+			opts.drop.drop[name] = true
+		}
+	}
+
+	if len(*oversizeReport) > 0 && *oversizePolicy != oversizeReject {
+		log.Fatal("-oversize-report requires -oversize-policy reject")
+	}
+	if *oversizePolicy == oversizeTruncate && opts.kmsKeyID != "" {
+		log.Fatal("Encrypted bodies can't be truncated, use reject or s3:BUCKET")
+	}
+
+	// Connect
+	svc := newService()
+	q := svc.resolveQueue(*queueName)
+	qURL, fifo := q.url, q.fifo
+	if len(*oversizePolicy) > 0 {
+		var err error
+		if opts.oversize, err = svc.newOversizePolicy(*oversizePolicy, *oversizeReport); err != nil {
+			log.Fatal("Invalid -oversize-policy ", err)
+		}
+	}
+
+	// Stream stdin in batches
+	handleInterrupts()
+	sent := svc.sendBodies(qURL, fifo, opts, newBodyReader(os.Stdin, *jsonStream))
+	if opts.oversize != nil {
+		opts.oversize.summary()
+	}
+	fmt.Fprintf(os.Stderr, "%d messages sent\n", sent)
+	if isInterrupted() {
+		os.Exit(exitInterrupted)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// newSendFlags registers the shared send flags on a command
+func newSendFlags(cmd *flag.FlagSet) *sendFlags {
+	attrs := &attrFlag{}
+	cmd.Var(attrs, "attr", "message attribute Name=Type:value, repeatable")
+	cmd.Var(attrs, "set-attr", "message attribute Name=Type:value, repeatable") // Aliasing
+	return &sendFlags{
+		batchSize: cmd.Int("batch-size", 10, "messages per batch (1-10)"),
+		group:     cmd.String("group", "sqscli", "FIFO message group ID template"),
+		delay:     cmd.Int64("delay-seconds", 0, "delay before messages become visible (0-900)"),
+		spread:    cmd.Duration("spread-over", 0, "randomly spread extra delays over this window"),
+		attrs:     attrs,
+		encrypt:   cmd.Bool("encrypt", false, "encrypt bodies client-side with a KMS data key"),
+		kmsKeyID:  cmd.String("kms-key-id", "", "KMS key ID used by -encrypt"),
+		trace:     cmd.String("trace", "", "trace header injected in every message: xray or w3c"),
+	}
+}
+
+// options validates the flags, exits on invalid values
+func (f *sendFlags) options() sendOptions {
+	if *f.batchSize < 1 || *f.batchSize > 10 {
+		log.Fatal("Batch size must be between 1 and 10")
+	}
+	maxDelay := time.Duration(maxDelaySeconds) * time.Second
+	if *f.delay < 0 || *f.spread < 0 || time.Duration(*f.delay)*time.Second+*f.spread > maxDelay {
+		log.Fatal("Delay plus spread must be between 0 and 15 minutes")
+	}
+	groupTpl, err := template.New("group").Parse(*f.group)
+	if err != nil {
+		log.Fatal("Error parsing group template ", err)
+	}
+	attrs, err := f.attrs.values()
+	if err != nil {
+		log.Fatal("Error parsing attributes ", err)
+	}
+	if *f.encrypt != (len(*f.kmsKeyID) > 0) {
+		log.Fatal("-encrypt and -kms-key-id go together")
+	}
+	trace, err := newTraceContext(*f.trace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return sendOptions{
+		batch:    *f.batchSize,
+		groupTpl: groupTpl,
+		delay:    *f.delay,
+		spread:   *f.spread,
+		attrs:    attrs,
+		kmsKeyID: *f.kmsKeyID,
+		trace:    trace,
+	}
+}
+
+// String implements flag.Value
+func (a *attrFlag) String() string {
+	return strings.Join(*a, ",")
+}
+
+// Set implements flag.Value, called once per -attr
+func (a *attrFlag) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+// values turns the flags into SQS message attributes
+// Binary values starting with @ are read from a file
+func (a *attrFlag) values() (map[string]*sqs.MessageAttributeValue, error) {
+	if len(*a) == 0 {
+		return nil, nil
+	}
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(*a))
+	for _, raw := range *a {
+		eq := strings.Index(raw, "=")
+		colon := strings.Index(raw, ":")
+		if eq < 1 || colon < eq {
+			return nil, fmt.Errorf("%q is not Name=Type:value", raw)
+		}
+		name, dataType, value := raw[:eq], raw[eq+1:colon], raw[colon+1:]
+
+		attr := &sqs.MessageAttributeValue{DataType: aws.String(dataType)}
+		// Custom types look like Number.float
+		switch strings.SplitN(dataType, ".", 2)[0] {
+		case "String":
+			attr.StringValue = aws.String(value)
+		case "Number":
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("attribute %s: %q is not a number", name, value)
+			}
+			attr.StringValue = aws.String(value)
+		case "Binary":
+			b := []byte(value)
+			if strings.HasPrefix(value, "@") {
+				var err error
+				if b, err = ioutil.ReadFile(value[1:]); err != nil {
+					return nil, fmt.Errorf("attribute %s: %s", name, err)
+				}
+			}
+			attr.BinaryValue = b
+		default:
+			return nil, fmt.Errorf("attribute %s: unknown type %q", name, dataType)
+		}
+		attrs[name] = attr
+	}
+	return attrs, nil
+}
+
+// delaySeconds returns the delay of the next message
+func (o sendOptions) delaySeconds() int64 {
+	if o.spread <= 0 {
+		return o.delay
+	}
+	return o.delay + rand.Int63n(int64(o.spread/time.Second)+1)
+}
+
+// newBodyReader returns a function yielding one message body per call
+// and io.EOF once the input is exhausted
+func newBodyReader(r io.Reader, jsonStream bool) func() (string, error) {
+	if jsonStream {
+		dec := json.NewDecoder(r)
+		return func() (string, error) {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return "", err
+			}
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, raw); err != nil {
+				return "", err
+			}
+			return buf.String(), nil
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	return func() (string, error) {
+		for scanner.Scan() {
+			// Skip blank lines, SQS refuses empty bodies
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			return scanner.Text(), nil
+		}
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+}
+
+// executeGroupTemplate renders the FIFO message group ID of a message
+func executeGroupTemplate(tpl *template.Template, index int, body string) (string, error) {
+	data := messageTemplateData{Index: index, Body: body}
+	// Not JSON is fine, JSON just stays nil
+	json.Unmarshal([]byte(body), &data.JSON)
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("empty message group ID for message %d", index)
+	}
+	return buf.String(), nil
+}
+
+// isPiped is true when the file is not a terminal
+func isPiped(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice == 0
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// sendBodies drains the next function and pushes the bodies in batches
+// returns the number of messages sent
+func (s *service) sendBodies(queue string, fifo bool, opts sendOptions, next func() (string, error)) int {
+	// FIFO queues only support a queue level delay
+	if fifo && (opts.delay > 0 || opts.spread > 0) {
+		log.Fatal("Per-message delays are not supported on FIFO queues")
+	}
+	var env *envelope
+	if opts.kmsKeyID != "" {
+		env = s.newEnvelope(opts.kmsKeyID)
+	}
+
+	var entries []*sqs.SendMessageBatchRequestEntry
+	var keys []string // Dedupe keys of the entries
+	sent, skipped, rejected := 0, 0, 0
+	flush := func() {
+		s.sendEntries(queue, entries)
+		sent += len(entries)
+		entries = nil
+		if opts.dedup != nil {
+			opts.dedup.mark(keys)
+			keys = nil
+		}
+	}
+	for !isInterrupted() {
+		body, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal("Error reading messages ", err)
+		}
+		key, keyed := "", false
+		if opts.dedup != nil {
+			key, keyed = opts.dedup.key(body, "")
+			if keyed && (opts.dedup.isSeen(key) || containsString(keys, key)) {
+				skipped++
+				continue
+			}
+		}
+
+		entry := &sqs.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.Itoa(sent + len(entries))),
+			MessageBody: aws.String(body),
+		}
+		if opts.attrs != nil {
+			entry.MessageAttributes = opts.attrs
+		}
+		if len(opts.events) > 0 {
+			index := sent + len(entries)
+			event, err := parseCloudEvent(body)
+			if err != nil {
+				log.Fatalf("Message %d is not a valid CloudEvent: %s\n", index, err)
+			}
+			if opts.events == cloudEventsUnwrap {
+				data, attrs, err := unwrapCloudEvent(event)
+				if err != nil {
+					log.Fatalf("Message %d is not a valid CloudEvent: %s\n", index, err)
+				}
+				// Dropping only lowers the count, checked below
+				opts.drop.apply(attrs)
+				for name, value := range opts.attrs {
+					attrs[name] = value
+				}
+				// Restored exports keep when their messages were first sent
+				if sent, ok := cloudEventTime(event); ok {
+					attrs[originalSentAtAttribute] = &sqs.MessageAttributeValue{
+						DataType:    aws.String("Number"),
+						StringValue: aws.String(strconv.FormatInt(sent.UnixNano()/int64(time.Millisecond), 10)),
+					}
+				}
+				if len(attrs) > maxMessageAttributes {
+					log.Fatalf("Message %d has %d attributes once unwrapped, SQS accepts %d\n", index, len(attrs), maxMessageAttributes)
+				}
+				body = data
+				entry.MessageBody = aws.String(body)
+				entry.MessageAttributes = attrs
+			}
+		}
+		if env != nil {
+			sealed, attrs := env.seal(body)
+			if len(sealed) > maxMessageSize && opts.oversize == nil {
+				log.Fatalf("Message %d is too big once encrypted (%d bytes)\n", sent+len(entries), len(sealed))
+			}
+			for name, value := range opts.attrs {
+				attrs[name] = value
+			}
+			entry.MessageBody = aws.String(sealed)
+			entry.MessageAttributes = attrs
+		}
+		opts.trace.inject(entry)
+		if len(entry.MessageAttributes) > maxMessageAttributes {
+			log.Fatalf("Message %d has %d attributes with -trace, SQS accepts %d\n", sent+len(entries), len(entry.MessageAttributes), maxMessageAttributes)
+		}
+		if size := entrySize(entry); size > maxMessageSize {
+			if opts.oversize == nil {
+				log.Fatalf("Message %d is %d bytes, over the SQS limit, see -oversize-policy\n", sent+len(entries), size)
+			}
+			// Rejected messages keep their input position in the report
+			if !opts.oversize.apply(entry, sent+len(entries)+rejected) {
+				rejected++
+				continue
+			}
+		}
+		if fifo {
+			groupID, err := executeGroupTemplate(opts.groupTpl, sent+len(entries), body)
+			if err != nil {
+				log.Fatal("Error executing group template ", err)
+			}
+			uuid, _ := newUUID()
+			entry.MessageDeduplicationId = aws.String(uuid)
+			entry.MessageGroupId = aws.String(groupID)
+		} else if delay := opts.delaySeconds(); delay > 0 {
+			entry.DelaySeconds = aws.Int64(delay)
+		}
+		// Batches are limited in payload as well as in count
+		if !fitsBatch(entries, entry) {
+			flush()
+		}
+		entries = append(entries, entry)
+		if keyed {
+			keys = append(keys, key)
+		}
+
+		if len(entries) == opts.batch {
+			flush()
+		}
+	}
+	if len(entries) > 0 {
+		flush()
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d messages already sent\n", skipped)
+	}
+	return sent
+}
+
+// sendEntries pushes a single batch of prepared entries in a queue
+func (s *service) sendEntries(queue string, entries []*sqs.SendMessageBatchRequestEntry) {
+	result, err := s.SendMessageBatch(&sqs.SendMessageBatchInput{
+		Entries:  entries,
+		QueueUrl: aws.String(queue),
+	})
+	if err != nil {
+		log.Fatal("Error sending messages ", err)
+	}
+	for _, f := range result.Failed {
+		log.Printf("Message %s was not sent: %s\n", *f.Id, aws.StringValue(f.Message))
+	}
+	if len(result.Failed) > 0 {
+		log.Fatalf("%d messages could not be sent\n", len(result.Failed))
+	}
+	if err := verifySent(entries, result.Successful); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func sendUsage() {
+	fmt.Println("usage: sqscli send [options] [-]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -batch-size       Messages per batch, 1 to 10 (default 10)")
+	fmt.Println("  -json             Read a stream of JSON objects instead of lines")
+	fmt.Println("  -group            FIFO message group ID template (default \"sqscli\")")
+	fmt.Println("                    e.g. '{{.JSON.customerId}}', '{{.Index}}', '{{.Body}}'")
+	fmt.Println("  -delay-seconds    Delay before messages become visible, 0 to 900 (standard queues)")
+	fmt.Println("  -spread-over      Randomly add up to this much delay per message, e.g. 5m")
+	fmt.Println("  -attr             Message attribute Name=Type:value, repeatable, alias -set-attr")
+	fmt.Println("                    e.g. Source=String:billing, Retry=Number:3, Blob=Binary:@file")
+	fmt.Println("  -encrypt          Encrypt bodies client-side, requires -kms-key-id")
+	fmt.Println("  -kms-key-id       KMS key ID used by -encrypt")
+	fmt.Println("  -trace            Trace header injected in every message: xray or w3c")
+	fmt.Println("  -dedupe-by        Skip bodies already sent, keyed by body-hash, jmespath:QUERY or expr:EXPRESSION")
+	fmt.Println("  -dedupe-state     File persisting the keys already sent, for re-runs")
+	fmt.Println("  -cloudevents      CloudEvents JSON input: unwrap (data as body, ce- attributes)")
+	fmt.Println("                    or validate (sent as is)")
+	fmt.Println("  -drop-attr        Attribute of unwrapped CloudEvents not sent, repeatable")
+	fmt.Println("  -oversize-policy  Messages over 256KB: reject, truncate (original size in a")
+	fmt.Println("                    sqscli.truncated attribute) or s3:BUCKET[/PREFIX] (body offloaded,")
+	fmt.Println("                    extended client pointer sent), fails the send by default")
+	fmt.Println("  -oversize-report  File the rejected messages are appended to, as JSON lines")
+	os.Exit(0)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultServiceName is the systemd unit or Windows service of daemon install
+const defaultServiceName = "sqscli"
+
+// serviceConfig is a daemon registered as a service
+type serviceConfig struct {
+	name string
+	exe  string   // The sqscli binary
+	args []string // Global options, daemon and its options
+	user string   // Account the service runs as, root or LocalSystem by default
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// daemonService installs, uninstalls or reports the daemon registered as a service,
+// a systemd unit on Linux or a Windows service
+func daemonService(action string, args []string) {
+	serviceCommand := flag.NewFlagSet("daemon "+action, flag.ExitOnError)
+	name := serviceCommand.String("name", defaultServiceName, "name of the service")
+	configFile := serviceCommand.String("config", "", "YAML file defining the jobs")
+	envFile := serviceCommand.String("env-file", "", "file of KEY=VALUE environment variables, like AWS credentials")
+	user := serviceCommand.String("user", "", "account the service runs as")
+	serviceHelp := serviceCommand.Bool("help", false, "help for daemon "+action+" command")
+	serviceCommand.BoolVar(serviceHelp, "h", false, "help") // Aliasing
+	parseFlags(serviceCommand, args)
+
+	if *serviceHelp {
+		daemonUsage()
+	}
+
+	// Verify
+	if len(*name) == 0 || strings.ContainsAny(*name, `/\ `) {
+		log.Fatalf("Invalid service name %q\n", *name)
+	}
+	if action != "install" {
+		if len(*configFile) > 0 || len(*envFile) > 0 || len(*user) > 0 {
+			log.Fatalf("-config, -env-file and -user only apply to daemon install\n")
+		}
+		if action == "uninstall" {
+			err := uninstallService(*name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Service %s uninstalled\n", *name)
+			return
+		}
+		os.Exit(serviceStatus(*name))
+	}
+	if len(*configFile) == 0 {
+		fmt.Println("Required config file is missing.")
+		daemonUsage()
+	}
+	if _, err := loadDaemonConfig(*configFile); err != nil {
+		log.Fatal(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal("Error locating the sqscli binary ", err)
+	}
+
+	// Services don't start in the current directory
+	args = append(append([]string{}, os.Args[1:len(os.Args)-len(flag.Args())]...), "daemon", "-service", *name, "-config", absPath(*configFile))
+	if len(*envFile) > 0 {
+		if _, err := loadEnvFile(*envFile); err != nil {
+			log.Fatal(err)
+		}
+		args = append(args, "-env-file", absPath(*envFile))
+	}
+	svcConfig := serviceConfig{name: *name, exe: exe, args: args, user: *user}
+	if err := installService(svcConfig); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Service %s installed and started\n", *name)
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// absPath makes a path absolute, fatal if it can't
+func absPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return abs
+}
+
+// loadEnvFile reads KEY=VALUE lines, blank lines and # comments are skipped
+// values may be quoted, the format of env/sqscli.env and systemd environment files
+func loadEnvFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("line %d of %s: expected KEY=VALUE", n, file)
+		}
+		value := strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[strings.TrimSpace(line[:i])] = value
+	}
+	return vars, scanner.Err()
+}
@@ -0,0 +1,123 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// systemdUnitDir is where daemon install writes its unit
+const systemdUnitDir = "/etc/systemd/system"
+
+// systemdUnit restarts the daemon if it exits, and gives its jobs time to finish their in-flight messages
+// KillMode=mixed signals the daemon only, which stops its jobs itself
+// the output goes to the journal: journalctl -u <name>
+var systemdUnit = template.Must(template.New("unit").Parse(`[Unit]
+Description=sqscli daemon {{.Name}}
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart={{.ExecStart}}
+Restart=always
+RestartSec=5
+KillMode=mixed
+TimeoutStopSec={{.StopTimeout}}
+{{if .User}}User={{.User}}
+{{end}}StandardOutput=journal
+StandardError=journal
+SyslogIdentifier={{.Name}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// - - - - - - - - - - - - - - - -
+//   SYSTEMD
+// - - - - - - - - - - - - - - - -
+
+// installService writes the systemd unit of the daemon, then enables and starts it
+func installService(c serviceConfig) error {
+	words := []string{systemdQuote(c.exe)}
+	for _, a := range c.args {
+		words = append(words, systemdQuote(a))
+	}
+	var unit strings.Builder
+	systemdUnit.Execute(&unit, map[string]interface{}{
+		"Name":        c.name,
+		"ExecStart":   strings.Join(words, " "),
+		"StopTimeout": int((jobStopTimeout).Seconds()) + 30,
+		"User":        c.user,
+	})
+	if err := ioutil.WriteFile(unitFile(c.name), []byte(unit.String()), 0644); err != nil {
+		return fmt.Errorf("%s, daemon install needs root", err)
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", "--now", c.name)
+}
+
+// uninstallService stops, disables and removes the systemd unit of the daemon
+func uninstallService(name string) error {
+	if _, err := os.Stat(unitFile(name)); err != nil {
+		return fmt.Errorf("no service %s: %s", name, err)
+	}
+	if err := systemctl("disable", "--now", name); err != nil {
+		return err
+	}
+	if err := os.Remove(unitFile(name)); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+// serviceStatus prints the systemctl status of the daemon and returns its exit code
+func serviceStatus(name string) int {
+	cmd := exec.Command("systemctl", "status", "--no-pager", name)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runService is for Windows services, systemd runs the daemon like a command
+func runService(name string, run func()) bool {
+	return false
+}
+
+// unitFile is the path of the systemd unit of a service
+func unitFile(name string) string {
+	return filepath.Join(systemdUnitDir, name+".service")
+}
+
+// systemctl runs a systemctl command, its output included in the error
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %s %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// systemdQuote quotes a word of ExecStart when it holds spaces, quotes or specifiers
+func systemdQuote(word string) string {
+	word = strings.ReplaceAll(word, "%", "%%")
+	word = strings.ReplaceAll(word, "$", "$$")
+	if !strings.ContainsAny(word, " \t\"'\\") && len(word) > 0 {
+		return word
+	}
+	word = strings.ReplaceAll(word, `\`, `\\`)
+	return `"` + strings.ReplaceAll(word, `"`, `\"`) + `"`
+}
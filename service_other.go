@@ -0,0 +1,33 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errNoServiceManager is returned where neither systemd nor the Windows service manager exists
+var errNoServiceManager = errors.New("daemon install supports systemd and Windows services, run sqscli daemon from launchd or rc.d here")
+
+// installService is not supported on this platform
+func installService(c serviceConfig) error {
+	return errNoServiceManager
+}
+
+// uninstallService is not supported on this platform
+func uninstallService(name string) error {
+	return errNoServiceManager
+}
+
+// serviceStatus is not supported on this platform
+func serviceStatus(name string) int {
+	fmt.Fprintln(os.Stderr, errNoServiceManager)
+	return 1
+}
+
+// runService is for Windows services
+func runService(name string, run func()) bool {
+	return false
+}
@@ -0,0 +1,185 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceRestartDelay is how long the service manager waits to restart a daemon that exited
+const serviceRestartDelay = 5 * time.Second
+
+// serviceStates names the states of a Windows service
+var serviceStates = map[svc.State]string{
+	svc.Stopped:         "stopped",
+	svc.StartPending:    "starting",
+	svc.StopPending:     "stopping",
+	svc.Running:         "running",
+	svc.ContinuePending: "resuming",
+	svc.PausePending:    "pausing",
+	svc.Paused:          "paused",
+}
+
+// daemonHandler runs the daemon under the service manager
+type daemonHandler struct {
+	run func()
+}
+
+// eventLogWriter sends the log lines of the daemon to the Application event log
+type eventLogWriter struct {
+	log *eventlog.Log
+}
+
+// - - - - - - - - - - - - - - - -
+//   WINDOWS SERVICE
+// - - - - - - - - - - - - - - - -
+
+// installService registers the daemon as an automatic Windows service restarted on failure,
+// logging to the Application event log, then starts it
+func installService(c serviceConfig) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("%s, daemon install needs an administrator", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(c.name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists, uninstall it first", c.name)
+	}
+	s, err := m.CreateService(c.name, c.exe, mgr.Config{
+		DisplayName:      "sqscli " + c.name,
+		Description:      "sqscli daemon running scheduled sqscli jobs",
+		StartType:        mgr.StartAutomatic,
+		ServiceStartName: c.user,
+	}, c.args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: serviceRestartDelay}
+	// Failures are forgotten after a day
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, 24*60*60); err != nil {
+		s.Delete()
+		return err
+	}
+	if err := eventlog.InstallAsEventCreate(c.name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+	return s.Start()
+}
+
+// uninstallService stops the daemon service, waiting for its jobs, and removes it
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("%s, daemon uninstall needs an administrator", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("no service %s: %s", name, err)
+	}
+	defer s.Close()
+	status, err := s.Control(svc.Stop)
+	for deadline := time.Now().Add(jobStopTimeout + 30*time.Second); err == nil && status.State != svc.Stopped; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s did not stop", name)
+		}
+		time.Sleep(time.Second)
+		status, err = s.Query()
+	}
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	eventlog.Remove(name)
+	return nil
+}
+
+// serviceStatus prints the state and command line of the daemon service, 0 if it runs
+func serviceStatus(name string) int {
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		fmt.Printf("Service %s is not installed\n", name)
+		return 4
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := s.Config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Service %s is %s\n", name, serviceStates[status.State])
+	fmt.Printf("  Command  %s\n", config.BinaryPathName)
+	fmt.Printf("  Logs     Application event log, source %s\n", name)
+	if status.State != svc.Running {
+		return 3
+	}
+	return 0
+}
+
+// runService runs the daemon as a Windows service, false when started from a console
+func runService(name string, run func()) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	if l, err := eventlog.Open(name); err == nil {
+		defer l.Close()
+		log.SetFlags(0) // Events are timestamped
+		log.SetOutput(eventLogWriter{l})
+	}
+	if err := svc.Run(name, &daemonHandler{run: run}); err != nil {
+		log.Fatal(err)
+	}
+	return true
+}
+
+// Execute reports the daemon running and stops it on request, like an interrupt
+func (h *daemonHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		h.run()
+		close(done)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((jobStopTimeout + 30*time.Second) / time.Millisecond)}
+				interrupt()
+			}
+		}
+	}
+}
+
+// Write logs a line as an event, errors as error events
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	if strings.Contains(line, "Error") {
+		return len(p), w.log.Error(1, line)
+	}
+	return len(p), w.log.Info(1, line)
+}
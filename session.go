@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// sessionEntry is a line of a session file, one per peeked message
+type sessionEntry struct {
+	QueueURL      string `json:"queueUrl"`
+	MessageID     string `json:"messageId"`
+	ReceiptHandle string `json:"receiptHandle"`
+}
+
+// sessionWriter appends entries to a session file
+type sessionWriter struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// sessionCommand acts on the messages recorded in a session file
+// action is one of delete, release or extend
+func sessionCommand(action string, args []string) {
+	cmd := flag.NewFlagSet(action, flag.ExitOnError)
+	sessionFile := cmd.String("session", "", "session file written by peek")
+	timeout := cmd.Int64("timeout", 30, "new visibility timeout in seconds (extend only)")
+	sessionHelp := cmd.Bool("help", false, "help for "+action+" command")
+	cmd.BoolVar(sessionHelp, "h", false, "help") // Aliasing
+	parseFlags(cmd, args)
+
+	if *sessionHelp {
+		sessionUsage(action)
+	}
+
+	// Verify
+	if len(*sessionFile) == 0 {
+		fmt.Println("Required session file is missing.")
+		sessionUsage(action)
+	}
+	if *timeout < 0 || *timeout > maxVisibilityTimeout {
+		log.Fatal("Timeout must be between 0 and 43200 seconds")
+	}
+
+	entries, err := readSession(*sessionFile)
+	if err != nil {
+		log.Fatal("Error reading session ", err)
+	}
+
+	// Connect
+	svc := newService()
+
+	// A session can span queues
+	queues := groupSessionByQueue(entries)
+	if action == "delete" {
+		var names []string
+		deleted := make(map[string]int)
+		for queue, handles := range queues {
+			names = append(names, queueNameFromURL(queue))
+			deleted[queueNameFromURL(queue)] = len(handles)
+		}
+		sort.Strings(names)
+		// Only the messages of the session are deleted, not the whole queue
+		enforceGuardrails(action, names, func(queue string) int { return deleted[queue] }, false)
+		startAudit(action, names...)
+	}
+	var errs []error
+	for queue, handles := range queues {
+		switch action {
+		case "delete":
+			errs = append(errs, svc.deleteReceiptHandles(queue, handles)...)
+		case "release":
+			errs = append(errs, svc.changeVisibilityBatch(queue, handles, 0)...)
+		case "extend":
+			errs = append(errs, svc.changeVisibilityBatch(queue, handles, *timeout)...)
+		}
+	}
+
+	for _, err := range errs {
+		log.Println(err)
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d messages processed\n", len(entries)-len(errs), len(entries))
+	finishAudit(int64(len(entries)-len(errs)), int64(len(errs)))
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// newSessionWriter creates (or truncates) a session file
+func newSessionWriter(file string) *sessionWriter {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal("Error creating session file ", err)
+	}
+	return &sessionWriter{f: f, enc: json.NewEncoder(f)}
+}
+
+// add records a message in the session
+func (w *sessionWriter) add(queue string, m *sqs.Message) {
+	err := w.enc.Encode(sessionEntry{
+		QueueURL:      queue,
+		MessageID:     aws.StringValue(m.MessageId),
+		ReceiptHandle: aws.StringValue(m.ReceiptHandle),
+	})
+	if err != nil {
+		log.Fatal("Error writing session file ", err)
+	}
+}
+
+// close flushes the session file to disk
+func (w *sessionWriter) close() {
+	if err := w.f.Sync(); err != nil {
+		log.Println("Error syncing session file", err)
+	}
+	w.f.Close()
+}
+
+// readSession loads all entries of a session file
+func readSession(file string) ([]sessionEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []sessionEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e sessionEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// groupSessionByQueue returns the receipt handles of a session per queue URL
+func groupSessionByQueue(entries []sessionEntry) map[string][]string {
+	byQueue := make(map[string][]string)
+	for _, e := range entries {
+		byQueue[e.QueueURL] = append(byQueue[e.QueueURL], e.ReceiptHandle)
+	}
+	return byQueue
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// deleteReceiptHandles deletes messages by receipt handle in batches of 10
+// returns one error per message that could not be deleted
+func (s *service) deleteReceiptHandles(queue string, handles []string) []error {
+	var errors []error
+
+	for i := 0; i < len(handles); i += 10 {
+		j := i + 10
+		if j > len(handles) {
+			j = len(handles)
+		}
+		var entries []*sqs.DeleteMessageBatchRequestEntry
+		for n, h := range handles[i:j] {
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i + n)),
+				ReceiptHandle: aws.String(h),
+			})
+		}
+
+		result, err := s.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			Entries:  entries,
+			QueueUrl: aws.String(queue),
+		})
+		if err != nil {
+			for range entries {
+				errors = append(errors, err)
+			}
+			continue
+		}
+		for _, f := range result.Failed {
+			errors = append(errors, fmt.Errorf("message %s: %s", *f.Id, aws.StringValue(f.Message)))
+		}
+	}
+	return errors
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func sessionUsage(action string) {
+	fmt.Printf("usage: sqscli %s [options]\n", action)
+	fmt.Println("options:")
+	fmt.Println("  -session required   Session file written by peek -session")
+	if action == "extend" {
+		fmt.Println("  -timeout            New visibility timeout in seconds (default 30)")
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// maxIdleConnsPerHost keeps a connection per concurrent receiver, sender and deleter
+// alive between calls, net/http keeps 2 by default
+const maxIdleConnsPerHost = 4 * maxReceivers
+
+// clientKey identifies a cached client
+// clients are per session, sessions of other profiles or accounts get their own
+type clientKey struct {
+	service  string           // sqs, kms, s3...
+	sess     *session.Session // Credentials the client signs with
+	region   string
+	endpoint string // Empty for the endpoint of the partition
+}
+
+// connections caches sessions and clients, so commands working on several queues or
+// regions reuse them, and their pooled connections, instead of building them per call
+// a session is created per region, the emulator and replays have no regions and share one
+var connections = struct {
+	sync.Mutex
+	sessions map[string]*session.Session
+	clients  map[clientKey]interface{}
+}{
+	sessions: make(map[string]*session.Session),
+	clients:  make(map[clientKey]interface{}),
+}
+
+// - - - - - - - - - - - - - - - -
+//   SESSION CACHE
+// - - - - - - - - - - - - - - - -
+
+// regionSession returns the session of a region, connecting it the first time
+func regionSession(region string) *session.Session {
+	key := region
+	if localMode || len(replayDir) > 0 {
+		key = ""
+	}
+	connections.Lock()
+	defer connections.Unlock()
+	if sess, ok := connections.sessions[key]; ok {
+		return sess
+	}
+	var sess *session.Session
+	switch {
+	case len(replayDir) > 0:
+		sess = newReplaySession(replayDir)
+	case localMode:
+		sess = newLocalSession(localStateFile)
+	case len(awsProfile) > 0:
+		sess = newProfileSession(region, awsProfile, "")
+		checkAccount(sess)
+	default:
+		sess = newAWSSession(region)
+		checkAccount(sess)
+	}
+	instrumentSession(sess)
+	connections.sessions[key] = sess
+	return sess
+}
+
+// accountSession returns the session of a region with the credentials of a shared config profile
+// or of an env file, connecting it the first time
+// without either, or against the emulator or a replay, it is the session of the region
+func accountSession(region, profile, envFile string) *session.Session {
+	if (len(profile) == 0 && len(envFile) == 0) || localMode || len(replayDir) > 0 {
+		return regionSession(region)
+	}
+	key := region + "|" + profile + "|" + envFile
+	connections.Lock()
+	defer connections.Unlock()
+	if sess, ok := connections.sessions[key]; ok {
+		return sess
+	}
+	sess := newProfileSession(region, profile, envFile)
+	instrumentSession(sess)
+	connections.sessions[key] = sess
+	return sess
+}
+
+// instrumentSession adds the recording, failure injection, counters and tracing of the run to a session
+func instrumentSession(sess *session.Session) {
+	if len(recordDir) > 0 {
+		recordSession(sess, recordDir)
+	}
+	if len(failureRates) > 0 {
+		injectFailures(sess, failureRates)
+	}
+	if readOnly {
+		blockMutations(sess)
+	}
+	countRetries(sess)
+	countThrottles(sess)
+	readyOnSuccess(sess)
+	traceCalls(sess)
+}
+
+// cachedClient returns the client of key, built by create the first time
+func cachedClient(key clientKey, create func() interface{}) interface{} {
+	connections.Lock()
+	defer connections.Unlock()
+	c, ok := connections.clients[key]
+	if !ok {
+		c = create()
+		connections.clients[key] = c
+	}
+	return c
+}
+
+// sqsClient returns the SQS client of a region, through endpoint when set
+func sqsClient(sess *session.Session, region, endpoint string) *sqs.SQS {
+	return cachedClient(clientKey{"sqs", sess, region, endpoint}, func() interface{} {
+		if len(endpoint) > 0 {
+			return sqs.New(sess, aws.NewConfig().WithEndpoint(endpoint))
+		}
+		return sqs.New(sess)
+	}).(*sqs.SQS)
+}
+
+// kmsClient returns the KMS client of the region of a session
+func kmsClient(sess *session.Session) *kms.KMS {
+	return cachedClient(clientKey{"kms", sess, aws.StringValue(sess.Config.Region), ""}, func() interface{} {
+		return kms.New(sess)
+	}).(*kms.KMS)
+}
+
+// s3Client returns the S3 client of the region of a session
+func s3Client(sess *session.Session) *s3.S3 {
+	return cachedClient(clientKey{"s3", sess, aws.StringValue(sess.Config.Region), ""}, func() interface{} {
+		return s3.New(sess)
+	}).(*s3.S3)
+}
+
+// cloudWatchClient returns the CloudWatch client of the region of a session
+func cloudWatchClient(sess *session.Session) *cloudwatch.CloudWatch {
+	return cachedClient(clientKey{"cloudwatch", sess, aws.StringValue(sess.Config.Region), ""}, func() interface{} {
+		return cloudwatch.New(sess)
+	}).(*cloudwatch.CloudWatch)
+}
+
+// snsClient returns the SNS client of a region, the one of the topic published to
+func snsClient(sess *session.Session, region string) *sns.SNS {
+	return cachedClient(clientKey{"sns", sess, region, ""}, func() interface{} {
+		return sns.New(sess, aws.NewConfig().WithRegion(region))
+	}).(*sns.SNS)
+}
+
+// dynamoDBClient returns the DynamoDB client of the region of a session
+func dynamoDBClient(sess *session.Session) *dynamodb.DynamoDB {
+	return cachedClient(clientKey{"dynamodb", sess, aws.StringValue(sess.Config.Region), ""}, func() interface{} {
+		return dynamodb.New(sess)
+	}).(*dynamodb.DynamoDB)
+}
+
+// stsClient returns the STS client of the region of a session
+func stsClient(sess *session.Session) *sts.STS {
+	return cachedClient(clientKey{"sts", sess, aws.StringValue(sess.Config.Region), ""}, func() interface{} {
+		return sts.New(sess)
+	}).(*sts.STS)
+}
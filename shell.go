@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// shellHistoryMax is the number of lines the history file keeps
+const shellHistoryMax = 1000
+
+// shellQueueFlags are the commands the shell gives the current queue to, and the flag taking it
+// with their alias, the current queue is used when neither is given
+var shellQueueFlags = map[string][2]string{
+	"qtocsv":            {"queue", "q"},
+	"qtoq":              {"queue1", "q1"},
+	"send":              {"queue", "q"},
+	"generate":          {"queue", "q"},
+	"peek":              {"queue", "q"},
+	"head":              {"queue", "q"},
+	"change-visibility": {"queue", "q"},
+	"stats":             {"queue", "q"},
+	"count":             {"queue", "q"},
+	"watch":             {"queue", "q"},
+	"purge":             {"queue", "q"},
+	"expire":            {"queue", "q"},
+	"lag":               {"queue", "q"},
+	"poison-report":     {"queue", "q"},
+	"fifo-verify":       {"queue", "q"},
+	"split":             {"queue", "q"},
+	"mirror":            {"queue", "q"},
+	"park":              {"queue", "q"},
+	"unpark":            {"queue", "q"},
+	"audit":             {"queue", "q"},
+	"set-attrs":         {"queue", "q"},
+	"canary":            {"queue", "q"},
+	"fill":              {"queue", "q"},
+	"drain":             {"queue", "q"},
+	"diff":              {"queue1", "q1"},
+}
+
+// shellSession is the state of a shell: the current queue and the lines entered
+type shellSession struct {
+	exe      string              // The sqscli binary
+	globals  []string            // Global options of the shell, passed on to each command
+	queue    string              // Current queue, see use
+	sources  map[string][]string // Queues redriving to each DLQ, see redrive
+	history  []string
+	file     string // History file, empty to keep none
+	running  int32  // A command is running, interrupts are its own
+	interact bool   // Reading from a terminal
+	svc      *service
+}
+
+// - - - - - - - - - - - - - - - -
+//   SHELL COMMAND
+// - - - - - - - - - - - - - - - -
+
+// shell reads sqscli commands at a prompt and runs each in a sqscli process of its own, with the same
+// global options, the current queue set by use filling in their -queue
+func shell(args []string) {
+	shellCommand := flag.NewFlagSet("shell", flag.ExitOnError)
+	historyFile := shellCommand.String("history", defaultShellHistory(), "file keeping the command history, empty for none")
+	queueName := shellCommand.String("queue", "", "current queue to start with")
+	shellCommand.StringVar(queueName, "q", "", "current queue to start with") // Aliasing
+	shellHelp := shellCommand.Bool("help", false, "help for shell command")
+	shellCommand.BoolVar(shellHelp, "h", false, "help") // Aliasing
+	parseFlags(shellCommand, args)
+
+	if *shellHelp {
+		shellUsage()
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal("Error locating the sqscli binary ", err)
+	}
+	sh := &shellSession{
+		exe: exe,
+		// Everything before the command name, the health endpoints and operation are the shell's
+		globals:  withoutFlag(withoutFlag(os.Args[1:len(os.Args)-len(flag.Args())], "health"), "operation-id"),
+		sources:  make(map[string][]string),
+		interact: !isPiped(os.Stdin),
+	}
+	os.Unsetenv(envName("", "health"))
+	if sh.interact {
+		sh.file = *historyFile
+		sh.loadHistory()
+	}
+	if len(*queueName) > 0 {
+		sh.use(*queueName)
+	}
+
+	// Interrupts go to the running command, the shell stays
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			if atomic.LoadInt32(&sh.running) == 0 && sh.interact {
+				fmt.Fprint(os.Stderr, "\n"+sh.prompt())
+			}
+		}
+	}()
+
+	if sh.interact {
+		fmt.Fprintln(os.Stderr, "sqscli shell, help lists the commands, exit or Ctrl-D leaves")
+	}
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		if sh.interact {
+			fmt.Fprint(os.Stderr, sh.prompt())
+		}
+		if !in.Scan() {
+			break
+		}
+		line := strings.TrimSpace(in.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line, err = sh.expandHistory(line); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		sh.remember(line)
+		if !sh.exec(line) {
+			break
+		}
+	}
+	if sh.interact {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// exec runs a line, false once the shell should exit
+func (sh *shellSession) exec(line string) bool {
+	words, err := splitShellWords(line)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return true
+	}
+	switch words[0] {
+	case "exit", "quit":
+		return false
+	case "help":
+		shellCommands()
+	case "history":
+		for i, h := range sh.history {
+			fmt.Printf("%5d  %s\n", i+1, h)
+		}
+	case "use":
+		if len(words) > 2 {
+			fmt.Fprintln(os.Stderr, "usage: use [QUEUE|-]")
+			break
+		}
+		if len(words) == 1 {
+			sh.listQueues()
+			break
+		}
+		sh.use(words[1])
+	case "redrive":
+		// redrive [QUEUE] [qtoq options], to the queue the current one is the DLQ of by default
+		if len(sh.queue) == 0 {
+			fmt.Fprintln(os.Stderr, "No current queue, use QUEUE first")
+			break
+		}
+		target, options := "", words[1:]
+		if len(options) > 0 && !strings.HasPrefix(options[0], "-") {
+			target, options = options[0], options[1:]
+		}
+		if len(target) == 0 {
+			if target, err = sh.redriveSource(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				break
+			}
+		}
+		sh.run(append([]string{"qtoq", "-queue1", sh.queue, "-queue2", target}, options...))
+	case "shell":
+		fmt.Fprintln(os.Stderr, "Already in the shell")
+	default:
+		// peek 5 peeks 5 messages
+		if words[0] == "peek" && len(words) == 2 {
+			if _, err := strconv.Atoi(words[1]); err == nil {
+				words = []string{"peek", "-n", words[1]}
+			}
+		}
+		sh.run(sh.withQueue(words))
+	}
+	return true
+}
+
+// use sets the current queue, checking it exists, - clears it
+func (sh *shellSession) use(name string) {
+	if name == "-" {
+		sh.queue = ""
+		return
+	}
+	if sh.svc == nil {
+		sh.svc = newService()
+	}
+	// use 2 picks the second recent queue
+	if n, err := strconv.Atoi(name); err == nil {
+		recents := sh.svc.recentQueueNames()
+		if n < 1 || n > len(recents) {
+			fmt.Fprintf(os.Stderr, "No recent queue %d, use lists them\n", n)
+			return
+		}
+		name = recents[n-1]
+	}
+	queue, err := lookupBookmark(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	out, err := sh.svc.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "No queue %s: %s\n", queue, err)
+		return
+	}
+	q := sh.svc.queueAt(aws.StringValue(out.QueueUrl))
+	sh.queue = q.name
+	sh.svc.rememberQueue(q.name)
+	fmt.Printf("%s: %d messages\n", q.name, q.depth())
+}
+
+// listQueues prints the current queue, then the queues used lately, most recent first, and the bookmarks
+func (sh *shellSession) listQueues() {
+	if sh.svc == nil {
+		sh.svc = newService()
+	}
+	if len(sh.queue) > 0 {
+		fmt.Println("Current queue:", sh.queue)
+	} else {
+		fmt.Println("No current queue, use QUEUE sets one")
+	}
+	if recents := sh.svc.recentQueueNames(); len(recents) > 0 {
+		fmt.Println("Recent queues, use N picks one:")
+		for i, name := range recents {
+			fmt.Printf("  %2d) %s\n", i+1, name)
+		}
+	}
+	bookmarks := loadBookmarks().Bookmarks
+	names := make([]string, 0, len(bookmarks))
+	for name := range bookmarks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		fmt.Println("Bookmarks, use @NAME:")
+		for _, name := range names {
+			fmt.Printf("  %s%s  %s\n", bookmarkRef, name, bookmarks[name].Queue)
+		}
+	}
+}
+
+// withQueue gives the current queue to the commands taking one, unless the command names its own
+func (sh *shellSession) withQueue(words []string) []string {
+	flags, ok := shellQueueFlags[words[0]]
+	if !ok || len(sh.queue) == 0 {
+		return words
+	}
+	for _, w := range words[1:] {
+		name := strings.SplitN(strings.TrimLeft(w, "-"), "=", 2)[0]
+		if strings.HasPrefix(w, "-") && (name == flags[0] || name == flags[1] || name == "help" || name == "h") {
+			return words
+		}
+	}
+	return append([]string{words[0], "-" + flags[0], sh.queue}, words[1:]...)
+}
+
+// run runs a sqscli command with the global options of the shell, attached to the terminal
+func (sh *shellSession) run(words []string) {
+	cmd := exec.Command(sh.exe, append(append([]string{}, sh.globals...), words...)...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// Piped lines are the shell's, not the command's
+	if sh.interact {
+		cmd.Stdin = os.Stdin
+	}
+	atomic.StoreInt32(&sh.running, 1)
+	defer atomic.StoreInt32(&sh.running, 0)
+	if err := cmd.Run(); err != nil {
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) {
+			fmt.Fprintln(os.Stderr, "Error running", words[0], err)
+			return
+		}
+		if code := exit.ExitCode(); code > 0 && sh.interact {
+			fmt.Fprintf(os.Stderr, "exit %d\n", code)
+		}
+	}
+}
+
+// redriveSource finds the queue the current queue is the dead-letter queue of
+func (sh *shellSession) redriveSource() (string, error) {
+	sources, ok := sh.sources[sh.queue]
+	if !ok {
+		if sh.svc == nil {
+			sh.svc = newService()
+		}
+		dlq := sh.svc.resolveQueue(sh.queue).arn()
+		for _, qURL := range sh.svc.listQueues("") {
+			if p, ok := parseRedrivePolicy(sh.svc.getQueueAttributes(qURL).Attributes); ok && p.DeadLetterTargetArn == dlq {
+				sources = append(sources, queueNameFromURL(qURL))
+			}
+		}
+		sh.sources[sh.queue] = sources
+	}
+	switch len(sources) {
+	case 0:
+		return "", fmt.Errorf("no queue has %s as dead-letter queue, give the destination: redrive QUEUE", sh.queue)
+	case 1:
+		return sources[0], nil
+	}
+	return "", fmt.Errorf("%s is the dead-letter queue of %s, give the destination: redrive QUEUE", sh.queue, strings.Join(sources, ", "))
+}
+
+// prompt shows the environment, of -env or else set by use-env, and the current queue
+func (sh *shellSession) prompt() string {
+	prompt := "sqscli"
+	env := os.Getenv(envName("", "env"))
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "env" {
+			env = f.Value.String()
+		}
+	})
+	if len(env) == 0 {
+		env = defaultEnvironment()
+	}
+	if len(env) > 0 {
+		prompt += "(" + env + ")"
+	}
+	if len(sh.queue) > 0 {
+		prompt += " " + sh.queue
+	}
+	return prompt + "> "
+}
+
+// splitShellWords splits a line into words like a shell, with single and double quotes and backslashes
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   HISTORY
+// - - - - - - - - - - - - - - - -
+
+// defaultShellHistory is ~/.sqscli/history
+func defaultShellHistory() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sqscli", "history")
+}
+
+// loadHistory reads the lines of the earlier shells, the last shellHistoryMax are kept
+func (sh *shellSession) loadHistory() {
+	if len(sh.file) == 0 {
+		return
+	}
+	b, err := ioutil.ReadFile(sh.file)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(lines) > shellHistoryMax {
+		lines = lines[len(lines)-shellHistoryMax:]
+		ioutil.WriteFile(sh.file, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+	for _, l := range lines {
+		if len(l) > 0 {
+			sh.history = append(sh.history, l)
+		}
+	}
+}
+
+// remember adds a line to the history, and to the history file
+func (sh *shellSession) remember(line string) {
+	if n := len(sh.history); n > 0 && sh.history[n-1] == line {
+		return
+	}
+	sh.history = append(sh.history, line)
+	if len(sh.file) == 0 {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(sh.file), 0700); err != nil {
+		return
+	}
+	f, err := os.OpenFile(sh.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// expandHistory replaces !! by the last line and !N by line N of history
+func (sh *shellSession) expandHistory(line string) (string, error) {
+	if !strings.HasPrefix(line, "!") {
+		return line, nil
+	}
+	n := len(sh.history)
+	if line != "!!" {
+		var err error
+		if n, err = strconv.Atoi(line[1:]); err != nil {
+			return "", fmt.Errorf("%s: expected !! or !N", line)
+		}
+	}
+	if n < 1 || n > len(sh.history) {
+		return "", fmt.Errorf("%s: no such line in history", line)
+	}
+	fmt.Fprintln(os.Stderr, sh.history[n-1])
+	return sh.history[n-1], nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func shellUsage() {
+	fmt.Println("usage: sqscli shell [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue            Current queue to start with")
+	fmt.Println("  -history          File keeping the command history, empty for none (default ~/.sqscli/history)")
+	fmt.Println("Commands are read from stdin, one per line, see help in the shell")
+	os.Exit(0)
+}
+
+// shellCommands lists the commands of the shell
+func shellCommands() {
+	fmt.Println("Any sqscli command runs with the global options of the shell, like peek -n 5 or qtocsv -format yaml,")
+	fmt.Println("the current queue is its -queue (-queue1 of qtoq and diff) unless it is given one")
+	fmt.Println(" use [QUEUE|@NAME|N|-]")
+	fmt.Println("                    Set the current queue, by name, bookmark or number of the recent queues,")
+	fmt.Println("                    clear it (-), or list the recent queues and bookmarks")
+	fmt.Println(" peek [N]           Peek N messages of the current queue")
+	fmt.Println(" count              Count the messages of the current queue")
+	fmt.Println(" redrive [QUEUE]    Move the messages of the current queue back to the queue it is the DLQ of, or to QUEUE")
+	fmt.Println(" history            List the lines entered, !N runs line N again, !! the last one")
+	fmt.Println(" help               List the commands")
+	fmt.Println(" exit               Leave the shell, like Ctrl-D")
+}
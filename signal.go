@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// exitInterrupted is the exit code of a run stopped by SIGINT or SIGTERM
+const exitInterrupted = 130
+
+var (
+	// interrupted is closed on the first SIGINT or SIGTERM
+	interrupted   = make(chan struct{})
+	interruptOnce sync.Once
+)
+
+// - - - - - - - - - - - - - - - -
+//   SIGNALS
+// - - - - - - - - - - - - - - - -
+
+// handleInterrupts asks running commands to stop on SIGINT or SIGTERM
+// they stop receiving and finish the messages already in flight
+// a second signal exits right away
+func handleInterrupts() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "Interrupted, finishing in-flight messages (interrupt again to force)")
+		interrupt()
+		<-signals
+		fmt.Fprintln(os.Stderr, "Forced exit, in-flight messages will reappear after their visibility timeout")
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// interrupt asks running commands to stop, like a first SIGINT
+// a Windows service is stopped through it
+func interrupt() {
+	interruptOnce.Do(func() { close(interrupted) })
+}
+
+// isInterrupted is true once a stop was requested
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// exitIfInterrupted prints a summary and exits with exitInterrupted
+// if the run was stopped before the queue was exhausted
+func (s *service) exitIfInterrupted(queue string, processed int) {
+	if !isInterrupted() {
+		return
+	}
+	attr := s.getQueueAttributes(queue)
+	fmt.Fprintf(os.Stderr, "Interrupted: %d messages processed, about %s remaining (%s in flight)\n",
+		processed,
+		aws.StringValue(attr.Attributes["ApproximateNumberOfMessages"]),
+		aws.StringValue(attr.Attributes["ApproximateNumberOfMessagesNotVisible"]))
+	finishReport()
+	// Deferred calls don't run on exit
+	if c, ok := output.(io.Closer); ok {
+		c.Close()
+	}
+	os.Exit(exitInterrupted)
+}
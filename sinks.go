@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Schemes of the -sink URIs
+const (
+	sinkStdout   = "-"
+	sinkFile     = "file"
+	sinkS3       = "s3"
+	sinkSQLite   = "sqlite"
+	sinkDynamoDB = "dynamodb"
+	sinkKafka    = "kafka"
+	sinkWebhook  = "webhook"
+	sinkPlugin   = "plugin"
+)
+
+// messageSink is where the messages a command writes out go, one at a time
+// a message is stored once Write returns, or once Flush returns for the sinks buffering them,
+// and only then deleted from its queue: a new destination is a type implementing it,
+// added to newMessageSink
+type messageSink interface {
+	Write(m *sqs.Message) error
+	Close() error
+}
+
+// streamSink writes JSON lines to stdout or a file
+type streamSink struct {
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// s3Sink puts each message in its own object, under a key prefix
+type s3Sink struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+// sqliteSink inserts the messages in a table of a SQLite database, through the sqlite3 command
+// sqscli carries no SQLite driver, the inserts of a batch are committed by Flush
+type sqliteSink struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// dynamoDBSink puts each message as an item of a table keyed by messageId
+type dynamoDBSink struct {
+	client *dynamodb.DynamoDB
+	table  string
+}
+
+// kafkaSink produces the messages to a topic through a Kafka REST Proxy, a batch per Flush
+type kafkaSink struct {
+	client  *http.Client
+	url     string // https://proxy:8082/topics/TOPIC
+	pending []kafkaRecord
+}
+
+// kafkaRecord is a record of the REST Proxy v2 JSON API, keyed by message ID
+type kafkaRecord struct {
+	Key   string        `json:"key"`
+	Value peekedMessage `json:"value"`
+}
+
+// webhookSink posts each message as JSON
+type webhookSink struct {
+	client *http.Client
+	url    string
+}
+
+// - - - - - - - - - - - - - - - -
+//   SINKS
+// - - - - - - - - - - - - - - - -
+
+// parseSinkURI splits a -sink URI into its scheme and target
+// -, file:PATH, s3://BUCKET/PREFIX, sqlite:PATH, dynamodb:TABLE, kafka:PROXY_TOPIC_URL,
+// webhook:URL, a plain http(s) URL or plugin:NAME
+func parseSinkURI(uri string) (string, string, error) {
+	switch {
+	case uri == sinkStdout:
+		return sinkStdout, "", nil
+	case strings.HasPrefix(uri, "s3://"):
+		if len(strings.SplitN(strings.TrimPrefix(uri, "s3://"), "/", 2)[0]) == 0 {
+			return "", "", fmt.Errorf("invalid S3 sink %q, expected s3://BUCKET/PREFIX", uri)
+		}
+		return sinkS3, uri, nil
+	case strings.HasPrefix(uri, "http://"), strings.HasPrefix(uri, "https://"):
+		return sinkWebhook, uri, nil
+	}
+	parts := strings.SplitN(uri, ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("invalid sink %q, expected -, file:PATH, s3://BUCKET/PREFIX, sqlite:PATH, dynamodb:TABLE, kafka:URL, webhook:URL or plugin:NAME", uri)
+	}
+	switch parts[0] {
+	case sinkFile, sinkSQLite, sinkDynamoDB, sinkPlugin:
+	case sinkKafka, sinkWebhook:
+		if !strings.HasPrefix(parts[1], "http://") && !strings.HasPrefix(parts[1], "https://") {
+			return "", "", fmt.Errorf("invalid %s sink %q, expected an http(s) URL", parts[0], parts[1])
+		}
+	default:
+		return "", "", fmt.Errorf("unknown sink %q, expected -, file, s3, sqlite, dynamodb, kafka, webhook or plugin", parts[0])
+	}
+	return parts[0], parts[1], nil
+}
+
+// newMessageSink opens the sink of a -sink URI
+func (s *service) newMessageSink(uri string) (messageSink, error) {
+	scheme, target, err := parseSinkURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case sinkStdout:
+		return newStreamSink(os.Stdout), nil
+	case sinkFile:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamSink(f), nil
+	case sinkS3:
+		rest := strings.TrimPrefix(target, "s3://")
+		parts := strings.SplitN(rest, "/", 2)
+		prefix := ""
+		if len(parts) == 2 {
+			prefix = parts[1]
+		}
+		return &s3Sink{client: s3Client(s.sess), bucket: parts[0], prefix: prefix}, nil
+	case sinkSQLite:
+		return newSQLiteSink(target)
+	case sinkDynamoDB:
+		return &dynamoDBSink{client: dynamoDBClient(s.sess), table: target}, nil
+	case sinkKafka:
+		client, err := newHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		return &kafkaSink{client: client, url: target}, nil
+	case sinkPlugin:
+		p, err := startPlugin(sinkPluginPrefix, target)
+		if err != nil {
+			return nil, err
+		}
+		return &pluginSink{p: p}, nil
+	default:
+		client, err := newHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		client.Timeout = alertTimeout
+		return &webhookSink{client: client, url: target}, nil
+	}
+}
+
+// newSinkRecord returns the record of a message, decrypted and with the -time-format timestamps
+func newSinkRecord(m *sqs.Message) peekedMessage {
+	return peekedMessage{
+		MessageID:         aws.StringValue(m.MessageId),
+		Body:              messageBody(m),
+		Attributes:        formattedAttributes(m.Attributes),
+		MessageAttributes: m.MessageAttributes,
+	}
+}
+
+// flushSink stores what a sink buffered, for the sinks that buffer
+func flushSink(sink messageSink) error {
+	if f, ok := sink.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// writeToSink writes a batch to a sink and flushes it, returning the messages stored
+// a FIFO batch stays in order, the messages after a failure are not written
+func writeToSink(sink messageSink, batch []*sqs.Message) ([]*sqs.Message, error) {
+	var written []*sqs.Message
+	var failure error
+	for _, m := range batch {
+		if err := sink.Write(m); err != nil {
+			failure = err
+			break
+		}
+		written = append(written, m)
+	}
+	// Nothing buffered is known to be stored until the flush succeeds
+	if err := flushSink(sink); err != nil {
+		return nil, err
+	}
+	return written, failure
+}
+
+// sinkStage writes each batch to the sink then deletes it from the queue
+// only messages that were stored are deleted, the others are released right away
+// returns the number of messages written
+func (s *service) sinkStage(from string, sink messageSink, acks chan<- struct{}, in <-chan []*sqs.Message) (int, []error) {
+	var errors []error
+	total := 0
+	for batch := range in {
+		written, err := writeToSink(sink, batch)
+		if err != nil {
+			log.Println("Error writing messages", err)
+			noteFailure(err)
+			errors = append(errors, err)
+		}
+		atomic.AddInt64(&tally.written, int64(len(written)))
+		atomic.AddInt64(&tally.failed, int64(len(batch)-len(written)))
+		if len(written) > 0 {
+			atomic.AddInt64(&tally.deleted, int64(s.deleteMessageBatch(from, written)))
+			total += len(written)
+		}
+		if len(written) < len(batch) {
+			s.changeVisibilityBatch(from, unsentReceipts(batch, written), 0)
+		}
+		if acks != nil {
+			acks <- struct{}{}
+		}
+	}
+	return total, errors
+}
+
+// toSink moves the messages of a queue to a sink, qtoq -sink
+// they are deleted once the sink stored them
+func toSink(qFrom, fromRegion, uri string, opts moveOptions) {
+	// Verify
+	if len(qFrom) == 0 {
+		fmt.Println("Required argument is missing.")
+		toQUsage()
+	}
+	if len(fromRegion) == 0 {
+		fromRegion = awsRegion
+	}
+
+	// Connect
+	svc := newRegionService(fromRegion)
+	handleInterrupts()
+	q := svc.resolveQueue(qFrom)
+	sink, err := svc.newMessageSink(uri)
+	if err != nil {
+		log.Fatal("Error opening the sink ", err)
+	}
+
+	// Apply
+	acks := newAcks(q.fifo)
+	in := svc.receiveStage(q, nil, opts.filter, acks, opts.concurrency)
+	processed, errs := svc.sinkStage(q.url, sink, acks, in)
+	if err := sink.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	svc.exitIfInterrupted(q.url, processed)
+	if len(errs) > 0 {
+		failReport()
+		finishReport()
+		log.Fatal("There were errors writing the messages", errs)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   STDOUT AND FILES
+// - - - - - - - - - - - - - - - -
+
+// newStreamSink returns a sink of JSON lines
+func newStreamSink(w io.Writer) *streamSink {
+	return &streamSink{w: w, enc: json.NewEncoder(w)}
+}
+
+// Write appends the message as a JSON line
+func (s *streamSink) Write(m *sqs.Message) error {
+	return s.enc.Encode(newSinkRecord(m))
+}
+
+// Flush syncs a file, so the messages are on disk before they are deleted
+func (s *streamSink) Flush() error {
+	if f, ok := s.w.(*os.File); ok && f != os.Stdout {
+		return f.Sync()
+	}
+	return nil
+}
+
+// Close closes a file, stdout stays open
+func (s *streamSink) Close() error {
+	if f, ok := s.w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   S3
+// - - - - - - - - - - - - - - - -
+
+// Write puts the message in PREFIX/MESSAGE_ID.json
+func (s *s3Sink) Write(m *sqs.Message) error {
+	b, err := json.Marshal(newSinkRecord(m))
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.prefix + aws.StringValue(m.MessageId) + ".json"),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// Close does nothing, every object is already put
+func (s *s3Sink) Close() error {
+	return nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   SQLITE
+// - - - - - - - - - - - - - - - -
+
+// newSQLiteSink starts sqlite3 on a database, creating the messages table if needed
+func newSQLiteSink(path string) (*sqliteSink, error) {
+	bin, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return nil, fmt.Errorf("sqlite sinks need the sqlite3 command: %s", err)
+	}
+	s := &sqliteSink{cmd: exec.Command(bin, "-bail", "-batch", path)}
+	s.cmd.Stderr = os.Stderr
+	if s.in, err = s.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	out, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	s.out = bufio.NewReader(out)
+	if err := s.cmd.Start(); err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(s.in, "CREATE TABLE IF NOT EXISTS messages (message_id TEXT PRIMARY KEY, body TEXT, "+
+		"attributes TEXT, message_attributes TEXT, written_at TEXT);\nBEGIN;\n")
+	if err != nil {
+		return nil, err
+	}
+	return s, s.Flush()
+}
+
+// Write inserts the message, replacing a message of the same ID
+func (s *sqliteSink) Write(m *sqs.Message) error {
+	r := newSinkRecord(m)
+	attrs, _ := json.Marshal(r.Attributes)
+	messageAttrs, _ := json.Marshal(r.MessageAttributes)
+	_, err := fmt.Fprintf(s.in, "INSERT OR REPLACE INTO messages VALUES (%s, %s, %s, %s, %s);\n",
+		sqlQuote(r.MessageID), sqlQuote(r.Body), sqlQuote(string(attrs)), sqlQuote(string(messageAttrs)),
+		sqlQuote(time.Now().UTC().Format(time.RFC3339)))
+	return err
+}
+
+// Flush commits the inserts, sqlite3 echoes a marker once they are
+// with -bail, it exits on the first error and the marker never comes
+func (s *sqliteSink) Flush() error {
+	if _, err := io.WriteString(s.in, "COMMIT;\nSELECT 'sqscli-committed';\nBEGIN;\n"); err != nil {
+		return err
+	}
+	line, err := s.out.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("sqlite3 stopped: %s", err)
+	}
+	if strings.TrimSpace(line) != "sqscli-committed" {
+		return fmt.Errorf("unexpected sqlite3 output %q", line)
+	}
+	return nil
+}
+
+// Close commits and stops sqlite3
+func (s *sqliteSink) Close() error {
+	io.WriteString(s.in, "COMMIT;\n")
+	s.in.Close()
+	return s.cmd.Wait()
+}
+
+// sqlQuote returns a SQL string literal
+func sqlQuote(v string) string {
+	return "'" + strings.Replace(v, "'", "''", -1) + "'"
+}
+
+// - - - - - - - - - - - - - - - -
+//   DYNAMODB
+// - - - - - - - - - - - - - - - -
+
+// Write puts the message as an item, the table must be keyed by the messageId string
+func (s *dynamoDBSink) Write(m *sqs.Message) error {
+	r := newSinkRecord(m)
+	item := map[string]*dynamodb.AttributeValue{
+		"messageId": {S: aws.String(r.MessageID)},
+		"writtenAt": {S: aws.String(time.Now().UTC().Format(time.RFC3339))},
+	}
+	// Empty strings are not valid attribute values
+	if len(r.Body) > 0 {
+		item["body"] = &dynamodb.AttributeValue{S: aws.String(r.Body)}
+	}
+	if len(r.Attributes) > 0 {
+		attrs := make(map[string]*dynamodb.AttributeValue, len(r.Attributes))
+		for name, value := range r.Attributes {
+			attrs[name] = &dynamodb.AttributeValue{S: value}
+		}
+		item["attributes"] = &dynamodb.AttributeValue{M: attrs}
+	}
+	if len(r.MessageAttributes) > 0 {
+		b, _ := json.Marshal(r.MessageAttributes)
+		item["messageAttributes"] = &dynamodb.AttributeValue{S: aws.String(string(b))}
+	}
+	_, err := s.client.PutItem(&dynamodb.PutItemInput{TableName: aws.String(s.table), Item: item})
+	return err
+}
+
+// Close does nothing, every item is already put
+func (s *dynamoDBSink) Close() error {
+	return nil
+}
+
+// - - - - - - - - - - - - - - - -
+//   KAFKA
+// - - - - - - - - - - - - - - - -
+
+// Write adds the message to the records produced on Flush
+func (s *kafkaSink) Write(m *sqs.Message) error {
+	s.pending = append(s.pending, kafkaRecord{Key: aws.StringValue(m.MessageId), Value: newSinkRecord(m)})
+	return nil
+}
+
+// Flush produces the pending records, the proxy answers an offset or an error for each
+func (s *kafkaSink) Flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(map[string]interface{}{"records": s.pending})
+	s.pending = nil
+	resp, err := s.client.Post(s.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("records refused: %s", resp.Status)
+	}
+	var produced struct {
+		Offsets []struct {
+			Error string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&produced); err != nil {
+		return fmt.Errorf("unexpected REST Proxy answer: %s", err)
+	}
+	for _, o := range produced.Offsets {
+		if len(o.Error) > 0 {
+			return fmt.Errorf("record refused: %s", o.Error)
+		}
+	}
+	return nil
+}
+
+// Close produces the records left
+func (s *kafkaSink) Close() error {
+	return s.Flush()
+}
+
+// - - - - - - - - - - - - - - - -
+//   WEBHOOKS
+// - - - - - - - - - - - - - - - -
+
+// Write posts the message, any answer but a 2xx is a failure
+func (s *webhookSink) Write(m *sqs.Message) error {
+	b, err := json.Marshal(newSinkRecord(m))
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("message refused: %s", resp.Status)
+	}
+	return nil
+}
+
+// Close does nothing, every message is already posted
+func (s *webhookSink) Close() error {
+	return nil
+}
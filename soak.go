@@ -0,0 +1,292 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// soakAttribute marks the messages of a soak run, its value is the run ID
+const soakAttribute = "sqscli.soak"
+
+// Results of the soak checks
+const (
+	soakPass = "pass"
+	soakFail = "fail"
+	soakSkip = "skip"
+)
+
+// soakMonitor samples the depth of a queue and of its DLQ during a soak run
+type soakMonitor struct {
+	queue        string
+	dlq          string // Empty without a DLQ
+	baseline     int    // Available messages before the run
+	dlqBaseline  int
+	maxDepth     int
+	depth        int // Available messages at the last sample
+	dlqDepth     int
+	mu           sync.Mutex
+	sampleFailed bool
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// soak sends a steady stream of marked messages to a queue while watching its depth and DLQ
+// then waits for the consumers to drain it, and reports whether they kept up
+// and whether messages were dead-lettered, exits with 1 on failure
+func soak(args []string) {
+	soakCommand := flag.NewFlagSet("soak", flag.ExitOnError)
+	queueName := soakCommand.String("queue", "", "queue name")
+	soakCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	rate := soakCommand.Float64("rate", 10, "messages sent per second")
+	duration := soakCommand.Duration("duration", 5*time.Minute, "how long messages are sent")
+	settle := soakCommand.Duration("settle", 2*time.Minute, "time the consumers have to drain the queue once sending stops")
+	checkInterval := soakCommand.Duration("check-interval", 5*time.Second, "interval of the depth samples")
+	maxDepth := soakCommand.Int("max-depth", -1, "fail when the queue holds more available messages than this over the baseline")
+	tplArg := soakCommand.String("template", "", "message template, inline or @file, a traceable JSON body by default")
+	schemaFile := soakCommand.String("schema", "", "JSON schema file")
+	flags := newSendFlags(soakCommand)
+	soakHelp := soakCommand.Bool("help", false, "help for soak command")
+	soakCommand.BoolVar(soakHelp, "h", false, "help") // Aliasing
+	parseFlags(soakCommand, args)
+
+	if *soakHelp {
+		soakUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		soakUsage()
+	}
+	if len(*tplArg) > 0 && len(*schemaFile) > 0 {
+		log.Fatal("-template and -schema don't go together")
+	}
+	if *rate <= 0 || *duration <= 0 || *settle < 0 || *checkInterval <= 0 {
+		log.Fatal("Rate, duration and check interval must be positive")
+	}
+	count := int(*rate * duration.Seconds())
+	if count < 1 {
+		log.Fatal("Rate and duration give no message to send")
+	}
+	opts := flags.options()
+	// Low rates would otherwise wait for full batches
+	if float64(opts.batch) > *rate {
+		opts.batch = int(*rate)
+		if opts.batch < 1 {
+			opts.batch = 1
+		}
+	}
+	runID, _ := newUUID()
+	if opts.attrs == nil {
+		opts.attrs = make(map[string]*sqs.MessageAttributeValue)
+	}
+	opts.attrs[soakAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(runID)}
+	if len(opts.attrs) > maxMessageAttributes {
+		log.Fatalf("Too many attributes, SQS accepts %d with %s\n", maxMessageAttributes, soakAttribute)
+	}
+	if len(*tplArg) == 0 && len(*schemaFile) == 0 {
+		*tplArg = fmt.Sprintf(`{"soak":"%s","seq":{{.Index}},"sentAt":"{{now}}"}`, runID)
+	}
+	rand.Seed(time.Now().UnixNano())
+	next := newGenerator(*tplArg, *schemaFile, count)
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+	q := svc.resolveQueue(*queueName)
+	qURL, fifo := q.url, q.fifo
+	m := &soakMonitor{queue: qURL, baseline: q.depth()}
+	m.maxDepth, m.depth = m.baseline, m.baseline
+	if dlq := q.deadLetterQueue(); dlq != nil {
+		m.dlq = dlq.url
+		m.dlqBaseline = dlq.depth()
+		m.dlqDepth = m.dlqBaseline
+	} else {
+		log.Printf("Warning: %s has no DLQ, dead-lettering is not checked\n", *queueName)
+	}
+
+	// Apply
+	log.Printf("Soak run %s: %d messages to %s over %s, marked with %s\n", runID, count, *queueName, *duration, soakAttribute)
+	stop := make(chan struct{})
+	var sampling sync.WaitGroup
+	sampling.Add(1)
+	go func() {
+		defer sampling.Done()
+		ticker := time.NewTicker(*checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				m.sample(svc)
+			}
+		}
+	}()
+
+	start := time.Now()
+	i := 0
+	paced := func() (string, error) {
+		// The i-th message is due at i/rate seconds
+		due := start.Add(time.Duration(float64(i) / *rate * float64(time.Second)))
+		select {
+		case <-interrupted:
+			return "", io.EOF
+		case <-time.After(time.Until(due)):
+		}
+		i++
+		return next()
+	}
+	sent := svc.sendBodies(qURL, fifo, opts, paced)
+	sendTime := time.Since(start)
+	log.Printf("%d messages sent in %s, waiting up to %s for the queue to drain\n", sent, sendTime.Round(time.Second), *settle)
+
+	// Settle
+	drained, drainTime := false, time.Duration(0)
+	settleStart := time.Now()
+	for !isInterrupted() {
+		m.sample(svc)
+		m.mu.Lock()
+		drained = m.depth <= m.baseline
+		m.mu.Unlock()
+		if drained {
+			drainTime = time.Since(settleStart)
+			break
+		}
+		if time.Since(settleStart) >= *settle {
+			break
+		}
+		select {
+		case <-interrupted:
+		case <-time.After(*checkInterval):
+		}
+	}
+	close(stop)
+	sampling.Wait()
+	// DLQ depths are approximate and lag, sampled once more at the very end
+	m.sample(svc)
+
+	// Report
+	t := &table{columns: []column{
+		{key: "check", title: "CHECK"},
+		{key: "value", title: "VALUE"},
+		{key: "limit", title: "LIMIT"},
+		{key: "result", title: "RESULT"},
+	}}
+	passed := true
+	result := func(ok bool) string {
+		if !ok {
+			passed = false
+			return soakFail
+		}
+		return soakPass
+	}
+	t.add("sent", fmt.Sprintf("%d in %s", sent, sendTime.Round(time.Second)), strconv.Itoa(count), result(sent == count))
+	limit := "-"
+	overDepth := m.maxDepth - m.baseline
+	if *maxDepth >= 0 {
+		limit = strconv.Itoa(*maxDepth)
+	}
+	t.add("max depth", fmt.Sprintf("%d over a baseline of %d", overDepth, m.baseline), limit, result(*maxDepth < 0 || overDepth <= *maxDepth))
+	if drained {
+		t.add("drained", "in "+drainTime.Round(time.Second).String(), settle.String(), result(true))
+	} else {
+		t.add("drained", fmt.Sprintf("%d left over the baseline", m.depth-m.baseline), settle.String(), result(false))
+	}
+	if len(m.dlq) > 0 {
+		arrivals := m.dlqDepth - m.dlqBaseline
+		if arrivals < 0 {
+			arrivals = 0
+		}
+		t.add("dlq arrivals", strconv.Itoa(arrivals), "0", result(arrivals == 0))
+	} else {
+		t.add("dlq arrivals", "no DLQ", "0", soakSkip)
+	}
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t.render(os.Stdout, format)
+	if m.sampleFailed {
+		log.Println("Warning: some depth samples failed, the maximum depth may be underestimated")
+	}
+	if isInterrupted() {
+		os.Exit(exitInterrupted)
+	}
+	if !passed {
+		fmt.Fprintln(os.Stderr, "Soak failed")
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "Soak passed")
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// sample reads the depth of the queue and of its DLQ
+// a failed read is skipped, the run goes on
+func (m *soakMonitor) sample(svc *service) {
+	result, err := svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(m.queue),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
+	})
+	var dlq *sqs.GetQueueAttributesOutput
+	if err == nil && len(m.dlq) > 0 {
+		dlq, err = svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(m.dlq),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
+		})
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.sampleFailed = true
+		return
+	}
+	m.depth = intAttribute(result.Attributes, "ApproximateNumberOfMessages")
+	if m.depth > m.maxDepth {
+		m.maxDepth = m.depth
+	}
+	if dlq != nil {
+		m.dlqDepth = intAttribute(dlq.Attributes, "ApproximateNumberOfMessages")
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func soakUsage() {
+	fmt.Println("usage: sqscli soak [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -rate             Messages sent per second (default 10)")
+	fmt.Println("  -duration         How long messages are sent (default 5m)")
+	fmt.Println("  -settle           Time the consumers have to drain the queue once sending stops (default 2m)")
+	fmt.Println("  -check-interval   Interval of the depth samples (default 5s)")
+	fmt.Println("  -max-depth        Fail when the queue holds more available messages than this over the baseline")
+	fmt.Println("  -template         Message template, inline or @file, a traceable JSON body by default")
+	fmt.Println("  -schema           JSON schema file to generate messages from")
+	fmt.Println("  -batch-size       Messages per batch, 1 to 10 (default 10)")
+	fmt.Println("  -group            FIFO message group ID template (default \"sqscli\")")
+	fmt.Println("  -delay-seconds    Delay before messages become visible, 0 to 900 (standard queues)")
+	fmt.Println("  -spread-over      Randomly add up to this much delay per message, e.g. 5m")
+	fmt.Println("  -attr             Message attribute Name=Type:value, repeatable")
+	fmt.Println("  -encrypt          Encrypt bodies client-side, requires -kms-key-id")
+	fmt.Println("  -kms-key-id       KMS key ID used by -encrypt")
+	fmt.Println("  -trace            Trace header injected in every message: xray or w3c")
+	os.Exit(0)
+}
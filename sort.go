@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Sort keys of -sort
+const (
+	sortNone     = "none"
+	sortSent     = "sent"
+	sortSequence = "sequence"
+	// sortMemory bounds the bodies sorted in memory, larger exports are merged from sorted runs on disk
+	sortMemory = 64 << 20
+)
+
+// sorter collects the messages of a queue export and writes them sorted once it is done
+// every batch goes to a journal on disk before its messages are deleted, so memory
+// only holds a chunk at a time
+type sorter struct {
+	key     string // sortSent or sortSequence
+	dir     string // Directory of the journal and the sorted runs
+	journal *os.File
+	enc     *json.Encoder
+}
+
+// runHead is the next message of a sorted run, during the merge
+type runHead struct {
+	m   *sqs.Message
+	dec *json.Decoder
+}
+
+// runHeads is a heap of the sorted runs, the one with the first message on top
+type runHeads struct {
+	key   string
+	heads []*runHead
+}
+
+// - - - - - - - - - - - - - - - -
+//   SORTING
+// - - - - - - - - - - - - - - - -
+
+// newSorter starts the journal of a queue export in dir, the temporary directory by default
+func newSorter(key, dir string) *sorter {
+	f, err := ioutil.TempFile(dir, "sqscli-sort-*.jsonl")
+	if err != nil {
+		log.Fatal("Error creating the sort journal ", err)
+	}
+	return &sorter{key: key, dir: dir, journal: f, enc: json.NewEncoder(f)}
+}
+
+// add journals a batch, synced so its messages can be deleted
+func (s *sorter) add(batch []*sqs.Message) {
+	for _, m := range batch {
+		if err := s.enc.Encode(m); err != nil {
+			log.Fatal("Error writing the sort journal ", err)
+		}
+	}
+	if err := s.journal.Sync(); err != nil {
+		log.Fatal("Error syncing the sort journal ", err)
+	}
+}
+
+// flush writes the journaled messages sorted, in batches of 10, and removes the journal
+// chunks that fit in memory are sorted into runs, merged if there are several
+func (s *sorter) flush(write func([]*sqs.Message)) {
+	defer os.Remove(s.journal.Name())
+	if _, err := s.journal.Seek(0, io.SeekStart); err != nil {
+		log.Fatal("Error reading the sort journal ", err)
+	}
+	dec := json.NewDecoder(bufio.NewReader(s.journal))
+	var runs []*os.File
+	defer func() {
+		for _, run := range runs {
+			run.Close()
+			os.Remove(run.Name())
+		}
+	}()
+	for {
+		chunk := s.readChunk(dec)
+		if len(chunk) == 0 {
+			break
+		}
+		sort.SliceStable(chunk, func(i, j int) bool { return sortLess(s.key, chunk[i], chunk[j]) })
+		// A single chunk needs no merge
+		if len(runs) == 0 && !dec.More() {
+			writeSorted(chunk, write)
+			s.journal.Close()
+			return
+		}
+		runs = append(runs, s.writeRun(chunk))
+	}
+	s.journal.Close()
+	if len(runs) > 0 {
+		log.Printf("Merging %d sorted runs\n", len(runs))
+	}
+
+	heads := &runHeads{key: s.key}
+	for _, run := range runs {
+		if _, err := run.Seek(0, io.SeekStart); err != nil {
+			log.Fatal("Error reading a sorted run ", err)
+		}
+		h := &runHead{dec: json.NewDecoder(bufio.NewReader(run))}
+		if h.next() {
+			heads.heads = append(heads.heads, h)
+		}
+	}
+	heap.Init(heads)
+	var batch []*sqs.Message
+	for heads.Len() > 0 {
+		h := heads.heads[0]
+		batch = append(batch, h.m)
+		if len(batch) == 10 {
+			write(batch)
+			batch = nil
+		}
+		if h.next() {
+			heap.Fix(heads, 0)
+		} else {
+			heap.Pop(heads)
+		}
+	}
+	if len(batch) > 0 {
+		write(batch)
+	}
+}
+
+// readChunk reads journaled messages until their bodies reach sortMemory
+func (s *sorter) readChunk(dec *json.Decoder) []*sqs.Message {
+	var chunk []*sqs.Message
+	size := 0
+	for size < sortMemory && dec.More() {
+		var m sqs.Message
+		if err := dec.Decode(&m); err != nil {
+			log.Fatal("Error reading the sort journal ", err)
+		}
+		chunk = append(chunk, &m)
+		size += len(aws.StringValue(m.Body))
+	}
+	return chunk
+}
+
+// writeRun writes a sorted chunk to a run file
+func (s *sorter) writeRun(chunk []*sqs.Message) *os.File {
+	f, err := ioutil.TempFile(s.dir, "sqscli-sort-run-*.jsonl")
+	if err != nil {
+		log.Fatal("Error creating a sorted run ", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, m := range chunk {
+		if err := enc.Encode(m); err != nil {
+			log.Fatal("Error writing a sorted run ", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal("Error writing a sorted run ", err)
+	}
+	return f
+}
+
+// writeSorted writes sorted messages in batches of 10
+func writeSorted(messages []*sqs.Message, write func([]*sqs.Message)) {
+	for i := 0; i < len(messages); i += 10 {
+		j := i + 10
+		if j > len(messages) {
+			j = len(messages)
+		}
+		write(messages[i:j])
+	}
+}
+
+// sortLess is true if a comes before b
+// sequence numbers only exist on FIFO queues, messages without one are sorted by sent time
+func sortLess(key string, a, b *sqs.Message) bool {
+	if key == sortSequence {
+		sa := aws.StringValue(a.Attributes[sqs.MessageSystemAttributeNameSequenceNumber])
+		sb := aws.StringValue(b.Attributes[sqs.MessageSystemAttributeNameSequenceNumber])
+		if len(sa) > 0 && len(sb) > 0 {
+			return sequenceLess(sa, sb)
+		}
+	}
+	ta, _ := sentAt(a)
+	tb, _ := sentAt(b)
+	return ta.Before(tb)
+}
+
+// sequenceLess is true if the FIFO sequence number a is smaller than b
+// 128-bit numbers, a shorter one is smaller
+func sequenceLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// next reads the next message of the run, false once it is exhausted
+func (h *runHead) next() bool {
+	if !h.dec.More() {
+		return false
+	}
+	var m sqs.Message
+	if err := h.dec.Decode(&m); err != nil {
+		log.Fatal("Error reading a sorted run ", err)
+	}
+	h.m = &m
+	return true
+}
+
+func (r *runHeads) Len() int           { return len(r.heads) }
+func (r *runHeads) Swap(i, j int)      { r.heads[i], r.heads[j] = r.heads[j], r.heads[i] }
+func (r *runHeads) Less(i, j int) bool { return sortLess(r.key, r.heads[i].m, r.heads[j].m) }
+
+// Push implements heap.Interface
+func (r *runHeads) Push(x interface{}) { r.heads = append(r.heads, x.(*runHead)) }
+
+// Pop implements heap.Interface
+func (r *runHeads) Pop() interface{} {
+	old := r.heads
+	h := old[len(old)-1]
+	r.heads = old[:len(old)-1]
+	return h
+}
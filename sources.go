@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Schemes of the -from URIs, files and S3 objects are read in the format of their extension
+const (
+	sourceStdin   = "-"
+	sourceFile    = "file"
+	sourceLines   = "lines"
+	sourceCSV     = "csv"
+	sourceJSONL   = "jsonl"
+	sourceParquet = "parquet"
+	sourceS3      = "s3"
+	sourceKafka   = "kafka"
+)
+
+// Defaults of the columns read from CSV and Parquet files
+const (
+	csvBodyColumn     = "Body" // Header of the qtocsv exports
+	parquetBodyColumn = "body"
+)
+
+// kafkaPollsEmpty ends a Kafka import after this many polls in a row return nothing
+const kafkaPollsEmpty = 3
+
+// messageSource yields the bodies of the messages to send, one per Read, io.EOF after the last one
+// the sink interface the other way around: a new input is a type implementing it,
+// added to newMessageSource
+type messageSource interface {
+	Read() (string, error)
+	Close() error
+}
+
+// readerSource reads bodies from a stream, in one of the formats of a file
+type readerSource struct {
+	next   func() (string, error)
+	closer io.Closer
+}
+
+// kafkaSource consumes a topic through a Kafka REST Proxy consumer
+// its offsets are only committed on Close, once the messages are sent
+type kafkaSource struct {
+	client   *http.Client
+	instance string // Consumer instance URL
+	pending  []string
+	empty    int // Empty polls in a row
+}
+
+// sourceURI is a parsed -from URI
+type sourceURI struct {
+	scheme string
+	format string // sourceLines, sourceCSV, sourceJSONL or sourceParquet
+	target string // File, s3://BUCKET/KEY or REST Proxy URL
+	column string // CSV or Parquet column of the bodies, #COLUMN
+	gzip   bool   // The file is gzipped, .gz
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// importMessages sends the messages of a source to a queue
+func importMessages(args []string) {
+	importCommand := flag.NewFlagSet("import", flag.ExitOnError)
+	queueName := importCommand.String("queue", "", "queue name")
+	importCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	from := importCommand.String("from", "", "source URI of the messages")
+	dedupeBy := importCommand.String("dedupe-by", "", "skip bodies already sent: body-hash, jmespath:QUERY or expr:EXPRESSION")
+	dedupeState := importCommand.String("dedupe-state", "", "file persisting the keys already sent")
+	flags := newSendFlags(importCommand)
+	importHelp := importCommand.Bool("help", false, "help for import command")
+	importCommand.BoolVar(importHelp, "h", false, "help") // Aliasing
+	parseFlags(importCommand, args)
+
+	if *importHelp {
+		importUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 || len(*from) == 0 {
+		fmt.Println("Required queue name or source is missing.")
+		importUsage()
+	}
+	source, err := parseSourceURI(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := flags.options()
+	if len(*dedupeBy) > 0 {
+		if *dedupeBy == dedupeMessageID {
+			log.Fatal("New messages have no ID yet, use body-hash, jmespath:QUERY or expr:EXPRESSION")
+		}
+		if opts.dedup, err = newDeduper(*dedupeBy, *dedupeState); err != nil {
+			log.Fatal(err)
+		}
+	} else if len(*dedupeState) > 0 {
+		log.Fatal("-dedupe-state requires -dedupe-by")
+	}
+
+	// Connect
+	svc := newService()
+	q := svc.resolveQueue(*queueName)
+	src, err := svc.newMessageSource(source)
+	if err != nil {
+		log.Fatal("Error opening the source ", err)
+	}
+
+	// Apply
+	handleInterrupts()
+	sent := svc.sendBodies(q.url, q.fifo, opts, src.Read)
+	fmt.Fprintf(os.Stderr, "%d messages sent\n", sent)
+	if isInterrupted() {
+		src.Close()
+		os.Exit(exitInterrupted)
+	}
+	if err := src.Close(); err != nil {
+		log.Fatal("Error closing the source ", err)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   SOURCES
+// - - - - - - - - - - - - - - - -
+
+// parseSourceURI parses a -from URI: -, [file:]PATH, lines:PATH, csv:PATH[#COLUMN], jsonl:PATH,
+// parquet:PATH[#COLUMN], s3://BUCKET/KEY[#COLUMN] or kafka:PROXY_TOPIC_URL
+// files and objects are read by extension, .csv, .jsonl, .ndjson or .parquet, lines otherwise, .gz gunzipped
+func parseSourceURI(uri string) (sourceURI, error) {
+	if uri == sourceStdin {
+		return sourceURI{scheme: sourceStdin, format: sourceLines}, nil
+	}
+	if strings.HasPrefix(uri, "s3://") {
+		if _, _, err := parseS3URI(strings.SplitN(uri, "#", 2)[0]); err != nil {
+			return sourceURI{}, err
+		}
+		return sourceFromPath(sourceS3, "", uri)
+	}
+	scheme, target := sourceFile, uri
+	if parts := strings.SplitN(uri, ":", 2); len(parts) == 2 && len(parts[0]) > 1 {
+		scheme, target = parts[0], parts[1]
+	}
+	switch scheme {
+	case sourceFile:
+		return sourceFromPath(sourceFile, "", target)
+	case sourceLines, sourceCSV, sourceJSONL, sourceParquet:
+		return sourceFromPath(sourceFile, scheme, target)
+	case sourceKafka:
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || !strings.Contains(u.Path, "/topics/") {
+			return sourceURI{}, fmt.Errorf("invalid kafka source %q, expected the REST Proxy URL of a topic, https://proxy:8082/topics/TOPIC", target)
+		}
+		return sourceURI{scheme: sourceKafka, target: target}, nil
+	}
+	return sourceURI{}, fmt.Errorf("unknown source %q, expected -, file, lines, csv, jsonl, parquet, s3 or kafka", scheme)
+}
+
+// sourceFromPath completes the source of a file or object, its format from its extension when not given
+func sourceFromPath(scheme, format, target string) (sourceURI, error) {
+	s := sourceURI{scheme: scheme, format: format, target: target}
+	if i := strings.LastIndex(target, "#"); i >= 0 {
+		s.target, s.column = target[:i], target[i+1:]
+	}
+	if len(s.target) == 0 {
+		return s, fmt.Errorf("missing file name")
+	}
+	name := strings.ToLower(path.Base(s.target))
+	if strings.HasSuffix(name, ".gz") {
+		s.gzip = true
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	if len(s.format) == 0 {
+		switch path.Ext(name) {
+		case ".csv":
+			s.format = sourceCSV
+		case ".jsonl", ".ndjson":
+			s.format = sourceJSONL
+		case ".parquet":
+			s.format = sourceParquet
+		default:
+			s.format = sourceLines
+		}
+	}
+	switch {
+	case len(s.column) > 0 && s.format != sourceCSV && s.format != sourceParquet:
+		return s, fmt.Errorf("#%s: only CSV and Parquet sources have columns", s.column)
+	case s.format == sourceParquet && s.gzip:
+		return s, fmt.Errorf("Parquet files compress their pages, they can't be gzipped")
+	case s.format == sourceCSV && len(s.column) == 0:
+		s.column = csvBodyColumn
+	case s.format == sourceParquet && len(s.column) == 0:
+		s.column = parquetBodyColumn
+	}
+	return s, nil
+}
+
+// newMessageSource opens a source
+func (s *service) newMessageSource(src sourceURI) (messageSource, error) {
+	switch src.scheme {
+	case sourceStdin:
+		return &readerSource{next: newBodyReader(os.Stdin, false)}, nil
+	case sourceKafka:
+		return newKafkaSource(src.target)
+	case sourceS3:
+		return s.newS3Source(src)
+	}
+	if src.format == sourceParquet {
+		return openParquet(src.target, src.column)
+	}
+	f, err := os.Open(src.target)
+	if err != nil {
+		return nil, err
+	}
+	return newReaderSource(f, src)
+}
+
+// newReaderSource reads a stream in the format of a source
+func newReaderSource(rc io.ReadCloser, src sourceURI) (messageSource, error) {
+	var r io.Reader = rc
+	if src.gzip {
+		gz, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		r = gz
+	}
+	source := &readerSource{closer: rc}
+	switch src.format {
+	case sourceCSV:
+		next, err := csvBodies(r, src.column)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		source.next = next
+	case sourceJSONL:
+		source.next = jsonlBodies(r)
+	default:
+		source.next = newBodyReader(r, false)
+	}
+	return source, nil
+}
+
+// Read returns the next body of the stream
+func (r *readerSource) Read() (string, error) {
+	return r.next()
+}
+
+// Close closes the file or object, stdin stays open
+func (r *readerSource) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// csvBodies reads the column of a CSV file with a header row, a qtocsv export by default
+// exports of several queues repeat the header and add # QUEUE lines, both are skipped
+func csvBodies(r io.Reader, column string) (func() (string, error), error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("no CSV header: %s", err)
+	}
+	index := -1
+	for i, title := range header {
+		if strings.EqualFold(strings.TrimSpace(title), column) {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("no column %s, the columns are %s", column, strings.Join(header, ", "))
+	}
+	return func() (string, error) {
+		for {
+			row, err := cr.Read()
+			if err != nil {
+				return "", err
+			}
+			if len(row) == 1 && len(header) > 1 && strings.HasPrefix(row[0], "# ") {
+				continue
+			}
+			if index >= len(row) || len(row[index]) == 0 || strings.Join(row, ",") == strings.Join(header, ",") {
+				continue
+			}
+			return row[index], nil
+		}
+	}, nil
+}
+
+// jsonlBodies reads JSON lines, each object a body
+// the records of peek and -sink are sent as their body, so their output imports back
+func jsonlBodies(r io.Reader) func() (string, error) {
+	next := newBodyReader(r, true)
+	return func() (string, error) {
+		body, err := next()
+		if err != nil {
+			return "", err
+		}
+		var record struct {
+			MessageID *string `json:"messageId"`
+			Body      *string `json:"body"`
+		}
+		if json.Unmarshal([]byte(body), &record) == nil && record.MessageID != nil && record.Body != nil {
+			return *record.Body, nil
+		}
+		return body, nil
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   S3
+// - - - - - - - - - - - - - - - -
+
+// newS3Source streams an object, Parquet objects are downloaded first to be read from their footer
+func (s *service) newS3Source(src sourceURI) (messageSource, error) {
+	bucket, key, _ := parseS3URI(src.target)
+	out, err := s3Client(s.sess).GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	if src.format != sourceParquet {
+		return newReaderSource(out.Body, src)
+	}
+	defer out.Body.Close()
+	f, err := ioutil.TempFile("", "sqscli-*.parquet")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, out.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The open file stays readable once removed, on Unix
+	return openParquet(f.Name(), src.column)
+}
+
+// - - - - - - - - - - - - - - - -
+//   KAFKA
+// - - - - - - - - - - - - - - - -
+
+// newKafkaSource creates a consumer of the topic in the sqscli group, or ?group=NAME, reading from the earliest offset
+// a group already consuming the topic carries on from its committed offsets
+func newKafkaSource(topicURL string) (*kafkaSource, error) {
+	u, _ := url.Parse(topicURL)
+	i := strings.Index(u.Path, "/topics/")
+	topic := strings.Trim(u.Path[i+len("/topics/"):], "/")
+	group := u.Query().Get("group")
+	if len(group) == 0 {
+		group = "sqscli"
+	}
+	base := *u
+	base.Path, base.RawQuery = u.Path[:i], ""
+
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	k := &kafkaSource{client: client}
+	var created struct {
+		BaseURI string `json:"base_uri"`
+	}
+	err = k.call("POST", base.String()+"/consumers/"+url.PathEscape(group), map[string]string{
+		"format":             "binary",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	}, &created)
+	if err != nil {
+		return nil, fmt.Errorf("creating the consumer: %s", err)
+	}
+	k.instance = created.BaseURI
+	if err := k.call("POST", k.instance+"/subscription", map[string][]string{"topics": {topic}}, nil); err != nil {
+		k.call("DELETE", k.instance, nil, nil)
+		return nil, fmt.Errorf("subscribing to %s: %s", topic, err)
+	}
+	return k, nil
+}
+
+// Read returns the value of the next record, the topic is done after a few empty polls
+func (k *kafkaSource) Read() (string, error) {
+	for len(k.pending) == 0 {
+		if k.empty >= kafkaPollsEmpty {
+			return "", io.EOF
+		}
+		var records []struct {
+			Value []byte `json:"value"` // Base64 of the binary format
+		}
+		if err := k.call("GET", k.instance+"/records", nil, &records); err != nil {
+			return "", err
+		}
+		k.empty++
+		for _, r := range records {
+			k.empty = 0
+			// Tombstones have no value
+			if len(r.Value) > 0 {
+				k.pending = append(k.pending, string(r.Value))
+			}
+		}
+	}
+	body := k.pending[0]
+	k.pending = k.pending[1:]
+	return body, nil
+}
+
+// Close commits the offsets of the records read and deletes the consumer
+func (k *kafkaSource) Close() error {
+	err := k.call("POST", k.instance+"/offsets", nil, nil)
+	if derr := k.call("DELETE", k.instance, nil, nil); err == nil {
+		err = derr
+	}
+	return err
+}
+
+// call calls the REST Proxy v2 API, decoding the answer into out if not nil
+func (k *kafkaSource) call(method, target string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, _ := json.Marshal(in)
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.binary.v2+json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s %s", method, target, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func importUsage() {
+	fmt.Println("usage: sqscli import [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -from required    Source of the messages: - (stdin), [file:]PATH, lines:PATH, csv:PATH[#COLUMN],")
+	fmt.Println("                    jsonl:PATH, parquet:PATH[#COLUMN], s3://BUCKET/KEY or kafka:URL")
+	fmt.Println("  -batch-size       Messages per batch, 1 to 10 (default 10)")
+	fmt.Println("  -group            FIFO message group ID template (default \"sqscli\")")
+	fmt.Println("  -delay-seconds    Delay before messages become visible, 0 to 900 (standard queues)")
+	fmt.Println("  -spread-over      Randomly add up to this much delay per message, e.g. 5m")
+	fmt.Println("  -attr             Message attribute Name=Type:value, repeatable, alias -set-attr")
+	fmt.Println("  -encrypt          Encrypt bodies client-side, requires -kms-key-id")
+	fmt.Println("  -kms-key-id       KMS key ID used by -encrypt")
+	fmt.Println("  -trace            Trace header injected in every message: xray or w3c")
+	fmt.Println("  -dedupe-by        Skip bodies already sent, keyed by body-hash, jmespath:QUERY or expr:EXPRESSION")
+	fmt.Println("  -dedupe-state     File persisting the keys already sent, for re-runs")
+	os.Exit(0)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// splitWriter writes the export in numbered part files
+// a full part is only closed before the next message, so the last part is never empty
+type splitWriter struct {
+	prefix   string
+	ext      string
+	compress bool
+	maxBytes int64 // Uncompressed bytes per part, 0 for no limit
+	maxCount int   // Messages per part, 0 for no limit
+	encrypt  func(io.Writer) io.WriteCloser
+
+	part  int
+	bytes int64
+	count int
+	file  *os.File
+	enc   io.WriteCloser // KMS encryption, if any
+	gz    *gzip.Writer
+	w     io.Writer // Top of the chain
+}
+
+// sizeUnits are the suffixes of -split-size, longest first
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+}
+
+// - - - - - - - - - - - - - - - -
+//   SPLIT OUTPUT
+// - - - - - - - - - - - - - - - -
+
+// parseSize parses a size like 100MB, 512KB or 1GB, plain numbers are bytes
+func parseSize(raw string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(raw))
+	factor := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, factor = strings.TrimSuffix(value, u.suffix), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid size %q, expected a positive size like 100MB", raw)
+	}
+	return n * factor, nil
+}
+
+// exportExtension is the part file extension of an export format
+func exportExtension(format string) string {
+	if format == exportCloudEventsFormat {
+		return "jsonl"
+	}
+	return format
+}
+
+// newSplitWriter returns a writer of part files, the first one is opened on first write
+func newSplitWriter(prefix, format string, compress bool, maxBytes int64, maxCount int) *splitWriter {
+	return &splitWriter{
+		prefix:   prefix,
+		ext:      exportExtension(format),
+		compress: compress,
+		maxBytes: maxBytes,
+		maxCount: maxCount,
+	}
+}
+
+// open starts the next part file
+func (w *splitWriter) open() {
+	w.part++
+	w.bytes, w.count = 0, 0
+	name := fmt.Sprintf("%s-%05d.%s", w.prefix, w.part, w.ext)
+	if w.compress {
+		name += ".gz"
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal("Error creating part file ", err)
+	}
+	w.file, w.w = f, f
+	if w.encrypt != nil {
+		w.enc = w.encrypt(w.w)
+		w.w = w.enc
+	}
+	if w.compress {
+		w.gz = gzip.NewWriter(w.w)
+		w.w = w.gz
+	}
+	log.Println("Writing", name)
+}
+
+// Write writes to the current part, opening the first one
+func (w *splitWriter) Write(p []byte) (int, error) {
+	if w.file == nil {
+		w.open()
+	}
+	n, err := w.w.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush pushes the compressed and encrypted data of the part to disk
+func (w *splitWriter) Flush() error {
+	if w.file == nil {
+		return nil
+	}
+	if w.gz != nil {
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.file.Sync()
+}
+
+// Close ends the current part
+func (w *splitWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return err
+		}
+		w.gz = nil
+	}
+	if w.enc != nil {
+		if err := w.enc.Close(); err != nil {
+			return err
+		}
+		w.enc = nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// written counts a message of the current part
+func (w *splitWriter) written() {
+	w.count++
+}
+
+// full is true once the current part reached a limit
+func (w *splitWriter) full() bool {
+	return w.file != nil &&
+		((w.maxBytes > 0 && w.bytes >= w.maxBytes) || (w.maxCount > 0 && w.count >= w.maxCount))
+}
+
+// rotateExport closes a full part and starts the next one with the header of the format
+// the queue element of XML exports is closed and reopened, Avro records end their block
+func rotateExport(w *splitWriter, qURL string, opts csvOptions) {
+	switch opts.format {
+	case exportXMLFormat:
+		endXMLQueue()
+		endXML()
+	case exportAvroFormat:
+		if err := opts.avro.flush(); err != nil {
+			log.Fatal("Error writing Avro block ", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal("Error closing part file ", err)
+	}
+	w.open()
+	switch opts.format {
+	case exportCSVFormat:
+		insertCSVHead(opts)
+	case exportXMLFormat:
+		startXML()
+		startXMLQueue(queueNameFromURL(qURL))
+	case exportAvroFormat:
+		if err := opts.avro.writeHeader(); err != nil {
+			log.Fatal("Error starting the Avro output ", err)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/jmespath/go-jmespath"
+	"gopkg.in/yaml.v3"
+)
+
+// splitRules is the rule file of split
+type splitRules struct {
+	Rules   []splitRule `yaml:"rules"`
+	Default string      `yaml:"default"` // Queue of the messages no rule matches, left in the source if empty
+}
+
+// splitRule routes the messages it matches to a queue
+// with a path, the values at the path of the JSON body are compared, the whole body otherwise,
+// or the expression of when is true for them
+type splitRule struct {
+	Queue  string `yaml:"queue"`
+	Path   string `yaml:"path"`   // JMESPath query on the body like customer.country, as the jmespath: keys of -dedupe-by
+	Equals string `yaml:"equals"` // A value at the path is this
+	Match  string `yaml:"match"`  // Regular expression matching a value at the path, or the body
+	When   string `yaml:"when"`   // Expression, like body.customer.country == "FR", see expr.go
+	query  *jmespath.JMESPath
+	match  *regexp.Regexp
+	when   *expression
+	url    string
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// split drains a queue into several queues, each message going to the queue
+// of the first rule it matches, or to the default queue
+func split(args []string) {
+	splitCommand := flag.NewFlagSet("split", flag.ExitOnError)
+	queueName := splitCommand.String("queue", "", "queue name")
+	splitCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	rulesFile := splitCommand.String("rules", "", "YAML file of the routing rules")
+	routes := &attrFlag{}
+	splitCommand.Var(routes, "route", "QUEUE=EXPRESSION routing the messages the expression is true for, repeatable")
+	reportFile := splitCommand.String("report", "", "file receiving the JSON summary")
+	concurrencyFlag := splitCommand.String("concurrency", "1", "concurrent receivers, or auto")
+	filters := newFilterFlags(splitCommand)
+	splitHelp := splitCommand.Bool("help", false, "help for split command")
+	splitCommand.BoolVar(splitHelp, "h", false, "help") // Aliasing
+	parseFlags(splitCommand, args)
+
+	if *splitHelp {
+		splitUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 || len(*rulesFile) == 0 && len(*routes) == 0 {
+		fmt.Println("Required queue name, rules file or route is missing.")
+		splitUsage()
+	}
+	rules := &splitRules{}
+	if len(*rulesFile) > 0 {
+		var err error
+		if rules, err = loadSplitRules(*rulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Tried after the rules of the file
+	for _, route := range *routes {
+		r, err := parseRoute(route)
+		if err != nil {
+			log.Fatal("Invalid -route ", err)
+		}
+		rules.Rules = append(rules.Rules, r)
+	}
+	concurrency, err := parseConcurrency(*concurrencyFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keep := filters.filter()
+	// Unmatched messages stay hidden until the end, like filtered ones, instead of being received again
+	if len(rules.Default) == 0 {
+		keep = append(messageFilter{func(m *sqs.Message) bool { return rules.route(m) != nil }}, keep...)
+	}
+
+	// Connect
+	svc := newService()
+	handleInterrupts()
+	q := svc.resolveQueue(*queueName)
+	qURL, fifo := q.url, q.fifo
+	queues := []string{*queueName}
+	for i := range rules.Rules {
+		r := &rules.Rules[i]
+		to := svc.resolveQueue(r.Queue)
+		r.url = to.url
+		if r.url == qURL {
+			log.Fatalf("Rule %d routes to %s, the queue split\n", i+1, r.Queue)
+		}
+		if to.fifo != fifo {
+			log.Fatalf("Queue %s is not of the same type as %s\n", r.Queue, *queueName)
+		}
+		queues = append(queues, r.Queue)
+	}
+	var defaultURL string
+	if len(rules.Default) > 0 {
+		defaultURL = svc.getQueueURL(rules.Default)
+		if defaultURL == qURL {
+			log.Fatal("The default queue is the queue split, leave it empty to keep unmatched messages")
+		}
+		if svc.isFIFO(defaultURL) != fifo {
+			log.Fatalf("Queue %s is not of the same type as %s\n", rules.Default, *queueName)
+		}
+		queues = append(queues, rules.Default)
+	}
+
+	enforceGuardrails("split", []string{q.name}, svc.depthCounter(), false)
+
+	// Apply
+	startReport("split", *reportFile, queues...)
+	acks := newAcks(fifo)
+	counts, errs := svc.splitStage(qURL, fifo, rules, defaultURL, acks, svc.receiveStage(q, nil, keep, acks, concurrency))
+	names := make([]string, 0, len(counts))
+	total := 0
+	for name, n := range counts {
+		names = append(names, name)
+		total += n
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("%d messages to %s\n", counts[name], name)
+	}
+	svc.exitIfInterrupted(qURL, total)
+	if len(errs) > 0 {
+		failReport()
+		finishReport()
+		log.Fatal("There were errors routing the messages", errs)
+	}
+	finishReport()
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// loadSplitRules reads and checks a rule file
+func loadSplitRules(file string) (*splitRules, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules splitRules
+	if err := yaml.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("invalid rules %s: %s", file, err)
+	}
+	if len(rules.Rules) == 0 {
+		return nil, fmt.Errorf("no rule in %s", file)
+	}
+	for i := range rules.Rules {
+		r := &rules.Rules[i]
+		if len(r.Queue) == 0 {
+			return nil, fmt.Errorf("rule %d of %s needs a queue", i+1, file)
+		}
+		if len(r.Equals) > 0 && len(r.Match) > 0 {
+			return nil, fmt.Errorf("rule %d of %s: equals and match don't go together", i+1, file)
+		}
+		if len(r.When) > 0 {
+			if len(r.Path) > 0 || len(r.Equals) > 0 || len(r.Match) > 0 {
+				return nil, fmt.Errorf("rule %d of %s: when doesn't go with path, equals or match", i+1, file)
+			}
+			if r.when, err = compileExpression(r.When); err != nil {
+				return nil, fmt.Errorf("rule %d of %s: %s", i+1, file, err)
+			}
+			continue
+		}
+		if len(r.Path) == 0 && len(r.Match) == 0 {
+			return nil, fmt.Errorf("rule %d of %s needs a path, a match or a when", i+1, file)
+		}
+		if len(r.Path) > 0 {
+			if r.query, err = jmespath.Compile(r.Path); err != nil {
+				return nil, fmt.Errorf("rule %d of %s: %s", i+1, file, err)
+			}
+		}
+		if len(r.Match) > 0 {
+			if r.match, err = regexp.Compile(r.Match); err != nil {
+				return nil, fmt.Errorf("rule %d of %s: %s", i+1, file, err)
+			}
+		}
+	}
+	return &rules, nil
+}
+
+// parseRoute parses a -route QUEUE=EXPRESSION
+// queue names and ARNs have no =, the expression starts at the first one
+func parseRoute(route string) (splitRule, error) {
+	parts := strings.SplitN(route, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return splitRule{}, fmt.Errorf("%q is not QUEUE=EXPRESSION", route)
+	}
+	e, err := compileExpression(parts[1])
+	if err != nil {
+		return splitRule{}, err
+	}
+	return splitRule{Queue: parts[0], When: parts[1], when: e}, nil
+}
+
+// route returns the first rule matching a message, nil if none does
+// an expression failing on a message doesn't match it
+func (r *splitRules) route(m *sqs.Message) *splitRule {
+	body := messageBody(m)
+	var doc interface{}
+	var env *exprEnv
+	decoded := false
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.when != nil {
+			// Shared by the expressions, decoded once
+			if env == nil {
+				env = newExprEnv(m, body)
+			}
+			if v, err := rule.when.eval(env); err == nil && exprTruthy(v) {
+				return rule
+			}
+			continue
+		}
+		if rule.query == nil {
+			if rule.match.MatchString(body) {
+				return rule
+			}
+			continue
+		}
+		// Decoded once, for the first rule with a path
+		if !decoded {
+			if d, ok := decodeJMESPathDoc(body); ok {
+				doc = d
+			}
+			decoded = true
+		}
+		if doc != nil && rule.matches(searchDoc(rule.query, doc)) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matches is true if a value at the path of the rule passes its comparison
+// without comparison, any value at the path does
+func (r *splitRule) matches(values []interface{}) bool {
+	for _, v := range values {
+		var s string
+		switch value := v.(type) {
+		case string:
+			s = value
+		case float64:
+			s = strconv.FormatFloat(value, 'f', -1, 64)
+		case json.Number:
+			s = value.String()
+		case bool, nil:
+			s = fmt.Sprint(value)
+		default:
+			b, _ := json.Marshal(value)
+			s = string(b)
+		}
+		switch {
+		case len(r.Equals) > 0 && s == r.Equals:
+			return true
+		case r.match != nil && r.match.MatchString(s):
+			return true
+		case len(r.Equals) == 0 && r.match == nil:
+			return true
+		}
+	}
+	return false
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// splitStage sends each message of the batches to the queue of its rule, or the default queue,
+// then deletes it from the queue from
+// only messages that were sent are deleted, the others are released right away
+// returns the number of messages sent to each queue
+func (s *service) splitStage(from string, fifo bool, rules *splitRules, defaultURL string, acks chan<- struct{}, in <-chan []*sqs.Message) (map[string]int, []error) {
+	counts := make(map[string]int)
+	var errors []error
+	for batch := range in {
+		// Routed in the order of the batch, so FIFO groups keep their order in each queue
+		var order []string
+		byQueue := make(map[string][]*sqs.Message)
+		for _, m := range batch {
+			to := defaultURL
+			if rule := rules.route(m); rule != nil {
+				to = rule.url
+			}
+			if _, ok := byQueue[to]; !ok {
+				order = append(order, to)
+			}
+			byQueue[to] = append(byQueue[to], m)
+		}
+		var sent []*sqs.Message
+		for _, to := range order {
+			done, errs := s.resendBatch(to, byQueue[to], fifo, 0, nil, nil)
+			for _, err := range errs {
+				log.Println("Error routing messages", err)
+				noteFailure(err)
+			}
+			errors = append(errors, errs...)
+			counts[queueNameFromURL(to)] += len(done)
+			sent = append(sent, done...)
+		}
+		atomic.AddInt64(&tally.sent, int64(len(sent)))
+		atomic.AddInt64(&tally.failed, int64(len(batch)-len(sent)))
+		if len(sent) > 0 {
+			atomic.AddInt64(&tally.deleted, int64(s.deleteMessageBatch(from, sent)))
+		}
+		if len(sent) < len(batch) {
+			s.changeVisibilityBatch(from, unsentReceipts(batch, sent), 0)
+		}
+		if acks != nil {
+			acks <- struct{}{}
+		}
+	}
+	return counts, errors
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func splitUsage() {
+	fmt.Println("usage: sqscli split [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue to split")
+	fmt.Println("  -rules            YAML file of the routing rules and the default queue")
+	fmt.Println("  -route            QUEUE=EXPRESSION, messages the expression is true for go to QUEUE, repeatable")
+	fmt.Println("  -concurrency      Concurrent receivers, 1 to 32, or auto to scale them (default 1)")
+	fmt.Println("  -since            Only messages sent after, RFC3339 or relative like 2h")
+	fmt.Println("  -until            Only messages sent before, RFC3339 or relative like 30m")
+	fmt.Println("  -filter-attr      Attribute predicate like RetryCount>3 or Source=billing, repeatable")
+	fmt.Println("  -filter           Expression the messages must match, like body.status == \"failed\"")
+	fmt.Println("  -sample           A share of the messages like 1%, or the first N")
+	fmt.Println("  -report           File receiving the JSON summary of the run")
+	os.Exit(0)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// spoolRecord is a line of a spool file
+// a batch record is written before the batch is sent and deleted,
+// a done record once it was, batches without done record are replayed
+type spoolRecord struct {
+	Batch    int            `json:"batch,omitempty"`
+	Queue    string         `json:"queue,omitempty"`
+	Messages []*sqs.Message `json:"messages,omitempty"`
+	Done     int            `json:"done,omitempty"`
+}
+
+// spool persists in-flight batches to a local file
+type spool struct {
+	file    string
+	f       *os.File
+	enc     *json.Encoder
+	next    int
+	pending []spoolRecord // Batches left over by a previous run
+}
+
+// - - - - - - - - - - - - - - - -
+//   SPOOL
+// - - - - - - - - - - - - - - - -
+
+// openSpool opens a spool file, loading the batches a previous run left pending
+func openSpool(file string) *spool {
+	sp := &spool{file: file, next: 1}
+
+	if f, err := os.Open(file); err == nil {
+		batches := make(map[int]spoolRecord)
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var r spoolRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				// A torn last line means we crashed while writing it,
+				// the batch was neither sent nor deleted
+				log.Println("Skipping corrupted spool record", err)
+				continue
+			}
+			if r.Done > 0 {
+				delete(batches, r.Done)
+			} else {
+				batches[r.Batch] = r
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			log.Fatal("Error reading spool ", err)
+		}
+		for _, r := range batches {
+			sp.pending = append(sp.pending, r)
+		}
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal("Error opening spool ", err)
+	}
+	sp.f = f
+	sp.enc = json.NewEncoder(f)
+	// Keep pending batches around until they are replayed
+	for _, r := range sp.pending {
+		sp.record(r)
+	}
+	return sp
+}
+
+// write persists a batch about to be sent to queue, returns its ID
+func (sp *spool) write(queue string, batch []*sqs.Message) int {
+	id := sp.next
+	sp.next++
+	sp.record(spoolRecord{Batch: id, Queue: queue, Messages: batch})
+	return id
+}
+
+// done marks a batch as sent and deleted
+func (sp *spool) done(id int) {
+	sp.record(spoolRecord{Done: id})
+}
+
+// record appends a record and syncs it to disk
+func (sp *spool) record(r spoolRecord) {
+	if r.Batch >= sp.next {
+		sp.next = r.Batch + 1
+	}
+	if err := sp.enc.Encode(r); err != nil {
+		log.Fatal("Error writing spool ", err)
+	}
+	if err := sp.f.Sync(); err != nil {
+		log.Fatal("Error syncing spool ", err)
+	}
+}
+
+// remove deletes the spool file once a run completed
+func (sp *spool) remove() {
+	sp.f.Close()
+	os.Remove(sp.file)
+}
+
+// replaySpool re-sends the batches a crashed run left pending
+// their originals may already be deleted so this is at-least-once
+// messages failing to send are saved to the recovery file, the errors returned are those of batches left pending
+func (s *service) replaySpool(sp *spool) []error {
+	var errors []error
+	for _, r := range sp.pending {
+		log.Printf("Replaying %d spooled messages to %s\n", len(r.Messages), r.Queue)
+		sent, errs := s.resendBatch(r.Queue, r.Messages, s.isFIFO(r.Queue), 0, nil, nil)
+		if len(errs) > 0 {
+			if err := saveForRecovery(r.Queue, unsentMessages(r.Messages, sent), errs[0]); err != nil {
+				errors = append(errors, errs...)
+				continue
+			}
+		}
+		sp.done(r.Batch)
+	}
+	sp.pending = nil
+	return errors
+}
+
+// syncOutput flushes the output, and stdout to disk when it is redirected to a file
+func syncOutput() {
+	if f, ok := output.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			log.Fatal("Error flushing output ", err)
+		}
+	}
+	if stat, err := os.Stdout.Stat(); err == nil && stat.Mode().IsRegular() {
+		if err := os.Stdout.Sync(); err != nil {
+			log.Fatal("Error syncing output ", err)
+		}
+	}
+}
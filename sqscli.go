@@ -8,33 +8,171 @@ import (
 	"io"
 	"log"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 // service struct embeds the sqs connector
-// @TODO - maybe create a "Queue" type that encapsulates queue metadata !
+// the queues it resolves are described by queue, see queue.go
 type service struct {
 	*sqs.SQS
+	sess   *session.Session // To create clients of other AWS services
+	region string           // Labels the queues of multi-region commands
 }
 
-func init() {
+// output is where exports are written, stdout unless encrypted
+var output io.Writer = os.Stdout
+
+// verbose logs how the run resolves what it works on, like queue types, set by -verbose
+var verbose bool
+
+// Export formats of qtocsv -format
+const (
+	exportCSVFormat         = "csv"
+	exportCloudEventsFormat = "cloudevents"
+	exportAvroFormat        = "avro"
+	exportXMLFormat         = "xml"
+	exportYAMLFormat        = "yaml"
+)
+
+// csvOptions tweaks the CSV output
+type csvOptions struct {
+	format      string // csv, cloudevents, avro, xml or yaml
+	fifo        bool
+	checksums   bool               // Adds MD5 columns
+	traceColumn bool               // Adds the trace header column
+	annotate    bool               // Adds the queue, region, account and export time to each record
+	source      *exportSource      // The exported queue, with annotate
+	attributes  attributeSelection // Attributes added as columns
+	spool       string             // Spool file persisting in-flight batches
+	kmsKey      string             // KMS key encrypting the output
+	redact      redactor           // Rules masking the exported bodies
+	filter      messageFilter      // Selects the exported messages
+	tolerance   float64            // Shortfall percentage accepted by the completeness check
+	schema      string             // Avro schema, from a file or a schema registry
+	avro        *avroWriter        // Avro container file of the output
+	split       *splitWriter       // Part files of the output, nil for stdout
+	s3URI       string             // S3 object receiving the output
+	manifest    string             // Manifest file of the S3 export
+	partSize    int64              // Size of the S3 upload parts
+	s3          *s3Writer          // Multipart upload of the output
+	sinkURI     string             // Sink receiving the messages instead of the output, -sink
+	sink        messageSink        // Opened sink of sinkURI
+	copies      *runCopies         // Copies re-added by the export, kept next to the manifest of an S3 export
+	resumed     bool               // The queue export continues a resumed run
+	expected    int                // Messages the queue held at the start, the export stops once through them
+	concurrency int                // Concurrent receivers, or adaptiveReceivers
+	order       string             // Order of the records, orderArrival or orderSent
+	orderWindow int                // Messages held to order them, with orderSent
+	sort        string             // Sort key of the records, sortNone by default
+	sortDir     string             // Directory of the sort journal and runs
+	sorter      *sorter            // Sorts the records of the queue exported
+}
+
+// moveOptions tweaks how qtoq moves messages
+type moveOptions struct {
+	spool       string          // Spool file persisting in-flight batches
+	staged      bool            // Moves through a temporary staging queue
+	dedup       *deduper        // Skips messages a previous run already sent
+	filter      messageFilter   // Selects the moved messages
+	maxReceives int             // Messages received more often are diverted
+	onExceed    string          // Where diverted messages go
+	bounces     *bounceTracker  // Diverts the messages redriven too many times
+	concurrency int             // Concurrent receivers, or adaptiveReceivers
+	provenance  bool            // Stamps the moved messages with their source queue and operation
+	rewrite     *messageRewrite // Rewrites the attributes and bodies of the moved messages
+	groupPrefix string          // Prefixes the FIFO message groups of the moved messages
+	delay       int64           // DelaySeconds of the moved messages, standard queues only
+}
+
+// parseGlobalFlags parses the flags coming before the command, and the settings holding their defaults
+// run by main rather than init, so the tests of the package start without a command line
+func parseGlobalFlags() {
 	// Go / no go ?
 	help := flag.Bool("help", false, "help")
 	flag.BoolVar(help, "h", false, "help") // Aliasing
-	flag.Parse()
+	flag.StringVar(&checksumMode, "checksum", checksumWarn, "MD5 mismatch handling: warn, fail or off")
+	flag.BoolVar(&localMode, "local", false, "run against an in-process SQS emulator")
+	flag.StringVar(&localStateFile, "local-state", "", "file persisting the emulated queues")
+	flag.StringVar(&recordDir, "record", "", "directory capturing the AWS API calls")
+	flag.StringVar(&replayDir, "replay", "", "directory of captured AWS API calls to replay")
+	flag.StringVar(&awsRegion, "region", defaultRegion, "region of the queues")
+	flag.StringVar(&environmentName, "env", "", "environment of the settings file, the one of use-env by default")
+	flag.StringVar(&awsProfile, "profile", "", "shared config profile of the credentials, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY by default")
+	flag.StringVar(&endpointURL, "endpoint-url", "", "SQS endpoint of the -region queues, like a VPC endpoint")
+	flag.BoolVar(&endpointFallback, "endpoint-fallback", false, "use the public endpoint when the endpoint doesn't resolve")
+	flag.StringVar(&proxyURL, "proxy", "", "proxy of the HTTP calls, HTTPS_PROXY by default")
+	flag.StringVar(&caBundle, "ca-bundle", caBundleFromEnv(), "PEM certificates trusted on top of the system ones")
+	flag.StringVar(&awsPartition, "partition", "", "partition of the region: aws, aws-cn, aws-us-gov...")
+	flag.StringVar(&otlpEndpoint, "otlp", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector receiving spans and metrics")
+	flag.BoolVar(&readOnly, "read-only", false, "block every call that changes queues or their messages")
+	flag.StringVar(&recoveryFile, "recovery-file", defaultRecoveryFile(), "JSONL file keeping the messages that failed to be sent back, for recover")
+	flag.BoolVar(&verbose, "verbose", false, "log how queue types and lookups are resolved")
+	flag.BoolVar(&noCache, "no-cache", false, "look up queue URLs and types on every use")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "keep queue URLs and types in ~/.sqscli/cache.json this long, 0 for the run only")
+	flag.BoolVar(&exactNames, "exact", false, "no close matches for queue names that don't exist")
+	flag.BoolVar(&assumeYes, "yes", false, "confirm the runs guardrails require -yes for")
+	flag.StringVar(&ticket, "ticket", "", "change or incident ticket of the run, recorded in the audit log")
+	flag.StringVar(&auditLog, "audit-log", defaultAuditLog(), "JSONL file or s3://bucket/prefix recording destructive actions, off to disable")
+	flag.StringVar(&healthAddr, "health", "", "listen address of the /healthz and /readyz probes, like :8080")
+	flag.StringVar(&outputFormat, "o", "", "output format: table, wide, json or yaml")
+	flag.BoolVar(&noColor, "no-color", false, "no colors in the output, even in a terminal")
+	timeFormatFlag := flag.String("time-format", "", "times in the output: rfc3339, epoch or relative")
+	timeZoneFlag := flag.String("timezone", "UTC", "timezone of the RFC3339 times, like Local or Europe/Paris")
+	// Hidden, set by ops resume
+	flag.StringVar(&operationID, "operation-id", "", "continue the bulk operation of this ID")
+	// Hidden, for resilience testing
+	injectFailure := flag.String("inject-failure", "", "fail a share of the calls, e.g. send:0.05,delete:0.02")
+	// Settings hold flag defaults
+	if err := loadSettings(); err != nil {
+		log.Fatal(err)
+	}
+	parseFlags(flag.CommandLine, os.Args[1:])
 
-	if len(os.Args) == 1 || *help {
+	if flag.NArg() == 0 || *help {
 		usage()
 	}
+	if checksumMode != checksumWarn && checksumMode != checksumFail && checksumMode != checksumOff {
+		log.Fatal("Checksum mode must be warn, fail or off")
+	}
+	if len(localStateFile) > 0 {
+		localMode = true
+	}
+	if len(outputFormat) > 0 && !isOutputFormat(outputFormat) {
+		log.Fatal("Output format must be table, wide, json or yaml")
+	}
+	if err := parseTimeFlags(*timeFormatFlag, *timeZoneFlag); err != nil {
+		log.Fatal(err)
+	}
+	if len(endpointURL) > 0 {
+		if _, err := parseEndpoint(endpointURL); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(recordDir) > 0 && len(replayDir) > 0 {
+		log.Fatal("-record and -replay can't be used together")
+	}
+	if len(*injectFailure) > 0 {
+		var err error
+		if failureRates, err = parseFailureRates(*injectFailure); err != nil {
+			log.Fatal("Invalid -inject-failure ", err)
+		}
+	}
 }
 
 func main() {
+	parseGlobalFlags()
+
 	// Subcommands
 	toCsvCommand := flag.NewFlagSet("qtocsv", flag.ExitOnError)
 	toQCommand := flag.NewFlagSet("qtoq", flag.ExitOnError)
@@ -42,6 +180,38 @@ func main() {
 	// Flags
 	queueName := toCsvCommand.String("queue", "", "queue name")
 	toCsvCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	checksums := toCsvCommand.Bool("md5", false, "add MD5 checksum columns")
+	csvTraceColumn := toCsvCommand.Bool("trace-column", false, "add the trace header column, X-Ray or W3C")
+	csvSystemAttrs := toCsvCommand.String("system-attributes", "", "system attributes added as columns, comma separated or All")
+	csvMessageAttrs := toCsvCommand.String("message-attributes", "", "message attributes added as columns, comma separated or All")
+	csvAnnotate := toCsvCommand.Bool("annotate", false, "add the queue, its URL, region and account, and the export time to each record")
+	csvSpool := toCsvCommand.String("spool", "", "spool file persisting in-flight batches")
+	csvKMS := toCsvCommand.String("kms-encrypt-export", "", "KMS key ID encrypting the output")
+	csvReport := toCsvCommand.String("report", "", "file receiving the JSON summary")
+	csvRedact := &attrFlag{}
+	csvOnComplete := &hookFlag{}
+	csvFilter := newFilterFlags(toCsvCommand)
+	csvFormat := toCsvCommand.String("format", exportCSVFormat, "output format: csv, cloudevents, avro, xml or yaml")
+	csvAvroSchema := toCsvCommand.String("avro-schema", "", "Avro schema file")
+	csvRegistry := toCsvCommand.String("schema-registry", "", "schema registry URL serving the Avro schema")
+	csvSplitSize := toCsvCommand.String("split-size", "", "start a new part file past this size, like 100MB")
+	csvSplitCount := toCsvCommand.Int("split-count", 0, "start a new part file past this many messages")
+	csvSplitPrefix := toCsvCommand.String("split-prefix", "export", "part file names prefix")
+	csvGzip := toCsvCommand.Bool("gzip", false, "gzip the part files")
+	csvConcurrency := toCsvCommand.String("concurrency", "1", "concurrent receivers, or auto")
+	csvOrder := toCsvCommand.String("order", orderArrival, "order of the records: arrival or sent")
+	csvOrderWindow := toCsvCommand.Int("order-window", 100, "messages held to order the records by sent time")
+	csvSort := toCsvCommand.String("sort", sortNone, "sort the records of each queue: sent, sequence or none")
+	csvSortDir := toCsvCommand.String("sort-dir", "", "directory of the sort files, the temporary directory by default")
+	csvS3 := toCsvCommand.String("s3", "", "S3 object receiving the export, s3://bucket/key")
+	csvSink := toCsvCommand.String("sink", "", "sink receiving the messages as JSON instead of the formatted output")
+	csvTransform := toCsvCommand.String("transform", "", "expr:EXPRESSION or transform plugin sqscli-transform-NAME the exported bodies go through")
+	csvManifest := toCsvCommand.String("manifest", "", "manifest file of the S3 export, <key>.manifest.json by default")
+	csvPartSize := toCsvCommand.String("part-size", "8MB", "size of the S3 upload parts, at least 5MB")
+	csvSubject := toCsvCommand.String("schema-subject", "", "schema registry subject, <queue>-value by default")
+	csvTolerance := toCsvCommand.Float64("tolerance", 0, "percentage of missing messages accepted by the completeness check")
+	toCsvCommand.Var(csvRedact, "redact", "redaction rule, repeatable")
+	toCsvCommand.Var(csvOnComplete, "on-complete", "exec:COMMAND or webhook:URL run once the export is done, repeatable")
 	queueHelp := toCsvCommand.Bool("help", false, "help for qtocsv command")
 	toCsvCommand.BoolVar(queueHelp, "h", false, "help") // Aliasing
 
@@ -49,30 +219,397 @@ func main() {
 	toQCommand.StringVar(qFrom, "q1", "", "queue from") // Aliasing
 	qTo := toQCommand.String("queue2", "", "queue to")
 	toQCommand.StringVar(qTo, "q2", "", "queue to") // Aliasing
+	qFromRegion := toQCommand.String("region1", "", "region of the queue from, -region by default")
+	qToRegion := toQCommand.String("region2", "", "region of the queue to, -region by default")
+	qToQSink := toQCommand.String("sink", "", "sink the messages are moved to instead of a queue")
+	qToQSpool := toQCommand.String("spool", "", "spool file persisting in-flight batches")
+	qToQStaged := toQCommand.Bool("staged", false, "move through a temporary staging queue")
+	qToQReport := toQCommand.String("report", "", "file receiving the JSON summary")
+	qToQOnComplete := &hookFlag{}
+	toQCommand.Var(qToQOnComplete, "on-complete", "exec:COMMAND or webhook:URL run once the move is done, repeatable")
+	qToQDedupe := toQCommand.String("dedupe-by", "", "skip messages already sent: body-hash, message-id, jmespath:QUERY or expr:EXPRESSION")
+	qToQDedupeState := toQCommand.String("dedupe-state", "", "file persisting the keys already sent")
+	qToQFilter := newFilterFlags(toQCommand)
+	qToQRewrite := newRewriteFlags(toQCommand)
+	qToQMaxReceives := toQCommand.Int("max-receive-count-filter", 0, "divert messages received more times than this")
+	qToQOnExceed := toQCommand.String("on-exceed", "", "where diverted messages go: drop, park:QUEUE or export:FILE")
+	qToQMaxBounces := toQCommand.Int("max-bounces", 0, "divert messages already redriven this many times within -bounce-window")
+	qToQBounceState := toQCommand.String("bounce-state", "", "file recording the messages redriven, shared by the runs")
+	qToQBounceWindow := toQCommand.Duration("bounce-window", defaultBounceWindow, "how long redrives are remembered")
+	qToQOnBounce := toQCommand.String("on-bounce", "", "where bounced messages go: drop, park:QUEUE or export:FILE")
+	qToQConcurrency := toQCommand.String("concurrency", "1", "concurrent receivers, or auto")
+	qToQDelay := toQCommand.Int64("delay-seconds", 0, "delay before re-sent messages become visible (0-900), standard queues")
+	qToQProvenance := toQCommand.Bool("provenance", false, "stamp moved messages with sqscli.sourceQueue, sqscli.movedAt and sqscli.operationId")
 	qToQHelp := toQCommand.Bool("help", false, "help for qtoq command")
 	toQCommand.BoolVar(qToQHelp, "h", false, "help") // Aliasing
 
 	// Command
-	switch os.Args[1] {
+	args := flag.Args()
+	// The daemon, mirror and canary add their own endpoints, and the daemon jobs trace themselves
+	if len(healthAddr) > 0 && args[0] != "daemon" && args[0] != "mirror" && args[0] != "canary" {
+		serveHealth(healthAddr, nil)
+	}
+	if args[0] != "daemon" {
+		startTelemetry(args[0])
+	}
+	switch args[0] {
 	case "qtocsv":
-		toCsvCommand.Parse(os.Args[2:])
+		parseFlags(toCsvCommand, args[1:])
 		if *queueHelp {
 			toCSVUsage()
 			break
 		}
-		toCSV(*queueName)
+		redact, err := parseRedactRules(*csvRedact)
+		if err != nil {
+			log.Fatal(err)
+		}
+		completionHooks = *csvOnComplete
+		startReport("qtocsv", *csvReport, *queueName)
+		if *csvTolerance < 0 || *csvTolerance > 100 {
+			log.Fatal("Tolerance must be between 0 and 100")
+		}
+		attributes, err := parseAttributeSelection(*csvSystemAttrs, *csvMessageAttrs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if (len(*csvSystemAttrs) > 0 || len(*csvMessageAttrs) > 0) && (*csvFormat == exportCloudEventsFormat || *csvFormat == exportAvroFormat) {
+			log.Fatal("-system-attributes and -message-attributes require -format csv, xml or yaml")
+		}
+		var schema string
+		switch *csvFormat {
+		case exportCSVFormat, exportCloudEventsFormat, exportXMLFormat, exportYAMLFormat:
+			if len(*csvAvroSchema) > 0 || len(*csvRegistry) > 0 {
+				log.Fatal("-avro-schema and -schema-registry require -format avro")
+			}
+		case exportAvroFormat:
+			if *csvAnnotate {
+				log.Fatal("-annotate is not supported with -format avro, records follow the schema")
+			}
+			if (len(*csvAvroSchema) > 0) == (len(*csvRegistry) > 0) {
+				log.Fatal("-format avro requires either -avro-schema or -schema-registry")
+			}
+			subject := *csvSubject
+			if len(subject) == 0 {
+				subject = *queueName + "-value"
+			}
+			if schema, err = loadAvroSchema(*csvAvroSchema, *csvRegistry, subject); err != nil {
+				log.Fatal("Error loading the Avro schema ", err)
+			}
+		default:
+			log.Fatal("Format must be csv, cloudevents, avro, xml or yaml")
+		}
+		var split *splitWriter
+		if len(*csvSplitSize) > 0 || *csvSplitCount != 0 {
+			var maxBytes int64
+			if len(*csvSplitSize) > 0 {
+				if maxBytes, err = parseSize(*csvSplitSize); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if *csvSplitCount < 0 {
+				log.Fatal("Split count must be positive")
+			}
+			split = newSplitWriter(*csvSplitPrefix, *csvFormat, *csvGzip, maxBytes, *csvSplitCount)
+		} else if *csvGzip {
+			log.Fatal("-gzip requires -split-size or -split-count")
+		}
+		concurrency, err := parseConcurrency(*csvConcurrency)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *csvOrder != orderArrival && *csvOrder != orderSent {
+			log.Fatal("Order must be arrival or sent")
+		}
+		if *csvOrderWindow < 1 || *csvOrderWindow > maxOrderWindow {
+			log.Fatal("Order window must be between 1 and 10000 messages")
+		}
+		switch *csvSort {
+		case sortNone:
+		case sortSent, sortSequence:
+			if *csvOrder == orderSent {
+				log.Fatal("-sort already orders the records, -order sent is not needed")
+			}
+			if len(*csvS3) > 0 {
+				log.Fatal("-sort is not supported with -s3, resumed uploads need the records in received order")
+			}
+		default:
+			log.Fatal("Sort must be sent, sequence or none")
+		}
+		if len(*csvSink) > 0 {
+			if *csvFormat != exportCSVFormat || split != nil || len(*csvS3) > 0 || len(*csvKMS) > 0 || len(*csvRedact) > 0 {
+				log.Fatal("-sink writes whole messages, it is not supported with -format, -split-size, -split-count, -s3, -kms-encrypt-export or -redact")
+			}
+			if _, _, err := parseSinkURI(*csvSink); err != nil {
+				log.Fatal(err)
+			}
+			report.Output = *csvSink
+		}
+		var partSize int64
+		manifest := *csvManifest
+		if len(*csvS3) > 0 {
+			if split != nil || len(*csvKMS) > 0 {
+				log.Fatal("-s3 is not supported with -split-size, -split-count or -kms-encrypt-export")
+			}
+			_, key, err := parseS3URI(*csvS3)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if partSize, err = parseSize(*csvPartSize); err != nil {
+				log.Fatal(err)
+			}
+			if partSize < s3MinPartSize {
+				log.Fatal("Part size must be at least 5MB")
+			}
+			if len(manifest) == 0 {
+				manifest = path.Base(key) + s3ManifestSuffix
+			}
+			report.Output = *csvS3
+		} else if len(manifest) > 0 {
+			log.Fatal("-manifest requires -s3")
+		}
+		if split != nil {
+			report.Output = *csvSplitPrefix
+		}
+		// Spools re-add messages, read-only exports have nothing to re-add
+		spoolFile := operationSpool(*csvSpool)
+		if readOnly {
+			if len(*csvSpool) > 0 {
+				log.Fatal("-spool re-adds messages, it can't be used with -read-only")
+			}
+			spoolFile = ""
+		}
+		startBodyDecoder(*csvTransform)
+		complete := toCSV(*queueName, csvOptions{
+			format:      *csvFormat,
+			checksums:   *checksums,
+			traceColumn: *csvTraceColumn,
+			annotate:    *csvAnnotate,
+			attributes:  attributes,
+			spool:       spoolFile,
+			kmsKey:      *csvKMS,
+			redact:      redact,
+			filter:      csvFilter.filter(),
+			tolerance:   *csvTolerance,
+			schema:      schema,
+			split:       split,
+			s3URI:       *csvS3,
+			sinkURI:     *csvSink,
+			manifest:    manifest,
+			partSize:    partSize,
+			concurrency: concurrency,
+			order:       *csvOrder,
+			orderWindow: *csvOrderWindow,
+			sort:        *csvSort,
+			sortDir:     *csvSortDir,
+		})
+		stopBodyDecoder()
+		if !complete {
+			failReport()
+		}
+		finishReport()
+		if !complete {
+			os.Exit(1)
+		}
 		break
 	case "qtoq":
-		toQCommand.Parse(os.Args[2:])
+		parseFlags(toQCommand, args[1:])
 		if *qToQHelp {
 			toQUsage()
 			break
 		}
-		toQ(*qFrom, *qTo)
+		var dedup *deduper
+		if len(*qToQDedupe) > 0 {
+			var err error
+			if dedup, err = newDeduper(*qToQDedupe, *qToQDedupeState); err != nil {
+				log.Fatal(err)
+			}
+			if *qToQStaged {
+				log.Fatal("-dedupe-by is not supported with -staged")
+			}
+		} else if len(*qToQDedupeState) > 0 {
+			log.Fatal("-dedupe-state requires -dedupe-by")
+		}
+		if (*qToQMaxReceives > 0) != (len(*qToQOnExceed) > 0) {
+			log.Fatal("-max-receive-count-filter and -on-exceed go together")
+		}
+		if *qToQMaxReceives > 0 && *qToQStaged {
+			log.Fatal("-max-receive-count-filter is not supported with -staged")
+		}
+		var bounces *bounceTracker
+		if *qToQMaxBounces > 0 || len(*qToQBounceState) > 0 || len(*qToQOnBounce) > 0 {
+			if *qToQMaxBounces <= 0 || len(*qToQBounceState) == 0 || len(*qToQOnBounce) == 0 {
+				log.Fatal("-max-bounces, -bounce-state and -on-bounce go together")
+			}
+			if *qToQStaged || len(*qToQSink) > 0 {
+				log.Fatal("-max-bounces is not supported with -staged or -sink")
+			}
+			var err error
+			if bounces, err = newBounceTracker(*qToQMaxBounces, *qToQBounceWindow, *qToQBounceState, *qToQOnBounce); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *qToQDelay < 0 || *qToQDelay > maxDelaySeconds {
+			log.Fatal("Delay must be between 0 and 900 seconds")
+		}
+		if *qToQDelay > 0 && (*qToQStaged || len(*qToQSink) > 0) {
+			log.Fatal("-delay-seconds is not supported with -staged or -sink")
+		}
+		rewrite := qToQRewrite.rewrite()
+		if rewrite != nil && *qToQStaged {
+			log.Fatal("-set-attr, -drop-attr, -replace, -transform and -trace are not supported with -staged")
+		}
+		concurrency, err := parseConcurrency(*qToQConcurrency)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(*qToQSink) > 0 {
+			if len(*qTo) > 0 || len(*qToRegion) > 0 {
+				log.Fatal("-sink replaces -queue2 and -region2")
+			}
+			if *qToQStaged || dedup != nil || *qToQMaxReceives > 0 || rewrite != nil || *qToQProvenance || len(*qToQSpool) > 0 {
+				log.Fatal("-sink is not supported with -staged, -dedupe-by, -max-receive-count-filter, -spool, -provenance or the rewrites")
+			}
+			if _, _, err := parseSinkURI(*qToQSink); err != nil {
+				log.Fatal(err)
+			}
+		}
+		// Checked before the guardrails resolve the queue from
+		if len(*qFrom) == 0 || (len(*qTo) == 0 && len(*qToQSink) == 0) {
+			fmt.Println("Required argument is missing.")
+			toQUsage()
+		}
+		fromRegion := *qFromRegion
+		if len(fromRegion) == 0 {
+			fromRegion = awsRegion
+		}
+		// Guardrails match the queue name, not a URL or @bookmark
+		fromSvc := newRegionService(fromRegion)
+		enforceGuardrails("qtoq", []string{fromSvc.resolveQueue(*qFrom).name}, fromSvc.depthCounter(), false)
+		completionHooks = *qToQOnComplete
+		if len(*qToQSink) > 0 {
+			startReport("qtoq", *qToQReport, *qFrom, *qToQSink)
+			toSink(*qFrom, *qFromRegion, *qToQSink, moveOptions{filter: qToQFilter.filter(), concurrency: concurrency})
+			finishReport()
+			break
+		}
+		startReport("qtoq", *qToQReport, *qFrom, *qTo)
+		toQ(*qFrom, *qTo, *qFromRegion, *qToRegion, moveOptions{
+			spool:       operationSpool(*qToQSpool),
+			staged:      *qToQStaged,
+			dedup:       dedup,
+			filter:      qToQFilter.filter(),
+			maxReceives: *qToQMaxReceives,
+			onExceed:    *qToQOnExceed,
+			bounces:     bounces,
+			concurrency: concurrency,
+			delay:       *qToQDelay,
+			provenance:  *qToQProvenance,
+			rewrite:     rewrite,
+		})
+		rewrite.close()
+		finishReport()
 		break
+	case "send":
+		send(args[1:])
+	case "generate":
+		generate(args[1:])
+	case "change-visibility":
+		changeVisibility(args[1:])
+	case "peek":
+		peek(args[1:])
+	case "head":
+		head(args[1:])
+	case "delete":
+		sessionCommand("delete", args[1:])
+	case "release":
+		sessionCommand("release", args[1:])
+	case "extend":
+		sessionCommand("extend", args[1:])
+	case "stats":
+		stats(args[1:])
+	case "count":
+		count(args[1:])
+	case "list":
+		list(args[1:])
+	case "watch":
+		watch(args[1:])
+	case "purge":
+		purge(args[1:])
+	case "expire":
+		expire(args[1:])
+	case "lag":
+		lag(args[1:])
+	case "poison-report":
+		poisonReport(args[1:])
+	case "fifo-verify":
+		fifoVerify(args[1:])
+	case "split":
+		split(args[1:])
+	case "merge":
+		merge(args[1:])
+	case "mirror":
+		mirror(args[1:])
+	case "canary":
+		canary(args[1:])
+	case "soak":
+		soak(args[1:])
+	case "fill":
+		fill(args[1:])
+	case "drain":
+		drain(args[1:])
+	case "diff":
+		diff(args[1:])
+	case "park":
+		parkCommand("park", args[1:])
+	case "unpark":
+		parkCommand("unpark", args[1:])
+	case "audit":
+		audit(args[1:])
+	case "config":
+		config(args[1:])
+	case "create":
+		create(args[1:])
+	case "set-attrs":
+		setAttrs(args[1:])
+	case "decrypt-export":
+		decryptExport(args[1:])
+	case "whoami":
+		whoami(args[1:])
+	case "ping":
+		ping(args[1:])
+	case "daemon":
+		daemon(args[1:])
+	case "grant":
+		grant(args[1:])
+	case "iam-policy":
+		iamPolicy(args[1:])
+	case "ops":
+		ops(args[1:])
+	case "drain-all":
+		drainAll(args[1:])
+	case "migrate":
+		migrate(args[1:])
+	case "use-env":
+		useEnv(args[1:])
+	case "recover":
+		recoverMessages(args[1:])
+	case "import":
+		importMessages(args[1:])
+	case "plugins":
+		listPlugins(args[1:])
+	case "run":
+		runScript(args[1:])
+	case "shell":
+		shell(args[1:])
+	case "bookmark":
+		bookmarkCommand(args[1:])
 	default:
-		fmt.Println("Command not found.")
+		// sqscli-NAME on PATH
+		if !runCommandPlugin(args) {
+			fmt.Println("Command not found.")
+		}
 	}
+	endTelemetry()
 }
 
 // - - - - - - - - - - - - - - - -
@@ -80,7 +617,9 @@ func main() {
 // - - - - - - - - - - - - - - - -
 
 // toCSV outputs the content of a queue in a CSV file
-func toCSV(queue string) {
+// a queue name with wildcards exports every matching queue in its own section
+// returns false if fewer messages were written than the queues held at the start
+func toCSV(queue string, opts csvOptions) bool {
 	// Verify
 	if len(queue) == 0 {
 		fmt.Println("Required queue name is missing.")
@@ -89,120 +628,411 @@ func toCSV(queue string) {
 
 	// Connect
 	svc := newService()
+	handleInterrupts()
 
-	// Query the queue
-	qURL := svc.getQueueURL(queue)
-	fifo := svc.isFIFO(qURL)
-	var readdMessages []*sqs.Message // Messages to re-add later
-
-	insertCSVHead(fifo)
-	// Getting all messages
-	for {
-		result := svc.receiveMessages(qURL, 10, fifo) // Batch of 10
-
-		if len(result.Messages) == 0 {
-			break // We are done
+	if len(opts.sinkURI) > 0 {
+		sink, err := svc.newMessageSink(opts.sinkURI)
+		if err != nil {
+			log.Fatal("Error opening the sink ", err)
+		}
+		opts.sink = sink
+		defer func() {
+			if err := sink.Close(); err != nil {
+				log.Fatal("Error closing the sink ", err)
+			}
+		}()
+	} else if len(opts.s3URI) > 0 {
+		opts.s3 = svc.newS3Writer(opts.s3URI, opts.manifest, opts.format, opts.partSize)
+		// The copies re-added before an interruption are known from their message IDs
+		copies, err := openRunCopies(opts.manifest+".copies", opts.s3.manifest.RunID)
+		if err != nil {
+			log.Fatal("Error opening the copies of the export ", err)
 		}
+		opts.copies = copies
+		output = opts.s3
+	} else if opts.split != nil {
+		// Each part is encrypted with its own data key
+		if len(opts.kmsKey) > 0 {
+			opts.split.encrypt = func(w io.Writer) io.WriteCloser {
+				return svc.newKMSWriter(opts.kmsKey, w)
+			}
+		}
+		defer func() {
+			if err := opts.split.Close(); err != nil {
+				log.Fatal("Error closing part file ", err)
+			}
+		}()
+		output = opts.split
+	} else if len(opts.kmsKey) > 0 {
+		w := svc.newKMSWriter(opts.kmsKey, os.Stdout)
+		defer w.Close()
+		output = w
+	}
+	// A resumed S3 export already holds the file headers
+	resumed := opts.s3 != nil && opts.s3.resumed
+	if opts.format == exportAvroFormat {
+		w, err := newAvroWriter(output, opts.schema)
+		if err != nil {
+			log.Fatal("Error starting the Avro output ", err)
+		}
+		if opts.s3 != nil {
+			opts.s3.syncAvro(w)
+		}
+		if !resumed {
+			if err := w.writeHeader(); err != nil {
+				log.Fatal("Error starting the Avro output ", err)
+			}
+		}
+		opts.avro = w
+	}
 
-		// Process
-		for _, m := range result.Messages {
-			// Readd later
-			readdMessages = append(readdMessages, m)
-			formatCSV(m, fifo)
+	// Query the queues
+	queues := svc.queuesMatching(queue)
+	var sp *spool
+	if len(opts.spool) > 0 {
+		sp = openSpool(opts.spool)
+		if errs := svc.replaySpool(sp); len(errs) > 0 {
+			log.Fatal("There were errors replaying the spool", errs)
 		}
+	}
 
-		// Delete in batch
-		svc.deleteMessageBatch(qURL, result.Messages)
+	complete := true
+	if opts.format == exportXMLFormat && !resumed {
+		startXML()
+	}
+	for _, q := range queues {
+		name := q.name
+		qOpts := opts
+		if opts.s3 != nil {
+			if opts.s3.queueDone(name) {
+				log.Println("Skipping", name, "exported by the resumed run")
+				continue
+			}
+			qOpts.resumed = !opts.s3.startQueue(name)
+		}
+		// Events carry their queue in their source, XML in the queue element
+		switch {
+		case qOpts.resumed, opts.sink != nil:
+		case opts.format == exportXMLFormat:
+			startXMLQueue(name)
+		case len(queues) > 1 && (opts.format == exportCSVFormat || opts.format == exportYAMLFormat):
+			fmt.Fprintf(output, "# %s\n", name)
+		}
+		expected := q.depth()
+		qOpts.expected = expected
+		written := svc.exportCSV(q, qOpts, sp)
+		if opts.format == exportXMLFormat {
+			endXMLQueue()
+		}
+		if opts.s3 != nil {
+			opts.s3.finishQueue(name)
+			syncOutput()
+		}
+		// Filters skip messages on purpose, and resumed queues were partly written before
+		if qOpts.resumed {
+			log.Printf("%d more messages written from %s, completeness is not checked on resume\n", written, name)
+		} else if opts.filter == nil && !isComplete(written, expected, opts.tolerance) {
+			log.Printf("Warning: %d messages written from %s, which held about %d at the start\n",
+				written, name, expected)
+			complete = false
+		}
 	}
 
-	// Re-add the messages to the queue
-	errs := svc.sendMessageBatch(qURL, readdMessages, 10, fifo)
-	if len(errs) > 0 {
-		log.Fatal("There were errors re-adding the messages", errs)
+	if opts.format == exportXMLFormat {
+		endXML()
+	}
+	if opts.s3 != nil {
+		opts.s3.complete()
+		opts.copies.remove()
+	}
+	if sp != nil {
+		sp.remove()
 	}
+	return complete
 }
 
 // toQ redrives a queue in another queue of the same type
 // usefull to process DLQs for instance
-func toQ(qFrom, qTo string) {
+// a spool file makes the run crash-safe, it is replayed on restart
+// staged moves copy everything to a temporary queue before deleting anything
+// a deduper skips the messages a previous run already sent
+// only the messages the filter keeps are moved
+// messages received too many times can be dropped, parked or exported instead
+// the queues may be in different regions, each gets its own connection
+func toQ(qFrom, qTo, fromRegion, toRegion string, opts moveOptions) {
 	// Verify
-	if len(qFrom) == 0 && len(qTo) == 0 {
+	if len(qFrom) == 0 || len(qTo) == 0 {
 		fmt.Println("Required argument is missing.")
 		toQUsage()
 	}
 
+	if len(fromRegion) == 0 {
+		fromRegion = awsRegion
+	}
+	if len(toRegion) == 0 {
+		toRegion = awsRegion
+	}
+
 	// Connect
-	svc := newService()
+	svc := newRegionService(fromRegion)
+	target := svc
+	if toRegion != fromRegion {
+		target = newRegionService(toRegion)
+	}
+	handleInterrupts()
+
+	svc.moveQueue(svc.resolveQueue(qFrom), target.resolveQueue(qTo), opts)
+}
 
-	// Get queues FQDN
-	qFromURL := svc.getQueueURL(qFrom)
-	qToURL := svc.getQueueURL(qTo)
-	fifo := svc.isFIFO(qFromURL)
-	fifo2 := svc.isFIFO(qToURL)
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// moveQueue streams a queue to another queue of the same type
+// the queue to is reached through its own service, it may be in another region
+func (s *service) moveQueue(from, to *queue, opts moveOptions) {
+	qFromURL, fifo := from.url, from.fifo
 	// Little sanity check on the queues
-	if fifo != fifo2 {
+	if fifo != to.fifo {
 		log.Fatal("Cannot redrive queues that are not of the same type")
 	}
 
-	// Query the queues
-	var readdMessages []*sqs.Message // Messages to re-add later
-	for {
-		result := svc.receiveMessages(qFromURL, 10, fifo) // Batch of 10
+	var prov *provenance
+	if opts.provenance {
+		prov = newProvenance(qFromURL)
+	}
 
-		if len(result.Messages) == 0 {
-			break // We are done
+	// Stream the queue: receive -> send to the other queue and delete
+	if opts.staged {
+		processed, errs := s.stagedMove(from, to, opts.filter, prov)
+		s.exitIfInterrupted(qFromURL, processed)
+		if len(errs) > 0 {
+			failReport()
+			finishReport()
+			log.Fatal("There were errors moving the messages", errs)
 		}
+		return
+	}
 
-		// Process
-		readdMessages = append(readdMessages, result.Messages...)
+	pOpts := pipelineOptions{dedup: opts.dedup, provenance: prov, rewrite: opts.rewrite, delay: opts.delay}
+	if opts.maxReceives > 0 {
+		route, err := s.newExceedRoute(opts.maxReceives, opts.onExceed, fifo)
+		if err != nil {
+			log.Fatal("Invalid -on-exceed ", err)
+		}
+		pOpts.exceed = route
+	}
+	if opts.bounces != nil {
+		route, err := s.newDivertRoute(opts.bounces.onBounce, fifo)
+		if err != nil {
+			log.Fatal("Invalid -on-bounce ", err)
+		}
+		opts.bounces.route = route
+		pOpts.bounces = opts.bounces
+	}
+	if len(opts.spool) > 0 {
+		pOpts.spool = openSpool(opts.spool)
+		if errs := to.svc.replaySpool(pOpts.spool); len(errs) > 0 {
+			log.Fatal("There were errors replaying the spool", errs)
+		}
+	}
+	acks := newAcks(fifo)
+	pOpts.acks = acks
+	in := s.receiveStage(from, nil, opts.filter, acks, opts.concurrency)
+	if len(opts.groupPrefix) > 0 {
+		in = regroupStage(opts.groupPrefix, in)
+	}
+	processed, errs := s.resendStage(from, to, pOpts, in)
+	s.exitIfInterrupted(qFromURL, processed)
+	if len(errs) > 0 {
+		failReport()
+		finishReport()
+		log.Fatal("There were errors re-adding the messages", errs)
+	}
+	if pOpts.spool != nil {
+		pOpts.spool.remove()
+	}
+}
 
-		// Delete in batch
-		svc.deleteMessageBatch(qFromURL, result.Messages)
+// exportCSV streams a queue to the CSV output
+// messages are re-added to the queue once written
+// returns the number of messages written
+func (s *service) exportCSV(q *queue, opts csvOptions, sp *spool) int {
+	qURL, fifo := q.url, q.fifo
+	// Later messages of a FIFO group are not received while the first ones are held
+	if readOnly && fifo {
+		log.Fatalf("FIFO queues can't be exported without deleting, %s can't be exported with -read-only\n", queueNameFromURL(qURL))
+	}
+	opts.fifo = fifo
+	if opts.annotate {
+		opts.source = s.newExportSource(qURL)
 	}
 
-	// Re-add the messages to the queue
-	errs := svc.sendMessageBatch(qToURL, readdMessages, 10, fifo)
+	if opts.format == exportCSVFormat && !opts.resumed && opts.sink == nil {
+		insertCSVHead(opts)
+	}
+	// Stream all messages: receive -> write -> re-add and delete
+	// re-added copies are recognised by their message ID so we don't export them twice, nor a resumed run
+	copies := opts.copies
+	if copies == nil {
+		copies = markedCopies("")
+	}
+	copies.expected = opts.expected
+	acks := newAcks(fifo)
+	received := s.receiveStage(q, copies, opts.filter, acks, opts.concurrency)
+	// FIFO queues are received one batch at a time, in order already
+	if opts.order == orderSent && !fifo {
+		received = s.orderStage(q, opts.orderWindow, received)
+	}
+	if opts.sort != sortNone {
+		opts.sorter = newSorter(opts.sort, opts.sortDir)
+	}
+	count := 0 // Read once written is closed
+	written := writeStage(qURL, opts, received, &count)
+
+	var processed int
+	var errs []error
+	var held []string
+	if readOnly {
+		held = s.holdStage(qURL, written)
+		processed = len(held)
+	} else {
+		pOpts := pipelineOptions{spool: sp, acks: acks, copies: copies}
+		processed, errs = s.resendStage(q, q, pOpts, written)
+	}
+	// Interrupted sorted exports still write what they received
+	if opts.sorter != nil {
+		opts.sorter.flush(func(batch []*sqs.Message) { writeRecords(qURL, opts, batch) })
+	}
+	// Read-only exports re-add nothing, the messages held are made visible again
+	s.changeVisibilityBatch(qURL, held, 0)
+	s.exitIfInterrupted(qURL, processed)
 	if len(errs) > 0 {
+		failReport()
+		finishReport()
 		log.Fatal("There were errors re-adding the messages", errs)
 	}
+	return count
 }
 
-// - - - - - - - - - - - - - - - -
-//   COMMANDS HELPERS
-// - - - - - - - - - - - - - - - -
+// writeStage writes the received messages to the output, one batch after the other
+// so records never interleave whatever the number of receivers
+// with a sorter, batches go to its journal and are written once the queue is done
+// batches are passed on once written, count is final when the returned channel is closed
+func writeStage(qURL string, opts csvOptions, in <-chan []*sqs.Message, count *int) <-chan []*sqs.Message {
+	written := make(chan []*sqs.Message, pipelineBuffer)
+	go func() {
+		for batch := range in {
+			if opts.sorter != nil {
+				opts.sorter.add(batch)
+			} else {
+				writeRecords(qURL, opts, batch)
+			}
+			atomic.AddInt64(&tally.written, int64(len(batch)))
+			*count += len(batch)
+			written <- batch
+		}
+		close(written)
+	}()
+	return written
+}
 
-// insertCSVHead adds row header to the CSV output
-func insertCSVHead(fifo bool) {
-	if fifo {
-		fmt.Println("Body,Message Group ID,Message Deduplication ID,Sequence Number,Sent")
-	} else {
-		fmt.Println("Body,Sent")
+// writeRecords writes a batch of messages in the export format
+// the output is synced so the messages can be deleted
+func writeRecords(qURL string, opts csvOptions, batch []*sqs.Message) {
+	// Sinks store the messages themselves, a failure stops the export before they are deleted
+	if opts.sink != nil {
+		if _, err := writeToSink(opts.sink, batch); err != nil {
+			log.Fatal("Error writing to the sink ", err)
+		}
+		return
+	}
+	for _, m := range batch {
+		if opts.s3 != nil {
+			opts.s3.written()
+		}
+		if opts.split != nil {
+			if opts.split.full() {
+				rotateExport(opts.split, qURL, opts)
+			}
+			opts.split.written()
+		}
+		switch opts.format {
+		case exportCloudEventsFormat:
+			formatCloudEvent(m, qURL, opts)
+		case exportXMLFormat:
+			formatXMLMessage(m, opts)
+		case exportYAMLFormat:
+			formatYAMLMessage(m, opts)
+		case exportAvroFormat:
+			if err := opts.avro.append(m, opts.redact.apply(messageBody(m))); err != nil {
+				log.Fatal(err)
+			}
+		default:
+			formatCSV(m, opts)
+		}
 	}
+	// One container block per batch
+	if opts.avro != nil {
+		if err := opts.avro.flush(); err != nil {
+			log.Fatal("Error writing Avro block ", err)
+		}
+	}
+	// Rows must be on disk before the messages are deleted
+	syncOutput()
 }
 
-// formatCSV outputs a CSV formatted row
-func formatCSV(m *sqs.Message, fifo bool) {
-	var row []string
+// isComplete is true if written is short of expected by at most tolerance percent
+// producers adding messages during the export only make written bigger
+func isComplete(written, expected int, tolerance float64) bool {
+	return float64(written) >= float64(expected)*(1-tolerance/100)
+}
 
-	// Remove spaces
-	mess := strings.Join(strings.Fields(*m.Body), " ")
+// insertCSVHead adds row header to the CSV output
+func insertCSVHead(opts csvOptions) {
+	var head []string
+	for _, c := range exportColumns(opts) {
+		head = append(head, c.title)
+	}
+	fmt.Fprintln(output, strings.Join(head, ","))
+}
 
-	if fifo {
-		row = []string{
-			mess,
+// exportRow returns the values of the exported columns of a message
+func exportRow(m *sqs.Message, opts csvOptions) []string {
+	row := []string{opts.redact.apply(messageBody(m))}
+	if opts.fifo {
+		row = append(row,
 			*m.Attributes["MessageGroupId"],
 			*m.Attributes["MessageDeduplicationId"],
 			*m.Attributes["SequenceNumber"],
-			*m.Attributes["SentTimestamp"],
-		}
-	} else {
-		row = []string{
-			mess,
-			*m.Attributes["SentTimestamp"],
-		}
+		)
+	}
+	sent := *m.Attributes["SentTimestamp"]
+	if t, ok := sentAt(m); ok {
+		sent = formatTime(t, timeEpoch)
+	}
+	row = append(row, sent)
+	if opts.checksums {
+		row = append(row, aws.StringValue(m.MD5OfBody), aws.StringValue(m.MD5OfMessageAttributes))
 	}
+	if opts.traceColumn {
+		row = append(row, traceHeader(m))
+	}
+	row = append(row, opts.attributes.values(m)...)
+	if opts.annotate {
+		row = append(row, opts.source.queue, opts.source.url, opts.source.region, opts.source.account, opts.source.exportedAt)
+	}
+	return row
+}
+
+// formatCSV outputs a CSV formatted row
+func formatCSV(m *sqs.Message, opts csvOptions) {
+	row := exportRow(m, opts)
 
-	w := csv.NewWriter(os.Stdout)
+	// Remove spaces
+	row[0] = strings.Join(strings.Fields(row[0]), " ")
+
+	w := csv.NewWriter(output)
 	if err := w.Write(row); err != nil {
 		log.Fatalln("Error writing row to csv:", err)
 	}
@@ -216,34 +1046,126 @@ func formatCSV(m *sqs.Message, fifo bool) {
 //   MANIPULATING QUEUES
 // - - - - - - - - - - - - - - - -
 
-// newService returns a SQS connection
+// newService returns a SQS connection to the -region queues
 func newService() *service {
+	return newRegionService(awsRegion)
+}
+
+// newRegionService returns a SQS connection to the queues of a region
+// sessions and clients are cached, connecting again to a region reuses them
+func newRegionService(region string) *service {
+	sess := regionSession(region)
+	endpoint := ""
+	// The emulator and replays are their own endpoint
+	if !localMode && len(replayDir) == 0 {
+		endpoint = sqsEndpoint(region)
+	}
+	if opener == nil {
+		opener = newEnvelopeOpener(sess)
+	}
+	return &service{SQS: sqsClient(sess, region, endpoint), sess: sess}
+}
+
+// newAWSSession returns a session using the credentials of the environment
+func newAWSSession(region string) *session.Session {
 	// Get environment variables
 	keyID := os.Getenv("AWS_ACCESS_KEY_ID")
 	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
 	if keyID == "" || secretKey == "" {
 		log.Fatal("Missing connection credentials")
 	}
-	// Connect
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String("us-west-2"),
-		Credentials: credentials.NewStaticCredentials(keyID, secretKey, ""),
+	// Connect, to the endpoints of the partition of the region
+	config, err := partitionConfig(region)
+	if err != nil {
+		log.Fatal("Invalid region ", err)
+	}
+	config.Credentials = credentials.NewStaticCredentials(keyID, secretKey, "")
+	if config.HTTPClient, err = newHTTPClient(); err != nil {
+		log.Fatal("Error configuring HTTP client ", err)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		log.Fatal("Error connecting to AWS ", err)
+	}
+	return sess
+}
+
+// newAccountService returns a SQS connection to the queues of a region with the credentials
+// of a shared config profile or of an env file, see accountSession
+// its clients are not cached, the cache is keyed by region and holds those of the environment credentials
+func newAccountService(region, profile, envFile string) *service {
+	if (len(profile) == 0 && len(envFile) == 0) || localMode || len(replayDir) > 0 {
+		return newRegionService(region)
+	}
+	sess := accountSession(region, profile, envFile)
+	if endpoint := sqsEndpoint(region); len(endpoint) > 0 {
+		return &service{SQS: sqs.New(sess, aws.NewConfig().WithEndpoint(endpoint)), sess: sess}
+	}
+	return &service{SQS: sqs.New(sess), sess: sess}
+}
+
+// newProfileSession returns a session using the credentials of a shared config profile,
+// assumed roles included, or the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN of an env file
+func newProfileSession(region, profile, envFile string) *session.Session {
+	config, err := partitionConfig(region)
+	if err != nil {
+		log.Fatal("Invalid region ", err)
+	}
+	if len(envFile) > 0 {
+		vars, err := loadEnvFile(envFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if vars["AWS_ACCESS_KEY_ID"] == "" || vars["AWS_SECRET_ACCESS_KEY"] == "" {
+			log.Fatalf("Missing connection credentials in %s\n", envFile)
+		}
+		config.Credentials = credentials.NewStaticCredentials(vars["AWS_ACCESS_KEY_ID"], vars["AWS_SECRET_ACCESS_KEY"], vars["AWS_SESSION_TOKEN"])
+	}
+	if config.HTTPClient, err = newHTTPClient(); err != nil {
+		log.Fatal("Error configuring HTTP client ", err)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
 	})
 	if err != nil {
 		log.Fatal("Error connecting to AWS ", err)
 	}
-	svc := sqs.New(sess)
-	return &service{svc}
+	return sess
 }
 
 // getQueueURL returns the FQDN for a queue name
+// a queue ARN resolves the queue of its account, it must be in the region of the service
 func (s *service) getQueueURL(name string) string {
-	queueInfo, err := s.GetQueueUrl(&sqs.GetQueueUrlInput{
-		QueueName: aws.String(name),
-	})
+	name = expandBookmark(name)
+	if qURL, ok := s.cachedQueueURL(name); ok {
+		s.rememberQueue(queueNameFromURL(qURL))
+		return qURL
+	}
+	input := &sqs.GetQueueUrlInput{QueueName: aws.String(name)}
+	if arn.IsARN(name) {
+		queueARN, err := parseQueueARN(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if queueARN.Region != aws.StringValue(s.sess.Config.Region) || queueARN.Partition != s.partition() {
+			log.Fatalf("Queue %s is not in %s (%s), set -region\n", name, aws.StringValue(s.sess.Config.Region), s.partition())
+		}
+		input.QueueName = aws.String(queueARN.Resource)
+		input.QueueOwnerAWSAccountId = aws.String(queueARN.AccountID)
+	}
+	queueInfo, err := s.GetQueueUrl(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == sqs.ErrCodeQueueDoesNotExist && input.QueueOwnerAWSAccountId == nil && !exactNames {
+		qURL := s.pickQueue(name, err)
+		s.rememberQueue(queueNameFromURL(qURL))
+		return qURL
+	}
 	if err != nil {
 		log.Fatalf("Error finding queue %s: %s\n", name, err)
 	}
+	s.cacheQueueURL(name, *queueInfo.QueueUrl)
+	s.rememberQueue(queueNameFromURL(*queueInfo.QueueUrl))
 	return *queueInfo.QueueUrl
 }
 
@@ -263,38 +1185,45 @@ func (s *service) getQueueAttributes(queue string) *sqs.GetQueueAttributesOutput
 
 // receiveMessages fetches SQS messages in batches
 func (s *service) receiveMessages(queue string, num int, fifo bool) *sqs.ReceiveMessageOutput {
-	// @TODO - use worker pools to fetch faster
+	return s.receiveMessagesFor(queue, num, fifo, 10) // 10 seconds
+}
+
+// receiveMessagesFor fetches SQS messages hiding them for visibility seconds
+func (s *service) receiveMessagesFor(queue string, num int, fifo bool, visibility int64) *sqs.ReceiveMessageOutput {
 	messageInput := &sqs.ReceiveMessageInput{
 		QueueUrl: &queue,
+		// Every system attribute, filters may look at any of them
 		AttributeNames: []*string{
-			aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
+			aws.String(sqs.QueueAttributeNameAll),
 		},
 		MessageAttributeNames: []*string{
 			aws.String(sqs.QueueAttributeNameAll),
 		},
 		MaxNumberOfMessages: aws.Int64(int64(num)),
-		VisibilityTimeout:   aws.Int64(10), // 10 seconds
+		VisibilityTimeout:   aws.Int64(visibility),
 		WaitTimeSeconds:     aws.Int64(0),
 	}
 
-	if fifo {
-		messageInput.AttributeNames = []*string{aws.String(sqs.QueueAttributeNameAll)}
-	}
-
+	sent := time.Now() // Visibility starts on the SQS side, after this
 	result, err := s.ReceiveMessage(messageInput)
 
 	if err != nil {
 		log.Fatal("Error fetching message ", err)
 	}
+	for _, m := range result.Messages {
+		if err := verifyReceived(m); err != nil {
+			log.Fatal(err)
+		}
+		trackReceipt(aws.StringValue(m.ReceiptHandle), sent, visibility)
+	}
 
 	return result
 }
 
 // sendMessageBatch pushes SQS messages in a queue
 // for performance reasons we have a FIFO argument
-func (s *service) sendMessageBatch(queue string, messages []*sqs.Message, batch int, fifo bool) []error {
-
-	var entries []*sqs.SendMessageBatchRequestEntry
+// extra attributes are added to every message
+func (s *service) sendMessageBatch(queue string, messages []*sqs.Message, batch int, fifo bool, extra map[string]*sqs.MessageAttributeValue) []error {
 	var errors []error
 
 	// For each Batches
@@ -303,38 +1232,119 @@ func (s *service) sendMessageBatch(queue string, messages []*sqs.Message, batch
 		if j > len(messages) {
 			j = len(messages)
 		}
-		// Prepare payload
-		entries = nil
-		for _, m := range messages[i:j] {
-			//uuid, _ := newUUID()
-			d := sqs.SendMessageBatchRequestEntry{
-				MessageAttributes: map[string]*sqs.MessageAttributeValue{
-					"SentTimestamp": &sqs.MessageAttributeValue{
-						DataType:    aws.String("String"),
-						StringValue: aws.String(*m.Attributes["SentTimestamp"]),
-					},
-				},
-				Id:          aws.String(*m.MessageId),
-				MessageBody: aws.String(*m.Body),
+		if sent, errs := s.resendBatch(queue, messages[i:j], fifo, 0, extra, nil); len(errs) > 0 {
+			// We couldn't readd the messages, they are kept in the recovery file
+			// still we need to continue in order not to lose more messages
+			errors = append(errors, errs...)
+			if err := saveForRecovery(queue, unsentMessages(messages[i:j], sent), errs[0]); err != nil {
+				log.Println("Error saving messages for recovery", err)
 			}
-			getBatchRequestEntryAttributes(&d, m, fifo)
-			entries = append(entries, &d)
 		}
+	}
+	return errors
+}
 
-		messageInput := &sqs.SendMessageBatchInput{
-			Entries:  entries,
-			QueueUrl: aws.String(queue),
+// resendBatch pushes at most 10 received messages in a queue, in as many batches as their size needs
+// rewrite, when set, adjusts their attributes and bodies
+// delay postpones their delivery on standard queues, FIFO queues only have a queue-wide delay
+// returns the messages that were sent and one error per failure
+func (s *service) resendBatch(queue string, messages []*sqs.Message, fifo bool, delay int64, extra map[string]*sqs.MessageAttributeValue, rewrite *messageRewrite) ([]*sqs.Message, []error) {
+	sent, _, errors := s.resendBatchCopies(queue, messages, fifo, delay, extra, rewrite)
+	return sent, errors
+}
+
+// resendBatchCopies is resendBatch also returning the message IDs of the copies sent
+func (s *service) resendBatchCopies(queue string, messages []*sqs.Message, fifo bool, delay int64, extra map[string]*sqs.MessageAttributeValue, rewrite *messageRewrite) ([]*sqs.Message, []string, []error) {
+	// Prepare payload
+	var entries []*sqs.SendMessageBatchRequestEntry
+	var errors []error
+	byID := make(map[string]*sqs.Message, len(messages))
+	for _, m := range messages {
+		// Left in the queue from, like the messages failing to send
+		body, err := rewrite.body(m)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("message %s was not sent: %s", *m.MessageId, err))
+			if fifo {
+				break
+			}
+			continue
+		}
+		d := sqs.SendMessageBatchRequestEntry{
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"SentTimestamp": &sqs.MessageAttributeValue{
+					DataType:    aws.String("String"),
+					StringValue: aws.String(*m.Attributes["SentTimestamp"]),
+				},
+			},
+			Id:          nextEntryID(),
+			MessageBody: aws.String(body),
+		}
+		rewrite.carry(m, d.MessageAttributes)
+		getBatchRequestEntryAttributes(&d, m, fifo)
+		if delay > 0 && !fifo {
+			d.DelaySeconds = aws.Int64(delay)
+		}
+		d.MessageAttributes[originalSentAtAttribute] = originalSentAt(m)
+		// Encrypted bodies are useless without their data key
+		for name, value := range envelopeAttributes(m) {
+			d.MessageAttributes[name] = value
+		}
+		// Redrives of the message keep counting on the same ID
+		if v, ok := m.MessageAttributes[redriveIDAttribute]; ok {
+			d.MessageAttributes[redriveIDAttribute] = v
+		}
+		for name, value := range extra {
+			d.MessageAttributes[name] = value
 		}
+		rewrite.stamp(&d)
+		// Left in the queue from, like the messages failing to send
+		rewrite.apply(d.MessageAttributes)
+		if err := fitAttributes(d.MessageAttributes); err != nil {
+			errors = append(errors, fmt.Errorf("message %s was not sent: %s", *m.MessageId, err))
+			if fifo {
+				break
+			}
+			continue
+		}
+		entries = append(entries, &d)
+		byID[*d.Id] = m
+	}
 
-		_, err := s.SendMessageBatch(messageInput)
+	// Big messages may not fit 10 to a batch
+	// on FIFO queues a failure leaves the next batches unsent, to keep groups in sequence
+	var sent []*sqs.Message
+	var copyIDs []string
+	batches := packEntries(entries, maxBatchEntries)
+	for i, batch := range batches {
+		if fifo && len(errors) > 0 {
+			errors = append(errors, fmt.Errorf("%d batches not sent after a failure, to keep FIFO order", len(batches)-i))
+			break
+		}
+		result, err := s.SendMessageBatch(&sqs.SendMessageBatchInput{
+			Entries:  batch,
+			QueueUrl: aws.String(queue),
+		})
 		if err != nil {
-			// We couldn't readd the messages
-			// this is bad because it means we will lose the message(s)
-			// still we need to continue in order not to lose more messages
+			for _, e := range batch {
+				errors = append(errors, err)
+				recordFailedEntry("send", queue, *e.Id, byID[*e.Id], "", err.Error())
+			}
+			continue
+		}
+		for _, f := range result.Failed {
+			m := byID[*f.Id]
+			errors = append(errors, fmt.Errorf("message %s (entry %s) was not sent: %s", aws.StringValue(m.MessageId), *f.Id, aws.StringValue(f.Message)))
+			recordFailedEntry("send", queue, *f.Id, m, aws.StringValue(f.Code), aws.StringValue(f.Message))
+		}
+		if err := verifySent(batch, result.Successful); err != nil {
 			errors = append(errors, err)
 		}
+		for _, r := range result.Successful {
+			sent = append(sent, byID[*r.Id])
+			copyIDs = append(copyIDs, aws.StringValue(r.MessageId))
+		}
 	}
-	return errors
+	return sent, copyIDs, errors
 }
 
 // sendMessage pushes a SQS message in a queue
@@ -346,6 +1356,7 @@ func (s *service) sendMessage(queue string, message *sqs.Message, fifo bool) {
 				DataType:    aws.String("String"),
 				StringValue: aws.String(*message.Attributes["SentTimestamp"]),
 			},
+			originalSentAtAttribute: originalSentAt(message),
 		},
 		MessageBody: aws.String(*message.Body),
 		QueueUrl:    &queue,
@@ -377,8 +1388,6 @@ func (s *service) sendMessage(queue string, message *sqs.Message, fifo bool) {
 			DataType:    aws.String("String"),
 			StringValue: aws.String(*message.Attributes["ApproximateReceiveCount"]),
 		}
-	} else {
-		messageInput.DelaySeconds = aws.Int64(1)
 	}
 
 	_, err := s.SendMessage(messageInput)
@@ -389,27 +1398,23 @@ func (s *service) sendMessage(queue string, message *sqs.Message, fifo bool) {
 }
 
 // deleteMessageBatch deletes a batch of messages from a queue
-func (s *service) deleteMessageBatch(queue string, messages []*sqs.Message) {
-	// Prepare payload
-	var entries []*sqs.DeleteMessageBatchRequestEntry
+// returns the number of messages deleted
+func (s *service) deleteMessageBatch(queue string, messages []*sqs.Message) int {
+	// Expired receipt handles "delete" successfully without deleting anything
+	var live, expired []*sqs.Message
 	for _, m := range messages {
-		entry := &sqs.DeleteMessageBatchRequestEntry{Id: m.MessageId, ReceiptHandle: m.ReceiptHandle}
-		entries = append(entries, entry)
+		if isExpired(m) {
+			expired = append(expired, m)
+		} else {
+			live = append(live, m)
+		}
 	}
-	// Batch ready
-	batchInput := sqs.DeleteMessageBatchInput{
-		Entries:  entries,
-		QueueUrl: aws.String(queue),
-	}
-
-	_, err := s.DeleteMessageBatch(&batchInput)
-	// @TODO - re-run errors - or not
-	// an error just means the message was not deleted and will be fetched on the next iteration (FIFO)
-	// for non-FIFO queues messages are processed one by one anyway
-	if err != nil {
-		fmt.Println("Delete Error", err)
-		// os.Exit(1)
+	deleted, failed := s.deleteBatch(queue, live)
+	expired = append(expired, failed...)
+	if len(expired) > 0 {
+		deleted += s.deleteExpired(queue, expired)
 	}
+	return deleted
 }
 
 // deleteMessage deletes a message from a queue
@@ -427,9 +1432,20 @@ func (s *service) deleteMessage(queue string, message *sqs.Message) {
 // isFIFO is true if the queue is a FIFO, else otherwise
 // this is an expensive operation, store the returned boolean in a variable
 func (s *service) isFIFO(queue string) bool {
+	name := queueNameFromURL(queue)
+	if fifo, ok := fifoFromName(name); ok {
+		logVerbose("Queue %s is %s, from its name\n", name, queueType(fifo))
+		return fifo
+	}
+	if fifo, ok := cachedFIFO(queue); ok {
+		logVerbose("Queue %s is %s, from the cache\n", name, queueType(fifo))
+		return fifo
+	}
 	attr := s.getQueueAttributes(queue)
 
 	if attr.Attributes["FifoQueue"] == nil {
+		logVerbose("Queue %s is standard, from its attributes\n", name)
+		cacheFIFO(queue, false)
 		return false
 	}
 
@@ -437,9 +1453,42 @@ func (s *service) isFIFO(queue string) bool {
 	if err != nil {
 		log.Fatal("Error determining queue type", err)
 	}
+	logVerbose("Queue %s is %s, from its attributes\n", name, queueType(b))
+	cacheFIFO(queue, b)
 	return b
 }
 
+// fifoFromName tells the type of a queue from its name: only FIFO queues end with .fifo,
+// and the names of standard queues can't hold a dot
+// ok is false for names SQS doesn't give queues, like the last part of an unusual URL
+func fifoFromName(name string) (fifo bool, ok bool) {
+	base := strings.TrimSuffix(name, ".fifo")
+	if len(base) == 0 || len(name) > 80 {
+		return false, false
+	}
+	for _, r := range base {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false, false
+		}
+	}
+	return base != name, true
+}
+
+// queueType names the type of a queue in messages
+func queueType(fifo bool) string {
+	if fifo {
+		return "FIFO"
+	}
+	return "standard"
+}
+
+// logVerbose logs with -verbose only
+func logVerbose(format string, v ...interface{}) {
+	if verbose {
+		log.Printf(format, v...)
+	}
+}
+
 // getBatchRequestEntryAttributes is a helper function for sendMessageBatch
 func getBatchRequestEntryAttributes(req *sqs.SendMessageBatchRequestEntry, m *sqs.Message, fifo bool) {
 	// FIFO ?
@@ -468,8 +1517,6 @@ func getBatchRequestEntryAttributes(req *sqs.SendMessageBatchRequestEntry, m *sq
 			DataType:    aws.String("String"),
 			StringValue: aws.String(*m.Attributes["ApproximateReceiveCount"]),
 		}
-	} else {
-		req.DelaySeconds = aws.Int64(1)
 	}
 }
 
@@ -480,6 +1527,9 @@ func getBatchRequestEntryAttributes(req *sqs.SendMessageBatchRequestEntry, m *sq
 // newUUID generates a pseudo-random UUID
 // used for Deduplication ID in FIFO queues
 func newUUID() (string, error) {
+	if id, ok := replayedUUID(); ok {
+		return id, nil
+	}
 	uuid := make([]byte, 16)
 	n, err := io.ReadFull(rand.Reader, uuid)
 	if n != len(uuid) || err != nil {
@@ -489,7 +1539,9 @@ func newUUID() (string, error) {
 	uuid[8] = uuid[8]&^0xc0 | 0x80
 	// version 4 (pseudo-random)
 	uuid[6] = uuid[6]&^0xf0 | 0x40
-	return fmt.Sprintf("%x%x%x%x%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+	id := fmt.Sprintf("%x%x%x%x%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+	recordUUID(id)
+	return id, nil
 }
 
 // - - - - - - - - - - - - - - - -
@@ -497,17 +1549,105 @@ func newUUID() (string, error) {
 // - - - - - - - - - - - - - - - -
 
 func usage() {
-	fmt.Println("usage: sqscli <command> [<args>]")
+	fmt.Println("usage: sqscli [-env name] [-profile name] [-region name] [-partition id] [-endpoint-url url] [-endpoint-fallback]")
+	fmt.Println("              [-proxy url] [-ca-bundle file] [-health addr] [-otlp url] [-audit-log file|s3://bucket/prefix|off]")
+	fmt.Println("              [-checksum warn|fail|off] [-read-only] [-yes] [-ticket id] [-exact]")
+	fmt.Println("              [-no-cache] [-cache-ttl duration] [-recovery-file file] [-verbose]")
+	fmt.Println("              [-local] [-local-state file] [-record dir | -replay dir] [-o table|wide|json|yaml] [-no-color]")
+	fmt.Println("              [-time-format rfc3339|epoch|relative] [-timezone zone] <command> [<args>]")
 	fmt.Println("The most commonly used sqscli commands are: ")
-	fmt.Println(" qtocsv   Output a queue in a csv format")
-	fmt.Println(" qtoq     Redrive queue in another queue")
+	fmt.Println(" qtocsv             Output a queue in a csv format")
+	fmt.Println(" qtoq               Redrive queue in another queue")
+	fmt.Println(" send               Send messages read from stdin to a queue")
+	fmt.Println(" generate           Send generated test messages to a queue")
+	fmt.Println(" change-visibility  Change the visibility timeout of in-flight messages")
+	fmt.Println(" peek               Print messages without deleting them")
+	fmt.Println(" head               Pretty-print the first available messages")
+	fmt.Println(" delete             Delete the messages of a peek session")
+	fmt.Println(" release            Make the messages of a peek session visible again")
+	fmt.Println(" extend             Extend the visibility timeout of a peek session")
+	fmt.Println(" stats              Print queue metadata")
+	fmt.Println(" count              Print the number of available messages")
+	fmt.Println(" list               List queues")
+	fmt.Println(" watch              Print queue depth at a regular interval")
+	fmt.Println(" purge              Delete all messages of queues")
+	fmt.Println(" expire             Delete or park the messages older than an age")
+	fmt.Println(" diff               Report messages present in one queue but not the other")
+	fmt.Println(" lag                Estimate the time to drain queues at their consumption rate")
+	fmt.Println(" poison-report      List messages received too many times, grouped by body")
+	fmt.Println(" fifo-verify        Check the ordering of the message groups of a FIFO queue")
+	fmt.Println(" split              Route the messages of a queue to several queues by rules")
+	fmt.Println(" merge              Drain several queues into one")
+	fmt.Println(" mirror             Copy the new messages of a queue to another queue, continuously")
+	fmt.Println(" park               Move messages to the parking-lot queue of a queue")
+	fmt.Println(" unpark             Move messages back from the parking-lot queue")
+	fmt.Println(" audit              Report queue misconfigurations")
+	fmt.Println(" config             Export or apply queue configurations")
+	fmt.Println(" create             Create a queue")
+	fmt.Println(" set-attrs          Update queue attributes and encryption")
+	fmt.Println(" decrypt-export     Decrypt a KMS encrypted export")
+	fmt.Println(" whoami             Print the caller identity and probe permissions")
+	fmt.Println(" ping               Measure the latency of the SQS endpoint")
+	fmt.Println(" canary             Time a probe message sent to a queue and received back")
+	fmt.Println(" soak               Send a steady stream of messages and check the consumers keep up")
+	fmt.Println(" fill               Push synthetic messages of a given size as fast as possible")
+	fmt.Println(" drain              Delete the messages of a queue, or only the synthetic ones of fill")
+	fmt.Println(" daemon             Run sqscli jobs on schedules with health endpoints")
+	fmt.Println(" iam-policy         Print the IAM policy a command needs")
+	fmt.Println(" grant              Mint short-lived credentials limited to what a command needs")
+	fmt.Println(" ops                List, resume and report bulk operations")
+	fmt.Println(" drain-all          Export or move many queues in parallel")
+	fmt.Println(" migrate            Recreate queues in another account or region and move their messages")
+	fmt.Println(" use-env            Set the environment of the next runs, or list the environments")
+	fmt.Println(" recover            Send again the messages saved to a recovery file")
+	fmt.Println(" import             Send the messages of a file, S3 object or Kafka topic")
+	fmt.Println(" plugins            List the sqscli-* plugins found on PATH")
+	fmt.Println(" run                Run a YAML runbook of export, move, verify and command steps")
+	fmt.Println(" shell              Run commands at a prompt, with a current queue and history")
+	fmt.Println(" bookmark           Save queues as @name, list the queues used lately")
 	os.Exit(0)
 }
 
 func toCSVUsage() {
 	fmt.Println("usage: sqscli qtocsv [options]")
 	fmt.Println("options:")
-	fmt.Println("  -queue required   Queue name")
+	fmt.Println("  -queue required   Queue name, wildcards export every matching queue")
+	fmt.Println("  -format           Output format, csv, cloudevents (JSON lines), avro, xml or yaml (default csv)")
+	fmt.Println("  -avro-schema      Avro schema file the JSON bodies are encoded with")
+	fmt.Println("  -schema-registry  Schema registry URL serving the Avro schema instead of a file")
+	fmt.Println("  -schema-subject   Schema registry subject (default <queue>-value)")
+	fmt.Println("  -md5              Add MD5 checksum columns")
+	fmt.Println("  -trace-column     Add the trace header column, X-Ray or W3C")
+	fmt.Println("  -system-attributes  System attributes added as columns, like ApproximateReceiveCount,SenderId or All")
+	fmt.Println("  -message-attributes  Message attributes added as columns, comma separated, or All in one JSON column")
+	fmt.Println("  -annotate         Add the queue, its URL, region and account, and the export time to each record")
+	fmt.Println("  -split-size       Write numbered part files of about this size, like 100MB")
+	fmt.Println("  -split-count      Write numbered part files of this many messages")
+	fmt.Println("  -split-prefix     Part file names prefix, parts are <prefix>-00001.<format> (default export)")
+	fmt.Println("  -gzip             Gzip the part files")
+	fmt.Println("  -sink             Sink receiving the messages as JSON instead of the output: -, file:PATH,")
+	fmt.Println("                    s3://BUCKET/PREFIX, sqlite:PATH, dynamodb:TABLE, kafka:URL, webhook:URL or plugin:NAME")
+	fmt.Println("  -transform        Exported bodies go through expr:EXPRESSION or the sqscli-transform-NAME plugin")
+	fmt.Println("  -s3               S3 object receiving the export through a multipart upload, s3://bucket/key")
+	fmt.Println("  -manifest         Manifest file of the S3 export, resumed when present (default <key>.manifest.json)")
+	fmt.Println("  -part-size        Size of the S3 upload parts, at least 5MB (default 8MB)")
+	fmt.Println("  -spool            Spool file persisting in-flight batches, replayed on restart")
+	fmt.Println("  -kms-encrypt-export  KMS key ID, encrypts the output with a data key of this key")
+	fmt.Println("  -redact           Redaction rule, repeatable: email, card, regex:PATTERN,")
+	fmt.Println("                    field:FIELD.PATH (e.g. items[*].card) or @rules-file")
+	fmt.Println("  -report           File receiving the JSON summary of the run")
+	fmt.Println("  -on-complete      exec:COMMAND or webhook:URL run once the export is done, repeatable")
+	fmt.Println("  -tolerance        Percentage of missing messages accepted by the completeness check (default 0)")
+	fmt.Println("  -concurrency      Concurrent receivers, 1 to 32, or auto to scale them (default 1)")
+	fmt.Println("  -order            Order of the records, arrival or sent (default arrival)")
+	fmt.Println("  -order-window     Messages held to order the records by sent time (default 100)")
+	fmt.Println("  -sort             Sort the records of each queue: sent, sequence or none (default none)")
+	fmt.Println("  -sort-dir         Directory of the sort files, the temporary directory by default")
+	fmt.Println("  -since            Only messages sent after, RFC3339 or relative like 2h")
+	fmt.Println("  -until            Only messages sent before, RFC3339 or relative like 30m")
+	fmt.Println("  -filter-attr      Attribute predicate like RetryCount>3 or Source=billing, repeatable")
+	fmt.Println("  -filter           Expression the messages must match, like body.status == \"failed\"")
+	fmt.Println("  -sample           A share of the messages like 1%, or the first N")
 	os.Exit(0)
 }
 
@@ -515,6 +1655,36 @@ func toQUsage() {
 	fmt.Println("usage: sqscli qtoq [options]")
 	fmt.Println("options:")
 	fmt.Println("  -queue1 required   Queue from")
-	fmt.Println("  -queue2 required   Queue to")
+	fmt.Println("  -queue2 required   Queue to, unless -sink")
+	fmt.Println("  -sink              Sink the messages are moved to instead of a queue: -, file:PATH,")
+	fmt.Println("                     s3://BUCKET/PREFIX, sqlite:PATH, dynamodb:TABLE, kafka:URL, webhook:URL or plugin:NAME")
+	fmt.Println("  -region1           Region of the queue from (default -region)")
+	fmt.Println("  -region2           Region of the queue to (default -region)")
+	fmt.Println("  -spool             Spool file persisting in-flight batches, replayed on restart")
+	fmt.Println("  -staged            Copy to a temporary staging queue and verify before deleting")
+	fmt.Println("  -report            File receiving the JSON summary of the run")
+	fmt.Println("  -on-complete       exec:COMMAND or webhook:URL run once the move is done, repeatable")
+	fmt.Println("  -dedupe-by         Skip messages already sent, keyed by body-hash, message-id,")
+	fmt.Println("                     jmespath:QUERY (e.g. jmespath:order.id) or expr:EXPRESSION")
+	fmt.Println("  -dedupe-state      File persisting the keys already sent, for re-runs")
+	fmt.Println("  -max-receive-count-filter  Divert messages received more times than this")
+	fmt.Println("  -on-exceed         Where diverted messages go: drop, park:QUEUE or export:FILE")
+	fmt.Println("  -max-bounces       Divert messages already redriven this many times within -bounce-window")
+	fmt.Println("  -bounce-state      File recording the messages redriven, shared by the runs")
+	fmt.Println("  -bounce-window     How long redrives are remembered (default 24h)")
+	fmt.Println("  -on-bounce         Where bounced messages go: drop, park:QUEUE or export:FILE")
+	fmt.Println("  -concurrency       Concurrent receivers, 1 to 32, or auto to scale them (default 1)")
+	fmt.Println("  -delay-seconds     Delay before moved messages become visible, 0 to 900 (standard queues)")
+	fmt.Println("  -since             Only messages sent after, RFC3339 or relative like 2h")
+	fmt.Println("  -until             Only messages sent before, RFC3339 or relative like 30m")
+	fmt.Println("  -filter-attr       Attribute predicate like RetryCount>3 or Source=billing, repeatable")
+	fmt.Println("  -filter            Expression the messages must match, like body.status == \"failed\"")
+	fmt.Println("  -sample            A share of the messages like 1%, or the first N")
+	fmt.Println("  -provenance        Stamp moved messages with sqscli.sourceQueue, sqscli.movedAt and sqscli.operationId")
+	fmt.Println("  -set-attr          Attribute Name=Type:value set on moved messages, repeatable")
+	fmt.Println("  -drop-attr         Attribute removed from moved messages, repeatable")
+	fmt.Println("  -replace           s/REGEX/REPLACEMENT/[g] applied to moved bodies, repeatable")
+	fmt.Println("  -transform         Moved bodies go through expr:EXPRESSION or the sqscli-transform-NAME plugin")
+	fmt.Println("  -trace             Trace header injected in moved messages: xray or w3c")
 	os.Exit(0)
 }
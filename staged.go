@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// stagingVisibility hides source messages while they are copied to staging
+	stagingVisibility = 1800
+	// stagingChecks is how many times the staging queue count is checked
+	// before giving up, counts are eventually consistent
+	stagingChecks = 10
+	// stagingChunk bounds the source messages held at once, each chunk is verified
+	// in staging and deleted from the source before the next one
+	stagingChunk = 10000
+	// stagingChunkAge closes a chunk well before its messages come back in the source
+	stagingChunkAge = stagingVisibility * time.Second / 3
+)
+
+// - - - - - - - - - - - - - - - -
+//   STAGED MOVE
+// - - - - - - - - - - - - - - - -
+
+// stagedMove moves a queue in another one through a temporary staging queue
+// messages are copied to staging by chunks, each counted before being deleted
+// from the source, then moved from staging to the destination
+// the staging queue is in the region of the source, the destination is reached through its own service
+// prov stamps the moved messages, nil for none
+// returns the number of messages moved
+func (s *service) stagedMove(source, to *queue, keep messageFilter, prov *provenance) (int, []error) {
+	from, fifo := source.url, source.fifo
+	// A FIFO group is not received further until its in-flight messages are deleted,
+	// so originals can't be kept hidden while the whole queue is copied
+	if fifo {
+		return 0, []error{fmt.Errorf("staged moves are not supported on FIFO queues")}
+	}
+
+	staging := s.createStagingQueue(from, fifo)
+	// Until the originals are deleted the staging copies are disposable
+	disposable := true
+	defer func() { s.deleteStagingQueue(staging, disposable) }()
+
+	// Messages the filter doesn't keep are hidden as well, and released at the end
+	held := make(map[string]string) // Receipt handles by message ID
+	seenIDs := make(map[string]bool)
+	defer func() {
+		others := make([]string, 0, len(held))
+		for _, handle := range held {
+			others = append(others, handle)
+		}
+		s.changeVisibilityBatch(from, others, 0)
+	}()
+
+	// commit verifies the chunk copied to staging and deletes its originals
+	staged := 0
+	var handles []string
+	commit := func() error {
+		if len(handles) == 0 {
+			return nil
+		}
+		// Hidden again for the check, however long the chunk took
+		s.changeVisibilityBatch(from, handles, stagingVisibility)
+		if err := s.waitForCount(staging, staged+len(handles)); err != nil {
+			s.changeVisibilityBatch(from, handles, 0)
+			return err
+		}
+		if errs := s.deleteReceiptHandles(from, handles); len(errs) > 0 {
+			// Whatever was not deleted is duplicated, not lost
+			log.Printf("%d messages could not be deleted from the source and will be duplicated\n", len(errs))
+		}
+		staged += len(handles)
+		handles = handles[:0]
+		disposable = false
+		return nil
+	}
+
+	// Copy, keeping the originals hidden
+	var errors []error
+	var chunkStart time.Time
+	copyOnly := 0
+	for !isInterrupted() {
+		result := s.receiveMessagesFor(from, 10, fifo, stagingVisibility)
+		if len(result.Messages) == 0 {
+			break // We are done
+		}
+		var batch, released []*sqs.Message
+		seen := 0
+		for _, m := range result.Messages {
+			if keep.keeps(m) {
+				batch = append(batch, m)
+				continue
+			}
+			id := aws.StringValue(m.MessageId)
+			if seenIDs[id] {
+				seen++
+			}
+			seenIDs[id] = true
+			if _, ok := held[id]; ok || len(held) < maxHeldSkipped {
+				held[id] = *m.ReceiptHandle
+			} else {
+				released = append(released, m)
+			}
+		}
+		if len(released) > 0 {
+			s.changeVisibilityBatch(from, receipts(released), 0)
+		}
+		if seen == len(result.Messages) {
+			copyOnly++
+			if copyOnly >= maxCopyOnlyReceives {
+				break // Cycled through the whole queue
+			}
+			continue
+		}
+		copyOnly = 0
+		if len(batch) == 0 {
+			continue
+		}
+		if len(handles) == 0 {
+			chunkStart = time.Now()
+		}
+		sent, errs := s.resendBatch(staging, batch, fifo, 0, nil, nil)
+		handles = append(handles, receipts(sent)...)
+		if len(errs) > 0 {
+			// What reached staging is kept, the rest stays in the source
+			s.changeVisibilityBatch(from, receipts(unsentMessages(batch, sent)), 0)
+			errors = append(errors, errs...)
+			errors = append(errors, fmt.Errorf("copy to staging failed, the messages not staged are left in the source"))
+			break
+		}
+		if len(handles) >= stagingChunk || time.Since(chunkStart) >= stagingChunkAge {
+			if err := commit(); err != nil {
+				errors = append(errors, err)
+				break
+			}
+		}
+	}
+	if isInterrupted() {
+		s.changeVisibilityBatch(from, handles, 0)
+		if staged == 0 {
+			return 0, []error{fmt.Errorf("interrupted while staging, source left untouched")}
+		}
+		return 0, []error{fmt.Errorf("interrupted while staging, %d messages are left in %s", staged, queueNameFromURL(staging))}
+	}
+
+	// Verify
+	if err := commit(); err != nil {
+		errors = append(errors, err)
+	}
+	if staged == 0 {
+		return 0, errors
+	}
+
+	// Move from staging to destination
+	// Stamped with the source, not the staging queue
+	stagingQueue := s.queueAt(staging)
+	moved, errs := s.resendStage(stagingQueue, to, pipelineOptions{provenance: prov}, s.receiveStage(stagingQueue, nil, nil, nil, 1))
+	return moved, append(errors, errs...)
+}
+
+// createStagingQueue creates a temporary queue of the same type as the source
+func (s *service) createStagingQueue(source string, fifo bool) string {
+	suffix, _ := newUUID()
+	name := stagingPrefix(queueNameFromURL(source)) + suffix[:8]
+
+	input := &sqs.CreateQueueInput{QueueName: aws.String(name)}
+	if fifo {
+		input.QueueName = aws.String(name + ".fifo")
+		input.Attributes = map[string]*string{
+			sqs.QueueAttributeNameFifoQueue: aws.String("true"),
+		}
+	}
+	result, err := s.CreateQueue(input)
+	if err != nil {
+		log.Fatal("Error creating staging queue ", err)
+	}
+	log.Println("Staging through", *result.QueueUrl)
+	return *result.QueueUrl
+}
+
+// stagingPrefix returns the start of the names of the staging queues of a queue
+// the name is cut so the staging name stays under the 80 characters SQS accepts
+func stagingPrefix(name string) string {
+	name = strings.TrimSuffix(name, ".fifo")
+	if len(name) > 50 {
+		name = name[:50]
+	}
+	return name + "-staging-"
+}
+
+// deleteStagingQueue removes the staging queue unless messages are left in it
+// disposable staging queues are removed whatever they hold
+func (s *service) deleteStagingQueue(queue string, disposable bool) {
+	attr := s.getQueueAttributes(queue)
+	for _, name := range []string{"ApproximateNumberOfMessages", "ApproximateNumberOfMessagesNotVisible"} {
+		if n, _ := strconv.Atoi(aws.StringValue(attr.Attributes[name])); n > 0 && !disposable {
+			log.Printf("Staging queue %s still holds messages, keeping it\n", queue)
+			return
+		}
+	}
+	if _, err := s.DeleteQueue(&sqs.DeleteQueueInput{QueueUrl: aws.String(queue)}); err != nil {
+		log.Println("Error deleting staging queue", err)
+	}
+}
+
+// waitForCount checks a queue reports the expected number of messages
+func (s *service) waitForCount(queue string, expected int) error {
+	count := 0
+	for i := 0; i < stagingChecks; i++ {
+		attr := s.getQueueAttributes(queue)
+		count, _ = strconv.Atoi(aws.StringValue(attr.Attributes["ApproximateNumberOfMessages"]))
+		if count == expected {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return fmt.Errorf("staging queue holds %d messages, expected %d, source left untouched", count, expected)
+}
+
+// - - - - - - - - - - - - - - - -
+//   UTILS
+// - - - - - - - - - - - - - - - -
+
+// receipts returns the receipt handles of messages
+func receipts(messages []*sqs.Message) []string {
+	handles := make([]string, 0, len(messages))
+	for _, m := range messages {
+		handles = append(handles, *m.ReceiptHandle)
+	}
+	return handles
+}
+
+// queueNameFromURL returns the queue name, the last part of its URL
+func queueNameFromURL(queue string) string {
+	return queue[strings.LastIndex(queue, "/")+1:]
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// statsAttributes are the queue attributes printed by stats, in order
+// human formats the numeric ones, like humanSeconds
+var statsAttributes = []struct {
+	name  string
+	label string
+	human func(interface{}) string
+}{
+	{"ApproximateNumberOfMessages", "Messages available", nil},
+	{"ApproximateNumberOfMessagesNotVisible", "Messages in flight", nil},
+	{"ApproximateNumberOfMessagesDelayed", "Messages delayed", nil},
+	{"FifoQueue", "FIFO", nil},
+	{"VisibilityTimeout", "Visibility timeout", humanSeconds},
+	{"MessageRetentionPeriod", "Retention period", humanSeconds},
+	{"DelaySeconds", "Delay", humanSeconds},
+	{"MaximumMessageSize", "Maximum message size", humanSize},
+	{"KmsDataKeyReusePeriodSeconds", "KMS data key reuse", humanSeconds},
+	{"RedrivePolicy", "Redrive policy", nil},
+	{"QueueArn", "ARN", nil},
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// stats prints the metadata of queues, one section per queue
+func stats(args []string) {
+	statsCommand := flag.NewFlagSet("stats", flag.ExitOnError)
+	queueName := statsCommand.String("queue", "", "queue name or pattern")
+	statsCommand.StringVar(queueName, "q", "", "queue name or pattern") // Aliasing
+	regions := statsCommand.String("regions", "", "comma separated regions to report across")
+	statsHelp := statsCommand.Bool("help", false, "help for stats command")
+	statsCommand.BoolVar(statsHelp, "h", false, "help") // Aliasing
+	parseFlags(statsCommand, args)
+
+	if *statsHelp {
+		queueCommandUsage("stats")
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		queueCommandUsage("stats")
+	}
+
+	// Connect
+	services := regionServices(*regions)
+
+	if len(outputFormat) > 0 {
+		t := regionalTable(statsTable(), services)
+		for _, svc := range services {
+			for _, q := range svc.queuesMatching(*queueName) {
+				a := q.attributes()
+				t.addIn(svc, q.name,
+					intAttribute(a, "ApproximateNumberOfMessages"),
+					intAttribute(a, "ApproximateNumberOfMessagesNotVisible"),
+					intAttribute(a, "ApproximateNumberOfMessagesDelayed"),
+					aws.StringValue(a["FifoQueue"]) == "true",
+					intAttribute(a, "VisibilityTimeout"),
+					intAttribute(a, "MessageRetentionPeriod"),
+					encryptionMode(a),
+					intAttribute(a, "DelaySeconds"),
+					intAttribute(a, "MaximumMessageSize"),
+					intAttribute(a, "KmsDataKeyReusePeriodSeconds"),
+					aws.StringValue(a["RedrivePolicy"]),
+					aws.StringValue(a["QueueArn"]))
+			}
+		}
+		t.render(os.Stdout, outputFormat)
+		return
+	}
+
+	first := true
+	for _, svc := range services {
+		for _, q := range svc.queuesMatching(*queueName) {
+			if !first {
+				fmt.Println()
+			}
+			first = false
+			attrs := q.attributes()
+			fmt.Println(paint(colorBold, "== "+svc.queueLabel(q.url)))
+			for _, a := range statsAttributes {
+				if v, ok := attrs[a.name]; ok {
+					value := aws.StringValue(v)
+					if a.human != nil {
+						value = a.human(intAttribute(attrs, a.name))
+					}
+					fmt.Printf("%-24s %s\n", a.label, value)
+				}
+			}
+			fmt.Printf("%-24s %s\n", "Encryption", encryptionMode(attrs))
+		}
+	}
+}
+
+// count prints the number of available messages of queues
+func count(args []string) {
+	countCommand := flag.NewFlagSet("count", flag.ExitOnError)
+	queueName := countCommand.String("queue", "", "queue name or pattern")
+	countCommand.StringVar(queueName, "q", "", "queue name or pattern") // Aliasing
+	regions := countCommand.String("regions", "", "comma separated regions to report across")
+	max := countCommand.Int("max", -1, "exit with 1 when a queue holds more messages")
+	countHelp := countCommand.Bool("help", false, "help for count command")
+	countCommand.BoolVar(countHelp, "h", false, "help") // Aliasing
+	parseFlags(countCommand, args)
+
+	if *countHelp {
+		queueCommandUsage("count")
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		queueCommandUsage("count")
+	}
+
+	// Connect
+	services := regionServices(*regions)
+
+	// Depth checks fail when a queue is over -max
+	over := false
+	defer func() {
+		if over {
+			os.Exit(1)
+		}
+	}()
+	if len(outputFormat) > 0 {
+		t := regionalTable(&table{columns: []column{{key: "queue", title: "QUEUE"}, {key: "messages", title: "MESSAGES"}}}, services)
+		for _, svc := range services {
+			for _, qURL := range svc.resolveQueues(*queueName) {
+				n := svc.messageCount(qURL)
+				over = over || (*max >= 0 && n > *max)
+				t.addIn(svc, queueNameFromURL(qURL), n)
+			}
+		}
+		t.render(os.Stdout, outputFormat)
+		return
+	}
+	for _, svc := range services {
+		qURLs := svc.resolveQueues(*queueName)
+		for _, qURL := range qURLs {
+			n := svc.messageCount(qURL)
+			over = over || (*max >= 0 && n > *max)
+			if len(qURLs) == 1 && len(services) == 1 {
+				fmt.Println(n)
+				break
+			}
+			fmt.Printf("%s %d\n", svc.queueLabel(qURL), n)
+		}
+	}
+}
+
+// list prints the queues matching a pattern, every queue by default
+func list(args []string) {
+	listCommand := flag.NewFlagSet("list", flag.ExitOnError)
+	queueName := listCommand.String("queue", "*", "queue name or pattern")
+	listCommand.StringVar(queueName, "q", "*", "queue name or pattern") // Aliasing
+	regions := listCommand.String("regions", "", "comma separated regions to report across")
+	listHelp := listCommand.Bool("help", false, "help for list command")
+	listCommand.BoolVar(listHelp, "h", false, "help") // Aliasing
+	parseFlags(listCommand, args)
+
+	if *listHelp {
+		listUsage()
+	}
+
+	// Connect
+	services := regionServices(*regions)
+
+	format := outputFormat
+	if len(format) == 0 {
+		format = formatTable
+	}
+	t := regionalTable(&table{columns: []column{
+		{key: "queue", title: "QUEUE"},
+		{key: "url", title: "URL", wide: true},
+		{key: "type", title: "TYPE", wide: true},
+		{key: "messages", title: "MESSAGES", wide: true},
+	}}, services)
+	for _, svc := range services {
+		var qURLs []string
+		if *queueName == "*" {
+			qURLs = svc.listQueues("") // An empty account is not an error here
+		} else {
+			qURLs = svc.resolveQueues(*queueName)
+		}
+		for _, qURL := range qURLs {
+			name := queueNameFromURL(qURL)
+			queueType := "standard"
+			if strings.HasSuffix(name, ".fifo") {
+				queueType = "fifo"
+			}
+			// Counting costs a call per queue, only done when the column is shown
+			messages := 0
+			if format != formatTable {
+				messages = svc.messageCount(qURL)
+			}
+			t.addIn(svc, name, qURL, queueType, messages)
+		}
+	}
+	t.render(os.Stdout, format)
+}
+
+// watch prints the depth of queues at a regular interval until interrupted
+func watch(args []string) {
+	watchCommand := flag.NewFlagSet("watch", flag.ExitOnError)
+	queueName := watchCommand.String("queue", "", "queue name or pattern")
+	watchCommand.StringVar(queueName, "q", "", "queue name or pattern") // Aliasing
+	interval := watchCommand.Duration("interval", 5*time.Second, "refresh interval")
+	regions := watchCommand.String("regions", "", "comma separated regions to report across")
+	var alerts alertFlag
+	watchCommand.Var(&alerts, "alert", "alert sink: sns:TOPIC_ARN, slack:WEBHOOK_URL, pagerduty:ROUTING_KEY or a webhook URL, repeatable")
+	maxDepth := watchCommand.Int("max-depth", -1, "alert when a queue holds more available messages")
+	maxAge := watchCommand.Duration("max-age", 0, "alert when the oldest message of a queue is older")
+	dlqArrivals := watchCommand.Int("dlq-arrivals", 0, "alert when this many messages reach the DLQ of a queue between two checks")
+	watchHelp := watchCommand.Bool("help", false, "help for watch command")
+	watchCommand.BoolVar(watchHelp, "h", false, "help") // Aliasing
+	parseFlags(watchCommand, args)
+
+	if *watchHelp {
+		queueCommandUsage("watch")
+	}
+
+	// Verify
+	if len(*queueName) == 0 {
+		fmt.Println("Required queue name is missing.")
+		queueCommandUsage("watch")
+	}
+	if *dlqArrivals < 0 {
+		log.Fatal("DLQ arrivals must be positive")
+	}
+	thresholds := watchThresholds{maxDepth: *maxDepth, maxAge: *maxAge, dlqArrivals: *dlqArrivals}
+
+	// Connect
+	services := regionServices(*regions)
+	handleInterrupts()
+	sinks, err := alerts.sinks(services[0].sess)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alerter := newWatchAlerter(thresholds, sinks)
+	if alerter == nil && len(sinks) > 0 {
+		log.Fatal("Alerts need a threshold: -max-depth, -max-age or -dlq-arrivals")
+	}
+
+	qURLs := make([][]string, len(services))
+	for i, svc := range services {
+		qURLs[i] = svc.resolveQueues(*queueName)
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now().Format("15:04:05")
+		for i, svc := range services {
+			for _, qURL := range qURLs[i] {
+				attr := svc.getQueueAttributes(qURL)
+				fmt.Printf("%s %s available=%s in-flight=%s delayed=%s\n", now, svc.queueLabel(qURL),
+					aws.StringValue(attr.Attributes["ApproximateNumberOfMessages"]),
+					aws.StringValue(attr.Attributes["ApproximateNumberOfMessagesNotVisible"]),
+					aws.StringValue(attr.Attributes["ApproximateNumberOfMessagesDelayed"]))
+				if alerter != nil {
+					alerter.check(svc, qURL, attr.Attributes)
+				}
+			}
+		}
+		select {
+		case <-interrupted:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// statsTable returns the empty table of stats
+func statsTable() *table {
+	return &table{columns: []column{
+		{key: "queue", title: "QUEUE"},
+		{key: "available", title: "AVAILABLE"},
+		{key: "inFlight", title: "IN FLIGHT"},
+		{key: "delayed", title: "DELAYED"},
+		{key: "fifo", title: "FIFO"},
+		{key: "visibilityTimeout", title: "VISIBILITY", human: humanSeconds},
+		{key: "retentionPeriod", title: "RETENTION", human: humanSeconds},
+		{key: "encryption", title: "ENCRYPTION"},
+		{key: "delaySeconds", title: "DELAY", wide: true, human: humanSeconds},
+		{key: "maximumMessageSize", title: "MAX SIZE", wide: true, human: humanSize},
+		{key: "kmsDataKeyReuse", title: "KMS REUSE", wide: true, human: humanSeconds},
+		{key: "redrivePolicy", title: "REDRIVE POLICY", wide: true},
+		{key: "arn", title: "ARN", wide: true},
+	}}
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// messageCount returns the approximate number of available messages of a queue
+func (s *service) messageCount(queue string) int {
+	attr := s.getQueueAttributes(queue)
+	n, err := strconv.Atoi(aws.StringValue(attr.Attributes["ApproximateNumberOfMessages"]))
+	if err != nil {
+		log.Fatal("Error reading message count ", err)
+	}
+	return n
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func listUsage() {
+	fmt.Println("usage: sqscli list [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue     Queue name pattern (default *)")
+	fmt.Println("  -regions   Comma separated regions to list, e.g. us-east-1,eu-west-1")
+	fmt.Println("Use -o wide, json or yaml for the URL, type and message count of each queue.")
+	os.Exit(0)
+}
+
+// queueCommandUsage prints the usage of the commands only taking queues
+func queueCommandUsage(command string) {
+	fmt.Printf("usage: sqscli %s [options]\n", command)
+	fmt.Println("options:")
+	fmt.Println("  -queue required   Queue name, wildcards match several queues")
+	fmt.Println("  -regions          Comma separated regions to report across, e.g. us-east-1,eu-west-1")
+	if command == "watch" {
+		fmt.Println("  -interval         Refresh interval (default 5s)")
+		fmt.Println("  -max-depth        Alert when a queue holds more available messages")
+		fmt.Println("  -max-age          Alert when the oldest message of a queue is older, e.g. 30m")
+		fmt.Println("  -dlq-arrivals     Alert when this many messages reach the DLQ of a queue between two checks")
+		fmt.Println("  -alert            Alert sink, repeatable: sns:TOPIC_ARN, slack:WEBHOOK_URL, pagerduty:ROUTING_KEY or a webhook URL")
+	}
+	if command == "count" {
+		fmt.Println("  -max              Exit with 1 when a queue holds more messages, for depth checks")
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	// spanBatchSize spans are exported at once, or every spanExportInterval
+	spanBatchSize      = 512
+	spanExportInterval = 5 * time.Second
+	// metricExportInterval is the default of OTEL_METRIC_EXPORT_INTERVAL
+	metricExportInterval = time.Minute
+	// OTLP enums
+	spanKindInternal = 1
+	spanKindClient   = 3
+	statusOK         = 1
+	statusError      = 2
+	cumulative       = 2
+)
+
+// callDurationBounds are the buckets of the AWS call duration histogram, in milliseconds
+var callDurationBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// otlpEndpoint is the OTLP/HTTP collector receiving spans and metrics, set by -otlp
+// OTEL_EXPORTER_OTLP_ENDPOINT by default, telemetry is off without one
+var otlpEndpoint string
+
+// telemetry exports the spans and metrics of the run, nil when off
+var telemetry *otlpExporter
+
+// otlpExporter batches spans and aggregates metrics, exported as OTLP JSON over HTTP
+type otlpExporter struct {
+	tracesURL  string
+	metricsURL string
+	headers    map[string]string
+	resource   map[string]interface{}
+	client     *http.Client
+	traceID    string
+	root       *otlpSpan // Span of the command, parent of the calls
+	mu         sync.Mutex
+	spans      []*otlpSpan
+	calls      map[callKey]*callStats
+	started    time.Time
+	warned     int32 // Export failures are logged once
+	once       sync.Once
+}
+
+// otlpSpan is a span in the OTLP JSON encoding
+type otlpSpan struct {
+	TraceID      string                   `json:"traceId"`
+	SpanID       string                   `json:"spanId"`
+	ParentSpanID string                   `json:"parentSpanId,omitempty"`
+	Name         string                   `json:"name"`
+	Kind         int                      `json:"kind"`
+	Start        string                   `json:"startTimeUnixNano"`
+	End          string                   `json:"endTimeUnixNano"`
+	Attributes   []map[string]interface{} `json:"attributes"`
+	Status       map[string]interface{}   `json:"status"`
+}
+
+// callKey groups the AWS call metrics
+type callKey struct {
+	service, method, errorCode string
+}
+
+// callStats aggregates the AWS calls of a key
+type callStats struct {
+	count   int64
+	sum     float64 // Milliseconds
+	buckets []int64
+}
+
+// - - - - - - - - - - - - - - - -
+//   TELEMETRY
+// - - - - - - - - - - - - - - - -
+
+// startTelemetry starts the span of the command and the periodic exports, if an endpoint is set
+// the standard OTEL_ variables configure the export: OTEL_EXPORTER_OTLP_TRACES_ENDPOINT,
+// OTEL_EXPORTER_OTLP_METRICS_ENDPOINT, OTEL_EXPORTER_OTLP_HEADERS, OTEL_SERVICE_NAME,
+// OTEL_RESOURCE_ATTRIBUTES, OTEL_METRIC_EXPORT_INTERVAL and OTEL_SDK_DISABLED
+func startTelemetry(command string) {
+	if len(otlpEndpoint) == 0 || strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return
+	}
+	if p := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); len(p) > 0 && p != "http/json" {
+		log.Fatalf("OTEL_EXPORTER_OTLP_PROTOCOL %s is not supported, sqscli exports http/json\n", p)
+	}
+	base, err := parseEndpoint(otlpEndpoint)
+	if err != nil {
+		log.Fatal("Invalid -otlp ", err)
+	}
+	client, err := newHTTPClient()
+	if err != nil {
+		log.Fatal("Error configuring HTTP client ", err)
+	}
+	client.Timeout = 10 * time.Second
+	e := &otlpExporter{
+		tracesURL:  otelEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", strings.TrimSuffix(base.String(), "/")+"/v1/traces"),
+		metricsURL: otelEnv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", strings.TrimSuffix(base.String(), "/")+"/v1/metrics"),
+		headers:    parseOTelList(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		client:     client,
+		traceID:    newTraceID(),
+		calls:      make(map[callKey]*callStats),
+		started:    time.Now(),
+	}
+	attrs := map[string]interface{}{"service.name": otelEnv("OTEL_SERVICE_NAME", "sqscli")}
+	for k, v := range parseOTelList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")) {
+		if k != "service.name" || len(os.Getenv("OTEL_SERVICE_NAME")) == 0 {
+			attrs[k] = v
+		}
+	}
+	e.resource = map[string]interface{}{"attributes": otlpAttributes(attrs)}
+	e.root = &otlpSpan{
+		TraceID: e.traceID,
+		SpanID:  randomHex(8),
+		Name:    "sqscli " + command,
+		Kind:    spanKindInternal,
+		Start:   unixNano(e.started),
+	}
+	e.root.Attributes = otlpAttributes(map[string]interface{}{"sqscli.command": command, "cloud.region": awsRegion})
+
+	interval := metricExportInterval
+	if ms, err := strconv.Atoi(os.Getenv("OTEL_METRIC_EXPORT_INTERVAL")); err == nil && ms > 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	go func() {
+		spanTicker, metricTicker := time.NewTicker(spanExportInterval), time.NewTicker(interval)
+		for {
+			select {
+			case <-spanTicker.C:
+				e.exportSpans()
+			case <-metricTicker.C:
+				e.exportMetrics()
+			}
+		}
+	}()
+	telemetry = e
+}
+
+// traceCalls records a span and metrics for every AWS call of the session
+func traceCalls(sess *session.Session) {
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		if telemetry != nil {
+			telemetry.recordCall(r)
+		}
+	})
+}
+
+// endTelemetry ends the span of the command and exports what is left
+// only the first call does anything, exit paths call it through finishReport
+func endTelemetry() {
+	e := telemetry
+	if e == nil {
+		return
+	}
+	e.once.Do(func() {
+		counts := map[string]interface{}{
+			"sqscli.messages.received": atomic.LoadInt64(&tally.received),
+			"sqscli.messages.written":  atomic.LoadInt64(&tally.written),
+			"sqscli.messages.sent":     atomic.LoadInt64(&tally.sent),
+			"sqscli.messages.deleted":  atomic.LoadInt64(&tally.deleted),
+			"sqscli.messages.failed":   atomic.LoadInt64(&tally.failed),
+			"sqscli.interrupted":       isInterrupted(),
+		}
+		if report != nil {
+			counts["messaging.destination.name"] = strings.Join(report.Queues, ",")
+		}
+		e.root.Attributes = append(e.root.Attributes, otlpAttributes(counts)...)
+		e.root.End = unixNano(time.Now())
+		e.root.Status = map[string]interface{}{"code": statusOK}
+		if atomic.LoadInt64(&tally.failed) > 0 || isInterrupted() {
+			e.root.Status = map[string]interface{}{"code": statusError, "message": "incomplete run"}
+		}
+		e.mu.Lock()
+		e.spans = append(e.spans, e.root)
+		e.mu.Unlock()
+		e.exportSpans()
+		e.exportMetrics()
+	})
+}
+
+// recordCall adds the span of an AWS call and counts it
+func (e *otlpExporter) recordCall(r *request.Request) {
+	end := time.Now()
+	service, method := r.ClientInfo.ServiceID, r.Operation.Name
+	attrs := map[string]interface{}{
+		"rpc.system":      "aws-api",
+		"rpc.service":     service,
+		"rpc.method":      method,
+		"cloud.region":    aws.StringValue(r.Config.Region),
+		"aws.request_id":  r.RequestID,
+		"aws.retry_count": r.RetryCount,
+	}
+	if r.HTTPResponse != nil {
+		attrs["http.status_code"] = r.HTTPResponse.StatusCode
+	}
+	if v, _ := awsutil.ValuesAtPath(r.Params, "QueueUrl"); len(v) > 0 {
+		if qURL, ok := v[0].(*string); ok {
+			attrs["messaging.destination.name"] = queueNameFromURL(aws.StringValue(qURL))
+		}
+	} else if v, _ := awsutil.ValuesAtPath(r.Params, "QueueName"); len(v) > 0 {
+		if name, ok := v[0].(*string); ok {
+			attrs["messaging.destination.name"] = aws.StringValue(name)
+		}
+	}
+	if v, _ := awsutil.ValuesAtPath(r.Params, "Entries[]"); len(v) > 0 {
+		attrs["messaging.batch.message_count"] = len(v)
+	} else if v, _ := awsutil.ValuesAtPath(r.Data, "Messages[]"); len(v) > 0 {
+		attrs["messaging.batch.message_count"] = len(v)
+	}
+	span := &otlpSpan{
+		TraceID:      e.traceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: e.root.SpanID,
+		Name:         service + "." + method,
+		Kind:         spanKindClient,
+		Start:        unixNano(r.Time),
+		End:          unixNano(end),
+		Attributes:   otlpAttributes(attrs),
+		Status:       map[string]interface{}{"code": statusOK},
+	}
+	key := callKey{service: service, method: method}
+	if r.Error != nil {
+		key.errorCode = r.Error.Error()
+		if aerr, ok := r.Error.(awserr.Error); ok {
+			key.errorCode = aerr.Code()
+		}
+		span.Status = map[string]interface{}{"code": statusError, "message": r.Error.Error()}
+	}
+
+	ms := float64(end.Sub(r.Time)) / float64(time.Millisecond)
+	e.mu.Lock()
+	stats, ok := e.calls[key]
+	if !ok {
+		stats = &callStats{buckets: make([]int64, len(callDurationBounds)+1)}
+		e.calls[key] = stats
+	}
+	stats.count++
+	stats.sum += ms
+	stats.buckets[sort.SearchFloat64s(callDurationBounds, ms)]++
+	e.spans = append(e.spans, span)
+	full := len(e.spans) >= spanBatchSize
+	e.mu.Unlock()
+	if full {
+		go e.exportSpans()
+	}
+}
+
+// exportSpans posts the spans recorded since the last export
+func (e *otlpExporter) exportSpans() {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	e.post(e.tracesURL, map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   e.resource,
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "sqscli"}, "spans": spans}},
+		}},
+	})
+}
+
+// exportMetrics posts the cumulative counters of the run:
+// sqscli.messages by outcome, sqscli.aws.calls and sqscli.aws.call.duration by service, method and error,
+// and the sqscli.mirror.lag and sqscli.canary.latency gauges of a mirror and a canary
+func (e *otlpExporter) exportMetrics() {
+	now, start := unixNano(time.Now()), unixNano(e.started)
+	point := func(attrs map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"attributes": otlpAttributes(attrs), "startTimeUnixNano": start, "timeUnixNano": now}
+	}
+	var messages []interface{}
+	for outcome, n := range map[string]*int64{
+		"received": &tally.received, "written": &tally.written, "sent": &tally.sent,
+		"deleted": &tally.deleted, "failed": &tally.failed, "duplicate": &tally.duplicates,
+	} {
+		p := point(map[string]interface{}{"outcome": outcome})
+		p["asInt"] = strconv.FormatInt(atomic.LoadInt64(n), 10)
+		messages = append(messages, p)
+	}
+	var calls, durations []interface{}
+	e.mu.Lock()
+	for key, stats := range e.calls {
+		attrs := map[string]interface{}{"rpc.service": key.service, "rpc.method": key.method}
+		if len(key.errorCode) > 0 {
+			attrs["error.type"] = key.errorCode
+		}
+		p := point(attrs)
+		p["asInt"] = strconv.FormatInt(stats.count, 10)
+		calls = append(calls, p)
+		d := point(attrs)
+		buckets := make([]string, len(stats.buckets))
+		for i, n := range stats.buckets {
+			buckets[i] = strconv.FormatInt(n, 10)
+		}
+		d["count"], d["sum"], d["bucketCounts"], d["explicitBounds"] = strconv.FormatInt(stats.count, 10), stats.sum, buckets, callDurationBounds
+		durations = append(durations, d)
+	}
+	e.mu.Unlock()
+
+	sum := func(points []interface{}) map[string]interface{} {
+		return map[string]interface{}{"aggregationTemporality": cumulative, "isMonotonic": true, "dataPoints": points}
+	}
+	metrics := []interface{}{
+		map[string]interface{}{"name": "sqscli.messages", "unit": "{message}", "sum": sum(messages)},
+		map[string]interface{}{"name": "sqscli.aws.retries", "unit": "{call}", "sum": sum([]interface{}{
+			mergeMaps(point(nil), map[string]interface{}{"asInt": strconv.FormatInt(atomic.LoadInt64(&tally.retried), 10)}),
+		})},
+	}
+	if mirroring != nil {
+		metrics = append(metrics, map[string]interface{}{"name": "sqscli.mirror.lag", "unit": "s", "gauge": map[string]interface{}{
+			"dataPoints": []interface{}{mergeMaps(point(nil), map[string]interface{}{"asDouble": mirroring.lag().Seconds()})},
+		}})
+	}
+	if canarying != nil {
+		metrics = append(metrics, map[string]interface{}{"name": "sqscli.canary.latency", "unit": "ms", "gauge": map[string]interface{}{
+			"dataPoints": []interface{}{mergeMaps(point(nil), map[string]interface{}{"asDouble": canarying.latency()})},
+		}})
+	}
+	if len(calls) > 0 {
+		metrics = append(metrics,
+			map[string]interface{}{"name": "sqscli.aws.calls", "unit": "{call}", "sum": sum(calls)},
+			map[string]interface{}{"name": "sqscli.aws.call.duration", "unit": "ms", "histogram": map[string]interface{}{
+				"aggregationTemporality": cumulative, "dataPoints": durations,
+			}})
+	}
+	e.post(e.metricsURL, map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource":     e.resource,
+			"scopeMetrics": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "sqscli"}, "metrics": metrics}},
+		}},
+	})
+}
+
+// post sends an OTLP JSON payload, failures are logged once and don't fail the run
+func (e *otlpExporter) post(url string, payload interface{}) {
+	b, _ := json.Marshal(payload)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range e.headers {
+			req.Header.Set(k, v)
+		}
+		var resp *http.Response
+		if resp, err = e.client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("%s", resp.Status)
+			}
+		}
+	}
+	if err != nil && atomic.CompareAndSwapInt32(&e.warned, 0, 1) {
+		log.Printf("Warning: exporting telemetry to %s failed: %s\n", url, err)
+	}
+}
+
+// otlpAttributes converts attributes to OTLP key values
+func otlpAttributes(attrs map[string]interface{}) []map[string]interface{} {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		var value map[string]interface{}
+		switch v := attrs[k].(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, map[string]interface{}{"key": k, "value": value})
+	}
+	return kvs
+}
+
+// parseOTelList parses the key=value,key=value lists of OTEL_ variables, values URL encoded
+func parseOTelList(raw string) map[string]string {
+	list := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		i := strings.Index(pair, "=")
+		if i < 1 {
+			continue
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			value = strings.TrimSpace(pair[i+1:])
+		}
+		list[strings.TrimSpace(pair[:i])] = value
+	}
+	return list
+}
+
+// otelEnv returns an OTEL_ variable, or a default
+func otelEnv(name, def string) string {
+	if v := os.Getenv(name); len(v) > 0 {
+		return v
+	}
+	return def
+}
+
+// mergeMaps adds the entries of b to a
+func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
+	for k, v := range b {
+		a[k] = v
+	}
+	return a
+}
+
+// randomHex returns n random bytes in hexadecimal, trace and span IDs
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// unixNano formats a time the way OTLP JSON encodes 64 bits integers
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Time formats of the -time-format flag
+const (
+	timeRFC3339  = "rfc3339"
+	timeEpoch    = "epoch"
+	timeRelative = "relative"
+)
+
+var (
+	// timeFormat is set by -time-format, empty keeps the format of each output:
+	// epoch milliseconds in exports, RFC3339 elsewhere
+	timeFormat string
+	// timeZone is the -timezone times are printed in, UTC by default
+	timeZone = time.UTC
+)
+
+// - - - - - - - - - - - - - - - -
+//   RENDERING
+// - - - - - - - - - - - - - - - -
+
+// parseTimeFlags checks -time-format and loads the -timezone location
+func parseTimeFlags(format, zone string) error {
+	switch format {
+	case "", timeRFC3339, timeEpoch, timeRelative:
+	default:
+		return fmt.Errorf("time format must be rfc3339, epoch or relative")
+	}
+	timeFormat = format
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %q", zone)
+	}
+	timeZone = loc
+	return nil
+}
+
+// formatTime prints a time in the -time-format, or in fallback when none is set
+func formatTime(t time.Time, fallback string) string {
+	format := timeFormat
+	if len(format) == 0 {
+		format = fallback
+	}
+	switch format {
+	case timeEpoch:
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	case timeRelative:
+		return humanAgo(t)
+	}
+	return t.In(timeZone).Format(time.RFC3339)
+}
+
+// formattedAttributes returns system attributes with their timestamps in the -time-format,
+// the attributes themselves when no format is set
+func formattedAttributes(attrs map[string]*string) map[string]*string {
+	if len(timeFormat) == 0 || timeFormat == timeEpoch {
+		return attrs
+	}
+	formatted := make(map[string]*string, len(attrs))
+	for name, value := range attrs {
+		formatted[name] = value
+	}
+	for _, name := range []string{sqs.MessageSystemAttributeNameSentTimestamp, sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp} {
+		if raw, ok := attrs[name]; ok {
+			formatted[name] = aws.String(formatMillis(aws.StringValue(raw), timeRFC3339))
+		}
+	}
+	return formatted
+}
+
+// formatMillis prints a timestamp attribute, epoch milliseconds like SentTimestamp,
+// values that are not timestamps are printed as is
+func formatMillis(raw string, fallback string) string {
+	ms, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return raw
+	}
+	return formatTime(time.Unix(0, ms*int64(time.Millisecond)), fallback)
+}
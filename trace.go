@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Trace header formats injected by -trace
+const (
+	traceXRay = "xray"
+	traceW3C  = "w3c"
+	// traceParentAttribute is the message attribute of W3C trace contexts
+	traceParentAttribute = "traceparent"
+)
+
+// traceContext is the trace header stamped on the messages of a run,
+// the messages being children of the run, the span of sqscli with -otlp
+type traceContext struct {
+	kind   string
+	header string
+}
+
+// - - - - - - - - - - - - - - - -
+//   TRACING
+// - - - - - - - - - - - - - - - -
+
+// newTraceContext returns the trace context of a -trace value, nil without one
+// with -otlp the messages join the trace of the run, a new trace is started otherwise
+func newTraceContext(kind string) (*traceContext, error) {
+	if len(kind) == 0 {
+		return nil, nil
+	}
+	traceID, spanID := newTraceID(), randomHex(8)
+	if telemetry != nil {
+		traceID, spanID = telemetry.traceID, telemetry.root.SpanID
+	}
+	switch kind {
+	case traceXRay:
+		return &traceContext{kind: kind, header: fmt.Sprintf("Root=1-%s-%s;Parent=%s;Sampled=1", traceID[:8], traceID[8:], spanID)}, nil
+	case traceW3C:
+		return &traceContext{kind: kind, header: fmt.Sprintf("00-%s-%s-01", traceID, spanID)}, nil
+	}
+	return nil, fmt.Errorf("trace %q: expected xray or w3c", kind)
+}
+
+// newTraceID returns a W3C trace ID starting with the current epoch seconds,
+// so it is a valid X-Ray trace ID as well
+func newTraceID() string {
+	return fmt.Sprintf("%08x", time.Now().Unix()) + randomHex(12)
+}
+
+// inject stamps a batch entry with the trace header: the AWSTraceHeader system attribute
+// for X-Ray, the traceparent message attribute for W3C, added to a copy of the attributes
+// as they may be shared between entries
+func (t *traceContext) inject(entry *sqs.SendMessageBatchRequestEntry) {
+	if t == nil {
+		return
+	}
+	if t.kind == traceXRay {
+		entry.MessageSystemAttributes = map[string]*sqs.MessageSystemAttributeValue{
+			sqs.MessageSystemAttributeNameForSendsAwstraceHeader: {DataType: aws.String("String"), StringValue: aws.String(t.header)},
+		}
+		return
+	}
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(entry.MessageAttributes)+1)
+	for name, value := range entry.MessageAttributes {
+		attrs[name] = value
+	}
+	attrs[traceParentAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(t.header)}
+	entry.MessageAttributes = attrs
+}
+
+// traceHeader returns the trace header of a received message, X-Ray or W3C, empty without one
+func traceHeader(m *sqs.Message) string {
+	if h := aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameAwstraceHeader]); len(h) > 0 {
+		return h
+	}
+	if attr, ok := m.MessageAttributes[traceParentAttribute]; ok {
+		return aws.StringValue(attr.StringValue)
+	}
+	return ""
+}
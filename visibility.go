@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// maxVisibilityTimeout is the longest visibility timeout SQS accepts (12 hours)
+const maxVisibilityTimeout = 43200
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// changeVisibility sets the visibility timeout of in-flight messages
+// a timeout of 0 releases them immediately
+func changeVisibility(args []string) {
+	visibilityCommand := flag.NewFlagSet("change-visibility", flag.ExitOnError)
+	queueName := visibilityCommand.String("queue", "", "queue name")
+	visibilityCommand.StringVar(queueName, "q", "", "queue name") // Aliasing
+	receipts := visibilityCommand.String("receipts", "", "file with one receipt handle per line")
+	timeout := visibilityCommand.Int64("timeout", 0, "visibility timeout in seconds (0 releases)")
+	visibilityHelp := visibilityCommand.Bool("help", false, "help for change-visibility command")
+	visibilityCommand.BoolVar(visibilityHelp, "h", false, "help") // Aliasing
+	parseFlags(visibilityCommand, args)
+
+	if *visibilityHelp {
+		changeVisibilityUsage()
+	}
+
+	// Verify
+	if len(*queueName) == 0 || len(*receipts) == 0 {
+		fmt.Println("Required argument is missing.")
+		changeVisibilityUsage()
+	}
+	if *timeout < 0 || *timeout > maxVisibilityTimeout {
+		log.Fatal("Timeout must be between 0 and 43200 seconds")
+	}
+
+	handles, err := readReceiptHandles(*receipts)
+	if err != nil {
+		log.Fatal("Error reading receipt handles ", err)
+	}
+
+	// Connect
+	svc := newService()
+	qURL := svc.getQueueURL(*queueName)
+
+	errs := svc.changeVisibilityBatch(qURL, handles, *timeout)
+	for _, err := range errs {
+		log.Println(err)
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d messages updated\n", len(handles)-len(errs), len(handles))
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// readReceiptHandles reads one receipt handle per line, blank lines are skipped
+func readReceiptHandles(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var handles []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 {
+			handles = append(handles, line)
+		}
+	}
+	return handles, scanner.Err()
+}
+
+// - - - - - - - - - - - - - - - -
+//   MANIPULATING QUEUES
+// - - - - - - - - - - - - - - - -
+
+// changeVisibilityBatch changes the visibility timeout of messages by batches of 10
+// returns one error per message that could not be updated
+func (s *service) changeVisibilityBatch(queue string, handles []string, timeout int64) []error {
+	var errors []error
+
+	for i := 0; i < len(handles); i += 10 {
+		j := i + 10
+		if j > len(handles) {
+			j = len(handles)
+		}
+		var entries []*sqs.ChangeMessageVisibilityBatchRequestEntry
+		for n, h := range handles[i:j] {
+			entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i + n)),
+				ReceiptHandle:     aws.String(h),
+				VisibilityTimeout: aws.Int64(timeout),
+			})
+		}
+
+		sent := time.Now()
+		result, err := s.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+			Entries:  entries,
+			QueueUrl: aws.String(queue),
+		})
+		if err != nil {
+			for range entries {
+				errors = append(errors, err)
+			}
+			continue
+		}
+		for _, e := range result.Successful {
+			if n, err := strconv.Atoi(aws.StringValue(e.Id)); err == nil {
+				trackReceipt(handles[n], sent, timeout)
+			}
+		}
+		for _, f := range result.Failed {
+			// Expired receipt handles end up here
+			errors = append(errors, fmt.Errorf("message %s: %s", *f.Id, aws.StringValue(f.Message)))
+		}
+	}
+	return errors
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func changeVisibilityUsage() {
+	fmt.Println("usage: sqscli change-visibility [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue required      Queue name")
+	fmt.Println("  -receipts required   File with one receipt handle per line")
+	fmt.Println("  -timeout             Visibility timeout in seconds, 0 releases the messages (default 0)")
+	os.Exit(0)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// capability is the outcome of probing a single IAM permission
+type capability struct {
+	action string
+	status string // ok, denied, skipped or error
+	detail string
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS
+// - - - - - - - - - - - - - - - -
+
+// whoami prints the identity behind the credentials and probes the SQS permissions
+// exits with 1 if a permission is missing
+func whoami(args []string) {
+	whoamiCommand := flag.NewFlagSet("whoami", flag.ExitOnError)
+	queueName := whoamiCommand.String("queue", "", "queue name to probe")
+	whoamiCommand.StringVar(queueName, "q", "", "queue name to probe") // Aliasing
+	whoamiHelp := whoamiCommand.Bool("help", false, "help for whoami command")
+	whoamiCommand.BoolVar(whoamiHelp, "h", false, "help") // Aliasing
+	parseFlags(whoamiCommand, args)
+
+	if *whoamiHelp {
+		whoamiUsage()
+	}
+
+	// Connect
+	svc := newService()
+
+	identity, err := stsClient(svc.sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Fatal("Error identifying credentials, they are invalid or expired ", err)
+	}
+	fmt.Printf("%-10s %s\n", "Account", aws.StringValue(identity.Account))
+	fmt.Printf("%-10s %s\n", "ARN", aws.StringValue(identity.Arn))
+	fmt.Printf("%-10s %s\n", "User ID", aws.StringValue(identity.UserId))
+	fmt.Printf("%-10s %s\n", "Region", aws.StringValue(svc.sess.Config.Region))
+	fmt.Printf("%-10s %s\n", "Partition", svc.partition())
+
+	fmt.Println()
+	missing := 0
+	for _, c := range svc.probeCapabilities(*queueName) {
+		line := fmt.Sprintf("%-24s %s", c.action, c.status)
+		if len(c.detail) > 0 {
+			line += " (" + c.detail + ")"
+		}
+		fmt.Println(line)
+		if c.status != "ok" {
+			missing++
+		}
+	}
+	if missing > 0 {
+		os.Exit(1)
+	}
+}
+
+// - - - - - - - - - - - - - - - -
+//   COMMANDS HELPERS
+// - - - - - - - - - - - - - - - -
+
+// probeCapabilities calls read-only SQS actions to find missing permissions
+// queue level actions are only probed when a queue is given
+func (s *service) probeCapabilities(queue string) []capability {
+	_, err := s.ListQueues(&sqs.ListQueuesInput{MaxResults: aws.Int64(1)})
+	caps := []capability{probeResult("sqs:ListQueues", err)}
+	if len(queue) == 0 {
+		return caps
+	}
+
+	result, err := s.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+	caps = append(caps, probeResult("sqs:GetQueueUrl", err))
+	if err != nil {
+		return append(caps, capability{action: "sqs:GetQueueAttributes", status: "skipped", detail: "no queue URL"})
+	}
+	_, err = s.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       result.QueueUrl,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+	})
+	return append(caps, probeResult("sqs:GetQueueAttributes", err))
+}
+
+// probeResult turns the error of a probe into a capability
+func probeResult(action string, err error) capability {
+	if err == nil {
+		return capability{action: action, status: "ok"}
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		if strings.Contains(aerr.Code(), "AccessDenied") {
+			return capability{action: action, status: "denied", detail: "missing IAM permission"}
+		}
+		return capability{action: action, status: "error", detail: aerr.Code() + ": " + aerr.Message()}
+	}
+	return capability{action: action, status: "error", detail: err.Error()}
+}
+
+// - - - - - - - - - - - - - - - -
+//   USAGE OUTPUT
+// - - - - - - - - - - - - - - - -
+
+func whoamiUsage() {
+	fmt.Println("usage: sqscli whoami [options]")
+	fmt.Println("options:")
+	fmt.Println("  -queue            Queue name whose permissions are probed too")
+	os.Exit(0)
+}